@@ -70,10 +70,19 @@ int mosquitto_auth_unpwd_check(void *userdata, const char *username, const char
     return MOSQ_ERR_AUTH;
   }
 
+  //The client id is only available from version 3 on.
+  const char* clientid = "";
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 3
+    if (mosquitto_client_id(client) != NULL) {
+      clientid = mosquitto_client_id(client);
+    }
+  #endif
+
   GoString go_username = {username, strlen(username)};
   GoString go_password = {password, strlen(password)};
+  GoString go_clientid = {clientid, strlen(clientid)};
 
-  if(AuthUnpwdCheck(go_username, go_password)){
+  if(AuthUnpwdCheck(go_username, go_password, go_clientid)){
     return MOSQ_ERR_SUCCESS;
   }
 
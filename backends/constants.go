@@ -9,3 +9,8 @@ const (
 	MOSQ_ACL_READWRITE = 0x03
 	MOSQ_ACL_SUBSCRIBE = 0x04
 )
+
+//accMatches tells if an acl's stored access grants the requested one. Readwrite grants any, and subscribing is granted by a read or subscribe acl, except on #, which needs a readwrite or exact subscribe acl to prevent subscribing to everything.
+func accMatches(aclAcc, acc int32, topic string) bool {
+	return acc == aclAcc || aclAcc == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (aclAcc == MOSQ_ACL_READ || aclAcc == MOSQ_ACL_SUBSCRIBE))
+}
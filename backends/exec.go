@@ -0,0 +1,265 @@
+package backends
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+type Exec struct {
+	Command        string
+	UserArgs       []string
+	SuperuserArgs  []string
+	AclArgs        []string
+	PasswordFormat string
+
+	Timeout  time.Duration
+	MaxProcs int
+
+	procs chan struct{}
+}
+
+//ExecOptions are the auth options the exec backend takes.
+var ExecOptions = Options{
+	Keys: []string{
+		"exec_acl_args", "exec_command", "exec_max_procs", "exec_password_format", "exec_superuser_args",
+		"exec_timeout_ms", "exec_user_args",
+	},
+}
+
+//execPasswordTerminators are what the password is followed by on the helper's stdin for each exec_password_format.
+var execPasswordTerminators = map[string]string{
+	"line": "\n",
+	"null": "\x00",
+	"raw":  "",
+}
+
+//execStderrLimit is the most of a helper's stderr that's logged.
+const execStderrLimit = 1024
+
+func NewExec(authOpts map[string]string, logLevel log.Level) (Exec, error) {
+
+	log.SetLevel(logLevel)
+
+	authOpts, err := ExecOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return Exec{}, errors.Errorf("Exec backend error: %s.\n", err)
+	}
+
+	var e = Exec{
+		PasswordFormat: "line",
+		Timeout:        time.Second,
+		MaxProcs:       10,
+	}
+
+	if command, ok := authOpts["exec_command"]; ok {
+		e.Command = strings.TrimSpace(command)
+	}
+
+	if e.Command == "" {
+		return e, errors.New("Exec backend error: missing options: exec_command.\n")
+	}
+
+	//The command is checked now rather than failing every check.
+	if _, err := exec.LookPath(e.Command); err != nil {
+		return e, errors.Errorf("Exec backend error: invalid exec_command: %s.\n", err)
+	}
+
+	if userArgs, ok := authOpts["exec_user_args"]; ok {
+		e.UserArgs = strings.Fields(userArgs)
+	}
+
+	if superuserArgs, ok := authOpts["exec_superuser_args"]; ok {
+		e.SuperuserArgs = strings.Fields(superuserArgs)
+	}
+
+	if aclArgs, ok := authOpts["exec_acl_args"]; ok {
+		e.AclArgs = strings.Fields(aclArgs)
+	}
+
+	if e.UserArgs == nil && e.SuperuserArgs == nil && e.AclArgs == nil {
+		return e, errors.New("Exec backend error: missing options: exec_user_args, exec_superuser_args or exec_acl_args.\n")
+	}
+
+	if passwordFormat, ok := authOpts["exec_password_format"]; ok {
+		if _, ok := execPasswordTerminators[passwordFormat]; !ok {
+			return e, errors.Errorf("Exec backend error: invalid exec_password_format %s, it must be line, null or raw.\n", passwordFormat)
+		}
+		e.PasswordFormat = passwordFormat
+	}
+
+	e.Timeout = common.DurationOption(authOpts, "exec_timeout_ms", time.Millisecond, time.Millisecond, e.Timeout)
+
+	e.MaxProcs = common.IntOption(authOpts, "exec_max_procs", 1, math.MaxInt32, e.MaxProcs)
+
+	e.procs = make(chan struct{}, e.MaxProcs)
+
+	return e, nil
+
+}
+
+//execArgs returns the arguments the template gives, with %u, %t, %c and %a replaced by the username, topic, clientid and access, and %% by %.
+//Each argument is split from the template before replacing, so values are passed as they are, within a single argument.
+func execArgs(template []string, username, topic, clientid string, acc int32) []string {
+	replacer := strings.NewReplacer("%%", "%", "%u", username, "%t", topic, "%c", clientid, "%a", strconv.Itoa(int(acc)))
+	args := make([]string, len(template))
+	for i, arg := range template {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
+
+//run runs the command with the arguments, writing stdin to it, and grants the check when it exits with 0.
+//A check, waiting for a free process slot included, never takes longer than exec_timeout_ms: the command is then killed, along with any process it started, and the check denied, telling not to cache the denial.
+func (o Exec) run(check string, args []string, stdin, username string) (bool, time.Duration) {
+	start := time.Now()
+	timer := time.NewTimer(o.Timeout)
+	defer timer.Stop()
+
+	select {
+	case o.procs <- struct{}{}:
+	case <-timer.C:
+		log.Errorf("Exec %s timed out after %s waiting for a free process slot, denying user %s.", check, time.Since(start), common.RedactUsername(username))
+		return false, SkipCache
+	}
+	defer func() {
+		<-o.procs
+	}()
+
+	//Stderr is read from a pipe of our own rather than one the command waits to be drained, as processes the helper left behind could keep it open forever.
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		log.Errorf("Exec %s error: %s", check, err)
+		return false, NoTTL
+	}
+	defer stderr.Close()
+
+	cmd := exec.Command(o.Command, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = stderrWriter
+	setExecProcessGroup(cmd)
+
+	err = cmd.Start()
+	stderrWriter.Close()
+	if err != nil {
+		log.Errorf("Exec %s error: couldn't run %s: %s", check, o.Command, err)
+		return false, NoTTL
+	}
+
+	output := make(chan string, 1)
+	go func() {
+		output <- readExecStderr(stderr)
+	}()
+
+	//The command is always waited for, so it's reaped even when killed.
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-timer.C:
+		timedOut = true
+		killExecProcessGroup(cmd)
+		err = <-done
+	}
+
+	//Whatever the helper wrote is only waited for a little, as processes it left behind may still hold its stderr.
+	var message string
+	select {
+	case message = <-output:
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if timedOut {
+		log.Errorf("Exec %s timed out after %s, denying user %s.", check, time.Since(start), common.RedactUsername(username))
+		return false, SkipCache
+	}
+
+	if err == nil {
+		return true, NoTTL
+	}
+
+	if message != "" {
+		message = ": " + message
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		log.Debugf("Exec %s denied user %s%s", check, common.RedactUsername(username), message)
+		return false, NoTTL
+	}
+	log.Errorf("Exec %s error, denying user %s: %s%s", check, common.RedactUsername(username), err, message)
+	return false, NoTTL
+}
+
+//readExecStderr returns the start of what's written to stderr until it's closed, reading the rest so the writer isn't blocked.
+func readExecStderr(stderr io.Reader) string {
+	message, _ := ioutil.ReadAll(io.LimitReader(stderr, execStderrLimit))
+	io.Copy(ioutil.Discard, stderr)
+	return strings.TrimSpace(string(message))
+}
+
+//GetUser runs the command with exec_user_args, writing the password to its stdin.
+func (o Exec) GetUser(username, password string) bool {
+	ok, _ := o.GetUserTTL(username, password)
+	return ok
+}
+
+//GetUserTTL checks the user as GetUser does, telling not to cache a denial when the command timed out.
+func (o Exec) GetUserTTL(username, password string) (bool, time.Duration) {
+	if o.UserArgs == nil {
+		return false, NoTTL
+	}
+
+	//A password holding what ends it would let it be taken as something else.
+	terminator := execPasswordTerminators[o.PasswordFormat]
+	if terminator != "" && strings.Contains(password, terminator) {
+		log.Warnf("Exec user check: password of user %s holds its terminator, denying it.", common.RedactUsername(username))
+		return false, NoTTL
+	}
+
+	return o.run("user check", execArgs(o.UserArgs, username, "", "", 0), password+terminator, username)
+}
+
+//GetSuperuser runs the command with exec_superuser_args.
+func (o Exec) GetSuperuser(username string) bool {
+	if o.SuperuserArgs == nil {
+		return false
+	}
+	ok, _ := o.run("superuser check", execArgs(o.SuperuserArgs, username, "", "", 0), "", username)
+	return ok
+}
+
+//CheckAcl runs the command with exec_acl_args.
+func (o Exec) CheckAcl(username, topic, clientid string, acc int32) bool {
+	ok, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return ok
+}
+
+//CheckAclTTL checks the acl as CheckAcl does, telling not to cache a denial when the command timed out.
+func (o Exec) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
+	if o.AclArgs == nil {
+		return false, NoTTL
+	}
+	return o.run("acl check", execArgs(o.AclArgs, username, topic, clientid, acc), "", username)
+}
+
+//GetName returns the backend's name
+func (o Exec) GetName() string {
+	return "Exec"
+}
+
+//Halt does nothing, as running commands are killed when they time out.
+func (o Exec) Halt() {}
@@ -0,0 +1,163 @@
+package backends
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExec(t *testing.T) {
+
+	authOpts := func(opts map[string]string) map[string]string {
+		all := map[string]string{
+			"exec_command":        "testdata/exec/helper.sh",
+			"exec_user_args":      "user %u",
+			"exec_superuser_args": "superuser %u",
+			"exec_acl_args":       "acl %u %t %c %a",
+		}
+		for key, value := range opts {
+			if value == "" {
+				delete(all, key)
+			} else {
+				all[key] = value
+			}
+		}
+		return all
+	}
+
+	Convey("Given wrong options, NewExec should fail", t, func() {
+		for _, opts := range []map[string]string{
+			{"exec_command": ""},
+			{"exec_command": "testdata/exec/missing.sh"},
+			{"exec_command": "testdata/exec"},
+			{"exec_user_args": "", "exec_superuser_args": "", "exec_acl_args": ""},
+			{"exec_password_format": "argv"},
+		} {
+			_, err := NewExec(authOpts(opts), log.DebugLevel)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given invalid numbers, NewExec should warn and use the defaults", t, func() {
+		e, err := NewExec(authOpts(map[string]string{"exec_timeout_ms": "0", "exec_max_procs": "many"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(e.Timeout, ShouldEqual, time.Second)
+		So(e.MaxProcs, ShouldEqual, 10)
+	})
+
+	Convey("Given arguments templates, placeholders should be replaced within each argument", t, func() {
+		args := execArgs([]string{"--user=%u", "%t", "%c", "%a", "100%%"}, "some user", "a/b", "%u", MOSQ_ACL_SUBSCRIBE)
+		So(args, ShouldResemble, []string{"--user=some user", "a/b", "%u", "4", "100%"})
+	})
+
+	Convey("Given a helper, checks should be granted when it exits with 0", t, func() {
+		e, err := NewExec(authOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer e.Halt()
+
+		So(e.GetUser("test1", "test pw"), ShouldBeTrue)
+		So(e.GetUser("test1", "wrong"), ShouldBeFalse)
+		So(e.GetUser("test2", "test pw"), ShouldBeFalse)
+		So(e.GetUser("test1", "test pw\nuser"), ShouldBeFalse)
+
+		So(e.GetSuperuser("admin"), ShouldBeTrue)
+		So(e.GetSuperuser("test1"), ShouldBeFalse)
+
+		So(e.CheckAcl("test1", "tele/dev1", "dev1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(e.CheckAcl("test1", "tele/dev1", "dev1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(e.CheckAcl("test1", "tele/dev1", "dev2", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(e.CheckAcl("test1", "cmd/test1", "dev1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+		So(e.CheckAcl("test1 cmd/test1", "x", "y", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+
+		_, ttl := e.GetUserTTL("test1", "test pw")
+		So(ttl, ShouldEqual, NoTTL)
+	})
+
+	Convey("Given other password formats, the password should be passed on stdin with them", t, func() {
+		for _, format := range []string{"null", "raw"} {
+			e, err := NewExec(authOpts(map[string]string{"exec_password_format": format}), log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(e.GetUser("test1", "test pw"), ShouldBeTrue)
+			So(e.GetUser("test1", "wrong"), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given only some arguments templates, the other checks should be denied without running the helper", t, func() {
+		e, err := NewExec(authOpts(map[string]string{"exec_superuser_args": "", "exec_acl_args": ""}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(e.GetUser("test1", "test pw"), ShouldBeTrue)
+		So(e.GetSuperuser("admin"), ShouldBeFalse)
+		So(e.CheckAcl("test1", "tele/dev1", "dev1", MOSQ_ACL_WRITE), ShouldBeFalse)
+	})
+
+	Convey("Given a helper crashing or failing, checks should be denied", t, func() {
+		e, err := NewExec(authOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		granted, ttl := e.GetUserTTL("crash", "test pw")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, NoTTL)
+		So(e.GetSuperuser("error"), ShouldBeFalse)
+	})
+
+	Convey("Given a helper hanging, checks should be denied in time and their denials not cached", t, func() {
+		e, err := NewExec(authOpts(map[string]string{"exec_timeout_ms": "200", "exec_max_procs": "1"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		start := time.Now()
+		granted, ttl := e.CheckAclTTL("hang", "tele/dev1", "dev1", MOSQ_ACL_WRITE)
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+		So(time.Since(start), ShouldBeLessThan, 600*time.Millisecond)
+
+		//The helper was killed and its slot freed, so checks keep being made.
+		So(e.CheckAcl("test1", "tele/dev1", "dev1", MOSQ_ACL_WRITE), ShouldBeTrue)
+
+		Convey("And checks waiting for a free process slot for too long should be denied too", func() {
+			var wg sync.WaitGroup
+			ttls := make([]time.Duration, 3)
+			start := time.Now()
+			for i := range ttls {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, ttls[i] = e.GetUserTTL("hang", "test pw")
+				}(i)
+			}
+			wg.Wait()
+
+			So(time.Since(start), ShouldBeLessThan, 600*time.Millisecond)
+			for _, ttl := range ttls {
+				So(ttl, ShouldEqual, SkipCache)
+			}
+		})
+	})
+
+	Convey("Given concurrent checks, no more than exec_max_procs helpers should run at once", t, func() {
+		e, err := NewExec(authOpts(map[string]string{"exec_max_procs": "2", "exec_timeout_ms": "5000"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		var wg sync.WaitGroup
+		results := make([]bool, 4)
+		start := time.Now()
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = e.GetSuperuser("slow")
+			}(i)
+		}
+		wg.Wait()
+
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 400*time.Millisecond)
+		for _, result := range results {
+			So(result, ShouldBeTrue)
+		}
+		So(len(e.procs), ShouldEqual, 0)
+	})
+
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package backends
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+//setExecProcessGroup starts the command in a process group of its own, so it can be killed along with the processes it starts.
+func setExecProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+//killExecProcessGroup kills the command's process group.
+func killExecProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,13 @@
+package backends
+
+import (
+	"os/exec"
+)
+
+//setExecProcessGroup does nothing, as there are no process groups to kill the processes the command starts with.
+func setExecProcessGroup(cmd *exec.Cmd) {}
+
+//killExecProcessGroup kills the command alone.
+func killExecProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -9,6 +9,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/iegomez/mosquitto-go-auth/common"
 )
@@ -29,15 +30,29 @@ type FileUser struct {
 type AclRecord struct {
 	Topic string
 	Acc   byte //None 0x00, Read 0x01, Write 0x02, ReadWrite: Read | Write : 0x03
+
+	//substitute tells if %u and %c are replaced in a user's record, as they're only in static acls, while users' topic lines are taken literally as mosquitto does.
+	substitute bool
 }
 
 //FileBE holds paths to files, list of file users and general (no user or pattern) acl records.
 type Files struct {
-	PasswordPath string
-	AclPath      string
-	CheckAcls    bool
-	Users        map[string]*FileUser //Users keeps a registry of username/FileUser pairs, holding a user's password and Acl records.
-	AclRecords   []AclRecord
+	PasswordPath   string
+	PasswordFormat string //PBKDF2 (default) or htpasswd (bcrypt entries only).
+	AclPath        string
+	StaticUsers    string //Comma separated username:hash pairs given inline in auth_opts.
+	StaticAcls     string //Comma separated username:acc:topic acls given inline in auth_opts.
+	CheckAcls      bool
+	Users          map[string]*FileUser //Users keeps a registry of username/FileUser pairs, holding a user's password and Acl records.
+	AclRecords     []AclRecord
+	Hasher         common.Hasher //Verifies password hashes, taking PBKDF2 salts in its encoding.
+}
+
+//FilesOptions are the auth options the files backend takes.
+var FilesOptions = Options{
+	Keys: withKeys([]string{
+		"password_path", "password_path_format", "acl_path", "static_users", "static_acls",
+	}, common.HasherOptions, common.PrefixedHasherOptions("files")),
 }
 
 //NewFiles initializes a files backend.
@@ -45,38 +60,79 @@ func NewFiles(authOpts map[string]string, logLevel log.Level) (Files, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := FilesOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return Files{}, errors.Errorf("Files backend error: %s.\n", err)
+	}
+
 	var files = Files{
-		PasswordPath: "",
-		AclPath:      "",
-		CheckAcls:    false,
-		Users:        make(map[string]*FileUser),
-		AclRecords:   make([]AclRecord, 0, 0),
+		PasswordPath:   "",
+		PasswordFormat: "pbkdf2",
+		AclPath:        "",
+		CheckAcls:      false,
+		Users:          make(map[string]*FileUser),
+		AclRecords:     make([]AclRecord, 0, 0),
+	}
+
+	if staticUsers, ok := authOpts["static_users"]; ok {
+		files.StaticUsers = staticUsers
+	}
+
+	if staticAcls, ok := authOpts["static_acls"]; ok {
+		files.StaticAcls = staticAcls
+	}
+
+	hasher, err := common.NewHasher(authOpts, "files")
+	if err != nil {
+		return files, errors.Errorf("Files backend error: %s.\n", err)
 	}
+	files.Hasher = hasher
 
 	if passwordPath, ok := authOpts["password_path"]; ok {
 		files.PasswordPath = passwordPath
-	} else {
-		return files, errors.New("Files backend error: no password path given.\n")
+	} else if files.StaticUsers == "" {
+		return files, errors.New("Files backend error: no password path or static users given.\n")
+	}
+
+	if passwordFormat, ok := authOpts["password_path_format"]; ok {
+		if passwordFormat != "pbkdf2" && passwordFormat != "htpasswd" {
+			return files, errors.Errorf("Files backend error: unknown password_path_format %s.\n", passwordFormat)
+		}
+		files.PasswordFormat = passwordFormat
 	}
 
 	if aclPath, ok := authOpts["acl_path"]; ok {
 		files.AclPath = aclPath
 		files.CheckAcls = true
+	} else if files.StaticAcls != "" {
+		files.CheckAcls = true
 	} else {
 		files.CheckAcls = false
 		log.Info("Acls won't be checked.\n")
 	}
 
 	//Now initialize FileUsers by reading from password and acl files.
-	uCount, uErr := files.readPasswords()
-	if uErr != nil {
-		return files, errors.Errorf("Fatal: %s\n", uErr)
-	} else {
-		log.Infof("Got %d users from passwords file.\n", uCount)
+	if files.PasswordPath != "" {
+		uCount, uErr := files.readPasswords()
+		if uErr != nil {
+			return files, errors.Errorf("Fatal: %s\n", uErr)
+		} else {
+			log.Infof("Got %d users from passwords file.\n", uCount)
+		}
+	}
+
+	//Inline users take precedence over the passwords file ones.
+	if files.StaticUsers != "" {
+		uCount, uErr := files.readStaticUsers()
+		if uErr != nil {
+			return files, errors.Errorf("Fatal: %s\n", uErr)
+		} else {
+			log.Infof("Got %d static users.\n", uCount)
+		}
 	}
 
 	//Only read acls if path was given.
-	if files.CheckAcls {
+	if files.AclPath != "" {
 		aclCount, aclErr := files.readAcls()
 		if aclErr != nil {
 			return files, errors.Errorf("Fatal: %s\n", aclErr)
@@ -85,6 +141,16 @@ func NewFiles(authOpts map[string]string, logLevel log.Level) (Files, error) {
 		}
 	}
 
+	//Inline acls are added to the ones read from the acl file.
+	if files.StaticAcls != "" {
+		aclCount, aclErr := files.readStaticAcls()
+		if aclErr != nil {
+			return files, errors.Errorf("Fatal: %s\n", aclErr)
+		} else {
+			log.Infof("Got %d static acls.\n", aclCount)
+		}
+	}
+
 	return files, nil
 
 }
@@ -117,6 +183,19 @@ func (o Files) readPasswords() (int, error) {
 			log.Errorf("Read passwords error: line %d is not well formatted.\n", index)
 			continue
 		}
+
+		//Don't allow mixing formats in htpasswd files, where only bcrypt is supported, so skip any crypt()/MD5-apr1/SHA entry.
+		//Other files take any hash the hasher verifies, bcrypt ones included.
+		if o.PasswordFormat == "htpasswd" {
+			if strings.HasPrefix(lineArr[1], "PBKDF2$") {
+				return usersCount, errors.Errorf("Files backend error: PBKDF2 hash at line %d of htpasswd file, formats can't be mixed.\n", index)
+			}
+			if !isBcryptHash(lineArr[1]) {
+				log.Warnf("Read passwords warning: unsupported htpasswd hash for user %s at line %d, only bcrypt is supported. Skipping it.\n", lineArr[0], index)
+				continue
+			}
+		}
+
 		//Create user if it doesn't exist and save password; override password if user existed.
 		var fileUser *FileUser
 		var ok bool
@@ -275,6 +354,111 @@ func (o *Files) readAcls() (int, error) {
 
 }
 
+//readStaticUsers parses the static_users option (username:hash pairs separated by commas) and populates FileUsers, overriding any existing user's password.
+func (o Files) readStaticUsers() (int, error) {
+
+	usersCount := 0
+
+	for index, entry := range splitStaticUsers(o.StaticUsers) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		entryArr := strings.Split(entry, ":")
+		if len(entryArr) != 2 || entryArr[0] == "" || entryArr[1] == "" {
+			return usersCount, errors.Errorf("Files backend error: static user entry %d is not well formatted.\n", index+1)
+		}
+
+		//Hashes must be bcrypt ones for htpasswd format, as in the passwords file.
+		if o.PasswordFormat == "htpasswd" && !isBcryptHash(entryArr[1]) {
+			return usersCount, errors.Errorf("Files backend error: static user %s must have a bcrypt hash for htpasswd format.\n", entryArr[0])
+		}
+
+		fileUser, ok := o.Users[entryArr[0]]
+		if ok {
+			log.Debugf("Static user %s overrides passwords file entry.\n", entryArr[0])
+			fileUser.Password = entryArr[1]
+		} else {
+			usersCount++
+			o.Users[entryArr[0]] = &FileUser{
+				Password:   entryArr[1],
+				AclRecords: make([]AclRecord, 0, 0),
+			}
+		}
+	}
+
+	return usersCount, nil
+
+}
+
+//readStaticAcls parses the static_acls option (username:acc:topic entries separated by commas) and associates them to existing users.
+func (o *Files) readStaticAcls() (int, error) {
+
+	aclsCount := 0
+
+	for _, entry := range strings.Split(o.StaticAcls, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		entryArr := strings.SplitN(entry, ":", 3)
+		if len(entryArr) != 3 || entryArr[2] == "" {
+			return aclsCount, errors.Errorf("Files backend error: static acl entry %s is not well formatted.\n", entry)
+		}
+
+		fUser, ok := o.Users[entryArr[0]]
+		if !ok {
+			return aclsCount, errors.Errorf("Files backend error: user %s does not exist for static acl entry %s.\n", entryArr[0], entry)
+		}
+
+		var aclRecord = AclRecord{
+			Topic:      entryArr[2],
+			Acc:        MOSQ_ACL_NONE,
+			substitute: true,
+		}
+
+		switch entryArr[1] {
+		case "read":
+			aclRecord.Acc = MOSQ_ACL_READ
+		case "write":
+			aclRecord.Acc = MOSQ_ACL_WRITE
+		case "readwrite":
+			aclRecord.Acc = MOSQ_ACL_READWRITE
+		case "subscribe":
+			aclRecord.Acc = MOSQ_ACL_SUBSCRIBE
+		default:
+			return aclsCount, errors.Errorf("Files backend error: wrong access %s for static acl entry %s.\n", entryArr[1], entry)
+		}
+
+		fUser.AclRecords = append(fUser.AclRecords, aclRecord)
+
+		aclsCount++
+	}
+
+	return aclsCount, nil
+
+}
+
+//splitStaticUsers splits the static_users option into its entries. Argon2id and scrypt hashes have commas in their parameters, so a piece without a colon following one is part of its hash.
+func splitStaticUsers(staticUsers string) []string {
+	var entries []string
+	for _, piece := range strings.Split(staticUsers, ",") {
+		if n := len(entries); n > 0 && (strings.Contains(entries[n-1], "$argon2id$") || strings.Contains(entries[n-1], "$scrypt$")) && !strings.Contains(piece, ":") {
+			entries[n-1] += "," + piece
+			continue
+		}
+		entries = append(entries, piece)
+	}
+	return entries
+}
+
+//isBcryptHash checks if the hash has any of the bcrypt prefixes generated by htpasswd or other tools.
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2y$") || strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$")
+}
+
 func checkCommentOrEmpty(line string) bool {
 	if len(strings.Replace(line, " ", "", -1)) == 0 || line[0:1] == "#" {
 		return true
@@ -290,11 +474,15 @@ func (o Files) GetUser(username, password string) bool {
 		return false
 	}
 
-	if common.HashCompare(password, fileUser.Password) {
+	if o.PasswordFormat == "htpasswd" {
+		if bcrypt.CompareHashAndPassword([]byte(fileUser.Password), []byte(password)) == nil {
+			return true
+		}
+	} else if o.Hasher.Compare(password, fileUser.Password) {
 		return true
 	}
 
-	log.Warnf("wrong password for user %s\n", username)
+	log.Warnf("wrong password for user %s\n", common.RedactUsername(username))
 
 	return false
 
@@ -317,16 +505,19 @@ func (o Files) CheckAcl(username, topic, clientid string, acc int32) bool {
 	//If user exists, check against his acls and common ones. If not, check against common acls only.
 	if ok {
 		for _, aclRecord := range fileUser.AclRecords {
-			if common.TopicsMatch(aclRecord.Topic, topic) && (acc == int32(aclRecord.Acc) || int32(aclRecord.Acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.Acc) == MOSQ_ACL_READ || int32(aclRecord.Acc) == MOSQ_ACL_SUBSCRIBE))) {
+			//Static acls may contain %c and %u too (e.g., user1:readwrite:tele/%u/#), while topic lines are matched as they are.
+			matches := common.TopicsMatch(aclRecord.Topic, topic)
+			if aclRecord.substitute {
+				matches = common.AclMatches(aclRecord.Topic, topic, username, clientid)
+			}
+			if matches && accMatches(int32(aclRecord.Acc), acc, topic) {
 				return true
 			}
 		}
 	}
 	for _, aclRecord := range o.AclRecords {
-		//Replace all occurrences of %c for clientid and %u for username
-		aclTopic := strings.Replace(aclRecord.Topic, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) && (acc == int32(aclRecord.Acc) || int32(aclRecord.Acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.Acc) == MOSQ_ACL_READ || int32(aclRecord.Acc) == MOSQ_ACL_SUBSCRIBE))) {
+		//%c and %u are replaced by the client id and username when matching.
+		if common.AclMatches(aclRecord.Topic, topic, username, clientid) && accMatches(int32(aclRecord.Acc), acc, topic) {
 			return true
 		}
 	}
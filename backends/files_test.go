@@ -1,11 +1,17 @@
 package backends
 
 import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
 )
 
 func TestFiles(t *testing.T) {
@@ -142,3 +148,779 @@ func TestFiles(t *testing.T) {
 	})
 
 }
+
+func TestFilesHtpasswd(t *testing.T) {
+
+	authOpts := make(map[string]string)
+
+	pwPath, _ := filepath.Abs("../test-files/htpasswd")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+	authOpts["password_path"] = pwPath
+	authOpts["acl_path"] = aclPath
+
+	Convey("Given an unknown password format NewFiles should fail", t, func() {
+		authOpts["password_path_format"] = "md5"
+		_, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given an htpasswd file with bcrypt entries and htpasswd format NewFiles should return a new files backend instance", t, func() {
+		authOpts["password_path_format"] = "htpasswd"
+		files, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		//Passwords are the same as users, as in the PBKDF2 passwords file.
+		user1 := "test1"
+		user2 := "test2"
+
+		Convey("Given a username and a correct password, it should correctly authenticate it", func() {
+			authenticated := files.GetUser(user1, user1)
+			So(authenticated, ShouldBeTrue)
+		})
+
+		Convey("Given a username and an incorrect password, it should not authenticate it", func() {
+			authenticated := files.GetUser(user1, user2)
+			So(authenticated, ShouldBeFalse)
+		})
+
+		Convey("Unsupported MD5-apr1 entries should be skipped", func() {
+			_, ok := files.Users["legacy"]
+			So(ok, ShouldBeFalse)
+			authenticated := files.GetUser("legacy", "legacy")
+			So(authenticated, ShouldBeFalse)
+		})
+
+		Convey("Acls should be checked as usual", func() {
+			tt1 := files.CheckAcl(user1, "test/topic/1", "test_client", 2)
+			tt2 := files.CheckAcl(user1, "test/topic/1", "test_client", 1)
+			So(tt1, ShouldBeTrue)
+			So(tt2, ShouldBeFalse)
+		})
+
+		files.Halt()
+	})
+
+	Convey("Given a PBKDF2 passwords file and htpasswd format NewFiles should fail", t, func() {
+		pbkdf2Path, _ := filepath.Abs("../test-files/passwords")
+		authOpts["password_path"] = pbkdf2Path
+		authOpts["password_path_format"] = "htpasswd"
+		_, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given a file mixing PBKDF2 and bcrypt entries NewFiles should fail for htpasswd format only", t, func() {
+		mixed, err := ioutil.TempFile("", "mixed_passwords")
+		So(err, ShouldBeNil)
+		defer os.Remove(mixed.Name())
+
+		htpasswd, _ := ioutil.ReadFile(pwPath)
+		pbkdf2, _ := ioutil.ReadFile("../test-files/passwords")
+		mixed.Write(htpasswd)
+		mixed.Write(pbkdf2)
+		mixed.Close()
+
+		authOpts["password_path"] = mixed.Name()
+
+		authOpts["password_path_format"] = "htpasswd"
+		_, err = NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["password_path_format"] = "pbkdf2"
+		files, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(files.GetUser("test1", "test1"), ShouldBeTrue)
+		So(files.GetUser("test1", "test2"), ShouldBeFalse)
+		files.Halt()
+	})
+
+}
+
+func TestFilesStatic(t *testing.T) {
+
+	//Hashes taken from the passwords file, where passwords are the same as users.
+	test1Hash := "PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg=="
+	test2Hash := "PBKDF2$sha512$100000$o513B9FfaKTL6xalU+UUwA==$mAUtjVg1aHkDpudOnLKUQs8ddGtKKyu+xi07tftd5umPKQKnJeXf1X7RpoL/Gj/ZRdpuBu5GWZ+NZ2rYyAsi1g=="
+
+	clientID := "test_client"
+
+	Convey("Given only static users and acls NewFiles should return a new files backend instance", t, func() {
+		authOpts := map[string]string{
+			"static_users": "user1:" + test1Hash + ", user2:" + test2Hash,
+			"static_acls":  "user1:readwrite:tele/%u/#, user2:read:cmd/+",
+		}
+
+		files, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Given a username and a correct password, it should correctly authenticate it", func() {
+			So(files.GetUser("user1", "test1"), ShouldBeTrue)
+			So(files.GetUser("user2", "test2"), ShouldBeTrue)
+		})
+
+		Convey("Given a username and an incorrect password, it should not authenticate it", func() {
+			So(files.GetUser("user1", "test2"), ShouldBeFalse)
+		})
+
+		Convey("User 1 should be able to read and write under its own tele topic only", func() {
+			So(files.CheckAcl("user1", "tele/user1/state", clientID, 1), ShouldBeTrue)
+			So(files.CheckAcl("user1", "tele/user1/state", clientID, 2), ShouldBeTrue)
+			So(files.CheckAcl("user1", "tele/user2/state", clientID, 1), ShouldBeFalse)
+		})
+
+		Convey("User 2 should be able to read but not write cmd topics", func() {
+			So(files.CheckAcl("user2", "cmd/reboot", clientID, 1), ShouldBeTrue)
+			So(files.CheckAcl("user2", "cmd/reboot", clientID, 2), ShouldBeFalse)
+			So(files.CheckAcl("user2", "tele/user2/state", clientID, 1), ShouldBeFalse)
+		})
+
+		files.Halt()
+	})
+
+	Convey("Given both files and static entries, static users should override file ones and acls should be merged", t, func() {
+		pwPath, _ := filepath.Abs("../test-files/passwords")
+		aclPath, _ := filepath.Abs("../test-files/acls")
+		authOpts := map[string]string{
+			"password_path": pwPath,
+			"acl_path":      aclPath,
+			"static_users":  "test1:" + test2Hash + ",static:" + test1Hash,
+			"static_acls":   "test1:write:static/topic,static:read:test/topic/2",
+		}
+
+		files, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(files.GetUser("test1", "test2"), ShouldBeTrue)
+		So(files.GetUser("test1", "test1"), ShouldBeFalse)
+		So(files.GetUser("test2", "test2"), ShouldBeTrue)
+		So(files.GetUser("static", "test1"), ShouldBeTrue)
+
+		So(files.CheckAcl("test1", "test/topic/1", clientID, 2), ShouldBeTrue)
+		So(files.CheckAcl("test1", "static/topic", clientID, 2), ShouldBeTrue)
+		So(files.CheckAcl("static", "test/topic/2", clientID, 1), ShouldBeTrue)
+		So(files.CheckAcl("static", "test/topic/1", clientID, 1), ShouldBeFalse)
+
+		files.Halt()
+	})
+
+	Convey("Given static acls and acl file topic lines, only static acls and patterns should have %u and %c replaced", t, func() {
+		aclFile, err := ioutil.TempFile("", "acls")
+		So(err, ShouldBeNil)
+		defer os.Remove(aclFile.Name())
+		_, err = aclFile.WriteString("user user1\ntopic read file/%u/#\n\npattern read pattern/%c\n")
+		So(err, ShouldBeNil)
+		aclFile.Close()
+
+		files, err := NewFiles(map[string]string{
+			"static_users": "user1:" + test1Hash,
+			"static_acls":  "user1:read:static/%u/#",
+			"acl_path":     aclFile.Name(),
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(files.CheckAcl("user1", "static/user1/state", clientID, 1), ShouldBeTrue)
+		So(files.CheckAcl("user1", "pattern/"+clientID, clientID, 1), ShouldBeTrue)
+		So(files.CheckAcl("user1", "file/user1/state", clientID, 1), ShouldBeFalse)
+		So(files.CheckAcl("user1", "file/%u/state", clientID, 1), ShouldBeTrue)
+
+		files.Halt()
+	})
+
+	Convey("Given wrong static entries NewFiles should fail naming the offending entry", t, func() {
+		//User entries are only told by their position, as they may hold a hash.
+		_, err := NewFiles(map[string]string{"static_users": "user2:" + test2Hash + ",user1" + test1Hash}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "entry 2 ")
+		So(err.Error(), ShouldNotContainSubstring, test1Hash)
+
+		_, err = NewFiles(map[string]string{
+			"static_users": "user1:" + test1Hash,
+			"static_acls":  "user1:readwrite:tele/#,user1:publish:cmd/#",
+		}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "user1:publish:cmd/#")
+
+		_, err = NewFiles(map[string]string{
+			"static_users": "user1:" + test1Hash,
+			"static_acls":  "user3:read:tele/#",
+		}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "user3:read:tele/#")
+	})
+
+}
+
+func TestFilesArgon2id(t *testing.T) {
+
+	//Vectors generated by an implementation of RFC 9106 independent from golang.org/x/crypto, checked against the RFC's argon2id test vector, and the reference one from the argon2 CLI.
+	vectors := []struct {
+		password, hash string
+	}{
+		{"password", "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{"testpw", "$argon2id$v=19$m=4096,t=3,p=1$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA"},
+		{"correct horse battery staple", "$argon2id$v=19$m=1024,t=2,p=4$MDEyMzQ1Njc4OWFiY2RlZg$rr/Dl+a4o5gcayema0lTnXlsmp27zihs9gL7T6Bl4cE"},
+		{"pässwörd€", "$argon2id$v=19$m=2048,t=1,p=2$TmFDbC1hbmQtcGVwcGVy$WU0FwbuE2AldxhylPfaNyQ"},
+		{"x", "$argon2id$v=19$m=256,t=4,p=8$MTZieXRlc29mc2FsdCEh$040+rSwaJpaBEMYLfvmNxFA6m4Y+8XEh/eNSUdJ3HOjNqJBGT6Tb/3CAiQeT54WfzXQpf6rp6wWBs310zmghQw"},
+	}
+
+	Convey("Given argon2id hashes generated elsewhere, they should be verified", t, func() {
+		for _, v := range vectors {
+			So(common.HashFormat(v.hash), ShouldEqual, common.HashArgon2id)
+			So(common.HashCompare(v.password, v.hash), ShouldBeTrue)
+			So(common.HashCompare(v.password+"x", v.hash), ShouldBeFalse)
+			So(common.HashCompare("", v.hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given tampered or malformed argon2id hashes, they shouldn't be verified", t, func() {
+		for _, hash := range []string{
+			//Another time, parallelism and memory than the hash was generated with.
+			"$argon2id$v=19$m=4096,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA",
+			"$argon2id$v=19$m=4096,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA",
+			"$argon2id$v=19$m=8192,t=3,p=1$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA",
+			//Another salt and a truncated hash.
+			"$argon2id$v=19$m=4096,t=3,p=1$c2FsdHNhbHRzYWx0c2FsdQ$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA",
+			"$argon2id$v=19$m=4096,t=3,p=1$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN",
+			//Less memory than 8 KiB per thread, which argon2 would silently raise.
+			"$argon2id$v=19$m=8,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA",
+			"$argon2id$v=19$m=4096,t=3$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA",
+			"$argon2id$v=19$m=4096,t=3,p=1$!!!$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA",
+			"$argon2id$v=19$m=4096,t=3,p=1$c2FsdHNhbHRzYWx0c2FsdA",
+		} {
+			So(common.HashCompare("testpw", hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given argon2id hashes with parameters past the limits, they shouldn't be verified", t, func() {
+		for _, params := range []string{
+			//No threads, too many of them, and more than a uint8 holds.
+			"m=4096,t=3,p=0",
+			"m=4096,t=3,p=65",
+			"m=4096,t=3,p=257",
+			//No passes, over 1 GiB of memory, and too many passes over the memory given.
+			"m=4096,t=0,p=1",
+			"m=2097152,t=1,p=1",
+			"m=4096,t=1025,p=1",
+			"m=4096,t=4294967295,p=1",
+			"m=4096,t=3,p=1,x=1",
+		} {
+			hash := "$argon2id$v=19$" + params + "$c2FsdHNhbHRzYWx0c2FsdA$TURNv0LbPjJydQsFUZNZvPZCy5r680HdeW3r5bRN8ZA"
+			So(common.HashCompare("testpw", hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given a password hashed with argon2id, it should be verified with the parameters given", t, func() {
+		hash, err := common.Argon2idHash("testpw", 16, 1024, 2, 2, 24)
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "$argon2id$v=19$m=1024,t=2,p=2$")
+		So(common.HashCompare("testpw", hash), ShouldBeTrue)
+		So(common.HashCompare("testpW", hash), ShouldBeFalse)
+
+		other, err := common.Argon2idHash("testpw", 16, 1024, 2, 2, 24)
+		So(err, ShouldBeNil)
+		So(other, ShouldNotEqual, hash)
+	})
+
+	Convey("Given wrong argon2id parameters, hashing should fail", t, func() {
+		for _, params := range []struct {
+			saltSize       int
+			memory, passes uint32
+			threads        uint8
+			keyLen         uint32
+		}{
+			{4, 1024, 2, 2, 32},
+			{16, 1024, 0, 2, 32},
+			{16, 1024, 2, 0, 32},
+			{16, 8, 2, 2, 32},
+			{16, 1024, 2, 2, 2},
+			{16, 1024, 2, 65, 32},
+			{16, 1 << 21, 1, 2, 32},
+			{16, 1 << 20, 5, 2, 32},
+		} {
+			_, err := common.Argon2idHash("testpw", params.saltSize, params.memory, params.passes, params.threads, params.keyLen)
+			So(err, ShouldBeError)
+		}
+	})
+
+	Convey("Given argon2id static users and passwords file entries, the files backend should verify them", t, func() {
+		passwords, err := ioutil.TempFile("", "argon2id_passwords")
+		So(err, ShouldBeNil)
+		defer os.Remove(passwords.Name())
+
+		_, err = passwords.WriteString("horse:" + vectors[2].hash + "\n")
+		So(err, ShouldBeNil)
+		So(passwords.Close(), ShouldBeNil)
+
+		//Static users are separated by commas, which argon2id parameters have too.
+		files, err := NewFiles(map[string]string{
+			"password_path": passwords.Name(),
+			"static_users":  "reference:" + vectors[0].hash + ", test:" + vectors[1].hash + ",pbkdf2:PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg==",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(files.GetUser("reference", "password"), ShouldBeTrue)
+		So(files.GetUser("test", "testpw"), ShouldBeTrue)
+		So(files.GetUser("pbkdf2", "test1"), ShouldBeTrue)
+		So(files.GetUser("horse", "correct horse battery staple"), ShouldBeTrue)
+
+		So(files.GetUser("reference", "testpw"), ShouldBeFalse)
+		So(files.GetUser("test", "password"), ShouldBeFalse)
+		So(files.GetUser("horse", "correct horse battery"), ShouldBeFalse)
+
+		files.Halt()
+	})
+
+}
+
+func TestFilesBcrypt(t *testing.T) {
+
+	//Vectors generated by libxcrypt's crypt(), as used by htpasswd, with the $2y$, $2a$ and $2b$ prefixes written by htpasswd, bcrypt-ruby (used by Rails) and the bcrypt Python and Node packages.
+	vectors := []struct {
+		password, hash string
+	}{
+		{"testpw", "$2y$10$Ro0CUfOqk6cXEKf3dyaM7O8pQPViliIFSbVBM5MgM7RaXUwdRBVIm"},
+		{"correct horse battery staple", "$2a$12$./abcdefghijklmnopqrsemJRHOKlsafdddOWXN4IkO3BlVQ.1nIK"},
+		{"pässwörd€", "$2b$04$0123456789ABCDEFGHIJK.yJ0I3Gf.rerjlnGsAD8c2ylStjJO6eG"},
+		{"", "$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s."},
+		//The reference vector from OpenBSD and crypt_blowfish.
+		{"U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+	}
+
+	Convey("Given bcrypt hashes generated by other tools, they should be verified", t, func() {
+		for _, v := range vectors {
+			So(common.HashFormat(v.hash), ShouldEqual, common.HashBcrypt)
+			So(common.HashCompare(v.password, v.hash), ShouldBeTrue)
+			So(common.HashCompare(v.password+"x", v.hash), ShouldBeFalse)
+			So(common.HashCompare(strings.ToUpper(v.password)+"X", v.hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given a password longer than 72 bytes, only its first 72 should be verified, as bcrypt does", t, func() {
+		hash := "$2b$05$CCCCCCCCCCCCCCCCCCCCC.XxrQqgBi/5Sxuq9soXzDtjIZ7w5pMfK"
+		So(common.HashCompare(strings.Repeat("0123456789", 8), hash), ShouldBeTrue)
+		So(common.HashCompare(strings.Repeat("0123456789", 7)+"01", hash), ShouldBeTrue)
+		So(common.HashCompare(strings.Repeat("0123456789", 7)+"0", hash), ShouldBeFalse)
+	})
+
+	Convey("Given bcrypt hashes with a cost outside 4 to 31 or malformed, they shouldn't be verified", t, func() {
+		for _, hash := range []string{
+			"$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+			"$2a$32$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+			"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOe",
+			"$2a$05$CCCCCCCCCCCCCCCCCCCCC",
+		} {
+			So(common.HashCompare("U*U", hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given a password hashed with bcrypt, it should be verified with the cost given", t, func() {
+		hash, err := common.BcryptHash("testpw", 5)
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "$2a$05$")
+		So(common.HashCompare("testpw", hash), ShouldBeTrue)
+		So(common.HashCompare("testpW", hash), ShouldBeFalse)
+	})
+
+	Convey("Given a cost outside 4 to 31 or a password longer than 72 bytes, hashing should fail", t, func() {
+		for _, cost := range []int{-1, 0, 3, 32} {
+			_, err := common.BcryptHash("testpw", cost)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "between 4 and 31")
+		}
+
+		_, err := common.BcryptHash(strings.Repeat("x", 73), 4)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given bcrypt hashes, the sqlite backend should verify them alongside PBKDF2 ones, as the files backend does in htpasswd format", t, func() {
+		sqlite, err := NewSqlite(map[string]string{
+			"sqlite_source":    "memory",
+			"sqlite_userquery": "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+
+		sqlite.DB.MustExec(userSchema)
+		sqlite.DB.MustExec("INSERT INTO test_user(username, password_hash, is_admin) values(?, ?, 0)", "rails", vectors[1].hash)
+		sqlite.DB.MustExec("INSERT INTO test_user(username, password_hash, is_admin) values(?, ?, 0)", "pbkdf2", userPassHash)
+
+		So(sqlite.GetUser("rails", "correct horse battery staple"), ShouldBeTrue)
+		So(sqlite.GetUser("rails", "correct horse"), ShouldBeFalse)
+		So(sqlite.GetUser("pbkdf2", "testpw"), ShouldBeTrue)
+
+		passwords, err := ioutil.TempFile("", "bcrypt_passwords")
+		So(err, ShouldBeNil)
+		defer os.Remove(passwords.Name())
+
+		_, err = passwords.WriteString("apache:" + vectors[0].hash + "\n")
+		So(err, ShouldBeNil)
+		So(passwords.Close(), ShouldBeNil)
+
+		files, err := NewFiles(map[string]string{
+			"password_path":        passwords.Name(),
+			"password_path_format": "htpasswd",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(files.GetUser("apache", "testpw"), ShouldBeTrue)
+		So(files.GetUser("apache", "testpW"), ShouldBeFalse)
+
+		files.Halt()
+	})
+
+	Convey("Given bcrypt passwords file entries and static users in the default format, the files backend should verify them alongside PBKDF2 ones", t, func() {
+		passwords, err := ioutil.TempFile("", "bcrypt_passwords")
+		So(err, ShouldBeNil)
+		defer os.Remove(passwords.Name())
+
+		_, err = passwords.WriteString("apache:" + vectors[0].hash + "\nrails:" + vectors[1].hash + "\ntest1:" + userPassHash + "\n")
+		So(err, ShouldBeNil)
+		So(passwords.Close(), ShouldBeNil)
+
+		files, err := NewFiles(map[string]string{
+			"password_path": passwords.Name(),
+			"static_users":  "node:" + vectors[2].hash,
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(files.PasswordFormat, ShouldEqual, "pbkdf2")
+
+		So(files.GetUser("apache", "testpw"), ShouldBeTrue)
+		So(files.GetUser("rails", "correct horse battery staple"), ShouldBeTrue)
+		So(files.GetUser("node", "pässwörd€"), ShouldBeTrue)
+		So(files.GetUser("test1", "testpw"), ShouldBeTrue)
+
+		So(files.GetUser("apache", "testpW"), ShouldBeFalse)
+		So(files.GetUser("rails", "correct horse"), ShouldBeFalse)
+		So(files.GetUser("node", "passwörd€"), ShouldBeFalse)
+
+		files.Halt()
+	})
+
+}
+
+func TestFilesHasher(t *testing.T) {
+
+	//Hashes generated by Python's hashlib.pbkdf2_hmac, with other parameters than the pw utility's defaults.
+	legacyHash := "PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg=="
+	policyHash := "PBKDF2$sha512$600000$AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=$CRgroK190+qq9j85IJ774g4TdM8mqfDg6F9ck/5bjChaM4i6nGsBfkyFz/ZLJPIjOZqfbqslVomAxFx5F5cPDQ=="
+	shortKeyHash := "PBKDF2$sha512$100000$MDEyMzQ1Njc4OWFiY2RlZg==$17GPn8xQn14Bmnk2uTqmIsaZlvwruxmFy5sRXYFYbCI="
+	sha256Hash := "PBKDF2$sha256$210000$c2FsdHNhbHRzYWx0c2FsdA==$EtguMN+HcLZYD8Uvxtx05sQ2H+SkktLFBeImyrvZX/0="
+	//A hash as stored by mosquitto-auth-plug, whose salt is taken as it is.
+	authPlugHash := "PBKDF2$sha256$901$qIk9UVrOC6DF3bg9$/aBf1gftpR34xB8O+zIt5PCsEj2BMyXv"
+
+	Convey("Given PBKDF2 hashes with old and new parameters in one backend, each should be verified with its own", t, func() {
+		files, err := NewFiles(map[string]string{
+			"static_users": "legacy:" + legacyHash + ",policy:" + policyHash + ",short:" + shortKeyHash + ",sha256:" + sha256Hash,
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(files.GetUser("legacy", "test1"), ShouldBeTrue)
+		So(files.GetUser("policy", "newpolicy"), ShouldBeTrue)
+		So(files.GetUser("short", "shortkey"), ShouldBeTrue)
+		So(files.GetUser("sha256", "sha256pw"), ShouldBeTrue)
+
+		So(files.GetUser("legacy", "newpolicy"), ShouldBeFalse)
+		So(files.GetUser("policy", "test1"), ShouldBeFalse)
+		So(files.GetUser("short", "shortkeY"), ShouldBeFalse)
+		So(files.GetUser("sha256", "sha256"), ShouldBeFalse)
+
+		files.Halt()
+	})
+
+	Convey("Given PBKDF2 hashes with parameters past the limits, they shouldn't be verified", t, func() {
+		salt := "c2FsdHNhbHRzYWx0c2FsdA=="
+		key := func(size int) string {
+			return base64.StdEncoding.EncodeToString(make([]byte, size))
+		}
+		for _, hash := range []string{
+			//No iterations, and far too many of them.
+			"PBKDF2$sha512$0$" + salt + "$" + key(64),
+			"PBKDF2$sha512$2000000000$" + salt + "$" + key(64),
+			"PBKDF2$sha512$8388609$" + salt + "$" + key(64),
+			//Too many iterations for a key of two sha512 blocks, and a key longer than 1024 bytes.
+			"PBKDF2$sha512$8388608$" + salt + "$" + key(128),
+			"PBKDF2$sha256$1000$" + salt + "$" + key(1025),
+		} {
+			So(common.HashCompare("testpw", hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given salts stored as they are, they should be verified only when the backend's salt encoding says so", t, func() {
+		files, err := NewFiles(map[string]string{"static_users": "plug:" + authPlugHash}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(files.GetUser("plug", "authplug"), ShouldBeFalse)
+
+		//The backend's option takes precedence over the common one.
+		files, err = NewFiles(map[string]string{
+			"static_users":               "plug:" + authPlugHash + ",legacy:" + legacyHash,
+			"hasher_salt_encoding":       "base64",
+			"files_hasher_salt_encoding": "utf-8",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(files.Hasher.SaltEncoding, ShouldEqual, common.SaltEncodingUTF8)
+		So(files.GetUser("plug", "authplug"), ShouldBeTrue)
+		So(files.GetUser("plug", "authplu"), ShouldBeFalse)
+		So(files.GetUser("legacy", "test1"), ShouldBeFalse)
+	})
+
+	Convey("Given hasher options, hashes should be generated with them and verified", t, func() {
+		files, err := NewFiles(map[string]string{
+			"static_users":           "legacy:" + legacyHash,
+			"hasher":                 "bcrypt",
+			"files_hasher":           "pbkdf2",
+			"hasher_iterations":      "1000",
+			"hasher_keylen":          "32",
+			"files_hasher_salt_size": "24",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(files.Hasher.Format, ShouldEqual, common.HashPBKDF2)
+
+		hash, err := files.Hasher.Hash("testpw")
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "PBKDF2$sha512$1000$")
+		So(files.Hasher.Compare("testpw", hash), ShouldBeTrue)
+		So(files.Hasher.Compare("testpW", hash), ShouldBeFalse)
+
+		for _, hasher := range []common.Hasher{
+			{Format: common.HashPBKDF2, Algorithm: "sha256", Iterations: 1000, SaltSize: 12, SaltEncoding: common.SaltEncodingUTF8},
+			{Format: common.HashBcrypt, Cost: 4},
+			{Format: common.HashArgon2id, SaltSize: 16, Memory: 64, Time: 1, Parallelism: 1, KeyLen: 16},
+		} {
+			hash, err := hasher.Hash("testpw")
+			So(err, ShouldBeNil)
+			So(common.HashFormat(hash), ShouldEqual, hasher.Format)
+			So(hasher.Compare("testpw", hash), ShouldBeTrue)
+			So(hasher.Compare("testpW", hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given wrong hasher options, NewFiles should fail naming the option", t, func() {
+		for opt, value := range map[string]string{
+			"files_hasher":               "md5",
+			"hasher_algorithm":           "sha1",
+			"files_hasher_salt_encoding": "hex",
+		} {
+			_, err := NewFiles(map[string]string{"static_users": "legacy:" + legacyHash, opt: value}, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, value)
+		}
+	})
+
+	Convey("Given invalid hasher numbers, NewFiles should warn and use the defaults", t, func() {
+		files, err := NewFiles(map[string]string{
+			"static_users":            "legacy:" + legacyHash,
+			"hasher_cost":             "3",
+			"files_hasher_iterations": "0",
+			"hasher_iterations":       "1000",
+			"hasher_keylen":           "1025",
+			"hasher_parallelism":      "65",
+			"hasher_memory":           "2097152",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		defaults := common.DefaultHasher()
+		So(files.Hasher.Cost, ShouldEqual, defaults.Cost)
+		So(files.Hasher.Iterations, ShouldEqual, defaults.Iterations)
+		So(files.Hasher.KeyLen, ShouldEqual, defaults.KeyLen)
+		So(files.Hasher.Parallelism, ShouldEqual, defaults.Parallelism)
+		So(files.Hasher.Memory, ShouldEqual, defaults.Memory)
+	})
+
+}
+
+func TestFilesPepper(t *testing.T) {
+
+	//Hashes generated by Python of the HMAC-SHA256 of pepperedpw keyed with s3cr3t-pepper, and a bcrypt one of pepperedpw by libxcrypt.
+	pepper := "s3cr3t-pepper"
+	pbkdf2Hash := "PBKDF2$sha512$100000$AAECAwQFBgcICQoLDA0ODw==$dpfv6zO44BZ4bxe5FlIvhQXr4e+U2OLUvcBMYYHhVRJ2ntw4h6RhxJUgigiBHxYzdEIuTjWA35gVcpjtQuA54Q=="
+	argon2idHash := "$argon2id$v=19$m=64,t=1,p=1$cGVwcGVyc2FsdHBlcHBlcg$wdUQIoedda82w2wZW7Dp8tRSL86mux0RsLyhTZ9+OfU"
+	bcryptHash := "$2y$04$abcdefghijklmnopqrstuuqoQHewhqEyYMD4RANOA5YF6Tgic9hO6"
+	//The same argon2id hash without pepper.
+	plainArgon2idHash := "$argon2id$v=19$m=64,t=1,p=1$cGVwcGVyc2FsdHBlcHBlcg$wpdtvi1WWybsU3cmB0J/7SN7DHZY+Vp8qBOjRC/Tfr8"
+	legacyHash := "PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg=="
+
+	staticUsers := "pbkdf2:" + pbkdf2Hash + ",argon2id:" + argon2idHash + ",plain:" + plainArgon2idHash + ",legacy:" + legacyHash + ",bcrypt:" + bcryptHash
+
+	Convey("Given no pepper, hashes should be verified as they were", t, func() {
+		files, err := NewFiles(map[string]string{"static_users": staticUsers}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(files.Hasher.Pepper, ShouldBeEmpty)
+
+		So(files.GetUser("pbkdf2", "pepperedpw"), ShouldBeFalse)
+		So(files.GetUser("argon2id", "pepperedpw"), ShouldBeFalse)
+		So(files.GetUser("plain", "pepperedpw"), ShouldBeTrue)
+		So(files.GetUser("legacy", "test1"), ShouldBeTrue)
+	})
+
+	Convey("Given a pepper, PBKDF2 and argon2id hashes should be verified with it and bcrypt ones without it", t, func() {
+		files, err := NewFiles(map[string]string{"static_users": staticUsers, "hasher_pepper": pepper}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(files.GetUser("pbkdf2", "pepperedpw"), ShouldBeTrue)
+		So(files.GetUser("argon2id", "pepperedpw"), ShouldBeTrue)
+		So(files.GetUser("pbkdf2", "pepperedpW"), ShouldBeFalse)
+		So(files.GetUser("argon2id", "pepperedpW"), ShouldBeFalse)
+		So(files.GetUser("plain", "pepperedpw"), ShouldBeFalse)
+		So(files.GetUser("legacy", "test1"), ShouldBeFalse)
+
+		//Hashes should be generated with it too.
+		for _, format := range []string{common.HashPBKDF2, common.HashArgon2id} {
+			hasher := files.Hasher
+			hasher.Format = format
+			hasher.Memory = 64
+			hasher.Time = 1
+			hasher.Parallelism = 1
+
+			hash, err := hasher.Hash("testpw")
+			So(err, ShouldBeNil)
+			So(hasher.Compare("testpw", hash), ShouldBeTrue)
+			So(common.HashCompare("testpw", hash), ShouldBeFalse)
+		}
+
+		//Bcrypt hashes are verified without the pepper.
+		So(files.GetUser("bcrypt", "pepperedpw"), ShouldBeTrue)
+
+		hasher := files.Hasher
+		hasher.Format = common.HashBcrypt
+		_, err = hasher.Hash("testpw")
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given a pepper file, its pepper should be used without its ending line break", t, func() {
+		dir, err := ioutil.TempDir("", "pepper")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "pepper")
+		So(ioutil.WriteFile(path, []byte(pepper+"\n"), 0600), ShouldBeNil)
+
+		files, err := NewFiles(map[string]string{"static_users": staticUsers, "files_hasher_pepper_file": path}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(string(files.Hasher.Pepper), ShouldEqual, pepper)
+		So(files.GetUser("pbkdf2", "pepperedpw"), ShouldBeTrue)
+		So(files.GetUser("argon2id", "pepperedpw"), ShouldBeTrue)
+
+		//The file takes precedence over the pepper given inline.
+		files, err = NewFiles(map[string]string{"static_users": staticUsers, "hasher_pepper": "other-pepper", "hasher_pepper_file": path}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(string(files.Hasher.Pepper), ShouldEqual, pepper)
+
+		empty := filepath.Join(dir, "empty")
+		So(ioutil.WriteFile(empty, []byte("\n"), 0600), ShouldBeNil)
+
+		for _, opts := range []map[string]string{
+			{"hasher_pepper_file": empty},
+			{"hasher_pepper_file": filepath.Join(dir, "missing")},
+			{"hasher_pepper": ""},
+			{"hasher_pepper": pepper, "files_hasher": "bcrypt"},
+		} {
+			opts["static_users"] = staticUsers
+			_, err := NewFiles(opts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldNotContainSubstring, pepper)
+		}
+	})
+
+}
+
+func TestFilesScrypt(t *testing.T) {
+
+	//The first vector is the example hash of passlib's scrypt docs, the others were generated by passlib's format from Python's hashlib.scrypt, with . in place of + in the salt and hash.
+	vectors := []struct {
+		password, hash string
+	}{
+		{"password", "$scrypt$ln=16,r=8,p=1$aM15713r3Xsvxbi31lqr1Q$nFNh2CVHVjNldFVKDHDlm4CbdRSCdEBsjjJxD+iCs5E"},
+		{"scryptpw", "$scrypt$ln=4,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4"},
+		{"migrated", "$scrypt$ln=10,r=4,p=2$MDEyMzQ1Njc4OWFiY2RlZg$tOVmgnogxGD.L7yKxLED6U5bHY6uF8buix6rDDZKxxGqt/.5x33X1d8cQSS3.4nKZTnIkFnGc5ngy9gFYy/Fuw"},
+	}
+
+	Convey("Given scrypt hashes generated elsewhere, they should be verified", t, func() {
+		for _, v := range vectors {
+			So(common.HashFormat(v.hash), ShouldEqual, common.HashScrypt)
+			So(common.HashCompare(v.password, v.hash), ShouldBeTrue)
+			So(common.HashCompare(v.password+"x", v.hash), ShouldBeFalse)
+			So(common.HashCompare("", v.hash), ShouldBeFalse)
+		}
+
+		//Some tools write + and padding in the salt and hash.
+		So(common.HashCompare("scryptpw", "$scrypt$ln=4,r=8,p=1$++++++++++++++++++++AQ==$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4="), ShouldBeTrue)
+	})
+
+	Convey("Given tampered or malformed scrypt hashes, they shouldn't be verified", t, func() {
+		for _, hash := range []string{
+			//Other parameters than the hash was generated with.
+			"$scrypt$ln=5,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=4,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=8,p=2$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			//Another salt and hash.
+			"$scrypt$ln=4,r=8,p=1$....................AA$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69t4",
+			//Parameters out of range or past the limits, which mustn't panic nor take all the memory.
+			"$scrypt$ln=0,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=-4,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=64,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=24,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=0,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=8,p=0$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=8,p=1073741824$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=99999999999999999999,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			//Malformed parameters, salt or hash.
+			"$scrypt$ln=4,r=8$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=8,p=1,x=2$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$n=16,r=8,p=1$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$$....................AQ$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=8,p=1$!!!$j1AIofY8sCwPM7umfVZb8Cp6p6wBQNxnl3jvZMl69s4",
+			"$scrypt$ln=4,r=8,p=1$....................AQ$",
+			"$scrypt$ln=4,r=8,p=1$....................AQ",
+			"$scrypt$",
+		} {
+			So(func() { common.HashCompare("scryptpw", hash) }, ShouldNotPanic)
+			So(common.HashCompare("scryptpw", hash), ShouldBeFalse)
+		}
+	})
+
+	Convey("Given a password hashed with scrypt, it should be verified with the parameters given", t, func() {
+		hash, err := common.ScryptHash("testpw", 16, 5, 4, 2, 24)
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "$scrypt$ln=5,r=4,p=2$")
+		So(hash, ShouldNotContainSubstring, "+")
+		So(common.HashCompare("testpw", hash), ShouldBeTrue)
+		So(common.HashCompare("testpW", hash), ShouldBeFalse)
+
+		for _, params := range [][5]int{
+			{4, 4, 8, 1, 32},
+			{16, 0, 8, 1, 32},
+			{16, 31, 8, 1, 32},
+			{16, 20, 1024, 1, 32},
+			{16, 4, 0, 1, 32},
+			{16, 4, 8, 17, 32},
+			{16, 4, 8, 1, 2},
+		} {
+			_, err := common.ScryptHash("testpw", params[0], params[1], params[2], params[3], params[4])
+			So(err, ShouldBeError)
+		}
+	})
+
+	Convey("Given scrypt static users, the files backend should verify them", t, func() {
+		//Static users are separated by commas, which scrypt parameters have too.
+		files, err := NewFiles(map[string]string{
+			"static_users": "scrypt:" + vectors[1].hash + ",migrated:" + vectors[2].hash + ",pbkdf2:PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg==",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(files.GetUser("scrypt", "scryptpw"), ShouldBeTrue)
+		So(files.GetUser("migrated", "migrated"), ShouldBeTrue)
+		So(files.GetUser("pbkdf2", "test1"), ShouldBeTrue)
+		So(files.GetUser("scrypt", "migrated"), ShouldBeFalse)
+
+		hasher, err := common.NewHasher(map[string]string{"hasher": "scrypt", "hasher_ln": "6", "hasher_block_size": "2"}, "files")
+		So(err, ShouldBeNil)
+		hash, err := hasher.Hash("testpw")
+		So(err, ShouldBeNil)
+		So(hash, ShouldStartWith, "$scrypt$ln=6,r=2,p=1$")
+		So(files.Hasher.Compare("testpw", hash), ShouldBeTrue)
+
+		_, err = common.NewHasher(map[string]string{"hasher": "scrypt", "hasher_ln": "20", "hasher_block_size": "1024"}, "files")
+		So(err, ShouldBeError)
+	})
+
+}
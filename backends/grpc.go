@@ -5,38 +5,172 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/protobuf/ptypes/empty"
 	grpc_logrus "github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
-	"github.com/golang/protobuf/ptypes/empty"
-
+	// Registers the health checks the round_robin balancer makes on each endpoint.
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
 	gs "github.com/iegomez/mosquitto-go-auth/grpc"
 )
 
 // GRPC holds a client for the service and implements the Backend interface.
 type GRPC struct {
-	client gs.AuthServiceClient
-	conn   *grpc.ClientConn
+	client   gs.AuthServiceClient
+	conn     *grpc.ClientConn
+	timeout  time.Duration
+	retries  int
+	metadata metadata.MD
+	health   *grpcHealth
+	// superusers holds the users hinted as superusers by the service when
+	// grpc_superuser_hints is set, or is nil otherwise.
+	superusers *grpcSuperusers
+	// aclStream carries acl checks when grpc_acl_stream is set, or is nil otherwise.
+	aclStream *grpcAclStream
+	// balanced tells if calls are spread over many endpoints.
+	balanced bool
+}
+
+const (
+	// grpcDefaultTimeout is the deadline of each call when grpc_timeout_ms isn't set.
+	grpcDefaultTimeout = 5 * time.Second
+	// grpcRetryBackoff is the wait before the first retry, doubled on each
+	// one up to grpcMaxRetryBackoff.
+	grpcRetryBackoff    = 100 * time.Millisecond
+	grpcMaxRetryBackoff = 2 * time.Second
+	// grpcDefaultBackoffMax is the longest wait between reconnections when
+	// grpc_backoff_max_ms isn't set, instead of gRPC's default of two minutes.
+	grpcDefaultBackoffMax = 5 * time.Second
+	// grpcDefaultHealthInterval is how often the service's health is checked
+	// when grpc_health_interval_ms isn't set.
+	grpcDefaultHealthInterval = 5 * time.Second
+	// grpcSocketAuthority is the authority of calls over a unix socket, which
+	// the server's certificate is verified for when using TLS.
+	grpcSocketAuthority = "localhost"
+	// grpcBalancedServiceConfig spreads calls over every ready endpoint of a
+	// list or DNS name, leaving out the ones failing their health checks.
+	grpcBalancedServiceConfig = `{"loadBalancingPolicy": "round_robin", "healthCheckConfig": {"serviceName": ""}}`
+)
+
+// grpcResolvers counts the resolvers registered for grpc_host lists, each one
+// with a scheme of its own.
+var grpcResolvers int32
+
+// GRPCOptions are the auth options the gRPC backend takes.
+var GRPCOptions = Options{
+	Keys: []string{
+		"grpc_acl_stream", "grpc_auth_token", "grpc_auth_token_file", "grpc_backoff_max_ms", "grpc_ca_cert",
+		"grpc_fail_on_dial_error", "grpc_health_interval_ms", "grpc_host", "grpc_keepalive_ms",
+		"grpc_metadata", "grpc_port", "grpc_retries", "grpc_socket", "grpc_superuser_hints",
+		"grpc_timeout_ms", "grpc_tls_cert", "grpc_tls_key", "grpc_with_tls",
+	},
 }
 
 // NewGRPC tries to connect to the gRPC service at the given host.
 func NewGRPC(authOpts map[string]string, logLevel log.Level) (GRPC, error) {
-	var g GRPC
+	g := GRPC{timeout: grpcDefaultTimeout}
+
+	authOpts, err := GRPCOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return g, err
+	}
+
+	socket, err := grpcSocket(authOpts)
+	if err != nil {
+		return g, err
+	}
+
+	// Hosts in a list may have ports of their own.
+	if socket == "" && (authOpts["grpc_host"] == "" || (authOpts["grpc_port"] == "" && !strings.Contains(authOpts["grpc_host"], ","))) {
+		return g, errors.New("grpc must have a host and port, or a socket")
+	}
+
+	g.timeout = common.DurationOption(authOpts, "grpc_timeout_ms", time.Millisecond, time.Millisecond, g.timeout)
 
-	if authOpts["grpc_host"] == "" || authOpts["grpc_port"] == "" {
-		return g, errors.New("grpc must have a host and port")
+	g.retries = common.IntOption(authOpts, "grpc_retries", 0, 1000, g.retries)
+
+	failOnDialError := common.BoolOption(authOpts, "grpc_fail_on_dial_error", true)
+
+	if common.BoolOption(authOpts, "grpc_superuser_hints", false) {
+		g.superusers = &grpcSuperusers{expirations: make(map[string]time.Time)}
 	}
 
-	caCert := []byte(authOpts["grpc_ca_cert"])
-	tlsCert := []byte(authOpts["grpc_tls_cert"])
-	tlsKey := []byte(authOpts["grpc_tls_key"])
-	addr := fmt.Sprintf("%s:%s", authOpts["grpc_host"], authOpts["grpc_port"])
+	aclStream := common.BoolOption(authOpts, "grpc_acl_stream", false)
+
+	durations := map[string]time.Duration{
+		"grpc_backoff_max_ms":     grpcDefaultBackoffMax,
+		"grpc_keepalive_ms":       0,
+		"grpc_health_interval_ms": grpcDefaultHealthInterval,
+	}
+	for opt, def := range durations {
+		min := time.Duration(0)
+		if opt == "grpc_backoff_max_ms" {
+			min = time.Millisecond
+		}
+		durations[opt] = common.DurationOption(authOpts, opt, time.Millisecond, min, def)
+	}
 
-	conn, gsClient, err := createClient(addr, caCert, tlsCert, tlsKey)
+	dialOpts := []grpc.DialOption{
+		grpc.WithBackoffMaxDelay(durations["grpc_backoff_max_ms"]),
+	}
+
+	if failOnDialError {
+		dialOpts = append(dialOpts, grpc.WithBlock())
+	}
+
+	// Pings find a connection the service is gone from while it's idle,
+	// rather than on the next check.
+	if keepaliveTime := durations["grpc_keepalive_ms"]; keepaliveTime > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepaliveTime,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	tlsConfig, err := grpcTLSConfig(authOpts)
+	if err != nil {
+		return g, err
+	}
+
+	g.metadata, err = grpcMetadata(authOpts)
+	if err != nil {
+		return g, err
+	}
+
+	if tlsConfig == nil && len(g.metadata["authorization"]) > 0 {
+		log.Warning("grpc_with_tls isn't set, the auth token will be sent in plain text")
+	}
+
+	network, target, endpoints := "unix", "", []string{socket}
+	if socket == "" {
+		network = "tcp"
+		target, endpoints, g.balanced, err = grpcTarget(authOpts["grpc_host"], authOpts["grpc_port"])
+		if err != nil {
+			return g, err
+		}
+		if g.balanced {
+			dialOpts = append(dialOpts, grpc.WithDefaultServiceConfig(grpcBalancedServiceConfig))
+		}
+	}
+
+	conn, gsClient, err := createClient(network, target, endpoints, tlsConfig, dialOpts)
 	if err != nil {
 		return g, err
 	}
@@ -44,48 +178,95 @@ func NewGRPC(authOpts map[string]string, logLevel log.Level) (GRPC, error) {
 	g.client = gsClient
 	g.conn = conn
 
+	if aclStream {
+		g.aclStream = newGRPCAclStream(gsClient, g.metadata)
+	}
+
+	if interval := durations["grpc_health_interval_ms"]; interval > 0 {
+		g.health = newGRPCHealth(conn, interval, g.timeout)
+	}
+
 	return g, nil
 }
 
 // GetUser checks that the username exists and the given password hashes to the same password.
 func (o GRPC) GetUser(username, password string) bool {
+	granted, _ := o.GetUserTTL(username, password)
+	return granted
+}
+
+// GetUserTTL checks the user just as GetUser, and also returns the ttl hinted
+// by the service, SkipCache when it couldn't be reached so the denial isn't
+// cached, or NoTTL otherwise. The user's superuser hint is replaced by the
+// response's.
+func (o GRPC) GetUserTTL(username, password string) (bool, time.Duration) {
 
 	req := gs.GetUserRequest{
 		Username: username,
 		Password: password,
 	}
 
-	resp, err := o.client.GetUser(context.Background(), &req)
+	var resp *gs.AuthResponse
+	err := o.invoke("get user", func(ctx context.Context, opts ...grpc.CallOption) (err error) {
+		resp, err = o.client.GetUser(ctx, &req, opts...)
+		return err
+	})
 
 	if err != nil {
-		log.Errorf("grpc get user error: %s", err)
-		return false
+		return false, grpcFailedTTL(err)
 	}
 
-	return resp.Ok
+	ttl := o.response("get user", username, resp)
+	if o.superusers != nil {
+		o.superusers.set(username, resp.Ok && resp.IsSuperuser, ttl)
+	}
+
+	return resp.Ok, ttl
 
 }
 
-// GetSuperuser checks that the user is a superuser.
+// GetSuperuser checks that the user is a superuser, unless the service
+// already hinted so.
 func (o GRPC) GetSuperuser(username string) bool {
 
+	if o.superusers != nil && o.superusers.has(username) {
+		log.Debugf("grpc user %s was hinted as superuser", common.RedactUsername(username))
+		return true
+	}
+
 	req := gs.GetSuperuserRequest{
 		Username: username,
 	}
 
-	resp, err := o.client.GetSuperuser(context.Background(), &req)
+	var resp *gs.AuthResponse
+	err := o.invoke("get superuser", func(ctx context.Context, opts ...grpc.CallOption) (err error) {
+		resp, err = o.client.GetSuperuser(ctx, &req, opts...)
+		return err
+	})
 
 	if err != nil {
-		log.Errorf("grpc get superuser error: %s", err)
 		return false
 	}
 
+	o.response("get superuser", username, resp)
+
 	return resp.Ok
 
 }
 
 // CheckAcl checks if the user has access to the given topic.
 func (o GRPC) CheckAcl(username, topic, clientid string, acc int32) bool {
+	granted, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return granted
+}
+
+// CheckAclTTL checks the acl just as CheckAcl, and also returns the ttl hinted
+// by the service, SkipCache when it couldn't be reached so the denial isn't
+// cached, or NoTTL otherwise. Superuser hints only spare GetSuperuser calls,
+// as superuser checks may be disabled, so hinted users' acls are still asked.
+// With grpc_acl_stream set, the check is sent over the acl stream, and made
+// with a unary call when the stream can't answer it.
+func (o GRPC) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
 
 	req := gs.CheckAclRequest{
 		Username: username,
@@ -94,72 +275,448 @@ func (o GRPC) CheckAcl(username, topic, clientid string, acc int32) bool {
 		Acc:      acc,
 	}
 
-	resp, err := o.client.CheckAcl(context.Background(), &req)
+	var resp *gs.AuthResponse
+	err := o.invoke("check acl", func(ctx context.Context, opts ...grpc.CallOption) (err error) {
+		if o.aclStream != nil && o.aclStream.supported() {
+			resp, err = o.aclStream.check(ctx, &req)
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+		}
+		resp, err = o.client.CheckAcl(ctx, &req, opts...)
+		return err
+	})
 
 	if err != nil {
-		log.Errorf("grpc check acl error: %s", err)
-		return false
+		return false, grpcFailedTTL(err)
 	}
 
-	return resp.Ok
+	ttl := o.response("check acl", username, resp)
+	if o.superusers != nil && resp.Ok && resp.IsSuperuser {
+		o.superusers.set(username, true, ttl)
+	}
+
+	return resp.Ok, ttl
 
 }
 
-// GetName gets the gRPC backend's name.
+// GetName gets the gRPC backend's name. As it's asked for on every check to
+// be logged, it's neither retried nor waits for the connection to be ready.
 func (o GRPC) GetName() string {
-	resp, err := o.client.GetName(context.Background(), &empty.Empty{})
+	ctx, cancel := o.callContext()
+	defer cancel()
+	resp, err := o.client.GetName(ctx, &empty.Empty{})
 	if err != nil {
 		return "gRPC name error"
 	}
 	return resp.Name
 }
 
-// Halt signals the gRPC backend that mosquitto is halting.
+// Halt signals the gRPC backend that mosquitto is halting, and closes the connection.
 func (o GRPC) Halt() {
-	o.client.Halt(context.Background(), &empty.Empty{})
+	if o.health != nil {
+		o.health.stop()
+	}
+
+	if o.aclStream != nil {
+		o.aclStream.close()
+	}
+
+	ctx, cancel := o.callContext()
+	defer cancel()
+	o.client.Halt(ctx, &empty.Empty{})
+
+	if err := o.conn.Close(); err != nil {
+		log.Errorf("grpc close error: %s", err)
+	}
+}
+
+// callContext returns the context of a call, with a deadline of
+// grpc_timeout_ms and carrying the metadata sent with every call.
+func (o GRPC) callContext() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if len(o.metadata) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, o.metadata)
+	}
+	return context.WithTimeout(ctx, o.timeout)
+}
+
+// invoke makes the call with a deadline of grpc_timeout_ms, waiting for the
+// connection to be ready within it rather than failing while it's being
+// established. Calls failing with a transient code are retried up to
+// grpc_retries times with a growing backoff, while any answer, including a
+// denial, and any other error are returned at once. When calls are balanced,
+// one lost with its endpoint is first made again at once on another one.
+func (o GRPC) invoke(method string, call func(ctx context.Context, opts ...grpc.CallOption) error) error {
+	backoff := grpcRetryBackoff
+	failedOver := false
+
+	for try := 0; ; try++ {
+		ctx, cancel := o.callContext()
+		err := call(ctx, grpc.WaitForReady(true))
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		if o.balanced && !failedOver && status.Code(err) == codes.Unavailable {
+			log.Warnf("grpc %s error, trying another endpoint: %s", method, err)
+			failedOver = true
+			try--
+			continue
+		}
+
+		if try >= o.retries || !grpcTransient(err) {
+			log.Errorf("grpc %s error: %s", method, err)
+			return err
+		}
+
+		log.Warnf("grpc %s error, retrying in %s (%d/%d): %s", method, backoff, try+1, o.retries, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > grpcMaxRetryBackoff {
+			backoff = grpcMaxRetryBackoff
+		}
+	}
+}
+
+// response logs the reason given in the response, if any, and returns the ttl
+// it hints for caching its decision.
+func (o GRPC) response(method, username string, resp *gs.AuthResponse) time.Duration {
+	if resp.Reason != "" {
+		log.Debugf("grpc %s for %s ok %t: %s", method, common.RedactUsername(username), resp.Ok, resp.Reason)
+	}
+	return grpcResponseTTL(resp.CacheTtlSeconds)
+}
+
+// grpcResponseTTL returns the ttl hinted by a response's cache_ttl_seconds:
+// NoTTL when unset, as with older services, and SkipCache when negative.
+func grpcResponseTTL(seconds int32) time.Duration {
+	switch {
+	case seconds > 0:
+		return time.Duration(seconds) * time.Second
+	case seconds < 0:
+		return SkipCache
+	default:
+		return NoTTL
+	}
 }
 
-func createClient(hostname string, caCert, tlsCert, tlsKey []byte) (*grpc.ClientConn, gs.AuthServiceClient, error) {
+// grpcDefaultSuperuserHintTTL is how long a superuser hint given without a ttl
+// lasts, unless the user's next login replaces it first.
+const grpcDefaultSuperuserHintTTL = 5 * time.Minute
+
+// grpcSuperusers holds the users the service hinted as superusers, along with
+// when the hint expires.
+type grpcSuperusers struct {
+	sync.Mutex
+	expirations map[string]time.Time
+}
+
+// set records or drops the user's superuser hint, which lasts for the given
+// ttl when hinted, or grpcDefaultSuperuserHintTTL without one. A hint that
+// mustn't be cached isn't recorded. Expired hints of other users are dropped
+// when a new user is hinted, so they don't pile up.
+func (s *grpcSuperusers) set(username string, superuser bool, ttl time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !superuser || ttl == SkipCache {
+		delete(s.expirations, username)
+		return
+	}
+
+	now := time.Now()
+	if ttl <= 0 {
+		ttl = grpcDefaultSuperuserHintTTL
+	}
+
+	if _, ok := s.expirations[username]; !ok {
+		for user, expiration := range s.expirations {
+			if now.After(expiration) {
+				delete(s.expirations, user)
+			}
+		}
+	}
+
+	s.expirations[username] = now.Add(ttl)
+}
+
+// has tells if the user was hinted as a superuser and the hint hasn't expired.
+func (s *grpcSuperusers) has(username string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	expiration, ok := s.expirations[username]
+	if ok && time.Now().After(expiration) {
+		delete(s.expirations, username)
+		return false
+	}
+	return ok
+}
+
+// grpcTransient tells if the call failed because the service was unavailable
+// or didn't answer in time, so it may succeed if retried.
+func grpcTransient(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// grpcFailedTTL returns the cache hint for a failed call's denial: one due to
+// the service being unavailable must not be cached, as it could have granted it.
+func grpcFailedTTL(err error) time.Duration {
+	if grpcTransient(err) {
+		return SkipCache
+	}
+	return NoTTL
+}
+
+// grpcMetadata returns the metadata sent with every call: the pairs in
+// grpc_metadata, given as comma separated key:value pairs, and the auth token
+// from grpc_auth_token, which may be read from grpc_auth_token_file, as a
+// bearer authorization. Keys are lowercased, as gRPC sends them.
+func grpcMetadata(authOpts map[string]string) (metadata.MD, error) {
+	md := metadata.MD{}
+
+	if pairs, ok := authOpts["grpc_metadata"]; ok {
+		for i, pair := range strings.Split(pairs, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, ":", 2)
+			key := strings.ToLower(strings.TrimSpace(kv[0]))
+			// The pair isn't shown, as its value may be a secret.
+			if len(kv) != 2 || key == "" {
+				return nil, errors.Errorf("invalid grpc_metadata pair number %d, it must be key:value", i+1)
+			}
+			md.Append(key, strings.TrimSpace(kv[1]))
+		}
+	}
+
+	token, hasToken := authOpts["grpc_auth_token"]
+
+	if hasToken {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			return nil, errors.New("the grpc auth token is empty")
+		}
+		if len(md["authorization"]) > 0 {
+			return nil, errors.New("grpc_metadata can't have an authorization key along with an auth token")
+		}
+		md.Set("authorization", "Bearer "+token)
+	}
+
+	return md, nil
+}
+
+// grpcSocket returns the path of the unix socket the service listens on, given
+// either in grpc_socket or as a unix:// grpc_host, or an empty one when it's
+// reached over TCP.
+func grpcSocket(authOpts map[string]string) (string, error) {
+	host := authOpts["grpc_host"]
+	socket, ok := authOpts["grpc_socket"]
+
+	if strings.HasPrefix(host, "unix://") {
+		if ok {
+			return "", errors.New("grpc_socket and a unix:// grpc_host can't be given together")
+		}
+		socket, ok = strings.TrimPrefix(host, "unix://"), true
+	} else if ok && host != "" {
+		return "", errors.New("grpc_socket and grpc_host can't be given together")
+	}
+
+	if ok && socket == "" {
+		return "", errors.New("the grpc socket path is empty")
+	}
+
+	return socket, nil
+}
+
+// grpcTarget returns the target to dial for grpc_host and grpc_port, along
+// with the endpoints behind it, and tells if calls are balanced over them.
+// grpc_host may be a single host, a dns:/// name resolving to many addresses,
+// or a comma separated list of hosts, each with an optional port of its own,
+// for which a resolver is registered.
+func grpcTarget(host, port string) (string, []string, bool, error) {
+	if strings.HasPrefix(host, "dns:///") {
+		name := strings.TrimPrefix(host, "dns:///")
+		if name == "" {
+			return "", nil, false, errors.New("the grpc dns name is empty")
+		}
+		endpoint := net.JoinHostPort(name, port)
+		return "dns:///" + endpoint, []string{endpoint}, true, nil
+	}
+
+	if !strings.Contains(host, ",") {
+		addr := fmt.Sprintf("%s:%s", host, port)
+		return addr, []string{addr}, false, nil
+	}
+
+	var endpoints []string
+	var addresses []resolver.Address
+	for _, h := range strings.Split(host, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			return "", nil, false, errors.Errorf("invalid grpc_host %s, it has an empty host", host)
+		}
+		name, hostPort, err := net.SplitHostPort(h)
+		if err != nil {
+			if port == "" {
+				return "", nil, false, errors.Errorf("invalid grpc_host %s, %s has no port and grpc_port isn't set", host, h)
+			}
+			name, hostPort = strings.Trim(h, "[]"), port
+		}
+		endpoint := net.JoinHostPort(name, hostPort)
+		endpoints = append(endpoints, endpoint)
+		// The server's certificate is verified for its own host.
+		addresses = append(addresses, resolver.Address{Addr: endpoint, ServerName: name})
+	}
+
+	r := manual.NewBuilderWithScheme(fmt.Sprintf("grpc-auth-%d", atomic.AddInt32(&grpcResolvers, 1)))
+	r.InitialState(resolver.State{Addresses: addresses})
+	resolver.Register(r)
+
+	return r.Scheme() + ":///" + strings.Join(endpoints, ","), endpoints, true, nil
+}
+
+// grpcTLSConfig returns the TLS config built from the grpc_ca_cert, grpc_tls_cert
+// and grpc_tls_key files, or nil when grpc_with_tls isn't set and the client
+// is insecure. Without a CA the server is verified against the system ones,
+// and a client certificate is only sent for mutual TLS when given.
+func grpcTLSConfig(authOpts map[string]string) (*tls.Config, error) {
+	caCert := authOpts["grpc_ca_cert"]
+	tlsCert := authOpts["grpc_tls_cert"]
+	tlsKey := authOpts["grpc_tls_key"]
+
+	if !common.BoolOption(authOpts, "grpc_with_tls", false) {
+		if caCert != "" || tlsCert != "" || tlsKey != "" {
+			return nil, errors.New("grpc_with_tls must be true to use grpc_ca_cert, grpc_tls_cert or grpc_tls_key")
+		}
+		return nil, nil
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		return nil, errors.New("grpc_tls_cert and grpc_tls_key must be given together")
+	}
+
+	config := &tls.Config{}
+
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "read grpc_ca_cert error")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in grpc_ca_cert %s", caCert)
+		}
+	}
+
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "load grpc_tls_cert and grpc_tls_key error")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// createClient dials the target with the given options, over TLS when given a
+// config. The endpoints are the addresses behind the target on the network,
+// tcp or unix, which are looked at to tell why when the dial fails. A unix
+// socket is the only endpoint, and is dialed for any target.
+func createClient(network, target string, endpoints []string, tlsConfig *tls.Config, dialOpts []grpc.DialOption) (*grpc.ClientConn, gs.AuthServiceClient, error) {
 	logrusEntry := log.NewEntry(log.StandardLogger())
 	logrusOpts := []grpc_logrus.Option{
 		grpc_logrus.WithLevels(grpc_logrus.DefaultCodeToLevel),
 	}
 
 	nsOpts := []grpc.DialOption{
-		grpc.WithBlock(),
 		grpc.WithUnaryInterceptor(
 			grpc_logrus.UnaryClientInterceptor(logrusEntry, logrusOpts...),
 		),
 	}
 
-	if len(caCert) == 0 && len(tlsCert) == 0 && len(tlsKey) == 0 {
-		nsOpts = append(nsOpts, grpc.WithInsecure())
-		log.WithField("server", hostname).Warning("creating insecure grpc client")
-	} else {
-		log.WithField("server", hostname).Info("creating grpc client")
-		cert, err := tls.X509KeyPair(tlsCert, tlsKey)
-		if err != nil {
-			return nil, nil, errors.Wrap(err, "load x509 keypair error")
-		}
+	nsOpts = append(nsOpts, dialOpts...)
 
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(caCert) {
-			return nil, nil, errors.Wrap(err, "append ca cert to pool error")
-		}
+	server := strings.Join(endpoints, ",")
 
-		nsOpts = append(nsOpts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      caCertPool,
-		})))
+	// gRPC is given a host to dial for the authority, and the socket is
+	// dialed instead of it.
+	if network == "unix" {
+		target = grpcSocketAuthority
+		nsOpts = append(nsOpts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		}))
+	}
+
+	if tlsConfig == nil {
+		nsOpts = append(nsOpts, grpc.WithInsecure())
+		log.WithField("server", server).Warning("creating insecure grpc client")
+	} else {
+		log.WithField("server", server).Info("creating grpc client")
+		nsOpts = append(nsOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
 	defer cancel()
 
-	gsClient, err := grpc.DialContext(ctx, hostname, nsOpts...)
+	gsClient, err := grpc.DialContext(ctx, target, nsOpts...)
 	if err != nil {
+		// A blocking dial only tells it timed out, so a missing socket or a
+		// failed handshake is looked for to tell why.
+		if network == "unix" {
+			conn, sockErr := net.DialTimeout(network, server, 500*time.Millisecond)
+			if sockErr != nil {
+				return nil, nil, errors.Wrapf(sockErr, "grpc socket %s can't be connected to, check the service is running and grpc_socket", server)
+			}
+			conn.Close()
+		}
+		if tlsConfig != nil {
+			for _, endpoint := range endpoints {
+				if tlsErr := probeGRPCTLS(network, endpoint, tlsConfig); tlsErr != nil {
+					return nil, nil, errors.Wrap(tlsErr, "grpc TLS handshake failed, check grpc_ca_cert, grpc_tls_cert and grpc_tls_key")
+				}
+			}
+		}
 		return nil, nil, errors.Wrap(err, "dial grpc api error")
 	}
 
 	return gsClient, gs.NewAuthServiceClient(gsClient), nil
 }
+
+// probeGRPCTLS makes a TLS handshake with the server and waits briefly for its
+// first bytes, as a server rejecting the client certificate may only say so
+// after the handshake completed on the client's side. It returns nil when the
+// server couldn't be reached, as that's no TLS error.
+func probeGRPCTLS(network, address string, tlsConfig *tls.Config) error {
+	config := tlsConfig.Clone()
+	config.NextProtos = []string{"h2"}
+	if network == "unix" && config.ServerName == "" {
+		config.ServerName = grpcSocketAuthority
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 500 * time.Millisecond}, network, address, config)
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package backends
+
+import (
+	"net"
+	"testing"
+
+	gs "github.com/iegomez/mosquitto-go-auth/grpc"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+//benchmarkGRPCAcl runs parallel acl checks against a local server, streamed or with unary calls.
+func benchmarkGRPCAcl(b *testing.B, stream string) {
+	grpcServer := grpc.NewServer()
+	gs.RegisterAuthServiceServer(grpcServer, NewAuthServiceAPI())
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("couldn't listen: %s", err)
+	}
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	g, err := NewGRPC(map[string]string{
+		"grpc_host":               "127.0.0.1",
+		"grpc_port":               port,
+		"grpc_acl_stream":         stream,
+		"grpc_health_interval_ms": "0",
+	}, log.ErrorLevel)
+	if err != nil {
+		b.Fatalf("couldn't create backend: %s", err)
+	}
+	defer g.Halt()
+
+	//The client logs every call.
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.ErrorLevel)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc)
+		}
+	})
+}
+
+func BenchmarkGRPCAclUnary(b *testing.B) {
+	benchmarkGRPCAcl(b, "false")
+}
+
+func BenchmarkGRPCAclStream(b *testing.B) {
+	benchmarkGRPCAcl(b, "true")
+}
@@ -2,11 +2,28 @@ package backends
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/empty"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	log "github.com/sirupsen/logrus"
 
@@ -62,6 +79,19 @@ func (a *AuthServiceAPI) CheckAcl(ctx context.Context, req *gs.CheckAclRequest)
 	}, nil
 }
 
+func (a *AuthServiceAPI) CheckAclStream(stream gs.AuthService_CheckAclStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		resp, _ := a.CheckAcl(stream.Context(), req.Check)
+		if err := stream.Send(&gs.CheckAclStreamResponse{Id: req.Id, Response: resp}); err != nil {
+			return err
+		}
+	}
+}
+
 func (a *AuthServiceAPI) GetName(ctx context.Context, req *empty.Empty) (*gs.NameResponse, error) {
 	return &gs.NameResponse{
 		Name: "MyGRPCBackend",
@@ -130,3 +160,1180 @@ func TestGRPC(t *testing.T) {
 	})
 
 }
+
+func TestGRPCTLS(t *testing.T) {
+
+	certs, err := writeTestCerts()
+	defer os.RemoveAll(certs.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	otherCerts, err := writeTestCerts()
+	defer os.RemoveAll(otherCerts.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	//Servers verifying client certificates or not, both presenting a certificate for 127.0.0.1 signed by the test CA.
+	serve := func(clientAuth tls.ClientAuthType) (string, func(), error) {
+		cert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+		if err != nil {
+			return "", nil, err
+		}
+		pem, err := ioutil.ReadFile(certs.CA)
+		if err != nil {
+			return "", nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		clientCAs.AppendCertsFromPEM(pem)
+
+		grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   clientAuth,
+		})))
+		gs.RegisterAuthServiceServer(grpcServer, NewAuthServiceAPI())
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", nil, err
+		}
+		go grpcServer.Serve(lis)
+
+		_, port, _ := net.SplitHostPort(lis.Addr().String())
+		return port, grpcServer.Stop, nil
+	}
+
+	tlsPort, stopTLS, err := serve(tls.NoClientCert)
+	if err != nil {
+		t.Fatalf("couldn't start TLS grpc server: %s", err)
+	}
+	defer stopTLS()
+
+	mtlsPort, stopMTLS, err := serve(tls.RequireAndVerifyClientCert)
+	if err != nil {
+		t.Fatalf("couldn't start mTLS grpc server: %s", err)
+	}
+	defer stopMTLS()
+
+	authOpts := func(port string, opts map[string]string) map[string]string {
+		opts["grpc_host"] = "127.0.0.1"
+		opts["grpc_port"] = port
+		return opts
+	}
+
+	Convey("Given wrong TLS options NewGRPC should fail before connecting", t, func() {
+		for _, c := range []struct {
+			opts map[string]string
+			err  string
+		}{
+			{map[string]string{"grpc_ca_cert": certs.CA}, "grpc_with_tls must be true"},
+			{map[string]string{"grpc_with_tls": "true", "grpc_ca_cert": filepath.Join(certs.Dir, "missing.pem")}, "read grpc_ca_cert error"},
+			{map[string]string{"grpc_with_tls": "true", "grpc_ca_cert": certs.ClientKey}, "no certificates found"},
+			{map[string]string{"grpc_with_tls": "true", "grpc_tls_key": certs.ClientKey}, "must be given together"},
+			{map[string]string{"grpc_with_tls": "true", "grpc_tls_cert": certs.ClientCert}, "must be given together"},
+			{map[string]string{"grpc_with_tls": "true", "grpc_tls_cert": certs.ClientCert, "grpc_tls_key": otherCerts.ClientKey}, "load grpc_tls_cert and grpc_tls_key error"},
+			{map[string]string{"grpc_with_tls": "true", "grpc_tls_cert": certs.CA, "grpc_tls_key": certs.CA}, "load grpc_tls_cert and grpc_tls_key error"},
+		} {
+			_, err := NewGRPC(authOpts(tlsPort, c.opts), log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, c.err)
+		}
+	})
+
+	Convey("Given a TLS server and its CA, the backend should connect and check", t, func() {
+		g, err := NewGRPC(authOpts(tlsPort, map[string]string{"grpc_with_tls": "true", "grpc_ca_cert": certs.CA}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+		So(g.GetUser(grpcUsername, "wrong"), ShouldBeFalse)
+		So(g.GetSuperuser(grpcSuperuser), ShouldBeTrue)
+		So(g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc), ShouldBeTrue)
+	})
+
+	Convey("Given a server whose certificate isn't signed by the CA, the handshake should fail", t, func() {
+		_, err := NewGRPC(authOpts(tlsPort, map[string]string{"grpc_with_tls": "true", "grpc_ca_cert": otherCerts.CA}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "TLS handshake failed")
+
+		Convey("Nor should the system CAs verify it", func() {
+			_, err := NewGRPC(authOpts(tlsPort, map[string]string{"grpc_with_tls": "true"}), log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "TLS handshake failed")
+		})
+	})
+
+	Convey("Given an insecure client, a TLS server should be unreachable", t, func() {
+		_, err := NewGRPC(authOpts(tlsPort, map[string]string{}), log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given a server requiring client certificates, the backend should connect with one", t, func() {
+		g, err := NewGRPC(authOpts(mtlsPort, map[string]string{
+			"grpc_with_tls": "true",
+			"grpc_ca_cert":  certs.CA,
+			"grpc_tls_cert": certs.ClientCert,
+			"grpc_tls_key":  certs.ClientKey,
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+		So(g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc), ShouldBeTrue)
+
+		Convey("Without a client certificate the handshake should fail", func() {
+			_, err := NewGRPC(authOpts(mtlsPort, map[string]string{"grpc_with_tls": "true", "grpc_ca_cert": certs.CA}), log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "TLS handshake failed")
+		})
+
+		Convey("With a client certificate signed by another CA the handshake should fail", func() {
+			_, err := NewGRPC(authOpts(mtlsPort, map[string]string{
+				"grpc_with_tls": "true",
+				"grpc_ca_cert":  certs.CA,
+				"grpc_tls_cert": otherCerts.ClientCert,
+				"grpc_tls_key":  otherCerts.ClientKey,
+			}), log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "TLS handshake failed")
+		})
+	})
+}
+
+//flakyAuthService fails its first failures calls with code, or by answering after delay when it's set, and then answers as AuthServiceAPI.
+type flakyAuthService struct {
+	*AuthServiceAPI
+	failures int32
+	code     codes.Code
+	delay    time.Duration
+	calls    int32
+}
+
+func (a *flakyAuthService) fail(ctx context.Context) error {
+	if atomic.AddInt32(&a.calls, 1) > a.failures {
+		return nil
+	}
+	if a.delay > 0 {
+		select {
+		case <-time.After(a.delay):
+		case <-ctx.Done():
+		}
+		return status.Error(codes.DeadlineExceeded, "too slow")
+	}
+	return status.Error(a.code, "failing on purpose")
+}
+
+func (a *flakyAuthService) GetUser(ctx context.Context, req *gs.GetUserRequest) (*gs.AuthResponse, error) {
+	if err := a.fail(ctx); err != nil {
+		return nil, err
+	}
+	return a.AuthServiceAPI.GetUser(ctx, req)
+}
+
+func (a *flakyAuthService) CheckAcl(ctx context.Context, req *gs.CheckAclRequest) (*gs.AuthResponse, error) {
+	if err := a.fail(ctx); err != nil {
+		return nil, err
+	}
+	return a.AuthServiceAPI.CheckAcl(ctx, req)
+}
+
+func TestGRPCRetries(t *testing.T) {
+
+	service := &flakyAuthService{AuthServiceAPI: NewAuthServiceAPI()}
+	grpcServer := grpc.NewServer()
+	gs.RegisterAuthServiceServer(grpcServer, service)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	port := strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)
+	authOpts := func(opts map[string]string) map[string]string {
+		opts["grpc_host"] = "127.0.0.1"
+		opts["grpc_port"] = port
+		return opts
+	}
+
+	//fails resets the service to fail the next calls.
+	fails := func(failures int32, code codes.Code, delay time.Duration) {
+		atomic.StoreInt32(&service.calls, 0)
+		service.failures, service.code, service.delay = failures, code, delay
+	}
+
+	Convey("Given invalid options, NewGRPC should warn and use the defaults", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{
+			"grpc_timeout_ms":         "0",
+			"grpc_retries":            "-1",
+			"grpc_fail_on_dial_error": "maybe",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+		So(g.timeout, ShouldEqual, grpcDefaultTimeout)
+		So(g.retries, ShouldEqual, 0)
+	})
+
+	Convey("Given retries, transient failures should be retried up to the limit", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{"grpc_retries": "2", "grpc_timeout_ms": "200"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(g.retries, ShouldEqual, 2)
+		So(g.timeout, ShouldEqual, 200*time.Millisecond)
+
+		fails(2, codes.Unavailable, 0)
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+		So(atomic.LoadInt32(&service.calls), ShouldEqual, 3)
+
+		fails(3, codes.Unavailable, 0)
+		granted, ttl := g.GetUserTTL(grpcUsername, grpcPassword)
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+		So(atomic.LoadInt32(&service.calls), ShouldEqual, 3)
+
+		Convey("Calls running past the deadline should be retried too", func() {
+			fails(1, codes.OK, time.Second)
+			start := time.Now()
+			So(g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc), ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(atomic.LoadInt32(&service.calls), ShouldEqual, 2)
+
+			fails(3, codes.OK, time.Second)
+			granted, ttl := g.CheckAclTTL(grpcUsername, grpcTopic, grpcClientId, grpcAcc)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+		})
+
+		Convey("Other errors should never be retried, nor their denials kept from the cache", func() {
+			fails(1, codes.PermissionDenied, 0)
+			granted, ttl := g.GetUserTTL(grpcUsername, grpcPassword)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, NoTTL)
+			So(atomic.LoadInt32(&service.calls), ShouldEqual, 1)
+		})
+
+		Convey("Denials should never be retried", func() {
+			fails(0, codes.OK, 0)
+			So(g.GetUser(grpcUsername, "wrong"), ShouldBeFalse)
+			So(g.CheckAcl(grpcUsername, "wrong/topic", grpcClientId, grpcAcc), ShouldBeFalse)
+			So(atomic.LoadInt32(&service.calls), ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given no retries, a transient failure should deny the check at once", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(g.timeout, ShouldEqual, grpcDefaultTimeout)
+
+		fails(1, codes.Unavailable, 0)
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeFalse)
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+		So(atomic.LoadInt32(&service.calls), ShouldEqual, 2)
+	})
+
+	Convey("Given the service is down on startup", t, func() {
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		freePort := strconv.Itoa(free.Addr().(*net.TCPAddr).Port)
+		free.Close()
+
+		Convey("The backend should fail to start by default", func() {
+			_, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": freePort}, log.DebugLevel)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Without failing on dial errors, calls should wait for it to come up", func() {
+			fails(0, codes.OK, 0)
+			g, err := NewGRPC(map[string]string{
+				"grpc_host":               "127.0.0.1",
+				"grpc_port":               freePort,
+				"grpc_fail_on_dial_error": "false",
+				"grpc_timeout_ms":         "3000",
+			}, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			late := grpc.NewServer()
+			gs.RegisterAuthServiceServer(late, service)
+			go func() {
+				time.Sleep(300 * time.Millisecond)
+				lis, err := net.Listen("tcp", "127.0.0.1:"+freePort)
+				if err == nil {
+					late.Serve(lis)
+				}
+			}()
+			defer late.Stop()
+
+			So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+		})
+	})
+}
+
+//metadataAuthService records the metadata received by each method before answering as AuthServiceAPI.
+type metadataAuthService struct {
+	*AuthServiceAPI
+	mu       sync.Mutex
+	received map[string]metadata.MD
+}
+
+func (a *metadataAuthService) record(ctx context.Context, method string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.received[method] = md
+}
+
+func (a *metadataAuthService) GetUser(ctx context.Context, req *gs.GetUserRequest) (*gs.AuthResponse, error) {
+	a.record(ctx, "GetUser")
+	return a.AuthServiceAPI.GetUser(ctx, req)
+}
+
+func (a *metadataAuthService) GetSuperuser(ctx context.Context, req *gs.GetSuperuserRequest) (*gs.AuthResponse, error) {
+	a.record(ctx, "GetSuperuser")
+	return a.AuthServiceAPI.GetSuperuser(ctx, req)
+}
+
+func (a *metadataAuthService) CheckAcl(ctx context.Context, req *gs.CheckAclRequest) (*gs.AuthResponse, error) {
+	a.record(ctx, "CheckAcl")
+	return a.AuthServiceAPI.CheckAcl(ctx, req)
+}
+
+func TestGRPCMetadata(t *testing.T) {
+
+	service := &metadataAuthService{AuthServiceAPI: NewAuthServiceAPI(), received: map[string]metadata.MD{}}
+	grpcServer := grpc.NewServer()
+	gs.RegisterAuthServiceServer(grpcServer, service)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	port := strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)
+	authOpts := func(opts map[string]string) map[string]string {
+		opts["grpc_host"] = "127.0.0.1"
+		opts["grpc_port"] = port
+		return opts
+	}
+
+	dir, err := ioutil.TempDir("", "go-auth-grpc")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("couldn't write token: %s", err)
+	}
+
+	//checks runs the three check RPCs and returns the metadata each one received.
+	checks := func(g GRPC) map[string]metadata.MD {
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+		So(g.GetSuperuser(grpcSuperuser), ShouldBeTrue)
+		So(g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc), ShouldBeTrue)
+
+		service.mu.Lock()
+		defer service.mu.Unlock()
+		received := service.received
+		service.received = map[string]metadata.MD{}
+		return received
+	}
+
+	Convey("Given an auth token and metadata, every check should carry them", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{
+			"grpc_auth_token": "secret-token",
+			"grpc_metadata":   "X-Tenant:acme, x-region:eu-west:1",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		received := checks(g)
+		So(received, ShouldHaveLength, 3)
+		for _, md := range received {
+			So(md["authorization"], ShouldResemble, []string{"Bearer secret-token"})
+			So(md["x-tenant"], ShouldResemble, []string{"acme"})
+			So(md["x-region"], ShouldResemble, []string{"eu-west:1"})
+		}
+	})
+
+	Convey("Given a token file, its trimmed contents should be sent", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{"grpc_auth_token_file": tokenFile}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		received := checks(g)
+		So(received, ShouldHaveLength, 3)
+		for _, md := range received {
+			So(md["authorization"], ShouldResemble, []string{"Bearer file-token"})
+		}
+	})
+
+	Convey("Given a token file along with a token, the file's should take precedence", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{"grpc_auth_token": "inline-token", "grpc_auth_token_file": tokenFile}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		for _, md := range checks(g) {
+			So(md["authorization"], ShouldResemble, []string{"Bearer file-token"})
+		}
+	})
+
+	Convey("Given no token nor metadata, no authorization should be sent", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		for _, md := range checks(g) {
+			So(md["authorization"], ShouldBeNil)
+		}
+	})
+
+	Convey("Given invalid metadata options, NewGRPC should fail without showing secrets", t, func() {
+		for _, c := range []struct {
+			opts map[string]string
+			err  string
+		}{
+			{map[string]string{"grpc_metadata": "x-api-key secret-value"}, "grpc_metadata"},
+			{map[string]string{"grpc_metadata": ":secret-value"}, "grpc_metadata"},
+			{map[string]string{"grpc_auth_token_file": filepath.Join(dir, "missing")}, "grpc_auth_token_file"},
+			{map[string]string{"grpc_auth_token": " "}, "empty"},
+			{map[string]string{"grpc_auth_token": "secret-value", "grpc_metadata": "Authorization:other"}, "authorization"},
+		} {
+			_, err := NewGRPC(authOpts(c.opts), log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, c.err)
+			So(err.Error(), ShouldNotContainSubstring, "secret-value")
+		}
+	})
+}
+
+func TestGRPCHealth(t *testing.T) {
+
+	healthServer := health.NewServer()
+
+	//serve serves the auth and health services on the address until the returned server is stopped.
+	serve := func(addr string) (*grpc.Server, string, error) {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		grpcServer := grpc.NewServer()
+		gs.RegisterAuthServiceServer(grpcServer, NewAuthServiceAPI())
+		healthpb.RegisterHealthServer(grpcServer, healthServer)
+		go grpcServer.Serve(lis)
+		return grpcServer, lis.Addr().String(), nil
+	}
+
+	grpcServer, addr, err := serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer func() {
+		grpcServer.Stop()
+	}()
+
+	host, port, _ := net.SplitHostPort(addr)
+	authOpts := map[string]string{
+		"grpc_host":               host,
+		"grpc_port":               port,
+		"grpc_timeout_ms":         "500",
+		"grpc_health_interval_ms": "50",
+		"grpc_backoff_max_ms":     "100",
+		"grpc_keepalive_ms":       "10000",
+	}
+
+	//eventually waits up to a few seconds for the backend's health to be the expected one.
+	eventually := func(g GRPC, healthy bool) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if g.Healthy() == healthy {
+				return true
+			}
+		}
+		return false
+	}
+
+	Convey("Given invalid durations, NewGRPC should warn and use the defaults", t, func() {
+		g, err := NewGRPC(map[string]string{
+			"grpc_host":               host,
+			"grpc_port":               port,
+			"grpc_backoff_max_ms":     "0",
+			"grpc_keepalive_ms":       "-1",
+			"grpc_health_interval_ms": "often",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+		So(g.Healthy(), ShouldBeTrue)
+	})
+
+	Convey("Given a healthy service, the backend should be healthy and check", t, func() {
+		g, err := NewGRPC(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		So(g.Healthy(), ShouldBeTrue)
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+
+		Convey("A service no longer serving should make it unhealthy until it serves again", func() {
+			healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+			So(eventually(g, false), ShouldBeTrue)
+
+			healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+			So(eventually(g, true), ShouldBeTrue)
+		})
+
+		Convey("A restarted service should be reconnected to without restarting the broker", func() {
+			grpcServer.Stop()
+			So(eventually(g, false), ShouldBeTrue)
+
+			//Checks fail while the service is down.
+			granted, ttl := g.GetUserTTL(grpcUsername, grpcPassword)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+
+			grpcServer, _, err = serve(addr)
+			So(err, ShouldBeNil)
+			So(eventually(g, true), ShouldBeTrue)
+
+			So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+			So(g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given health checking is disabled, the backend should always be healthy", t, func() {
+		g, err := NewGRPC(map[string]string{"grpc_host": host, "grpc_port": port, "grpc_health_interval_ms": "0"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		So(g.health, ShouldBeNil)
+		So(g.Healthy(), ShouldBeTrue)
+	})
+
+	Convey("Given a service without health checking, the backend should stay healthy", t, func() {
+		plain := grpc.NewServer()
+		gs.RegisterAuthServiceServer(plain, NewAuthServiceAPI())
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go plain.Serve(lis)
+		defer plain.Stop()
+
+		_, plainPort, _ := net.SplitHostPort(lis.Addr().String())
+		g, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": plainPort, "grpc_health_interval_ms": "50"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		time.Sleep(200 * time.Millisecond)
+		So(g.Healthy(), ShouldBeTrue)
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+	})
+}
+
+func TestGRPCSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatalf("couldn't create socket dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certs, err := writeTestCerts()
+	defer os.RemoveAll(certs.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	//serve serves the auth service on a socket in dir, with the given server options.
+	serve := func(name string, opts ...grpc.ServerOption) (string, func(), error) {
+		socket := filepath.Join(dir, name)
+		lis, err := net.Listen("unix", socket)
+		if err != nil {
+			return "", nil, err
+		}
+		grpcServer := grpc.NewServer(opts...)
+		gs.RegisterAuthServiceServer(grpcServer, NewAuthServiceAPI())
+		go grpcServer.Serve(lis)
+		return socket, grpcServer.Stop, nil
+	}
+
+	socket, stop, err := serve("authz.sock")
+	if err != nil {
+		t.Fatalf("couldn't start grpc server: %s", err)
+	}
+	defer stop()
+
+	cert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+	if err != nil {
+		t.Fatalf("couldn't load server cert: %s", err)
+	}
+	tlsSocket, stopTLS, err := serve("authz-tls.sock", grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	if err != nil {
+		t.Fatalf("couldn't start TLS grpc server: %s", err)
+	}
+	defer stopTLS()
+
+	Convey("Given conflicting socket options, NewGRPC should fail", t, func() {
+		for _, c := range []struct {
+			opts map[string]string
+			err  string
+		}{
+			{map[string]string{"grpc_socket": socket, "grpc_host": "localhost"}, "can't be given together"},
+			{map[string]string{"grpc_socket": socket, "grpc_host": "unix://" + socket}, "can't be given together"},
+			{map[string]string{"grpc_socket": ""}, "socket path is empty"},
+			{map[string]string{"grpc_host": "unix://"}, "socket path is empty"},
+		} {
+			_, err := NewGRPC(c.opts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, c.err)
+		}
+	})
+
+	Convey("Given a socket, the backend should connect and check", t, func() {
+		for _, opts := range []map[string]string{
+			{"grpc_socket": socket},
+			{"grpc_host": "unix://" + socket},
+		} {
+			g, err := NewGRPC(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+			So(g.GetUser(grpcUsername, "wrong"), ShouldBeFalse)
+			So(g.GetSuperuser(grpcSuperuser), ShouldBeTrue)
+			So(g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc), ShouldBeTrue)
+			So(g.GetName(), ShouldEqual, "MyGRPCBackend")
+
+			g.Halt()
+		}
+	})
+
+	Convey("Given TLS over a socket, the server should be verified as localhost", t, func() {
+		g, err := NewGRPC(map[string]string{"grpc_socket": tlsSocket, "grpc_with_tls": "true", "grpc_ca_cert": certs.CA}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+
+		Convey("And an insecure client shouldn't reach it", func() {
+			_, err := NewGRPC(map[string]string{"grpc_socket": tlsSocket}, log.DebugLevel)
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("Given a missing socket, NewGRPC should tell it can't be connected to", t, func() {
+		_, err := NewGRPC(map[string]string{"grpc_socket": filepath.Join(dir, "missing.sock")}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "grpc socket")
+		So(err.Error(), ShouldContainSubstring, "no such file or directory")
+	})
+}
+
+//richAuthService answers with the responses set per username, counting the acl checks it's asked, and as AuthServiceAPI for other users.
+type richAuthService struct {
+	*AuthServiceAPI
+	users     map[string]*gs.AuthResponse
+	aclChecks int32
+}
+
+func (a *richAuthService) GetUser(ctx context.Context, req *gs.GetUserRequest) (*gs.AuthResponse, error) {
+	if resp, ok := a.users[req.Username]; ok {
+		return resp, nil
+	}
+	return a.AuthServiceAPI.GetUser(ctx, req)
+}
+
+func (a *richAuthService) CheckAcl(ctx context.Context, req *gs.CheckAclRequest) (*gs.AuthResponse, error) {
+	atomic.AddInt32(&a.aclChecks, 1)
+	if resp, ok := a.users[req.Username]; ok {
+		return resp, nil
+	}
+	return a.AuthServiceAPI.CheckAcl(ctx, req)
+}
+
+func TestGRPCRichResponses(t *testing.T) {
+
+	service := &richAuthService{
+		AuthServiceAPI: NewAuthServiceAPI(),
+		users: map[string]*gs.AuthResponse{
+			"admin":     {Ok: true, IsSuperuser: true, Reason: "admin role", CacheTtlSeconds: 300},
+			"operator":  {Ok: true, IsSuperuser: true, Reason: "operator role"},
+			"ephemeral": {Ok: true, IsSuperuser: true, CacheTtlSeconds: -1},
+			"banned":    {Ok: false, Reason: "banned", CacheTtlSeconds: 60},
+		},
+	}
+
+	grpcServer := grpc.NewServer()
+	gs.RegisterAuthServiceServer(grpcServer, service)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	authOpts := func(opts map[string]string) map[string]string {
+		opts["grpc_host"] = "127.0.0.1"
+		opts["grpc_port"] = port
+		return opts
+	}
+
+	Convey("The new response fields should survive a round trip, and be zero for older services", t, func() {
+		resp := &gs.AuthResponse{Ok: true, IsSuperuser: true, Reason: "admin role", CacheTtlSeconds: -1}
+		b, err := proto.Marshal(resp)
+		So(err, ShouldBeNil)
+
+		decoded := &gs.AuthResponse{}
+		So(proto.Unmarshal(b, decoded), ShouldBeNil)
+		So(proto.Equal(decoded, resp), ShouldBeTrue)
+
+		//An older service only sets ok, field 1.
+		old := &gs.AuthResponse{}
+		So(proto.Unmarshal([]byte{0x08, 0x01}, old), ShouldBeNil)
+		So(old.Ok, ShouldBeTrue)
+		So(old.IsSuperuser, ShouldBeFalse)
+		So(old.Reason, ShouldEqual, "")
+		So(old.CacheTtlSeconds, ShouldEqual, 0)
+	})
+
+	Convey("Given an invalid grpc_superuser_hints, NewGRPC should warn and leave hints off", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{"grpc_superuser_hints": "maybe"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+		So(g.superusers, ShouldBeNil)
+	})
+
+	Convey("Given rich responses, their ttls should be handed to the cache", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		granted, ttl := g.GetUserTTL("admin", "any")
+		So(granted, ShouldBeTrue)
+		So(ttl, ShouldEqual, 300*time.Second)
+
+		granted, ttl = g.GetUserTTL("banned", "any")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, time.Minute)
+
+		granted, ttl = g.CheckAclTTL("ephemeral", grpcTopic, grpcClientId, grpcAcc)
+		So(granted, ShouldBeTrue)
+		So(ttl, ShouldEqual, SkipCache)
+
+		//Responses of older services carry no hint.
+		granted, ttl = g.GetUserTTL(grpcUsername, grpcPassword)
+		So(granted, ShouldBeTrue)
+		So(ttl, ShouldEqual, NoTTL)
+
+		Convey("Without grpc_superuser_hints, superuser hints should be ignored", func() {
+			So(g.GetSuperuser("admin"), ShouldBeFalse)
+
+			calls := atomic.LoadInt32(&service.aclChecks)
+			g.CheckAcl("admin", grpcTopic, grpcClientId, grpcAcc)
+			So(atomic.LoadInt32(&service.aclChecks), ShouldEqual, calls+1)
+		})
+	})
+
+	Convey("Given grpc_superuser_hints, hinted superusers shouldn't be asked for superuser checks but still for acls", t, func() {
+		g, err := NewGRPC(authOpts(map[string]string{"grpc_superuser_hints": "true"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		So(g.GetUser("admin", "any"), ShouldBeTrue)
+		So(g.GetSuperuser("admin"), ShouldBeTrue)
+
+		calls := atomic.LoadInt32(&service.aclChecks)
+		granted, ttl := g.CheckAclTTL("admin", "any/topic", grpcClientId, 2)
+		So(granted, ShouldBeTrue)
+		So(ttl, ShouldEqual, 300*time.Second)
+		So(atomic.LoadInt32(&service.aclChecks), ShouldEqual, calls+1)
+
+		Convey("A hint without a ttl should be replaced by the next login", func() {
+			So(g.GetUser("operator", "any"), ShouldBeTrue)
+			So(g.GetSuperuser("operator"), ShouldBeTrue)
+
+			service.users["operator"] = &gs.AuthResponse{Ok: true}
+			So(g.GetUser("operator", "any"), ShouldBeTrue)
+			So(g.GetSuperuser("operator"), ShouldBeFalse)
+		})
+
+		Convey("A hint that mustn't be cached shouldn't be kept", func() {
+			So(g.GetUser("ephemeral", "any"), ShouldBeTrue)
+			So(g.GetSuperuser("ephemeral"), ShouldBeFalse)
+		})
+
+		Convey("Other users should still be asked", func() {
+			So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+			So(g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc), ShouldBeTrue)
+			So(g.CheckAcl(grpcUsername, "other/topic", grpcClientId, grpcAcc), ShouldBeFalse)
+			So(atomic.LoadInt32(&service.aclChecks), ShouldEqual, calls+3)
+		})
+	})
+
+	Convey("Superuser hints should expire with their ttl", t, func() {
+		hints := &grpcSuperusers{expirations: make(map[string]time.Time)}
+		hints.set("admin", true, 50*time.Millisecond)
+		So(hints.has("admin"), ShouldBeTrue)
+
+		time.Sleep(100 * time.Millisecond)
+		So(hints.has("admin"), ShouldBeFalse)
+	})
+
+	Convey("Superuser hints without a ttl should get the default one, and expired ones shouldn't pile up", t, func() {
+		hints := &grpcSuperusers{expirations: make(map[string]time.Time)}
+		hints.set("operator", true, NoTTL)
+		So(hints.expirations["operator"], ShouldHappenWithin, time.Second, time.Now().Add(grpcDefaultSuperuserHintTTL))
+
+		hints.set("admin", true, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		hints.set("other", true, time.Minute)
+		So(hints.expirations, ShouldHaveLength, 2)
+		So(hints.has("operator"), ShouldBeTrue)
+		So(hints.has("other"), ShouldBeTrue)
+	})
+}
+
+//streamAuthService answers acl checks as AuthServiceAPI, streamed ones concurrently and so out of order, counting unary checks and opened streams.
+//A stream fails with code after answering breakAfter checks when it's set, and when unimplemented it isn't served at all.
+type streamAuthService struct {
+	*AuthServiceAPI
+	unimplemented bool
+	breakAfter    int
+	code          codes.Code
+	unaryChecks   int32
+	streams       int32
+}
+
+func (a *streamAuthService) CheckAcl(ctx context.Context, req *gs.CheckAclRequest) (*gs.AuthResponse, error) {
+	atomic.AddInt32(&a.unaryChecks, 1)
+	return a.AuthServiceAPI.CheckAcl(ctx, req)
+}
+
+func (a *streamAuthService) CheckAclStream(stream gs.AuthService_CheckAclStreamServer) error {
+	if a.unimplemented {
+		return status.Error(codes.Unimplemented, "unknown method CheckAclStream")
+	}
+	atomic.AddInt32(&a.streams, 1)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for n := 1; ; n++ {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if a.breakAfter > 0 && n > a.breakAfter {
+			return status.Error(a.code, "stream broken")
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := a.AuthServiceAPI.CheckAcl(stream.Context(), req.Check)
+			time.Sleep(time.Duration(req.Id%5) * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			stream.Send(&gs.CheckAclStreamResponse{Id: req.Id, Response: resp})
+		}()
+	}
+}
+
+//stalledAuthService opens acl streams but never reads from them, so sends on them end up blocked by flow control.
+type stalledAuthService struct {
+	*AuthServiceAPI
+	streams int32
+}
+
+func (a *stalledAuthService) CheckAclStream(stream gs.AuthService_CheckAclStreamServer) error {
+	atomic.AddInt32(&a.streams, 1)
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestGRPCAclStream(t *testing.T) {
+
+	//serve serves the service on a local port until the returned func is called.
+	serve := func(service gs.AuthServiceServer) (string, func()) {
+		grpcServer := grpc.NewServer()
+		gs.RegisterAuthServiceServer(grpcServer, service)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("couldn't listen: %s", err)
+		}
+		go grpcServer.Serve(lis)
+		_, port, _ := net.SplitHostPort(lis.Addr().String())
+		return port, grpcServer.Stop
+	}
+
+	//checkConcurrently makes n concurrent acl checks, every other one for a topic that's denied, and tells if all were answered right.
+	checkConcurrently := func(g GRPC, n int) bool {
+		var wrong int32
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				topic, want := grpcTopic, true
+				if i%2 == 1 {
+					topic, want = "denied/topic", false
+				}
+				if g.CheckAcl(grpcUsername, topic, grpcClientId, grpcAcc) != want {
+					atomic.AddInt32(&wrong, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		return wrong == 0
+	}
+
+	Convey("Given an invalid grpc_acl_stream, NewGRPC should warn and leave the stream off", t, func() {
+		port, stop := serve(NewAuthServiceAPI())
+		defer stop()
+
+		g, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": port, "grpc_acl_stream": "maybe"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+		So(g.aclStream, ShouldBeNil)
+	})
+
+	Convey("Given a service implementing the stream, concurrent checks should be multiplexed on it", t, func() {
+		service := &streamAuthService{AuthServiceAPI: NewAuthServiceAPI()}
+		port, stop := serve(service)
+		defer stop()
+
+		g, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": port, "grpc_acl_stream": "true"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		So(checkConcurrently(g, 200), ShouldBeTrue)
+		So(atomic.LoadInt32(&service.streams), ShouldEqual, 1)
+		So(atomic.LoadInt32(&service.unaryChecks), ShouldEqual, 0)
+	})
+
+	Convey("Given a service not implementing the stream, checks should fall back to unary calls", t, func() {
+		service := &streamAuthService{AuthServiceAPI: NewAuthServiceAPI(), unimplemented: true}
+		port, stop := serve(service)
+		defer stop()
+
+		g, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": port, "grpc_acl_stream": "true"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		So(checkConcurrently(g, 20), ShouldBeTrue)
+		So(g.aclStream.supported(), ShouldBeFalse)
+
+		//Once told, the stream isn't tried again.
+		calls := atomic.LoadInt32(&service.unaryChecks)
+		So(checkConcurrently(g, 10), ShouldBeTrue)
+		So(atomic.LoadInt32(&service.unaryChecks), ShouldEqual, calls+10)
+	})
+
+	Convey("Given a stream that breaks, checks should still be answered and the stream opened again", t, func() {
+		service := &streamAuthService{AuthServiceAPI: NewAuthServiceAPI(), breakAfter: 25, code: codes.Unavailable}
+		port, stop := serve(service)
+		defer stop()
+
+		g, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": port, "grpc_acl_stream": "true"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		for i := 0; i < 5; i++ {
+			So(checkConcurrently(g, 40), ShouldBeTrue)
+		}
+		So(atomic.LoadInt32(&service.streams), ShouldBeGreaterThan, 1)
+		So(g.aclStream.supported(), ShouldBeTrue)
+	})
+
+	Convey("Given a restarted service, the stream should be opened again", t, func() {
+		service := &streamAuthService{AuthServiceAPI: NewAuthServiceAPI()}
+		grpcServer := grpc.NewServer()
+		gs.RegisterAuthServiceServer(grpcServer, service)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go grpcServer.Serve(lis)
+
+		addr := lis.Addr().String()
+		_, port, _ := net.SplitHostPort(addr)
+		g, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": port, "grpc_acl_stream": "true", "grpc_backoff_max_ms": "100"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		So(checkConcurrently(g, 10), ShouldBeTrue)
+		grpcServer.Stop()
+
+		grpcServer = grpc.NewServer()
+		gs.RegisterAuthServiceServer(grpcServer, service)
+		lis, err = net.Listen("tcp", addr)
+		So(err, ShouldBeNil)
+		go grpcServer.Serve(lis)
+		defer grpcServer.Stop()
+
+		So(checkConcurrently(g, 10), ShouldBeTrue)
+
+		//The first checks after the restart may have been made with unary calls while the connection was coming back.
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&service.streams) < 2 && time.Now().Before(deadline); {
+			g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc)
+		}
+		So(atomic.LoadInt32(&service.streams), ShouldEqual, 2)
+	})
+
+	Convey("Given a service that stops reading the stream, blocked sends should give up at the check's deadline and break the stream", t, func() {
+		service := &stalledAuthService{AuthServiceAPI: NewAuthServiceAPI()}
+		port, stop := serve(service)
+		defer stop()
+
+		g, err := NewGRPC(map[string]string{"grpc_host": "127.0.0.1", "grpc_port": port, "grpc_acl_stream": "true"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		//check makes a check whose request is big enough to fill the flow control window soon, telling if it returned in time.
+		check := func() (bool, error) {
+			done := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				_, err := g.aclStream.check(ctx, &gs.CheckAclRequest{Username: grpcUsername, Topic: strings.Repeat("a", 1<<20), Clientid: grpcClientId, Acc: grpcAcc})
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				return true, err
+			case <-time.After(2 * time.Second):
+				return false, nil
+			}
+		}
+
+		//Checks aren't answered, and once one's send is blocked the stream is broken, so a later check opens a new one instead of waiting on it.
+		for i := 0; i < 100 && atomic.LoadInt32(&service.streams) < 2; i++ {
+			returned, err := check()
+			So(returned, ShouldBeTrue)
+			So(err, ShouldNotBeNil)
+		}
+		So(atomic.LoadInt32(&service.streams), ShouldEqual, 2)
+	})
+}
+
+//countingAuthService answers as AuthServiceAPI, counting the users it's asked to check.
+type countingAuthService struct {
+	*AuthServiceAPI
+	users int32
+}
+
+func (a *countingAuthService) GetUser(ctx context.Context, req *gs.GetUserRequest) (*gs.AuthResponse, error) {
+	atomic.AddInt32(&a.users, 1)
+	return a.AuthServiceAPI.GetUser(ctx, req)
+}
+
+func TestGRPCBalancing(t *testing.T) {
+
+	type replica struct {
+		service *countingAuthService
+		health  *health.Server
+		server  *grpc.Server
+		addr    string
+	}
+
+	replicas := make([]*replica, 2)
+	for i := range replicas {
+		r := &replica{
+			service: &countingAuthService{AuthServiceAPI: NewAuthServiceAPI()},
+			health:  health.NewServer(),
+			server:  grpc.NewServer(),
+		}
+		gs.RegisterAuthServiceServer(r.server, r.service)
+		healthpb.RegisterHealthServer(r.server, r.health)
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("couldn't listen: %s", err)
+		}
+		go r.server.Serve(lis)
+		defer r.server.Stop()
+
+		r.addr = lis.Addr().String()
+		replicas[i] = r
+	}
+
+	//spread makes n checks and returns how many each replica was asked.
+	spread := func(g GRPC, n int) ([]int32, bool) {
+		before := make([]int32, len(replicas))
+		for i, r := range replicas {
+			before[i] = atomic.LoadInt32(&r.service.users)
+		}
+		ok := true
+		for i := 0; i < n; i++ {
+			ok = g.GetUser(grpcUsername, grpcPassword) && ok
+		}
+		counts := make([]int32, len(replicas))
+		for i, r := range replicas {
+			counts[i] = atomic.LoadInt32(&r.service.users) - before[i]
+		}
+		return counts, ok
+	}
+
+	Convey("Given invalid host lists, NewGRPC should fail", t, func() {
+		for _, c := range []struct {
+			host, port, err string
+		}{
+			{replicas[0].addr + ",," + replicas[1].addr, "", "empty host"},
+			{replicas[0].addr + ",127.0.0.1", "", "has no port"},
+			{"dns:///", "50051", "dns name is empty"},
+		} {
+			_, err := NewGRPC(map[string]string{"grpc_host": c.host, "grpc_port": c.port}, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, c.err)
+		}
+	})
+
+	Convey("Given a list of replicas, checks should be spread over all of them", t, func() {
+		g, err := NewGRPC(map[string]string{"grpc_host": replicas[0].addr + ", " + replicas[1].addr}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		//Calls may go to the first replica that's ready while the other connects.
+		var counts []int32
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			var ok bool
+			counts, ok = spread(g, 20)
+			So(ok, ShouldBeTrue)
+			if counts[0] > 0 && counts[1] > 0 {
+				break
+			}
+		}
+		So(counts[0], ShouldBeGreaterThan, 0)
+		So(counts[1], ShouldBeGreaterThan, 0)
+
+		Convey("A replica failing its health checks should be left out", func() {
+			replicas[0].health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+			defer replicas[0].health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				var ok bool
+				counts, ok = spread(g, 20)
+				So(ok, ShouldBeTrue)
+				if counts[0] == 0 {
+					break
+				}
+			}
+			So(counts[0], ShouldEqual, 0)
+			So(counts[1], ShouldEqual, 20)
+		})
+
+		Convey("A dead replica shouldn't affect the others", func() {
+			replicas[1].server.Stop()
+
+			counts, ok := spread(g, 20)
+			So(ok, ShouldBeTrue)
+			So(counts[0], ShouldEqual, 20)
+		})
+	})
+
+	Convey("Given a dns:/// name, its addresses should be dialed", t, func() {
+		_, port, _ := net.SplitHostPort(replicas[0].addr)
+		g, err := NewGRPC(map[string]string{"grpc_host": "dns:///localhost", "grpc_port": port}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer g.Halt()
+
+		counts, ok := spread(g, 10)
+		So(ok, ShouldBeTrue)
+		So(counts[0], ShouldEqual, 10)
+	})
+}
@@ -0,0 +1,134 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// grpcHealth polls the service with the standard gRPC health checking
+// protocol, telling checks to skip the backend while it's not serving
+// instead of each one waiting for it until its deadline.
+type grpcHealth struct {
+	client   healthpb.HealthClient
+	conn     *grpc.ClientConn
+	interval time.Duration
+	timeout  time.Duration
+	healthy  int32
+	stopping chan struct{}
+	done     chan struct{}
+	halt     sync.Once
+}
+
+// newGRPCHealth starts polling the health of the service on the connection.
+// The service is taken as healthy until a check tells otherwise, so calls made
+// meanwhile wait for the connection to be ready as usual.
+func newGRPCHealth(conn *grpc.ClientConn, interval, timeout time.Duration) *grpcHealth {
+	h := &grpcHealth{
+		client:   healthpb.NewHealthClient(conn),
+		conn:     conn,
+		interval: interval,
+		timeout:  timeout,
+		healthy:  1,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go h.run()
+
+	return h
+}
+
+// run checks the service's health every interval until stopped. A service
+// that doesn't implement the health protocol is taken as always healthy.
+func (h *grpcHealth) run() {
+	defer close(h.done)
+
+	for {
+		select {
+		case <-h.stopping:
+			return
+		case <-time.After(h.interval):
+		}
+
+		if !h.check() {
+			return
+		}
+	}
+}
+
+// check checks the service's health once, logging transitions, and tells
+// whether to keep polling. It doesn't wait for the connection to be ready,
+// so a service that's down is told at once.
+func (h *grpcHealth) check() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	resp, err := h.client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		log.Warning("grpc service doesn't implement health checking, it will be taken as always healthy")
+		h.set(true, "")
+		return false
+	}
+
+	switch {
+	case err != nil:
+		h.set(false, err.Error())
+	case resp.Status != healthpb.HealthCheckResponse_SERVING:
+		h.set(false, resp.Status.String())
+	default:
+		h.set(true, "")
+	}
+
+	// The channel waits longer and longer between reconnections while the
+	// service is down, so it's told to try again now.
+	if !h.isHealthy() {
+		h.conn.ResetConnectBackoff()
+	}
+
+	return true
+}
+
+// set sets the health state, logging when it changes.
+func (h *grpcHealth) set(healthy bool, reason string) {
+	state := int32(0)
+	if healthy {
+		state = 1
+	}
+
+	if atomic.SwapInt32(&h.healthy, state) == state {
+		return
+	}
+
+	if healthy {
+		log.Info("grpc service is healthy again")
+	} else {
+		log.Warningf("grpc service is unhealthy, checks will skip it until it recovers: %s", reason)
+	}
+}
+
+// isHealthy tells if the last health check passed.
+func (h *grpcHealth) isHealthy() bool {
+	return atomic.LoadInt32(&h.healthy) == 1
+}
+
+// stop stops polling and waits for the last check to end.
+func (h *grpcHealth) stop() {
+	h.halt.Do(func() {
+		close(h.stopping)
+		<-h.done
+	})
+}
+
+// Healthy tells if the service passed its last health check, so checks may
+// skip the backend while it doesn't.
+func (o GRPC) Healthy() bool {
+	return o.health == nil || o.health.isHealthy()
+}
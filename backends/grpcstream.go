@@ -0,0 +1,236 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	gs "github.com/iegomez/mosquitto-go-auth/grpc"
+)
+
+// grpcAclStream multiplexes concurrent acl checks onto a long-lived
+// CheckAclStream call, correlating each response with its check by id. A
+// broken stream is opened again on the next check.
+type grpcAclStream struct {
+	client   gs.AuthServiceClient
+	metadata metadata.MD
+	// unsupported is set once the service answers the stream as
+	// unimplemented, so checks are only made with unary calls from then on.
+	unsupported int32
+
+	mu     sync.Mutex
+	conn   *grpcAclStreamConn
+	nextID uint64
+	closed bool
+}
+
+// grpcAclStreamConn is an opened stream along with the checks waiting for
+// their response on it. Sends on a stream mustn't be concurrent, so they hold
+// sending, a semaphore apart from the stream's lock so responses are still
+// handed out while a send waits for the service to take it.
+type grpcAclStreamConn struct {
+	stream  gs.AuthService_CheckAclStreamClient
+	cancel  context.CancelFunc
+	pending map[uint64]chan grpcAclStreamResult
+	sending chan struct{}
+}
+
+// grpcAclStreamResult is the response to a check, or the error that broke
+// the stream before it was answered.
+type grpcAclStreamResult struct {
+	resp *gs.AuthResponse
+	err  error
+}
+
+func newGRPCAclStream(client gs.AuthServiceClient, md metadata.MD) *grpcAclStream {
+	return &grpcAclStream{
+		client:   client,
+		metadata: md,
+	}
+}
+
+// supported tells if checks may be sent over the stream.
+func (s *grpcAclStream) supported() bool {
+	return atomic.LoadInt32(&s.unsupported) == 0
+}
+
+// check sends the check over the stream, opening it if needed, and waits for
+// its response until ctx is done. Any error means the check wasn't answered
+// and may be made with a unary call instead.
+func (s *grpcAclStream) check(ctx context.Context, req *gs.CheckAclRequest) (*gs.AuthResponse, error) {
+	result := make(chan grpcAclStreamResult, 1)
+
+	s.mu.Lock()
+	conn, err := s.open()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	s.nextID++
+	id := s.nextID
+	conn.pending[id] = result
+	s.mu.Unlock()
+
+	if err := s.send(ctx, conn, &gs.CheckAclStreamRequest{Id: id, Check: req}); err != nil {
+		s.forget(conn, id)
+		return nil, err
+	}
+
+	select {
+	case r := <-result:
+		return r.resp, r.err
+	case <-ctx.Done():
+		s.forget(conn, id)
+		return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+}
+
+// send sends the check on the stream once no other send is being made, until
+// ctx is done. A send still blocked then, e.g. because the service stopped
+// taking them, breaks the stream, as no later send would get through either,
+// so the next check opens a new one.
+func (s *grpcAclStream) send(ctx context.Context, conn *grpcAclStreamConn, req *gs.CheckAclStreamRequest) error {
+	select {
+	case conn.sending <- struct{}{}:
+	case <-ctx.Done():
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- conn.stream.Send(req)
+		<-conn.sending
+	}()
+
+	select {
+	case err := <-sent:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+		conn.cancel()
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+}
+
+// forget drops a check that's no longer waiting for its response.
+func (s *grpcAclStream) forget(conn *grpcAclStreamConn, id uint64) {
+	s.mu.Lock()
+	delete(conn.pending, id)
+	s.mu.Unlock()
+}
+
+// open returns the current stream, opening one when there's none. The stream
+// doesn't wait for the connection to be ready, so checks fall back to unary
+// calls that do when it's not. It must be called holding the lock.
+func (s *grpcAclStream) open() (*grpcAclStreamConn, error) {
+	if s.closed {
+		return nil, status.Error(codes.Canceled, "grpc acl stream closed")
+	}
+
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if len(s.metadata) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, s.metadata)
+	}
+
+	stream, err := s.client.CheckAclStream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	conn := &grpcAclStreamConn{
+		stream:  stream,
+		cancel:  cancel,
+		pending: make(map[uint64]chan grpcAclStreamResult),
+		sending: make(chan struct{}, 1),
+	}
+	s.conn = conn
+
+	go s.receive(conn)
+
+	log.Debug("grpc acl stream opened")
+
+	return conn, nil
+}
+
+// receive hands each response on the stream to the check waiting for it,
+// until the stream breaks.
+func (s *grpcAclStream) receive(conn *grpcAclStreamConn) {
+	for {
+		resp, err := conn.stream.Recv()
+		if err != nil {
+			s.broken(conn, err)
+			return
+		}
+
+		s.mu.Lock()
+		result, ok := conn.pending[resp.Id]
+		delete(conn.pending, resp.Id)
+		s.mu.Unlock()
+
+		// The check may have given up waiting for it already.
+		if !ok {
+			continue
+		}
+
+		if resp.Response == nil {
+			result <- grpcAclStreamResult{err: status.Errorf(codes.Internal, "grpc acl stream response %d has no response", resp.Id)}
+			continue
+		}
+		result <- grpcAclStreamResult{resp: resp.Response}
+	}
+}
+
+// broken drops the stream, failing the checks still waiting on it so they're
+// made again, and tells when the service doesn't implement it.
+func (s *grpcAclStream) broken(conn *grpcAclStreamConn, err error) {
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	pending := conn.pending
+	conn.pending = nil
+	closed := s.closed
+	s.mu.Unlock()
+
+	conn.cancel()
+
+	for _, result := range pending {
+		result <- grpcAclStreamResult{err: err}
+	}
+
+	switch {
+	case closed:
+	case status.Code(err) == codes.Unimplemented:
+		atomic.StoreInt32(&s.unsupported, 1)
+		log.Warning("grpc service doesn't implement CheckAclStream, acls will be checked with unary calls")
+	default:
+		log.Warningf("grpc acl stream broke, it will be opened again on the next check: %s", err)
+	}
+}
+
+// close closes the stream, failing the checks still waiting on it.
+func (s *grpcAclStream) close() {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn != nil {
+		conn.cancel()
+	}
+}
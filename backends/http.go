@@ -2,17 +2,27 @@ package backends
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	h "net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/iegomez/mosquitto-go-auth/common"
 	"github.com/pkg/errors"
 )
 
@@ -26,6 +36,58 @@ type HTTP struct {
 	VerifyPeer   bool
 	ParamsMode   string
 	ResponseMode string
+	Method       string
+
+	ResponsePath       string
+	ResponseAllowValue string
+
+	Timeout           time.Duration
+	MaxIdleConns      int
+	IdleConnTimeout   time.Duration
+	DisableKeepAlives bool
+	Client            *h.Client
+
+	Retries       int
+	RetryBackoff  time.Duration
+	RetryDeadline time.Duration
+
+	SSLCert               string
+	SSLKey                string
+	SSLCA                 string
+	SSLInsecureSkipVerify bool
+
+	Headers     map[string]string
+	BearerToken string
+
+	Socket string
+
+	ProxyURL             *url.URL
+	NoProxy              []string
+	ProxyFromEnvironment bool
+
+	EnrichParams bool
+	ExtraParams  map[string]string
+	Fields       map[string]string
+
+	HMACSecret []byte
+	HMACHeader string
+
+	UserEndpoint      HTTPEndpoint
+	SuperuserEndpoint HTTPEndpoint
+	AclEndpoint       HTTPEndpoint
+}
+
+//HTTPEndpoint holds where a check is sent to, which defaults to the shared host, port and TLS settings, and the client used to reach it.
+type HTTPEndpoint struct {
+	Host                  string
+	Port                  string
+	WithTLS               bool
+	SSLCert               string
+	SSLKey                string
+	SSLCA                 string
+	SSLInsecureSkipVerify bool
+	Socket                string
+	Client                *h.Client
 }
 
 type HTTPResponse struct {
@@ -33,16 +95,64 @@ type HTTPResponse struct {
 	Error string `json:"error"`
 }
 
+//accNames maps mosquitto's access levels to the names sent when params are enriched.
+var accNames = map[int32]string{
+	1: "read",
+	2: "write",
+	3: "readwrite",
+	4: "subscribe",
+}
+
+//NoTTL is returned by TTL aware checks when the response carried no hint on how long its decision may be cached.
+const NoTTL time.Duration = -1
+
+//SkipCache is returned by TTL aware checks when their decision must not be cached at all, e.g. a denial due to the backend failing to answer in time.
+const SkipCache time.Duration = -2
+
+//httpMaxRetries is the most http_retries may be.
+const httpMaxRetries = 100
+
+//httpMaxRetryBackoff is the longest wait between retries, however many were made.
+const httpMaxRetryBackoff = 30 * time.Second
+
+//HTTPOptions are the auth options the HTTP backend takes.
+var HTTPOptions = Options{
+	Keys: []string{
+		"http_acc_field", "http_acc_name_field", "http_aclcheck_uri", "http_bearer_token",
+		"http_bearer_token_file", "http_check_field", "http_clientid_field", "http_disable_keepalives",
+		"http_enrich_params", "http_extra_params", "http_getuser_uri", "http_headers", "http_hmac_header",
+		"http_hmac_secret", "http_hmac_secret_file", "http_host", "http_idle_conn_timeout_ms",
+		"http_max_idle_conns", "http_method", "http_no_proxy", "http_params_mode", "http_password_field",
+		"http_port", "http_proxy_from_environment", "http_proxy_url", "http_response_allow_value",
+		"http_response_mode", "http_response_path", "http_retries", "http_retry_backoff_ms",
+		"http_retry_deadline_ms", "http_socket", "http_ssl_ca", "http_ssl_cert",
+		"http_ssl_insecure_skip_verify", "http_ssl_key", "http_superuser_uri", "http_timeout_ms",
+		"http_topic_field", "http_user_field", "http_verify_peer", "http_with_tls",
+	},
+}
+
 func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := HTTPOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return HTTP{}, errors.Errorf("HTTP backend error: %s.\n", err)
+	}
+
 	//Initialize with defaults
 	var http = HTTP{
-		WithTLS:      false,
-		VerifyPeer:   false,
-		ResponseMode: "status",
-		ParamsMode:   "json",
+		WithTLS:         false,
+		VerifyPeer:      false,
+		ResponseMode:    "status",
+		ParamsMode:      "json",
+		Method:          "POST",
+		HMACHeader:      "X-Signature",
+		Timeout:         5 * time.Second,
+		MaxIdleConns:    100,
+		IdleConnTimeout: 90 * time.Second,
+		Retries:         0,
+		RetryBackoff:    100 * time.Millisecond,
 	}
 
 	//If remote, set remote api fields. Else, set jwt secret.
@@ -51,17 +161,36 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 	httpOk := true
 
 	if responseMode, ok := authOpts["http_response_mode"]; ok {
-		if responseMode == "text" || responseMode == "json" {
+		if responseMode == "text" || responseMode == "json" || responseMode == "path" {
 			http.ResponseMode = responseMode
 		}
 	}
 
+	if responsePath, ok := authOpts["http_response_path"]; ok {
+		http.ResponsePath = responsePath
+	}
+
+	if responseAllowValue, ok := authOpts["http_response_allow_value"]; ok {
+		http.ResponseAllowValue = responseAllowValue
+	}
+
+	if http.ResponseMode == "path" && (http.ResponsePath == "" || http.ResponseAllowValue == "") {
+		return http, errors.New("HTTP backend error: path response mode needs http_response_path and http_response_allow_value.\n")
+	}
+
 	if paramsMode, ok := authOpts["http_params_mode"]; ok {
-		if paramsMode == "form" {
+		if paramsMode == "form" || paramsMode == "querystring" {
 			http.ParamsMode = paramsMode
 		}
 	}
 
+	if method, ok := authOpts["http_method"]; ok {
+		if method != "GET" && method != "POST" {
+			return http, errors.Errorf("HTTP backend error: unknown http_method %s.\n", method)
+		}
+		http.Method = method
+	}
+
 	if userUri, ok := authOpts["http_getuser_uri"]; ok {
 		http.UserUri = userUri
 	} else {
@@ -83,136 +212,519 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 		missingOpts += " http_aclcheck_uri"
 	}
 
+	//When dialing a unix socket, host is only used as the Host header's value and port isn't needed.
+	if socket, ok := authOpts["http_socket"]; ok {
+		http.Socket = socket
+	}
+
 	if host, ok := authOpts["http_host"]; ok {
 		http.Host = host
-	} else {
+	} else if http.Socket != "" {
+		http.Host = "localhost"
+	}
+
+	port, portOk := authOpts["http_port"]
+	http.Port = port
+
+	http.WithTLS = common.BoolOption(authOpts, "http_with_tls", false)
+
+	http.VerifyPeer = common.BoolOption(authOpts, "http_verify_peer", false)
+
+	if sslCert, ok := authOpts["http_ssl_cert"]; ok {
+		http.SSLCert = sslCert
+	}
+
+	if sslKey, ok := authOpts["http_ssl_key"]; ok {
+		http.SSLKey = sslKey
+	}
+
+	if sslCA, ok := authOpts["http_ssl_ca"]; ok {
+		http.SSLCA = sslCA
+	}
+
+	//Verification is skipped unless the peer must be verified or a CA or client certificate is given, but it may be explicitly set too.
+	_, skipVerifyOk := authOpts["http_ssl_insecure_skip_verify"]
+	http.SSLInsecureSkipVerify = common.BoolOption(authOpts, "http_ssl_insecure_skip_verify", http.skipVerifyDefault(http.SSLCA, http.SSLCert))
+
+	//Static headers are given as comma separated Key:value pairs.
+	http.Headers = make(map[string]string)
+	if headers, ok := authOpts["http_headers"]; ok {
+		for _, header := range strings.Split(headers, ",") {
+			if strings.TrimSpace(header) == "" {
+				continue
+			}
+			headerArr := strings.SplitN(header, ":", 2)
+			if len(headerArr) != 2 || strings.TrimSpace(headerArr[0]) == "" {
+				return http, errors.Errorf("HTTP backend error: wrong header %s in http_headers.\n", header)
+			}
+			http.Headers[strings.TrimSpace(headerArr[0])] = strings.TrimSpace(headerArr[1])
+		}
+	}
+
+	if bearerToken, ok := authOpts["http_bearer_token"]; ok {
+		http.BearerToken = bearerToken
+	}
+
+	if hmacSecret, ok := authOpts["http_hmac_secret"]; ok {
+		if hmacSecret == "" {
+			return http, errors.New("HTTP backend error: empty hmac secret.\n")
+		}
+		http.HMACSecret = []byte(hmacSecret)
+	}
+
+	if hmacHeader, ok := authOpts["http_hmac_header"]; ok && hmacHeader != "" {
+		http.HMACHeader = hmacHeader
+	}
+
+	http.Timeout = common.DurationOption(authOpts, "http_timeout_ms", time.Millisecond, time.Millisecond, http.Timeout)
+
+	http.MaxIdleConns = common.IntOption(authOpts, "http_max_idle_conns", 0, math.MaxInt32, http.MaxIdleConns)
+
+	http.IdleConnTimeout = common.DurationOption(authOpts, "http_idle_conn_timeout_ms", time.Millisecond, 0, http.IdleConnTimeout)
+
+	http.DisableKeepAlives = common.BoolOption(authOpts, "http_disable_keepalives", false)
+
+	http.Retries = common.IntOption(authOpts, "http_retries", 0, httpMaxRetries, http.Retries)
+
+	http.RetryBackoff = common.DurationOption(authOpts, "http_retry_backoff_ms", time.Millisecond, 0, http.RetryBackoff)
+
+	//By default every attempt may take up to the client timeout.
+	http.RetryDeadline = http.Timeout * time.Duration(http.Retries+1)
+
+	http.RetryDeadline = common.DurationOption(authOpts, "http_retry_deadline_ms", time.Millisecond, time.Millisecond, http.RetryDeadline)
+
+	http.EnrichParams = common.BoolOption(authOpts, "http_enrich_params", false)
+
+	//Field names default to the params' names but may be overridden for services expecting different ones.
+	http.Fields = map[string]string{
+		"username": "username",
+		"password": "password",
+		"topic":    "topic",
+		"clientid": "clientid",
+		"acc":      "acc",
+		"acc_name": "acc_name",
+		"check":    "check",
+	}
+
+	fieldOpts := map[string]string{
+		"username": "http_user_field",
+		"password": "http_password_field",
+		"topic":    "http_topic_field",
+		"clientid": "http_clientid_field",
+		"acc":      "http_acc_field",
+		"acc_name": "http_acc_name_field",
+		"check":    "http_check_field",
+	}
+
+	usedFields := make(map[string]bool)
+	for param, opt := range fieldOpts {
+		if field, ok := authOpts[opt]; ok && field != "" {
+			http.Fields[param] = field
+		}
+		if usedFields[http.Fields[param]] {
+			return http, errors.Errorf("HTTP backend error: field %s is used by more than one param.\n", http.Fields[param])
+		}
+		usedFields[http.Fields[param]] = true
+	}
+
+	//Extra params are given as comma separated key=value pairs and are sent along every check.
+	http.ExtraParams = make(map[string]string)
+	if extraParams, ok := authOpts["http_extra_params"]; ok {
+		for _, param := range strings.Split(extraParams, ",") {
+			if strings.TrimSpace(param) == "" {
+				continue
+			}
+			paramArr := strings.SplitN(param, "=", 2)
+			key := strings.TrimSpace(paramArr[0])
+			if len(paramArr) != 2 || key == "" {
+				return http, errors.Errorf("HTTP backend error: wrong param %s in http_extra_params.\n", param)
+			}
+			if usedFields[key] {
+				return http, errors.Errorf("HTTP backend error: extra param %s overrides a check's field.\n", key)
+			}
+			http.ExtraParams[key] = strings.TrimSpace(paramArr[1])
+		}
+	}
+
+	if proxyURL, ok := authOpts["http_proxy_url"]; ok {
+		u, err := url.Parse(proxyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return http, errors.Errorf("HTTP backend error: invalid http_proxy_url %s.\n", common.RedactURL(proxyURL))
+		}
+		http.ProxyURL = u
+	}
+
+	if noProxy, ok := authOpts["http_no_proxy"]; ok {
+		for _, host := range strings.Split(noProxy, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				http.NoProxy = append(http.NoProxy, strings.ToLower(host))
+			}
+		}
+	}
+
+	if common.BoolOption(authOpts, "http_proxy_from_environment", false) {
+		if http.ProxyURL != nil {
+			return http, errors.New("HTTP backend error: only one of http_proxy_url and http_proxy_from_environment may be given.\n")
+		}
+		http.ProxyFromEnvironment = true
+	}
+
+	//Each check may override the shared host, port and TLS settings.
+	shared := HTTPEndpoint{
+		Host:                  http.Host,
+		Port:                  http.Port,
+		WithTLS:               http.WithTLS,
+		SSLCert:               http.SSLCert,
+		SSLKey:                http.SSLKey,
+		SSLCA:                 http.SSLCA,
+		SSLInsecureSkipVerify: http.SSLInsecureSkipVerify,
+		Socket:                http.Socket,
+	}
+
+	endpoints := []struct {
+		check    string
+		endpoint *HTTPEndpoint
+	}{
+		{"getuser", &http.UserEndpoint},
+		{"superuser", &http.SuperuserEndpoint},
+		{"aclcheck", &http.AclEndpoint},
+	}
+
+	hostMissing, portMissing := false, false
+
+	for _, e := range endpoints {
+		endpoint := shared
+
+		host, hostOk := authOpts[fmt.Sprintf("http_%s_host", e.check)]
+		if hostOk {
+			endpoint.Host = host
+		}
+
+		checkPort, checkPortOk := authOpts[fmt.Sprintf("http_%s_port", e.check)]
+		if checkPortOk {
+			endpoint.Port = checkPort
+		}
+
+		//The unix socket is only dialed for checks sent to the shared host and port.
+		if hostOk || checkPortOk {
+			endpoint.Socket = ""
+		}
+
+		if endpoint.Host == "" {
+			hostMissing = true
+		}
+
+		if !portOk && !checkPortOk && endpoint.Socket == "" {
+			portMissing = true
+		}
+
+		endpoint.WithTLS = common.BoolOption(authOpts, fmt.Sprintf("http_%s_with_tls", e.check), endpoint.WithTLS)
+
+		if sslCert, ok := authOpts[fmt.Sprintf("http_%s_ssl_cert", e.check)]; ok {
+			endpoint.SSLCert = sslCert
+		}
+
+		if sslKey, ok := authOpts[fmt.Sprintf("http_%s_ssl_key", e.check)]; ok {
+			endpoint.SSLKey = sslKey
+		}
+
+		if sslCA, ok := authOpts[fmt.Sprintf("http_%s_ssl_ca", e.check)]; ok {
+			endpoint.SSLCA = sslCA
+		}
+
+		//A CA or client certificate given for the check turns verification on, unless it's explicitly skipped.
+		if !skipVerifyOk {
+			endpoint.SSLInsecureSkipVerify = http.skipVerifyDefault(endpoint.SSLCA, endpoint.SSLCert)
+		}
+		endpoint.SSLInsecureSkipVerify = common.BoolOption(authOpts, fmt.Sprintf("http_%s_ssl_insecure_skip_verify", e.check), endpoint.SSLInsecureSkipVerify)
+
+		if endpoint.WithTLS && endpoint.SSLInsecureSkipVerify && (endpoint.SSLCA != "" || endpoint.SSLCert != "") {
+			log.Warnf("HTTP backend: server certificate verification is skipped for %s checks though a CA or client certificate is given.", e.check)
+		}
+
+		*e.endpoint = endpoint
+	}
+
+	if hostMissing {
 		httpOk = false
 		missingOpts += " http_host"
 	}
 
-	if port, ok := authOpts["http_port"]; ok {
-		http.Port = port
-	} else {
+	if portMissing {
 		httpOk = false
 		missingOpts += " http_port"
 	}
 
-	if withTLS, ok := authOpts["http_with_tls"]; ok && withTLS == "true" {
-		http.WithTLS = true
+	if !httpOk {
+		return http, errors.Errorf("HTTP backend error: missing remote options%s.\n", missingOpts)
 	}
 
-	if verifyPeer, ok := authOpts["http_verify_peer"]; ok && verifyPeer == "true" {
-		http.VerifyPeer = true
+	//Build a client once per distinct endpoint so connections may be reused between checks, with each host getting its own pool.
+	clients := make(map[HTTPEndpoint]*h.Client)
+
+	for _, e := range endpoints {
+		if http.ParamsMode == "querystring" && !e.endpoint.WithTLS {
+			log.Warnf("HTTP backend: passwords will be sent in the url's query string over plain http for %s checks.", e.check)
+		}
+
+		if client, ok := clients[*e.endpoint]; ok {
+			e.endpoint.Client = client
+			continue
+		}
+
+		client, err := http.newClient(*e.endpoint)
+		if err != nil {
+			return http, err
+		}
+
+		clients[*e.endpoint] = client
+		e.endpoint.Client = client
 	}
 
-	if !httpOk {
-		return http, errors.Errorf("HTTP backend error: missing remote options%s.\n", missingOpts)
+	//The shared client is the one used for checks that don't override the shared settings.
+	if client, ok := clients[shared]; ok {
+		http.Client = client
 	}
 
 	return http, nil
 }
 
-func (o HTTP) GetUser(username, password string) bool {
+//newClient builds a client for the given endpoint.
+//All of its requests are sent to the same host, so every idle connection may be kept for it.
+func (o HTTP) newClient(endpoint HTTPEndpoint) (*h.Client, error) {
 
-	var dataMap = map[string]interface{}{
-		"username": username,
-		"password": password,
+	tr := &h.Transport{
+		MaxIdleConns:        o.MaxIdleConns,
+		MaxIdleConnsPerHost: o.MaxIdleConns,
+		IdleConnTimeout:     o.IdleConnTimeout,
+		DisableKeepAlives:   o.DisableKeepAlives,
 	}
 
-	var urlValues = url.Values{
-		"username": []string{username},
-		"password": []string{password},
+	//Requests dialed through a unix socket never go through a proxy.
+	if endpoint.Socket != "" {
+		dialer := &net.Dialer{}
+		socket := endpoint.Socket
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	} else if o.ProxyURL != nil {
+		tr.Proxy = o.proxy
+	} else if o.ProxyFromEnvironment {
+		tr.Proxy = h.ProxyFromEnvironment
 	}
 
-	return httpRequest(o.Host, o.UserUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	tlsConfig, err := endpoint.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr.TLSClientConfig = tlsConfig
 
+	return &h.Client{
+		Timeout:   o.Timeout,
+		Transport: tr,
+	}, nil
 }
 
-func (o HTTP) GetSuperuser(username string) bool {
+//proxy returns the proxy url for the request, or nil if its host is excluded by http_no_proxy.
+func (o HTTP) proxy(req *h.Request) (*url.URL, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	ip := net.ParseIP(host)
 
-	var dataMap = map[string]interface{}{
-		"username": username,
+	for _, noProxy := range o.NoProxy {
+		if noProxy == "*" || host == noProxy || strings.HasSuffix(host, "."+strings.TrimPrefix(noProxy, ".")) {
+			return nil, nil
+		}
+		if _, cidr, err := net.ParseCIDR(noProxy); err == nil && ip != nil && cidr.Contains(ip) {
+			return nil, nil
+		}
+	}
+
+	return o.ProxyURL, nil
+}
+
+//skipVerifyDefault tells if server certificates are verified when http_ssl_insecure_skip_verify isn't given: they are when the peer must be verified, or a CA or client certificate is given, as they'd be pointless otherwise.
+func (o HTTP) skipVerifyDefault(sslCA, sslCert string) bool {
+	return !o.VerifyPeer && sslCA == "" && sslCert == ""
+}
+
+//tlsConfig builds the endpoint's tls config, loading the client certificate and custom CA if given.
+func (o HTTPEndpoint) tlsConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: o.SSLInsecureSkipVerify,
+	}
+
+	if o.SSLCert != "" || o.SSLKey != "" {
+		if o.SSLCert == "" || o.SSLKey == "" {
+			return nil, errors.New("HTTP backend error: both http_ssl_cert and http_ssl_key must be given.\n")
+		}
+		cert, err := tls.LoadX509KeyPair(o.SSLCert, o.SSLKey)
+		if err != nil {
+			return nil, errors.Errorf("HTTP backend error: couldn't load client cert and key: %s\n", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	var urlValues = url.Values{
-		"username": []string{username},
+	if o.SSLCA != "" {
+		pem, err := ioutil.ReadFile(o.SSLCA)
+		if err != nil {
+			return nil, errors.Errorf("HTTP backend error: couldn't read CA file: %s\n", err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("HTTP backend error: no valid certificates found in CA file %s.\n", o.SSLCA)
+		}
+		tlsConfig.RootCAs = caCertPool
 	}
 
-	return httpRequest(o.Host, o.SuperuserUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	return tlsConfig, nil
+}
+
+func (o HTTP) GetUser(username, password string) bool {
+	granted, _ := o.GetUserTTL(username, password)
+	return granted
+}
+
+//GetUserTTL checks the user just as GetUser, and also returns the ttl the response hinted for caching the decision, or NoTTL if there was none.
+func (o HTTP) GetUserTTL(username, password string) (bool, time.Duration) {
+
+	dataMap, urlValues := o.params("user", map[string]interface{}{
+		"username": username,
+		"password": password,
+	})
+
+	return o.httpRequest(o.UserEndpoint, o.UserUri, username, dataMap, urlValues)
+
+}
+
+func (o HTTP) GetSuperuser(username string) bool {
+
+	dataMap, urlValues := o.params("superuser", map[string]interface{}{
+		"username": username,
+	})
+
+	granted, _ := o.httpRequest(o.SuperuserEndpoint, o.SuperuserUri, username, dataMap, urlValues)
+	return granted
 
 }
 
 func (o HTTP) CheckAcl(username, topic, clientid string, acc int32) bool {
+	granted, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return granted
+}
+
+//CheckAclTTL checks the acl just as CheckAcl, and also returns the ttl the response hinted for caching the decision, or NoTTL if there was none.
+func (o HTTP) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
 
-	dataMap := map[string]interface{}{
+	dataMap, urlValues := o.params("acl", map[string]interface{}{
 		"username": username,
 		"clientid": clientid,
 		"topic":    topic,
 		"acc":      acc,
-	}
-
-	var urlValues = url.Values{
-		"username": []string{username},
-		"clientid": []string{clientid},
-		"topic":    []string{topic},
-		"acc":      []string{strconv.Itoa(int(acc))},
-	}
+	})
 
-	return httpRequest(o.Host, o.AclUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	return o.httpRequest(o.AclEndpoint, o.AclUri, username, dataMap, urlValues)
 
 }
 
-func httpRequest(host, uri, username string, withTLS, verifyPeer bool, dataMap map[string]interface{}, port, paramsMode, responseMode string, urlValues map[string][]string) bool {
+func (o HTTP) httpRequest(endpoint HTTPEndpoint, uri, username string, dataMap map[string]interface{}, urlValues map[string][]string) (bool, time.Duration) {
 
 	tlsStr := "http://"
 
-	if withTLS {
+	if endpoint.WithTLS {
 		tlsStr = "https://"
 	}
 
-	fullUri := fmt.Sprintf("%s%s%s", tlsStr, host, uri)
-	if port != "" {
-		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, host, port, uri)
+	fullUri := fmt.Sprintf("%s%s%s", tlsStr, endpoint.Host, uri)
+	if endpoint.Port != "" {
+		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, endpoint.Host, endpoint.Port, uri)
 	}
 
-	client := &h.Client{Timeout: 5 * time.Second}
+	//Every attempt, and the backoff between them, must fit in the overall deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), o.RetryDeadline)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		granted, retry, ttl := o.doRequest(ctx, endpoint.Client, fullUri, username, dataMap, urlValues)
+		if granted || !retry || attempt >= o.Retries {
+			return granted, ttl
+		}
+
+		backoff := o.retryBackoff(attempt)
+		log.Debugf("http request for %s failed, retrying in %s (retry %d of %d)\n", common.RedactUsername(username), backoff, attempt+1, o.Retries)
 
-	if !verifyPeer {
-		tr := &h.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		select {
+		case <-ctx.Done():
+			log.Errorf("http request for %s gave up: %s\n", common.RedactUsername(username), ctx.Err())
+			return false, SkipCache
+		case <-time.After(backoff):
 		}
-		client.Transport = tr
 	}
 
-	var resp *h.Response
-	var err error
+}
+
+//doRequest makes a single request and checks the response. It returns whether access was granted, whether a failure is transient and the request may be retried, and the cache ttl hinted by the response.
+//Transient failures return SkipCache, as the server didn't answer and the denial mustn't outlive the outage.
+func (o HTTP) doRequest(ctx context.Context, client *h.Client, fullUri, username string, dataMap map[string]interface{}, urlValues url.Values) (bool, bool, time.Duration) {
+
+	var req *h.Request
+	var reqErr error
+
+	//payload holds what the request carries, body or query string, so it may be signed.
+	var payload []byte
 
-	if paramsMode == "form" {
-		resp, err = client.PostForm(fullUri, urlValues)
+	if o.ParamsMode == "querystring" {
+		payload = []byte(urlValues.Encode())
+		req, reqErr = h.NewRequest(o.Method, fmt.Sprintf("%s?%s", fullUri, payload), nil)
+
+		if reqErr != nil {
+			log.Errorf("req error: %v\n", common.RedactURLError(reqErr))
+			return false, false, NoTTL
+		}
+	} else if o.ParamsMode == "form" {
+		payload = []byte(urlValues.Encode())
+		req, reqErr = h.NewRequest(o.Method, fullUri, bytes.NewReader(payload))
+
+		if reqErr != nil {
+			log.Errorf("req error: %v\n", common.RedactURLError(reqErr))
+			return false, false, NoTTL
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	} else {
 		dataJson, mErr := json.Marshal(dataMap)
 
 		if mErr != nil {
 			log.Errorf("marshal error: %v\n", mErr)
-			return false
+			return false, false, NoTTL
 		}
 
+		payload = dataJson
 		contentReader := bytes.NewReader(dataJson)
-		req, reqErr := h.NewRequest("POST", fullUri, contentReader)
+		req, reqErr = h.NewRequest(o.Method, fullUri, contentReader)
 
 		if reqErr != nil {
-			log.Errorf("req error: %v\n", reqErr)
-			return false
+			log.Errorf("req error: %v\n", common.RedactURLError(reqErr))
+			return false, false, NoTTL
 		}
 
 		req.Header.Set("Content-Type", "application/json")
+	}
 
-		resp, err = client.Do(req)
+	o.setHeaders(req)
+
+	if len(o.HMACSecret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set(o.HMACHeader, hmacSignature(o.HMACSecret, timestamp, payload))
 	}
 
+	resp, err := client.Do(req.WithContext(ctx))
+
+	//Connection errors and timeouts may be retried.
 	if err != nil {
-		log.Errorf("POST error: %v\n", err)
-		return false
+		log.Errorf("%s error: %v\n", o.Method, common.RedactURLError(err))
+		return false, true, SkipCache
 	}
 
 	body, bErr := ioutil.ReadAll(resp.Body)
@@ -220,23 +732,31 @@ func httpRequest(host, uri, username string, withTLS, verifyPeer bool, dataMap m
 
 	if bErr != nil {
 		log.Errorf("read error: %v\n", bErr)
-		return false
+		return false, true, SkipCache
+	}
+
+	//Server errors may be retried, any other status is a definitive deny.
+	if resp.StatusCode >= 500 {
+		log.Errorf("Wrong http status: %v\n", resp.StatusCode)
+		return false, true, SkipCache
 	}
 
+	ttl := responseTTL(resp.Header, body)
+
 	if resp.StatusCode != 200 {
 		log.Infof("Wrong http status: %v\n", resp.StatusCode)
-		return false
+		return false, false, ttl
 	}
 
-	if responseMode == "text" {
+	if o.ResponseMode == "text" {
 
 		//For test response, we expect "ok" or an error message.
 		if string(body) != "ok" {
 			log.Infof("api error: %s\n", string(body))
-			return false
+			return false, false, ttl
 		}
 
-	} else if responseMode == "json" {
+	} else if o.ResponseMode == "json" {
 
 		//For json response, we expect Ok and Error fields.
 		response := HTTPResponse{Ok: false, Error: ""}
@@ -244,19 +764,206 @@ func httpRequest(host, uri, username string, withTLS, verifyPeer bool, dataMap m
 
 		if jErr != nil {
 			log.Errorf("unmarshal error: %v\n", jErr)
-			return false
+			return false, false, ttl
 		}
 
 		if !response.Ok {
 			log.Infof("api error: %s\n", response.Error)
-			return false
+			return false, false, ttl
 		}
 
+	} else if o.ResponseMode == "path" {
+
+		//For path response, we expect the value at the given path to match the allow value.
+		var response interface{}
+		jErr := json.Unmarshal(body, &response)
+
+		if jErr != nil {
+			log.Errorf("unmarshal error: %v\n", jErr)
+			return false, false, ttl
+		}
+
+		value, ok := jsonPathValue(response, o.ResponsePath)
+		if !ok {
+			log.Infof("api error: no valid value at path %s\n", o.ResponsePath)
+			if redacted, rErr := json.Marshal(redactPasswords(response)); rErr == nil {
+				log.Debugf("response body: %s\n", redacted)
+			}
+			return false, false, ttl
+		}
+
+		if value != o.ResponseAllowValue {
+			log.Infof("api error: got %s at path %s\n", value, o.ResponsePath)
+			return false, false, ttl
+		}
+
+	}
+
+	log.Debugf("http request approved for %s\n", common.RedactUsername(username))
+	return true, false, ttl
+
+}
+
+//params builds the json and form params for the given check, renaming them to the configured fields and adding the enrichment and extra params if set.
+func (o HTTP) params(check string, params map[string]interface{}) (map[string]interface{}, url.Values) {
+
+	dataMap := make(map[string]interface{})
+	urlValues := url.Values{}
+
+	for key, value := range o.ExtraParams {
+		dataMap[key] = value
+		urlValues.Set(key, value)
+	}
+
+	if o.EnrichParams {
+		params["check"] = check
+		if acc, ok := params["acc"].(int32); ok {
+			params["acc_name"] = accName(acc)
+		}
+	}
+
+	for param, value := range params {
+		field := o.Fields[param]
+		dataMap[field] = value
+		urlValues.Set(field, fmt.Sprint(value))
+	}
+
+	return dataMap, urlValues
+}
+
+//accName returns the name of the given access level, or its number if it's unknown.
+func accName(acc int32) string {
+	if name, ok := accNames[acc]; ok {
+		return name
+	}
+	return strconv.Itoa(int(acc))
+}
+
+//jsonPathValue walks the dotted path (e.g., data.result or data.results.0.allowed) through the decoded json and returns the string representation of the scalar found at the end of it, if any.
+func jsonPathValue(data interface{}, path string) (string, bool) {
+	data, ok := jsonPathNode(data, path)
+	if !ok {
+		return "", false
+	}
+
+	switch value := data.(type) {
+	case string:
+		return value, true
+	case bool:
+		return strconv.FormatBool(value), true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	default:
+		//Objects, arrays and nulls can't be compared against the allow value.
+		return "", false
+	}
+}
+
+//jsonPathNode returns whatever the dotted path points to in the decoded json data.
+func jsonPathNode(data interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := data.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			data = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			data = node[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return data, true
+}
+
+//responseTTL returns the cache ttl hinted by the response, either by a ttl field (in seconds) in a json body or by the max-age directive of the Cache-Control header, with the former taking precedence. If there's no hint, it returns NoTTL.
+func responseTTL(header h.Header, body []byte) time.Duration {
+	ttl := NoTTL
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		if seconds, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64); err == nil && seconds >= 0 {
+			ttl = time.Duration(seconds) * time.Second
+		}
 	}
 
-	log.Debugf("http request approved for %s\n", username)
-	return true
+	var response struct {
+		TTL *float64 `json:"ttl"`
+	}
+	if err := json.Unmarshal(body, &response); err == nil && response.TTL != nil && *response.TTL >= 0 {
+		ttl = time.Duration(*response.TTL * float64(time.Second))
+	}
 
+	return ttl
+}
+
+//redactPasswords replaces the value of any password field in the decoded json so it may be safely logged.
+func redactPasswords(data interface{}) interface{} {
+	switch node := data.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(node))
+		for key, value := range node {
+			if strings.Contains(strings.ToLower(key), "password") {
+				redacted[key] = common.Redacted
+			} else {
+				redacted[key] = redactPasswords(value)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(node))
+		for i, value := range node {
+			redacted[i] = redactPasswords(value)
+		}
+		return redacted
+	default:
+		return data
+	}
+}
+
+//setHeaders sets the static headers and bearer token, if any, on the request.
+func (o HTTP) setHeaders(req *h.Request) {
+	for key, value := range o.Headers {
+		req.Header.Set(key, value)
+	}
+
+	if o.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+o.BearerToken)
+	}
+}
+
+//hmacSignature returns the hex encoded HMAC-SHA256 of the timestamp and payload, joined by a dot, keyed with the secret.
+func hmacSignature(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//retryBackoff returns the exponential backoff for the given retry attempt, up to httpMaxRetryBackoff, with up to 50% of jitter added.
+func (o HTTP) retryBackoff(attempt int) time.Duration {
+	backoff := o.RetryBackoff
+	if backoff <= 0 {
+		return 0
+	}
+	for i := 0; i < attempt && backoff < httpMaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > httpMaxRetryBackoff {
+		backoff = httpMaxRetryBackoff
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
 }
 
 //GetName returns the backend's name
@@ -264,7 +971,13 @@ func (o HTTP) GetName() string {
 	return "HTTP"
 }
 
-//Halt does nothing for http as there's no cleanup needed.
+//Halt closes any idle connection kept by the clients.
 func (o HTTP) Halt() {
-	//Do nothing
+	for _, endpoint := range []HTTPEndpoint{o.UserEndpoint, o.SuperuserEndpoint, o.AclEndpoint} {
+		if endpoint.Client != nil {
+			if tr, ok := endpoint.Client.Transport.(*h.Transport); ok {
+				tr.CloseIdleConnections()
+			}
+		}
+	}
 }
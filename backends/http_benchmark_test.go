@@ -0,0 +1,58 @@
+package backends
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func benchmarkHTTPUser(b *testing.B, disableKeepAlives string) {
+	var newConns int64
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	mockServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&newConns, 1)
+		}
+	}
+	mockServer.Start()
+	defer mockServer.Close()
+
+	var authOpts = map[string]string{
+		"http_host":               strings.Replace(mockServer.URL, "http://", "", -1),
+		"http_port":               "",
+		"http_getuser_uri":        "/user",
+		"http_superuser_uri":      "/superuser",
+		"http_aclcheck_uri":       "/acl",
+		"http_disable_keepalives": disableKeepAlives,
+	}
+
+	hb, err := NewHTTP(authOpts, log.ErrorLevel)
+	if err != nil {
+		b.Fatalf("HTTP error: %s", err)
+	}
+	defer hb.Halt()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hb.GetUser("test_user", "test_password")
+	}
+	b.StopTimer()
+
+	b.Logf("%d requests used %d connections", b.N, atomic.LoadInt64(&newConns))
+}
+
+func BenchmarkHTTPUser(b *testing.B) {
+	benchmarkHTTPUser(b, "false")
+}
+
+func BenchmarkHTTPUserNoKeepAlives(b *testing.B) {
+	benchmarkHTTPUser(b, "true")
+}
@@ -1,13 +1,31 @@
 package backends
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -808,3 +826,1380 @@ func TestHTTPFormTextResponseServer(t *testing.T) {
 	})
 
 }
+
+func TestHTTPTimeout(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//Sleep past the client's deadline.
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given invalid client options NewHTTP should warn and use the defaults", t, func() {
+		authOpts["http_timeout_ms"] = "soon"
+		authOpts["http_max_idle_conns"] = "-1"
+		authOpts["http_idle_conn_timeout_ms"] = "never"
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Timeout, ShouldEqual, 5*time.Second)
+		So(hb.MaxIdleConns, ShouldEqual, 100)
+		So(hb.IdleConnTimeout, ShouldEqual, 90*time.Second)
+
+		delete(authOpts, "http_timeout_ms")
+		delete(authOpts, "http_max_idle_conns")
+		delete(authOpts, "http_idle_conn_timeout_ms")
+	})
+
+	Convey("Given durations and booleans in any accepted form, NewHTTP should take them", t, func() {
+		authOpts["http_timeout_ms"] = "2s"
+		authOpts["http_idle_conn_timeout_ms"] = "1m"
+		authOpts["http_disable_keepalives"] = "Yes"
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Timeout, ShouldEqual, 2*time.Second)
+		So(hb.IdleConnTimeout, ShouldEqual, time.Minute)
+		So(hb.DisableKeepAlives, ShouldBeTrue)
+
+		authOpts["http_disable_keepalives"] = "maybe"
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.DisableKeepAlives, ShouldBeFalse)
+
+		delete(authOpts, "http_idle_conn_timeout_ms")
+		delete(authOpts, "http_disable_keepalives")
+	})
+
+	Convey("Given a server slower than the configured timeout, every check should be denied without hanging", t, func() {
+		authOpts["http_timeout_ms"] = "100"
+		authOpts["http_max_idle_conns"] = "10"
+		authOpts["http_idle_conn_timeout_ms"] = "1000"
+		authOpts["http_disable_keepalives"] = "true"
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Timeout, ShouldEqual, 100*time.Millisecond)
+		So(hb.MaxIdleConns, ShouldEqual, 10)
+		So(hb.IdleConnTimeout, ShouldEqual, time.Second)
+		So(hb.DisableKeepAlives, ShouldBeTrue)
+
+		start := time.Now()
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		So(hb.GetSuperuser("test_user"), ShouldBeFalse)
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeFalse)
+		So(time.Since(start), ShouldBeLessThan, 1500*time.Millisecond)
+
+		hb.Halt()
+	})
+
+}
+
+func TestHTTPRetries(t *testing.T) {
+
+	var requests int32
+	var failures int32
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		switch r.URL.Path {
+		case "/user":
+			//Fail twice, then succeed.
+			if atomic.AddInt32(&failures, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ok": true, "error": ""}`))
+		case "/superuser":
+			w.WriteHeader(http.StatusForbidden)
+		case "/acl":
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ok": false, "error": "Acl check failed."}`))
+		case "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_retries"] = "3"
+	authOpts["http_retry_backoff_ms"] = "10"
+
+	Convey("Given invalid retry options NewHTTP should warn and use the defaults", t, func() {
+		authOpts["http_retries"] = "-1"
+		authOpts["http_retry_backoff_ms"] = "fast"
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Retries, ShouldEqual, 0)
+		So(hb.RetryBackoff, ShouldEqual, 100*time.Millisecond)
+
+		authOpts["http_retries"] = "1000"
+
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Retries, ShouldEqual, 0)
+
+		authOpts["http_retries"] = "3"
+		authOpts["http_retry_backoff_ms"] = "10"
+	})
+
+	Convey("Retry backoffs should double on each retry and saturate at their maximum", t, func() {
+		hb := HTTP{RetryBackoff: 100 * time.Millisecond}
+
+		backoff := hb.retryBackoff(2)
+		So(backoff, ShouldBeGreaterThanOrEqualTo, 400*time.Millisecond)
+		So(backoff, ShouldBeLessThanOrEqualTo, 600*time.Millisecond)
+
+		for _, attempt := range []int{9, 62, 63, 64, httpMaxRetries} {
+			backoff := hb.retryBackoff(attempt)
+			So(backoff, ShouldBeGreaterThanOrEqualTo, httpMaxRetryBackoff)
+			So(backoff, ShouldBeLessThanOrEqualTo, httpMaxRetryBackoff*3/2)
+		}
+
+		hb.RetryBackoff = time.Hour
+		So(hb.retryBackoff(0), ShouldBeLessThanOrEqualTo, httpMaxRetryBackoff*3/2)
+		So(HTTP{}.retryBackoff(3), ShouldEqual, 0)
+	})
+
+	Convey("Given retries, transient errors should be retried but definitive denies should not", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("A server failing twice should eventually authenticate the user", func() {
+			atomic.StoreInt32(&requests, 0)
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 3)
+		})
+
+		Convey("A 403 should not be retried", func() {
+			atomic.StoreInt32(&requests, 0)
+			So(hb.GetSuperuser("test_user"), ShouldBeFalse)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+
+		Convey("An ok:false response should not be retried", func() {
+			atomic.StoreInt32(&requests, 0)
+			So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeFalse)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+
+		Convey("A server that keeps failing should be retried up to http_retries times", func() {
+			atomic.StoreInt32(&requests, 0)
+			hb.UserUri = "/down"
+			So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 4)
+		})
+
+		hb.Halt()
+	})
+
+	Convey("Retries should respect the overall deadline", t, func() {
+		authOpts["http_getuser_uri"] = "/down"
+		authOpts["http_retries"] = "10"
+		authOpts["http_retry_backoff_ms"] = "100"
+		authOpts["http_retry_deadline_ms"] = "250"
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		atomic.StoreInt32(&requests, 0)
+		start := time.Now()
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+		So(atomic.LoadInt32(&requests), ShouldBeLessThan, 4)
+
+		hb.Halt()
+	})
+
+}
+
+//testCerts holds paths to a CA, a server certificate for 127.0.0.1/localhost and a client certificate, all signed by the CA.
+type testCerts struct {
+	Dir        string
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+func writeTestCerts() (testCerts, error) {
+	var certs testCerts
+
+	dir, err := ioutil.TempDir("", "go-auth-certs")
+	if err != nil {
+		return certs, err
+	}
+	certs.Dir = dir
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return certs, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-auth test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return certs, err
+	}
+	certs.CA = filepath.Join(dir, "ca.pem")
+	if err := writePEM(certs.CA, "CERTIFICATE", caDER); err != nil {
+		return certs, err
+	}
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) (string, string, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			DNSNames:     []string{"localhost"},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+		if err != nil {
+			return "", "", err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return "", "", err
+		}
+		certPath := filepath.Join(dir, name+".pem")
+		keyPath := filepath.Join(dir, name+".key")
+		if err := writePEM(certPath, "CERTIFICATE", der); err != nil {
+			return "", "", err
+		}
+		if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER); err != nil {
+			return "", "", err
+		}
+		return certPath, keyPath, nil
+	}
+
+	certs.ServerCert, certs.ServerKey, err = issue(2, "server", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return certs, err
+	}
+	certs.ClientCert, certs.ClientKey, err = issue(3, "client", x509.ExtKeyUsageClientAuth)
+
+	return certs, err
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
+
+func TestHTTPMutualTLS(t *testing.T) {
+
+	certs, err := writeTestCerts()
+	defer os.RemoveAll(certs.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	caPEM, _ := ioutil.ReadFile(certs.CA)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPEM)
+	serverCert, _ := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "client" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	mockServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	mockServer.StartTLS()
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "https://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_with_tls"] = "true"
+	authOpts["http_verify_peer"] = "true"
+	authOpts["http_ssl_ca"] = certs.CA
+
+	Convey("Given a cert without a key, or unreadable files, NewHTTP should fail", t, func() {
+		authOpts["http_ssl_cert"] = certs.ClientCert
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["http_ssl_key"] = certs.ServerKey
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["http_ssl_key"] = filepath.Join(certs.Dir, "missing.key")
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["http_ssl_key"] = certs.ClientKey
+		authOpts["http_ssl_ca"] = certs.ClientKey
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["http_ssl_ca"] = certs.CA
+		delete(authOpts, "http_ssl_cert")
+		delete(authOpts, "http_ssl_key")
+	})
+
+	Convey("Without a client certificate the server should reject the request", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		hb.Halt()
+	})
+
+	Convey("Given a client certificate and the custom CA, requests should succeed", t, func() {
+		authOpts["http_ssl_cert"] = certs.ClientCert
+		authOpts["http_ssl_key"] = certs.ClientKey
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeTrue)
+		hb.Halt()
+	})
+
+	Convey("Given the custom CA or a client certificate without http_verify_peer, the server certificate should still be verified", t, func() {
+		untrustedServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer untrustedServer.Close()
+
+		opts := make(map[string]string)
+		for key, value := range authOpts {
+			opts[key] = value
+		}
+		delete(opts, "http_verify_peer")
+		delete(opts, "http_ssl_cert")
+		delete(opts, "http_ssl_key")
+		opts["http_host"] = strings.Replace(untrustedServer.URL, "https://", "", -1)
+
+		hb, err := NewHTTP(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.UserEndpoint.SSLInsecureSkipVerify, ShouldBeFalse)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		hb.Halt()
+
+		delete(opts, "http_ssl_ca")
+		opts["http_ssl_cert"] = certs.ClientCert
+		opts["http_ssl_key"] = certs.ClientKey
+		hb, err = NewHTTP(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.UserEndpoint.SSLInsecureSkipVerify, ShouldBeFalse)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		hb.Halt()
+
+		Convey("Unless verification is explicitly skipped", func() {
+			opts["http_ssl_ca"] = certs.CA
+			opts["http_ssl_insecure_skip_verify"] = "true"
+			hb, err := NewHTTP(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			hb.Halt()
+		})
+
+		Convey("And a CA given for a single check should only turn verification on for it", func() {
+			delete(opts, "http_ssl_cert")
+			delete(opts, "http_ssl_key")
+			opts["http_aclcheck_ssl_ca"] = certs.CA
+			hb, err := NewHTTP(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(hb.UserEndpoint.SSLInsecureSkipVerify, ShouldBeTrue)
+			So(hb.AclEndpoint.SSLInsecureSkipVerify, ShouldBeFalse)
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeFalse)
+			hb.Halt()
+		})
+	})
+
+	Convey("Given a client certificate but no custom CA, the server certificate should not be trusted unless verification is skipped", t, func() {
+		delete(authOpts, "http_ssl_ca")
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		hb.Halt()
+
+		authOpts["http_ssl_insecure_skip_verify"] = "true"
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		hb.Halt()
+	})
+
+}
+
+func TestHTTPHeaders(t *testing.T) {
+
+	token := "s3cr3t-t0k3n"
+	seenPaths := make(map[string]bool)
+	var mu sync.Mutex
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token || r.Header.Get("X-Tenant") != "acme" || r.Header.Get("X-Source") != "mosquitto" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		seenPaths[r.URL.Path] = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_headers"] = "X-Tenant: acme, X-Source:mosquitto"
+
+	Convey("Given wrong header options NewHTTP should fail", t, func() {
+		authOpts["http_headers"] = "X-Tenant acme"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "X-Tenant acme")
+		authOpts["http_headers"] = "X-Tenant: acme, X-Source:mosquitto"
+
+		authOpts["http_bearer_token"] = token
+		authOpts["http_bearer_token_file"] = "/some/file"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "couldn't read http_bearer_token_file")
+		delete(authOpts, "http_bearer_token")
+
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(authOpts, "http_bearer_token_file")
+	})
+
+	Convey("Without the bearer token requests should be rejected", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		hb.Halt()
+	})
+
+	Convey("Given a bearer token, headers should arrive on every check", t, func() {
+		authOpts["http_bearer_token"] = token
+		for _, paramsMode := range []string{"json", "form"} {
+			authOpts["http_params_mode"] = paramsMode
+			seenPaths = make(map[string]bool)
+
+			hb, err := NewHTTP(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+			So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeTrue)
+			So(seenPaths, ShouldResemble, map[string]bool{"/user": true, "/superuser": true, "/acl": true})
+			hb.Halt()
+		}
+		delete(authOpts, "http_bearer_token")
+	})
+
+	Convey("Given a bearer token file, the trimmed token should be sent", t, func() {
+		tokenFile, err := ioutil.TempFile("", "http_token")
+		So(err, ShouldBeNil)
+		defer os.Remove(tokenFile.Name())
+		tokenFile.WriteString(token + "\n")
+		tokenFile.Close()
+
+		authOpts["http_bearer_token_file"] = tokenFile.Name()
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.BearerToken, ShouldEqual, token)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		hb.Halt()
+
+		//The file takes precedence over the token given inline.
+		authOpts["http_bearer_token"] = "wrong-token"
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.BearerToken, ShouldEqual, token)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		hb.Halt()
+		delete(authOpts, "http_bearer_token")
+		delete(authOpts, "http_bearer_token_file")
+	})
+
+}
+
+func TestHTTPQueryStringServer(t *testing.T) {
+
+	username := "test_user"
+	password := "p@ss&word="
+	topic := "a/b+c#"
+	clientId := "test_client"
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+		log.Debugf("received query %s for path %s\n", r.URL.RawQuery, r.URL.Path)
+
+		if r.URL.Path == "/user" {
+			if params.Get("username") == username && params.Get("password") == password {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		} else if r.URL.Path == "/superuser" {
+			if params.Get("username") == username {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		} else if r.URL.Path == "/acl" {
+			//Reserved characters must be encoded.
+			if strings.Contains(r.URL.RawQuery, "topic=a%2Fb%2Bc%23") && params.Get("username") == username && params.Get("topic") == topic && params.Get("clientid") == clientId && params.Get("acc") == "1" {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "querystring"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given an unknown method NewHTTP should fail", t, func() {
+		authOpts["http_method"] = "PUT"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given querystring mode and GET method an http backend instance should be returned", t, func() {
+		authOpts["http_method"] = "GET"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Given correct password/username, get user should return true", func() {
+			So(hb.GetUser(username, password), ShouldBeTrue)
+		})
+
+		Convey("Given incorrect password/username, get user should return false", func() {
+			So(hb.GetUser(username, "wrong_password"), ShouldBeFalse)
+		})
+
+		Convey("Given correct username, get superuser should return true", func() {
+			So(hb.GetSuperuser(username), ShouldBeTrue)
+		})
+
+		Convey("Given a topic with reserved characters, acl check should return true", func() {
+			So(hb.CheckAcl(username, topic, clientId, 1), ShouldBeTrue)
+		})
+
+		Convey("Given another topic, acl check should return false", func() {
+			So(hb.CheckAcl(username, "a/b", clientId, 1), ShouldBeFalse)
+		})
+
+		hb.Halt()
+	})
+
+}
+
+func TestHTTPPathResponseServer(t *testing.T) {
+
+	var responseBody string
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(responseBody))
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "path"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given path response mode without a path or allow value NewHTTP should fail", t, func() {
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["http_response_path"] = "data.result"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given a nested object path, the value should be compared against the allow value", t, func() {
+		authOpts["http_response_path"] = "data.result"
+		authOpts["http_response_allow_value"] = "allow"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		responseBody = `{"data": {"result": "allow", "reason": "known user"}}`
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+
+		responseBody = `{"data": {"result": "deny", "reason": "wrong password", "password": "test_password"}}`
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+
+		Convey("Missing paths or non scalar values should deny", func() {
+			responseBody = `{"data": {"reason": "no result"}}`
+			So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+
+			responseBody = `{"data": "allow"}`
+			So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+
+			responseBody = `{"data": {"result": {"value": "allow"}}}`
+			So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+
+			responseBody = `{"data": {"result": null}}`
+			So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+
+			responseBody = `not json`
+			So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		})
+
+		hb.Halt()
+	})
+
+	Convey("Given a path through an array, the indexed element should be used", t, func() {
+		authOpts["http_response_path"] = "data.results.1.allowed"
+		authOpts["http_response_allow_value"] = "true"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		responseBody = `{"data": {"results": [{"allowed": false}, {"allowed": true}]}}`
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeTrue)
+
+		responseBody = `{"data": {"results": [{"allowed": true}, {"allowed": false}]}}`
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeFalse)
+
+		responseBody = `{"data": {"results": [{"allowed": true}]}}`
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeFalse)
+
+		hb.Halt()
+	})
+
+	Convey("Given boolean, string and number values, their string representation should be compared", t, func() {
+		authOpts["http_response_path"] = "superuser"
+		authOpts["http_response_allow_value"] = "true"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		responseBody = `{"superuser": true}`
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+
+		responseBody = `{"superuser": "true"}`
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+
+		responseBody = `{"superuser": false}`
+		So(hb.GetSuperuser("test_user"), ShouldBeFalse)
+
+		hb.ResponseAllowValue = "1"
+		responseBody = `{"superuser": 1}`
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+
+		hb.Halt()
+	})
+
+	Convey("Password fields should be redacted before logging a response", t, func() {
+		var data interface{}
+		json.Unmarshal([]byte(`{"data": {"Password": "secret", "items": [{"user_password": "secret", "name": "test"}]}}`), &data)
+		redacted, _ := json.Marshal(redactPasswords(data))
+		So(string(redacted), ShouldNotContainSubstring, "secret")
+		So(string(redacted), ShouldContainSubstring, "test")
+	})
+
+}
+
+func TestHTTPUnixSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "go-auth-socket")
+	if err != nil {
+		t.Fatalf("couldn't create socket dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "authz.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("couldn't listen on unix socket: %s", err)
+	}
+
+	var hosts []string
+	var mu sync.Mutex
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		if r.URL.Path == "/user" || r.URL.Path == "/superuser" || r.URL.Path == "/acl" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	mockServer.Listener.Close()
+	mockServer.Listener = listener
+	mockServer.Start()
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_socket"] = socket
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given a socket and no host or port, requests should be sent through the socket", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeTrue)
+		hb.Halt()
+	})
+
+	Convey("Given a socket and a host, the host should be used for the Host header only", t, func() {
+		authOpts["http_host"] = "authz.local"
+		hosts = nil
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hosts, ShouldResemble, []string{"authz.local"})
+
+		hb.UserUri = "/missing"
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		hb.Halt()
+	})
+
+	Convey("Given a missing socket, checks should be denied as with any connection error", t, func() {
+		authOpts["http_socket"] = filepath.Join(dir, "missing.sock")
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeFalse)
+		hb.Halt()
+	})
+
+}
+
+func TestHTTPCacheTTL(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&params)
+		username, _ := params["username"].(string)
+
+		switch username {
+		case "header_user":
+			w.Header().Set("Cache-Control", "private, max-age=120")
+			w.Write([]byte(`{"ok": true}`))
+		case "body_user":
+			w.Header().Set("Cache-Control", "max-age=120")
+			w.Write([]byte(`{"ok": true, "ttl": 45}`))
+		case "denied_user":
+			w.Header().Set("Cache-Control", "max-age=10")
+			w.Write([]byte(`{"ok": false, "error": "denied"}`))
+		case "zero_user":
+			w.Header().Set("Cache-Control", "no-store, max-age=0")
+			w.Write([]byte(`{"ok": true}`))
+		case "forbidden_user":
+			w.WriteHeader(http.StatusForbidden)
+		case "unavailable_user":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "slow_user":
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte(`{"ok": true}`))
+		default:
+			w.Write([]byte(`{"ok": true}`))
+		}
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_response_mode"] = "json"
+
+	Convey("Given responses with and without cache hints", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("The max-age directive should be returned as the ttl", func() {
+			granted, ttl := hb.GetUserTTL("header_user", "test_password")
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, 120*time.Second)
+		})
+
+		Convey("A ttl field in the body should take precedence over the header", func() {
+			granted, ttl := hb.CheckAclTTL("body_user", "test/topic/1", "test_clientid", 1)
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, 45*time.Second)
+		})
+
+		Convey("Denies should carry their hint too", func() {
+			granted, ttl := hb.GetUserTTL("denied_user", "test_password")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, 10*time.Second)
+		})
+
+		Convey("A zero max-age should be kept so the decision isn't cached", func() {
+			granted, ttl := hb.GetUserTTL("zero_user", "test_password")
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, 0)
+		})
+
+		Convey("Without a hint NoTTL should be returned", func() {
+			granted, ttl := hb.GetUserTTL("test_user", "test_password")
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, NoTTL)
+			So(hb.GetUser("header_user", "test_password"), ShouldBeTrue)
+
+			granted, ttl = hb.GetUserTTL("forbidden_user", "test_password")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, NoTTL)
+		})
+
+		Reset(func() {
+			hb.Halt()
+		})
+	})
+
+	Convey("Given a server failing to answer, denials should not be cached", t, func() {
+		opts := make(map[string]string)
+		for key, value := range authOpts {
+			opts[key] = value
+		}
+		opts["http_timeout_ms"] = "100"
+		opts["http_retries"] = "1"
+		opts["http_retry_backoff_ms"] = "10"
+
+		hb, err := NewHTTP(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer hb.Halt()
+
+		Convey("A 5xx response should return SkipCache once retries are exhausted, whatever its hint", func() {
+			granted, ttl := hb.GetUserTTL("unavailable_user", "test_password")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+		})
+
+		Convey("A timeout should return SkipCache", func() {
+			granted, ttl := hb.CheckAclTTL("slow_user", "test/topic/1", "test_clientid", 1)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+		})
+
+		Convey("A connection error should return SkipCache", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			opts["http_host"] = listener.Addr().String()
+			listener.Close()
+
+			down, err := NewHTTP(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer down.Halt()
+
+			granted, ttl := down.GetUserTTL("test_user", "test_password")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+		})
+
+		Convey("A deadline passed while backing off should return SkipCache", func() {
+			opts["http_retries"] = "5"
+			opts["http_retry_backoff_ms"] = "1000"
+			opts["http_retry_deadline_ms"] = "200"
+
+			hb, err := NewHTTP(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer hb.Halt()
+
+			granted, ttl := hb.GetUserTTL("unavailable_user", "test_password")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+		})
+	})
+
+}
+
+func TestHTTPEnrichedParams(t *testing.T) {
+
+	bodies := make(map[string]string)
+	var mu sync.Mutex
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = string(body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_enrich_params"] = "true"
+	authOpts["http_extra_params"] = "listener=8883, region = eu"
+	authOpts["http_user_field"] = "user"
+	authOpts["http_topic_field"] = "t"
+
+	Convey("Given wrong field or extra params options NewHTTP should fail", t, func() {
+		authOpts["http_clientid_field"] = "user"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(authOpts, "http_clientid_field")
+
+		authOpts["http_extra_params"] = "listener"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "listener")
+
+		authOpts["http_extra_params"] = "t=some/topic"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["http_extra_params"] = "listener=8883, region = eu"
+	})
+
+	Convey("Given json params mode, bodies should be enriched", t, func() {
+		authOpts["http_params_mode"] = "json"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+		So(hb.CheckAcl("test_user", "test/topic/1", "test_clientid", 4), ShouldBeTrue)
+
+		So(bodies["/user"], ShouldEqual, `{"check":"user","listener":"8883","password":"test_password","region":"eu","user":"test_user"}`)
+		So(bodies["/superuser"], ShouldEqual, `{"check":"superuser","listener":"8883","region":"eu","user":"test_user"}`)
+		So(bodies["/acl"], ShouldEqual, `{"acc":4,"acc_name":"subscribe","check":"acl","clientid":"test_clientid","listener":"8883","region":"eu","t":"test/topic/1","user":"test_user"}`)
+
+		hb.Halt()
+	})
+
+	Convey("Given form params mode, bodies should be enriched", t, func() {
+		authOpts["http_params_mode"] = "form"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+		So(hb.CheckAcl("test_user", "test/topic/1", "test_clientid", 3), ShouldBeTrue)
+
+		So(bodies["/user"], ShouldEqual, "check=user&listener=8883&password=test_password&region=eu&user=test_user")
+		So(bodies["/superuser"], ShouldEqual, "check=superuser&listener=8883&region=eu&user=test_user")
+		So(bodies["/acl"], ShouldEqual, "acc=3&acc_name=readwrite&check=acl&clientid=test_clientid&listener=8883&region=eu&t=test%2Ftopic%2F1&user=test_user")
+
+		hb.Halt()
+	})
+
+	Convey("Without enrichment only the renamed and extra params should be sent", t, func() {
+		authOpts["http_params_mode"] = "json"
+		delete(authOpts, "http_enrich_params")
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.CheckAcl("test_user", "test/topic/1", "test_clientid", 1), ShouldBeTrue)
+		So(bodies["/acl"], ShouldEqual, `{"acc":1,"clientid":"test_clientid","listener":"8883","region":"eu","t":"test/topic/1","user":"test_user"}`)
+
+		hb.Halt()
+	})
+
+}
+
+func TestHTTPHMACSignature(t *testing.T) {
+
+	secret := "s3cr3t-hm4c"
+	var mu sync.Mutex
+	verified := make(map[string]bool)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := body
+		if r.Method == http.MethodGet {
+			payload = []byte(r.URL.RawQuery)
+		}
+
+		timestamp := r.Header.Get("X-Timestamp")
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(ts, 0)) > time.Minute || time.Until(time.Unix(ts, 0)) > time.Minute {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(payload)
+		signature, err := hex.DecodeString(r.Header.Get("X-Auth-Signature"))
+		if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		verified[r.URL.Path] = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_hmac_header"] = "X-Auth-Signature"
+
+	Convey("Signatures should match the known test vectors", t, func() {
+		So(hmacSignature([]byte("secret"), "1700000000", []byte(`{"password":"test_password","username":"test_user"}`)), ShouldEqual, "46772aa04ba8b0011a08a7847d3f7e1d44837ce46356b02964cedd8fb97eff47")
+		So(hmacSignature([]byte("secret"), "1700000000", []byte("password=test_password&username=test_user")), ShouldEqual, "66ee8adebd26eb9945f08039e5c2bbe40496f0bad097219aa6e39d2ab2108239")
+		So(hmacSignature([]byte("secret"), "1700000000", nil), ShouldEqual, "4bc5f74d868b97888288889c5d9d65df02526f94c1592a79fdf4fe8b26e311e5")
+	})
+
+	Convey("Given wrong hmac options NewHTTP should fail", t, func() {
+		authOpts["http_hmac_secret"] = secret
+		authOpts["http_hmac_secret_file"] = "/some/file"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(authOpts, "http_hmac_secret")
+
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(authOpts, "http_hmac_secret_file")
+
+		authOpts["http_hmac_secret"] = ""
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(authOpts, "http_hmac_secret")
+	})
+
+	Convey("Without a secret requests should be rejected", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+		hb.Halt()
+	})
+
+	Convey("Given a secret file, every check should be signed in every params mode", t, func() {
+		dir, err := ioutil.TempDir("", "hmac")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		secretFile := filepath.Join(dir, "secret")
+		So(ioutil.WriteFile(secretFile, []byte(secret+"\n"), 0600), ShouldBeNil)
+		authOpts["http_hmac_secret_file"] = secretFile
+
+		for _, paramsMode := range []string{"json", "form", "querystring"} {
+			authOpts["http_params_mode"] = paramsMode
+			authOpts["http_method"] = "POST"
+			if paramsMode == "querystring" {
+				authOpts["http_method"] = "GET"
+			}
+			verified = make(map[string]bool)
+
+			hb, err := NewHTTP(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+			So(hb.CheckAcl("test_user", "test/topic/1", "test_clientid", 1), ShouldBeTrue)
+			So(verified, ShouldResemble, map[string]bool{"/user": true, "/superuser": true, "/acl": true})
+			hb.Halt()
+		}
+	})
+
+}
+
+func TestHTTPPerCheckEndpoints(t *testing.T) {
+
+	var userHits, aclHits int32
+
+	userServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&userHits, 1)
+		if r.URL.Path != "/user" && r.URL.Path != "/superuser" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer userServer.Close()
+
+	aclServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&aclHits, 1)
+		if r.URL.Path != "/acl" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer aclServer.Close()
+
+	aclHost, aclPort, err := net.SplitHostPort(strings.Replace(aclServer.URL, "https://", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authOpts := make(map[string]string)
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_aclcheck_host"] = aclHost
+	authOpts["http_aclcheck_port"] = aclPort
+	authOpts["http_aclcheck_with_tls"] = "true"
+
+	Convey("Without a shared host the checks that don't override it should make NewHTTP fail", t, func() {
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "http_host")
+	})
+
+	Convey("Given a shared host and an acl override, each check should hit its own server", t, func() {
+		authOpts["http_host"] = strings.Replace(userServer.URL, "http://", "", -1)
+		authOpts["http_port"] = ""
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.UserEndpoint.Client, ShouldEqual, hb.SuperuserEndpoint.Client)
+		So(hb.AclEndpoint.Client, ShouldNotEqual, hb.UserEndpoint.Client)
+
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+		So(hb.CheckAcl("test_user", "test/topic/1", "test_clientid", 1), ShouldBeTrue)
+
+		So(atomic.LoadInt32(&userHits), ShouldEqual, 2)
+		So(atomic.LoadInt32(&aclHits), ShouldEqual, 1)
+
+		hb.Halt()
+	})
+
+	Convey("Without the acl endpoint's TLS override the acl check should fail", t, func() {
+		delete(authOpts, "http_aclcheck_with_tls")
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.CheckAcl("test_user", "test/topic/1", "test_clientid", 1), ShouldBeFalse)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+
+		hb.Halt()
+	})
+
+}
+
+//newRecordingProxy starts a forward proxy, tunneling CONNECT requests too, that records the hosts requested through it.
+func newRecordingProxy() (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var hosts []string
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Method+" "+r.Host)
+		mu.Unlock()
+
+		if r.Method == http.MethodConnect {
+			target, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			hijacker, _ := w.(http.Hijacker)
+			client, _, err := hijacker.Hijack()
+			if err != nil {
+				target.Close()
+				return
+			}
+			client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			go func() {
+				io.Copy(target, client)
+				target.Close()
+			}()
+			io.Copy(client, target)
+			client.Close()
+			return
+		}
+
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+
+	return proxy, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), hosts...)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer tlsServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given wrong proxy options NewHTTP should fail", t, func() {
+		authOpts["http_proxy_url"] = "localhost:3128"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["http_proxy_url"] = "http://localhost:3128"
+		authOpts["http_proxy_from_environment"] = "true"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		delete(authOpts, "http_proxy_url")
+		delete(authOpts, "http_proxy_from_environment")
+	})
+
+	Convey("Given a proxy url, requests should traverse the proxy", t, func() {
+		proxy, traversed := newRecordingProxy()
+		defer proxy.Close()
+		authOpts["http_proxy_url"] = proxy.URL
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hb.CheckAcl("test_user", "test/topic/1", "test_clientid", 1), ShouldBeTrue)
+		So(traversed(), ShouldResemble, []string{"POST " + authOpts["http_host"], "POST " + authOpts["http_host"]})
+		hb.Halt()
+
+		Convey("Hosts in http_no_proxy should be reached directly", func() {
+			authOpts["http_no_proxy"] = "example.com, 127.0.0.0/8"
+			hb, err := NewHTTP(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			So(traversed(), ShouldHaveLength, 2)
+			hb.Halt()
+			delete(authOpts, "http_no_proxy")
+		})
+
+		Convey("An https authorizer should be reached through a CONNECT tunnel", func() {
+			tlsAuthOpts := make(map[string]string)
+			for k, v := range authOpts {
+				tlsAuthOpts[k] = v
+			}
+			tlsAuthOpts["http_host"] = strings.Replace(tlsServer.URL, "https://", "", -1)
+			tlsAuthOpts["http_with_tls"] = "true"
+
+			hb, err := NewHTTP(tlsAuthOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			So(traversed()[2:], ShouldResemble, []string{"CONNECT " + tlsAuthOpts["http_host"]})
+			hb.Halt()
+		})
+
+		delete(authOpts, "http_proxy_url")
+	})
+
+	Convey("Without proxy options the environment should be ignored unless asked for", t, func() {
+		proxy, traversed := newRecordingProxy()
+		defer proxy.Close()
+		os.Setenv("HTTP_PROXY", proxy.URL)
+		defer os.Unsetenv("HTTP_PROXY")
+
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(traversed(), ShouldBeEmpty)
+		So(hb.Client.Transport.(*http.Transport).Proxy, ShouldBeNil)
+		hb.Halt()
+
+		authOpts["http_proxy_from_environment"] = "true"
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Client.Transport.(*http.Transport).Proxy, ShouldNotBeNil)
+		hb.Halt()
+		delete(authOpts, "http_proxy_from_environment")
+	})
+
+}
@@ -0,0 +1,83 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//Introspector asks an OAuth2 authorization server about opaque tokens through its introspection endpoint (RFC 7662), authenticating with client credentials.
+type Introspector struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+
+	client *http.Client
+}
+
+//NewIntrospector returns an introspector for the given endpoint and client credentials.
+func NewIntrospector(url, clientID, clientSecret string) *Introspector {
+	return &Introspector{
+		URL:          url,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+//Introspect returns the claims given by the introspection response for an active token. Inactive tokens and malformed responses are errors.
+func (i *Introspector) Introspect(token string) (*Claims, error) {
+	form := url.Values{
+		"token":           []string{token},
+		"token_type_hint": []string{"access_token"},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, i.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.ClientID), url.QueryEscape(i.ClientSecret))
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("introspection wrong http status %d", resp.StatusCode)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, errors.Errorf("introspection malformed response: %s", err)
+	}
+
+	active, ok := raw["active"].(bool)
+	if !ok {
+		return nil, errors.New("introspection malformed response: missing active field")
+	}
+	if !active {
+		return nil, errors.New("introspection inactive token")
+	}
+
+	claims := &Claims{}
+	if err := json.Unmarshal(body, claims); err != nil {
+		return nil, errors.Errorf("introspection malformed response: %s", err)
+	}
+	claims.Raw = raw
+
+	return claims, nil
+}
@@ -0,0 +1,217 @@
+package backends
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIntrospection(t *testing.T) {
+
+	responses := map[string]string{
+		"active-token":   `{"active": true, "sub": "dev1", "client_id": "fleet", "device": {"serial": "sn-1"}, "scope": "openid mqtt:pub:tele/%u/# mqtt:sub:cmd/%u/+ mqtt:pub:shared/# mqtt:sub:shared/# other:pub:#"}`,
+		"admin-token":    `{"active": true, "sub": "ops", "su": true}`,
+		"inactive-token": `{"active": false}`,
+		"no-active":      `{"sub": "dev1"}`,
+		"string-active":  `{"active": "true", "sub": "dev1"}`,
+		"not-json":       `<html>oops</html>`,
+		"wrong-exp":      `{"active": true, "sub": "dev1", "exp": "tomorrow"}`,
+	}
+
+	var requests int32
+
+	introspectionServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "mqtt-broker" || clientSecret != "broker-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != http.MethodPost || r.FormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token := r.FormValue("token")
+		if token == "expiring-token" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "dev1", "exp": time.Now().Add(time.Minute).Unix()})
+			return
+		}
+
+		response, ok := responses[token]
+		if !ok {
+			response = `{"active": false}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+
+	defer introspectionServer.Close()
+
+	authOpts := func() map[string]string {
+		return map[string]string{
+			"jwt_mode":              "introspection",
+			"jwt_introspection_url": introspectionServer.URL,
+			"jwt_client_id":         "mqtt-broker",
+			"jwt_client_secret":     "broker-secret",
+		}
+	}
+
+	Convey("Given wrong introspection options NewJWT should fail", t, func() {
+		opts := authOpts()
+		delete(opts, "jwt_client_secret")
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "jwt_client_secret")
+
+		opts = authOpts()
+		opts["jwt_remote"] = "true"
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		opts = authOpts()
+		opts["jwt_mode"] = "magic"
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given an introspector", t, func() {
+		introspector := NewIntrospector(introspectionServer.URL, "mqtt-broker", "broker-secret")
+
+		Convey("Active tokens should give their claims", func() {
+			claims, err := introspector.Introspect("active-token")
+			So(err, ShouldBeNil)
+			So(claims.Subject, ShouldEqual, "dev1")
+			So(claims.Raw["client_id"], ShouldEqual, "fleet")
+		})
+
+		Convey("Inactive tokens should be rejected", func() {
+			_, err := introspector.Introspect("inactive-token")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "inactive")
+
+			_, err = introspector.Introspect("unknown-token")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Malformed responses should be rejected", func() {
+			for _, token := range []string{"no-active", "string-active", "not-json", "wrong-exp"} {
+				_, err := introspector.Introspect(token)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "malformed")
+			}
+		})
+
+		Convey("Wrong client credentials should be rejected", func() {
+			introspector.ClientSecret = "wrong"
+			_, err := introspector.Introspect("active-token")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given introspection mode", t, func() {
+		opts := authOpts()
+		opts["jwt_superuser_claim"] = "su"
+		//Acls are given by scopes, as there's no acl query to check them with.
+		opts["jwt_scope_acls"] = "true"
+		o, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(o.tokenCache, ShouldNotBeNil)
+		atomic.StoreInt32(&requests, 0)
+
+		Convey("Only active tokens should authenticate, without any DB", func() {
+			So(o.GetUser("active-token", ""), ShouldBeTrue)
+			So(o.GetUser("inactive-token", ""), ShouldBeFalse)
+			So(o.GetUser("not-json", ""), ShouldBeFalse)
+		})
+
+		Convey("Superusers should be given by the superuser claim", func() {
+			So(o.GetSuperuser("admin-token"), ShouldBeTrue)
+			So(o.GetSuperuser("active-token"), ShouldBeFalse)
+		})
+
+		Convey("Responses should be cached per token", func() {
+			for i := 0; i < 10; i++ {
+				So(o.GetUser("active-token", ""), ShouldBeTrue)
+				So(o.CheckAcl("active-token", "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			}
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+
+			So(o.GetUser("admin-token", ""), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 2)
+		})
+
+		Convey("Cached responses should die when the token expires", func() {
+			So(o.GetUser("expiring-token", ""), ShouldBeTrue)
+			o.tokenCache.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+			So(o.GetUser("expiring-token", ""), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 2)
+		})
+
+		Convey("Inactive and malformed responses should not be cached", func() {
+			So(o.GetUser("inactive-token", ""), ShouldBeFalse)
+			So(o.GetUser("inactive-token", ""), ShouldBeFalse)
+			So(o.GetUser("no-active", ""), ShouldBeFalse)
+			So(o.GetUser("no-active", ""), ShouldBeFalse)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 4)
+		})
+	})
+
+	Convey("Given introspection mode with a username field", t, func() {
+		opts := authOpts()
+		opts["jwt_username_claim"] = "device.serial"
+		opts["jwt_token_source"] = "password"
+		opts["jwt_verify_username"] = "true"
+		o, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("The username should be taken from it", func() {
+			So(o.GetClientUser("sn-1", "active-token", "client-1"), ShouldBeTrue)
+			So(o.GetClientUser("dev1", "active-token", "client-1"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given introspection mode with scope acls", t, func() {
+		opts := authOpts()
+		opts["jwt_scope_acls"] = "true"
+		o, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Writes should be allowed by pub scopes", func() {
+			So(o.CheckAcl("active-token", "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl("active-token", "tele/dev2/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl("active-token", "cmd/dev1/reboot", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Reads and subscriptions should be allowed by sub scopes", func() {
+			So(o.CheckAcl("active-token", "cmd/dev1/reboot", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("active-token", "cmd/dev1/+", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(o.CheckAcl("active-token", "tele/dev1/temp", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl("active-token", "cmd/#", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+		})
+
+		Convey("Readwrite should need both scopes", func() {
+			So(o.CheckAcl("active-token", "shared/state", "client-1", MOSQ_ACL_READWRITE), ShouldBeTrue)
+			So(o.CheckAcl("active-token", "tele/dev1/temp", "client-1", MOSQ_ACL_READWRITE), ShouldBeFalse)
+		})
+
+		Convey("Scopes with other prefixes should be ignored", func() {
+			So(o.CheckAcl("active-token", "anything", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Inactive tokens and tokens without scopes should be denied", func() {
+			So(o.CheckAcl("inactive-token", "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl("admin-token", "tele/ops/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+	})
+
+}
@@ -0,0 +1,296 @@
+package backends
+
+import (
+	"io/ioutil"
+	"math"
+	"runtime"
+	"time"
+
+	"github.com/dop251/goja"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+type JS struct {
+	UserScript      string
+	SuperuserScript string
+	AclScript       string
+
+	Timeout  time.Duration
+	PoolSize int
+
+	programs jsPrograms
+	vms      chan *jsVM
+}
+
+//JSOptions are the auth options the JavaScript backend takes.
+var JSOptions = Options{
+	Keys: []string{"js_acl_script", "js_pool_size", "js_superuser_script", "js_timeout_ms", "js_user_script"},
+}
+
+//jsPrograms are the compiled scripts, nil when not given, which every vm runs.
+type jsPrograms struct {
+	user      *goja.Program
+	superuser *goja.Program
+	acl       *goja.Program
+}
+
+//jsVM is a runtime with the functions the scripts export, which checks are made with one at a time.
+type jsVM struct {
+	runtime   *goja.Runtime
+	user      goja.Callable
+	superuser goja.Callable
+	acl       goja.Callable
+}
+
+//jsTimeout is what a vm is interrupted with when a script runs for too long.
+var jsTimeout = errors.New("timed out")
+
+func NewJS(authOpts map[string]string, logLevel log.Level) (JS, error) {
+
+	log.SetLevel(logLevel)
+
+	authOpts, err := JSOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return JS{}, errors.Errorf("JavaScript backend error: %s.\n", err)
+	}
+
+	var js = JS{
+		Timeout:  200 * time.Millisecond,
+		PoolSize: runtime.NumCPU(),
+	}
+
+	if userScript, ok := authOpts["js_user_script"]; ok {
+		js.UserScript = userScript
+	}
+
+	if superuserScript, ok := authOpts["js_superuser_script"]; ok {
+		js.SuperuserScript = superuserScript
+	}
+
+	if aclScript, ok := authOpts["js_acl_script"]; ok {
+		js.AclScript = aclScript
+	}
+
+	if js.UserScript == "" && js.SuperuserScript == "" && js.AclScript == "" {
+		return js, errors.New("JavaScript backend error: missing options: js_user_script, js_superuser_script or js_acl_script.\n")
+	}
+
+	js.Timeout = common.DurationOption(authOpts, "js_timeout_ms", time.Millisecond, time.Millisecond, js.Timeout)
+
+	js.PoolSize = common.IntOption(authOpts, "js_pool_size", 1, math.MaxInt32, js.PoolSize)
+
+	if js.programs.user, err = compileJSScript("js_user_script", js.UserScript); err != nil {
+		return js, errors.Errorf("JavaScript backend error: %s.\n", err)
+	}
+	if js.programs.superuser, err = compileJSScript("js_superuser_script", js.SuperuserScript); err != nil {
+		return js, errors.Errorf("JavaScript backend error: %s.\n", err)
+	}
+	if js.programs.acl, err = compileJSScript("js_acl_script", js.AclScript); err != nil {
+		return js, errors.Errorf("JavaScript backend error: %s.\n", err)
+	}
+
+	//Every vm runs the scripts now, so one failing to load keeps mosquitto from starting rather than failing checks.
+	js.vms = make(chan *jsVM, js.PoolSize)
+	for i := 0; i < js.PoolSize; i++ {
+		vm, err := js.newVM()
+		if err != nil {
+			return js, errors.Errorf("JavaScript backend error: %s.\n", err)
+		}
+		js.vms <- vm
+	}
+
+	log.Infof("JavaScript backend: loaded scripts in %d vms.", js.PoolSize)
+
+	return js, nil
+
+}
+
+//compileJSScript compiles the script at path, given by the option, wrapped as a CommonJS module so its top level variables are its own. It returns a nil program when there's no path.
+func compileJSScript(option, path string) (*goja.Program, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read %s: %s", option, err)
+	}
+
+	//The wrapper starts on the script's first line, so errors tell the script's own line numbers.
+	program, err := goja.Compile(path, "(function (module, exports) {"+string(source)+"\n})", false)
+	if err != nil {
+		return nil, errors.Errorf("couldn't compile %s: %s", option, err)
+	}
+	return program, nil
+}
+
+//newVM returns a vm which ran every script, with the functions they export.
+func (o JS) newVM() (*jsVM, error) {
+	vm := &jsVM{runtime: goja.New()}
+
+	var err error
+	if vm.user, err = vm.load(o.programs.user, "js_user_script", o.Timeout); err != nil {
+		return nil, err
+	}
+	if vm.superuser, err = vm.load(o.programs.superuser, "js_superuser_script", o.Timeout); err != nil {
+		return nil, err
+	}
+	if vm.acl, err = vm.load(o.programs.acl, "js_acl_script", o.Timeout); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+//load runs the program, given by the option, returning the function it sets module.exports to.
+func (vm *jsVM) load(program *goja.Program, option string, timeout time.Duration) (goja.Callable, error) {
+	if program == nil {
+		return nil, nil
+	}
+
+	module := vm.runtime.NewObject()
+	exports := vm.runtime.NewObject()
+	if err := module.Set("exports", exports); err != nil {
+		return nil, err
+	}
+
+	_, err := vm.run(timeout, func() (goja.Value, error) {
+		wrapper, err := vm.runtime.RunProgram(program)
+		if err != nil {
+			return nil, err
+		}
+		call, ok := goja.AssertFunction(wrapper)
+		if !ok {
+			return nil, errors.New("script isn't a module")
+		}
+		return call(goja.Undefined(), module, exports)
+	})
+	if err != nil {
+		return nil, errors.Errorf("couldn't load %s: %s", option, err)
+	}
+
+	check, ok := goja.AssertFunction(module.Get("exports"))
+	if !ok {
+		return nil, errors.Errorf("%s doesn't export a function, it must set module.exports to one", option)
+	}
+	return check, nil
+}
+
+//run calls f, interrupting the vm when it takes longer than the timeout, e.g. a script looping forever.
+func (vm *jsVM) run(timeout time.Duration, f func() (goja.Value, error)) (goja.Value, error) {
+	interrupted := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		vm.runtime.Interrupt(jsTimeout)
+		close(interrupted)
+	})
+
+	value, err := f()
+
+	//When the timer fired, its interrupt must be done before it's cleared, or it could be left for the next check.
+	if !timer.Stop() {
+		<-interrupted
+	}
+	vm.runtime.ClearInterrupt()
+
+	if err != nil {
+		if _, ok := err.(*goja.InterruptedError); ok {
+			return nil, jsTimeout
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+//check calls the function the script given by the option exports with a free vm, denying when it fails or returns anything but a boolean.
+//A check, waiting for a free vm included, never takes longer than js_timeout_ms, and a denial due to it timing out is told not to be cached.
+func (o JS) check(option string, function func(vm *jsVM) goja.Callable, username, password, topic, clientid string, acc int32) (bool, time.Duration) {
+	start := time.Now()
+	timer := time.NewTimer(o.Timeout)
+	defer timer.Stop()
+
+	var vm *jsVM
+	select {
+	case vm = <-o.vms:
+	case <-timer.C:
+		log.Errorf("JavaScript backend: %s timed out after %s waiting for a free vm, denying user %s.", option, time.Since(start), common.RedactUsername(username))
+		return false, SkipCache
+	}
+	defer func() {
+		o.vms <- vm
+	}()
+
+	call := function(vm)
+
+	timeout := o.Timeout - time.Since(start)
+	if timeout <= 0 {
+		timeout = time.Nanosecond
+	}
+
+	value, err := vm.run(timeout, func() (goja.Value, error) {
+		r := vm.runtime
+		return call(goja.Undefined(), r.ToValue(username), r.ToValue(password), r.ToValue(topic), r.ToValue(clientid), r.ToValue(acc))
+	})
+	if err == jsTimeout {
+		log.Errorf("JavaScript backend: %s timed out after %s, denying user %s.", option, time.Since(start), common.RedactUsername(username))
+		return false, SkipCache
+	}
+	if err != nil {
+		log.Errorf("JavaScript backend: %s error, denying user %s: %s", option, common.RedactUsername(username), err)
+		return false, NoTTL
+	}
+
+	granted, ok := value.Export().(bool)
+	if !ok {
+		log.Errorf("JavaScript backend: %s returned %s instead of a boolean, denying user %s.", option, value, common.RedactUsername(username))
+		return false, NoTTL
+	}
+	return granted, NoTTL
+}
+
+//GetUser checks the user with the function js_user_script exports, given the username and password.
+func (o JS) GetUser(username, password string) bool {
+	ok, _ := o.GetUserTTL(username, password)
+	return ok
+}
+
+//GetUserTTL checks the user as GetUser does, telling not to cache a denial when the script timed out.
+func (o JS) GetUserTTL(username, password string) (bool, time.Duration) {
+	if o.programs.user == nil {
+		return false, NoTTL
+	}
+	return o.check("js_user_script", func(vm *jsVM) goja.Callable { return vm.user }, username, password, "", "", 0)
+}
+
+//GetSuperuser checks the user with the function js_superuser_script exports, given the username.
+func (o JS) GetSuperuser(username string) bool {
+	if o.programs.superuser == nil {
+		return false
+	}
+	ok, _ := o.check("js_superuser_script", func(vm *jsVM) goja.Callable { return vm.superuser }, username, "", "", "", 0)
+	return ok
+}
+
+//CheckAcl checks the acl with the function js_acl_script exports, given the username, topic, clientid and access.
+func (o JS) CheckAcl(username, topic, clientid string, acc int32) bool {
+	ok, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return ok
+}
+
+//CheckAclTTL checks the acl as CheckAcl does, telling not to cache a denial when the script timed out.
+func (o JS) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
+	if o.programs.acl == nil {
+		return false, NoTTL
+	}
+	return o.check("js_acl_script", func(vm *jsVM) goja.Callable { return vm.acl }, username, "", topic, clientid, acc)
+}
+
+//GetName returns the backend's name
+func (o JS) GetName() string {
+	return "JavaScript"
+}
+
+//Halt does nothing, as the vms need no cleanup.
+func (o JS) Halt() {}
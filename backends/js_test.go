@@ -0,0 +1,155 @@
+package backends
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJS(t *testing.T) {
+
+	authOpts := func(opts map[string]string) map[string]string {
+		all := map[string]string{
+			"js_user_script":      "testdata/js/user.js",
+			"js_superuser_script": "testdata/js/superuser.js",
+			"js_acl_script":       "testdata/js/acl.js",
+		}
+		for key, value := range opts {
+			if value == "" {
+				delete(all, key)
+			} else {
+				all[key] = value
+			}
+		}
+		return all
+	}
+
+	Convey("Given wrong options or scripts failing to load, NewJS should fail", t, func() {
+		for _, opts := range []map[string]string{
+			{"js_user_script": "", "js_superuser_script": "", "js_acl_script": ""},
+			{"js_user_script": "testdata/js/missing.js"},
+			{"js_user_script": "testdata/js/syntax.js"},
+			{"js_superuser_script": "testdata/js/loadthrow.js"},
+			{"js_acl_script": "testdata/js/noexport.js"},
+			{"js_acl_script": "testdata/js/loadloop.js", "js_timeout_ms": "50"},
+		} {
+			_, err := NewJS(authOpts(opts), log.DebugLevel)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given invalid numbers, NewJS should warn and use the defaults", t, func() {
+		js, err := NewJS(authOpts(map[string]string{"js_timeout_ms": "0", "js_pool_size": "0"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer js.Halt()
+		So(js.Timeout, ShouldEqual, 200*time.Millisecond)
+		So(js.PoolSize, ShouldEqual, runtime.NumCPU())
+	})
+
+	Convey("Given sample scripts, checks should be made by the functions they export", t, func() {
+		js, err := NewJS(authOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer js.Halt()
+
+		So(js.GetUser("test1", "testpw"), ShouldBeTrue)
+		So(js.GetUser("test2", "otherpw"), ShouldBeTrue)
+		So(js.GetUser("test1", "otherpw"), ShouldBeFalse)
+		So(js.GetUser("nobody", "testpw"), ShouldBeFalse)
+		So(js.GetUser("hasOwnProperty", ""), ShouldBeFalse)
+
+		So(js.GetSuperuser("admin"), ShouldBeTrue)
+		So(js.GetSuperuser("test1"), ShouldBeFalse)
+
+		So(js.CheckAcl("test1", "tele/dev1", "dev1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(js.CheckAcl("test1", "tele/dev1", "dev1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(js.CheckAcl("test1", "tele/dev1", "dev2", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(js.CheckAcl("test1", "cmd/test1", "dev1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+		So(js.CheckAcl("test1", "cmd/test1", "dev1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(js.CheckAcl("test2", "cmd/test1", "dev1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(js.CheckAcl("test2", "announcements/all", "dev1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(js.CheckAcl("test2", "announcements/all", "dev1", MOSQ_ACL_READWRITE), ShouldBeFalse)
+
+		_, ttl := js.GetUserTTL("test1", "testpw")
+		So(ttl, ShouldEqual, NoTTL)
+	})
+
+	Convey("Given only some scripts, the other checks should be denied", t, func() {
+		js, err := NewJS(authOpts(map[string]string{"js_superuser_script": "", "js_acl_script": ""}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(js.GetUser("test1", "testpw"), ShouldBeTrue)
+		So(js.GetSuperuser("admin"), ShouldBeFalse)
+		So(js.CheckAcl("test1", "tele/dev1", "dev1", MOSQ_ACL_WRITE), ShouldBeFalse)
+	})
+
+	Convey("Given a script throwing or returning anything but a boolean, checks should be denied", t, func() {
+		js, err := NewJS(authOpts(map[string]string{"js_superuser_script": "testdata/js/throwing.js"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(js.GetSuperuser("throwing"), ShouldBeFalse)
+		So(js.GetSuperuser("test1"), ShouldBeFalse)
+		So(js.GetSuperuser("test2"), ShouldBeTrue)
+	})
+
+	Convey("Given a script looping forever, checks should be denied in time and their denials not cached", t, func() {
+		js, err := NewJS(authOpts(map[string]string{"js_acl_script": "testdata/js/loop.js", "js_timeout_ms": "100", "js_pool_size": "1"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		start := time.Now()
+		granted, ttl := js.CheckAclTTL("looping", "some/topic", "client", MOSQ_ACL_READ)
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+		So(time.Since(start), ShouldBeLessThan, 300*time.Millisecond)
+
+		//The vm is interrupted rather than left running, so it's free for the next checks.
+		granted, ttl = js.CheckAclTTL("test1", "some/topic", "client", MOSQ_ACL_READ)
+		So(granted, ShouldBeTrue)
+		So(ttl, ShouldEqual, NoTTL)
+
+		Convey("And checks waiting for a free vm for too long should be denied too", func() {
+			var wg sync.WaitGroup
+			ttls := make([]time.Duration, 3)
+			start := time.Now()
+			for i := range ttls {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, ttls[i] = js.CheckAclTTL("looping", "some/topic", "client", MOSQ_ACL_READ)
+				}(i)
+			}
+			wg.Wait()
+
+			So(time.Since(start), ShouldBeLessThan, 300*time.Millisecond)
+			for _, ttl := range ttls {
+				So(ttl, ShouldEqual, SkipCache)
+			}
+		})
+	})
+
+	Convey("Given concurrent checks, they should be made on pooled vms", t, func() {
+		js, err := NewJS(authOpts(map[string]string{"js_pool_size": "4"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(len(js.vms), ShouldEqual, 4)
+
+		var wg sync.WaitGroup
+		results := make([]bool, 50)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = js.GetUser("test1", "testpw") && js.CheckAcl("test1", "cmd/test1", "dev1", MOSQ_ACL_READ) && !js.GetSuperuser("test1")
+			}(i)
+		}
+		wg.Wait()
+
+		for _, result := range results {
+			So(result, ShouldBeTrue)
+		}
+		So(len(js.vms), ShouldEqual, 4)
+	})
+
+}
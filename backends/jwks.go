@@ -0,0 +1,244 @@
+package backends
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//JWKS holds the keys published at a JSON Web Key Set url, refreshing them periodically and on demand when an unknown key id shows up.
+type JWKS struct {
+	URL                string
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+
+	client      *http.Client
+	mu          sync.RWMutex
+	keys        map[string]interface{}
+	lastRefresh time.Time
+	refreshMu   sync.Mutex
+	done        chan struct{}
+	halt        sync.Once
+}
+
+//jsonWebKey holds the fields of a JWK needed to build RSA and EC public keys.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//NewJWKS fetches the key set at url and starts refreshing it every refreshInterval. A failed first fetch is only logged, as keys will be fetched again when needed.
+func NewJWKS(url string, refreshInterval time.Duration) *JWKS {
+	jwks := &JWKS{
+		URL:                url,
+		RefreshInterval:    refreshInterval,
+		MinRefreshInterval: 10 * time.Second,
+		client:             &http.Client{Timeout: 5 * time.Second},
+		keys:               make(map[string]interface{}),
+		done:               make(chan struct{}),
+	}
+
+	if err := jwks.refresh(); err != nil {
+		log.Warningf("jwks fetch error, no keys available yet: %s\n", err)
+	}
+
+	go jwks.refreshLoop()
+
+	return jwks
+}
+
+//Key returns the key with the given id. Unknown ids trigger a refresh, unless the keys were refreshed too recently.
+//An empty id may only be used when the set holds a single key.
+func (k *JWKS) Key(kid string) (interface{}, error) {
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+
+	k.refreshMu.Lock()
+	//Some other check may have refreshed the keys while waiting for the lock.
+	if key, ok := k.lookup(kid); ok {
+		k.refreshMu.Unlock()
+		return key, nil
+	}
+	k.mu.RLock()
+	recent := time.Since(k.lastRefresh) < k.MinRefreshInterval
+	k.mu.RUnlock()
+	if !recent {
+		log.Debugf("jwks unknown kid %s, refreshing keys\n", kid)
+		if err := k.refresh(); err != nil {
+			log.Warningf("jwks refresh error, keeping last keys: %s\n", err)
+		}
+	}
+	k.refreshMu.Unlock()
+
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+
+	return nil, errors.Errorf("jwks unknown kid %s", kid)
+}
+
+func (k *JWKS) lookup(kid string) (interface{}, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *JWKS) refreshLoop() {
+	ticker := time.NewTicker(k.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+			k.refreshMu.Lock()
+			if err := k.refresh(); err != nil {
+				log.Warningf("jwks refresh error, keeping last keys: %s\n", err)
+			}
+			k.refreshMu.Unlock()
+		}
+	}
+}
+
+//refresh fetches the key set and replaces the current keys with it. On any error, current keys are kept.
+func (k *JWKS) refresh() error {
+	//Failed attempts count as refreshes too so an unreachable url isn't hammered.
+	k.mu.Lock()
+	k.lastRefresh = time.Now()
+	k.mu.Unlock()
+
+	resp, err := k.client.Get(k.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("wrong http status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Warningf("jwks skipping key %s: %s\n", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return errors.New("no valid keys in key set")
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+
+	log.Debugf("jwks fetched %d keys\n", len(keys))
+
+	return nil
+}
+
+//Stop stops refreshing the keys. It may be called more than once.
+func (k *JWKS) Stop() {
+	k.halt.Do(func() {
+		close(k.done)
+	})
+}
+
+//publicKey builds the RSA or EC public key described by the JWK.
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBase64URLInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
+
+func decodeBase64URLInt(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, errors.Errorf("wrong key parameter: %s", err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
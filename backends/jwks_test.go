@@ -0,0 +1,212 @@
+package backends
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	pad := func(b []byte) []byte {
+		return append(make([]byte, size-len(b)), b...)
+	}
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(pad(key.X.Bytes())),
+		"y":   base64.RawURLEncoding.EncodeToString(pad(key.Y.Bytes())),
+	}
+}
+
+func TestJWKS(t *testing.T) {
+
+	firstKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	secondKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	thirdKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var mu sync.Mutex
+	var fetches int32
+	failing := false
+	keySet := []map[string]string{rsaJWK("first", &firstKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}
+
+	setKeys := func(keys ...map[string]string) {
+		mu.Lock()
+		keySet = keys
+		mu.Unlock()
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keySet})
+	}))
+
+	defer jwksServer.Close()
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"nbf":      nowSecondsSinceEpoch,
+			"exp":      expSecondsSinceEpoch,
+			"sub":      "user",
+			"username": username,
+		})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		tokenStr, err := token.SignedString(key)
+		if err != nil {
+			panic(err)
+		}
+		return tokenStr
+	}
+
+	Convey("Given a jwks server", t, func() {
+		jwks := NewJWKS(jwksServer.URL, time.Hour)
+		jwks.MinRefreshInterval = 0
+		o := JWT{JWKS: jwks, Algorithms: []string{"RS256", "ES256"}}
+
+		Convey("Tokens should be verified with the key matching their kid", func() {
+			_, err := o.getClaims(sign(jwt.SigningMethodRS256, "first", firstKey))
+			So(err, ShouldBeNil)
+
+			_, err = o.getClaims(sign(jwt.SigningMethodES256, "ec", ecKey))
+			So(err, ShouldBeNil)
+
+			//Right kid, wrong key type.
+			_, err = o.getClaims(sign(jwt.SigningMethodES256, "first", ecKey))
+			So(err, ShouldNotBeNil)
+
+			//Without a kid, a multiple key set can't tell which one to use.
+			_, err = o.getClaims(sign(jwt.SigningMethodRS256, "", firstKey))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When keys rotate, unknown kids should trigger a refresh", func() {
+			setKeys(rsaJWK("second", &secondKey.PublicKey))
+
+			_, err := o.getClaims(sign(jwt.SigningMethodRS256, "second", secondKey))
+			So(err, ShouldBeNil)
+
+			_, err = o.getClaims(sign(jwt.SigningMethodRS256, "first", firstKey))
+			So(err, ShouldNotBeNil)
+
+			//The set now holds a single key, so tokens without kid may use it.
+			_, err = o.getClaims(sign(jwt.SigningMethodRS256, "", secondKey))
+			So(err, ShouldBeNil)
+
+			Convey("On demand refreshes should be rate limited", func() {
+				jwks.MinRefreshInterval = time.Hour
+				setKeys(rsaJWK("third", &thirdKey.PublicKey))
+				before := atomic.LoadInt32(&fetches)
+
+				for i := 0; i < 5; i++ {
+					_, err := o.getClaims(sign(jwt.SigningMethodRS256, "third", thirdKey))
+					So(err, ShouldNotBeNil)
+				}
+				So(atomic.LoadInt32(&fetches), ShouldEqual, before)
+			})
+
+			Convey("Failed refreshes should keep the last good keys", func() {
+				mu.Lock()
+				failing = true
+				mu.Unlock()
+
+				_, err := o.getClaims(sign(jwt.SigningMethodRS256, "unknown", thirdKey))
+				So(err, ShouldNotBeNil)
+
+				_, err = o.getClaims(sign(jwt.SigningMethodRS256, "second", secondKey))
+				So(err, ShouldBeNil)
+
+				mu.Lock()
+				failing = false
+				mu.Unlock()
+			})
+		})
+
+		Reset(func() {
+			jwks.Stop()
+			setKeys(rsaJWK("first", &firstKey.PublicKey), ecJWK("ec", &ecKey.PublicKey))
+		})
+	})
+
+	Convey("Keys should be refreshed in the background", t, func() {
+		jwks := NewJWKS(jwksServer.URL, 50*time.Millisecond)
+		jwks.MinRefreshInterval = time.Hour
+		defer jwks.Stop()
+		o := JWT{JWKS: jwks, Algorithms: []string{"RS256"}}
+
+		setKeys(rsaJWK("third", &thirdKey.PublicKey))
+		time.Sleep(200 * time.Millisecond)
+
+		_, err := o.getClaims(sign(jwt.SigningMethodRS256, "third", thirdKey))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Stopping should end background refreshes, and may be done more than once", t, func() {
+		//A server of its own, so refreshes of the key sets above still running can't be counted.
+		var stopFetches int32
+		stopServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&stopFetches, 1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJWK("first", &firstKey.PublicKey)}})
+		}))
+		defer stopServer.Close()
+
+		jwks := NewJWKS(stopServer.URL, 20*time.Millisecond)
+		jwks.Stop()
+		So(jwks.Stop, ShouldNotPanic)
+
+		before := atomic.LoadInt32(&stopFetches)
+		time.Sleep(100 * time.Millisecond)
+		So(atomic.LoadInt32(&stopFetches), ShouldEqual, before)
+	})
+
+	Convey("Given a DB connector failing to start, NewJWT should fail without fetching the key set", t, func() {
+		before := atomic.LoadInt32(&fetches)
+		_, err := NewJWT(map[string]string{
+			"jwt_jwks_url":        jwksServer.URL,
+			"jwt_userquery":       "SELECT count(*) FROM test_user WHERE username = ?",
+			"jwt_db":              "mysql",
+			"mysql_host":          "127.0.0.1",
+			"mysql_port":          "1",
+			"mysql_dbname":        "go_auth_test",
+			"mysql_user":          "go_auth_test",
+			"mysql_password":      "go_auth_test",
+			"mysql_connect_tries": "1",
+		}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(atomic.LoadInt32(&fetches), ShouldEqual, before)
+	})
+
+}
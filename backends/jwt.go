@@ -2,15 +2,21 @@ package backends
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,6 +24,9 @@ import (
 	"github.com/pkg/errors"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
 )
 
 type JWT struct {
@@ -26,7 +35,14 @@ type JWT struct {
 
 	Postgres       Postgres
 	Mysql          Mysql
+	Sqlite         Sqlite
 	Secret         string
+	PublicKey      interface{}
+	JWKS           *JWKS
+	Algorithms     []string
+	Issuer         string
+	Audience       []string
+	Issuers        map[string]JWTIssuer
 	UserQuery      string
 	SuperuserQuery string
 	AclQuery       string
@@ -42,14 +58,113 @@ type JWT struct {
 	ParamsMode   string
 	ResponseMode string
 
-	UserField string
+	AuthHeader      string
+	BearerPrefix    string
+	HostHeader      string
+	UserParams      []string
+	SuperuserParams []string
+	AclParams       []string
+
+	UserField      string
+	UsernameClaim  string
+	VerifyUsername bool
+	TokenSource    string
+
+	Skew time.Duration
+
+	SuperuserClaim string
+
+	AclClaims      bool
+	ReadClaim      string
+	WriteClaim     string
+	SubscribeClaim string
+
+	Introspector *Introspector
+	ScopeAcls    bool
+	ScopePrefix  string
+
+	aclsDisabled bool
+
+	claimsCache *jwtClaimsCache
+	tokenCache  *jwtTokenCache
+}
+
+//JWTIssuer holds the key material used to verify tokens from one issuer when several are configured.
+type JWTIssuer struct {
+	Secret     string
+	PublicKey  interface{}
+	JWKS       *JWKS
+	Algorithms []string
+
+	jwksURL     string
+	jwksRefresh time.Duration
+}
+
+//jwtClaimsCache keeps the tokens validated when authenticating clients that send them as the password, so that superuser and acl checks, which don't get it, may use them. It holds up to size entries, and those for tokens without exp expire after ttl.
+type jwtClaimsCache struct {
+	mu      sync.Mutex
+	entries map[jwtClaimsKey]jwtClaimsEntry
+	ttl     time.Duration
+	size    int
+	now     func() time.Time
+}
+
+//jwtClaimsKey identifies the client a kept token was validated for.
+type jwtClaimsKey struct {
+	username string
+	clientid string
+}
+
+//jwtTokenCache keeps the results of validating tokens, keyed by a hash of the token and the request, so checks don't have to verify the same token or call the remote service again until the entry expires. It holds up to size entries.
+type jwtTokenCache struct {
+	mu      sync.Mutex
+	entries map[string]jwtTokenEntry
+	ttl     time.Duration
+	size    int
+	now     func() time.Time
+}
+
+//jwtTokenEntry holds a token's validated claims (only in local mode) and when the entry expires.
+type jwtTokenEntry struct {
+	claims  *Claims
+	expires time.Time
+}
+
+//jwtClaimsEntry holds a client's token, its validated claims (only in local mode) and when it expires, if the token tells.
+type jwtClaimsEntry struct {
+	token   string
+	claims  *Claims
+	expires time.Time
 }
 
 // Claims defines the struct containing the token claims. StandardClaim's Subject field should contain the username, unless an opt is set to support Username field.
 type Claims struct {
 	jwt.StandardClaims
+	// Audience overrides StandardClaim's one as it may be either a string or an array of strings.
+	Audience ClaimStrings `json:"aud,omitempty"`
 	// If set, Username defines the identity of the user.
 	Username string `json:"username"`
+	// Raw holds every claim so the username may be taken from any of them.
+	Raw map[string]interface{} `json:"-"`
+}
+
+//ClaimStrings holds a claim that may be given either as a single string or as an array of strings.
+type ClaimStrings []string
+
+//UnmarshalJSON accepts both a single string and an array of strings.
+func (c *ClaimStrings) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*c = ClaimStrings{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return errors.Errorf("claim must be a string or an array of strings: %s", err)
+	}
+	*c = multiple
+	return nil
 }
 
 type Response struct {
@@ -57,10 +172,65 @@ type Response struct {
 	Error string `json:"error"`
 }
 
+//JWTOptions are the auth options the JWT backend takes.
+var JWTOptions = Options{
+	Keys: []string{
+		"jwt_acl_claims", "jwt_aclcheck_params", "jwt_aclcheck_uri", "jwt_aclquery", "jwt_algorithms",
+		"jwt_audience", "jwt_auth_header", "jwt_bearer_prefix", "jwt_claims_cache_seconds", "jwt_claims_cache_size",
+		"jwt_client_id", "jwt_client_secret",
+		"jwt_db", "jwt_getuser_params", "jwt_getuser_uri", "jwt_host", "jwt_host_header",
+		"jwt_introspection_url", "jwt_issuer", "jwt_issuers", "jwt_jwks_refresh_seconds", "jwt_jwks_url",
+		"jwt_mode", "jwt_params_mode", "jwt_port", "jwt_pubkey_file", "jwt_read_claim", "jwt_remote",
+		"jwt_response_mode", "jwt_scope_acls", "jwt_scope_prefix", "jwt_secret", "jwt_skew_seconds",
+		"jwt_subscribe_claim", "jwt_superquery", "jwt_superuser_claim", "jwt_superuser_params",
+		"jwt_superuser_uri", "jwt_token_cache_seconds", "jwt_token_cache_size", "jwt_token_source",
+		"jwt_userfield", "jwt_username_claim", "jwt_userquery", "jwt_verify_peer", "jwt_verify_username",
+		"jwt_with_tls", "jwt_write_claim",
+	},
+	Named: jwtNamedOptions,
+}
+
+//jwtNamedOptions returns the options of each issuer jwt_issuers lists and, in local mode, those of the DB the user is checked with, which is given its options.
+func jwtNamedOptions(authOpts map[string]string) []string {
+	var options []string
+	if issuers, ok := authOpts["jwt_issuers"]; ok {
+		for _, name := range strings.Split(issuers, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			for _, opt := range []string{"secret", "pubkey_file", "jwks_url", "jwks_refresh_seconds", "algorithms", "issuer"} {
+				options = append(options, fmt.Sprintf("jwt_%s_%s", name, opt))
+			}
+		}
+	}
+
+	mode, ok := authOpts["jwt_mode"]
+	if !ok && !common.BoolOption(authOpts, "jwt_remote", false) {
+		mode = "local"
+	}
+	if mode == "local" {
+		switch authOpts["jwt_db"] {
+		case "mysql":
+			options = append(options, MysqlOptions.Keys...)
+		case "sqlite":
+			options = append(options, SqliteOptions.Keys...)
+		default:
+			options = append(options, PostgresOptions.Keys...)
+		}
+	}
+
+	return options
+}
+
 func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := JWTOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return JWT{}, errors.Errorf("JWT backend error: %s.\n", err)
+	}
+
 	//Initialize with defaults
 	var jwt = JWT{
 		Remote:       false,
@@ -68,8 +238,14 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 		VerifyPeer:   false,
 		ResponseMode: "status",
 		ParamsMode:   "json",
+		AuthHeader:   "Authorization",
+		AclParams:    []string{"clientid", "topic", "acc"},
 		LocalDB:      "postgres",
 		UserField:    "Subject",
+		TokenSource:  "username",
+		ReadClaim:    "subs",
+		WriteClaim:   "publ",
+		ScopePrefix:  "mqtt",
 	}
 
 	if userField, ok := authOpts["jwt_userfield"]; ok && userField == "Username" {
@@ -78,11 +254,91 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 		log.Debugln("JWT user field not present or incorrect, defaulting to Subject field.")
 	}
 
-	if remote, ok := authOpts["jwt_remote"]; ok && remote == "true" {
-		jwt.Remote = true
+	//A username claim, which may be a dotted path to a nested claim, overrides the user field.
+	if usernameClaim, ok := authOpts["jwt_username_claim"]; ok && usernameClaim != "" {
+		jwt.UsernameClaim = usernameClaim
+	}
+
+	if tokenSource, ok := authOpts["jwt_token_source"]; ok {
+		if tokenSource != "username" && tokenSource != "password" {
+			return jwt, errors.Errorf("JWT backend error: unknown jwt_token_source %s.\n", tokenSource)
+		}
+		jwt.TokenSource = tokenSource
+	}
+
+	if jwt.TokenSource == "password" {
+		//Tokens without exp are kept for a day by default, and up to as many clients as are expected to be connected at once.
+		claimsTTL := common.DurationOption(authOpts, "jwt_claims_cache_seconds", time.Second, time.Second, 24*time.Hour)
+		claimsSize := common.IntOption(authOpts, "jwt_claims_cache_size", 1, math.MaxInt32, 10000)
+
+		jwt.claimsCache = newJWTClaimsCache(claimsTTL, claimsSize)
+	}
+
+	jwt.Remote = common.BoolOption(authOpts, "jwt_remote", false)
+
+	introspection := false
+	if mode, ok := authOpts["jwt_mode"]; ok {
+		switch mode {
+		case "local", "introspection":
+			if jwt.Remote {
+				return jwt, errors.Errorf("JWT backend error: jwt_mode %s contradicts jwt_remote.\n", mode)
+			}
+			introspection = mode == "introspection"
+		case "remote":
+			jwt.Remote = true
+		default:
+			return jwt, errors.Errorf("JWT backend error: unknown jwt_mode %s.\n", mode)
+		}
+	}
+
+	//Introspection responses are always cached, as otherwise every check would call the authorization server.
+	cacheTTL := time.Duration(0)
+	if introspection {
+		cacheTTL = time.Minute
 	}
+	cacheTTL = common.DurationOption(authOpts, "jwt_token_cache_seconds", time.Second, 0, cacheTTL)
 
-	//If remote, set remote api fields. Else, set jwt secret.
+	cacheSize := common.IntOption(authOpts, "jwt_token_cache_size", 1, math.MaxInt32, 1000)
+
+	if cacheTTL > 0 {
+		jwt.tokenCache = newJWTTokenCache(cacheTTL, cacheSize)
+	}
+
+	if common.BoolOption(authOpts, "jwt_verify_username", false) {
+		//When the token is carried in the MQTT username there's no other username to verify against, and remote tokens aren't parsed.
+		if jwt.TokenSource != "password" || jwt.Remote {
+			return jwt, errors.New("JWT backend error: jwt_verify_username needs jwt_token_source password in local or introspection mode.\n")
+		}
+		jwt.VerifyUsername = true
+	}
+
+	//In remote mode the superuser uri still decides, as tokens aren't validated by the backend.
+	if superuserClaim, ok := authOpts["jwt_superuser_claim"]; ok && superuserClaim != "" {
+		jwt.SuperuserClaim = superuserClaim
+	}
+
+	if common.BoolOption(authOpts, "jwt_acl_claims", false) {
+		//Remote tokens aren't validated by the backend, so their claims can't be trusted.
+		if jwt.Remote {
+			return jwt, errors.New("JWT backend error: jwt_acl_claims is only available in local or introspection mode.\n")
+		}
+		jwt.AclClaims = true
+	}
+
+	if readClaim, ok := authOpts["jwt_read_claim"]; ok && readClaim != "" {
+		jwt.ReadClaim = readClaim
+	}
+
+	if writeClaim, ok := authOpts["jwt_write_claim"]; ok && writeClaim != "" {
+		jwt.WriteClaim = writeClaim
+	}
+
+	//When no subscribe claim is given, subscriptions are checked against the read claim.
+	if subscribeClaim, ok := authOpts["jwt_subscribe_claim"]; ok && subscribeClaim != "" {
+		jwt.SubscribeClaim = subscribeClaim
+	}
+
+	//If remote, set remote api fields. If introspecting, set the authorization server ones. Else, set jwt secret.
 	if jwt.Remote {
 
 		missingOpts := ""
@@ -135,27 +391,143 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 			missingOpts += " jwt_port"
 		}
 
-		if withTLS, ok := authOpts["jwt_with_tls"]; ok && withTLS == "true" {
-			jwt.WithTLS = true
+		jwt.WithTLS = common.BoolOption(authOpts, "jwt_with_tls", false)
+
+		if authHeader, ok := authOpts["jwt_auth_header"]; ok && authHeader != "" {
+			jwt.AuthHeader = authHeader
+		}
+
+		if bearerPrefix, ok := authOpts["jwt_bearer_prefix"]; ok {
+			jwt.BearerPrefix = bearerPrefix
+		}
+
+		if hostHeader, ok := authOpts["jwt_host_header"]; ok {
+			jwt.HostHeader = hostHeader
 		}
 
-		if verifyPeer, ok := authOpts["jwt_verify_peer"]; ok && verifyPeer == "true" {
-			jwt.VerifyPeer = true
+		//Each check may only send the values it gets.
+		paramsOpts := []struct {
+			opt     string
+			params  *[]string
+			allowed []string
+		}{
+			{"jwt_getuser_params", &jwt.UserParams, []string{"username", "clientid"}},
+			{"jwt_superuser_params", &jwt.SuperuserParams, []string{"username"}},
+			{"jwt_aclcheck_params", &jwt.AclParams, []string{"username", "clientid", "topic", "acc"}},
 		}
+		for _, p := range paramsOpts {
+			value, ok := authOpts[p.opt]
+			if !ok {
+				continue
+			}
+			params, err := parseJWTParams(value, p.allowed)
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: invalid %s: %s.\n", p.opt, err)
+			}
+			*p.params = params
+		}
+
+		jwt.VerifyPeer = common.BoolOption(authOpts, "jwt_verify_peer", false)
 
 		if !remoteOk {
 			return jwt, errors.Errorf("JWT backend error: missing remote options%s.\n", missingOpts)
 		}
 
+	} else if introspection {
+
+		missingOpts := ""
+		introspectionOk := true
+
+		introspectionURL, ok := authOpts["jwt_introspection_url"]
+		if !ok {
+			introspectionOk = false
+			missingOpts += " jwt_introspection_url"
+		}
+
+		clientID, ok := authOpts["jwt_client_id"]
+		if !ok {
+			introspectionOk = false
+			missingOpts += " jwt_client_id"
+		}
+
+		clientSecret, ok := authOpts["jwt_client_secret"]
+		if !ok {
+			introspectionOk = false
+			missingOpts += " jwt_client_secret"
+		}
+
+		jwt.ScopeAcls = common.BoolOption(authOpts, "jwt_scope_acls", false)
+
+		if scopePrefix, ok := authOpts["jwt_scope_prefix"]; ok && scopePrefix != "" {
+			jwt.ScopePrefix = scopePrefix
+		}
+
+		if !introspectionOk {
+			return jwt, errors.Errorf("JWT backend error: missing introspection options%s.\n", missingOpts)
+		}
+
+		jwt.Introspector = NewIntrospector(introspectionURL, clientID, clientSecret)
+
 	} else {
 
 		missingOpts := ""
 		localOk := true
 
-		if secret, ok := authOpts["jwt_secret"]; ok {
-			jwt.Secret = secret
+		var keys JWTIssuer
+		if issuers, ok := authOpts["jwt_issuers"]; ok {
+			//Each issuer brings its own keys, so none may be given for the whole backend.
+			for _, opt := range []string{"jwt_secret", "jwt_pubkey_file", "jwt_jwks_url", "jwt_algorithms", "jwt_issuer"} {
+				if _, ok := authOpts[opt]; ok {
+					return jwt, errors.Errorf("JWT backend error: %s can't be given along with jwt_issuers.\n", opt)
+				}
+			}
+
+			jwt.Issuers = make(map[string]JWTIssuer)
+			for _, name := range strings.Split(issuers, ",") {
+				name = strings.TrimSpace(name)
+				if name == "" {
+					continue
+				}
+				prefix := fmt.Sprintf("jwt_%s_", name)
+				issuer, err := newJWTIssuer(authOpts, prefix)
+				if err != nil {
+					return jwt, err
+				}
+				iss := name
+				if value, ok := authOpts[prefix+"issuer"]; ok && value != "" {
+					iss = value
+				}
+				if _, ok := jwt.Issuers[iss]; ok {
+					return jwt, errors.Errorf("JWT backend error: issuer %s given more than once.\n", iss)
+				}
+				jwt.Issuers[iss] = issuer
+			}
+			if len(jwt.Issuers) == 0 {
+				return jwt, errors.New("JWT backend error: empty jwt_issuers.\n")
+			}
 		} else {
-			return jwt, errors.New("JWT backend error: missing jwt secret.\n")
+			var err error
+			keys, err = newJWTIssuer(authOpts, "jwt_")
+			if err != nil {
+				return jwt, err
+			}
+			jwt.Secret = keys.Secret
+			jwt.PublicKey = keys.PublicKey
+			jwt.Algorithms = keys.Algorithms
+		}
+
+		if issuer, ok := authOpts["jwt_issuer"]; ok {
+			jwt.Issuer = issuer
+		}
+
+		jwt.Skew = common.DurationOption(authOpts, "jwt_skew_seconds", time.Second, 0, jwt.Skew)
+
+		if audience, ok := authOpts["jwt_audience"]; ok {
+			for _, aud := range strings.Split(audience, ",") {
+				if aud = strings.TrimSpace(aud); aud != "" {
+					jwt.Audience = append(jwt.Audience, aud)
+				}
+			}
 		}
 
 		if userQuery, ok := authOpts["jwt_userquery"]; ok {
@@ -169,8 +541,10 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 			jwt.SuperuserQuery = superuserQuery
 		}
 
+		//An empty acl query disables acl checks, while not giving it grants them as it always did.
 		if aclQuery, ok := authOpts["jwt_aclquery"]; ok {
 			jwt.AclQuery = aclQuery
+			jwt.aclsDisabled = aclQuery == ""
 		}
 
 		if localDB, ok := authOpts["jwt_db"]; ok {
@@ -192,6 +566,17 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 			mysql.AclQuery = jwt.AclQuery
 
 			jwt.Mysql = mysql
+		} else if jwt.LocalDB == "sqlite" {
+			//Try to create a sqlite backend with these custom queries.
+			sqlite, err := NewSqlite(authOpts, logLevel)
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: couldn't create sqlite connector for local jwt: %s\n", err)
+			}
+			sqlite.UserQuery = jwt.UserQuery
+			sqlite.SuperuserQuery = jwt.SuperuserQuery
+			sqlite.AclQuery = jwt.AclQuery
+
+			jwt.Sqlite = sqlite
 		} else {
 			//Try to create a postgres backend with these custom queries.
 			postgres, err := NewPostgres(authOpts, logLevel)
@@ -205,18 +590,53 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 			jwt.Postgres = postgres
 		}
 
+		//Catch wrong queries now rather than on every check.
+		if err := jwt.prepareQueries(); err != nil {
+			jwt.Halt()
+			return jwt, err
+		}
+
+		//Key sets are fetched last so nothing is left running if any other option is wrong or the DB connector fails.
+		if keys.jwksURL != "" {
+			jwt.JWKS = NewJWKS(keys.jwksURL, keys.jwksRefresh)
+		}
+		for iss, issuer := range jwt.Issuers {
+			if issuer.jwksURL != "" {
+				issuer.JWKS = NewJWKS(issuer.jwksURL, issuer.jwksRefresh)
+				jwt.Issuers[iss] = issuer
+			}
+		}
+
 	}
 
 	return jwt, nil
 }
 
 //GetUser authenticates a given user.
-func (o JWT) GetUser(token, password string) bool {
+func (o JWT) GetUser(username, password string) bool {
+	return o.GetClientUser(username, password, "")
+}
+
+//GetClientUser authenticates a given user. When the token is sent as the password, it's kept for the user and client id so following superuser and acl checks may use it.
+func (o JWT) GetClientUser(username, password, clientid string) bool {
+
+	token := username
+	if o.TokenSource == "password" {
+		token = password
+	}
 
 	if o.Remote {
-		var dataMap map[string]interface{}
-		var urlValues = url.Values{}
-		return jwtRequest(o.Host, o.UserUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		dataMap, urlValues := requestParams(o.UserParams, map[string]interface{}{
+			"username": username,
+			"clientid": clientid,
+		})
+		if !o.remoteRequest(o.UserUri, token, dataMap, urlValues) {
+			return false
+		}
+		if o.claimsCache != nil {
+			o.claimsCache.set(username, clientid, jwtClaimsEntry{token: token, expires: unverifiedExpiration(token)})
+		}
+		return true
 	}
 
 	//If not remote, get the claims and check against postgres for user.
@@ -226,106 +646,384 @@ func (o JWT) GetUser(token, password string) bool {
 		log.Printf("jwt get user error: %s\n", err)
 		return false
 	}
-	//Now check against the DB.
-	if o.UserField == "Username" {
-		return o.getLocalUser(claims.Username)
+
+	if o.VerifyUsername {
+		if err := o.verifyUsername(claims, username); err != nil {
+			log.Debugf("jwt get user error: %s\n", err)
+			return false
+		}
+	}
+
+	localUsername, err := o.claimsUsername(claims)
+	if err != nil {
+		log.Debugf("jwt get user error: %s\n", err)
+		return false
+	}
+
+	//Now check against the DB, unless the authorization server already vouched for the token.
+	if o.Introspector == nil && !o.getLocalUser(localUsername) {
+		return false
 	}
-	return o.getLocalUser(claims.Subject)
+
+	if o.claimsCache != nil {
+		entry := jwtClaimsEntry{token: token, claims: claims}
+		if claims.ExpiresAt != 0 {
+			entry.expires = time.Unix(claims.ExpiresAt, 0).Add(o.Skew)
+		}
+		o.claimsCache.set(username, clientid, entry)
+	}
+
+	return true
 
 }
 
 //GetSuperuser checks if the given user is a superuser.
-func (o JWT) GetSuperuser(token string) bool {
+func (o JWT) GetSuperuser(username string) bool {
+	return o.GetClientSuperuser(username, "")
+}
+
+//GetClientSuperuser checks if the given user is a superuser. When the token is sent as the password, the one validated for the user and client id is used, as clients may share a username.
+func (o JWT) GetClientSuperuser(username, clientid string) bool {
+
+	token := username
+	var claims *Claims
+	if o.claimsCache != nil {
+		entry, ok := o.claimsCache.get(username, clientid)
+		if !ok {
+			log.Debugf("jwt get superuser error: no valid token for %s and client %s\n", common.RedactUsername(username), clientid)
+			return false
+		}
+		token, claims = entry.token, entry.claims
+	}
 
 	if o.Remote {
-		var dataMap map[string]interface{}
-		var urlValues = url.Values{}
-		return jwtRequest(o.Host, o.SuperuserUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		dataMap, urlValues := requestParams(o.SuperuserParams, map[string]interface{}{
+			"username": username,
+		})
+		return o.remoteRequest(o.SuperuserUri, token, dataMap, urlValues)
 	}
 
 	//If not remote, get the claims and check against postgres for user.
-	//But check first that there's superuser query.
+	//But check first that there's superuser query or claim.
+	if o.SuperuserQuery == "" && o.SuperuserClaim == "" {
+		return false
+	}
+
+	if claims == nil {
+		var err error
+		claims, err = o.getClaims(token)
+
+		if err != nil {
+			log.Debugf("jwt get superuser error: %s\n", err)
+			return false
+		}
+	}
+
+	if o.SuperuserClaim != "" && o.claimsSuperuser(claims) {
+		return true
+	}
+
 	if o.SuperuserQuery == "" {
 		return false
 	}
-	claims, err := o.getClaims(token)
 
+	localUsername, err := o.claimsUsername(claims)
 	if err != nil {
 		log.Debugf("jwt get superuser error: %s\n", err)
 		return false
 	}
-	//Now check against DB
-	if o.UserField == "Username" {
-		if o.LocalDB == "mysql" {
-			return o.Mysql.GetSuperuser(claims.Username)
-		} else {
-			return o.Postgres.GetSuperuser(claims.Username)
-		}
-	}
 
-	if o.LocalDB == "mysql" {
-		return o.Mysql.GetSuperuser(claims.Subject)
-	} else {
-		return o.Postgres.GetSuperuser(claims.Subject)
+	//Now check against DB
+	switch o.LocalDB {
+	case "mysql":
+		return o.Mysql.GetSuperuser(localUsername)
+	case "sqlite":
+		return o.Sqlite.GetSuperuser(localUsername)
+	default:
+		return o.Postgres.GetSuperuser(localUsername)
 	}
 
 }
 
 //CheckAcl checks user authorization.
-func (o JWT) CheckAcl(token, topic, clientid string, acc int32) bool {
+func (o JWT) CheckAcl(username, topic, clientid string, acc int32) bool {
+
+	//When the token is sent as the password, the one validated for this user and client is used.
+	token := username
+	var claims *Claims
+	if o.claimsCache != nil {
+		entry, ok := o.claimsCache.get(username, clientid)
+		if !ok {
+			log.Debugf("jwt check acl error: no valid token for %s and client %s\n", common.RedactUsername(username), clientid)
+			return false
+		}
+		token, claims = entry.token, entry.claims
+	}
 
 	if o.Remote {
-		dataMap := map[string]interface{}{
+		dataMap, urlValues := requestParams(o.AclParams, map[string]interface{}{
+			"username": username,
 			"clientid": clientid,
 			"topic":    topic,
 			"acc":      acc,
-		}
-		var urlValues = url.Values{
-			"clientid": []string{clientid},
-			"topic":    []string{topic},
-			"acc":      []string{strconv.Itoa(int(acc))},
-		}
-		return jwtRequest(o.Host, o.AclUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		})
+		return o.remoteRequest(o.AclUri, token, dataMap, urlValues)
 	}
 
 	//If not remote, get the claims and check against postgres for user.
-	//But check first that there's acl query.
-	if o.AclQuery == "" {
-		return true
+	//But check first that there's acl query, unless acls are given by the claims or scopes. When there's none every acl is granted, unless the query was given empty, which denies them so they're left to other backends.
+	if o.AclQuery == "" && !o.AclClaims && !o.ScopeAcls {
+		return !o.aclsDisabled
+	}
+
+	if claims == nil {
+		var err error
+		claims, err = o.getClaims(token)
+
+		if err != nil {
+			log.Debugf("jwt check acl error: %s\n", err)
+			return false
+		}
 	}
-	claims, err := o.getClaims(token)
 
+	localUsername, err := o.claimsUsername(claims)
 	if err != nil {
 		log.Debugf("jwt check acl error: %s\n", err)
 		return false
 	}
+
+	if o.ScopeAcls {
+		return o.checkScopeAcl(claims, localUsername, topic, clientid, acc)
+	}
+
+	if o.AclClaims {
+		return o.checkClaimsAcl(claims, localUsername, topic, clientid, acc)
+	}
+
 	//Now check against the DB.
-	if o.UserField == "Username" {
-		if o.LocalDB == "mysql" {
-			return o.Mysql.CheckAcl(claims.Username, topic, clientid, acc)
-		} else {
-			return o.Postgres.CheckAcl(claims.Username, topic, clientid, acc)
+	switch o.LocalDB {
+	case "mysql":
+		return o.Mysql.CheckAcl(localUsername, topic, clientid, acc)
+	case "sqlite":
+		return o.Sqlite.CheckAcl(localUsername, topic, clientid, acc)
+	default:
+		return o.Postgres.CheckAcl(localUsername, topic, clientid, acc)
+	}
+
+}
+
+func newJWTClaimsCache(ttl time.Duration, size int) *jwtClaimsCache {
+	return &jwtClaimsCache{
+		entries: make(map[jwtClaimsKey]jwtClaimsEntry),
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+	}
+}
+
+//set keeps the entry for the user and client, until its token expires or, when it has no exp, the ttl elapses. When full, expired entries are dropped and, if that's not enough, the one closest to expiring.
+func (c *jwtClaimsCache) set(username, clientid string, entry jwtClaimsEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if entry.expires.IsZero() {
+		entry.expires = now.Add(c.ttl)
+	}
+	if !now.Before(entry.expires) {
+		return
+	}
+
+	key := jwtClaimsKey{username: username, clientid: clientid}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		var soonest jwtClaimsKey
+		found := false
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			} else if !found || e.expires.Before(c.entries[soonest].expires) {
+				soonest, found = k, true
+			}
+		}
+		if len(c.entries) >= c.size {
+			delete(c.entries, soonest)
 		}
 	}
-	if o.LocalDB == "mysql" {
-		return o.Mysql.CheckAcl(claims.Subject, topic, clientid, acc)
-	} else {
-		return o.Postgres.CheckAcl(claims.Subject, topic, clientid, acc)
+
+	c.entries[key] = entry
+}
+
+//get returns the unexpired entry for the user and client, if any.
+func (c *jwtClaimsCache) get(username, clientid string) (jwtClaimsEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := jwtClaimsKey{username: username, clientid: clientid}
+	entry, ok := c.entries[key]
+	if !ok {
+		return entry, false
+	}
+
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return entry, false
+	}
+
+	return entry, true
+}
+
+func newJWTTokenCache(ttl time.Duration, size int) *jwtTokenCache {
+	return &jwtTokenCache{
+		entries: make(map[string]jwtTokenEntry),
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+	}
+}
+
+//tokenCacheKey hashes the token along with anything else identifying the request, so tokens aren't kept in memory as they are.
+func tokenCacheKey(token string, parts ...string) string {
+	h := sha256.New()
+	h.Write([]byte(token))
+	for _, part := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(part))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//set keeps the entry until the token expires or the ttl elapses, whichever comes first. When full, expired entries are dropped and, if that's not enough, the one closest to expiring.
+func (c *jwtTokenCache) set(key string, claims *Claims, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	entry := jwtTokenEntry{claims: claims, expires: now.Add(c.ttl)}
+	if !expires.IsZero() && expires.Before(entry.expires) {
+		entry.expires = expires
+	}
+	if !now.Before(entry.expires) {
+		return
+	}
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		var soonest string
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			} else if soonest == "" || e.expires.Before(c.entries[soonest].expires) {
+				soonest = k
+			}
+		}
+		if len(c.entries) >= c.size {
+			delete(c.entries, soonest)
+		}
+	}
+
+	c.entries[key] = entry
+}
+
+//get returns the unexpired entry for the key, if any.
+func (c *jwtTokenCache) get(key string) (jwtTokenEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return entry, false
+	}
+
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return entry, false
+	}
+
+	return entry, true
+}
+
+//remoteRequest asks the remote service about the token. Granted requests are cached, when enabled, so the same check for the same token doesn't call it again. Denials aren't, as they may be due to transient errors.
+func (o JWT) remoteRequest(uri, token string, dataMap map[string]interface{}, urlValues url.Values) bool {
+	var key string
+	if o.tokenCache != nil {
+		key = tokenCacheKey(token, uri, urlValues.Encode())
+		if _, ok := o.tokenCache.get(key); ok {
+			return true
+		}
+	}
+
+	if !o.jwtRequest(uri, token, dataMap, urlValues) {
+		return false
+	}
+
+	if o.tokenCache != nil {
+		o.tokenCache.set(key, nil, unverifiedExpiration(token))
+	}
+
+	return true
+}
+
+//unverifiedExpiration returns the token's expiration without verifying it, as remote tokens are verified by the remote service. A zero time means it has none.
+func unverifiedExpiration(token string) time.Time {
+	claims := &Claims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil || claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+//parseJWTParams parses a comma separated list of request params, which must be among the allowed ones.
+func parseJWTParams(value string, allowed []string) ([]string, error) {
+	params := []string{}
+	seen := make(map[string]bool)
+	for _, param := range strings.Split(value, ",") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		ok := false
+		for _, a := range allowed {
+			if param == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, errors.Errorf("param %s must be one of %s", param, strings.Join(allowed, ", "))
+		}
+		if seen[param] {
+			return nil, errors.Errorf("param %s given more than once", param)
+		}
+		seen[param] = true
+		params = append(params, param)
 	}
+	return params, nil
+}
 
+//requestParams picks the given params out of the check's values, both for json and form requests. Without params, the json body is null.
+func requestParams(params []string, values map[string]interface{}) (map[string]interface{}, url.Values) {
+	var dataMap map[string]interface{}
+	urlValues := url.Values{}
+	for _, param := range params {
+		if dataMap == nil {
+			dataMap = make(map[string]interface{})
+		}
+		dataMap[param] = values[param]
+		urlValues.Set(param, fmt.Sprint(values[param]))
+	}
+	return dataMap, urlValues
 }
 
-func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[string]interface{}, port, paramsMode, responseMode string, urlValues url.Values) bool {
+func (o JWT) jwtRequest(uri, token string, dataMap map[string]interface{}, urlValues url.Values) bool {
 
 	tlsStr := "http://"
 
-	if withTLS {
+	if o.WithTLS {
 		tlsStr = "https://"
 	}
 
-	fullUri := fmt.Sprintf("%s%s%s", tlsStr, host, uri)
-	if port != "" {
-		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, host, port, uri)
+	fullUri := fmt.Sprintf("%s%s%s", tlsStr, o.Host, uri)
+	if o.Port != "" {
+		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, o.Host, o.Port, uri)
 	}
 
 	client := &http.Client{Timeout: 5 * time.Second}
@@ -333,7 +1031,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 	var resp *http.Response
 	var err error
 
-	if !verifyPeer {
+	if !o.VerifyPeer {
 		tr := &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
@@ -343,7 +1041,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 	var req *http.Request
 	var reqErr error
 
-	if paramsMode == "json" {
+	if o.ParamsMode == "json" {
 		dataJson, mErr := json.Marshal(dataMap)
 
 		if mErr != nil {
@@ -355,7 +1053,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 		req, reqErr = http.NewRequest("POST", fullUri, contentReader)
 
 		if reqErr != nil {
-			log.Errorf("req error: %v\n", reqErr)
+			log.Errorf("req error: %v\n", common.RedactURLError(reqErr))
 			return false
 		}
 		req.Header.Set("Content-Type", "application/json")
@@ -365,17 +1063,25 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 		req.Header.Set("Content-Length", strconv.Itoa(len(urlValues.Encode())))
 
 		if reqErr != nil {
-			log.Errorf("req error: %v\n", reqErr)
+			log.Errorf("req error: %v\n", common.RedactURLError(reqErr))
 			return false
 		}
 	}
 
-	req.Header.Set("authorization", token)
+	authValue := token
+	if o.BearerPrefix != "" {
+		authValue = o.BearerPrefix + " " + token
+	}
+	req.Header.Set(o.AuthHeader, authValue)
+
+	if o.HostHeader != "" {
+		req.Host = o.HostHeader
+	}
 
 	resp, err = client.Do(req)
 
 	if err != nil {
-		log.Errorf("error: %v\n", err)
+		log.Errorf("error: %v\n", common.RedactURLError(err))
 		return false
 	}
 
@@ -392,7 +1098,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 		return false
 	}
 
-	if responseMode == "text" {
+	if o.ResponseMode == "text" {
 
 		//For test response, we expect "ok" or an error message.
 		if string(body) != "ok" {
@@ -400,7 +1106,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 			return false
 		}
 
-	} else if responseMode == "json" {
+	} else if o.ResponseMode == "json" {
 
 		//For json response, we expect Ok and Error fields.
 		response := Response{Ok: false, Error: ""}
@@ -418,7 +1124,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 
 	}
 
-	log.Debugf("jwt request approved for %s\n", token)
+	log.Debugf("jwt request approved for %s\n", common.RedactToken(token))
 	return true
 
 }
@@ -428,6 +1134,43 @@ func (o JWT) GetName() string {
 	return "JWT"
 }
 
+//localDB returns the connection to the DB used in local mode.
+func (o JWT) localDB() *sqlx.DB {
+	switch o.LocalDB {
+	case "mysql":
+		return o.Mysql.db()
+	case "sqlite":
+		return o.Sqlite.db()
+	default:
+		return o.Postgres.db()
+	}
+}
+
+//prepareQueries prepares every given query as a dry run, so wrong queries or ones not fitting the schema are reported on startup. Empty queries are skipped, as they disable their check.
+func (o JWT) prepareQueries() error {
+	queries := []struct {
+		opt   string
+		query string
+	}{
+		{"jwt_userquery", o.UserQuery},
+		{"jwt_superquery", o.SuperuserQuery},
+		{"jwt_aclquery", o.AclQuery},
+	}
+
+	for _, q := range queries {
+		if q.query == "" {
+			continue
+		}
+		stmt, err := o.localDB().Preparex(q.query)
+		if err != nil {
+			return errors.Errorf("JWT backend error: invalid %s: %s\n", q.opt, err)
+		}
+		stmt.Close()
+	}
+
+	return nil
+}
+
 func (o JWT) getLocalUser(username string) bool {
 	//If there's no user query, return false.
 	if o.UserQuery == "" {
@@ -435,12 +1178,7 @@ func (o JWT) getLocalUser(username string) bool {
 	}
 
 	var count sql.NullInt64
-	var err error
-	if o.LocalDB == "mysql" {
-		err = o.Mysql.DB.Get(&count, o.UserQuery, username)
-	} else {
-		err = o.Postgres.DB.Get(&count, o.UserQuery, username)
-	}
+	err := o.localDB().Get(&count, o.UserQuery, username)
 
 	if err != nil {
 		log.Debugf("Local JWT get user error: %s\n", err)
@@ -448,7 +1186,7 @@ func (o JWT) getLocalUser(username string) bool {
 	}
 
 	if !count.Valid {
-		log.Debugf("Local JWT get user error: user %s not found.\n", username)
+		log.Debugf("Local JWT get user error: user %s not found.\n", common.RedactUsername(username))
 		return false
 	}
 
@@ -459,11 +1197,214 @@ func (o JWT) getLocalUser(username string) bool {
 	return false
 }
 
+//loadPublicKey reads a PEM encoded RSA or ECDSA public key, returning it along with the algorithms it may verify by default.
+func loadPublicKey(path string) (interface{}, []string, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Errorf("JWT backend error: couldn't read public key file: %s\n", err)
+	}
+
+	if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return rsaKey, []string{"RS256", "RS384", "RS512"}, nil
+	}
+
+	if ecKey, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+		return ecKey, []string{"ES256", "ES384", "ES512"}, nil
+	}
+
+	return nil, nil, errors.Errorf("JWT backend error: no valid RSA or ECDSA public key found in %s.\n", path)
+}
+
+//newJWTIssuer reads the key options starting with prefix (e.g., jwt_ or jwt_tenantA_). Exactly one of a secret, a public key file or a jwks url must be given. The key set isn't fetched yet.
+func newJWTIssuer(authOpts map[string]string, prefix string) (JWTIssuer, error) {
+	var issuer JWTIssuer
+
+	secret, secretOk := authOpts[prefix+"secret"]
+	pubkeyFile, pubkeyOk := authOpts[prefix+"pubkey_file"]
+	jwksURL, jwksOk := authOpts[prefix+"jwks_url"]
+
+	issuer.jwksRefresh = common.DurationOption(authOpts, prefix+"jwks_refresh_seconds", time.Second, time.Second, time.Hour)
+
+	if (secretOk && pubkeyOk) || (secretOk && jwksOk) || (pubkeyOk && jwksOk) {
+		return issuer, errors.Errorf("JWT backend error: only one of %[1]ssecret, %[1]spubkey_file and %[1]sjwks_url may be given.\n", prefix)
+	} else if secretOk {
+		issuer.Secret = secret
+		issuer.Algorithms = []string{"HS256", "HS384", "HS512"}
+	} else if pubkeyOk {
+		key, algorithms, err := loadPublicKey(pubkeyFile)
+		if err != nil {
+			return issuer, err
+		}
+		issuer.PublicKey = key
+		issuer.Algorithms = algorithms
+	} else if jwksOk {
+		issuer.jwksURL = jwksURL
+		issuer.Algorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+	} else {
+		return issuer, errors.Errorf("JWT backend error: missing %[1]ssecret, %[1]spubkey_file or %[1]sjwks_url.\n", prefix)
+	}
+
+	if algorithms, ok := authOpts[prefix+"algorithms"]; ok {
+		issuer.Algorithms = nil
+		for _, alg := range strings.Split(algorithms, ",") {
+			alg = strings.TrimSpace(alg)
+			if alg == "" {
+				continue
+			}
+			if !issuer.supportsAlgorithm(alg) {
+				return issuer, errors.Errorf("JWT backend error: algorithm %s can't be used with the configured key.\n", alg)
+			}
+			issuer.Algorithms = append(issuer.Algorithms, alg)
+		}
+		if len(issuer.Algorithms) == 0 {
+			return issuer, errors.Errorf("JWT backend error: empty %salgorithms.\n", prefix)
+		}
+	}
+
+	return issuer, nil
+}
+
+//supportsAlgorithm tells if the configured key, or any key from a key set, may verify tokens signed with the given algorithm.
+func (k JWTIssuer) supportsAlgorithm(alg string) bool {
+	if k.jwksURL != "" || k.JWKS != nil {
+		return algorithmFits(&rsa.PublicKey{}, alg) || algorithmFits(&ecdsa.PublicKey{}, alg)
+	}
+	if k.PublicKey != nil {
+		return algorithmFits(k.PublicKey, alg)
+	}
+	return algorithmFits([]byte(k.Secret), alg)
+}
+
+//algorithmFits tells if the key may verify tokens signed with the given algorithm. The none algorithm never fits.
+func algorithmFits(key interface{}, alg string) bool {
+	var ok bool
+	switch jwt.GetSigningMethod(alg).(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok = key.([]byte)
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok = key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		_, ok = key.(*ecdsa.PublicKey)
+	}
+	return ok
+}
+
+//verificationKey returns the key to verify the token with. When several issuers are configured, the key is taken from the one given by the token's iss claim.
+func (o JWT) verificationKey(token *jwt.Token) (interface{}, error) {
+	if len(o.Issuers) == 0 {
+		return JWTIssuer{Secret: o.Secret, PublicKey: o.PublicKey, JWKS: o.JWKS, Algorithms: o.Algorithms}.verificationKey(token)
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || claims.Issuer == "" {
+		return nil, errors.New("jwt iss claim missing")
+	}
+
+	issuer, ok := o.Issuers[claims.Issuer]
+	if !ok {
+		return nil, errors.Errorf("jwt unknown issuer %s", claims.Issuer)
+	}
+
+	return issuer.verificationKey(token)
+}
+
+//verificationKey returns the key to verify the token with, as long as its algorithm is allowed.
+func (k JWTIssuer) verificationKey(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+
+	allowed := false
+	for _, allowedAlg := range k.Algorithms {
+		if alg == allowedAlg {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return nil, errors.Errorf("jwt algorithm %s not allowed", alg)
+	}
+
+	var key interface{} = []byte(k.Secret)
+	if k.JWKS != nil {
+		kid, _ := token.Header["kid"].(string)
+		jwksKey, err := k.JWKS.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		key = jwksKey
+	} else if k.PublicKey != nil {
+		key = k.PublicKey
+	}
+
+	if !algorithmFits(key, alg) {
+		return nil, errors.Errorf("jwt algorithm %s doesn't fit the key", alg)
+	}
+
+	return key, nil
+}
+
+//getClaims returns the claims of the verified and valid token. When the token cache is enabled, validated claims are reused until the token expires or the cache ttl elapses.
 func (o JWT) getClaims(tokenStr string) (*Claims, error) {
+	if o.Introspector != nil {
+		return o.introspect(tokenStr)
+	}
+
+	if o.tokenCache == nil {
+		return o.validateToken(tokenStr)
+	}
+
+	key := tokenCacheKey(tokenStr)
+	if entry, ok := o.tokenCache.get(key); ok {
+		return entry.claims, nil
+	}
+
+	claims, err := o.validateToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var expires time.Time
+	if claims.ExpiresAt != 0 {
+		expires = time.Unix(claims.ExpiresAt, 0).Add(o.Skew)
+	}
+	o.tokenCache.set(key, claims, expires)
+
+	return claims, nil
+}
+
+//introspect returns the claims of the active token, only asking the authorization server when they aren't cached.
+func (o JWT) introspect(tokenStr string) (*Claims, error) {
+	var key string
+	if o.tokenCache != nil {
+		key = tokenCacheKey(tokenStr, "introspection")
+		if entry, ok := o.tokenCache.get(key); ok {
+			return entry.claims, nil
+		}
+	}
+
+	claims, err := o.Introspector.Introspect(tokenStr)
+	if err != nil {
+		log.Debugf("jwt introspection error: %s\n", err)
+		return nil, err
+	}
+
+	if o.tokenCache != nil {
+		var expires time.Time
+		if claims.ExpiresAt != 0 {
+			expires = time.Unix(claims.ExpiresAt, 0)
+		}
+		o.tokenCache.set(key, claims, expires)
+	}
+
+	return claims, nil
+}
+
+//validateToken verifies the token and validates its claims.
+func (o JWT) validateToken(tokenStr string) (*Claims, error) {
 
-	jwtToken, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(o.Secret), nil
-	})
+	//Time based claims are validated along with the rest so the configured skew may be applied.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	jwtToken, err := parser.ParseWithClaims(tokenStr, &Claims{}, o.verificationKey)
 
 	if err != nil {
 		log.Debugf("jwt parse error: %s\n", err)
@@ -481,20 +1422,212 @@ func (o JWT) getClaims(tokenStr string) (*Claims, error) {
 		return nil, errors.New("got strange claims")
 	}
 
+	//Keep every claim around, as the username may be nested anywhere in them.
+	segments := strings.Split(jwtToken.Raw, ".")
+	payload, err := jwt.DecodeSegment(segments[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &claims.Raw); err != nil {
+		return nil, err
+	}
+
+	if err := o.validateClaims(claims); err != nil {
+		log.Debugf("jwt claims error: %s\n", err)
+		return nil, err
+	}
+
 	return claims, nil
 }
 
-//Halt closes any DB connection.
-func (o JWT) Halt() {
-	if o.Postgres != (Postgres{}) && o.Postgres.DB != nil {
-		err := o.Postgres.DB.Close()
-		if err != nil {
-			log.Errorf("JWT cleanup error: %s", err)
+//claimsSuperuser tells if the superuser claim is truthy, i.e., true, "true" or 1.
+func (o JWT) claimsSuperuser(claims *Claims) bool {
+	value, ok := jsonPathValue(claims.Raw, o.SuperuserClaim)
+	if !ok {
+		return false
+	}
+	return strings.EqualFold(value, "true") || value == "1"
+}
+
+//checkClaimsAcl checks the topic against the patterns listed in the claims for the given acc. Patterns may contain %u and %c, which are replaced by the claims' username and the client id.
+func (o JWT) checkClaimsAcl(claims *Claims, username, topic, clientid string, acc int32) bool {
+	subscribeClaim := o.SubscribeClaim
+	if subscribeClaim == "" {
+		subscribeClaim = o.ReadClaim
+	}
+
+	switch acc {
+	case MOSQ_ACL_READ:
+		return o.claimsAllow(claims, o.ReadClaim, username, topic, clientid)
+	case MOSQ_ACL_WRITE:
+		return o.claimsAllow(claims, o.WriteClaim, username, topic, clientid)
+	case MOSQ_ACL_READWRITE:
+		return o.claimsAllow(claims, o.ReadClaim, username, topic, clientid) && o.claimsAllow(claims, o.WriteClaim, username, topic, clientid)
+	case MOSQ_ACL_SUBSCRIBE:
+		return o.claimsAllow(claims, subscribeClaim, username, topic, clientid)
+	default:
+		return false
+	}
+}
+
+//claimsAllow tells if any of the patterns listed in the claim matches the topic. The claim may be a dotted path to a nested one, and hold either a single pattern or an array of them.
+func (o JWT) claimsAllow(claims *Claims, claim, username, topic, clientid string) bool {
+	value, ok := jsonPathNode(claims.Raw, claim)
+	if !ok {
+		log.Debugf("jwt check acl: claim %s missing\n", claim)
+		return false
+	}
+
+	var patterns []interface{}
+	switch v := value.(type) {
+	case string:
+		patterns = []interface{}{v}
+	case []interface{}:
+		patterns = v
+	default:
+		log.Debugf("jwt check acl: claim %s isn't a list of topics\n", claim)
+		return false
+	}
+
+	for _, p := range patterns {
+		pattern, ok := p.(string)
+		if !ok {
+			continue
 		}
-	} else if o.Mysql != (Mysql{}) && o.Mysql.DB != nil {
-		err := o.Mysql.DB.Close()
-		if err != nil {
-			log.Errorf("JWT cleanup error: %s", err)
+		if common.AclMatches(pattern, topic, username, clientid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//checkScopeAcl checks the topic against the patterns given by the token's scopes, such as mqtt:pub:tele/%u/# for writes and mqtt:sub:cmd/%u/+ for reads and subscriptions, %u and %c being replaced by the username and client id.
+func (o JWT) checkScopeAcl(claims *Claims, username, topic, clientid string, acc int32) bool {
+	scope, _ := claims.Raw["scope"].(string)
+
+	canRead, canWrite := false, false
+	for _, s := range strings.Fields(scope) {
+		parts := strings.SplitN(s, ":", 3)
+		if len(parts) != 3 || parts[0] != o.ScopePrefix {
+			continue
+		}
+		if !common.AclMatches(parts[2], topic, username, clientid) {
+			continue
+		}
+		switch parts[1] {
+		case "pub":
+			canWrite = true
+		case "sub":
+			canRead = true
+		}
+	}
+
+	switch acc {
+	case MOSQ_ACL_READ, MOSQ_ACL_SUBSCRIBE:
+		return canRead
+	case MOSQ_ACL_WRITE:
+		return canWrite
+	case MOSQ_ACL_READWRITE:
+		return canRead && canWrite
+	default:
+		return false
+	}
+}
+
+//claimsUsername returns the username the claims identify, taken from the configured username claim or else from the user field.
+func (o JWT) claimsUsername(claims *Claims) (string, error) {
+	if o.UsernameClaim == "" {
+		if o.UserField == "Username" {
+			return claims.Username, nil
 		}
+		return claims.Subject, nil
+	}
+
+	username, ok := jsonPathValue(claims.Raw, o.UsernameClaim)
+	if !ok || username == "" {
+		return "", errors.Errorf("jwt username claim %s missing", o.UsernameClaim)
+	}
+
+	return username, nil
+}
+
+//verifyUsername checks that the MQTT username matches the one identified by the claims.
+func (o JWT) verifyUsername(claims *Claims, mqttUsername string) error {
+	username, err := o.claimsUsername(claims)
+	if err != nil {
+		return err
+	}
+
+	if username != mqttUsername {
+		return errors.Errorf("jwt username claim %s doesn't match username %s", username, mqttUsername)
+	}
+
+	return nil
+}
+
+//validateClaims checks the exp, nbf and iat claims allowing for the configured skew, and the issuer and audience claims when expected ones are configured.
+func (o JWT) validateClaims(claims *Claims) error {
+	now := time.Now().Unix()
+	skew := int64(o.Skew / time.Second)
+
+	if claims.ExpiresAt != 0 && now > claims.ExpiresAt+skew {
+		return errors.Errorf("jwt token expired %ds ago", now-claims.ExpiresAt)
+	}
+
+	if claims.NotBefore != 0 && now+skew < claims.NotBefore {
+		return errors.Errorf("jwt token not valid for another %ds", claims.NotBefore-now)
+	}
+
+	if claims.IssuedAt != 0 && now+skew < claims.IssuedAt {
+		return errors.Errorf("jwt token issued %ds in the future", claims.IssuedAt-now)
+	}
+
+	if o.Issuer != "" && claims.Issuer != o.Issuer {
+		if claims.Issuer == "" {
+			return errors.New("jwt iss claim missing")
+		}
+		return errors.Errorf("jwt iss claim %s doesn't match", claims.Issuer)
+	}
+
+	if len(o.Audience) == 0 {
+		return nil
+	}
+
+	if len(claims.Audience) == 0 {
+		return errors.New("jwt aud claim missing")
+	}
+
+	//Per RFC 7519, the token is valid for us if any of its audiences is an accepted one.
+	for _, aud := range claims.Audience {
+		for _, accepted := range o.Audience {
+			if aud == accepted {
+				return nil
+			}
+		}
+	}
+
+	return errors.Errorf("jwt aud claim %s doesn't match", strings.Join(claims.Audience, ","))
+}
+
+//Halt closes any DB connection and stops refreshing the key sets, if any.
+func (o JWT) Halt() {
+	if o.JWKS != nil {
+		o.JWKS.Stop()
+	}
+	for _, issuer := range o.Issuers {
+		if issuer.JWKS != nil {
+			issuer.JWKS.Stop()
+		}
+	}
+	if o.Postgres.DB != nil {
+		//Postgres may hold connections to several hosts.
+		o.Postgres.Halt()
+	} else if o.Mysql.DB != nil {
+		//Mysql may hold connections to several hosts, and a TLS config.
+		o.Mysql.Halt()
+	} else if o.Sqlite.DB != nil {
+		//Sqlite may be watching its file.
+		o.Sqlite.Halt()
 	}
 }
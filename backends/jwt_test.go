@@ -1,18 +1,29 @@
 package backends
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -1131,3 +1142,1281 @@ func TestJWTFormTextResponseServer(t *testing.T) {
 	})
 
 }
+
+//writePublicKey writes the PEM encoded public key to a file in dir and returns its path.
+func writePublicKey(dir, name string, pub interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		panic(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		panic(err)
+	}
+	return path
+}
+
+func TestJWTPublicKey(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongRsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaPath := writePublicKey(dir, "rsa.pem", &rsaKey.PublicKey)
+	ecPath := writePublicKey(dir, "ec.pem", &ecKey.PublicKey)
+	garbagePath := filepath.Join(dir, "garbage.pem")
+	ioutil.WriteFile(garbagePath, []byte("not a key"), 0600)
+
+	claims := func(exp, nbf int64) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":      "jwt-test",
+			"nbf":      nbf,
+			"exp":      exp,
+			"sub":      "user",
+			"username": username,
+		}
+	}
+
+	sign := func(method jwt.SigningMethod, key interface{}, c jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, c).SignedString(key)
+		if err != nil {
+			panic(err)
+		}
+		return token
+	}
+
+	validClaims := claims(expSecondsSinceEpoch, nowSecondsSinceEpoch)
+
+	Convey("Given wrong key options NewJWT should fail before connecting to any DB", t, func() {
+		authOpts := map[string]string{"jwt_userquery": "select 1"}
+
+		_, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["jwt_secret"] = jwtSecret
+		authOpts["jwt_pubkey_file"] = rsaPath
+		_, err = NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(authOpts, "jwt_secret")
+
+		authOpts["jwt_pubkey_file"] = garbagePath
+		_, err = NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["jwt_pubkey_file"] = rsaPath
+		authOpts["jwt_algorithms"] = "RS256,ES256"
+		_, err = NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "ES256")
+
+		authOpts["jwt_algorithms"] = "none"
+		_, err = NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given an RSA public key", t, func() {
+		key, algorithms, err := loadPublicKey(rsaPath)
+		So(err, ShouldBeNil)
+		So(algorithms, ShouldResemble, []string{"RS256", "RS384", "RS512"})
+		o := JWT{PublicKey: key, Algorithms: algorithms}
+
+		Convey("Tokens signed with every RS algorithm should be valid", func() {
+			for _, method := range []jwt.SigningMethod{jwt.SigningMethodRS256, jwt.SigningMethodRS384, jwt.SigningMethodRS512} {
+				c, err := o.getClaims(sign(method, rsaKey, validClaims))
+				So(err, ShouldBeNil)
+				So(c.Username, ShouldEqual, username)
+			}
+		})
+
+		Convey("Algorithms out of the allow-list should be rejected", func() {
+			o.Algorithms = []string{"RS256"}
+			_, err := o.getClaims(sign(jwt.SigningMethodRS512, rsaKey, validClaims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tokens signed with a wrong key should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.SigningMethodRS256, wrongRsaKey, validClaims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("HMAC tokens using the public key as secret should be rejected", func() {
+			pemKey, _ := ioutil.ReadFile(rsaPath)
+			_, err := o.getClaims(sign(jwt.SigningMethodHS256, pemKey, validClaims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unsigned tokens should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, validClaims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Expired and not yet valid tokens should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.SigningMethodRS256, rsaKey, claims(nowSecondsSinceEpoch-60, nowSecondsSinceEpoch-120)))
+			So(err, ShouldNotBeNil)
+
+			_, err = o.getClaims(sign(jwt.SigningMethodRS256, rsaKey, claims(expSecondsSinceEpoch, nowSecondsSinceEpoch+3600)))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given an ECDSA public key", t, func() {
+		key, algorithms, err := loadPublicKey(ecPath)
+		So(err, ShouldBeNil)
+		o := JWT{PublicKey: key, Algorithms: algorithms}
+
+		Convey("ES256 tokens should be valid", func() {
+			c, err := o.getClaims(sign(jwt.SigningMethodES256, ecKey, validClaims))
+			So(err, ShouldBeNil)
+			So(c.Subject, ShouldEqual, "user")
+		})
+
+		Convey("RS256 tokens should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.SigningMethodRS256, rsaKey, validClaims))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a secret, only HMAC tokens should be valid", t, func() {
+		o := JWT{Secret: jwtSecret, Algorithms: []string{"HS256", "HS384", "HS512"}}
+
+		_, err := o.getClaims(sign(jwt.SigningMethodHS256, []byte(jwtSecret), validClaims))
+		So(err, ShouldBeNil)
+
+		_, err = o.getClaims(sign(jwt.SigningMethodRS256, rsaKey, validClaims))
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestJWTIssuerAudience(t *testing.T) {
+
+	sign := func(c jwt.MapClaims) string {
+		c["exp"] = expSecondsSinceEpoch
+		c["sub"] = "user"
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(jwtSecret))
+		if err != nil {
+			panic(err)
+		}
+		return token
+	}
+
+	Convey("Given expected issuer and audiences", t, func() {
+		o := JWT{
+			Secret:     jwtSecret,
+			Algorithms: []string{"HS256"},
+			Issuer:     "https://idp.example.com",
+			Audience:   []string{"mqtt", "mqtt-staging"},
+		}
+
+		Convey("Matching string claims should be valid", func() {
+			_, err := o.getClaims(sign(jwt.MapClaims{"iss": "https://idp.example.com", "aud": "mqtt"}))
+			So(err, ShouldBeNil)
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"iss": "https://idp.example.com", "aud": "mqtt-staging"}))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("An array audience containing an accepted one should be valid", func() {
+			c, err := o.getClaims(sign(jwt.MapClaims{"iss": "https://idp.example.com", "aud": []string{"billing", "mqtt"}}))
+			So(err, ShouldBeNil)
+			So(c.Audience, ShouldResemble, ClaimStrings{"billing", "mqtt"})
+		})
+
+		Convey("Mismatching claims should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.MapClaims{"iss": "https://other.example.com", "aud": "mqtt"}))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "iss")
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"iss": "https://idp.example.com", "aud": "billing"}))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "aud")
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"iss": "https://idp.example.com", "aud": []string{"billing", "reports"}}))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Absent claims should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.MapClaims{"aud": "mqtt"}))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "iss claim missing")
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"iss": "https://idp.example.com"}))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "aud claim missing")
+		})
+	})
+
+	Convey("Without expected issuer and audience, any claims should be valid", t, func() {
+		o := JWT{Secret: jwtSecret, Algorithms: []string{"HS256"}}
+
+		_, err := o.getClaims(sign(jwt.MapClaims{"iss": "anyone", "aud": []string{"anything"}}))
+		So(err, ShouldBeNil)
+
+		_, err = o.getClaims(sign(jwt.MapClaims{}))
+		So(err, ShouldBeNil)
+	})
+
+}
+
+func TestJWTSkew(t *testing.T) {
+
+	sign := func(c jwt.MapClaims) string {
+		c["sub"] = "user"
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(jwtSecret))
+		if err != nil {
+			panic(err)
+		}
+		return token
+	}
+
+	Convey("Given a wrong skew NewJWT should warn and allow no skew", t, func() {
+		authOpts := map[string]string{"jwt_secret": jwtSecret, "jwt_userquery": "select 1", "jwt_db": "sqlite", "sqlite_source": "memory", "sqlite_userquery": "select 1"}
+
+		for _, skew := range []string{"-5", "a while"} {
+			authOpts["jwt_skew_seconds"] = skew
+			o, err := NewJWT(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(o.Skew, ShouldEqual, 0)
+			o.Halt()
+		}
+	})
+
+	Convey("Given no skew", t, func() {
+		o := JWT{Secret: jwtSecret, Algorithms: []string{"HS256"}}
+
+		Convey("Tokens issued or starting slightly in the future should be rejected", func() {
+			now := time.Now().Unix()
+			_, err := o.getClaims(sign(jwt.MapClaims{"iat": now + 5, "exp": now + 3600}))
+			So(err, ShouldNotBeNil)
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"nbf": now + 5, "exp": now + 3600}))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tokens just expired should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.MapClaims{"exp": time.Now().Unix() - 5}))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a skew of 30 seconds", t, func() {
+		o := JWT{Secret: jwtSecret, Algorithms: []string{"HS256"}, Skew: 30 * time.Second}
+
+		Convey("Tokens valid only with the skew applied should be valid", func() {
+			now := time.Now().Unix()
+			_, err := o.getClaims(sign(jwt.MapClaims{"iat": now + 5, "nbf": now + 5, "exp": now + 3600}))
+			So(err, ShouldBeNil)
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"iat": now - 3600, "exp": now - 5}))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Tokens beyond the skew should be rejected", func() {
+			now := time.Now().Unix()
+			_, err := o.getClaims(sign(jwt.MapClaims{"iat": now - 3600, "exp": now - 60}))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "expired")
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"nbf": now + 60, "exp": now + 3600}))
+			So(err, ShouldNotBeNil)
+
+			_, err = o.getClaims(sign(jwt.MapClaims{"iat": now + 60, "exp": now + 3600}))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+}
+
+func TestJWTUsernameClaim(t *testing.T) {
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":       expSecondsSinceEpoch,
+		"sub":       "user",
+		"username":  username,
+		"device_id": "device-1",
+		"ext": map[string]interface{}{
+			"identity": map[string]interface{}{"device": "device-2", "serial": 1234},
+		},
+	}).SignedString([]byte(jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := JWT{Secret: jwtSecret, Algorithms: []string{"HS256"}, UserField: "Subject"}
+
+	Convey("Given wrong username options NewJWT should fail", t, func() {
+		_, err := NewJWT(map[string]string{"jwt_secret": jwtSecret, "jwt_verify_username": "true"}, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Without a username claim, the user field should be used", t, func() {
+		claims, err := o.getClaims(token)
+		So(err, ShouldBeNil)
+
+		name, err := o.claimsUsername(claims)
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, "user")
+
+		o.UserField = "Username"
+		name, err = o.claimsUsername(claims)
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, username)
+	})
+
+	Convey("Given top level and nested username claims, they should be extracted", t, func() {
+		claims, err := o.getClaims(token)
+		So(err, ShouldBeNil)
+
+		o.UsernameClaim = "device_id"
+		name, err := o.claimsUsername(claims)
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, "device-1")
+
+		o.UsernameClaim = "ext.identity.device"
+		name, err = o.claimsUsername(claims)
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, "device-2")
+
+		o.UsernameClaim = "ext.identity.serial"
+		name, err = o.claimsUsername(claims)
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, "1234")
+	})
+
+	Convey("Given missing or non scalar username claims, extraction should fail", t, func() {
+		claims, err := o.getClaims(token)
+		So(err, ShouldBeNil)
+
+		o.UsernameClaim = "ext.identity.owner"
+		_, err = o.claimsUsername(claims)
+		So(err, ShouldNotBeNil)
+
+		o.UsernameClaim = "ext.identity"
+		_, err = o.claimsUsername(claims)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Verifying the username should require it to match the claim", t, func() {
+		claims, err := o.getClaims(token)
+		So(err, ShouldBeNil)
+
+		o.UsernameClaim = "device_id"
+		So(o.verifyUsername(claims, "device-1"), ShouldBeNil)
+		So(o.verifyUsername(claims, "device-2"), ShouldNotBeNil)
+		So(o.verifyUsername(claims, ""), ShouldNotBeNil)
+
+		o.UsernameClaim = "missing"
+		So(o.verifyUsername(claims, "device-1"), ShouldNotBeNil)
+	})
+
+}
+
+func TestJWTPasswordTokenSource(t *testing.T) {
+
+	token, _ := jwtToken.SignedString([]byte(jwtSecret))
+	wrongToken, _ := wrongJwtToken.SignedString([]byte(jwtSecret))
+	noExpToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString([]byte(jwtSecret))
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gToken := r.Header.Get("authorization")
+		if gToken != token && gToken != noExpToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "true"
+	authOpts["jwt_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["jwt_port"] = ""
+	authOpts["jwt_getuser_uri"] = "/user"
+	authOpts["jwt_superuser_uri"] = "/superuser"
+	authOpts["jwt_aclcheck_uri"] = "/acl"
+
+	Convey("Given wrong token source options NewJWT should fail", t, func() {
+		authOpts["jwt_token_source"] = "header"
+		_, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		//Remote tokens aren't parsed, so usernames can't be verified.
+		authOpts["jwt_token_source"] = "password"
+		authOpts["jwt_verify_username"] = "true"
+		_, err = NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(authOpts, "jwt_verify_username")
+	})
+
+	Convey("Given the token in the password", t, func() {
+		authOpts["jwt_token_source"] = "password"
+		hb, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Acl checks should use the token validated when the client authenticated", func() {
+			So(hb.GetClientUser("jwt", token, "client-1"), ShouldBeTrue)
+			So(hb.CheckAcl("jwt", "test/topic", "client-1", 1), ShouldBeTrue)
+			So(hb.GetClientSuperuser("jwt", "client-1"), ShouldBeTrue)
+
+			//Other clients and users haven't authenticated, and superuser checks without a client don't pick any client's token.
+			So(hb.CheckAcl("jwt", "test/topic", "client-2", 1), ShouldBeFalse)
+			So(hb.CheckAcl("other", "test/topic", "client-1", 1), ShouldBeFalse)
+			So(hb.GetClientSuperuser("jwt", "client-2"), ShouldBeFalse)
+			So(hb.GetClientSuperuser("other", "client-1"), ShouldBeFalse)
+			So(hb.GetSuperuser("jwt"), ShouldBeFalse)
+		})
+
+		Convey("A token sent as the username should not be used", func() {
+			So(hb.GetClientUser(token, "", "client-1"), ShouldBeFalse)
+			So(hb.CheckAcl(token, "test/topic", "client-1", 1), ShouldBeFalse)
+		})
+
+		Convey("A rejected token should not be kept", func() {
+			So(hb.GetClientUser("jwt", wrongToken, "client-1"), ShouldBeFalse)
+			So(hb.CheckAcl("jwt", "test/topic", "client-1", 1), ShouldBeFalse)
+		})
+
+		Convey("Kept tokens should expire along with the token", func() {
+			So(hb.GetClientUser("jwt", token, "client-1"), ShouldBeTrue)
+
+			hb.claimsCache.now = func() time.Time {
+				return time.Unix(expSecondsSinceEpoch-1, 0)
+			}
+			So(hb.CheckAcl("jwt", "test/topic", "client-1", 1), ShouldBeTrue)
+
+			hb.claimsCache.now = func() time.Time {
+				return time.Unix(expSecondsSinceEpoch, 0)
+			}
+			So(hb.CheckAcl("jwt", "test/topic", "client-1", 1), ShouldBeFalse)
+			So(hb.GetClientSuperuser("jwt", "client-1"), ShouldBeFalse)
+		})
+
+		Convey("Tokens without expiration should be kept for the fallback ttl", func() {
+			So(hb.GetClientUser("jwt", noExpToken, "client-1"), ShouldBeTrue)
+
+			hb.claimsCache.now = func() time.Time {
+				return time.Now().Add(23 * time.Hour)
+			}
+			So(hb.CheckAcl("jwt", "test/topic", "client-1", 1), ShouldBeTrue)
+
+			hb.claimsCache.now = func() time.Time {
+				return time.Now().Add(25 * time.Hour)
+			}
+			So(hb.CheckAcl("jwt", "test/topic", "client-1", 1), ShouldBeFalse)
+		})
+
+		Reset(func() {
+			hb.Halt()
+		})
+	})
+
+	Convey("Given wrong claims cache options NewJWT should warn and use the defaults", t, func() {
+		authOpts["jwt_token_source"] = "password"
+		authOpts["jwt_claims_cache_seconds"] = "0"
+		authOpts["jwt_claims_cache_size"] = "0"
+
+		hb, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer hb.Halt()
+		So(hb.claimsCache.ttl, ShouldEqual, 24*time.Hour)
+		So(hb.claimsCache.size, ShouldEqual, 10000)
+
+		delete(authOpts, "jwt_claims_cache_seconds")
+		delete(authOpts, "jwt_claims_cache_size")
+	})
+
+	Convey("Given a full claims cache", t, func() {
+		now := time.Now()
+		c := newJWTClaimsCache(time.Hour, 2)
+		c.now = func() time.Time {
+			return now
+		}
+
+		c.set("jwt", "client-1", jwtClaimsEntry{token: "1", expires: now.Add(time.Minute)})
+		c.set("jwt", "client-2", jwtClaimsEntry{token: "2"})
+
+		Convey("Expired entries should be dropped first", func() {
+			c.now = func() time.Time {
+				return now.Add(2 * time.Minute)
+			}
+			c.set("jwt", "client-3", jwtClaimsEntry{token: "3"})
+
+			So(c.entries, ShouldHaveLength, 2)
+			_, ok := c.get("jwt", "client-2")
+			So(ok, ShouldBeTrue)
+			_, ok = c.get("jwt", "client-3")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Otherwise the entry closest to expiring should be dropped", func() {
+			c.set("jwt", "client-3", jwtClaimsEntry{token: "3"})
+
+			So(c.entries, ShouldHaveLength, 2)
+			_, ok := c.get("jwt", "client-1")
+			So(ok, ShouldBeFalse)
+			_, ok = c.get("jwt", "client-2")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Replacing a client's entry should not drop others", func() {
+			c.set("jwt", "client-1", jwtClaimsEntry{token: "4"})
+
+			So(c.entries, ShouldHaveLength, 2)
+			entry, ok := c.get("jwt", "client-1")
+			So(ok, ShouldBeTrue)
+			So(entry.token, ShouldEqual, "4")
+		})
+	})
+
+}
+
+func TestJWTClaimsAcl(t *testing.T) {
+
+	sign := func(c jwt.MapClaims) string {
+		c["exp"] = expSecondsSinceEpoch
+		c["sub"] = "dev1"
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(jwtSecret))
+		if err != nil {
+			panic(err)
+		}
+		return token
+	}
+
+	token := sign(jwt.MapClaims{
+		"publ": []string{"tele/%u/#", "cmd/%c/ack"},
+		"subs": []string{"cmd/%u/+", "broadcast/#"},
+	})
+	noClaimsToken := sign(jwt.MapClaims{})
+
+	Convey("Given claims acls in remote mode NewJWT should fail", t, func() {
+		authOpts := map[string]string{
+			"jwt_remote":        "true",
+			"jwt_host":          "localhost",
+			"jwt_port":          "8080",
+			"jwt_getuser_uri":   "/user",
+			"jwt_superuser_uri": "/superuser",
+			"jwt_aclcheck_uri":  "/acl",
+			"jwt_acl_claims":    "true",
+		}
+		_, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given the token in the username and the default claims", t, func() {
+		o := JWT{
+			Secret:     jwtSecret,
+			Algorithms: []string{"HS256"},
+			UserField:  "Subject",
+			AclClaims:  true,
+			ReadClaim:  "subs",
+			WriteClaim: "publ",
+		}
+
+		Convey("Read checks should use the read claim", func() {
+			So(o.CheckAcl(token, "cmd/dev1/reboot", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl(token, "broadcast/fw/version", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl(token, "cmd/dev2/reboot", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl(token, "tele/dev1/temp", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Write checks should use the write claim", func() {
+			So(o.CheckAcl(token, "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl(token, "tele/dev1/a/b/c", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl(token, "cmd/client-1/ack", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl(token, "cmd/client-2/ack", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl(token, "tele/dev2/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl(token, "broadcast/fw/version", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Readwrite checks should need both claims to match", func() {
+			rw := sign(jwt.MapClaims{"publ": "shared/#", "subs": []string{"shared/dev1"}})
+			So(o.CheckAcl(rw, "shared/dev1", "client-1", MOSQ_ACL_READWRITE), ShouldBeTrue)
+			So(o.CheckAcl(rw, "shared/dev2", "client-1", MOSQ_ACL_READWRITE), ShouldBeFalse)
+			So(o.CheckAcl(token, "tele/dev1/temp", "client-1", MOSQ_ACL_READWRITE), ShouldBeFalse)
+		})
+
+		Convey("Subscribe checks should fall back to the read claim and match wildcard subscriptions", func() {
+			So(o.CheckAcl(token, "cmd/dev1/+", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(o.CheckAcl(token, "broadcast/#", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(o.CheckAcl(token, "cmd/#", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+			So(o.CheckAcl(token, "#", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+		})
+
+		Convey("A configured subscribe claim should be used for subscriptions", func() {
+			o.SubscribeClaim = "sub_topics"
+			sub := sign(jwt.MapClaims{"subs": "a/#", "sub_topics": []string{"b/#"}})
+			So(o.CheckAcl(sub, "b/c", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(o.CheckAcl(sub, "a/c", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+			So(o.CheckAcl(sub, "a/c", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+		})
+
+		Convey("Tokens without the claims should be denied", func() {
+			So(o.CheckAcl(noClaimsToken, "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl(noClaimsToken, "cmd/dev1/reboot", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl(noClaimsToken, "cmd/dev1/reboot", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+
+			wrongType := sign(jwt.MapClaims{"publ": map[string]string{"topic": "tele/#"}})
+			So(o.CheckAcl(wrongType, "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Invalid tokens should be denied", func() {
+			So(o.CheckAcl("not a token", "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given the token in the password and nested claims", t, func() {
+		o := JWT{
+			Secret:      jwtSecret,
+			Algorithms:  []string{"HS256"},
+			UserField:   "Subject",
+			TokenSource: "password",
+			AclClaims:   true,
+			ReadClaim:   "mqtt.read",
+			WriteClaim:  "mqtt.write",
+			claimsCache: newJWTClaimsCache(time.Hour, 10),
+		}
+
+		nested := sign(jwt.MapClaims{"mqtt": map[string]interface{}{"read": []string{"in/%u"}, "write": []string{"out/%u"}}})
+		claims, err := o.getClaims(nested)
+		So(err, ShouldBeNil)
+		o.claimsCache.set("jwt", "client-1", jwtClaimsEntry{token: nested, claims: claims})
+
+		Convey("Acl checks should use the claims kept for the client", func() {
+			So(o.CheckAcl("jwt", "in/dev1", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("jwt", "out/dev1", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl("jwt", "out/dev1", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Clients without kept claims should be denied", func() {
+			So(o.CheckAcl("jwt", "in/dev1", "client-2", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+
+}
+
+func TestJWTSuperuserClaim(t *testing.T) {
+
+	sign := func(c jwt.MapClaims) string {
+		if _, ok := c["exp"]; !ok {
+			c["exp"] = expSecondsSinceEpoch
+		}
+		c["sub"] = "admin"
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(jwtSecret))
+		if err != nil {
+			panic(err)
+		}
+		return token
+	}
+
+	Convey("Given a superuser claim in local mode", t, func() {
+		o := JWT{
+			Secret:         jwtSecret,
+			Algorithms:     []string{"HS256"},
+			UserField:      "Subject",
+			SuperuserClaim: "su",
+		}
+
+		Convey("Truthy claims should grant superuser", func() {
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": true})), ShouldBeTrue)
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": "true"})), ShouldBeTrue)
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": 1})), ShouldBeTrue)
+		})
+
+		Convey("Falsy or absent claims should not grant superuser", func() {
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": false})), ShouldBeFalse)
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": "no"})), ShouldBeFalse)
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": 0})), ShouldBeFalse)
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": []bool{true}})), ShouldBeFalse)
+			So(o.GetSuperuser(sign(jwt.MapClaims{})), ShouldBeFalse)
+		})
+
+		Convey("Expired tokens should never grant superuser", func() {
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": true, "exp": nowSecondsSinceEpoch - 60})), ShouldBeFalse)
+		})
+
+		Convey("Nested claims should be supported", func() {
+			o.SuperuserClaim = "roles.admin"
+			So(o.GetSuperuser(sign(jwt.MapClaims{"roles": map[string]interface{}{"admin": true}})), ShouldBeTrue)
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": true})), ShouldBeFalse)
+		})
+
+		Convey("With the token in the password, the kept claims should be used", func() {
+			o.TokenSource = "password"
+			o.claimsCache = newJWTClaimsCache(time.Hour, 10)
+
+			token := sign(jwt.MapClaims{"su": true})
+			claims, err := o.getClaims(token)
+			So(err, ShouldBeNil)
+			o.claimsCache.set("jwt", "client-1", jwtClaimsEntry{token: token, claims: claims})
+
+			So(o.GetClientSuperuser("jwt", "client-1"), ShouldBeTrue)
+			So(o.GetClientSuperuser("jwt", "client-2"), ShouldBeFalse)
+			So(o.GetClientSuperuser("other", "client-1"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a superuser claim in remote mode", t, func() {
+		superToken := sign(jwt.MapClaims{"su": true})
+		var superuserRequests int
+
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/superuser" {
+				superuserRequests++
+			}
+			if r.Header.Get("authorization") != superToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer mockServer.Close()
+
+		authOpts := map[string]string{
+			"jwt_remote":          "true",
+			"jwt_host":            strings.Replace(mockServer.URL, "http://", "", -1),
+			"jwt_port":            "",
+			"jwt_getuser_uri":     "/user",
+			"jwt_superuser_uri":   "/superuser",
+			"jwt_aclcheck_uri":    "/acl",
+			"jwt_superuser_claim": "su",
+		}
+		o, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Superuser checks should be forwarded to the superuser uri", func() {
+			So(o.GetSuperuser(superToken), ShouldBeTrue)
+			So(o.GetSuperuser(sign(jwt.MapClaims{"su": true, "jti": "other"})), ShouldBeFalse)
+			So(superuserRequests, ShouldEqual, 2)
+		})
+	})
+
+}
+
+func TestJWTIssuers(t *testing.T) {
+
+	tenantBKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJWK("b1", &tenantBKey.PublicKey)}})
+	}))
+	defer jwksServer.Close()
+
+	sign := func(method jwt.SigningMethod, key interface{}, iss string) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"iss":      iss,
+			"exp":      expSecondsSinceEpoch,
+			"sub":      "user",
+			"username": username,
+		})
+		token.Header["kid"] = "b1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			panic(err)
+		}
+		return signed
+	}
+
+	authOpts := map[string]string{
+		"jwt_userquery":        "select 1",
+		"jwt_issuers":          "tenantA, tenantB",
+		"jwt_tenantA_secret":   jwtSecret,
+		"jwt_tenantB_issuer":   "https://idp.tenant-b.example.com",
+		"jwt_tenantB_jwks_url": jwksServer.URL,
+	}
+
+	Convey("Given wrong issuers options NewJWT should fail before connecting to any DB", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+
+		opts["jwt_secret"] = jwtSecret
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		delete(opts, "jwt_secret")
+
+		opts["jwt_tenantA_pubkey_file"] = "/some/key.pem"
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "jwt_tenantA_")
+		delete(opts, "jwt_tenantA_pubkey_file")
+
+		opts["jwt_issuers"] = "tenantA,tenantB,tenantC"
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "jwt_tenantC_")
+
+		opts["jwt_issuers"] = "tenantA,tenantB"
+		opts["jwt_tenantB_issuer"] = "tenantA"
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		opts["jwt_issuers"] = " , "
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given two issuers with their own keys", t, func() {
+		tenantA, err := newJWTIssuer(authOpts, "jwt_tenantA_")
+		So(err, ShouldBeNil)
+		tenantB, err := newJWTIssuer(authOpts, "jwt_tenantB_")
+		So(err, ShouldBeNil)
+		tenantB.JWKS = NewJWKS(authOpts["jwt_tenantB_jwks_url"], time.Hour)
+		defer tenantB.JWKS.Stop()
+
+		o := JWT{
+			UserField: "Subject",
+			Issuers: map[string]JWTIssuer{
+				"tenantA":                          tenantA,
+				"https://idp.tenant-b.example.com": tenantB,
+			},
+		}
+
+		Convey("Tokens from each issuer should be verified with its keys", func() {
+			c, err := o.getClaims(sign(jwt.SigningMethodHS256, []byte(jwtSecret), "tenantA"))
+			So(err, ShouldBeNil)
+			So(c.Issuer, ShouldEqual, "tenantA")
+
+			c, err = o.getClaims(sign(jwt.SigningMethodRS256, tenantBKey, "https://idp.tenant-b.example.com"))
+			So(err, ShouldBeNil)
+			So(c.Issuer, ShouldEqual, "https://idp.tenant-b.example.com")
+		})
+
+		Convey("Tokens signed with another issuer's keys should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.SigningMethodRS256, tenantBKey, "tenantA"))
+			So(err, ShouldNotBeNil)
+
+			_, err = o.getClaims(sign(jwt.SigningMethodHS256, []byte(jwtSecret), "https://idp.tenant-b.example.com"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tokens from unconfigured or missing issuers should be rejected", func() {
+			_, err := o.getClaims(sign(jwt.SigningMethodHS256, []byte(jwtSecret), "tenantC"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unknown issuer")
+
+			_, err = o.getClaims(sign(jwt.SigningMethodHS256, []byte(jwtSecret), ""))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+}
+
+func TestJWTTokenCache(t *testing.T) {
+
+	exp := time.Now().Add(time.Minute).Unix()
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":      exp,
+		"sub":      "user",
+		"username": username,
+	}).SignedString([]byte(jwtSecret))
+
+	var aclRequests int32
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/acl" {
+			atomic.AddInt32(&aclRequests, 1)
+		}
+		if r.Header.Get("authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	authOpts := map[string]string{
+		"jwt_remote":              "true",
+		"jwt_host":                strings.Replace(mockServer.URL, "http://", "", -1),
+		"jwt_port":                "",
+		"jwt_getuser_uri":         "/user",
+		"jwt_superuser_uri":       "/superuser",
+		"jwt_aclcheck_uri":        "/acl",
+		"jwt_token_cache_seconds": "3600",
+	}
+
+	Convey("Given wrong token cache options NewJWT should warn and use the defaults", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+
+		opts["jwt_token_cache_seconds"] = "-1"
+		hb, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.tokenCache, ShouldBeNil)
+		hb.Halt()
+
+		opts["jwt_token_cache_seconds"] = "60"
+		opts["jwt_token_cache_size"] = "0"
+		hb, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.tokenCache.ttl, ShouldEqual, time.Minute)
+		So(hb.tokenCache.size, ShouldEqual, 1000)
+		hb.Halt()
+	})
+
+	Convey("Given the token cache in remote mode", t, func() {
+		atomic.StoreInt32(&aclRequests, 0)
+		o, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(o.tokenCache, ShouldNotBeNil)
+
+		Convey("One remote call should service many acl checks", func() {
+			for i := 0; i < 10; i++ {
+				So(o.CheckAcl(token, "test/topic", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			}
+			So(atomic.LoadInt32(&aclRequests), ShouldEqual, 1)
+
+			//Other checks aren't answered by the cached one.
+			So(o.CheckAcl(token, "test/other", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(atomic.LoadInt32(&aclRequests), ShouldEqual, 2)
+		})
+
+		Convey("Denials should not be cached", func() {
+			So(o.CheckAcl("wrong", "test/topic", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl("wrong", "test/topic", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(atomic.LoadInt32(&aclRequests), ShouldEqual, 2)
+		})
+
+		Convey("Entries should die at token expiry", func() {
+			So(o.CheckAcl(token, "test/topic", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(atomic.LoadInt32(&aclRequests), ShouldEqual, 1)
+
+			o.tokenCache.now = func() time.Time { return time.Unix(exp, 0) }
+			So(o.CheckAcl(token, "test/topic", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(atomic.LoadInt32(&aclRequests), ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given the token cache in local mode", t, func() {
+		o := JWT{
+			Secret:     jwtSecret,
+			Algorithms: []string{"HS256"},
+			tokenCache: newJWTTokenCache(time.Hour, 10),
+		}
+
+		Convey("Validated claims should be reused until the token expires", func() {
+			claims, err := o.getClaims(token)
+			So(err, ShouldBeNil)
+
+			cached, err := o.getClaims(token)
+			So(err, ShouldBeNil)
+			So(cached, ShouldEqual, claims)
+
+			_, ok := o.tokenCache.get(tokenCacheKey(token))
+			So(ok, ShouldBeTrue)
+
+			o.tokenCache.now = func() time.Time { return time.Unix(exp, 0) }
+			_, ok = o.tokenCache.get(tokenCacheKey(token))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Entries should expire after the ttl when the token outlives it", func() {
+			o.tokenCache.ttl = time.Second
+			_, err := o.getClaims(token)
+			So(err, ShouldBeNil)
+
+			o.tokenCache.now = func() time.Time { return time.Now().Add(2 * time.Second) }
+			_, ok := o.tokenCache.get(tokenCacheKey(token))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Invalid tokens should not be cached", func() {
+			badToken, _ := jwtToken.SignedString([]byte("other_secret"))
+			_, err := o.getClaims(badToken)
+			So(err, ShouldNotBeNil)
+			So(len(o.tokenCache.entries), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a full token cache", t, func() {
+		c := newJWTTokenCache(time.Hour, 2)
+		now := time.Now()
+
+		c.set("a", nil, now.Add(time.Minute))
+		c.set("b", nil, now.Add(2*time.Minute))
+		c.set("c", nil, now.Add(3*time.Minute))
+
+		Convey("The entry closest to expiring should be dropped", func() {
+			So(len(c.entries), ShouldEqual, 2)
+			_, ok := c.get("a")
+			So(ok, ShouldBeFalse)
+			_, ok = c.get("c")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Concurrent use should stay bounded", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					key := strconv.Itoa(i)
+					c.set(key, nil, time.Time{})
+					c.get(key)
+				}(i)
+			}
+			wg.Wait()
+			So(len(c.entries), ShouldEqual, 2)
+		})
+	})
+
+}
+
+func TestJWTLocalQueries(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "devices.db")
+	db, err := sqlx.Open("sqlite3", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MustExec(`
+CREATE TABLE devices (
+	serial varchar(100) primary key,
+	admin integer not null
+);
+CREATE TABLE device_topics (
+	serial varchar(100) not null,
+	pattern varchar(200) not null,
+	access integer not null
+);
+INSERT INTO devices(serial, admin) values('dev1', 0), ('ops', 1);
+INSERT INTO device_topics(serial, pattern, access) values('dev1', 'tele/%u/#', 2), ('dev1', 'cmd/%c', 1);
+`)
+	db.Close()
+
+	sign := func(sub string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp": expSecondsSinceEpoch,
+			"sub": sub,
+		}).SignedString([]byte(jwtSecret))
+		if err != nil {
+			panic(err)
+		}
+		return token
+	}
+
+	authOpts := func() map[string]string {
+		return map[string]string{
+			"jwt_db":           "sqlite",
+			"jwt_secret":       jwtSecret,
+			"jwt_userquery":    "SELECT count(*) FROM devices WHERE serial = ?",
+			"jwt_superquery":   "SELECT count(*) FROM devices WHERE serial = ? AND admin = 1",
+			"jwt_aclquery":     "SELECT pattern FROM device_topics WHERE serial = ? AND access >= ?",
+			"sqlite_source":    source,
+			"sqlite_userquery": "SELECT 1",
+		}
+	}
+
+	Convey("Given queries fitting a custom schema", t, func() {
+		o, err := NewJWT(authOpts(), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer o.Halt()
+
+		Convey("Users should be checked with the user query", func() {
+			So(o.GetUser(sign("dev1"), ""), ShouldBeTrue)
+			So(o.GetUser(sign("dev2"), ""), ShouldBeFalse)
+		})
+
+		Convey("Superusers should be checked with the superuser query", func() {
+			So(o.GetSuperuser(sign("ops")), ShouldBeTrue)
+			So(o.GetSuperuser(sign("dev1")), ShouldBeFalse)
+		})
+
+		Convey("Acls should be checked with the acl query", func() {
+			So(o.CheckAcl(sign("dev1"), "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl(sign("dev1"), "cmd/client-1", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl(sign("dev1"), "cmd/client-1", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl(sign("dev1"), "tele/dev2/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given empty superuser and acl queries", t, func() {
+		opts := authOpts()
+		opts["jwt_superquery"] = ""
+		opts["jwt_aclquery"] = ""
+		o, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer o.Halt()
+
+		Convey("Their checks should be denied", func() {
+			So(o.GetUser(sign("dev1"), ""), ShouldBeTrue)
+			So(o.GetSuperuser(sign("ops")), ShouldBeFalse)
+			So(o.CheckAcl(sign("dev1"), "any/topic", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl(sign("dev1"), "tele/dev1/temp", "client-1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl(sign("dev1"), "cmd/client-1", "client-1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given no acl query", t, func() {
+		opts := authOpts()
+		delete(opts, "jwt_aclquery")
+		o, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer o.Halt()
+
+		Convey("Every acl should be granted", func() {
+			So(o.CheckAcl(sign("dev1"), "any/topic", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl(sign("dev1"), "cmd/client-1", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given queries not fitting the schema NewJWT should fail", t, func() {
+		for _, opt := range []string{"jwt_userquery", "jwt_superquery", "jwt_aclquery"} {
+			opts := authOpts()
+			opts[opt] = "SELECT topic FROM test_acl WHERE username = ?"
+			_, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, opt)
+		}
+	})
+
+}
+
+func TestJWTRemoteRequestShape(t *testing.T) {
+
+	type request struct {
+		path        string
+		host        string
+		auth        string
+		contentType string
+		body        string
+	}
+
+	var mu sync.Mutex
+	var requests []request
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, request{
+			path:        r.URL.Path,
+			host:        r.Host,
+			auth:        r.Header.Get("Authorization") + r.Header.Get("X-Device-Token"),
+			contentType: r.Header.Get("Content-Type"),
+			body:        string(body),
+		})
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	last := func() request {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[len(requests)-1]
+	}
+
+	authOpts := func() map[string]string {
+		return map[string]string{
+			"jwt_remote":        "true",
+			"jwt_host":          strings.Replace(mockServer.URL, "http://", "", -1),
+			"jwt_port":          "",
+			"jwt_getuser_uri":   "/user",
+			"jwt_superuser_uri": "/superuser",
+			"jwt_aclcheck_uri":  "/acl",
+		}
+	}
+
+	Convey("Given wrong params options NewJWT should fail", t, func() {
+		opts := authOpts()
+		opts["jwt_superuser_params"] = "username,topic"
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "jwt_superuser_params")
+
+		opts = authOpts()
+		opts["jwt_aclcheck_params"] = "topic,topic"
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given the default request shape", t, func() {
+		o, err := NewJWT(authOpts(), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("The raw token should be sent in the Authorization header with json bodies", func() {
+			So(o.GetUser("token", ""), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/user", host: o.Host, auth: "token", contentType: "application/json", body: "null"})
+
+			So(o.GetSuperuser("token"), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/superuser", host: o.Host, auth: "token", contentType: "application/json", body: "null"})
+
+			So(o.CheckAcl("token", "test/topic", "client-1", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/acl", host: o.Host, auth: "token", contentType: "application/json", body: `{"acc":2,"clientid":"client-1","topic":"test/topic"}`})
+		})
+	})
+
+	Convey("Given a bearer prefix, host header and custom json params", t, func() {
+		opts := authOpts()
+		opts["jwt_bearer_prefix"] = "Bearer"
+		opts["jwt_host_header"] = "auth.internal"
+		opts["jwt_getuser_params"] = "username,clientid"
+		opts["jwt_superuser_params"] = "username"
+		opts["jwt_aclcheck_params"] = "clientid,topic"
+		opts["jwt_token_source"] = "password"
+		o, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Requests should carry the configured header and fields", func() {
+			So(o.GetClientUser("dev1", "token", "client-1"), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/user", host: "auth.internal", auth: "Bearer token", contentType: "application/json", body: `{"clientid":"client-1","username":"dev1"}`})
+
+			So(o.GetClientSuperuser("dev1", "client-1"), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/superuser", host: "auth.internal", auth: "Bearer token", contentType: "application/json", body: `{"username":"dev1"}`})
+
+			So(o.CheckAcl("dev1", "test/topic", "client-1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/acl", host: "auth.internal", auth: "Bearer token", contentType: "application/json", body: `{"clientid":"client-1","topic":"test/topic"}`})
+		})
+	})
+
+	Convey("Given a custom auth header and form params", t, func() {
+		opts := authOpts()
+		opts["jwt_auth_header"] = "X-Device-Token"
+		opts["jwt_params_mode"] = "form"
+		opts["jwt_getuser_params"] = "clientid"
+		opts["jwt_aclcheck_params"] = "username,topic,acc"
+		o, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Requests should carry the configured header and form fields", func() {
+			So(o.GetClientUser("token", "", "client-1"), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/user", host: o.Host, auth: "token", contentType: "application/x-www-form-urlencoded", body: "clientid=client-1"})
+
+			So(o.GetSuperuser("token"), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/superuser", host: o.Host, auth: "token", contentType: "application/x-www-form-urlencoded", body: ""})
+
+			So(o.CheckAcl("token", "test/topic", "client-1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(last(), ShouldResemble, request{path: "/acl", host: o.Host, auth: "token", contentType: "application/x-www-form-urlencoded", body: "acc=4&topic=test%2Ftopic&username=token"})
+		})
+	})
+
+}
@@ -0,0 +1,490 @@
+package backends
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+type LDAP struct {
+	URL      string
+	Address  string
+	StartTLS bool
+
+	SSLCA                 string
+	SSLCert               string
+	SSLKey                string
+	SSLInsecureSkipVerify bool
+
+	BindDN       string
+	BindPassword string
+
+	BaseDN          string
+	UserDN          string
+	UserFilter      string
+	SuperuserFilter string
+	GroupBaseDN     string
+	GroupFilter     string
+	AclGroups       []LDAPAclGroup
+
+	Timeout  time.Duration
+	MaxConns int
+
+	tlsConfig *tls.Config
+	pool      *ldapPool
+}
+
+//LDAPAclGroup grants the members of a group the access to the topics matching the pattern.
+type LDAPAclGroup struct {
+	Group string
+	Acc   int32
+	Topic string
+}
+
+//LDAPOptions are the auth options the LDAP backend takes.
+var LDAPOptions = Options{
+	Keys: []string{
+		"ldap_acl_group", "ldap_base_dn", "ldap_bind_dn", "ldap_bind_password", "ldap_group_base_dn",
+		"ldap_group_filter", "ldap_max_conns", "ldap_ssl_ca", "ldap_ssl_cert", "ldap_ssl_insecure_skip_verify",
+		"ldap_ssl_key", "ldap_start_tls", "ldap_superuser_filter", "ldap_timeout_ms", "ldap_url",
+		"ldap_user_dn", "ldap_user_filter",
+	},
+}
+
+func NewLDAP(authOpts map[string]string, logLevel log.Level) (LDAP, error) {
+
+	log.SetLevel(logLevel)
+
+	authOpts, err := LDAPOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return LDAP{}, errors.Errorf("LDAP backend error: %s.\n", err)
+	}
+
+	var l = LDAP{
+		URL:         "ldap://localhost",
+		UserFilter:  "(uid=%u)",
+		GroupFilter: "(member=%d)",
+		Timeout:     5 * time.Second,
+		MaxConns:    10,
+	}
+
+	if ldapURL, ok := authOpts["ldap_url"]; ok {
+		l.URL = strings.TrimSpace(ldapURL)
+	}
+
+	u, err := url.Parse(l.URL)
+	if err != nil || u.Hostname() == "" {
+		return l, errors.Errorf("LDAP backend error: invalid ldap_url %s.\n", l.URL)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return l, errors.Errorf("LDAP backend error: invalid ldap_url %s, it must start with ldap:// or ldaps://.\n", l.URL)
+	}
+	l.Address = net.JoinHostPort(u.Hostname(), port)
+
+	l.StartTLS = common.BoolOption(authOpts, "ldap_start_tls", false)
+	if l.StartTLS && u.Scheme == "ldaps" {
+		return l, errors.New("LDAP backend error: ldap_start_tls can't be used with an ldaps:// ldap_url.\n")
+	}
+
+	if sslCA, ok := authOpts["ldap_ssl_ca"]; ok {
+		l.SSLCA = sslCA
+	}
+
+	if sslCert, ok := authOpts["ldap_ssl_cert"]; ok {
+		l.SSLCert = sslCert
+	}
+
+	if sslKey, ok := authOpts["ldap_ssl_key"]; ok {
+		l.SSLKey = sslKey
+	}
+
+	l.SSLInsecureSkipVerify = common.BoolOption(authOpts, "ldap_ssl_insecure_skip_verify", false)
+
+	if u.Scheme == "ldaps" || l.StartTLS {
+		if l.tlsConfig, err = l.newTLSConfig(u.Hostname()); err != nil {
+			return l, err
+		}
+		if l.SSLInsecureSkipVerify {
+			log.Warnf("LDAP backend: ldap_ssl_insecure_skip_verify is set, the server's certificate won't be verified.")
+		}
+	} else if l.SSLCA != "" || l.SSLCert != "" || l.SSLKey != "" || l.SSLInsecureSkipVerify {
+		return l, errors.New("LDAP backend error: ldap_ssl_ca, ldap_ssl_cert, ldap_ssl_key and ldap_ssl_insecure_skip_verify need an ldaps:// ldap_url or ldap_start_tls.\n")
+	}
+
+	if bindDN, ok := authOpts["ldap_bind_dn"]; ok {
+		l.BindDN = bindDN
+	}
+
+	if bindPassword, ok := authOpts["ldap_bind_password"]; ok {
+		l.BindPassword = bindPassword
+	}
+
+	//Binding a DN without a password is an unauthenticated bind, which servers accept whatever the DN.
+	if l.BindDN != "" && l.BindPassword == "" {
+		return l, errors.New("LDAP backend error: ldap_bind_dn needs ldap_bind_password.\n")
+	}
+
+	if baseDN, ok := authOpts["ldap_base_dn"]; ok {
+		l.BaseDN = baseDN
+	}
+
+	if userDN, ok := authOpts["ldap_user_dn"]; ok {
+		l.UserDN = userDN
+	}
+
+	if userFilter, ok := authOpts["ldap_user_filter"]; ok {
+		l.UserFilter = userFilter
+	}
+
+	//Users are either bound by the DN their name gives, or searched for under the base DN.
+	if l.UserDN == "" && l.BaseDN == "" {
+		return l, errors.New("LDAP backend error: missing options: ldap_user_dn or ldap_base_dn.\n")
+	}
+	if l.UserDN != "" && !strings.Contains(l.UserDN, "%u") {
+		return l, errors.Errorf("LDAP backend error: invalid ldap_user_dn %s, it must hold %%u.\n", l.UserDN)
+	}
+
+	if superuserFilter, ok := authOpts["ldap_superuser_filter"]; ok {
+		l.SuperuserFilter = superuserFilter
+	}
+
+	l.GroupBaseDN = l.BaseDN
+	if groupBaseDN, ok := authOpts["ldap_group_base_dn"]; ok {
+		l.GroupBaseDN = groupBaseDN
+	}
+
+	if groupFilter, ok := authOpts["ldap_group_filter"]; ok {
+		l.GroupFilter = groupFilter
+	}
+
+	if aclGroups, ok := authOpts["ldap_acl_group"]; ok {
+		if l.AclGroups, err = parseLDAPAclGroups(aclGroups); err != nil {
+			return l, errors.Errorf("LDAP backend error: %s.\n", err)
+		}
+		if l.GroupBaseDN == "" {
+			return l, errors.New("LDAP backend error: ldap_acl_group needs ldap_group_base_dn or ldap_base_dn.\n")
+		}
+	}
+
+	//Filters are checked now rather than failing every check.
+	for _, filter := range []*string{&l.UserFilter, &l.SuperuserFilter, &l.GroupFilter} {
+		if *filter == "" {
+			continue
+		}
+		if *filter, err = checkLDAPFilter(*filter); err != nil {
+			return l, errors.Errorf("LDAP backend error: %s.\n", err)
+		}
+	}
+
+	l.Timeout = common.DurationOption(authOpts, "ldap_timeout_ms", time.Millisecond, time.Millisecond, l.Timeout)
+
+	l.MaxConns = common.IntOption(authOpts, "ldap_max_conns", 1, math.MaxInt32, l.MaxConns)
+
+	l.pool = newLDAPPool(l.MaxConns, l.dial)
+
+	//Connect once, binding as the service account if any, so wrong addresses, certificates or credentials keep mosquitto from starting.
+	if err := l.do(func(conn *ldapConn, deadline time.Time) error {
+		return l.bindService(conn, deadline)
+	}); err != nil {
+		l.Halt()
+		return l, errors.Errorf("LDAP backend error: couldn't connect to %s: %s.\n", l.URL, err)
+	}
+
+	log.Infof("LDAP backend: connected to %s.", l.URL)
+
+	return l, nil
+
+}
+
+//newTLSConfig returns the TLS config verifying the server's certificate for the host, with the given CA and client certificate loaded.
+func (o LDAP) newTLSConfig(host string) (*tls.Config, error) {
+	if o.SSLKey != "" && o.SSLCert == "" {
+		return nil, errors.New("LDAP backend error: ldap_ssl_key needs ldap_ssl_cert.\n")
+	}
+
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: o.SSLInsecureSkipVerify}
+
+	if o.SSLCA != "" {
+		pem, err := ioutil.ReadFile(o.SSLCA)
+		if err != nil {
+			return nil, errors.Errorf("LDAP backend error: couldn't read ldap_ssl_ca: %s\n", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("LDAP backend error: no certificates found in ldap_ssl_ca %s.\n", o.SSLCA)
+		}
+	}
+
+	if o.SSLCert != "" {
+		keyFile := o.SSLKey
+		if keyFile == "" {
+			keyFile = o.SSLCert
+		}
+		cert, err := tls.LoadX509KeyPair(o.SSLCert, keyFile)
+		if err != nil {
+			return nil, errors.Errorf("LDAP backend error: couldn't load ldap_ssl_cert and ldap_ssl_key: %s\n", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+//parseLDAPAclGroups parses the mappings ldap_acl_group gives, separated by semicolons, each one a group's DN, an access (read, write, readwrite or subscribe) and a topic pattern separated by colons, e.g. cn=telemetry,ou=groups,dc=example,dc=com:read:tele/#.
+func parseLDAPAclGroups(value string) ([]LDAPAclGroup, error) {
+	var aclGroups []LDAPAclGroup
+	for _, mapping := range strings.Split(value, ";") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+
+		//DNs and topics may hold colons, so the access is the first one between colons.
+		at := -1
+		var aclGroup LDAPAclGroup
+		for acc, name := range accNames {
+			if i := strings.Index(mapping, ":"+name+":"); i > 0 && (at < 0 || i < at) {
+				at = i
+				aclGroup = LDAPAclGroup{
+					Group: normalizeLDAPDN(mapping[:i]),
+					Acc:   acc,
+					Topic: strings.TrimSpace(mapping[i+len(name)+2:]),
+				}
+			}
+		}
+		if at < 0 || aclGroup.Topic == "" {
+			return nil, errors.Errorf("ldap_acl_group mapping %s is not well formatted, it must be group:access:topic", mapping)
+		}
+
+		aclGroups = append(aclGroups, aclGroup)
+	}
+	return aclGroups, nil
+}
+
+//checkLDAPFilter checks an RFC 4515 filter, e.g. (&(objectClass=person)(uid=%u)), returning it with its outer parentheses, which may be left out.
+func checkLDAPFilter(filter string) (string, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+
+	if _, err := ldap.CompileFilter(ldapFilter(filter, "user", "cn=user")); err != nil {
+		return "", errors.Errorf("invalid LDAP filter %s: %s", filter, err)
+	}
+	return filter, nil
+}
+
+//ldapFilter returns the filter with %u replaced by the username and %d by the user's DN, escaped so they're matched as they are.
+func ldapFilter(filter, username, dn string) string {
+	return strings.NewReplacer("%u", ldap.EscapeFilter(username), "%d", ldap.EscapeFilter(dn)).Replace(filter)
+}
+
+//dial connects to the server before the deadline, over TLS with an ldaps:// URL or StartTLS.
+func (o LDAP) dial(deadline time.Time) (*ldapConn, error) {
+	return dialLDAP(o.Address, o.tlsConfig, o.StartTLS, deadline)
+}
+
+//do runs the operation on a pooled connection, which it must be done with by the deadline ldap_timeout_ms sets, waiting for a free one included.
+//The connection is closed when the operation fails, as it may be left in any state.
+func (o LDAP) do(operation func(conn *ldapConn, deadline time.Time) error) error {
+	deadline := time.Now().Add(o.Timeout)
+
+	conn, err := o.pool.get(deadline)
+	if err != nil {
+		return err
+	}
+
+	err = operation(conn, deadline)
+	o.pool.put(conn, err != nil)
+	return err
+}
+
+//bindService binds the connection as ldap_bind_dn, or anonymously when it isn't given, unless it already is, e.g. after a user was bound on it.
+func (o LDAP) bindService(conn *ldapConn, deadline time.Time) error {
+	if conn.boundDN == o.BindDN {
+		return nil
+	}
+	ok, err := conn.bind(o.BindDN, o.BindPassword, deadline)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("ldap_bind_dn or ldap_bind_password is wrong")
+	}
+	return nil
+}
+
+//userDN returns the user's DN: ldap_user_dn with the username, or the one of the single entry ldap_user_filter finds under ldap_base_dn, or an empty one when there's no such entry.
+func (o LDAP) userDN(conn *ldapConn, username string, deadline time.Time) (string, error) {
+	if o.UserDN != "" {
+		return strings.Replace(o.UserDN, "%u", escapeLDAPDN(username), -1), nil
+	}
+
+	if err := o.bindService(conn, deadline); err != nil {
+		return "", err
+	}
+	//Finding two entries is enough to tell the user is ambiguous.
+	entries, err := conn.search(o.BaseDN, ldap.ScopeWholeSubtree, ldapFilter(o.UserFilter, username, ""), nil, 2, deadline)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(entries) {
+	case 0:
+		return "", nil
+	case 1:
+		return entries[0].DN, nil
+	}
+	log.Warnf("LDAP backend: ldap_user_filter finds more than one entry for user %s, denying it.", common.RedactUsername(username))
+	return "", nil
+}
+
+//GetUser checks that the user exists and binding as them with the password succeeds.
+func (o LDAP) GetUser(username, password string) bool {
+	ok, _ := o.GetUserTTL(username, password)
+	return ok
+}
+
+//GetUserTTL checks the user as GetUser does, telling not to cache a denial when the server couldn't be reached or didn't respond in time.
+func (o LDAP) GetUserTTL(username, password string) (bool, time.Duration) {
+	//An empty password would be an unauthenticated bind.
+	if username == "" || password == "" {
+		return false, NoTTL
+	}
+
+	start := time.Now()
+	authenticated := false
+	err := o.do(func(conn *ldapConn, deadline time.Time) error {
+		dn, err := o.userDN(conn, username, deadline)
+		if err != nil || dn == "" {
+			return err
+		}
+		authenticated, err = conn.bind(dn, password, deadline)
+		return err
+	})
+	if err != nil {
+		return false, o.checkFailed("user check", start, err)
+	}
+
+	return authenticated, NoTTL
+}
+
+//GetSuperuser checks that the user's entry matches ldap_superuser_filter, e.g. one telling they're a member of an admins group. Without it, there are no superusers.
+func (o LDAP) GetSuperuser(username string) bool {
+	if o.SuperuserFilter == "" || username == "" {
+		return false
+	}
+
+	start := time.Now()
+	superuser := false
+	err := o.do(func(conn *ldapConn, deadline time.Time) error {
+		dn, err := o.userDN(conn, username, deadline)
+		if err != nil || dn == "" {
+			return err
+		}
+		if err := o.bindService(conn, deadline); err != nil {
+			return err
+		}
+		entries, err := conn.search(dn, ldap.ScopeBaseObject, ldapFilter(o.SuperuserFilter, username, dn), nil, 1, deadline)
+		superuser = len(entries) > 0
+		return err
+	})
+	if err != nil {
+		o.checkFailed("superuser check", start, err)
+		return false
+	}
+
+	return superuser
+}
+
+//CheckAcl checks that the user is a member of a group ldap_acl_group grants the access to the topic.
+func (o LDAP) CheckAcl(username, topic, clientid string, acc int32) bool {
+	ok, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return ok
+}
+
+//CheckAclTTL checks the acl as CheckAcl does, telling not to cache a denial when the server couldn't be reached or didn't respond in time.
+func (o LDAP) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
+	//Only the groups granting the access may grant it, so the server isn't asked when there's none.
+	var candidates []LDAPAclGroup
+	for _, aclGroup := range o.AclGroups {
+		if accMatches(aclGroup.Acc, acc, topic) && common.AclMatches(aclGroup.Topic, topic, username, clientid) {
+			candidates = append(candidates, aclGroup)
+		}
+	}
+	if len(candidates) == 0 || username == "" {
+		return false, NoTTL
+	}
+
+	start := time.Now()
+	groups := make(map[string]bool)
+	err := o.do(func(conn *ldapConn, deadline time.Time) error {
+		dn, err := o.userDN(conn, username, deadline)
+		if err != nil || dn == "" {
+			return err
+		}
+		if err := o.bindService(conn, deadline); err != nil {
+			return err
+		}
+		entries, err := conn.search(o.GroupBaseDN, ldap.ScopeWholeSubtree, ldapFilter(o.GroupFilter, username, dn), nil, 0, deadline)
+		for _, entry := range entries {
+			groups[normalizeLDAPDN(entry.DN)] = true
+		}
+		return err
+	})
+	if err != nil {
+		return false, o.checkFailed("acl check", start, err)
+	}
+
+	for _, aclGroup := range candidates {
+		if groups[aclGroup.Group] {
+			return true, NoTTL
+		}
+	}
+	return false, NoTTL
+}
+
+//checkFailed logs a check's error and returns the cache hint for its denial: a check that failed to reach the server or timed out must not have its denial cached, as the server could have granted it.
+//go-ldap tells both apart from errors the server responded with by their network error code, while waiting for a free connection times out on its own.
+func (o LDAP) checkFailed(check string, start time.Time, err error) time.Duration {
+	if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || ldap.IsErrorWithCode(errors.Cause(err), ldap.ErrorNetwork) {
+		log.Errorf("LDAP %s couldn't get a response after %s: %s", check, time.Since(start), err)
+		return SkipCache
+	}
+	log.Errorf("LDAP %s error: %s", check, err)
+	return NoTTL
+}
+
+//GetName returns the backend's name
+func (o LDAP) GetName() string {
+	return "LDAP"
+}
+
+//Halt closes the connections to the server.
+func (o LDAP) Halt() {
+	if o.pool != nil {
+		o.pool.close()
+	}
+}
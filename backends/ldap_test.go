@@ -0,0 +1,598 @@
+package backends
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//fakeLDAP is a fake LDAP server holding the given entries. It only knows the operations the backend sends: simple binds, searches, StartTLS and unbinds.
+type fakeLDAP struct {
+	//entries are the attributes of each entry by DN, userPassword being the password it's bound with.
+	entries map[string]map[string][]string
+	//searchers are the DNs a connection must be bound as to search, when set.
+	searchers []string
+	//tlsConfig serves ldaps:// when listening, or StartTLS otherwise, when set.
+	tlsConfig *tls.Config
+	useTLS    bool
+
+	listener net.Listener
+	delay    int64
+	conns    int32
+
+	mu   sync.Mutex
+	open []net.Conn
+}
+
+//start listens on a free port, returning the server's url.
+func (f *fakeLDAP) start() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	scheme := "ldap"
+	if f.useTLS {
+		listener = tls.NewListener(listener, f.tlsConfig)
+		scheme = "ldaps"
+	}
+	f.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&f.conns, 1)
+			f.mu.Lock()
+			f.open = append(f.open, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+
+	return scheme + "://" + listener.Addr().String(), nil
+}
+
+//stop stops listening and closes the connections made.
+func (f *fakeLDAP) stop() {
+	f.listener.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.open {
+		conn.Close()
+	}
+}
+
+//setDelay delays every response from now on.
+func (f *fakeLDAP) setDelay(delay time.Duration) {
+	atomic.StoreInt64(&f.delay, int64(delay))
+}
+
+//ldapStartTLSOID names the StartTLS extended operation.
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+//ldapMessage encodes an LDAP message with the id, carrying the operation.
+func ldapMessage(id int64, op *ber.Packet) []byte {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	return message.Bytes()
+}
+
+//ldapResult encodes a response with the tag and result code.
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+//ldapSearchEntry encodes a search result entry with the DN and no attributes.
+func ldapSearchEntry(dn string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	op.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, ""))
+	return op
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	bound := ""
+	respond := func(id int64, op *ber.Packet) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&f.delay)))
+		conn.Write(ldapMessage(id, op))
+	}
+
+	for {
+		message, err := ber.ReadPacket(reader)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		id, _ := message.Children[0].Value.(int64)
+		op := message.Children[1]
+		parts := op.Children
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := parts[1].Data.String(), parts[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if entry, ok := f.entry(dn); (ok && contains(entry["userPassword"], password)) || (dn == "" && password == "") {
+				code = ldap.LDAPResultSuccess
+			}
+			bound = ""
+			if code == ldap.LDAPResultSuccess {
+				bound = dn
+			}
+			respond(id, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if len(f.searchers) > 0 && !contains(f.searchers, bound) {
+				respond(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			base := normalizeLDAPDN(parts[0].Data.String())
+			scope, _ := parts[1].Value.(int64)
+			sizeLimit, _ := parts[3].Value.(int64)
+			if _, ok := f.entry(base); !ok {
+				respond(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject))
+				continue
+			}
+
+			var dns []string
+			for dn := range f.entries {
+				dns = append(dns, dn)
+			}
+			sort.Strings(dns)
+
+			code := int64(ldap.LDAPResultSuccess)
+			found := int64(0)
+			for _, dn := range dns {
+				normalized := normalizeLDAPDN(dn)
+				inScope := normalized == base || (scope == ldap.ScopeWholeSubtree && strings.HasSuffix(normalized, ","+base))
+				if !inScope || !f.matches(parts[6], f.entries[dn]) {
+					continue
+				}
+				if sizeLimit > 0 && found == sizeLimit {
+					code = ldap.LDAPResultSizeLimitExceeded
+					break
+				}
+				found++
+				respond(id, ldapSearchEntry(dn))
+			}
+			respond(id, ldapResult(ldap.ApplicationSearchResultDone, code))
+		case ldap.ApplicationExtendedRequest:
+			if f.tlsConfig == nil || f.useTLS || parts[0].Data.String() != ldapStartTLSOID {
+				respond(id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError))
+				continue
+			}
+			respond(id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(tlsConn)
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+//entry returns the entry with the DN, however it's written.
+func (f *fakeLDAP) entry(dn string) (map[string][]string, bool) {
+	for entryDN, entry := range f.entries {
+		if normalizeLDAPDN(entryDN) == normalizeLDAPDN(dn) {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+//matches tells if the entry matches the filter. Values are compared as DNs, which compares other values regardless of case too. Extensible matches are compared as equality ones.
+func (f *fakeLDAP) matches(filter *ber.Packet, entry map[string][]string) bool {
+	children := filter.Children
+	values := func(attribute string) []string {
+		for name, values := range entry {
+			if strings.EqualFold(name, attribute) {
+				return values
+			}
+		}
+		return nil
+	}
+
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range children {
+			if !f.matches(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range children {
+			if f.matches(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !f.matches(children[0], entry)
+	case ldap.FilterPresent:
+		return len(values(filter.Data.String())) > 0
+	case ldap.FilterEqualityMatch, ldap.FilterExtensibleMatch:
+		var attribute, value string
+		if filter.Tag == ldap.FilterEqualityMatch {
+			attribute, value = children[0].Data.String(), children[1].Data.String()
+		} else {
+			for _, child := range children {
+				switch child.Tag {
+				case ldap.MatchingRuleAssertionType:
+					attribute = child.Data.String()
+				case ldap.MatchingRuleAssertionMatchValue:
+					value = child.Data.String()
+				}
+			}
+		}
+		for _, v := range values(attribute) {
+			if normalizeLDAPDN(v) == normalizeLDAPDN(value) {
+				return true
+			}
+		}
+	case ldap.FilterSubstrings:
+		for _, v := range values(children[0].Data.String()) {
+			v = strings.ToLower(v)
+			ok := true
+			for _, substring := range children[1].Children {
+				s := strings.ToLower(substring.Data.String())
+				switch substring.Tag {
+				case ldap.FilterSubstringsInitial:
+					ok = ok && strings.HasPrefix(v, s)
+				case ldap.FilterSubstringsFinal:
+					ok = ok && strings.HasSuffix(v, s)
+				default:
+					ok = ok && strings.Contains(v, s)
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func newFakeLDAP() *fakeLDAP {
+	return &fakeLDAP{
+		entries: map[string]map[string][]string{
+			"dc=example,dc=com":                        {},
+			"ou=people,dc=example,dc=com":              {},
+			"ou=staff,dc=example,dc=com":               {},
+			"ou=groups,dc=example,dc=com":              {},
+			"cn=service,dc=example,dc=com":             {"userPassword": {"service-pw"}},
+			"uid=alice,ou=people,dc=example,dc=com":    {"uid": {"alice"}, "userPassword": {"alice-pw"}, "memberOf": {"cn=admins,ou=groups,dc=example,dc=com"}},
+			"uid=bob,ou=people,dc=example,dc=com":      {"uid": {"bob"}, "userPassword": {"bob-pw"}},
+			"uid=carol,ou=people,dc=example,dc=com":    {"uid": {"carol"}, "userPassword": {"carol-pw"}},
+			"uid=carol,ou=staff,dc=example,dc=com":     {"uid": {"carol"}, "userPassword": {"carol-pw"}},
+			"cn=admins,ou=groups,dc=example,dc=com":    {"member": {"uid=alice,ou=people,dc=example,dc=com"}},
+			"cn=telemetry,ou=groups,dc=example,dc=com": {"member": {"uid=bob, ou=people, dc=example, dc=com"}},
+			"cn=ops,ou=groups,dc=example,dc=com":       {"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"}},
+		},
+	}
+}
+
+func TestLDAPFilters(t *testing.T) {
+
+	Convey("Given valid filters, they should be checked and given their outer parentheses", t, func() {
+		for _, filter := range []string{
+			"(uid=%u)",
+			"(cn=j*d*e)",
+			"(&(objectClass=person)(|(uid=%u)(mail=%u@example.com)))",
+			"(!(uid=jdoe))",
+			"(memberOf:1.2.840.113556.1.4.1941:=cn=admins,dc=example,dc=com)",
+			"(member=%d)",
+			`(cn=a\2ab\28c\29)`,
+		} {
+			checked, err := checkLDAPFilter(filter)
+			So(err, ShouldBeNil)
+			So(checked, ShouldEqual, filter)
+		}
+
+		checked, err := checkLDAPFilter(" uid=%u ")
+		So(err, ShouldBeNil)
+		So(checked, ShouldEqual, "(uid=%u)")
+	})
+
+	Convey("Given invalid filters, they should be rejected", t, func() {
+		for _, filter := range []string{
+			"(uid=jdoe", "(uid)", "(&(uid=a)", "(!(uid=a)", `(uid=a\2)`, `(uid=a\zz)`,
+		} {
+			_, err := checkLDAPFilter(filter)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given values, they should be escaped for filters and DNs", t, func() {
+		So(ldapFilter("(uid=%u)", "jdoe", ""), ShouldEqual, "(uid=jdoe)")
+		So(ldapFilter("(uid=%u)", `*)(uid=*\`, ""), ShouldEqual, `(uid=\2a\29\28uid=\2a\5c)`)
+		So(ldapFilter("(&(uid=%u)(member=%d))", "a\x00b", "cn=(x)"), ShouldEqual, `(&(uid=a\00b)(member=cn=\28x\29))`)
+
+		So(escapeLDAPDN("jdoe"), ShouldEqual, "jdoe")
+		So(escapeLDAPDN("doe, john+x"), ShouldEqual, `doe\, john\+x`)
+		So(escapeLDAPDN("#admin "), ShouldEqual, `\#admin\ `)
+		So(escapeLDAPDN(` a=b;"<>\`), ShouldEqual, `\ a\=b\;\"\<\>\\`)
+	})
+
+	Convey("Given DNs written differently, they should be normalized alike", t, func() {
+		So(normalizeLDAPDN("CN=Telemetry, OU=Groups,DC=Example , DC=com"), ShouldEqual, "cn=telemetry,ou=groups,dc=example,dc=com")
+		So(normalizeLDAPDN(`cn=Doe\, John,dc=example`), ShouldEqual, `cn=doe\, john,dc=example`)
+	})
+
+	Convey("Given acl group mappings, they should be parsed or rejected", t, func() {
+		aclGroups, err := parseLDAPAclGroups("CN=Telemetry,OU=Groups,DC=example,DC=com:read:tele/#; cn=ops,dc=example,dc=com:readwrite:ops/%u/#;cn=x,dc=example,dc=com:subscribe:a:b/+")
+		So(err, ShouldBeNil)
+		So(aclGroups, ShouldResemble, []LDAPAclGroup{
+			{Group: "cn=telemetry,ou=groups,dc=example,dc=com", Acc: MOSQ_ACL_READ, Topic: "tele/#"},
+			{Group: "cn=ops,dc=example,dc=com", Acc: MOSQ_ACL_READWRITE, Topic: "ops/%u/#"},
+			{Group: "cn=x,dc=example,dc=com", Acc: MOSQ_ACL_SUBSCRIBE, Topic: "a:b/+"},
+		})
+
+		for _, mapping := range []string{"cn=ops,dc=example,dc=com", "cn=ops,dc=example,dc=com:all:#", "cn=ops,dc=example,dc=com:read:", ":read:#"} {
+			_, err := parseLDAPAclGroups(mapping)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+}
+
+func TestLDAP(t *testing.T) {
+
+	fake := newFakeLDAP()
+	fake.searchers = []string{"cn=service,dc=example,dc=com"}
+	ldapURL, err := fake.start()
+	if err != nil {
+		t.Fatalf("couldn't start fake LDAP: %s", err)
+	}
+	defer fake.stop()
+
+	authOpts := func(opts map[string]string) map[string]string {
+		all := map[string]string{
+			"ldap_url":              ldapURL,
+			"ldap_base_dn":          "dc=example,dc=com",
+			"ldap_bind_dn":          "cn=service,dc=example,dc=com",
+			"ldap_bind_password":    "service-pw",
+			"ldap_superuser_filter": "(memberOf=cn=admins,ou=groups,dc=example,dc=com)",
+			"ldap_acl_group":        "cn=telemetry,ou=groups,dc=example,dc=com:read:tele/#;cn=ops,ou=groups,dc=example,dc=com:readwrite:ops/%u/#",
+		}
+		for key, value := range opts {
+			if value == "" {
+				delete(all, key)
+			} else {
+				all[key] = value
+			}
+		}
+		return all
+	}
+
+	Convey("Given wrong options, NewLDAP should fail", t, func() {
+		for _, opts := range []map[string]string{
+			{"ldap_base_dn": ""},
+			{"ldap_url": "http://127.0.0.1"},
+			{"ldap_url": "ldap://"},
+			{"ldap_url": "ldaps://127.0.0.1", "ldap_start_tls": "true"},
+			{"ldap_ssl_insecure_skip_verify": "true"},
+			{"ldap_bind_password": ""},
+			{"ldap_bind_password": "wrong"},
+			{"ldap_user_dn": "ou=people,dc=example,dc=com"},
+			{"ldap_acl_group": "cn=ops:all:#"},
+			{"ldap_user_filter": "(uid=%u"},
+			{"ldap_url": "ldap://127.0.0.1:1"},
+		} {
+			_, err := NewLDAP(authOpts(opts), log.DebugLevel)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given invalid numbers, NewLDAP should warn and use the defaults", t, func() {
+		l, err := NewLDAP(authOpts(map[string]string{"ldap_timeout_ms": "0", "ldap_max_conns": "0"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer l.Halt()
+		So(l.Timeout, ShouldEqual, 5*time.Second)
+		So(l.MaxConns, ShouldEqual, 10)
+	})
+
+	Convey("Given users searched for with a service account, checks should be made by their entries and groups", t, func() {
+		l, err := NewLDAP(authOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer l.Halt()
+
+		So(l.GetUser("alice", "alice-pw"), ShouldBeTrue)
+		So(l.GetUser("bob", "bob-pw"), ShouldBeTrue)
+		So(l.GetUser("alice", "bob-pw"), ShouldBeFalse)
+		So(l.GetUser("alice", ""), ShouldBeFalse)
+		So(l.GetUser("nobody", "alice-pw"), ShouldBeFalse)
+		So(l.GetUser("*", "alice-pw"), ShouldBeFalse)
+		So(l.GetUser("alice)(uid=*", "alice-pw"), ShouldBeFalse)
+
+		//Carol has an entry in two branches, so which one is meant can't be told.
+		So(l.GetUser("carol", "carol-pw"), ShouldBeFalse)
+
+		//Connections left bound as a user are bound as the service account again to search.
+		So(l.GetSuperuser("alice"), ShouldBeTrue)
+		So(l.GetSuperuser("bob"), ShouldBeFalse)
+		So(l.GetSuperuser("nobody"), ShouldBeFalse)
+
+		So(l.CheckAcl("bob", "tele/dev1/temp", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(l.CheckAcl("bob", "tele/dev1/temp", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+		So(l.CheckAcl("bob", "tele/dev1/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(l.CheckAcl("alice", "tele/dev1/temp", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(l.CheckAcl("alice", "ops/alice/deploy", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(l.CheckAcl("alice", "ops/bob/deploy", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(l.CheckAcl("nobody", "tele/dev1/temp", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(l.CheckAcl("bob", "other/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+
+		_, ttl := l.GetUserTTL("alice", "alice-pw")
+		So(ttl, ShouldEqual, NoTTL)
+	})
+
+	Convey("Given users bound by their DN, they should be checked without searching for them", t, func() {
+		l, err := NewLDAP(authOpts(map[string]string{
+			"ldap_user_dn":       "uid=%u,ou=people,dc=example,dc=com",
+			"ldap_base_dn":       "",
+			"ldap_group_base_dn": "ou=groups,dc=example,dc=com",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer l.Halt()
+
+		So(l.GetUser("alice", "alice-pw"), ShouldBeTrue)
+		So(l.GetUser("alice", "wrong"), ShouldBeFalse)
+		So(l.GetUser("alice,ou=people", "alice-pw"), ShouldBeFalse)
+		So(l.GetSuperuser("alice"), ShouldBeTrue)
+		So(l.CheckAcl("bob", "tele/dev1/temp", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+	Convey("Given a server slower than ldap_timeout_ms, checks should be denied in time and their denials not cached", t, func() {
+		l, err := NewLDAP(authOpts(map[string]string{"ldap_timeout_ms": "100", "ldap_max_conns": "1"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer l.Halt()
+
+		fake.setDelay(300 * time.Millisecond)
+		defer fake.setDelay(0)
+
+		var wg sync.WaitGroup
+		ttls := make([]time.Duration, 3)
+		start := time.Now()
+		for i := range ttls {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, ttls[i] = l.GetUserTTL("alice", "alice-pw")
+			}(i)
+		}
+		wg.Wait()
+
+		So(time.Since(start), ShouldBeLessThan, 250*time.Millisecond)
+		for _, ttl := range ttls {
+			So(ttl, ShouldEqual, SkipCache)
+		}
+
+		granted, ttl := l.CheckAclTTL("bob", "tele/dev1/temp", "client", MOSQ_ACL_READ)
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+	})
+
+	Convey("Given a server gone after starting, checks should be denied and their denials not cached", t, func() {
+		gone := newFakeLDAP()
+		goneURL, err := gone.start()
+		So(err, ShouldBeNil)
+
+		l, err := NewLDAP(authOpts(map[string]string{"ldap_url": goneURL, "ldap_bind_dn": "", "ldap_bind_password": ""}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer l.Halt()
+		So(l.GetUser("alice", "alice-pw"), ShouldBeTrue)
+
+		//The idle connection the server closed is dropped, and a new one can't be made.
+		gone.stop()
+		time.Sleep(50 * time.Millisecond)
+
+		granted, ttl := l.GetUserTTL("alice", "alice-pw")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+	})
+
+	Convey("Given sequential checks, connections should be reused", t, func() {
+		l, err := NewLDAP(authOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer l.Halt()
+
+		before := atomic.LoadInt32(&fake.conns)
+		for i := 0; i < 5; i++ {
+			So(l.GetUser("alice", "alice-pw"), ShouldBeTrue)
+			So(l.GetSuperuser("alice"), ShouldBeTrue)
+		}
+		So(atomic.LoadInt32(&fake.conns), ShouldEqual, before)
+	})
+
+}
+
+func TestLDAPTLS(t *testing.T) {
+
+	certs, err := writeTestCerts()
+	defer os.RemoveAll(certs.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+	serverCert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+	if err != nil {
+		t.Fatalf("couldn't load test certs: %s", err)
+	}
+
+	for _, useTLS := range []bool{true, false} {
+		fake := newFakeLDAP()
+		fake.tlsConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+		fake.useTLS = useTLS
+		ldapURL, err := fake.start()
+		if err != nil {
+			t.Fatalf("couldn't start fake LDAP: %s", err)
+		}
+
+		authOpts := map[string]string{
+			"ldap_url":     ldapURL,
+			"ldap_user_dn": "uid=%u,ou=people,dc=example,dc=com",
+			"ldap_ssl_ca":  certs.CA,
+		}
+		if !useTLS {
+			authOpts["ldap_start_tls"] = "true"
+		}
+
+		Convey("Given "+ldapURL+" with TLS, the server's certificate should be verified", t, func() {
+			l, err := NewLDAP(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(l.GetUser("alice", "alice-pw"), ShouldBeTrue)
+			l.Halt()
+
+			Convey("And without the CA it should fail", func() {
+				delete(authOpts, "ldap_ssl_ca")
+				_, err := NewLDAP(authOpts, log.DebugLevel)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		fake.stop()
+	}
+
+	Convey("Given StartTLS a server doesn't support, NewLDAP should fail", t, func() {
+		fake := newFakeLDAP()
+		ldapURL, err := fake.start()
+		So(err, ShouldBeNil)
+		defer fake.stop()
+
+		_, err = NewLDAP(map[string]string{"ldap_url": ldapURL, "ldap_user_dn": "uid=%u,dc=example,dc=com", "ldap_start_tls": "true", "ldap_ssl_ca": certs.CA}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
@@ -0,0 +1,206 @@
+package backends
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+//ldapConn is a connection to an LDAP server, used by one check at a time.
+type ldapConn struct {
+	*ldap.Conn
+	//netConn is the connection the LDAP one runs on, whose deadline bounds connecting and closing, as go-ldap doesn't time them out.
+	netConn net.Conn
+	//boundDN is the DN the connection is bound as, empty when it's anonymous, as it is after a failed bind.
+	boundDN string
+}
+
+//dialLDAP connects to the address, over TLS when tlsConfig is given, and upgrades the connection with StartTLS when startTLS is, all before the deadline.
+func dialLDAP(address string, tlsConfig *tls.Config, startTLS bool, deadline time.Time) (*ldapConn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var netConn net.Conn
+	var err error
+	if tlsConfig != nil && !startTLS {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	conn := &ldapConn{Conn: ldap.NewConn(netConn, tlsConfig != nil && !startTLS), netConn: netConn}
+	conn.Start()
+
+	if startTLS {
+		netConn.SetDeadline(deadline)
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "StartTLS failed")
+		}
+		netConn.SetDeadline(time.Time{})
+	}
+
+	return conn, nil
+}
+
+//setTimeout makes the next operation time out at the deadline.
+func (c *ldapConn) setTimeout(deadline time.Time) error {
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection timed out"))
+	}
+	c.SetTimeout(timeout)
+	return nil
+}
+
+//bind binds the connection as the DN with the password, telling if the server accepted them.
+//A DN is never bound without a password, as servers take it as an unauthenticated bind, which succeeds whatever the DN.
+func (c *ldapConn) bind(dn, password string, deadline time.Time) (bool, error) {
+	if dn != "" && password == "" {
+		return false, nil
+	}
+	if err := c.setTimeout(deadline); err != nil {
+		return false, err
+	}
+
+	_, err := c.SimpleBind(&ldap.SimpleBindRequest{Username: dn, Password: password, AllowEmptyPassword: dn == ""})
+
+	c.boundDN = ""
+	switch {
+	case err == nil:
+		c.boundDN = dn
+		return true, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		return false, nil
+	}
+	return false, err
+}
+
+//search returns the entries in the scope of base matching the filter, with the attributes, or none when none are given.
+//At most sizeLimit entries are returned, or as many as the server allows when 0. A base that doesn't exist has no entries.
+func (c *ldapConn) search(base string, scope int, filter string, attributes []string, sizeLimit int, deadline time.Time) ([]*ldap.Entry, error) {
+	//1.1 asks for no attributes.
+	if len(attributes) == 0 {
+		attributes = []string{"1.1"}
+	}
+
+	if err := c.setTimeout(deadline); err != nil {
+		return nil, err
+	}
+
+	//The server is given the time left, rounded up to a second, as it takes no less.
+	timeLimit := int((time.Until(deadline) + time.Second - 1) / time.Second)
+
+	//Referrals to other servers aren't followed.
+	result, err := c.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, sizeLimit, timeLimit, false, filter, attributes, nil))
+	switch {
+	case err == nil, ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		return result.Entries, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		return nil, nil
+	}
+	return nil, err
+}
+
+//close unbinds and closes the connection, without waiting for the server.
+func (c *ldapConn) close() {
+	c.netConn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := c.Unbind(); err != nil {
+		c.Close()
+	}
+}
+
+//ldapPoolTimeout is returned when no connection was free before the deadline. It's a net.Error timing out, as dialing not done in time.
+type ldapPoolTimeout struct{}
+
+func (ldapPoolTimeout) Error() string   { return "timed out waiting for a free LDAP connection" }
+func (ldapPoolTimeout) Timeout() bool   { return true }
+func (ldapPoolTimeout) Temporary() bool { return true }
+
+//ldapPool bounds the connections to an LDAP server, keeping idle ones to be reused.
+type ldapPool struct {
+	dial func(deadline time.Time) (*ldapConn, error)
+	//slots holds a token per connection in use.
+	slots chan struct{}
+	idle  chan *ldapConn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newLDAPPool(size int, dial func(deadline time.Time) (*ldapConn, error)) *ldapPool {
+	return &ldapPool{
+		dial:  dial,
+		slots: make(chan struct{}, size),
+		idle:  make(chan *ldapConn, size),
+	}
+}
+
+//get returns an idle connection, or a new one. When as many as the pool's size are in use, it waits for one to be put back until the deadline.
+//Idle connections the server closed in the meantime are dropped.
+func (p *ldapPool) get(deadline time.Time) (*ldapConn, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, ldapPoolTimeout{}
+	}
+
+idle:
+	for {
+		select {
+		case conn := <-p.idle:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+			conn.Close()
+		default:
+			break idle
+		}
+	}
+
+	conn, err := p.dial(deadline)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+//put puts the connection back to be reused, or closes it when it's broken, e.g. an operation on it failed and it may be in any state.
+func (p *ldapPool) put(conn *ldapConn, broken bool) {
+	p.mu.Lock()
+	if broken || p.closed {
+		p.mu.Unlock()
+		conn.close()
+	} else {
+		//There are never more connections than idle may hold.
+		p.idle <- conn
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+//close closes the idle connections, and the ones in use as they're put back.
+func (p *ldapPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package backends
+
+import "strings"
+
+//escapeLDAPDN escapes a value to be put in a DN as an attribute's value, e.g. a username in uid=%u,ou=people,dc=example,dc=com.
+func escapeLDAPDN(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			escaped.WriteString(`\00`)
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+//normalizeLDAPDN returns the DN in lower case, without the spaces around its separators, so DNs written differently may be compared.
+func normalizeLDAPDN(dn string) string {
+	var rdns []string
+	var rdn []byte
+	escaped := false
+	flush := func() {
+		parts := strings.SplitN(string(rdn), "=", 2)
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		rdns = append(rdns, strings.Join(parts, "="))
+		rdn = rdn[:0]
+	}
+	for i := 0; i < len(dn); i++ {
+		c := dn[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ',':
+			flush()
+			continue
+		}
+		rdn = append(rdn, c)
+	}
+	flush()
+	return strings.ToLower(strings.Join(rdns, ","))
+}
@@ -2,7 +2,13 @@ package backends
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +24,7 @@ import (
 )
 
 type Mongo struct {
+	URI             string
 	Host            string
 	Port            string
 	Username        string
@@ -25,7 +32,37 @@ type Mongo struct {
 	DBName          string
 	UsersCollection string
 	AclsCollection  string
+	AclsEmbedded    bool
 	Conn            *mongo.Client
+	ConnectTries    int
+	ConnectRetry    time.Duration
+	SSL             bool
+	SSLCA           string
+	SSLCert         string
+	SSLKey          string
+	AuthMechanism   string
+	AuthSource      string
+	UsernameField   string
+	PasswordField   string
+	SuperuserField  string
+	AclsField       string
+	TopicField      string
+	AccField        string
+
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	OperationTimeout       time.Duration
+	MaxPoolSize            int
+	MinPoolSize            int
+
+	AclPipelineCollection string
+	AclPipelineField      string
+	aclPipeline           bson.A
+
+	WatchChanges bool
+	watchFilter  bson.D
+	watcher      *mongoWatcher
+	Hasher       common.Hasher //Verifies password hashes, taking PBKDF2 salts in its encoding.
 }
 
 type MongoAcl struct {
@@ -40,10 +77,29 @@ type MongoUser struct {
 	Acls         []MongoAcl `bson:"acls"`
 }
 
+//MongoOptions are the auth options the Mongo backend takes.
+var MongoOptions = Options{
+	Keys: withKeys([]string{
+		"mongo_acc_field", "mongo_acl_pipeline", "mongo_acl_pipeline_collection", "mongo_acl_pipeline_field",
+		"mongo_acls", "mongo_acls_embedded", "mongo_acls_field", "mongo_auth_mechanism", "mongo_auth_source",
+		"mongo_connect_retry_ms", "mongo_connect_timeout_ms", "mongo_connect_tries", "mongo_dbname",
+		"mongo_host", "mongo_max_pool_size", "mongo_min_pool_size", "mongo_operation_timeout_ms",
+		"mongo_password", "mongo_password_field", "mongo_port", "mongo_server_selection_timeout_ms",
+		"mongo_ssl", "mongo_ssl_ca", "mongo_ssl_cert", "mongo_ssl_key", "mongo_superuser_field",
+		"mongo_topic_field", "mongo_uri", "mongo_username", "mongo_username_field", "mongo_users",
+		"mongo_watch_changes", "mongo_watch_filter",
+	}, common.HasherOptions, common.PrefixedHasherOptions("mongo")),
+}
+
 func NewMongo(authOpts map[string]string, logLevel log.Level) (Mongo, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := MongoOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return Mongo{}, errors.Errorf("Mongo backend error: %s.\n", err)
+	}
+
 	var m = Mongo{
 		Host:            "localhost",
 		Port:            "27017",
@@ -52,6 +108,18 @@ func NewMongo(authOpts map[string]string, logLevel log.Level) (Mongo, error) {
 		DBName:          "mosquitto",
 		UsersCollection: "users",
 		AclsCollection:  "acls",
+		ConnectTries:    -1,
+		ConnectRetry:    2 * time.Second,
+
+		ConnectTimeout:         60 * time.Second,
+		ServerSelectionTimeout: 5 * time.Second,
+		OperationTimeout:       5 * time.Second,
+		UsernameField:          "username",
+		PasswordField:          "password",
+		SuperuserField:         "superuser",
+		AclsField:              "acls",
+		TopicField:             "topic",
+		AccField:               "acc",
 	}
 
 	if mongoHost, ok := authOpts["mongo_host"]; ok {
@@ -82,123 +150,570 @@ func NewMongo(authOpts map[string]string, logLevel log.Level) (Mongo, error) {
 		m.AclsCollection = aclsCollection
 	}
 
-	addr := fmt.Sprintf("mongodb://%s:%s", m.Host, m.Port)
+	//With embedded acls, only the ones in the user's document are checked and the acls collection is never queried.
+	if common.BoolOption(authOpts, "mongo_acls_embedded", false) {
+		m.AclsEmbedded = true
+		if _, ok := authOpts["mongo_acls"]; ok {
+			log.Warnf("Mongo backend: mongo_acls_embedded is set, ignoring mongo_acls.")
+		}
+	}
+
+	//A URI overrides the host and port, and may set anything else the driver takes, e.g. a mongodb+srv one for a replica set found through SRV records.
+	if uri, ok := authOpts["mongo_uri"]; ok {
+		m.URI = strings.TrimSpace(uri)
+		for _, opt := range []string{"mongo_host", "mongo_port"} {
+			if _, ok := authOpts[opt]; ok {
+				log.Warnf("Mongo backend: mongo_uri is set, ignoring %s.", opt)
+			}
+		}
+	}
+
+	hasher, err := common.NewHasher(authOpts, "mongo")
+	if err != nil {
+		return m, errors.Errorf("Mongo backend error: %s.\n", err)
+	}
+	m.Hasher = hasher
+
+	//Field names may be dotted paths into embedded documents, e.g. profile.password.
+	for opt, field := range map[string]*string{
+		"mongo_username_field":  &m.UsernameField,
+		"mongo_password_field":  &m.PasswordField,
+		"mongo_superuser_field": &m.SuperuserField,
+		"mongo_acls_field":      &m.AclsField,
+		"mongo_topic_field":     &m.TopicField,
+		"mongo_acc_field":       &m.AccField,
+	} {
+		if name, ok := authOpts[opt]; ok {
+			name = strings.TrimSpace(name)
+			if name == "" || strings.HasPrefix(name, "$") {
+				return m, errors.Errorf("Mongo backend error: invalid %s %s.\n", opt, name)
+			}
+			*field = name
+		}
+	}
+
+	//An aggregation pipeline replaces the acl lookups, e.g. to join devices with their groups' permissions.
+	if pipeline, ok := authOpts["mongo_acl_pipeline"]; ok {
+		if m.AclsEmbedded {
+			return m, errors.New("Mongo backend error: mongo_acl_pipeline can't be used with mongo_acls_embedded.\n")
+		}
+		stages, err := parseMongoPipeline(pipeline)
+		if err != nil {
+			return m, errors.Errorf("Mongo backend error: invalid mongo_acl_pipeline: %s\n", err)
+		}
+		m.aclPipeline = stages
+		m.AclPipelineCollection = m.UsersCollection
+	}
+
+	if collection, ok := authOpts["mongo_acl_pipeline_collection"]; ok {
+		m.AclPipelineCollection = collection
+	}
+
+	if field, ok := authOpts["mongo_acl_pipeline_field"]; ok {
+		m.AclPipelineField = strings.TrimSpace(field)
+	}
+
+	m.WatchChanges = common.BoolOption(authOpts, "mongo_watch_changes", false)
+
+	if filter, ok := authOpts["mongo_watch_filter"]; ok {
+		if !m.WatchChanges {
+			return m, errors.New("Mongo backend error: mongo_watch_filter needs mongo_watch_changes.\n")
+		}
+		if err := bson.UnmarshalExtJSON([]byte(filter), false, &m.watchFilter); err != nil {
+			return m, errors.Errorf("Mongo backend error: invalid mongo_watch_filter: %s\n", err)
+		}
+	}
+
+	m.SSL = common.BoolOption(authOpts, "mongo_ssl", false)
+
+	if sslCA, ok := authOpts["mongo_ssl_ca"]; ok {
+		m.SSLCA = sslCA
+	}
 
-	to := 60 * time.Second
-	opts := options.ClientOptions{
-		ConnectTimeout: &to,
+	if sslCert, ok := authOpts["mongo_ssl_cert"]; ok {
+		m.SSLCert = sslCert
 	}
 
-	opts.ApplyURI(addr)
+	if sslKey, ok := authOpts["mongo_ssl_key"]; ok {
+		m.SSLKey = sslKey
+	}
 
-	if m.Username != "" && m.Password != "" {
-		opts.Auth = &options.Credential{
-			AuthSource:  m.DBName,
-			Username:    m.Username,
-			Password:    m.Password,
-			PasswordSet: true,
+	if authMechanism, ok := authOpts["mongo_auth_mechanism"]; ok {
+		m.AuthMechanism = strings.ToUpper(strings.TrimSpace(authMechanism))
+		switch m.AuthMechanism {
+		case "SCRAM-SHA-1", "SCRAM-SHA-256", "MONGODB-X509", "PLAIN":
+		default:
+			return m, errors.Errorf("Mongo backend error: invalid mongo_auth_mechanism %s, it must be SCRAM-SHA-1, SCRAM-SHA-256, MONGODB-X509 or PLAIN.\n", authMechanism)
 		}
 	}
 
-	client, err := mongo.Connect(context.TODO(), &opts)
+	if authSource, ok := authOpts["mongo_auth_source"]; ok {
+		m.AuthSource = authSource
+	}
+
+	//A check never waits longer than the operation timeout, including selecting a server and waiting for a free connection, so a flaky DB can't hang mosquitto.
+	for opt, timeout := range map[string]*time.Duration{
+		"mongo_connect_timeout_ms":          &m.ConnectTimeout,
+		"mongo_server_selection_timeout_ms": &m.ServerSelectionTimeout,
+		"mongo_operation_timeout_ms":        &m.OperationTimeout,
+	} {
+		*timeout = common.DurationOption(authOpts, opt, time.Millisecond, time.Millisecond, *timeout)
+	}
+
+	for opt, size := range map[string]*int{
+		"mongo_max_pool_size": &m.MaxPoolSize,
+		"mongo_min_pool_size": &m.MinPoolSize,
+	} {
+		*size = common.IntOption(authOpts, opt, 0, math.MaxInt32, *size)
+	}
+
+	if m.MaxPoolSize > 0 && m.MinPoolSize > m.MaxPoolSize {
+		return m, errors.Errorf("Mongo backend error: mongo_min_pool_size %d is greater than mongo_max_pool_size %d.\n", m.MinPoolSize, m.MaxPoolSize)
+	}
+
+	m.ConnectTries = common.IntOption(authOpts, "mongo_connect_tries", 0, math.MaxInt32, m.ConnectTries)
+
+	m.ConnectRetry = common.DurationOption(authOpts, "mongo_connect_retry_ms", time.Millisecond, time.Millisecond, m.ConnectRetry)
+
+	opts, err := m.clientOptions()
+	if err != nil {
+		return m, err
+	}
+
+	client, err := mongo.Connect(context.TODO(), opts)
 	if err != nil {
 		return m, errors.Errorf("couldn't start mongo backend. error: %s\n", err)
 	}
 
 	m.Conn = client
 
+	//Unless told to, don't wait for the DB to be up, as the client connects lazily.
+	if m.ConnectTries >= 0 {
+		if err := m.ping(); err != nil {
+			client.Disconnect(context.TODO())
+			return m, errors.Errorf("couldn't start mongo backend. error: %s\n", err)
+		}
+	} else if m.SSL {
+		if err := m.checkTLS(); err != nil {
+			client.Disconnect(context.TODO())
+			return m, err
+		}
+	}
+
+	if m.WatchChanges {
+		m.watcher = newMongoWatcher(m, m.watchFilter)
+	}
+
 	return m, nil
 
 }
 
+//clientOptions returns the options to connect with, from the URI or else the host and port, and the TLS, auth, timeout and pool ones.
+//Credentials in the URI win over the username and password options, which are otherwise added to any auth options the URI has, and so do its timeouts and pool sizes.
+func (o Mongo) clientOptions() (*options.ClientOptions, error) {
+	uri := o.URI
+	if uri == "" {
+		uri = fmt.Sprintf("mongodb://%s:%s", o.Host, o.Port)
+	}
+
+	opts := &options.ClientOptions{}
+	if o.ConnectTimeout > 0 {
+		connectTimeout := o.ConnectTimeout
+		opts.ConnectTimeout = &connectTimeout
+	}
+	if o.ServerSelectionTimeout > 0 {
+		serverSelectionTimeout := o.ServerSelectionTimeout
+		opts.ServerSelectionTimeout = &serverSelectionTimeout
+	}
+
+	//Pool sizes are set as URI options, so the driver validates them as it does for ones given in mongo_uri.
+	params := url.Values{}
+	if o.MaxPoolSize > 0 {
+		params.Set("maxPoolSize", strconv.Itoa(o.MaxPoolSize))
+	}
+	if o.MinPoolSize > 0 {
+		params.Set("minPoolSize", strconv.Itoa(o.MinPoolSize))
+	}
+
+	opts.ApplyURI(mongoURIWithParams(uri, params))
+
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.TLSConfig = tlsConfig
+	}
+
+	x509Auth := o.AuthMechanism == "MONGODB-X509"
+	if x509Auth && o.Password != "" {
+		return nil, errors.New("Mongo backend error: mongo_password can't be used with the MONGODB-X509 mongo_auth_mechanism, which authenticates with the client certificate.\n")
+	}
+
+	switch {
+	case opts.Auth != nil && opts.Auth.Username != "":
+		if o.Username != "" || o.AuthMechanism != "" || o.AuthSource != "" {
+			log.Warnf("Mongo backend: using the credentials for user %s in mongo_uri, ignoring mongo_username, mongo_password, mongo_auth_mechanism and mongo_auth_source.", opts.Auth.Username)
+		} else {
+			log.Infof("Mongo backend: using the credentials for user %s in mongo_uri.", opts.Auth.Username)
+		}
+	case x509Auth || (o.Username != "" && o.Password != ""):
+		if opts.Auth == nil {
+			opts.Auth = &options.Credential{AuthSource: o.DBName}
+		}
+		if o.AuthMechanism != "" {
+			opts.Auth.AuthMechanism = o.AuthMechanism
+		}
+		opts.Auth.Username = o.Username
+		if x509Auth {
+			//X.509 users live in the $external DB, and the username is taken from the certificate when not given.
+			opts.Auth.AuthSource = "$external"
+		} else {
+			opts.Auth.Password = o.Password
+			opts.Auth.PasswordSet = true
+		}
+		if o.AuthSource != "" {
+			opts.Auth.AuthSource = o.AuthSource
+		}
+		if o.URI != "" {
+			log.Infof("Mongo backend: mongo_uri has no credentials, using mongo_username %s and mongo_password.", o.Username)
+		}
+	}
+
+	return opts, nil
+}
+
+//tlsConfig returns the TLS config with the given CA and client certificate loaded, or nil when TLS isn't enabled by mongo_ssl.
+//The key may be in the certificate's file, as mongod expects it, so mongo_ssl_key is optional.
+func (o Mongo) tlsConfig() (*tls.Config, error) {
+	if !o.SSL {
+		if o.SSLCA != "" || o.SSLCert != "" || o.SSLKey != "" || o.AuthMechanism == "MONGODB-X509" {
+			return nil, errors.New("Mongo backend error: mongo_ssl must be true to use mongo_ssl_ca, mongo_ssl_cert, mongo_ssl_key or MONGODB-X509 auth.\n")
+		}
+		return nil, nil
+	}
+
+	if o.SSLKey != "" && o.SSLCert == "" {
+		return nil, errors.New("Mongo backend error: mongo_ssl_key needs mongo_ssl_cert.\n")
+	}
+
+	if o.AuthMechanism == "MONGODB-X509" && o.SSLCert == "" {
+		return nil, errors.New("Mongo backend error: MONGODB-X509 auth needs a client certificate in mongo_ssl_cert.\n")
+	}
+
+	config := &tls.Config{}
+
+	if o.SSLCA != "" {
+		pem, err := ioutil.ReadFile(o.SSLCA)
+		if err != nil {
+			return nil, errors.Errorf("Mongo backend error: couldn't read mongo_ssl_ca: %s\n", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("Mongo backend error: no certificates found in mongo_ssl_ca %s.\n", o.SSLCA)
+		}
+	}
+
+	if o.SSLCert != "" {
+		keyFile := o.SSLKey
+		if keyFile == "" {
+			keyFile = o.SSLCert
+		}
+		cert, err := tls.LoadX509KeyPair(o.SSLCert, keyFile)
+		if err != nil {
+			return nil, errors.Errorf("Mongo backend error: couldn't load mongo_ssl_cert and mongo_ssl_key: %s\n", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+//mongoURIWithParams adds the params the URI doesn't already have to its options.
+func mongoURIWithParams(uri string, params url.Values) string {
+	rest := uri
+	if i := strings.Index(uri, "://"); i >= 0 {
+		rest = uri[i+3:]
+	}
+
+	query := ""
+	if i := strings.Index(rest, "?"); i >= 0 {
+		query = strings.ToLower(rest[i+1:])
+	}
+
+	added := url.Values{}
+	for key, values := range params {
+		if !strings.Contains("&"+query, "&"+strings.ToLower(key)+"=") {
+			added[key] = values
+		}
+	}
+	if len(added) == 0 {
+		return uri
+	}
+
+	switch {
+	case strings.Contains(rest, "?"):
+		return uri + "&" + added.Encode()
+	case strings.Contains(rest, "/"):
+		return uri + "?" + added.Encode()
+	default:
+		return uri + "/?" + added.Encode()
+	}
+}
+
+//checkTLS pings the DB once so a server certificate that can't be verified fails init, rather than every check timing out.
+//Any other error, e.g. the DB being down, is only logged as the client connects lazily.
+func (o Mongo) checkTLS() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := o.Conn.Ping(ctx, nil)
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "x509:") || strings.Contains(msg, "tls:") || strings.Contains(msg, "certificate") {
+		return errors.Errorf("Mongo backend error: TLS handshake failed, check mongo_ssl_ca and mongo_ssl_cert: %s\n", err)
+	}
+
+	log.Warnf("Mongo backend: couldn't reach the DB over TLS yet, will keep trying on checks: %s", err)
+	return nil
+}
+
+//ping pings the DB up to the connect tries, or forever when they're 0, waiting the connect retry between attempts.
+func (o Mongo) ping() error {
+	for try := 1; ; try++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := o.Conn.Ping(ctx, nil)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if o.ConnectTries > 0 && try >= o.ConnectTries {
+			return errors.Wrapf(err, "ping database error after %d tries", try)
+		}
+		log.Errorf("Mongo ping error, will retry in %s: %s", o.ConnectRetry, err)
+		time.Sleep(o.ConnectRetry)
+	}
+}
+
+//queryContext bounds a check's operations, including selecting a server and waiting for a free connection, by the operation timeout.
+func (o Mongo) queryContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), o.OperationTimeout)
+}
+
+//queryFailed logs a check's error and returns the cache hint for its denial: an operation that timed out must not have its denial cached, as the DB could have granted it.
+func (o Mongo) queryFailed(ctx context.Context, check string, start time.Time, err error) time.Duration {
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Errorf("Mongo %s timed out after %s (timeout %s): %s", check, time.Since(start), o.OperationTimeout, err)
+		return SkipCache
+	}
+	log.Debugf("Mongo %s error: %s", check, err)
+	return NoTTL
+}
+
+//findUser returns the user's document, found by its username field.
+func (o Mongo) findUser(ctx context.Context, username string) (bson.M, error) {
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user bson.M
+	err := uc.FindOne(ctx, bson.M{o.UsernameField: username}).Decode(&user)
+
+	return user, err
+}
+
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Mongo) GetUser(username, password string) bool {
+	granted, _ := o.GetUserTTL(username, password)
+	return granted
+}
 
-	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+//GetUserTTL checks the user just as GetUser, and also returns SkipCache when the DB didn't answer in time so the denial isn't cached, or NoTTL otherwise.
+func (o Mongo) GetUserTTL(username, password string) (bool, time.Duration) {
+
+	ctx, cancel := o.queryContext()
+	defer cancel()
 
-	var user MongoUser
+	start := time.Now()
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	user, err := o.findUser(ctx, username)
 	if err != nil {
-		log.Debugf("Mongo get user error: %s", err)
-		return false
+		return false, o.queryFailed(ctx, "get user", start, err)
+	}
+
+	pwHash, ok := mongoLookup(user, o.PasswordField).(string)
+	if !ok {
+		log.Debugf("Mongo get user error: user %s has no %s field.", common.RedactUsername(username), o.PasswordField)
+		return false, NoTTL
 	}
 
-	if common.HashCompare(password, user.PasswordHash) {
-		return true
+	if o.Hasher.Compare(password, pwHash) {
+		return true, NoTTL
 	}
 
-	return false
+	return false, NoTTL
 
 }
 
-//GetSuperuser checks that the key username:su exists and has value "true".
+//GetSuperuser checks that the user's superuser field is true.
 func (o Mongo) GetSuperuser(username string) bool {
 
-	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+	ctx, cancel := o.queryContext()
+	defer cancel()
 
-	var user MongoUser
+	start := time.Now()
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	user, err := o.findUser(ctx, username)
 	if err != nil {
-		log.Debugf("Mongo get superuser error: %s", err)
+		o.queryFailed(ctx, "get superuser", start, err)
 		return false
 	}
 
-	return user.Superuser
+	superuser, _ := mongoLookup(user, o.SuperuserField).(bool)
+
+	return superuser
 
 }
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
+	granted, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return granted
+}
 
-	//Get user and check his acls.
-	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+//CheckAclTTL checks the acl just as CheckAcl, and also returns SkipCache when the DB didn't answer in time so the denial isn't cached, or NoTTL otherwise.
+func (o Mongo) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
 
-	var user MongoUser
+	ctx, cancel := o.queryContext()
+	defer cancel()
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	start := time.Now()
+
+	if o.aclPipeline != nil {
+		granted, err := o.checkAclPipeline(ctx, username, topic, clientid, acc)
+		if err != nil {
+			return false, o.queryFailed(ctx, "check acl pipeline", start, err)
+		}
+		return granted, NoTTL
+	}
+
+	//Get user and check his acls.
+	user, err := o.findUser(ctx, username)
 	if err != nil {
-		log.Debugf("Mongo get superuser error: %s", err)
-		return false
+		return false, o.queryFailed(ctx, "check acl", start, err)
 	}
 
-	for _, acl := range user.Acls {
-		if (acl.Acc == acc || acl.Acc == 3) && common.TopicsMatch(acl.Topic, topic) {
-			return true
+	var acls []interface{}
+	switch a := mongoLookup(user, o.AclsField).(type) {
+	case bson.A:
+		acls = a
+	case []interface{}:
+		acls = a
+	}
+	for _, acl := range acls {
+		//User acls may contain %c and %u too (e.g., tele/%u/#).
+		if o.aclGrants(acl, topic, username, clientid, acc) {
+			return true, NoTTL
 		}
 	}
 
-	//Now check common acls.
+	if o.AclsEmbedded {
+		return false, NoTTL
+	}
+
+	//Now check common acls, fetching only the ones whose access may grant the check and matching their patterns here.
 
 	ac := o.Conn.Database(o.DBName).Collection(o.AclsCollection)
-	cur, aErr := ac.Find(context.TODO(), bson.M{"acc": bson.M{"$in": []int32{acc, 3}}})
+	cur, err := ac.Find(ctx, bson.M{o.AccField: bson.M{"$in": grantingAccs(acc, topic)}})
 
-	if aErr != nil {
-		log.Debugf("Mongo check acl error: %s", err)
-		return false
+	if err != nil {
+		return false, o.queryFailed(ctx, "check acl", start, err)
 	}
 
-	defer cur.Close(context.TODO())
+	defer cur.Close(context.Background())
 
-	for cur.Next(context.TODO()) {
-		var acl MongoAcl
+	for cur.Next(ctx) {
+		var acl bson.M
 		err = cur.Decode(&acl)
 		if err == nil {
-			aclTopic := strings.Replace(acl.Topic, "%c", clientid, -1)
-			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if common.TopicsMatch(aclTopic, topic) {
-				return true
+			if o.aclGrants(acl, topic, username, clientid, acc) {
+				return true, NoTTL
 			}
 		} else {
 			log.Errorf("mongo cursor decode error: %s", err)
 		}
 	}
 
-	return false
+	if err := cur.Err(); err != nil {
+		return false, o.queryFailed(ctx, "check acl", start, err)
+	}
+
+	return false, NoTTL
 
 }
 
+//acl returns the topic and access of an acl document, and false if it lacks either.
+func (o Mongo) acl(doc interface{}) (string, int32, bool) {
+	topic, ok := mongoLookup(doc, o.TopicField).(string)
+	if !ok {
+		return "", 0, false
+	}
+
+	//Numbers may have been stored as any BSON numeric type, e.g. doubles by the mongo shell.
+	switch acc := mongoLookup(doc, o.AccField).(type) {
+	case int32:
+		return topic, acc, true
+	case int64:
+		return topic, int32(acc), true
+	case float64:
+		return topic, int32(acc), true
+	}
+
+	return "", 0, false
+}
+
+//aclGrants tells if an acl document grants the check, matching its pattern with MQTT wildcards and %u and %c replaced, and its access just as the files backend does.
+func (o Mongo) aclGrants(doc interface{}, topic, username, clientid string, acc int32) bool {
+	aclTopic, aclAcc, ok := o.acl(doc)
+	return ok && accMatches(aclAcc, acc, topic) && common.AclMatches(aclTopic, topic, username, clientid)
+}
+
+//grantingAccs returns the stored accesses that grant the requested one on the topic.
+func grantingAccs(acc int32, topic string) []int32 {
+	accs := []int32{}
+	for _, aclAcc := range []int32{MOSQ_ACL_READ, MOSQ_ACL_WRITE, MOSQ_ACL_READWRITE, MOSQ_ACL_SUBSCRIBE} {
+		if accMatches(aclAcc, acc, topic) {
+			accs = append(accs, aclAcc)
+		}
+	}
+	return accs
+}
+
+//mongoLookup returns the value at the dotted path in a document, or nil if it's not there.
+func mongoLookup(doc interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		switch d := doc.(type) {
+		case bson.M:
+			doc = d[key]
+		case map[string]interface{}:
+			doc = d[key]
+		case bson.D:
+			doc = nil
+			for _, e := range d {
+				if e.Key == key {
+					doc = e.Value
+					break
+				}
+			}
+		default:
+			return nil
+		}
+	}
+
+	return doc
+}
+
 //GetName returns the backend's name
 func (o Mongo) GetName() string {
 	return "Mongo"
@@ -206,6 +721,9 @@ func (o Mongo) GetName() string {
 
 //Halt closes the mongo session.
 func (o Mongo) Halt() {
+	if o.watcher != nil {
+		o.watcher.stop()
+	}
 	if o.Conn != nil {
 		o.Conn.Disconnect(context.TODO())
 	}
@@ -0,0 +1,142 @@
+package backends
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//mongoPlaceholders are the placeholders a pipeline template may have, each one as a whole string value.
+var mongoPlaceholders = map[string]bool{
+	"{{username}}": true,
+	"{{clientid}}": true,
+	"{{topic}}":    true,
+	"{{acc}}":      true,
+}
+
+//parseMongoPipeline parses a pipeline template given as an array of stages in extended JSON, checking its placeholders.
+func parseMongoPipeline(template string) (bson.A, error) {
+	var wrapper bson.D
+	if err := bson.UnmarshalExtJSON([]byte(`{"pipeline": `+template+`}`), false, &wrapper); err != nil {
+		return nil, errors.Wrap(err, "invalid JSON")
+	}
+
+	var stages bson.A
+	if len(wrapper) == 1 {
+		stages, _ = wrapper[0].Value.(bson.A)
+	}
+	if len(stages) == 0 {
+		return nil, errors.New("it must be a non empty array of stages")
+	}
+
+	for i, stage := range stages {
+		switch stage.(type) {
+		case bson.D, bson.M:
+		default:
+			return nil, errors.Errorf("stage %d isn't a document", i+1)
+		}
+	}
+
+	if err := checkMongoPlaceholders(stages); err != nil {
+		return nil, err
+	}
+
+	return stages, nil
+}
+
+//checkMongoPlaceholders checks every placeholder in the template is known and is a whole value, as values are never spliced into strings.
+func checkMongoPlaceholders(value interface{}) error {
+	switch v := value.(type) {
+	case bson.D:
+		for _, e := range v {
+			if err := checkMongoPlaceholders(e.Value); err != nil {
+				return err
+			}
+		}
+	case bson.M:
+		for _, e := range v {
+			if err := checkMongoPlaceholders(e); err != nil {
+				return err
+			}
+		}
+	case bson.A:
+		for _, e := range v {
+			if err := checkMongoPlaceholders(e); err != nil {
+				return err
+			}
+		}
+	case string:
+		if strings.Contains(v, "{{") && !mongoPlaceholders[v] {
+			return errors.Errorf("unknown placeholder in %q, it must be one of {{username}}, {{clientid}}, {{topic}} or {{acc}} as a whole value", v)
+		}
+	}
+
+	return nil
+}
+
+//fillMongoPipeline returns a copy of the template with its placeholders replaced by the given values, which are passed as BSON values.
+func fillMongoPipeline(value interface{}, values map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		filled := make(bson.D, len(v))
+		for i, e := range v {
+			filled[i] = bson.E{Key: e.Key, Value: fillMongoPipeline(e.Value, values)}
+		}
+		return filled
+	case bson.M:
+		filled := make(bson.M, len(v))
+		for k, e := range v {
+			filled[k] = fillMongoPipeline(e, values)
+		}
+		return filled
+	case bson.A:
+		filled := make(bson.A, len(v))
+		for i, e := range v {
+			filled[i] = fillMongoPipeline(e, values)
+		}
+		return filled
+	case string:
+		if filled, ok := values[v]; ok {
+			return filled
+		}
+	}
+
+	return value
+}
+
+//checkAclPipeline runs the acl pipeline for the check, granting it when a document is returned, and the grant field of the first one is true when set.
+func (o Mongo) checkAclPipeline(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	pipeline := fillMongoPipeline(o.aclPipeline, map[string]interface{}{
+		"{{username}}": username,
+		"{{clientid}}": clientid,
+		"{{topic}}":    topic,
+		"{{acc}}":      acc,
+	})
+
+	coll := o.Conn.Database(o.DBName).Collection(o.AclPipelineCollection)
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return false, err
+	}
+	defer cur.Close(context.Background())
+
+	if !cur.Next(ctx) {
+		return false, cur.Err()
+	}
+
+	if o.AclPipelineField == "" {
+		return true, nil
+	}
+
+	var doc bson.M
+	if err := cur.Decode(&doc); err != nil {
+		return false, err
+	}
+
+	granted, _ := mongoLookup(doc, o.AclPipelineField).(bool)
+
+	return granted, nil
+}
@@ -0,0 +1,221 @@
+package backends
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//mongoMaxWatchBackoff is the longest wait between attempts to reopen the change stream.
+const mongoMaxWatchBackoff = time.Minute
+
+//mongoWatcher watches the users and acls collections through a change stream and hands the username of every changed user to the handler set with OnUserChange, so its cached decisions are dropped.
+//Common acls apply to any user, so the handler is given an empty username meaning any user may have changed when they change, when a user's username can't be told, and when the stream is reopened, as changes may have been missed meanwhile.
+type mongoWatcher struct {
+	mongo   Mongo
+	filter  bson.D
+	handler atomic.Value
+	cancel  context.CancelFunc
+	done    chan struct{}
+	halt    sync.Once
+}
+
+//mongoChangeEvent holds the fields of a change event the watcher reads.
+type mongoChangeEvent struct {
+	OperationType string `bson:"operationType"`
+	Ns            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	FullDocument      bson.M `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+//newMongoWatcher starts watching the backend's collections for changes matching the filter, if any.
+func newMongoWatcher(m Mongo, filter bson.D) *mongoWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &mongoWatcher{
+		mongo:  m,
+		filter: filter,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go w.run(ctx)
+
+	return w
+}
+
+//run opens the change stream and handles its events, reopening it when it fails or is invalidated, waiting from the connect retry up to mongoMaxWatchBackoff between attempts.
+//It gives up for good when the server doesn't support change streams, as a standalone mongod, leaving checks unaffected.
+func (w *mongoWatcher) run(ctx context.Context) {
+	defer close(w.done)
+
+	backoff := w.mongo.ConnectRetry
+	opened := false
+
+	for {
+		reopened, err := w.watch(ctx, opened)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if reopened {
+			opened = true
+			backoff = w.mongo.ConnectRetry
+		}
+
+		if err != nil && changeStreamsUnsupported(err) {
+			log.Warnf("Mongo backend: the server doesn't support change streams, which need a replica set or sharded cluster, so changes won't drop cached decisions: %s", err)
+			return
+		}
+
+		if err != nil {
+			log.Errorf("Mongo backend: change stream failed, reopening in %s: %s", backoff, err)
+		} else {
+			log.Warnf("Mongo backend: change stream was invalidated, reopening in %s.", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if !reopened {
+			backoff *= 2
+			if backoff > mongoMaxWatchBackoff {
+				backoff = mongoMaxWatchBackoff
+			}
+		}
+	}
+}
+
+//watch opens the change stream and handles its events until it ends, telling whether it could be opened.
+//When the stream had been opened before, every cached decision is dropped once it's reopened.
+func (w *mongoWatcher) watch(ctx context.Context, missed bool) (bool, error) {
+	collections := bson.A{w.mongo.UsersCollection}
+	if !w.mongo.AclsEmbedded {
+		collections = append(collections, w.mongo.AclsCollection)
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"ns.coll": bson.M{"$in": collections}}},
+	}
+	if w.filter != nil {
+		pipeline = append(pipeline, bson.M{"$match": w.filter})
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	stream, err := w.mongo.Conn.Database(w.mongo.DBName).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close(context.Background())
+
+	log.Infof("Mongo backend: watching collections %v for changes.", collections)
+
+	if missed {
+		log.Warnf("Mongo backend: change stream reopened, dropping every cached decision as changes may have been missed.")
+		w.notify("")
+	}
+
+	for stream.Next(ctx) {
+		var event mongoChangeEvent
+		if err := stream.Decode(&event); err != nil {
+			log.Errorf("Mongo backend: couldn't decode change event, dropping every cached decision: %s", err)
+			w.notify("")
+			continue
+		}
+
+		if event.OperationType == "invalidate" {
+			return true, nil
+		}
+
+		username := w.changedUsername(event)
+		if username == "" {
+			log.Debugf("Mongo backend: %s on %s may affect any user, dropping every cached decision.", event.OperationType, event.Ns.Coll)
+		} else {
+			log.Debugf("Mongo backend: user %s changed, dropping its cached decisions.", common.RedactUsername(username))
+		}
+		w.notify(username)
+	}
+
+	return true, stream.Err()
+}
+
+//changedUsername returns the username of the user changed by the event, or an empty one when any user may have been affected: common acls changed, or the user was deleted or renamed, which leaves its former username unknown.
+func (w *mongoWatcher) changedUsername(event mongoChangeEvent) string {
+	if event.Ns.Coll != w.mongo.UsersCollection {
+		return ""
+	}
+
+	field := w.mongo.UsernameField
+	for updated := range event.UpdateDescription.UpdatedFields {
+		if mongoPathsOverlap(updated, field) {
+			return ""
+		}
+	}
+	for _, removed := range event.UpdateDescription.RemovedFields {
+		if mongoPathsOverlap(removed, field) {
+			return ""
+		}
+	}
+
+	//A replaced document may have had another username too, and the full document of a deleted one is gone.
+	if event.OperationType != "insert" && event.OperationType != "update" {
+		return ""
+	}
+
+	username, _ := mongoLookup(event.FullDocument, field).(string)
+
+	return username
+}
+
+//mongoPathsOverlap tells if setting one dotted path changes the value at the other.
+func mongoPathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+//notify hands the username to the handler, if set.
+func (w *mongoWatcher) notify(username string) {
+	if handler, ok := w.handler.Load().(func(string)); ok {
+		handler(username)
+	}
+}
+
+//stop closes the change stream and waits for its events to be handled.
+func (w *mongoWatcher) stop() {
+	w.halt.Do(func() {
+		w.cancel()
+		<-w.done
+	})
+}
+
+//changeStreamsUnsupported tells if opening a change stream failed because the server can't have them, e.g. a standalone mongod.
+func changeStreamsUnsupported(err error) bool {
+	if cmdErr, ok := err.(mongo.CommandError); ok && (cmdErr.Code == 40573 || cmdErr.Code == 40324) {
+		return true
+	}
+	return strings.Contains(err.Error(), "only supported on replica sets")
+}
+
+//OnUserChange sets the handler given the usernames of users changed in the DB, or an empty one when any may have changed. It returns false when mongo_watch_changes isn't set, as nothing will be watched.
+func (o Mongo) OnUserChange(handler func(username string)) bool {
+	if o.watcher == nil {
+		return false
+	}
+	o.watcher.handler.Store(handler)
+	return true
+}
@@ -1,12 +1,22 @@
 package backends
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -36,12 +46,101 @@ type Mysql struct {
 	Protocol             string
 	SocketPath           string
 	AllowNativePasswords bool
+	Charset              string
+	Collation            string
+	ConnectTries         int
+	ConnectRetry         time.Duration
+	ConnectDegraded      bool
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	QueryTimeout    time.Duration
+
+	CallResult string
+
+	NodeDownTime time.Duration
+
+	VaultAddr  string
+	VaultMount string
+	VaultRole  string
+
+	tlsConfigName string
+	hosts         []string
+	nodes         *mysqlNodes
+	reconnect     *mysqlReconnect
+	vault         *mysqlVault
+	Hasher        common.Hasher //Verifies password hashes, taking PBKDF2 salts in its encoding.
+}
+
+//mysqlNode is a MySQL host checks may be run against, keeping track of whether it's down.
+type mysqlNode struct {
+	addr      string
+	db        *sqlx.DB
+	downUntil int64
+}
+
+//mysqlNodes holds the hosts checks fail over across: they're tried in the given order, so the first one, the primary, answers whenever it's up.
+//A host failing at the connection level is marked down for downFor, and only tried again before that if no other host could answer.
+type mysqlNodes struct {
+	nodes   []*mysqlNode
+	downFor time.Duration
+	now     func() time.Time
+}
+
+//mysqlMaxReconnectBackoff bounds the wait between background reconnection attempts.
+const mysqlMaxReconnectBackoff = time.Minute
+
+//mysqlReconnect keeps track of a backend started degraded, i.e. while its DB was down, which keeps trying to reach it in the background.
+type mysqlReconnect struct {
+	degraded int32
+	stop     chan struct{}
+	done     chan struct{}
+	halt     sync.Once
+}
+
+//mysqlRetireDelay is how long DBs replaced by ones connecting with new credentials are kept open at least, so checks that got them just before they were replaced may still run their query on them.
+const mysqlRetireDelay = 10 * time.Second
+
+//mysqlConns are the DBs checks run against, all connecting with the same credentials.
+type mysqlConns struct {
+	db    *sqlx.DB
+	nodes *mysqlNodes
+}
+
+//mysqlVault keeps the credentials the backend connects with coming from Vault, holding the DBs connecting with the current ones.
+type mysqlVault struct {
+	conns   atomic.Value
+	renewer *vaultRenewer
+}
+
+//mysqlTLSConfigs counts the TLS configs registered with the driver, so every backend gets its own name.
+var mysqlTLSConfigs uint32
+
+//MysqlOptions are the auth options the MySQL backend takes.
+var MysqlOptions = Options{
+	Keys: withKeys([]string{
+		"mysql_aclquery", "mysql_allow_native_passwords", "mysql_call_result", "mysql_charset",
+		"mysql_collation", "mysql_conn_max_lifetime_seconds", "mysql_connect_degraded",
+		"mysql_connect_retry_ms", "mysql_connect_tries", "mysql_dbname", "mysql_host", "mysql_max_idle_conns",
+		"mysql_max_open_conns", "mysql_node_down_seconds", "mysql_password", "mysql_port", "mysql_protocol",
+		"mysql_query_timeout_ms", "mysql_query_timeout_seconds", "mysql_socket", "mysql_ssl_ca",
+		"mysql_ssl_cert", "mysql_ssl_key", "mysql_ssl_mode", "mysql_sslcert", "mysql_sslkey", "mysql_sslmode",
+		"mysql_sslrootcert", "mysql_superquery", "mysql_user", "mysql_userquery", "mysql_vault_addr",
+		"mysql_vault_approle_mount", "mysql_vault_approle_role_id", "mysql_vault_approle_secret",
+		"mysql_vault_mount", "mysql_vault_role", "mysql_vault_ssl_ca", "mysql_vault_token",
+	}, common.HasherOptions, common.PrefixedHasherOptions("mysql")),
 }
 
 func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := MysqlOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return Mysql{}, errors.Errorf("MySql backend error: %s.\n", err)
+	}
+
 	//Set defaults for Mysql
 
 	mysqlOk := true
@@ -50,10 +149,24 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 	var mysql = Mysql{
 		Host:           "localhost",
 		Port:           "3306",
-		SSLMode:        "false",
+		SSLMode:        "disable",
 		SuperuserQuery: "",
 		AclQuery:       "",
 		Protocol:       "tcp",
+		Charset:        "utf8mb4",
+		Collation:      "utf8mb4_unicode_ci",
+		ConnectRetry:   2 * time.Second,
+
+		MaxOpenConns:    10,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 30 * time.Minute,
+		QueryTimeout:    5 * time.Second,
+
+		CallResult: "bool",
+
+		NodeDownTime: 10 * time.Second,
+
+		VaultMount: "database",
 	}
 
 	if protocol, ok := authOpts["mysql_protocol"]; ok {
@@ -72,6 +185,14 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 		mysql.Port = port
 	}
 
+	hasher, err := common.NewHasher(authOpts, "mysql")
+	if err != nil {
+		return mysql, errors.Errorf("MySql backend error: %s.\n", err)
+	}
+	mysql.Hasher = hasher
+
+	mysql.NodeDownTime = common.DurationOption(authOpts, "mysql_node_down_seconds", time.Second, time.Second, mysql.NodeDownTime)
+
 	if dbName, ok := authOpts["mysql_dbname"]; ok {
 		mysql.DBName = dbName
 	} else {
@@ -79,74 +200,184 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 		missingOptions += " mysql_dbname"
 	}
 
-	if user, ok := authOpts["mysql_user"]; ok {
-		mysql.User = user
-	} else {
-		mysqlOk = false
-		missingOptions += " mysql_user"
+	if vaultAddr, ok := authOpts["mysql_vault_addr"]; ok {
+		mysql.VaultAddr = strings.TrimSpace(vaultAddr)
 	}
 
-	if password, ok := authOpts["mysql_password"]; ok {
-		mysql.Password = password
+	//Credentials issued by Vault take the place of the configured ones.
+	if mysql.VaultAddr != "" {
+		_, hasUser := authOpts["mysql_user"]
+		_, hasPassword := authOpts["mysql_password"]
+		if hasUser || hasPassword {
+			return mysql, errors.New("MySql backend error: mysql_user and mysql_password can't be given along with mysql_vault_addr.\n")
+		}
 	} else {
-		mysqlOk = false
-		missingOptions += " mysql_password"
+		if user, ok := authOpts["mysql_user"]; ok {
+			mysql.User = user
+		} else {
+			mysqlOk = false
+			missingOptions += " mysql_user"
+		}
+
+		if password, ok := authOpts["mysql_password"]; ok {
+			mysql.Password = password
+		} else {
+			mysqlOk = false
+			missingOptions += " mysql_password"
+		}
 	}
 
+	//Checks whose query is left empty aren't handled by this backend.
 	if userQuery, ok := authOpts["mysql_userquery"]; ok {
-		mysql.UserQuery = userQuery
-	} else {
-		mysqlOk = false
-		missingOptions += " mysql_userquery"
+		mysql.UserQuery = strings.TrimSpace(userQuery)
 	}
 
 	if superuserQuery, ok := authOpts["mysql_superquery"]; ok {
-		mysql.SuperuserQuery = superuserQuery
+		mysql.SuperuserQuery = strings.TrimSpace(superuserQuery)
 	}
 
 	if aclQuery, ok := authOpts["mysql_aclquery"]; ok {
-		mysql.AclQuery = aclQuery
+		mysql.AclQuery = strings.TrimSpace(aclQuery)
+	}
+
+	mysql.AllowNativePasswords = common.BoolOption(authOpts, "mysql_allow_native_passwords", false)
+
+	//The collation is sent on connecting and sets the connection's charset along with it, so a charset given alone gets the server's default collation for it.
+	if charset, ok := authOpts["mysql_charset"]; ok {
+		if charset == "" {
+			return mysql, errors.New("MySql backend error: mysql_charset can't be empty.\n")
+		}
+		mysql.Charset = charset
+		mysql.Collation = ""
 	}
 
-	if allowNativePasswords, ok := authOpts["mysql_allow_native_passwords"]; ok && allowNativePasswords == "true" {
-		mysql.AllowNativePasswords = true
+	if collation, ok := authOpts["mysql_collation"]; ok {
+		mysql.Collation = collation
 	}
 
-	customSSL := false
+	if mysql.Collation != "" && !strings.HasPrefix(mysql.Collation, mysql.Charset+"_") {
+		return mysql, errors.Errorf("MySql backend error: mysql_collation %s isn't a collation of mysql_charset %s.\n", mysql.Collation, mysql.Charset)
+	}
 
-	if sslmode, ok := authOpts["mysql_sslmode"]; ok {
-		if sslmode == "custom" {
-			customSSL = true
+	//TLS is set by mysql_ssl_mode, with mysql_sslmode (true, false, skip-verify or custom) and its file options kept for older configurations.
+	if sslMode, ok := authOpts["mysql_ssl_mode"]; ok {
+		mysql.SSLMode = sslMode
+	} else if sslMode, ok := authOpts["mysql_sslmode"]; ok {
+		legacyModes := map[string]string{
+			"false":       "disable",
+			"skip-verify": "require",
+			"true":        "verify-full",
+			"custom":      "verify-full",
 		}
-		mysql.SSLMode = sslmode
+		mysql.SSLMode, ok = legacyModes[sslMode]
+		if !ok {
+			return mysql, errors.Errorf("MySql backend error: invalid mysql_sslmode %s.\n", sslMode)
+		}
+		log.Warnf("MySql backend: mysql_sslmode is deprecated, use mysql_ssl_mode %s instead.", mysql.SSLMode)
+	}
+
+	switch mysql.SSLMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		return mysql, errors.Errorf("MySql backend error: invalid mysql_ssl_mode %s, it must be disable, require, verify-ca or verify-full.\n", mysql.SSLMode)
+	}
+
+	if sslCA, ok := authOpts["mysql_ssl_ca"]; ok {
+		mysql.SSLRootCert = sslCA
+	} else if sslCA, ok := authOpts["mysql_sslrootcert"]; ok {
+		mysql.SSLRootCert = sslCA
 	}
 
-	if sslCert, ok := authOpts["mysql_sslcert"]; ok {
+	if sslCert, ok := authOpts["mysql_ssl_cert"]; ok {
+		mysql.SSLCert = sslCert
+	} else if sslCert, ok := authOpts["mysql_sslcert"]; ok {
 		mysql.SSLCert = sslCert
-	} else {
-		customSSL = false
 	}
 
-	if sslKey, ok := authOpts["mysql_sslkey"]; ok {
+	if sslKey, ok := authOpts["mysql_ssl_key"]; ok {
+		mysql.SSLKey = sslKey
+	} else if sslKey, ok := authOpts["mysql_sslkey"]; ok {
 		mysql.SSLKey = sslKey
-	} else {
-		customSSL = false
 	}
 
-	if sslCert, ok := authOpts["mysql_sslrootcert"]; ok {
-		mysql.SSLCert = sslCert
+	//A socket takes precedence over host and port, connecting through it even if the protocol isn't set to unix.
+	if mysql.SocketPath != "" {
+		_, hostOk := authOpts["mysql_host"]
+		_, portOk := authOpts["mysql_port"]
+		if hostOk || portOk {
+			log.Warnf("MySql backend: connecting through socket %s, ignoring mysql_host and mysql_port.", mysql.SocketPath)
+		}
+		mysql.Protocol = "unix"
+		if err := checkMysqlSocket(mysql.SocketPath); err != nil {
+			return mysql, err
+		}
+	} else if mysql.Protocol == "unix" {
+		mysqlOk = false
+		missingOptions += " mysql_socket"
 	} else {
-		customSSL = false
+		//Several hosts may be given, with the first one being the primary. Hosts without a port use mysql_port.
+		hosts, err := parseMysqlHosts(mysql.Host, mysql.Port)
+		if err != nil {
+			return mysql, errors.Errorf("MySql backend error: invalid mysql_host: %s.\n", err)
+		}
+		mysql.hosts = hosts
+		mysql.Host, mysql.Port, _ = net.SplitHostPort(hosts[0])
 	}
 
-	//If the protocol is a unix socket, we need to set the address as the socket path. If it's tcp, then set the address using host and port.
-	addr := fmt.Sprintf("%s:%s", mysql.Host, mysql.Port)
-	if mysql.Protocol == "unix" {
-		if mysql.SocketPath != "" {
-			addr = mysql.SocketPath
-		} else {
-			mysqlOk = false
-			missingOptions += " mysql_socket"
+	mysql.ConnectTries = common.IntOption(authOpts, "mysql_connect_tries", 0, math.MaxInt32, mysql.ConnectTries)
+
+	mysql.ConnectRetry = common.DurationOption(authOpts, "mysql_connect_retry_ms", time.Millisecond, time.Millisecond, mysql.ConnectRetry)
+
+	if common.BoolOption(authOpts, "mysql_connect_degraded", false) {
+		mysql.ConnectDegraded = true
+		//Retrying forever would never get to start degraded, so try once unless told otherwise.
+		if _, ok := authOpts["mysql_connect_tries"]; !ok {
+			mysql.ConnectTries = 1
+		}
+		if mysql.ConnectTries == 0 {
+			return mysql, errors.New("MySql backend error: mysql_connect_degraded needs mysql_connect_tries to be greater than 0.\n")
+		}
+	}
+
+	mysql.MaxOpenConns = common.IntOption(authOpts, "mysql_max_open_conns", 0, math.MaxInt32, mysql.MaxOpenConns)
+
+	mysql.MaxIdleConns = common.IntOption(authOpts, "mysql_max_idle_conns", 0, math.MaxInt32, mysql.MaxIdleConns)
+
+	//Idle conns beyond the open ones would never be used.
+	if mysql.MaxOpenConns > 0 && mysql.MaxIdleConns > mysql.MaxOpenConns {
+		mysql.MaxIdleConns = mysql.MaxOpenConns
+	}
+
+	mysql.ConnMaxLifetime = common.DurationOption(authOpts, "mysql_conn_max_lifetime_seconds", time.Second, 0, mysql.ConnMaxLifetime)
+
+	mysql.QueryTimeout = common.DurationOption(authOpts, "mysql_query_timeout_seconds", time.Second, time.Second, mysql.QueryTimeout)
+
+	if _, ok := authOpts["mysql_query_timeout_ms"]; ok {
+		if _, ok := authOpts["mysql_query_timeout_seconds"]; ok {
+			return mysql, errors.New("MySql backend error: mysql_query_timeout_ms and mysql_query_timeout_seconds can't be both set.\n")
+		}
+		mysql.QueryTimeout = common.DurationOption(authOpts, "mysql_query_timeout_ms", time.Millisecond, time.Millisecond, mysql.QueryTimeout)
+	}
+
+	if callResult, ok := authOpts["mysql_call_result"]; ok {
+		if callResult != "bool" && callResult != "count" {
+			return mysql, errors.Errorf("MySql backend error: invalid mysql_call_result %s, it must be bool or count.\n", callResult)
+		}
+		mysql.CallResult = callResult
+	}
+
+	//Stored procedures decide on their own, so they're given everything the check knows.
+	for _, call := range []struct {
+		opt   string
+		query string
+		args  int
+	}{
+		{"mysql_userquery", mysql.UserQuery, 2},
+		{"mysql_superquery", mysql.SuperuserQuery, 1},
+		{"mysql_aclquery", mysql.AclQuery, 4},
+	} {
+		if isMysqlCall(call.query) && strings.Count(call.query, "?") != call.args {
+			return mysql, errors.Errorf("MySql backend error: %s calls a procedure, so it must take %d parameters.\n", call.opt, call.args)
 		}
 	}
 
@@ -155,71 +386,684 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 		return mysql, errors.Errorf("MySql backend error: missing options%s.\n", missingOptions)
 	}
 
-	var msConfig = mq.Config{
-		User:                 mysql.User,
-		Passwd:               mysql.Password,
-		Net:                  mysql.Protocol,
-		Addr:                 addr,
-		DBName:               mysql.DBName,
-		TLSConfig:            mysql.SSLMode,
-		AllowNativePasswords: mysql.AllowNativePasswords,
-	}
+	logHandledChecks("MySql", mysql.UserQuery, mysql.SuperuserQuery, mysql.AclQuery)
 
-	if customSSL {
+	var vault *vaultClient
+	var lease vaultLease
+	if mysql.VaultAddr != "" {
+		if vaultMount, ok := authOpts["mysql_vault_mount"]; ok {
+			mysql.VaultMount = vaultMount
+		}
 
-		rootCertPool := x509.NewCertPool()
-		pem, err := ioutil.ReadFile(mysql.SSLRootCert)
-		if err != nil {
-			return mysql, errors.Errorf("Mysql read root CA error: %s\n", err)
+		if vaultRole, ok := authOpts["mysql_vault_role"]; ok {
+			mysql.VaultRole = vaultRole
+		}
+		if mysql.VaultRole == "" {
+			return mysql, errors.New("MySql backend error: missing options: mysql_vault_role.\n")
 		}
-		if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-			return mysql, errors.Errorf("Mysql failed to append root CA pem error: %s\n", err)
+
+		approleMount := "approle"
+		if mount, ok := authOpts["mysql_vault_approle_mount"]; ok {
+			approleMount = mount
 		}
-		clientCert := make([]tls.Certificate, 0, 1)
-		certs, err := tls.LoadX509KeyPair(mysql.SSLCert, mysql.SSLKey)
+
+		vault, err = newVaultClient(mysql.VaultAddr, authOpts["mysql_vault_ssl_ca"], authOpts["mysql_vault_token"], approleMount, authOpts["mysql_vault_approle_role_id"], authOpts["mysql_vault_approle_secret"])
 		if err != nil {
-			return mysql, errors.Errorf("Mysql load key and cert error: %s\n", err)
+			return mysql, errors.Errorf("MySql backend error: %s.\n", err)
 		}
-		clientCert = append(clientCert, certs)
 
-		mq.RegisterTLSConfig("custom", &tls.Config{
-			RootCAs:      rootCertPool,
-			Certificates: clientCert,
-		})
+		//Without credentials there's nothing to connect with, so Vault must be reachable on startup.
+		lease, err = vault.databaseCredentials(mysql.VaultMount, mysql.VaultRole)
+		if err != nil {
+			return mysql, errors.Errorf("MySql backend error: %s.\n", err)
+		}
+		mysql.User = lease.username
+		mysql.Password = lease.password
+		log.Infof("MySql backend: got Vault credentials for role %s, connecting as %s.", mysql.VaultRole, lease.username)
+	}
+
+	//Certificates are loaded now so that wrong files fail right away instead of on every connection.
+	tlsConfig, err := mysql.tlsConfig()
+	if err != nil {
+		return mysql, err
+	}
+	if tlsConfig != nil {
+		mysql.tlsConfigName = fmt.Sprintf("mosquitto-go-auth-%d", atomic.AddUint32(&mysqlTLSConfigs, 1))
+		if err := mq.RegisterTLSConfig(mysql.tlsConfigName, tlsConfig); err != nil {
+			return mysql, errors.Errorf("MySql backend error: couldn't register TLS config: %s\n", err)
+		}
+	}
+
+	mysql, err = connectMysql(mysql, "mysql")
+	if err != nil {
+		if mysql.tlsConfigName != "" {
+			mq.DeregisterTLSConfig(mysql.tlsConfigName)
+		}
+		return mysql, err
 	}
 
+	if vault != nil {
+		mysql.vault = &mysqlVault{}
+		mysql.vault.conns.Store(mysqlConns{db: mysql.DB, nodes: mysql.nodes})
+		mysql.vault.renewer = newVaultRenewer("MySql", vault, mysql.VaultMount, mysql.VaultRole, lease, mysql.rotateCredentials)
+	}
+
+	return mysql, nil
+
+}
+
+//connectMysql connects the backend to the DB following its connect policy. When every try failed and it may start degraded, it's returned with checks denied until a background reconnection reaches the DB.
+func connectMysql(mysql Mysql, engine string) (Mysql, error) {
 	var dbErr error
-	mysql.DB, dbErr = common.OpenDatabase(msConfig.FormatDSN(), "mysql")
+	if len(mysql.hosts) > 1 {
+		mysql.nodes, dbErr = mysql.connectHosts(engine)
+		if mysql.nodes != nil {
+			mysql.DB = mysql.nodes.nodes[0].db
+		}
+	} else {
+		mysql.DB, dbErr = common.ConnectDatabase(mysql.dsn(), engine, mysql.ConnectTries, mysql.ConnectRetry)
+	}
 
 	if dbErr != nil {
-		return mysql, errors.Errorf("MySql backend error: couldn't open DB: %s\n", dbErr)
+		if mysql.DB == nil || !mysql.ConnectDegraded {
+			if mysql.DB != nil {
+				for _, db := range mysql.dbs() {
+					db.Close()
+				}
+			}
+			if mysql.Protocol == "unix" {
+				if _, err := os.Stat(mysql.SocketPath); os.IsNotExist(err) {
+					return mysql, errors.Errorf("MySql backend error: couldn't open DB: socket %s doesn't exist, check mysql_socket and that MySQL is running.\n", mysql.SocketPath)
+				}
+			}
+			return mysql, errors.Errorf("MySql backend error: couldn't open DB: %s\n", dbErr)
+		}
+
+		log.Warnf("MySql backend: couldn't reach DB, starting degraded and denying checks until it's up: %s", dbErr)
+		mysql.setPool()
+		mysql.reconnect = &mysqlReconnect{
+			degraded: 1,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		go mysql.reconnectLoop()
+
+		return mysql, nil
 	}
 
+	mysql.setPool()
+
 	return mysql, nil
+}
+
+//reconnectLoop pings the DB, doubling the wait between attempts from the connect retry up to mysqlMaxReconnectBackoff, until it's reached or the backend is halted.
+func (o Mysql) reconnectLoop() {
+	defer close(o.reconnect.done)
+
+	backoff := o.ConnectRetry
+	for {
+		select {
+		case <-o.reconnect.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		if !o.degraded() {
+			return
+		}
+
+		ctx, cancel := o.queryContext()
+		err := o.ping(ctx)
+		cancel()
+
+		if err == nil {
+			atomic.StoreInt32(&o.reconnect.degraded, 0)
+			log.Infof("MySql backend: reached DB, no longer degraded.")
+			return
+		}
+
+		backoff *= 2
+		if backoff > mysqlMaxReconnectBackoff {
+			backoff = mysqlMaxReconnectBackoff
+		}
+		log.Errorf("MySql backend: DB still unreachable, will retry in %s: %s", backoff, err)
+	}
+}
+
+//ping pings the DB, or every host in order until one answers when there are several.
+func (o Mysql) ping(ctx context.Context) error {
+	return o.query(ctx, func(db *sqlx.DB) error {
+		return db.PingContext(ctx)
+	})
+}
+
+//degraded tells if the backend hasn't reached its DB yet.
+func (o Mysql) degraded() bool {
+	return o.reconnect != nil && atomic.LoadInt32(&o.reconnect.degraded) == 1
+}
+
+//setPool applies the pool limits to the DB of every host the backend holds, which may be new ones checks don't run on yet.
+func (o Mysql) setPool() {
+	for _, db := range (mysqlConns{db: o.DB, nodes: o.nodes}).dbs() {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+		db.SetMaxIdleConns(o.MaxIdleConns)
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+
+	log.Infof("MySql pool: max open conns %d, max idle conns %d, conn max lifetime %s, query timeout %s.", o.MaxOpenConns, o.MaxIdleConns, o.ConnMaxLifetime, o.QueryTimeout)
+}
+
+//connectHosts opens a DB for every host and, following the connect policy, pings them in order until one answers.
+//Hosts that didn't answer are marked down, so checks start on one that did rather than waiting on them. When every try failed, the opened hosts are returned along with the error so that they may still be used once one is up.
+func (o Mysql) connectHosts(engine string) (*mysqlNodes, error) {
+	nodes, err := o.openHosts(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	for try := 1; ; try++ {
+		var err error
+		for i, node := range nodes.nodes {
+			if err = node.db.Ping(); err == nil {
+				for _, down := range nodes.nodes[:i] {
+					nodes.markDown(down, errors.New("unreachable on startup"))
+				}
+				return nodes, nil
+			}
+			log.Errorf("MySql backend: couldn't reach host %s: %s", node.addr, err)
+		}
+		if o.ConnectTries > 0 && try >= o.ConnectTries {
+			return nodes, errors.Wrapf(err, "ping database error on every host after %d tries", try)
+		}
+		log.Errorf("ping database error on every host, will retry in %s", o.ConnectRetry)
+		time.Sleep(o.ConnectRetry)
+	}
+}
+
+//openHosts opens a DB for every host, without connecting to any yet.
+func (o Mysql) openHosts(engine string) (*mysqlNodes, error) {
+	nodes := &mysqlNodes{
+		downFor: o.NodeDownTime,
+		now:     time.Now,
+	}
+
+	for _, addr := range o.hosts {
+		db, err := sqlx.Open(engine, o.addrDSN(addr))
+		if err != nil {
+			nodes.close()
+			return nil, errors.Wrapf(err, "couldn't open DB at %s", addr)
+		}
+		nodes.nodes = append(nodes.nodes, &mysqlNode{addr: addr, db: db})
+	}
+
+	return nodes, nil
+}
+
+//order returns the hosts to try a check on, in the given order with those marked down last.
+func (n *mysqlNodes) order() []*mysqlNode {
+	now := n.now().UnixNano()
+	healthy := make([]*mysqlNode, 0, len(n.nodes))
+	var down []*mysqlNode
+
+	for _, node := range n.nodes {
+		if atomic.LoadInt64(&node.downUntil) > now {
+			down = append(down, node)
+			continue
+		}
+		healthy = append(healthy, node)
+	}
+
+	return append(healthy, down...)
+}
+
+//markDown keeps the host from being tried before others for a while.
+func (n *mysqlNodes) markDown(node *mysqlNode, err error) {
+	atomic.StoreInt64(&node.downUntil, n.now().Add(n.downFor).UnixNano())
+	log.Warnf("MySql backend: host %s is down, trying other hosts for %s: %s", node.addr, n.downFor, err)
+}
+
+//markUp clears a host's down mark once it answered.
+func (n *mysqlNodes) markUp(node *mysqlNode) {
+	if atomic.SwapInt64(&node.downUntil, 0) != 0 {
+		log.Infof("MySql backend: host %s is back up.", node.addr)
+	}
+}
+
+//close closes every host's DB.
+func (n *mysqlNodes) close() {
+	for _, node := range n.nodes {
+		node.db.Close()
+	}
+}
+
+//dbs returns the DBs of every host checks currently run against.
+func (o Mysql) dbs() []*sqlx.DB {
+	return o.current().dbs()
+}
+
+//dbs returns the DBs of every host, or just the one when there's a single host.
+func (c mysqlConns) dbs() []*sqlx.DB {
+	if c.nodes == nil {
+		return []*sqlx.DB{c.db}
+	}
+	dbs := make([]*sqlx.DB, 0, len(c.nodes.nodes))
+	for _, node := range c.nodes.nodes {
+		dbs = append(dbs, node.db)
+	}
+	return dbs
+}
+
+//current returns the DBs to run checks against, which are replaced when Vault issues new credentials.
+func (o Mysql) current() mysqlConns {
+	if o.vault != nil {
+		return o.vault.conns.Load().(mysqlConns)
+	}
+	return mysqlConns{db: o.DB, nodes: o.nodes}
+}
+
+//db returns the primary's DB to run queries against.
+func (o Mysql) db() *sqlx.DB {
+	return o.current().db
+}
+
+//rotateCredentials connects with the credentials of the new lease, and once they're known to work on any host, has checks run on the new DBs. The previous ones are closed when the checks that got them are done.
+func (o Mysql) rotateCredentials(lease vaultLease) error {
+	o.User = lease.username
+	o.Password = lease.password
+
+	var conns mysqlConns
+	if len(o.hosts) > 1 {
+		nodes, err := o.openHosts("mysql")
+		if err != nil {
+			return err
+		}
+		conns = mysqlConns{db: nodes.nodes[0].db, nodes: nodes}
+	} else {
+		db, err := sqlx.Open("mysql", o.dsn())
+		if err != nil {
+			return err
+		}
+		conns = mysqlConns{db: db}
+	}
+
+	ctx, cancel := o.queryContext()
+	err := conns.query(ctx, func(db *sqlx.DB) error {
+		return db.PingContext(ctx)
+	})
+	cancel()
+	if err != nil {
+		for _, db := range conns.dbs() {
+			db.Close()
+		}
+		return err
+	}
+
+	o.DB, o.nodes = conns.db, conns.nodes
+	o.setPool()
+
+	old := o.vault.conns.Load().(mysqlConns)
+	o.vault.conns.Store(conns)
+
+	//The new DBs answered, so a backend started degraded has reached its DB, and stops pinging the replaced ones.
+	if o.degraded() {
+		atomic.StoreInt32(&o.reconnect.degraded, 0)
+		log.Infof("MySql backend: reached DB, no longer degraded.")
+	}
+
+	retireDelay := mysqlRetireDelay
+	if o.QueryTimeout > retireDelay {
+		retireDelay = o.QueryTimeout
+	}
+	time.AfterFunc(retireDelay, func() {
+		for _, db := range old.dbs() {
+			if err := db.Close(); err != nil {
+				log.Errorf("Mysql cleanup error: %s", err)
+			}
+		}
+	})
+
+	return nil
+}
+
+//parseMysqlHosts parses a comma separated list of hosts, each one optionally with its port, e.g. db1,db2:3307,[::1]:3308, into host:port addresses.
+func parseMysqlHosts(list, defaultPort string) ([]string, error) {
+	var addrs []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, errors.Errorf("empty host in %s", list)
+		}
+		host, port := entry, defaultPort
+		//Bare IPv6 addresses have several colons and no port.
+		if strings.HasPrefix(entry, "[") || strings.Count(entry, ":") == 1 {
+			var err error
+			if host, port, err = net.SplitHostPort(entry); err != nil {
+				return nil, err
+			}
+			if _, err := strconv.Atoi(port); err != nil {
+				return nil, errors.Errorf("invalid port %s for host %s", port, host)
+			}
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs, nil
+}
+
+//mysqlConnectionError tells if a query failed because of its connection to the host, rather than the query itself.
+func mysqlConnectionError(err error) bool {
+	if err == driver.ErrBadConn || err == mq.ErrInvalidConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if myErr, ok := err.(*mq.MySQLError); ok {
+		//1040 is too many connections, 1053 the server shutting down and 1129 the host being blocked after too many connection errors.
+		switch myErr.Number {
+		case 1040, 1053, 1129:
+			return true
+		}
+	}
+
+	return false
+}
+
+//query runs a check's query on the current DBs.
+func (o Mysql) query(ctx context.Context, run func(db *sqlx.DB) error) error {
+	return o.current().query(ctx, run)
+}
+
+//query runs a check's query, moving on to the next host when there are several and one fails at the connection level.
+func (c mysqlConns) query(ctx context.Context, run func(db *sqlx.DB) error) error {
+	if c.nodes == nil {
+		return retryInvalidConn(c.db, run)
+	}
+
+	var err error
+	for _, node := range c.nodes.order() {
+		err = retryInvalidConn(node.db, run)
+		if err == nil || !mysqlConnectionError(err) {
+			c.nodes.markUp(node)
+			return err
+		}
+		c.nodes.markDown(node, err)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+//retryInvalidConn runs a check's query on the DB, running it again once if it failed because its connection had been closed by the server while idle, e.g. by a proxy.
+//The driver then tells the connection is invalid rather than bad, which database/sql doesn't retry, and the next try gets another connection.
+func retryInvalidConn(db *sqlx.DB, run func(db *sqlx.DB) error) error {
+	err := run(db)
+	if err == mq.ErrInvalidConn {
+		log.Debugf("MySql backend: connection was closed by the server, retrying on another one.")
+		err = run(db)
+	}
+	return err
+}
+
+//dsn builds the DSN for the primary host, or the socket when the protocol is unix.
+func (o Mysql) dsn() string {
+	return o.addrDSN(net.JoinHostPort(o.Host, o.Port))
+}
+
+//addrDSN builds the DSN for the driver, connecting through the socket when the protocol is unix or to the given host:port address otherwise, and referencing the registered TLS config if any.
+//Parameters are sent in the connection's charset, utf8mb4 by default, so usernames with 4 byte characters such as emoji are compared as given rather than failing.
+//Dialing is bounded by the query timeout too, so that an unreachable host is found down instead of holding checks until the system gives up on it.
+func (o Mysql) addrDSN(addr string) string {
+	if o.Protocol == "unix" {
+		addr = o.SocketPath
+	}
+
+	config := mq.Config{
+		User:                 o.User,
+		Passwd:               o.Password,
+		Net:                  o.Protocol,
+		Addr:                 addr,
+		DBName:               o.DBName,
+		TLSConfig:            o.tlsConfigName,
+		AllowNativePasswords: o.AllowNativePasswords,
+		Timeout:              o.QueryTimeout,
+		Collation:            o.Collation,
+	}
+
+	//Without a collation, the charset is set once connected instead.
+	if o.Collation == "" && o.Charset != "" {
+		config.Params = map[string]string{"charset": o.Charset}
+	}
+
+	return config.FormatDSN()
+}
+
+//checkMysqlSocket checks that the socket path, if it exists yet, is a socket. A missing one is left to connection tries, as MySQL may still be starting.
+func checkMysqlSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		log.Warnf("MySql backend: socket %s doesn't exist yet, is MySQL running?", path)
+		return nil
+	}
+	if err != nil {
+		return errors.Errorf("MySql backend error: couldn't access mysql_socket %s: %s\n", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("MySql backend error: mysql_socket %s isn't a socket.\n", path)
+	}
+	return nil
+}
+
+//tlsConfig returns the TLS config for the ssl mode with the given CA and client certificate loaded, or nil when TLS is disabled.
+//As with Postgres, require doesn't verify the server's certificate, verify-ca checks it's signed by the CA and verify-full also checks the host name.
+func (o Mysql) tlsConfig() (*tls.Config, error) {
+	if o.SSLMode == "disable" {
+		return nil, nil
+	}
+
+	if (o.SSLCert == "") != (o.SSLKey == "") {
+		return nil, errors.New("MySql backend error: mysql_ssl_cert and mysql_ssl_key must be given together.\n")
+	}
+
+	config := &tls.Config{}
+
+	if o.SSLRootCert != "" {
+		pem, err := ioutil.ReadFile(o.SSLRootCert)
+		if err != nil {
+			return nil, errors.Errorf("MySql backend error: couldn't read mysql_ssl_ca: %s\n", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("MySql backend error: no certificates found in mysql_ssl_ca %s.\n", o.SSLRootCert)
+		}
+	}
 
+	if o.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.SSLCert, o.SSLKey)
+		if err != nil {
+			return nil, errors.Errorf("MySql backend error: couldn't load mysql_ssl_cert and mysql_ssl_key: %s\n", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch o.SSLMode {
+	case "require":
+		config.InsecureSkipVerify = true
+	case "verify-ca":
+		//Go can't verify the chain without the host name, so it's skipped and done by hand.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyCertificateChain(config.RootCAs)
+	}
+
+	return config, nil
+}
+
+//verifyCertificateChain returns a function checking the peer's certificate is signed by the given CAs, or the system ones if nil, regardless of its host name.
+func verifyCertificateChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate given by the server")
+		}
+
+		intermediates := x509.NewCertPool()
+		var leaf *x509.Certificate
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				leaf = cert
+				continue
+			}
+			intermediates.AddCert(cert)
+		}
+
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}
+
+//queryContext bounds a check's query, including any wait for a free connection when the pool is exhausted, by the query timeout.
+func (o Mysql) queryContext() (context.Context, context.CancelFunc) {
+	if o.QueryTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), o.QueryTimeout)
+}
+
+//queryFailed logs a check's query error and returns the cache hint for its denial: a query that timed out must not have its denial cached, as the DB could have granted it.
+//The driver closes a connection whose query was cancelled, and the pool drops it instead of handing it to the next check.
+func (o Mysql) queryFailed(ctx context.Context, check string, start time.Time, err error) time.Duration {
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Errorf("MySql %s timed out after %s (timeout %s): %s", check, time.Since(start), o.QueryTimeout, err)
+		return SkipCache
+	}
+	log.Debugf("MySql %s error: %s\n", check, err)
+	return NoTTL
+}
+
+//isMysqlCall tells if the query calls a stored procedure.
+func isMysqlCall(query string) bool {
+	fields := strings.Fields(query)
+	return len(fields) > 0 && strings.EqualFold(fields[0], "call")
+}
+
+//call runs a stored procedure for a check and tells if it granted it: in bool mode, the first column of its first row must be true or a non zero number, and in count mode, it must have returned any rows.
+//Procedures return a status result after their rows, and the rest of the results are read when closing so the connection may be reused.
+func (o Mysql) call(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	granted := false
+
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		granted = false
+
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		columns, err := rows.Columns()
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		for rows.Next() {
+			count++
+			if o.CallResult == "count" || count > 1 {
+				continue
+			}
+			values := make([]sql.NullString, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			granted = len(values) > 0 && mysqlTruthy(values[0])
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if o.CallResult == "count" {
+			granted = count > 0
+		}
+
+		return rows.Close()
+	})
+
+	return granted, err
+}
+
+//mysqlTruthy tells if a procedure's result value is true: a non zero number, or true as a string.
+func mysqlTruthy(value sql.NullString) bool {
+	if !value.Valid {
+		return false
+	}
+	v := strings.TrimSpace(value.String)
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		return n != 0
+	}
+	return strings.EqualFold(v, "true")
 }
 
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Mysql) GetUser(username, password string) bool {
+	granted, _ := o.GetUserTTL(username, password)
+	return granted
+}
+
+//GetUserTTL checks the user just as GetUser, and also returns SkipCache when the query timed out so the denial isn't cached, or NoTTL otherwise.
+func (o Mysql) GetUserTTL(username, password string) (bool, time.Duration) {
+
+	//If there's no user query, users aren't handled by this backend.
+	if o.UserQuery == "" {
+		return false, NoTTL
+	}
+
+	if o.degraded() {
+		log.Debugf("MySql get user error: backend degraded, DB not reached yet.\n")
+		return false, SkipCache
+	}
+
+	ctx, cancel := o.queryContext()
+	defer cancel()
+
+	start := time.Now()
+
+	if isMysqlCall(o.UserQuery) {
+		granted, err := o.call(ctx, o.UserQuery, username, password)
+		if err != nil {
+			return false, o.queryFailed(ctx, "get user", start, err)
+		}
+		return granted, NoTTL
+	}
 
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &pwHash, o.UserQuery, username)
+	})
 
 	if err != nil {
-		log.Debugf("MySql get user error: %s\n", err)
-		return false
+		return false, o.queryFailed(ctx, "get user", start, err)
 	}
 
 	if !pwHash.Valid {
-		log.Debugf("MySql get user error: user %s not found.\n", username)
-		return false
+		log.Debugf("MySql get user error: user %s not found.\n", common.RedactUsername(username))
+		return false, NoTTL
 	}
 
-	if common.HashCompare(password, pwHash.String) {
-		return true
+	if o.Hasher.Compare(password, pwHash.String) {
+		return true, NoTTL
 	}
 
-	return false
+	return false, NoTTL
 
 }
 
@@ -231,16 +1075,37 @@ func (o Mysql) GetSuperuser(username string) bool {
 		return false
 	}
 
+	if o.degraded() {
+		log.Debugf("MySql get superuser error: backend degraded, DB not reached yet.\n")
+		return false
+	}
+
+	ctx, cancel := o.queryContext()
+	defer cancel()
+
+	start := time.Now()
+
+	if isMysqlCall(o.SuperuserQuery) {
+		granted, err := o.call(ctx, o.SuperuserQuery, username)
+		if err != nil {
+			o.queryFailed(ctx, "get superuser", start, err)
+			return false
+		}
+		return granted
+	}
+
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &count, o.SuperuserQuery, username)
+	})
 
 	if err != nil {
-		log.Debugf("MySql get superuser error: %s\n", err)
+		o.queryFailed(ctx, "get superuser", start, err)
 		return false
 	}
 
 	if !count.Valid {
-		log.Debugf("MySql get superuser error: user %s not found.\n", username)
+		log.Debugf("MySql get superuser error: user %s not found.\n", common.RedactUsername(username))
 		return false
 	}
 
@@ -254,29 +1119,53 @@ func (o Mysql) GetSuperuser(username string) bool {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) bool {
-	//If there's no acl query, assume all privileges for all users.
+	granted, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return granted
+}
+
+//CheckAclTTL checks the acl just as CheckAcl, and also returns SkipCache when the query timed out so the denial isn't cached, or NoTTL otherwise.
+func (o Mysql) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
+	//If there's no acl query, acls aren't handled by this backend.
 	if o.AclQuery == "" {
-		return true
+		return false, NoTTL
+	}
+
+	if o.degraded() {
+		log.Debugf("MySql check acl error: backend degraded, DB not reached yet.\n")
+		return false, SkipCache
+	}
+
+	ctx, cancel := o.queryContext()
+	defer cancel()
+
+	start := time.Now()
+
+	if isMysqlCall(o.AclQuery) {
+		granted, err := o.call(ctx, o.AclQuery, username, topic, clientid, acc)
+		if err != nil {
+			return false, o.queryFailed(ctx, "check acl", start, err)
+		}
+		return granted, NoTTL
 	}
 
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		acls = nil
+		return db.SelectContext(ctx, &acls, o.AclQuery, username, acc)
+	})
 
 	if err != nil {
-		log.Debugf("MySql check acl error: %s\n", err)
-		return false
+		return false, o.queryFailed(ctx, "check acl", start, err)
 	}
 
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
-			return true
+		if common.AclMatches(acl, topic, username, clientid) {
+			return true, NoTTL
 		}
 	}
 
-	return false
+	return false, NoTTL
 
 }
 
@@ -285,12 +1174,26 @@ func (o Mysql) GetName() string {
 	return "Mysql"
 }
 
-//Halt closes the mysql connection.
+//Halt stops renewing Vault credentials and reconnecting, closes the connections to every host and drops the TLS config.
 func (o Mysql) Halt() {
+	if o.vault != nil {
+		o.vault.renewer.stop()
+	}
+	if o.reconnect != nil {
+		o.reconnect.halt.Do(func() {
+			close(o.reconnect.stop)
+			<-o.reconnect.done
+		})
+	}
 	if o.DB != nil {
-		err := o.DB.Close()
-		if err != nil {
-			log.Errorf("Mysql cleanup error: %s", err)
+		for _, db := range o.dbs() {
+			err := db.Close()
+			if err != nil {
+				log.Errorf("Mysql cleanup error: %s", err)
+			}
 		}
 	}
+	if o.tlsConfigName != "" {
+		mq.DeregisterTLSConfig(o.tlsConfigName)
+	}
 }
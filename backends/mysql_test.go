@@ -1,8 +1,23 @@
 package backends
 
 import (
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	mq "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -29,6 +44,34 @@ func TestMysql(t *testing.T) {
 	authOpts["mysql_superquery"] = "select count(*) from test_user where username = ? and is_admin = true"
 	authOpts["mysql_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND (rw >= ? or rw = 3)"
 
+	Convey("Given wrong connect options NewMysql should warn and use the defaults", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["mysql_connect_tries"] = "-1"
+		opts["mysql_connect_retry_ms"] = "0"
+		mysql, err := NewMysql(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer mysql.Halt()
+		So(mysql.ConnectTries, ShouldEqual, 0)
+		So(mysql.ConnectRetry, ShouldEqual, 2*time.Second)
+	})
+
+	Convey("Given an unreachable DB and limited tries NewMysql should give up", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["mysql_host"] = "127.0.0.1"
+		opts["mysql_port"] = "1"
+		opts["mysql_connect_tries"] = "2"
+		opts["mysql_connect_retry_ms"] = "10"
+		_, err := NewMysql(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "2 tries")
+	})
+
 	Convey("Given valid params NewMysql should return a Mysql backend instance", t, func() {
 		mysql, err := NewMysql(authOpts, log.DebugLevel)
 		So(err, ShouldBeNil)
@@ -74,6 +117,24 @@ func TestMysql(t *testing.T) {
 			So(superuser, ShouldBeTrue)
 		})
 
+		Convey("Given a username with 4 byte UTF-8 characters, it should be found as given", func() {
+			deviceName := "sensor-🐝-1"
+			_, err := mysql.DB.Exec(insertQuery, deviceName, userPassHash, false)
+			So(err, ShouldBeNil)
+
+			So(mysql.GetUser(deviceName, userPass), ShouldBeTrue)
+			So(mysql.GetUser("sensor-?-1", userPass), ShouldBeFalse)
+			So(mysql.GetSuperuser(deviceName), ShouldBeFalse)
+
+			var stored string
+			So(mysql.DB.Get(&stored, "SELECT username FROM test_user WHERE username = ?", deviceName), ShouldBeNil)
+			So(stored, ShouldEqual, deviceName)
+
+			var collation string
+			So(mysql.DB.Get(&collation, "SELECT @@collation_connection"), ShouldBeNil)
+			So(collation, ShouldEqual, "utf8mb4_unicode_ci")
+		})
+
 		//Now create some acls and test topics
 
 		strictAcl := "test/topic/1"
@@ -163,6 +224,80 @@ func TestMysql(t *testing.T) {
 			So(tt1, ShouldBeTrue)
 		})
 
+		Convey("Given an unreachable primary, checks should fail over to the next host", func() {
+			opts := map[string]string{}
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts["mysql_host"] = "127.0.0.1:1,localhost"
+			opts["mysql_connect_tries"] = "1"
+
+			failover, err := NewMysql(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer failover.Halt()
+
+			So(failover.GetUser(username, userPass), ShouldBeTrue)
+			So(failover.CheckAcl(username, strictAcl, clientID, MOSQ_ACL_READ), ShouldBeTrue)
+			So(atomic.LoadInt64(&failover.nodes.nodes[0].downUntil), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("Given checks calling stored procedures, their results should decide them", func() {
+			mysql.DB.MustExec("DROP PROCEDURE IF EXISTS go_auth_check_user")
+			mysql.DB.MustExec("DROP PROCEDURE IF EXISTS go_auth_check_acl")
+			mysql.DB.MustExec("DROP PROCEDURE IF EXISTS go_auth_check_fail")
+			mysql.DB.MustExec(`CREATE PROCEDURE go_auth_check_user(IN u VARCHAR(100), IN p VARCHAR(100))
+				BEGIN
+					SELECT COUNT(*) FROM test_user WHERE username = u AND p = 'testpw';
+				END`)
+			mysql.DB.MustExec(`CREATE PROCEDURE go_auth_check_acl(IN u VARCHAR(100), IN t VARCHAR(200), IN c VARCHAR(100), IN a INT)
+				BEGIN
+					SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = u AND test_acl.test_user_id = test_user.id AND test_acl.topic = t AND rw >= a;
+				END`)
+			mysql.DB.MustExec(`CREATE PROCEDURE go_auth_check_fail(IN u VARCHAR(100))
+				BEGIN
+					SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'not allowed to check';
+				END`)
+
+			calls := mysql
+			calls.UserQuery = "CALL go_auth_check_user(?, ?)"
+			calls.SuperuserQuery = "CALL go_auth_check_fail(?)"
+
+			//A single connection shows results are drained, as otherwise the next check would fail on it.
+			mysql.DB.SetMaxOpenConns(1)
+
+			So(calls.GetUser(username, userPass), ShouldBeTrue)
+			So(calls.GetUser(username, "wrong_password"), ShouldBeFalse)
+			So(calls.GetUser("unknown", userPass), ShouldBeFalse)
+			So(calls.GetSuperuser(username), ShouldBeFalse)
+			So(mysql.GetSuperuser(username), ShouldBeTrue)
+
+			calls.AclQuery = "CALL go_auth_check_acl(?, ?, ?, ?)"
+			calls.CallResult = "count"
+			So(calls.CheckAcl(username, strictAcl, clientID, 1), ShouldBeTrue)
+			So(calls.CheckAcl(username, "other/topic", clientID, 1), ShouldBeFalse)
+			So(calls.GetUser(username, userPass), ShouldBeTrue)
+
+			mysql.DB.MustExec("DROP PROCEDURE go_auth_check_user")
+			mysql.DB.MustExec("DROP PROCEDURE go_auth_check_acl")
+			mysql.DB.MustExec("DROP PROCEDURE go_auth_check_fail")
+		})
+
+		Convey("Given a user query slower than the query timeout, it should be cancelled and denied without caching", func() {
+			slow := mysql
+			slow.UserQuery = "SELECT password_hash FROM test_user WHERE username = ? AND SLEEP(2) = 0 limit 1"
+			slow.QueryTimeout = 200 * time.Millisecond
+
+			start := time.Now()
+			granted, ttl := slow.GetUserTTL(username, userPass)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+
+			//The cancelled query's connection shouldn't be handed to the next check.
+			So(mysql.GetUser(username, userPass), ShouldBeTrue)
+			So(mysql.DB.Stats().InUse, ShouldEqual, 0)
+		})
+
 		//Empty db
 		mysql.DB.MustExec("delete from test_user where 1 = 1")
 		mysql.DB.MustExec("delete from test_acl where 1 = 1")
@@ -172,3 +307,966 @@ func TestMysql(t *testing.T) {
 	})
 
 }
+
+func TestMysqlQueries(t *testing.T) {
+	checkQueryCombinations(t, "mysql", func(db *sqlx.DB, userQuery, superuserQuery, aclQuery string) sqlBackend {
+		return Mysql{DB: db, UserQuery: userQuery, SuperuserQuery: superuserQuery, AclQuery: aclQuery}
+	})
+}
+
+func TestMysqlTLS(t *testing.T) {
+
+	certs, err := writeTestCerts()
+	defer os.RemoveAll(certs.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	otherCerts, err := writeTestCerts()
+	defer os.RemoveAll(otherCerts.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	authOpts := map[string]string{
+		"mysql_dbname":   "go_auth_test",
+		"mysql_user":     "go_auth_test",
+		"mysql_password": "go_auth_test",
+	}
+
+	withOpts := func(opts map[string]string) map[string]string {
+		merged := map[string]string{}
+		for k, v := range authOpts {
+			merged[k] = v
+		}
+		for k, v := range opts {
+			merged[k] = v
+		}
+		return merged
+	}
+
+	Convey("Given wrong ssl options NewMysql should fail before connecting", t, func() {
+		_, err := NewMysql(withOpts(map[string]string{"mysql_ssl_mode": "prefer"}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_ssl_mode")
+
+		_, err = NewMysql(withOpts(map[string]string{"mysql_sslmode": "maybe"}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_sslmode")
+
+		_, err = NewMysql(withOpts(map[string]string{"mysql_ssl_mode": "verify-full", "mysql_ssl_ca": filepath.Join(certs.Dir, "missing.pem")}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_ssl_ca")
+
+		_, err = NewMysql(withOpts(map[string]string{"mysql_ssl_mode": "verify-full", "mysql_ssl_ca": certs.ClientKey}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "no certificates")
+
+		_, err = NewMysql(withOpts(map[string]string{"mysql_ssl_mode": "require", "mysql_ssl_cert": certs.ClientCert}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "together")
+
+		_, err = NewMysql(withOpts(map[string]string{"mysql_ssl_mode": "require", "mysql_ssl_cert": certs.ClientCert, "mysql_ssl_key": otherCerts.ClientKey}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_ssl_cert and mysql_ssl_key")
+	})
+
+	Convey("Given each ssl mode, the DSN should reference the registered TLS config", t, func() {
+		o := Mysql{User: "user", Password: "pw", DBName: "db", Host: "db.example.com", Port: "3306", Protocol: "tcp", SSLMode: "disable"}
+		So(o.dsn(), ShouldStartWith, "user:pw@tcp(db.example.com:3306)/db?")
+		So(o.dsn(), ShouldNotContainSubstring, "tls=")
+
+		o.tlsConfigName = "mosquitto-go-auth-test"
+		So(o.dsn(), ShouldContainSubstring, "tls=mosquitto-go-auth-test")
+
+		//The driver only takes names that were registered.
+		_, err := mq.ParseDSN(o.dsn())
+		So(err, ShouldBeError)
+
+		So(mq.RegisterTLSConfig(o.tlsConfigName, &tls.Config{}), ShouldBeNil)
+		defer mq.DeregisterTLSConfig(o.tlsConfigName)
+		config, err := mq.ParseDSN(o.dsn())
+		So(err, ShouldBeNil)
+		So(config.TLSConfig, ShouldEqual, "mosquitto-go-auth-test")
+	})
+
+	Convey("Given each ssl mode, the TLS config should verify the server accordingly", t, func() {
+		o := Mysql{SSLMode: "disable", SSLRootCert: certs.CA}
+		config, err := o.tlsConfig()
+		So(err, ShouldBeNil)
+		So(config, ShouldBeNil)
+
+		o.SSLMode = "require"
+		config, err = o.tlsConfig()
+		So(err, ShouldBeNil)
+		So(config.InsecureSkipVerify, ShouldBeTrue)
+		So(config.VerifyPeerCertificate, ShouldBeNil)
+
+		o.SSLMode = "verify-ca"
+		o.SSLCert = certs.ClientCert
+		o.SSLKey = certs.ClientKey
+		config, err = o.tlsConfig()
+		So(err, ShouldBeNil)
+		So(config.RootCAs, ShouldNotBeNil)
+		So(config.Certificates, ShouldHaveLength, 1)
+		So(config.VerifyPeerCertificate, ShouldNotBeNil)
+
+		o.SSLMode = "verify-full"
+		config, err = o.tlsConfig()
+		So(err, ShouldBeNil)
+		So(config.InsecureSkipVerify, ShouldBeFalse)
+		So(config.RootCAs, ShouldNotBeNil)
+	})
+
+	Convey("Given a TLS server, handshakes should follow the ssl mode", t, func() {
+		serverCert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+		So(err, ShouldBeNil)
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		handshake := func(o Mysql, serverName string) error {
+			config, err := o.tlsConfig()
+			if err != nil {
+				return err
+			}
+			config.ServerName = serverName
+			conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+
+		//The server's certificate is for 127.0.0.1 and localhost only.
+		So(handshake(Mysql{SSLMode: "require", SSLRootCert: otherCerts.CA}, "db.example.com"), ShouldBeNil)
+
+		So(handshake(Mysql{SSLMode: "verify-ca", SSLRootCert: certs.CA}, "db.example.com"), ShouldBeNil)
+		So(handshake(Mysql{SSLMode: "verify-ca", SSLRootCert: otherCerts.CA}, "db.example.com"), ShouldBeError)
+
+		So(handshake(Mysql{SSLMode: "verify-full", SSLRootCert: certs.CA}, "localhost"), ShouldBeNil)
+		So(handshake(Mysql{SSLMode: "verify-full", SSLRootCert: certs.CA}, "db.example.com"), ShouldBeError)
+		So(handshake(Mysql{SSLMode: "verify-full", SSLRootCert: otherCerts.CA}, "localhost"), ShouldBeError)
+	})
+
+	Convey("Given legacy ssl options, they should map to the new ones", t, func() {
+		//An unreachable DB makes NewMysql fail after parsing and loading the files.
+		opts := withOpts(map[string]string{
+			"mysql_host":             "127.0.0.1",
+			"mysql_port":             "1",
+			"mysql_connect_tries":    "1",
+			"mysql_sslmode":          "custom",
+			"mysql_sslrootcert":      certs.CA,
+			"mysql_sslcert":          certs.ClientCert,
+			"mysql_sslkey":           certs.ClientKey,
+			"mysql_connect_retry_ms": "10",
+		})
+		_, err := NewMysql(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "couldn't open DB")
+
+		opts["mysql_sslrootcert"] = filepath.Join(certs.Dir, "missing.pem")
+		_, err = NewMysql(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_ssl_ca")
+	})
+
+}
+
+//TestMysqlTLSHandshake connects to a TLS enabled MySQL given by the MYSQL_TLS_HOST, MYSQL_TLS_SSL_CA, MYSQL_TLS_SSL_CERT and MYSQL_TLS_SSL_KEY env vars, if available.
+func TestMysqlTLSHandshake(t *testing.T) {
+	host := os.Getenv("MYSQL_TLS_HOST")
+	if host == "" {
+		t.Skip("MYSQL_TLS_HOST not set, skipping TLS MySQL test")
+	}
+
+	authOpts := map[string]string{
+		"mysql_host":                   host,
+		"mysql_dbname":                 "go_auth_test",
+		"mysql_user":                   "go_auth_test",
+		"mysql_password":               "go_auth_test",
+		"mysql_allow_native_passwords": "true",
+		"mysql_userquery":              "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+		"mysql_ssl_mode":               "verify-full",
+		"mysql_ssl_ca":                 os.Getenv("MYSQL_TLS_SSL_CA"),
+		"mysql_ssl_cert":               os.Getenv("MYSQL_TLS_SSL_CERT"),
+		"mysql_ssl_key":                os.Getenv("MYSQL_TLS_SSL_KEY"),
+		"mysql_connect_tries":          "1",
+	}
+
+	Convey("Given a TLS enabled MySQL and valid certificates, NewMysql should connect over TLS", t, func() {
+		mysql, err := NewMysql(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer mysql.Halt()
+
+		var cipher string
+		var name string
+		err = mysql.DB.QueryRowx("SHOW SESSION STATUS LIKE 'Ssl_cipher'").Scan(&name, &cipher)
+		So(err, ShouldBeNil)
+		So(cipher, ShouldNotBeEmpty)
+	})
+
+}
+
+func TestMysqlSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	authOpts := map[string]string{
+		"mysql_dbname":           "go_auth_test",
+		"mysql_user":             "go_auth_test",
+		"mysql_password":         "go_auth_test",
+		"mysql_connect_tries":    "1",
+		"mysql_connect_retry_ms": "10",
+	}
+
+	withOpts := func(opts map[string]string) map[string]string {
+		merged := map[string]string{}
+		for k, v := range authOpts {
+			merged[k] = v
+		}
+		for k, v := range opts {
+			merged[k] = v
+		}
+		return merged
+	}
+
+	Convey("Given a socket, the DSN should use it instead of host and port", t, func() {
+		o := Mysql{User: "user", Password: "pw", DBName: "db", Host: "db.example.com", Port: "3306", Protocol: "tcp", SocketPath: "/var/run/mysqld/mysqld.sock"}
+		So(o.dsn(), ShouldStartWith, "user:pw@tcp(db.example.com:3306)/db")
+
+		o.Protocol = "unix"
+		So(o.dsn(), ShouldStartWith, "user:pw@unix(/var/run/mysqld/mysqld.sock)/db")
+	})
+
+	Convey("Given the unix protocol without a socket NewMysql should fail", t, func() {
+		_, err := NewMysql(withOpts(map[string]string{"mysql_protocol": "unix"}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_socket")
+	})
+
+	Convey("Given a socket path that isn't a socket NewMysql should fail right away", t, func() {
+		path := filepath.Join(dir, "file.sock")
+		ioutil.WriteFile(path, []byte("not a socket"), 0644)
+		_, err := NewMysql(withOpts(map[string]string{"mysql_socket": path}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "isn't a socket")
+	})
+
+	Convey("Given a missing socket NewMysql should say so once it gives up", t, func() {
+		path := filepath.Join(dir, "missing.sock")
+		_, err := NewMysql(withOpts(map[string]string{"mysql_socket": path}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "socket "+path+" doesn't exist")
+	})
+
+	Convey("Given a socket along with host and port, NewMysql should connect through the socket", t, func() {
+		path := filepath.Join(dir, "mysqld.sock")
+		listener, err := net.Listen("unix", path)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		var accepted int32
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&accepted, 1)
+				conn.Close()
+			}
+		}()
+
+		//The fake server hangs up, so connecting fails, but it must have been through the socket.
+		_, err = NewMysql(withOpts(map[string]string{"mysql_socket": path, "mysql_host": "127.0.0.1", "mysql_port": "1"}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldNotContainSubstring, "doesn't exist")
+		So(atomic.LoadInt32(&accepted), ShouldBeGreaterThan, 0)
+	})
+
+}
+
+//TestMysqlSocketConnection connects to MySQL through the socket given by the MYSQL_SOCKET env var, if available.
+func TestMysqlSocketConnection(t *testing.T) {
+	socket := os.Getenv("MYSQL_SOCKET")
+	if socket == "" {
+		t.Skip("MYSQL_SOCKET not set, skipping MySQL socket test")
+	}
+
+	authOpts := map[string]string{
+		"mysql_socket":                 socket,
+		"mysql_dbname":                 "go_auth_test",
+		"mysql_user":                   "go_auth_test",
+		"mysql_password":               "go_auth_test",
+		"mysql_allow_native_passwords": "true",
+		"mysql_superquery":             "select count(*) from test_user where username = ? and is_admin = true",
+		"mysql_connect_tries":          "1",
+	}
+
+	Convey("Given a MySQL socket, NewMysql should connect and run checks through it", t, func() {
+		mysql, err := NewMysql(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer mysql.Halt()
+
+		So(mysql.DB.Ping(), ShouldBeNil)
+		So(mysql.GetSuperuser("not_a_user"), ShouldBeFalse)
+	})
+
+}
+
+func TestMysqlPool(t *testing.T) {
+
+	authOpts := map[string]string{
+		"mysql_dbname":   "go_auth_test",
+		"mysql_user":     "go_auth_test",
+		"mysql_password": "go_auth_test",
+	}
+
+	Convey("Given wrong pool options NewMysql should warn and use the defaults", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["mysql_max_open_conns"] = "-1"
+		opts["mysql_max_idle_conns"] = "x"
+		opts["mysql_conn_max_lifetime_seconds"] = "-5"
+		mysql, err := NewMysql(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer mysql.Halt()
+		So(mysql.MaxOpenConns, ShouldEqual, 10)
+		So(mysql.MaxIdleConns, ShouldEqual, 5)
+		So(mysql.ConnMaxLifetime, ShouldEqual, 30*time.Minute)
+	})
+
+	Convey("Given pool limits, they should be applied to the DB", t, func() {
+		d := &countingDriver{value: "1"}
+		o := Mysql{
+			DB:              newCountingDB(d),
+			SuperuserQuery:  "select count(*) from test_user where username = ? and is_admin = true",
+			MaxOpenConns:    3,
+			MaxIdleConns:    2,
+			ConnMaxLifetime: time.Minute,
+		}
+		o.setPool()
+		defer o.Halt()
+
+		So(o.DB.Stats().MaxOpenConnections, ShouldEqual, 3)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				o.GetSuperuser("test")
+			}()
+		}
+		wg.Wait()
+
+		So(atomic.LoadInt32(&d.maxOpen), ShouldBeLessThanOrEqualTo, 3)
+		So(o.DB.Stats().Idle, ShouldBeLessThanOrEqualTo, 2)
+	})
+
+	Convey("Given connections closed by the server while idle, checks should be retried on another one", t, func() {
+		d := &countingDriver{value: "1", dropErr: mq.ErrInvalidConn}
+		o := Mysql{
+			DB:             newCountingDB(d),
+			UserQuery:      "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+			SuperuserQuery: "select count(*) from test_user where username = ? and is_admin = true",
+			AclQuery:       "SELECT topic FROM test_acl WHERE username = ? AND rw >= ?",
+			MaxOpenConns:   2,
+			MaxIdleConns:   2,
+		}
+		o.setPool()
+		defer o.Halt()
+
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+
+		d.dropConns()
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+
+		d.value = "test/#"
+		d.dropConns()
+		So(o.CheckAcl("test", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+
+		d.value = "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+		d.dropConns()
+		So(o.GetUser("test", "testpw"), ShouldBeTrue)
+
+		Convey("Other errors shouldn't be retried", func() {
+			d.dropErr = errors.New("some query error")
+			d.dropConns()
+			before := atomic.LoadInt32(&d.queries)
+			So(o.GetSuperuser("test"), ShouldBeFalse)
+			So(atomic.LoadInt32(&d.queries)-before, ShouldEqual, 1)
+		})
+	})
+
+}
+
+func TestMysqlQueryTimeout(t *testing.T) {
+
+	Convey("Given both query timeout options NewMysql should fail", t, func() {
+		authOpts := map[string]string{
+			"mysql_dbname":                "go_auth_test",
+			"mysql_user":                  "go_auth_test",
+			"mysql_password":              "go_auth_test",
+			"mysql_query_timeout_seconds": "1",
+			"mysql_query_timeout_ms":      "500",
+		}
+		_, err := NewMysql(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_query_timeout_ms")
+
+		delete(authOpts, "mysql_query_timeout_seconds")
+		authOpts["mysql_query_timeout_ms"] = "0"
+		_, err = NewMysql(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_query_timeout_ms")
+	})
+
+	Convey("Given queries slower than the query timeout", t, func() {
+		d := &countingDriver{delay: time.Second, value: "topic/#"}
+		o := Mysql{
+			DB:           newCountingDB(d),
+			UserQuery:    "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+			AclQuery:     "SELECT topic FROM test_acl WHERE username = ? AND rw >= ?",
+			MaxOpenConns: 1,
+			QueryTimeout: 50 * time.Millisecond,
+		}
+		o.setPool()
+		defer o.Halt()
+
+		Convey("User checks should be denied once it's exceeded and not be cached", func() {
+			start := time.Now()
+			granted, ttl := o.GetUserTTL("test", "test")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+		})
+
+		Convey("Acl checks should be denied once it's exceeded and not be cached", func() {
+			start := time.Now()
+			granted, ttl := o.CheckAclTTL("test", "topic/1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+		})
+
+		Convey("Superuser checks should be denied once it's exceeded", func() {
+			o.SuperuserQuery = "select count(*) from test_user where username = ? and is_admin = true"
+			So(o.GetSuperuser("test"), ShouldBeFalse)
+		})
+
+		Convey("Once cancelled, the only connection should be free for the next checks", func() {
+			granted, _ := o.CheckAclTTL("test", "topic/1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(o.DB.Stats().InUse, ShouldEqual, 0)
+
+			d.delay = 0
+			granted, ttl := o.CheckAclTTL("test", "topic/1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, NoTTL)
+
+			granted, ttl = o.CheckAclTTL("test", "other/1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, NoTTL)
+		})
+	})
+
+}
+
+func TestMysqlCalls(t *testing.T) {
+
+	authOpts := map[string]string{
+		"mysql_dbname":   "go_auth_test",
+		"mysql_user":     "go_auth_test",
+		"mysql_password": "go_auth_test",
+	}
+
+	Convey("Given wrong call options NewMysql should fail before connecting", t, func() {
+		for opt, value := range map[string]string{
+			"mysql_call_result": "first",
+			"mysql_userquery":   "CALL check_user(?)",
+			"mysql_superquery":  "call check_superuser(?, ?)",
+			"mysql_aclquery":    "  CALL check_acl(?, ?)",
+		} {
+			opts := map[string]string{}
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts[opt] = value
+			_, err := NewMysql(opts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, opt)
+		}
+	})
+
+	Convey("Only queries starting with CALL should be taken as calls", t, func() {
+		So(isMysqlCall("CALL check_user(?, ?)"), ShouldBeTrue)
+		So(isMysqlCall("  call\tcheck_user(?, ?)"), ShouldBeTrue)
+		So(isMysqlCall("SELECT recall FROM test_user WHERE username = ?"), ShouldBeFalse)
+		So(isMysqlCall("CALLING"), ShouldBeFalse)
+		So(isMysqlCall(""), ShouldBeFalse)
+	})
+
+	Convey("Given checks calling procedures", t, func() {
+		d := &countingDriver{value: "1"}
+		o := Mysql{
+			DB:             newCountingDB(d),
+			UserQuery:      "CALL check_user(?, ?)",
+			SuperuserQuery: "CALL check_superuser(?)",
+			AclQuery:       "CALL check_acl(?, ?, ?, ?)",
+			CallResult:     "bool",
+		}
+		defer o.Halt()
+
+		Convey("They should be given everything the check knows", func() {
+			So(o.GetUser("test", "testpw"), ShouldBeTrue)
+			So(d.lastArgs(), ShouldResemble, []interface{}{"test", "testpw"})
+
+			So(o.GetSuperuser("test"), ShouldBeTrue)
+			So(d.lastArgs(), ShouldResemble, []interface{}{"test"})
+
+			So(o.CheckAcl("test", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(d.lastArgs(), ShouldResemble, []interface{}{"test", "test/topic", "client", int64(MOSQ_ACL_WRITE)})
+		})
+
+		Convey("In bool mode, the first column of the first row should decide", func() {
+			for value, granted := range map[string]bool{"1": true, "2": true, "true": true, "TRUE": true, "0": false, "0.0": false, "false": false, "no": false} {
+				d.value = value
+				So(o.GetUser("test", "testpw"), ShouldEqual, granted)
+			}
+
+			d.rows = []string{"0", "1"}
+			So(o.GetSuperuser("test"), ShouldBeFalse)
+
+			d.rows = []string{}
+			So(o.CheckAcl("test", "test/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("In count mode, any row should grant it", func() {
+			o.CallResult = "count"
+
+			d.value = "0"
+			So(o.GetUser("test", "testpw"), ShouldBeTrue)
+
+			d.rows = []string{"a", "b"}
+			So(o.GetSuperuser("test"), ShouldBeTrue)
+
+			d.rows = []string{}
+			So(o.CheckAcl("test", "test/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Procedure errors should deny", func() {
+			d.dropErr = errors.New("Error 1644: not allowed to check")
+			So(o.GetSuperuser("test"), ShouldBeTrue)
+			d.dropConns()
+			So(o.GetSuperuser("test"), ShouldBeFalse)
+		})
+
+		Convey("Procedure errors shouldn't be cached", func() {
+			d.dropErr = errors.New("Error 1644: not allowed to check")
+			So(o.CheckAcl("test", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			d.dropConns()
+			granted, ttl := o.CheckAclTTL("test", "test/topic", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, NoTTL)
+		})
+	})
+
+}
+
+func TestMysqlHosts(t *testing.T) {
+
+	authOpts := map[string]string{
+		"mysql_dbname":   "go_auth_test",
+		"mysql_user":     "go_auth_test",
+		"mysql_password": "go_auth_test",
+	}
+
+	Convey("Given host lists, they should be parsed with their ports", t, func() {
+		addrs, err := parseMysqlHosts("db1, db2:3307,[::1]:3308,::1", "3306")
+		So(err, ShouldBeNil)
+		So(addrs, ShouldResemble, []string{"db1:3306", "db2:3307", "[::1]:3308", "[::1]:3306"})
+
+		for _, list := range []string{"db1,", "db1:port", "[::1"} {
+			_, err := parseMysqlHosts(list, "3306")
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given wrong host options NewMysql should fail before connecting", t, func() {
+		for opt, value := range map[string]string{"mysql_host": "db1,,db2", "mysql_node_down_seconds": "0"} {
+			opts := map[string]string{}
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts[opt] = value
+			_, err := NewMysql(opts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, opt)
+		}
+	})
+
+	Convey("Given several hosts, the DSN should be the primary's and bound dialing by the query timeout", t, func() {
+		o := Mysql{User: "user", Password: "pw", DBName: "db", Host: "db1", Port: "3306", Protocol: "tcp", QueryTimeout: 5 * time.Second}
+		So(o.dsn(), ShouldStartWith, "user:pw@tcp(db1:3306)/db?")
+		So(o.addrDSN("[::1]:3307"), ShouldStartWith, "user:pw@tcp([::1]:3307)/db?")
+		So(o.dsn(), ShouldContainSubstring, "timeout=5s")
+	})
+
+	Convey("Given several hosts on startup", t, func() {
+		primary := &countingDriver{value: "1"}
+		standby := &countingDriver{value: "1"}
+		engine := registerMysqlHostsDriver(mysqlHostsDriver{"primary:3306": primary, "standby:3306": standby})
+
+		o := Mysql{
+			User:           "user",
+			Password:       "pw",
+			DBName:         "db",
+			Protocol:       "tcp",
+			hosts:          []string{"primary:3306", "standby:3306"},
+			SuperuserQuery: "select count(*) from test_user where username = ? and is_admin = true",
+			QueryTimeout:   time.Second,
+			NodeDownTime:   time.Minute,
+			ConnectTries:   2,
+			ConnectRetry:   10 * time.Millisecond,
+		}
+
+		Convey("With the primary down, the backend should start on the standby without retrying the primary on every check", func() {
+			atomic.StoreInt32(&primary.down, 1)
+			nodes, err := o.connectHosts(engine)
+			So(err, ShouldBeNil)
+			o.nodes = nodes
+			o.DB = nodes.nodes[0].db
+			defer o.Halt()
+
+			attempts := atomic.LoadInt32(&primary.attempts)
+			for i := 0; i < 5; i++ {
+				So(o.GetSuperuser("test"), ShouldBeTrue)
+			}
+			So(atomic.LoadInt32(&primary.attempts), ShouldEqual, attempts)
+			So(atomic.LoadInt32(&standby.queries), ShouldEqual, 5)
+		})
+
+		Convey("With every host down, the backend should give up after the given tries", func() {
+			atomic.StoreInt32(&primary.down, 1)
+			atomic.StoreInt32(&standby.down, 1)
+			nodes, err := o.connectHosts(engine)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "2 tries")
+			nodes.close()
+		})
+	})
+
+	Convey("Given a primary and a standby", t, func() {
+		primary := &countingDriver{value: "topic/#"}
+		standby := &countingDriver{value: "topic/#"}
+
+		now := time.Now()
+		nodes := &mysqlNodes{
+			nodes:   []*mysqlNode{{addr: "primary:3306", db: newCountingDB(primary)}, {addr: "standby:3306", db: newCountingDB(standby)}},
+			downFor: 10 * time.Second,
+			now:     func() time.Time { return now },
+		}
+
+		o := Mysql{
+			DB:           nodes.nodes[0].db,
+			UserQuery:    "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+			AclQuery:     "SELECT topic FROM test_acl WHERE username = ? AND rw >= ?",
+			QueryTimeout: time.Second,
+			nodes:        nodes,
+		}
+		defer o.Halt()
+
+		check := func(times int) {
+			for i := 0; i < times; i++ {
+				So(o.CheckAcl("test", "topic/1", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			}
+		}
+
+		Convey("Checks should go to the primary only", func() {
+			check(4)
+			So(atomic.LoadInt32(&primary.queries), ShouldEqual, 4)
+			So(atomic.LoadInt32(&standby.queries), ShouldEqual, 0)
+		})
+
+		Convey("When the primary goes away, checks should go on against the standby and it shouldn't be retried on every one", func() {
+			check(2)
+			atomic.StoreInt32(&primary.down, 1)
+
+			check(1)
+			attempts := atomic.LoadInt32(&primary.attempts)
+
+			check(10)
+			So(atomic.LoadInt32(&primary.attempts), ShouldEqual, attempts)
+			So(atomic.LoadInt32(&standby.queries), ShouldEqual, 11)
+
+			Convey("And once it's back, it should be used again after the down time", func() {
+				atomic.StoreInt32(&primary.down, 0)
+				check(2)
+				So(atomic.LoadInt32(&primary.attempts), ShouldEqual, attempts)
+
+				now = now.Add(11 * time.Second)
+				primaryQueries := atomic.LoadInt32(&primary.queries)
+				check(2)
+				So(atomic.LoadInt32(&primary.queries), ShouldEqual, primaryQueries+2)
+				So(atomic.LoadInt64(&nodes.nodes[0].downUntil), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When every host goes away, checks should be denied", func() {
+			atomic.StoreInt32(&primary.down, 1)
+			atomic.StoreInt32(&standby.down, 1)
+			So(o.CheckAcl("test", "topic/1", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.GetUser("test", "test"), ShouldBeFalse)
+		})
+
+		Convey("Query errors other than connection ones shouldn't fail over", func() {
+			So(mysqlConnectionError(sql.ErrNoRows), ShouldBeFalse)
+			So(mysqlConnectionError(&mq.MySQLError{Number: 1146}), ShouldBeFalse)
+			So(mysqlConnectionError(&mq.MySQLError{Number: 1053}), ShouldBeTrue)
+			So(mysqlConnectionError(mq.ErrInvalidConn), ShouldBeTrue)
+			So(mysqlConnectionError(driver.ErrBadConn), ShouldBeTrue)
+			So(mysqlConnectionError(io.ErrUnexpectedEOF), ShouldBeTrue)
+		})
+	})
+
+}
+
+//mysqlHostsDriver is a fake sql driver handing each connection to the counting driver of the host in its DSN.
+type mysqlHostsDriver map[string]*countingDriver
+
+func (d mysqlHostsDriver) Open(dsn string) (driver.Conn, error) {
+	config, err := mq.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return d[config.Addr].Open(dsn)
+}
+
+//registerMysqlHostsDriver registers a new hosts driver and returns its name.
+func registerMysqlHostsDriver(d mysqlHostsDriver) string {
+	name := fmt.Sprintf("mysqlhosts%d", atomic.AddInt32(&countingDrivers, 1))
+	sql.Register(name, d)
+	return name
+}
+
+func TestMysqlCharset(t *testing.T) {
+
+	authOpts := map[string]string{
+		"mysql_dbname":   "go_auth_test",
+		"mysql_user":     "go_auth_test",
+		"mysql_password": "go_auth_test",
+	}
+
+	Convey("Given wrong charset options NewMysql should fail before connecting", t, func() {
+		for opts, expected := range map[[2]string]string{
+			{"mysql_charset", ""}:                    "mysql_charset",
+			{"mysql_collation", "latin1_swedish_ci"}: "mysql_charset utf8mb4",
+		} {
+			withOpts := map[string]string{}
+			for k, v := range authOpts {
+				withOpts[k] = v
+			}
+			withOpts[opts[0]] = opts[1]
+			_, err := NewMysql(withOpts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, expected)
+		}
+
+		withOpts := map[string]string{"mysql_charset": "latin1", "mysql_collation": "utf8mb4_bin"}
+		for k, v := range authOpts {
+			withOpts[k] = v
+		}
+		_, err := NewMysql(withOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_collation utf8mb4_bin")
+	})
+
+	Convey("Given a collation, it should be sent on connecting", t, func() {
+		o := Mysql{User: "user", Password: "pw", DBName: "db", Host: "db1", Port: "3306", Protocol: "tcp", Charset: "utf8mb4", Collation: "utf8mb4_unicode_ci"}
+		config, err := mq.ParseDSN(o.dsn())
+		So(err, ShouldBeNil)
+		So(config.Collation, ShouldEqual, "utf8mb4_unicode_ci")
+		So(config.Params, ShouldBeEmpty)
+	})
+
+	Convey("Given a charset alone, it should be set once connected", t, func() {
+		o := Mysql{User: "user", Password: "pw", DBName: "db", Host: "db1", Port: "3306", Protocol: "tcp", Charset: "latin1"}
+		config, err := mq.ParseDSN(o.dsn())
+		So(err, ShouldBeNil)
+		So(config.Params, ShouldResemble, map[string]string{"charset": "latin1"})
+	})
+
+}
+
+func TestMysqlConnect(t *testing.T) {
+
+	authOpts := map[string]string{
+		"mysql_dbname":   "go_auth_test",
+		"mysql_user":     "go_auth_test",
+		"mysql_password": "go_auth_test",
+	}
+
+	Convey("Given a degraded start with endless tries NewMysql should fail before connecting", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["mysql_connect_degraded"] = "true"
+		opts["mysql_connect_tries"] = "0"
+		_, err := NewMysql(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "mysql_connect_tries")
+	})
+
+	Convey("Given an unreachable DB and a degraded start, NewMysql should start denying checks", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["mysql_host"] = "127.0.0.1"
+		opts["mysql_port"] = "1"
+		opts["mysql_userquery"] = "SELECT password_hash FROM test_user WHERE username = ? limit 1"
+		opts["mysql_connect_degraded"] = "true"
+		o, err := NewMysql(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer o.Halt()
+		So(o.degraded(), ShouldBeTrue)
+		So(o.GetUser("test", "testpw"), ShouldBeFalse)
+	})
+
+	newBackend := func() Mysql {
+		return Mysql{
+			UserQuery:      "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+			SuperuserQuery: "select count(*) from test_user where username = ? and is_admin = true",
+			AclQuery:       "SELECT topic FROM test_acl WHERE username = ? AND rw >= ?",
+			MaxOpenConns:   2,
+			QueryTimeout:   time.Second,
+			ConnectTries:   3,
+			ConnectRetry:   10 * time.Millisecond,
+		}
+	}
+
+	Convey("Given a DB that's down and no degraded start, connecting should fail after the given tries", t, func() {
+		d := &countingDriver{value: "1", down: 1}
+		start := time.Now()
+		_, err := connectMysql(newBackend(), registerCountingDriver(d))
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "3 tries")
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+	})
+
+	Convey("Given a DB that's up after a few tries, connecting should succeed", t, func() {
+		d := &countingDriver{value: "1", down: 1}
+		time.AfterFunc(15*time.Millisecond, func() { atomic.StoreInt32(&d.down, 0) })
+		o := newBackend()
+		o.ConnectTries = 0
+		o, err := connectMysql(o, registerCountingDriver(d))
+		So(err, ShouldBeNil)
+		defer o.Halt()
+		So(o.degraded(), ShouldBeFalse)
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+	})
+
+	Convey("Given a DB that's down and a degraded start", t, func() {
+		d := &countingDriver{value: "1", down: 1}
+		o := newBackend()
+		o.ConnectDegraded = true
+		o, err := connectMysql(o, registerCountingDriver(d))
+		So(err, ShouldBeNil)
+		defer o.Halt()
+		So(o.degraded(), ShouldBeTrue)
+
+		Convey("Checks should fail closed and not be cached", func() {
+			granted, ttl := o.GetUserTTL("test", "test")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+
+			granted, ttl = o.CheckAclTTL("test", "1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+
+			So(o.GetSuperuser("test"), ShouldBeFalse)
+		})
+
+		Convey("Once the DB is up, the backend should recover in the background", func() {
+			atomic.StoreInt32(&d.down, 0)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for o.degraded() && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(o.degraded(), ShouldBeFalse)
+
+			granted, ttl := o.CheckAclTTL("test", "1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, NoTTL)
+			So(o.GetSuperuser("test"), ShouldBeTrue)
+		})
+
+		Convey("Halting it should stop reconnecting", func() {
+			o.Halt()
+			select {
+			case <-o.reconnect.done:
+			case <-time.After(time.Second):
+				So("reconnection still running", ShouldBeEmpty)
+			}
+			//A second halt should be harmless.
+			o.Halt()
+		})
+	})
+
+	Convey("Given several hosts that are down and a degraded start, the backend should recover once any is up", t, func() {
+		primary := &countingDriver{value: "1", down: 1}
+		standby := &countingDriver{value: "1", down: 1}
+		o := newBackend()
+		o.Protocol = "tcp"
+		o.hosts = []string{"primary:3306", "standby:3306"}
+		o.NodeDownTime = time.Minute
+		o.ConnectDegraded = true
+		o, err := connectMysql(o, registerMysqlHostsDriver(mysqlHostsDriver{"primary:3306": primary, "standby:3306": standby}))
+		So(err, ShouldBeNil)
+		defer o.Halt()
+		So(o.degraded(), ShouldBeTrue)
+
+		atomic.StoreInt32(&standby.down, 0)
+		deadline := time.Now().Add(2 * time.Second)
+		for o.degraded() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(o.degraded(), ShouldBeFalse)
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+	})
+
+	Convey("Given a DB restarting while running, checks should be denied while it's down and recover once it's back", t, func() {
+		d := &countingDriver{value: "1"}
+		o, err := connectMysql(newBackend(), registerCountingDriver(d))
+		So(err, ShouldBeNil)
+		defer o.Halt()
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+
+		atomic.StoreInt32(&d.down, 1)
+		So(o.GetSuperuser("test"), ShouldBeFalse)
+
+		atomic.StoreInt32(&d.down, 0)
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+	})
+
+}
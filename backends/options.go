@@ -0,0 +1,52 @@
+package backends
+
+import "github.com/iegomez/mosquitto-go-auth/common"
+
+//Options are the auth options a backend takes, so the ones no backend takes, e.g. misspelled, may be reported.
+type Options struct {
+	//Keys are the options the backend takes.
+	Keys []string
+	//Named returns the options the backend takes under names given by others, e.g. those of each issuer jwt_issuers lists.
+	Named func(authOpts map[string]string) []string
+}
+
+//Takes tells if the backend takes the option, given every other one.
+func (o Options) Takes(key string, authOpts map[string]string) bool {
+	for _, k := range o.Keys {
+		if k == key {
+			return true
+		}
+	}
+	if o.Named != nil {
+		for _, k := range o.Named(authOpts) {
+			if k == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//All returns every option the backend takes, given every other one.
+func (o Options) All(authOpts map[string]string) []string {
+	all := append([]string(nil), o.Keys...)
+	if o.Named != nil {
+		all = append(all, o.Named(authOpts)...)
+	}
+	return all
+}
+
+//readSecretFiles returns the auth options with the backend's secret ones read from the files their _file variants give, if any.
+func (o Options) readSecretFiles(authOpts map[string]string) (map[string]string, error) {
+	return common.ReadSecretFiles(authOpts, func(key string) bool {
+		return o.Takes(key, authOpts)
+	})
+}
+
+//withKeys returns the keys followed by the others, so options shared by backends, such as the hasher's, may be added to theirs.
+func withKeys(keys []string, others ...[]string) []string {
+	for _, other := range others {
+		keys = append(keys, other...)
+	}
+	return keys
+}
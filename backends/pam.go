@@ -0,0 +1,305 @@
+//go:build pam
+// +build pam
+
+package backends
+
+import (
+	"math"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+type PAM struct {
+	Service        string
+	ConfigDir      string
+	CheckAccount   bool
+	SuperuserGroup string
+
+	Timeout   time.Duration
+	MaxChecks int
+
+	superuserGid string
+	groupAcls    map[string][]AclRecord
+	checks       chan struct{}
+}
+
+//PAMOptions are the auth options the PAM backend takes.
+var PAMOptions = Options{
+	Keys: []string{
+		"pam_check_account", "pam_config_dir", "pam_group_acls", "pam_max_checks", "pam_service", "pam_superuser_group",
+		"pam_timeout_ms",
+	},
+}
+
+//pamServiceDirs are where PAM looks for service files when no config dir is given.
+var pamServiceDirs = []string{"/etc/pam.d", "/usr/lib/pam.d"}
+
+func NewPAM(authOpts map[string]string, logLevel log.Level) (PAM, error) {
+
+	log.SetLevel(logLevel)
+
+	authOpts, err := PAMOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return PAM{}, errors.Errorf("PAM backend error: %s.\n", err)
+	}
+
+	var p = PAM{
+		Service:      "mosquitto",
+		CheckAccount: true,
+		Timeout:      time.Second,
+		MaxChecks:    10,
+		groupAcls:    make(map[string][]AclRecord),
+	}
+
+	if service, ok := authOpts["pam_service"]; ok {
+		p.Service = strings.TrimSpace(service)
+	}
+
+	if p.Service == "" || strings.ContainsAny(p.Service, "/\x00") {
+		return p, errors.Errorf("PAM backend error: invalid pam_service %s.\n", p.Service)
+	}
+
+	if configDir, ok := authOpts["pam_config_dir"]; ok {
+		p.ConfigDir = configDir
+	}
+
+	//PAM falls back to the "other" service when the service's file is missing, which is hardly what's wanted.
+	if p.ConfigDir != "" {
+		if !pamHasConfigDir() {
+			return p, errors.New("PAM backend error: pam_config_dir needs Linux-PAM 1.4 or later.\n")
+		}
+		if _, err := os.Stat(filepath.Join(p.ConfigDir, p.Service)); err != nil {
+			return p, errors.Errorf("PAM backend error: invalid pam_service %s: %s.\n", p.Service, err)
+		}
+	} else if !pamServiceExists(p.Service) {
+		log.Warnf("PAM backend: no file found for service %s in %s, PAM will check users with its other service.", p.Service, strings.Join(pamServiceDirs, " or "))
+	}
+
+	p.CheckAccount = common.BoolOption(authOpts, "pam_check_account", p.CheckAccount)
+
+	p.Timeout = common.DurationOption(authOpts, "pam_timeout_ms", time.Millisecond, time.Millisecond, p.Timeout)
+
+	p.MaxChecks = common.IntOption(authOpts, "pam_max_checks", 1, math.MaxInt32, p.MaxChecks)
+
+	//Groups are looked up now, so a misspelled one fails on startup rather than denying every check.
+	if superuserGroup, ok := authOpts["pam_superuser_group"]; ok && superuserGroup != "" {
+		group, err := user.LookupGroup(superuserGroup)
+		if err != nil {
+			return p, errors.Errorf("PAM backend error: invalid pam_superuser_group: %s.\n", err)
+		}
+		p.SuperuserGroup = superuserGroup
+		p.superuserGid = group.Gid
+	}
+
+	if groupAcls, ok := authOpts["pam_group_acls"]; ok {
+		count, err := p.readGroupAcls(groupAcls)
+		if err != nil {
+			return p, err
+		}
+		log.Infof("PAM backend: got %d group acls.", count)
+	}
+
+	p.checks = make(chan struct{}, p.MaxChecks)
+
+	return p, nil
+
+}
+
+//pamServiceExists tells if there's a file for the service where PAM looks for them.
+func pamServiceExists(service string) bool {
+	for _, dir := range pamServiceDirs {
+		if _, err := os.Stat(filepath.Join(dir, service)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+//readGroupAcls parses the pam_group_acls option (group:access:topic entries separated by commas) into the acls of each group, by its id.
+func (o *PAM) readGroupAcls(groupAcls string) (int, error) {
+
+	aclsCount := 0
+
+	for _, entry := range strings.Split(groupAcls, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		entryArr := strings.SplitN(entry, ":", 3)
+		if len(entryArr) != 3 || entryArr[0] == "" || entryArr[2] == "" {
+			return aclsCount, errors.Errorf("PAM backend error: group acl entry %s is not well formatted.\n", entry)
+		}
+
+		group, err := user.LookupGroup(entryArr[0])
+		if err != nil {
+			return aclsCount, errors.Errorf("PAM backend error: invalid group for group acl entry %s: %s.\n", entry, err)
+		}
+
+		var aclRecord = AclRecord{
+			Topic: entryArr[2],
+			Acc:   MOSQ_ACL_NONE,
+		}
+
+		switch entryArr[1] {
+		case "read":
+			aclRecord.Acc = MOSQ_ACL_READ
+		case "write":
+			aclRecord.Acc = MOSQ_ACL_WRITE
+		case "readwrite":
+			aclRecord.Acc = MOSQ_ACL_READWRITE
+		case "subscribe":
+			aclRecord.Acc = MOSQ_ACL_SUBSCRIBE
+		default:
+			return aclsCount, errors.Errorf("PAM backend error: wrong access %s for group acl entry %s.\n", entryArr[1], entry)
+		}
+
+		o.groupAcls[group.Gid] = append(o.groupAcls[group.Gid], aclRecord)
+
+		aclsCount++
+	}
+
+	return aclsCount, nil
+
+}
+
+//pamValidUsername tells if the username may be given to PAM and the system's user database: names holding a NUL would be cut short by them and taken as another user.
+func pamValidUsername(username string) bool {
+	return username != "" && !strings.ContainsRune(username, 0)
+}
+
+//userGroups returns the ids of the groups the system user is a member of, its primary one included, or nil when there's no such user.
+func (o PAM) userGroups(username string) map[string]bool {
+	if !pamValidUsername(username) {
+		return nil
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		if _, ok := err.(user.UnknownUserError); !ok {
+			log.Errorf("PAM backend: couldn't look up user %s: %s", common.RedactUsername(username), err)
+		}
+		return nil
+	}
+
+	gids, err := u.GroupIds()
+	if err != nil {
+		log.Errorf("PAM backend: couldn't look up groups of user %s: %s", common.RedactUsername(username), err)
+		return nil
+	}
+
+	groups := make(map[string]bool, len(gids)+1)
+	groups[u.Gid] = true
+	for _, gid := range gids {
+		groups[gid] = true
+	}
+	return groups
+}
+
+//GetUser authenticates the user with the password by the PAM service, checking its account is valid too unless pam_check_account is false.
+func (o PAM) GetUser(username, password string) bool {
+	ok, _ := o.GetUserTTL(username, password)
+	return ok
+}
+
+//GetUserTTL checks the user as GetUser does, telling not to cache a denial when PAM didn't answer in time or couldn't reach what it checks against.
+//A PAM call can't be interrupted, so one that timed out keeps running, and holding its slot out of pam_max_checks, until it returns.
+func (o PAM) GetUserTTL(username, password string) (bool, time.Duration) {
+	if !pamValidUsername(username) || strings.ContainsRune(password, 0) {
+		log.Warnf("PAM user check: username or password of user %s holds a NUL, denying it.", common.RedactUsername(username))
+		return false, NoTTL
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(o.Timeout)
+	defer timer.Stop()
+
+	select {
+	case o.checks <- struct{}{}:
+	case <-timer.C:
+		log.Errorf("PAM user check timed out after %s waiting for a free slot, denying user %s.", time.Since(start), common.RedactUsername(username))
+		return false, SkipCache
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			<-o.checks
+		}()
+		result <- pamAuthenticate(o.Service, o.ConfigDir, username, password, o.CheckAccount)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-timer.C:
+		log.Errorf("PAM user check timed out after %s, denying user %s.", time.Since(start), common.RedactUsername(username))
+		return false, SkipCache
+	}
+
+	if err == nil {
+		return true, NoTTL
+	}
+
+	if pamErr, ok := err.(pamError); ok {
+		if pamErr.denied() {
+			log.Debugf("PAM user check denied user %s: %s", common.RedactUsername(username), err)
+			return false, NoTTL
+		}
+		if pamErr.unavailable() {
+			log.Errorf("PAM user check couldn't check user %s, denying it: %s", common.RedactUsername(username), err)
+			return false, SkipCache
+		}
+	}
+	log.Errorf("PAM user check error, denying user %s: %s", common.RedactUsername(username), err)
+	return false, NoTTL
+}
+
+//GetSuperuser tells if the user is a member of pam_superuser_group.
+func (o PAM) GetSuperuser(username string) bool {
+	if o.superuserGid == "" {
+		return false
+	}
+	return o.userGroups(username)[o.superuserGid]
+}
+
+//CheckAcl checks the topic against the acls pam_group_acls gives to the groups the user is a member of.
+//Without them, every acl is denied, so acls are left to the next backends.
+func (o PAM) CheckAcl(username, topic, clientid string, acc int32) bool {
+	if len(o.groupAcls) == 0 {
+		return false
+	}
+
+	for gid := range o.userGroups(username) {
+		for _, aclRecord := range o.groupAcls[gid] {
+			//%c and %u are replaced by the client id and username when matching.
+			if common.AclMatches(aclRecord.Topic, topic, username, clientid) && accMatches(int32(aclRecord.Acc), acc, topic) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//CheckAclTTL checks the acl as CheckAcl does.
+func (o PAM) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
+	return o.CheckAcl(username, topic, clientid, acc), NoTTL
+}
+
+//GetName returns the backend's name
+func (o PAM) GetName() string {
+	return "PAM"
+}
+
+//Halt does nothing, as running PAM calls can't be interrupted and end on their own.
+func (o PAM) Halt() {}
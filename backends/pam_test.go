@@ -0,0 +1,167 @@
+//go:build pam
+// +build pam
+
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPAM(t *testing.T) {
+
+	//The test service is written to a config dir of its own, with the paths of the helpers it runs.
+	testdata, err := filepath.Abs("testdata/pam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := ioutil.ReadFile(filepath.Join(testdata, "service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDir, err := ioutil.TempDir("", "mosquitto-pam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+	if err := ioutil.WriteFile(filepath.Join(configDir, "mosquitto-test"), []byte(strings.Replace(string(service), "TESTDATA", testdata, -1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	//Groups checks are made against the user running the tests and its primary group.
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authOpts := func(opts map[string]string) map[string]string {
+		all := map[string]string{
+			"pam_service":    "mosquitto-test",
+			"pam_config_dir": configDir,
+		}
+		for key, value := range opts {
+			if value == "" {
+				delete(all, key)
+			} else {
+				all[key] = value
+			}
+		}
+		return all
+	}
+
+	Convey("Given wrong options, NewPAM should fail", t, func() {
+		for _, opts := range []map[string]string{
+			{"pam_service": "missing"},
+			{"pam_service": "../mosquitto-test"},
+			{"pam_superuser_group": "no-such-group-for-mosquitto"},
+			{"pam_group_acls": primary.Name + ":readwrite"},
+			{"pam_group_acls": primary.Name + ":publish:tele/#"},
+			{"pam_group_acls": "no-such-group-for-mosquitto:read:tele/#"},
+		} {
+			_, err := NewPAM(authOpts(opts), log.DebugLevel)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given invalid options, NewPAM should warn and use the defaults", t, func() {
+		p, err := NewPAM(authOpts(map[string]string{"pam_check_account": "maybe", "pam_timeout_ms": "0", "pam_max_checks": "0"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer p.Halt()
+		So(p.CheckAccount, ShouldBeTrue)
+		So(p.Timeout, ShouldEqual, time.Second)
+		So(p.MaxChecks, ShouldEqual, 10)
+	})
+
+	Convey("Given a test service, users should be authenticated by it", t, func() {
+		p, err := NewPAM(authOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer p.Halt()
+
+		So(p.GetUser("test1", "test pw"), ShouldBeTrue)
+		So(p.GetUser("test1", "wrong"), ShouldBeFalse)
+		So(p.GetUser("nobody-knows", "test pw"), ShouldBeFalse)
+		So(p.GetUser("test1\x00x", "test pw"), ShouldBeFalse)
+		So(p.GetUser("test1", "test pw\x00x"), ShouldBeFalse)
+
+		granted, ttl := p.GetUserTTL("test1", "test pw")
+		So(granted, ShouldBeTrue)
+		So(ttl, ShouldEqual, NoTTL)
+
+		//pam_faildelay asks for a 2 seconds delay after failures, which the backend doesn't wait for.
+		start := time.Now()
+		granted, ttl = p.GetUserTTL("test1", "wrong")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, NoTTL)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+
+		Convey("And accounts should be checked unless pam_check_account is false", func() {
+			So(p.GetUser("expired", "test pw"), ShouldBeFalse)
+
+			p, err := NewPAM(authOpts(map[string]string{"pam_check_account": "false"}), log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(p.GetUser("expired", "test pw"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given PAM hanging, checks should be denied in time and their denials not cached", t, func() {
+		p, err := NewPAM(authOpts(map[string]string{"pam_timeout_ms": "200", "pam_max_checks": "1"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		start := time.Now()
+		granted, ttl := p.GetUserTTL("hang", "test pw")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+		So(time.Since(start), ShouldBeLessThan, 600*time.Millisecond)
+
+		//The hanging call can't be interrupted, so it holds its slot until it returns.
+		granted, ttl = p.GetUserTTL("test1", "test pw")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+
+		time.Sleep(time.Second)
+		So(p.GetUser("test1", "test pw"), ShouldBeTrue)
+	})
+
+	Convey("Given a superuser group, its members should be superusers", t, func() {
+		p, err := NewPAM(authOpts(map[string]string{"pam_superuser_group": primary.Name}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(p.GetSuperuser(current.Username), ShouldBeTrue)
+		So(p.GetSuperuser("no-such-user-for-mosquitto"), ShouldBeFalse)
+		So(p.GetSuperuser(current.Username+"\x00x"), ShouldBeFalse)
+
+		p, err = NewPAM(authOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(p.GetSuperuser(current.Username), ShouldBeFalse)
+	})
+
+	Convey("Given group acls, members of the groups should be granted them", t, func() {
+		p, err := NewPAM(authOpts(map[string]string{"pam_group_acls": primary.Name + ":readwrite:devices/%u/#, " + primary.Name + ":read:announcements/#"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(p.CheckAcl(current.Username, "devices/"+current.Username+"/tele", "dev1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(p.CheckAcl(current.Username, "devices/other/tele", "dev1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(p.CheckAcl(current.Username, "announcements/all", "dev1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(p.CheckAcl(current.Username, "announcements/all", "dev1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(p.CheckAcl("no-such-user-for-mosquitto", "announcements/all", "dev1", MOSQ_ACL_READ), ShouldBeFalse)
+
+		Convey("And without them, acls should be left to other backends", func() {
+			p, err := NewPAM(authOpts(nil), log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(p.CheckAcl(current.Username, "announcements/all", "dev1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+
+}
@@ -0,0 +1,208 @@
+//go:build pam
+// +build pam
+
+package backends
+
+/*
+#cgo LDFLAGS: -lpam
+
+#include <stdlib.h>
+#include <string.h>
+#include <security/pam_appl.h>
+
+#ifndef PAM_MAX_NUM_MSG
+#define PAM_MAX_NUM_MSG 32
+#endif
+
+#define MQTT_PAM_MESSAGE_SIZE 256
+
+//mqtt_pam_credentials are what the conversation answers with, along with the last error message a module sent.
+typedef struct {
+	const char *username;
+	const char *password;
+	int password_sent;
+	char message[MQTT_PAM_MESSAGE_SIZE];
+} mqtt_pam_credentials;
+
+//mqtt_pam_conv answers the first password prompt with the password and fails on any other prompt, e.g. asking for a new password or a one-time code, as nobody may answer it.
+static int mqtt_pam_conv(int num_msg, const struct pam_message **msg, struct pam_response **resp, void *appdata_ptr) {
+	mqtt_pam_credentials *creds = appdata_ptr;
+	struct pam_response *replies;
+	int i;
+
+	if (num_msg <= 0 || num_msg > PAM_MAX_NUM_MSG) {
+		return PAM_CONV_ERR;
+	}
+
+	replies = calloc(num_msg, sizeof(struct pam_response));
+	if (replies == NULL) {
+		return PAM_BUF_ERR;
+	}
+
+	for (i = 0; i < num_msg; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+			if (creds->password_sent) {
+				goto fail;
+			}
+			replies[i].resp = strdup(creds->password);
+			if (replies[i].resp == NULL) {
+				goto fail;
+			}
+			creds->password_sent = 1;
+			break;
+		case PAM_ERROR_MSG:
+			if (msg[i]->msg != NULL) {
+				strncpy(creds->message, msg[i]->msg, MQTT_PAM_MESSAGE_SIZE - 1);
+			}
+			break;
+		case PAM_TEXT_INFO:
+			break;
+		default:
+			goto fail;
+		}
+	}
+
+	*resp = replies;
+	return PAM_SUCCESS;
+
+fail:
+	for (i = 0; i < num_msg; i++) {
+		free(replies[i].resp);
+	}
+	free(replies);
+	return PAM_CONV_ERR;
+}
+
+#ifdef PAM_FAIL_DELAY
+//mqtt_pam_no_delay keeps PAM from sleeping after a failed authentication, which would block the broker.
+static void mqtt_pam_no_delay(int status, unsigned int delay, void *appdata_ptr) {
+}
+#endif
+
+#ifdef __LINUX_PAM__
+//pam_start_confdir is only in Linux-PAM 1.4 and later, so it's null when the library lacks it.
+extern int pam_start_confdir(const char *service_name, const char *user, const struct pam_conv *pam_conversation, const char *confdir, pam_handle_t **pamh) __attribute__((weak));
+
+static int mqtt_pam_has_confdir(void) {
+	return pam_start_confdir != NULL;
+}
+#else
+static int mqtt_pam_has_confdir(void) {
+	return 0;
+}
+#endif
+
+//mqtt_pam_check authenticates the user, and checks its account when asked to, setting the call that failed in step, if any, and its error in the credentials' message.
+static int mqtt_pam_check(const char *service, const char *confdir, mqtt_pam_credentials *creds, int account, int *step) {
+	struct pam_conv conv = { mqtt_pam_conv, creds };
+	pam_handle_t *pamh = NULL;
+	int status;
+
+	*step = 0;
+	if (confdir != NULL) {
+#ifdef __LINUX_PAM__
+		status = mqtt_pam_has_confdir() ? pam_start_confdir(service, creds->username, &conv, confdir, &pamh) : PAM_SYSTEM_ERR;
+#else
+		status = PAM_SYSTEM_ERR;
+#endif
+	} else {
+		status = pam_start(service, creds->username, &conv, &pamh);
+	}
+	if (status != PAM_SUCCESS) {
+		strncpy(creds->message, pam_strerror(pamh, status), MQTT_PAM_MESSAGE_SIZE - 1);
+		return status;
+	}
+
+#ifdef PAM_FAIL_DELAY
+	pam_set_item(pamh, PAM_FAIL_DELAY, (const void *)mqtt_pam_no_delay);
+#endif
+
+	*step = 1;
+	status = pam_authenticate(pamh, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	if (status == PAM_SUCCESS && account) {
+		*step = 2;
+		status = pam_acct_mgmt(pamh, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	if (status != PAM_SUCCESS && creds->message[0] == '\0') {
+		strncpy(creds->message, pam_strerror(pamh, status), MQTT_PAM_MESSAGE_SIZE - 1);
+	}
+
+	pam_end(pamh, status);
+	return status;
+}
+*/
+import "C"
+
+import "unsafe"
+
+//pamSteps are the PAM calls mqtt_pam_check makes, by the step it sets.
+var pamSteps = []string{"pam_start", "pam_authenticate", "pam_acct_mgmt"}
+
+//pamError is a PAM call failing, with the status it returned and the error message a module sent, if any, or else the status' one.
+type pamError struct {
+	call    string
+	status  C.int
+	message string
+}
+
+func (e pamError) Error() string {
+	return e.call + ": " + e.message
+}
+
+//denied tells if PAM refused the user, e.g. a wrong password or an expired account, rather than failing to check it.
+func (e pamError) denied() bool {
+	switch e.status {
+	case C.PAM_AUTH_ERR, C.PAM_USER_UNKNOWN, C.PAM_MAXTRIES, C.PAM_CRED_INSUFFICIENT, C.PAM_PERM_DENIED, C.PAM_ACCT_EXPIRED, C.PAM_NEW_AUTHTOK_REQD:
+		return true
+	}
+	return false
+}
+
+//unavailable tells if a module couldn't reach what it checks against, e.g. a directory server, so it could have granted the user.
+func (e pamError) unavailable() bool {
+	return e.status == C.PAM_AUTHINFO_UNAVAIL
+}
+
+//pamHasConfigDir tells if the PAM library may read service files from a given directory, as Linux-PAM does since 1.4.
+func pamHasConfigDir() bool {
+	return C.mqtt_pam_has_confdir() != 0
+}
+
+//pamAuthenticate authenticates the user with the password by the service, read from the config dir if given, checking its account too when asked to.
+//It returns a pamError when PAM refused the user or couldn't check it.
+func pamAuthenticate(service, configDir, username, password string, checkAccount bool) error {
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+
+	var cConfigDir *C.char
+	if configDir != "" {
+		cConfigDir = C.CString(configDir)
+		defer C.free(unsafe.Pointer(cConfigDir))
+	}
+
+	//PAM keeps the conversation's data for the whole transaction, so it's held in C memory.
+	creds := (*C.mqtt_pam_credentials)(C.calloc(1, C.sizeof_mqtt_pam_credentials))
+	defer C.free(unsafe.Pointer(creds))
+	creds.username = C.CString(username)
+	defer C.free(unsafe.Pointer(creds.username))
+	creds.password = C.CString(password)
+	defer C.free(unsafe.Pointer(creds.password))
+
+	account := C.int(0)
+	if checkAccount {
+		account = 1
+	}
+
+	var step C.int
+	status := C.mqtt_pam_check(cService, cConfigDir, creds, account, &step)
+	if status == C.PAM_SUCCESS {
+		return nil
+	}
+
+	return pamError{
+		call:    pamSteps[step],
+		status:  status,
+		message: C.GoString(&creds.message[0]),
+	}
+}
@@ -0,0 +1,163 @@
+package backends
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/lib/pq"
+)
+
+//pgNotifier listens on a channel for notifications carrying the username of a user whose data changed, e.g. a revoked device, and hands it to the handler set with OnUserChange so its cached decisions are dropped.
+//The listener reconnects on its own after losing its connection, and as notifications sent meanwhile are lost, the handler is then given an empty username meaning any user may have changed.
+type pgNotifier struct {
+	channel      string
+	minReconnect time.Duration
+	handler      atomic.Value
+	halted       int32
+	mu           sync.Mutex
+	listener     *pq.Listener
+	done         chan struct{}
+	halt         sync.Once
+}
+
+//newPGNotifier starts listening on the channel, waiting from minReconnect up to pgMaxReconnectBackoff between reconnection attempts.
+func newPGNotifier(connStr, channel string, minReconnect time.Duration) *pgNotifier {
+	n := &pgNotifier{
+		channel:      channel,
+		minReconnect: minReconnect,
+	}
+	n.listener, n.done = n.listen(connStr)
+
+	return n
+}
+
+//listen starts a listener connecting with the connection string, returning it along with a channel closed once its notifications are all handled.
+func (n *pgNotifier) listen(connStr string) (*pq.Listener, chan struct{}) {
+	listener := pq.NewListener(connStr, n.minReconnect, pgMaxReconnectBackoff, n.event)
+	done := make(chan struct{})
+
+	//Listen blocks until the listener is connected, which may take a while if the DB is down.
+	go func() {
+		if err := listener.Listen(n.channel); err != nil && n.current(listener) {
+			log.Errorf("PG backend: couldn't listen on channel %s: %s", n.channel, err)
+		}
+	}()
+	go n.run(listener, done)
+
+	return listener, done
+}
+
+//run hands every notification of the listener to the handler until it's closed.
+func (n *pgNotifier) run(listener *pq.Listener, done chan struct{}) {
+	defer close(done)
+	for notification := range listener.Notify {
+		n.handle(notification)
+	}
+}
+
+//current tells if the listener is the one in use, rather than one replaced or closed on halt.
+func (n *pgNotifier) current(listener *pq.Listener) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return atomic.LoadInt32(&n.halted) == 0 && n.listener == listener
+}
+
+//reconnect replaces the listener with one connecting with the new connection string, e.g. holding new credentials.
+//Notifications sent while switching may be missed, so the handler is then given an empty username, as after the listener reconnects.
+func (n *pgNotifier) reconnect(connStr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if atomic.LoadInt32(&n.halted) == 1 {
+		return
+	}
+
+	old, done := n.listener, n.done
+	n.listener, n.done = n.listen(connStr)
+	old.Close()
+	<-done
+
+	n.handle(nil)
+}
+
+//handle hands the notified username to the handler. A nil notification is sent after reconnecting, when notifications may have been missed.
+func (n *pgNotifier) handle(notification *pq.Notification) {
+	handler, _ := n.handler.Load().(func(string))
+
+	if notification == nil {
+		log.Warnf("PG backend: notification listener reconnected, dropping every cached decision as changes may have been missed.")
+		if handler != nil {
+			handler("")
+		}
+		return
+	}
+
+	username := notifiedUsername(notification.Extra)
+	if username == "" {
+		log.Warnf("PG backend: ignoring notification on channel %s without a username: %q", n.channel, notification.Extra)
+		return
+	}
+
+	log.Debugf("PG backend: user %s changed, dropping its cached decisions.", common.RedactUsername(username))
+	if handler != nil {
+		handler(username)
+	}
+}
+
+//event logs the listener's connection changes.
+func (n *pgNotifier) event(event pq.ListenerEventType, err error) {
+	if atomic.LoadInt32(&n.halted) == 1 {
+		return
+	}
+	switch event {
+	case pq.ListenerEventDisconnected:
+		log.Errorf("PG backend: notification listener lost its connection, reconnecting: %s", err)
+	case pq.ListenerEventConnectionAttemptFailed:
+		log.Errorf("PG backend: notification listener couldn't connect: %s", err)
+	case pq.ListenerEventReconnected:
+		log.Infof("PG backend: notification listener reconnected.")
+	}
+}
+
+//stop closes the listener and waits for pending notifications to be handled.
+func (n *pgNotifier) stop() {
+	n.halt.Do(func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		atomic.StoreInt32(&n.halted, 1)
+		n.listener.Close()
+		<-n.done
+	})
+}
+
+//notifiedUsername returns the username given by a notification's payload, which may be the username itself or a JSON object with a username field, e.g. as built by a trigger with json_build_object('username', username).
+func notifiedUsername(payload string) string {
+	payload = strings.TrimSpace(payload)
+	if !strings.HasPrefix(payload, "{") {
+		return payload
+	}
+
+	var body struct {
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal([]byte(payload), &body); err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(body.Username)
+}
+
+//OnUserChange sets the handler given the usernames notified on pg_notify_channel, or an empty one when changes may have been missed. It returns false when no channel is set, as nothing will be notified.
+func (o Postgres) OnUserChange(handler func(username string)) bool {
+	if o.notifier == nil {
+		return false
+	}
+	o.notifier.handler.Store(handler)
+	return true
+}
@@ -0,0 +1,209 @@
+package backends
+
+import (
+	"plugin"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/pluginapi"
+)
+
+//legacyPluginVersion is the version given for plugins exposing the legacy funcs, which can't tell theirs.
+const legacyPluginVersion = "legacy"
+
+//CustomPlugin is a custom backend loaded from a Go plugin, which either exposes a GetPlugin func returning a pluginapi.PluginV2, or the legacy Init, GetName, GetUser, GetSuperuser, CheckAcl and Halt funcs, and optionally GetUserWithClientid.
+type CustomPlugin struct {
+	Path         string
+	version      string
+	getName      func() string
+	getUser      func(username, password, clientid string) (bool, error)
+	getSuperuser func(username string) (bool, error)
+	checkAcl     func(username, topic, clientid string, acc int) (bool, error)
+	halt         func()
+	options      []string
+	tellsOptions bool
+}
+
+//LoadPlugin opens the plugin at path, looks up the v2 contract or else every legacy func, and inits it with the options.
+//Plugins built against another contract are reported as incompatible instead of panicking, as is any panic while loading them.
+func LoadPlugin(path string, authOpts map[string]string, logLevel log.Level) (p CustomPlugin, err error) {
+	p.Path = path
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("incompatible plugin %s: %v", path, r)
+		}
+	}()
+
+	plug, err := plugin.Open(path)
+	if err != nil {
+		return p, errors.Errorf("couldn't open plugin %s: %s", path, err)
+	}
+
+	var initFunc func(authOpts map[string]string, logLevel log.Level) error
+	if symbol, lookupErr := plug.Lookup("GetPlugin"); lookupErr == nil {
+		initFunc, err = p.loadV2(symbol)
+	} else {
+		initFunc, err = p.loadLegacy(plug)
+	}
+	if err != nil {
+		return p, err
+	}
+
+	if err := initFunc(authOpts, logLevel); err != nil {
+		return p, errors.Errorf("couldn't init plugin %s: %s", path, err)
+	}
+
+	return p, nil
+}
+
+//loadV2 sets the funcs given by the plugin's GetPlugin, returning its Init.
+func (p *CustomPlugin) loadV2(symbol plugin.Symbol) (func(map[string]string, log.Level) error, error) {
+	getPlugin, ok := symbol.(func() pluginapi.PluginV2)
+	if !ok {
+		return nil, wrongSymbolType(p.Path, "GetPlugin", symbol, getPlugin)
+	}
+
+	v2 := getPlugin()
+
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"Version", v2.Version != nil},
+		{"Init", v2.Init != nil},
+		{"GetName", v2.GetName != nil},
+		{"GetUser", v2.GetUser != nil},
+		{"GetSuperuser", v2.GetSuperuser != nil},
+		{"CheckAcl", v2.CheckAcl != nil},
+	} {
+		if !f.set {
+			return nil, errors.Errorf("incompatible plugin %s: its PluginV2 doesn't set %s", p.Path, f.name)
+		}
+	}
+
+	p.version = v2.Version()
+	p.getName = v2.GetName
+	p.getUser = v2.GetUserWithClientid
+	if p.getUser == nil {
+		p.getUser = func(username, password, clientid string) (bool, error) {
+			return v2.GetUser(username, password)
+		}
+	}
+	p.getSuperuser = v2.GetSuperuser
+	p.checkAcl = v2.CheckAcl
+	p.halt = v2.Halt
+	if p.halt == nil {
+		p.halt = func() {}
+	}
+	if v2.Options != nil {
+		p.options = v2.Options()
+		p.tellsOptions = true
+	}
+
+	return v2.Init, nil
+}
+
+//loadLegacy sets the legacy funcs exposed by the plugin, returning its Init. As they can't fail, they never return errors.
+func (p *CustomPlugin) loadLegacy(plug *plugin.Plugin) (func(map[string]string, log.Level) error, error) {
+	symbols := make(map[string]plugin.Symbol)
+	for _, name := range []string{"Init", "GetName", "GetUser", "GetSuperuser", "CheckAcl", "Halt"} {
+		symbol, err := plug.Lookup(name)
+		if err != nil {
+			return nil, errors.Errorf("couldn't find func %s in plugin %s: %s", name, p.Path, err)
+		}
+		symbols[name] = symbol
+	}
+
+	initFunc, ok := symbols["Init"].(func(authOpts map[string]string, logLevel log.Level) error)
+	if !ok {
+		return nil, wrongSymbolType(p.Path, "Init", symbols["Init"], initFunc)
+	}
+	getName, ok := symbols["GetName"].(func() string)
+	if !ok {
+		return nil, wrongSymbolType(p.Path, "GetName", symbols["GetName"], getName)
+	}
+	getUser, ok := symbols["GetUser"].(func(username, password string) bool)
+	if !ok {
+		return nil, wrongSymbolType(p.Path, "GetUser", symbols["GetUser"], getUser)
+	}
+	getSuperuser, ok := symbols["GetSuperuser"].(func(username string) bool)
+	if !ok {
+		return nil, wrongSymbolType(p.Path, "GetSuperuser", symbols["GetSuperuser"], getSuperuser)
+	}
+	checkAcl, ok := symbols["CheckAcl"].(func(username, topic, clientid string, acc int) bool)
+	if !ok {
+		return nil, wrongSymbolType(p.Path, "CheckAcl", symbols["CheckAcl"], checkAcl)
+	}
+	halt, ok := symbols["Halt"].(func())
+	if !ok {
+		return nil, wrongSymbolType(p.Path, "Halt", symbols["Halt"], halt)
+	}
+
+	//GetUserWithClientid is optional, letting older plugins lack it.
+	var getClientUser func(username, password, clientid string) bool
+	if symbol, err := plug.Lookup("GetUserWithClientid"); err == nil {
+		if getClientUser, ok = symbol.(func(username, password, clientid string) bool); !ok {
+			return nil, wrongSymbolType(p.Path, "GetUserWithClientid", symbol, getClientUser)
+		}
+	}
+
+	p.version = legacyPluginVersion
+	p.getName = getName
+	p.getUser = func(username, password, clientid string) (bool, error) {
+		if getClientUser != nil {
+			return getClientUser(username, password, clientid), nil
+		}
+		return getUser(username, password), nil
+	}
+	p.getSuperuser = func(username string) (bool, error) {
+		return getSuperuser(username), nil
+	}
+	p.checkAcl = func(username, topic, clientid string, acc int) (bool, error) {
+		return checkAcl(username, topic, clientid, acc), nil
+	}
+	p.halt = halt
+
+	return initFunc, nil
+}
+
+//wrongSymbolType reports the plugin's symbol doesn't have the type of expected, which is the zero value of the type it must have, telling both types.
+func wrongSymbolType(path, name string, symbol plugin.Symbol, expected interface{}) error {
+	return errors.Errorf("incompatible plugin %s: %s is a %T, it must be a %T", path, name, symbol, expected)
+}
+
+//Version returns the version the plugin gives, or legacy for plugins exposing the legacy funcs.
+func (o CustomPlugin) Version() string {
+	return o.version
+}
+
+//GetName returns the name the plugin gives.
+func (o CustomPlugin) GetName() string {
+	return o.getName()
+}
+
+//GetUser checks the user with the plugin, passing it the client id when it takes it, and returning an error when it couldn't tell.
+func (o CustomPlugin) GetUser(username, password, clientid string) (bool, error) {
+	return o.getUser(username, password, clientid)
+}
+
+//GetSuperuser checks if the user is a superuser with the plugin, returning an error when it couldn't tell.
+func (o CustomPlugin) GetSuperuser(username string) (bool, error) {
+	return o.getSuperuser(username)
+}
+
+//CheckAcl checks the acl with the plugin, returning an error when it couldn't tell.
+func (o CustomPlugin) CheckAcl(username, topic, clientid string, acc int) (bool, error) {
+	return o.checkAcl(username, topic, clientid, acc)
+}
+
+//Options returns the auth options the plugin takes, and whether it tells them, which legacy plugins can't.
+func (o CustomPlugin) Options() ([]string, bool) {
+	return o.options, o.tellsOptions
+}
+
+//Halt lets the plugin clean up.
+func (o CustomPlugin) Halt() {
+	o.halt()
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package backends
+
+//pluginRace tells test plugins must be built with the race detector, as they must be built just as the test binary.
+const pluginRace = true
@@ -0,0 +1,321 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//buildTestPlugins builds the test plugins with the given names from testdata/plugins into dir, returning their paths.
+func buildTestPlugins(t *testing.T, dir string, names ...string) map[string]string {
+	paths := make(map[string]string)
+	for _, name := range names {
+		paths[name] = filepath.Join(dir, name+".so")
+		buildTestPlugin(t, name, paths[name], "")
+	}
+	return paths
+}
+
+//buildTestPlugin builds the test plugin with the given name from testdata/plugins at path.
+//Go won't load two plugins with the same plugin path, which is the package's import path, so a plugin built again to be loaded alongside is given a tag,
+//which builds it from its files with the tag set in the build, giving it a plugin path of its own.
+func buildTestPlugin(t *testing.T, name, path, tag string) {
+	args := []string{"build", "-buildmode=plugin"}
+	if pluginRace {
+		args = append(args, "-race")
+	}
+	if tag == "" {
+		args = append(args, "-o", path, "./testdata/plugins/"+name)
+	} else {
+		args = append(args, "-ldflags=-X main.buildTag="+tag, "-o", path, "./testdata/plugins/"+name+"/main.go")
+	}
+	if out, err := exec.Command("go", args...).CombinedOutput(); err != nil {
+		t.Fatalf("couldn't build test plugin %s: %s\n%s", name, err, out)
+	}
+}
+
+func TestPlugins(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatalf("couldn't create plugins dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := buildTestPlugins(t, dir, "registry", "geofence", "incomplete", "devicesv2", "wrongsig", "panicking", "bound", "boundv2", "badacl")
+
+	authOpts := map[string]string{
+		"registry_devices": "sensor-1:secret,sensor-2:other",
+		"geofence_region":  "eu",
+		"geofence_admin":   "ops",
+
+		"devicesv2_devices":     "sensor-3:secret",
+		"devicesv2_unreachable": "sensor-4",
+
+		"bound_devices": "sensor-5:secret:client-5",
+	}
+
+	Convey("Given two plugins, both should be loaded and answer on their own", t, func() {
+		registry, err := LoadPlugin(paths["registry"], authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(registry.GetName(), ShouldEqual, "Device registry")
+		So(registry.Path, ShouldEqual, paths["registry"])
+
+		geofence, err := LoadPlugin(paths["geofence"], authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(geofence.GetName(), ShouldEqual, "Geofencing")
+
+		checks := []struct {
+			check func() (bool, error)
+			want  bool
+		}{
+			{func() (bool, error) { return registry.GetUser("sensor-1", "secret", "any") }, true},
+			{func() (bool, error) { return registry.GetUser("sensor-1", "other", "any") }, false},
+			{func() (bool, error) { return geofence.GetUser("sensor-1", "secret", "any") }, false},
+			{func() (bool, error) { return registry.CheckAcl("sensor-1", "devices/sensor-1/temp", "id", 2) }, true},
+			{func() (bool, error) { return registry.CheckAcl("sensor-1", "geo/eu/alerts", "id", 1) }, false},
+			{func() (bool, error) { return geofence.CheckAcl("sensor-1", "geo/eu/alerts", "id", 1) }, true},
+			{func() (bool, error) { return geofence.CheckAcl("sensor-1", "geo/us/alerts", "id", 1) }, false},
+			{func() (bool, error) { return geofence.GetSuperuser("ops") }, true},
+			{func() (bool, error) { return registry.GetSuperuser("ops") }, false},
+		}
+		for _, c := range checks {
+			granted, err := c.check()
+			So(err, ShouldBeNil)
+			So(granted, ShouldEqual, c.want)
+		}
+
+		So(registry.Version(), ShouldEqual, "legacy")
+
+		_, tells := registry.Options()
+		So(tells, ShouldBeFalse)
+
+		registry.Halt()
+		geofence.Halt()
+	})
+
+	Convey("Given a v2 plugin, its checks should tell errors apart from denials", t, func() {
+		devices, err := LoadPlugin(paths["devicesv2"], authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(devices.GetName(), ShouldEqual, "Devices v2")
+		So(devices.Version(), ShouldEqual, "2.1.0")
+
+		options, tells := devices.Options()
+		So(tells, ShouldBeTrue)
+		So(options, ShouldResemble, []string{"devicesv2_devices", "devicesv2_unreachable"})
+
+		granted, err := devices.GetUser("sensor-3", "secret", "any")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+
+		granted, err = devices.GetUser("sensor-3", "other", "any")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+
+		granted, err = devices.CheckAcl("sensor-3", "devices/sensor-3/temp", "id", 2)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+
+		_, err = devices.GetUser("sensor-4", "secret", "any")
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "unreachable")
+
+		_, err = devices.GetSuperuser("sensor-4")
+		So(err, ShouldBeError)
+
+		_, err = devices.CheckAcl("sensor-4", "devices/sensor-4/temp", "id", 2)
+		So(err, ShouldBeError)
+
+		//Halt isn't set, so it should do nothing.
+		devices.Halt()
+	})
+
+	Convey("Given plugins taking the client id, they should authenticate users only from theirs", t, func() {
+		for _, name := range []string{"bound", "boundv2"} {
+			bound, err := LoadPlugin(paths[name], authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			granted, err := bound.GetUser("sensor-5", "secret", "client-5")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+
+			granted, err = bound.GetUser("sensor-5", "secret", "client-6")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+
+			granted, err = bound.GetUser("sensor-5", "other", "client-5")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+
+			bound.Halt()
+		}
+	})
+
+	Convey("Given a plugin whose GetPlugin has the wrong signature, it shouldn't be loaded", t, func() {
+		_, err := LoadPlugin(paths["wrongsig"], authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "incompatible plugin")
+		So(err.Error(), ShouldContainSubstring, "GetPlugin is a func() *pluginapi.PluginV2, it must be a func() pluginapi.PluginV2")
+	})
+
+	Convey("Given a legacy plugin with a func having the wrong signature, it shouldn't be loaded and the func should be told", t, func() {
+		_, err := LoadPlugin(paths["badacl"], authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "incompatible plugin")
+		So(err.Error(), ShouldContainSubstring, "CheckAcl is a func(string, string, string, int32) bool, it must be a func(string, string, string, int) bool")
+	})
+
+	Convey("Given a plugin panicking while loaded, it shouldn't be loaded", t, func() {
+		_, err := LoadPlugin(paths["panicking"], authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "incompatible plugin")
+		So(err.Error(), ShouldContainSubstring, "built against another mosquitto-go-auth")
+	})
+
+	Convey("Given a plugin that fails to init, it shouldn't be loaded", t, func() {
+		_, err := LoadPlugin(paths["registry"], map[string]string{"registry_fail": "true"}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "registry unavailable")
+	})
+
+	Convey("Given a plugin lacking a func, it shouldn't be loaded", t, func() {
+		_, err := LoadPlugin(paths["incomplete"], authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "couldn't find func Halt")
+	})
+
+	Convey("Given a missing plugin, it shouldn't be loaded", t, func() {
+		_, err := LoadPlugin(filepath.Join(dir, "missing.so"), authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "couldn't open plugin")
+	})
+}
+
+func TestPluginReload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatalf("couldn't create plugins dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	builds := make(map[string]string)
+	for _, name := range []string{"registry", "geofence", "incomplete", "bound", "devicesv2"} {
+		builds[name] = filepath.Join(dir, name+".so")
+		buildTestPlugin(t, name, builds[name], "reload")
+	}
+
+	authOpts := map[string]string{
+		"registry_devices":  "sensor-1:secret",
+		"geofence_region":   "eu",
+		"bound_devices":     "sensor-5:secret:client-5",
+		"devicesv2_devices": "sensor-3:secret",
+	}
+
+	current := filepath.Join(dir, "current.so")
+
+	//point makes the current path a symlink to the build, swapping it as a deployment would.
+	point := func(build string) {
+		link := filepath.Join(dir, "current.so.new")
+		So(os.Symlink(build, link), ShouldBeNil)
+		So(os.Rename(link, current), ShouldBeNil)
+	}
+
+	//replace copies the build next to the current path and renames it over it, as a deployment would.
+	replace := func(build string) {
+		content, err := ioutil.ReadFile(build)
+		So(err, ShouldBeNil)
+		tmp := filepath.Join(dir, "current.so.new")
+		So(ioutil.WriteFile(tmp, content, 0755), ShouldBeNil)
+		So(os.Rename(tmp, current), ShouldBeNil)
+	}
+
+	waitFor := func(condition func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return condition()
+	}
+
+	Convey("Given a plugin whose file changes while checks run", t, func() {
+		point(builds["registry"])
+
+		plug, err := LoadPlugin(current, authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		set := NewPluginSet([]CustomPlugin{plug}, authOpts, log.DebugLevel, 20*time.Millisecond)
+		defer set.Halt()
+
+		name := func() string {
+			return set.Plugins()[0].GetName()
+		}
+		So(name(), ShouldEqual, "Device registry")
+
+		var failed int32
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					//Whichever plugin a check gets, every func must be that plugin's.
+					plug := set.Plugins()[0]
+					granted, err := plug.GetUser("sensor-1", "secret", "id")
+					if err != nil || granted != (plug.GetName() == "Device registry") {
+						atomic.AddInt32(&failed, 1)
+					}
+				}
+			}()
+		}
+
+		point(builds["geofence"])
+		swapped := waitFor(func() bool { return name() == "Geofencing" })
+
+		close(stop)
+		wg.Wait()
+
+		So(swapped, ShouldBeTrue)
+		So(atomic.LoadInt32(&failed), ShouldEqual, 0)
+		So(set.Plugins()[0].Path, ShouldEqual, current)
+
+		Convey("A broken update should be ignored until a sound one shows up", func() {
+			point(builds["incomplete"])
+			time.Sleep(100 * time.Millisecond)
+			So(name(), ShouldEqual, "Geofencing")
+
+			replace(builds["bound"])
+			So(waitFor(func() bool { return name() == "Bound devices" }), ShouldBeTrue)
+
+			granted, err := set.Plugins()[0].GetUser("sensor-5", "secret", "client-5")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+
+			Convey("A file replaced at a path already loaded should be loaded too", func() {
+				replace(builds["devicesv2"])
+				So(waitFor(func() bool { return name() == "Devices v2" }), ShouldBeTrue)
+				So(set.Plugins()[0].Version(), ShouldEqual, "2.1.0")
+			})
+		})
+	})
+
+	Convey("Given no reload interval, plugins shouldn't be reloaded", t, func() {
+		set := NewPluginSet(nil, authOpts, log.DebugLevel, 0)
+		So(set.Plugins(), ShouldBeEmpty)
+		set.Halt()
+	})
+}
@@ -0,0 +1,193 @@
+package backends
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+//pluginRetireDelay is how long a replaced plugin is kept before being halted, so checks that got it just before it was replaced may still finish with it.
+const pluginRetireDelay = 10 * time.Second
+
+//PluginSet holds the loaded custom plugins. Given a reload interval, it polls their files and loads a plugin again when its path now leads to another file, e.g. a symlink pointing to a new version, or its file was modified.
+//The new plugin is swapped in only once every func was found and it inited, so a broken update is logged and the current plugin kept. Go can't unload plugins, so every version loaded stays in memory until mosquitto restarts.
+type PluginSet struct {
+	authOpts map[string]string
+	logLevel log.Level
+	interval time.Duration
+	plugins  atomic.Value
+	files    []pluginFile
+	opened   map[string]bool
+	done     chan struct{}
+	stopped  chan struct{}
+	halt     sync.Once
+}
+
+//pluginFile is the file a plugin's path led to when last checked.
+type pluginFile struct {
+	path string
+	info os.FileInfo
+}
+
+//NewPluginSet holds the loaded plugins, polling their files every interval when it's positive.
+func NewPluginSet(plugins []CustomPlugin, authOpts map[string]string, logLevel log.Level, interval time.Duration) *PluginSet {
+	s := &PluginSet{
+		authOpts: authOpts,
+		logLevel: logLevel,
+		interval: interval,
+		files:    make([]pluginFile, len(plugins)),
+		opened:   make(map[string]bool),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	s.plugins.Store(plugins)
+
+	for i, plug := range plugins {
+		file, err := statPlugin(plug.Path)
+		if err != nil {
+			log.Warnf("Plugin %s: couldn't stat its file: %s", plug.Path, err)
+		}
+		s.files[i] = file
+		s.opened[file.path] = true
+	}
+
+	if interval <= 0 {
+		close(s.stopped)
+		return s
+	}
+
+	log.Infof("Reloading plugins when their files change, checking every %s.", interval)
+	go s.run()
+
+	return s
+}
+
+//statPlugin returns the file the path leads to, following symlinks.
+func statPlugin(path string) (pluginFile, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return pluginFile{path: path}, err
+	}
+	info, err := os.Stat(resolved)
+	return pluginFile{path: resolved, info: info}, err
+}
+
+//Plugins returns the plugins checks must use. A check should get them once, so it isn't made with a plugin swapped midway.
+func (s *PluginSet) Plugins() []CustomPlugin {
+	return s.plugins.Load().([]CustomPlugin)
+}
+
+//run checks the files every interval until the set is halted.
+func (s *PluginSet) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			for i := range s.files {
+				s.check(i)
+			}
+		}
+	}
+}
+
+//check loads the plugin at index i again if its path leads to another file or the file changed since last seen, swapping it for the current one.
+func (s *PluginSet) check(i int) {
+	current := s.Plugins()[i]
+
+	file, err := statPlugin(current.Path)
+	if err != nil {
+		log.Warnf("Plugin %s: couldn't stat its file, keeping the current one: %s", current.Path, err)
+		return
+	}
+
+	last := s.files[i]
+	if last.info != nil && file.path == last.path && os.SameFile(file.info, last.info) && file.info.ModTime().Equal(last.info.ModTime()) && file.info.Size() == last.info.Size() {
+		return
+	}
+
+	//The file is taken as seen even if it can't be loaded, so a broken one isn't tried again until it changes.
+	s.files[i] = file
+
+	plug, err := s.load(file.path)
+	if err != nil {
+		log.Errorf("Plugin %s: %s changed but couldn't be loaded, keeping the current one: %s", current.Path, file.path, err)
+		return
+	}
+	plug.Path = current.Path
+
+	//The current slice may be in use by checks, so the new one is a copy.
+	plugins := append([]CustomPlugin(nil), s.Plugins()...)
+	plugins[i] = plug
+	s.plugins.Store(plugins)
+
+	log.Infof("Plugin %s: %s changed, reloaded it as %s %s.", current.Path, file.path, plug.GetName(), plug.Version())
+
+	time.AfterFunc(pluginRetireDelay, current.Halt)
+}
+
+//load loads the plugin file. Go won't open a path again once opened, so a file modified in place is loaded from a copy.
+func (s *PluginSet) load(path string) (CustomPlugin, error) {
+	if !s.opened[path] {
+		s.opened[path] = true
+		return LoadPlugin(path, s.authOpts, s.logLevel)
+	}
+
+	copied, err := copyPlugin(path)
+	if err != nil {
+		return CustomPlugin{}, err
+	}
+	//The plugin stays mapped once opened, so its copy isn't needed afterwards.
+	defer os.Remove(copied)
+
+	return LoadPlugin(copied, s.authOpts, s.logLevel)
+}
+
+//copyPlugin copies the plugin file to a new temporary one, returning its path.
+func copyPlugin(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", errors.Errorf("couldn't open plugin %s: %s", path, err)
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile("", "go-auth-plugin-*.so")
+	if err != nil {
+		return "", errors.Errorf("couldn't copy plugin %s: %s", path, err)
+	}
+
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", errors.Errorf("couldn't copy plugin %s: %s", path, err)
+	}
+
+	return dst.Name(), nil
+}
+
+//Halt stops polling the files, waiting for any reload to be done, and halts every plugin.
+func (s *PluginSet) Halt() {
+	s.halt.Do(func() {
+		close(s.done)
+		<-s.stopped
+	})
+
+	for _, plug := range s.Plugins() {
+		plug.Halt()
+	}
+}
@@ -1,14 +1,26 @@
 package backends
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 
 	"github.com/iegomez/mosquitto-go-auth/common"
@@ -29,12 +41,106 @@ type Postgres struct {
 	SSLCert        string
 	SSLKey         string
 	SSLRootCert    string
+
+	PasswordCheckMode string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	QueryTimeout    time.Duration
+
+	ConnectTries    int
+	ConnectRetry    time.Duration
+	ConnectDegraded bool
+
+	NodeDownTime time.Duration
+
+	NotifyChannel string
+
+	VaultAddr  string
+	VaultMount string
+	VaultRole  string
+
+	hosts     []pgAddr
+	replicas  []pgAddr
+	nodes     *pgNodes
+	reconnect *pgReconnect
+	notifier  *pgNotifier
+	vault     *pgVault
+	Hasher    common.Hasher //Verifies password hashes, taking PBKDF2 salts in its encoding.
+}
+
+//pgAddr is the address of a DB host.
+type pgAddr struct {
+	host string
+	port string
+}
+
+//pgNode is a DB host checks may be run against, keeping track of whether it's down.
+type pgNode struct {
+	addr      pgAddr
+	db        *sqlx.DB
+	downUntil int64
+}
+
+//pgNodes holds the nodes checks are spread over: preferred ones are used round-robin, and fallback ones, in order, only when no preferred one could answer.
+//A node failing at the connection level is marked down for downFor, and only tried again before that if no other node could answer.
+type pgNodes struct {
+	preferred []*pgNode
+	fallback  []*pgNode
+	next      uint32
+	downFor   time.Duration
+	now       func() time.Time
+}
+
+//pgMaxReconnectBackoff bounds the wait between background reconnection attempts.
+const pgMaxReconnectBackoff = time.Minute
+
+//pgReconnect keeps track of a backend started degraded, i.e. while its DB was down, which keeps trying to reach it in the background.
+type pgReconnect struct {
+	degraded int32
+	stop     chan struct{}
+	done     chan struct{}
+	halt     sync.Once
+}
+
+//pgRetireDelay is how long DBs replaced by ones connecting with new credentials are kept open at least, so checks that got them just before they were replaced may still run their query on them.
+const pgRetireDelay = 10 * time.Second
+
+//pgConns are the DBs checks run against, all connecting with the same credentials.
+type pgConns struct {
+	db    *sqlx.DB
+	nodes *pgNodes
+}
+
+//pgVault keeps the credentials the backend connects with coming from Vault, holding the DBs connecting with the current ones.
+type pgVault struct {
+	conns   atomic.Value
+	renewer *vaultRenewer
+}
+
+//PostgresOptions are the auth options the Postgres backend takes.
+var PostgresOptions = Options{
+	Keys: withKeys([]string{
+		"pg_aclquery", "pg_conn_max_lifetime_seconds", "pg_connect_degraded", "pg_connect_retry_ms",
+		"pg_connect_tries", "pg_dbname", "pg_host", "pg_max_idle_conns", "pg_max_open_conns",
+		"pg_node_down_seconds", "pg_notify_channel", "pg_password", "pg_password_check_mode", "pg_port",
+		"pg_query_timeout_ms", "pg_query_timeout_seconds", "pg_replica_host", "pg_sslcert", "pg_sslkey",
+		"pg_sslmode", "pg_sslrootcert", "pg_superquery", "pg_user", "pg_userquery", "pg_vault_addr",
+		"pg_vault_approle_mount", "pg_vault_approle_role_id", "pg_vault_approle_secret", "pg_vault_mount",
+		"pg_vault_role", "pg_vault_ssl_ca", "pg_vault_token",
+	}, common.HasherOptions, common.PrefixedHasherOptions("pg")),
 }
 
 func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := PostgresOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return Postgres{}, errors.Errorf("PG backend error: %s.\n", err)
+	}
+
 	//Set defaults for postgres
 
 	pgOk := true
@@ -46,6 +152,19 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, erro
 		SSLMode:        "disable",
 		SuperuserQuery: "",
 		AclQuery:       "",
+
+		PasswordCheckMode: "local",
+
+		MaxOpenConns:    10,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 30 * time.Minute,
+		QueryTimeout:    5 * time.Second,
+
+		ConnectRetry: 2 * time.Second,
+
+		NodeDownTime: 10 * time.Second,
+
+		VaultMount: "database",
 	}
 
 	if host, ok := authOpts["pg_host"]; ok {
@@ -56,6 +175,32 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, erro
 		postgres.Port = port
 	}
 
+	hasher, err := common.NewHasher(authOpts, "pg")
+	if err != nil {
+		return postgres, errors.Errorf("PG backend error: %s.\n", err)
+	}
+	postgres.Hasher = hasher
+
+	//Several hosts may be given, with the first one being the primary. Hosts without a port use pg_port.
+	defaultPort := postgres.Port
+	hosts, err := parsePGHosts(postgres.Host, defaultPort)
+	if err != nil {
+		return postgres, errors.Errorf("PG backend error: invalid pg_host: %s.\n", err)
+	}
+	postgres.hosts = hosts
+	postgres.Host = hosts[0].host
+	postgres.Port = hosts[0].port
+
+	if replicaHost, ok := authOpts["pg_replica_host"]; ok {
+		replicas, err := parsePGHosts(replicaHost, defaultPort)
+		if err != nil {
+			return postgres, errors.Errorf("PG backend error: invalid pg_replica_host: %s.\n", err)
+		}
+		postgres.replicas = replicas
+	}
+
+	postgres.NodeDownTime = common.DurationOption(authOpts, "pg_node_down_seconds", time.Second, time.Second, postgres.NodeDownTime)
+
 	if dbName, ok := authOpts["pg_dbname"]; ok {
 		postgres.DBName = dbName
 	} else {
@@ -63,59 +208,130 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, erro
 		missingOptions += " pg_dbname"
 	}
 
-	if user, ok := authOpts["pg_user"]; ok {
-		postgres.User = user
-	} else {
-		pgOk = false
-		missingOptions += " pg_user"
+	if vaultAddr, ok := authOpts["pg_vault_addr"]; ok {
+		postgres.VaultAddr = strings.TrimSpace(vaultAddr)
 	}
 
-	if password, ok := authOpts["pg_password"]; ok {
-		postgres.Password = password
+	//Credentials issued by Vault take the place of the configured ones.
+	if postgres.VaultAddr != "" {
+		_, hasUser := authOpts["pg_user"]
+		_, hasPassword := authOpts["pg_password"]
+		if hasUser || hasPassword {
+			return postgres, errors.New("PG backend error: pg_user and pg_password can't be given along with pg_vault_addr.\n")
+		}
 	} else {
-		pgOk = false
-		missingOptions += " pg_password"
+		if user, ok := authOpts["pg_user"]; ok {
+			postgres.User = user
+		} else {
+			pgOk = false
+			missingOptions += " pg_user"
+		}
+
+		if password, ok := authOpts["pg_password"]; ok {
+			postgres.Password = password
+		} else {
+			pgOk = false
+			missingOptions += " pg_password"
+		}
 	}
 
+	//Checks whose query is left empty aren't handled by this backend.
 	if userQuery, ok := authOpts["pg_userquery"]; ok {
-		postgres.UserQuery = userQuery
-	} else {
-		pgOk = false
-		missingOptions += " pg_userquery"
+		postgres.UserQuery = strings.TrimSpace(userQuery)
+	}
+
+	if checkMode, ok := authOpts["pg_password_check_mode"]; ok {
+		switch checkMode {
+		case "local", "server":
+			postgres.PasswordCheckMode = checkMode
+		default:
+			return postgres, errors.Errorf("PG backend error: unknown pg_password_check_mode %s, must be local or server.\n", checkMode)
+		}
+	}
+
+	//In server mode the query must get the password to check it.
+	if postgres.PasswordCheckMode == "server" && postgres.UserQuery != "" && !strings.Contains(postgres.UserQuery, "$2") {
+		return postgres, errors.New("PG backend error: pg_userquery must take the password as $2 when pg_password_check_mode is server.\n")
 	}
 
 	if superuserQuery, ok := authOpts["pg_superquery"]; ok {
-		postgres.SuperuserQuery = superuserQuery
+		postgres.SuperuserQuery = strings.TrimSpace(superuserQuery)
 	}
 
 	if aclQuery, ok := authOpts["pg_aclquery"]; ok {
-		postgres.AclQuery = aclQuery
+		postgres.AclQuery = strings.TrimSpace(aclQuery)
 	}
 
-	checkSSL := true
-
 	if sslmode, ok := authOpts["pg_sslmode"]; ok {
-		postgres.SSLMode = sslmode
-	} else {
-		postgres.SSLMode = "disable"
+		//Keep accepting required, which was once documented.
+		if sslmode == "required" {
+			sslmode = "require"
+		}
+		switch sslmode {
+		case "disable", "require", "verify-ca", "verify-full":
+			postgres.SSLMode = sslmode
+		default:
+			return postgres, errors.Errorf("PG backend error: unknown pg_sslmode %s, must be one of disable, require, verify-ca or verify-full.\n", sslmode)
+		}
 	}
 
 	if sslCert, ok := authOpts["pg_sslcert"]; ok {
 		postgres.SSLCert = sslCert
-	} else {
-		checkSSL = false
 	}
 
 	if sslKey, ok := authOpts["pg_sslkey"]; ok {
 		postgres.SSLKey = sslKey
-	} else {
-		checkSSL = false
 	}
 
-	if sslCert, ok := authOpts["pg_sslrootcert"]; ok {
-		postgres.SSLCert = sslCert
-	} else {
-		checkSSL = false
+	if sslRootCert, ok := authOpts["pg_sslrootcert"]; ok {
+		postgres.SSLRootCert = sslRootCert
+	}
+
+	if err := postgres.checkSSLFiles(); err != nil {
+		return postgres, err
+	}
+
+	//A max of 0 open conns means unbounded, as in database/sql.
+	postgres.MaxOpenConns = common.IntOption(authOpts, "pg_max_open_conns", 0, math.MaxInt32, postgres.MaxOpenConns)
+
+	postgres.MaxIdleConns = common.IntOption(authOpts, "pg_max_idle_conns", 0, math.MaxInt32, postgres.MaxIdleConns)
+
+	//Idle conns beyond the open ones would never be used.
+	if postgres.MaxOpenConns > 0 && postgres.MaxIdleConns > postgres.MaxOpenConns {
+		postgres.MaxIdleConns = postgres.MaxOpenConns
+	}
+
+	postgres.ConnMaxLifetime = common.DurationOption(authOpts, "pg_conn_max_lifetime_seconds", time.Second, 0, postgres.ConnMaxLifetime)
+
+	postgres.QueryTimeout = common.DurationOption(authOpts, "pg_query_timeout_seconds", time.Second, time.Second, postgres.QueryTimeout)
+
+	if _, ok := authOpts["pg_query_timeout_ms"]; ok {
+		if _, ok := authOpts["pg_query_timeout_seconds"]; ok {
+			return postgres, errors.New("PG backend error: pg_query_timeout_ms and pg_query_timeout_seconds can't be both set.\n")
+		}
+		postgres.QueryTimeout = common.DurationOption(authOpts, "pg_query_timeout_ms", time.Millisecond, time.Millisecond, postgres.QueryTimeout)
+	}
+
+	postgres.ConnectTries = common.IntOption(authOpts, "pg_connect_tries", 0, math.MaxInt32, postgres.ConnectTries)
+
+	postgres.ConnectRetry = common.DurationOption(authOpts, "pg_connect_retry_ms", time.Millisecond, time.Millisecond, postgres.ConnectRetry)
+
+	if common.BoolOption(authOpts, "pg_connect_degraded", false) {
+		postgres.ConnectDegraded = true
+		//Retrying forever would never get to start degraded, so try once unless told otherwise.
+		if _, ok := authOpts["pg_connect_tries"]; !ok {
+			postgres.ConnectTries = 1
+		}
+		if postgres.ConnectTries == 0 {
+			return postgres, errors.New("PG backend error: pg_connect_degraded needs pg_connect_tries to be greater than 0.\n")
+		}
+	}
+
+	if notifyChannel, ok := authOpts["pg_notify_channel"]; ok {
+		postgres.NotifyChannel = strings.TrimSpace(notifyChannel)
+		if postgres.NotifyChannel == "" {
+			return postgres, errors.New("PG backend error: pg_notify_channel can't be empty.\n")
+		}
 	}
 
 	//Exit if any mandatory option is missing.
@@ -123,49 +339,641 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, erro
 		return postgres, errors.Errorf("PG backend error: missing options%s.\n", missingOptions)
 	}
 
+	logHandledChecks("PG", postgres.UserQuery, postgres.SuperuserQuery, postgres.AclQuery)
+
+	var vault *vaultClient
+	var lease vaultLease
+	if postgres.VaultAddr != "" {
+		if vaultMount, ok := authOpts["pg_vault_mount"]; ok {
+			postgres.VaultMount = vaultMount
+		}
+
+		if vaultRole, ok := authOpts["pg_vault_role"]; ok {
+			postgres.VaultRole = vaultRole
+		}
+		if postgres.VaultRole == "" {
+			return postgres, errors.New("PG backend error: missing options: pg_vault_role.\n")
+		}
+
+		approleMount := "approle"
+		if mount, ok := authOpts["pg_vault_approle_mount"]; ok {
+			approleMount = mount
+		}
+
+		vault, err = newVaultClient(postgres.VaultAddr, authOpts["pg_vault_ssl_ca"], authOpts["pg_vault_token"], approleMount, authOpts["pg_vault_approle_role_id"], authOpts["pg_vault_approle_secret"])
+		if err != nil {
+			return postgres, errors.Errorf("PG backend error: %s.\n", err)
+		}
+
+		//Without credentials there's nothing to connect with, so Vault must be reachable on startup.
+		lease, err = vault.databaseCredentials(postgres.VaultMount, postgres.VaultRole)
+		if err != nil {
+			return postgres, errors.Errorf("PG backend error: %s.\n", err)
+		}
+		postgres.User = lease.username
+		postgres.Password = lease.password
+		log.Infof("PG backend: got Vault credentials for role %s, connecting as %s.", postgres.VaultRole, lease.username)
+	}
+
 	//Build the dsn string and try to connect to the DB.
-	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%s", postgres.User, postgres.Password, postgres.DBName, postgres.Host, postgres.Port)
+	connStr := postgres.connectionString()
 
-	if (postgres.SSLMode == "verify-ca" || postgres.SSLMode == "verify-full") && checkSSL {
-		connStr = fmt.Sprintf("%s sslmode=verify-ca sslcert=%s sslkey=%s sslrootcert=%s", connStr, postgres.SSLCert, postgres.SSLKey, postgres.SSLRootCert)
-	} else if postgres.SSLMode == "required" {
-		connStr = fmt.Sprintf("%s sslmode=require", connStr)
-	} else {
-		connStr = fmt.Sprintf("%s sslmode=disable", connStr)
+	//TLS and auth failures won't go away by retrying, so fail right away on them.
+	if err := checkPostgresConnection(connStr); err != nil {
+		return postgres, err
 	}
 
+	postgres, err = connectPostgres(postgres, connStr, "postgres")
+	if err != nil {
+		return postgres, err
+	}
+
+	//The listener keeps its own connection to the primary, reconnecting on its own when it's lost.
+	if postgres.NotifyChannel != "" {
+		postgres.notifier = newPGNotifier(connStr, postgres.NotifyChannel, postgres.ConnectRetry)
+		log.Infof("PG backend: listening for user changes on channel %s.", postgres.NotifyChannel)
+	}
+
+	if vault != nil {
+		postgres.vault = &pgVault{}
+		postgres.vault.conns.Store(pgConns{db: postgres.DB, nodes: postgres.nodes})
+		postgres.vault.renewer = newVaultRenewer("PG", vault, postgres.VaultMount, postgres.VaultRole, lease, postgres.rotateCredentials)
+	}
+
+	return postgres, nil
+
+}
+
+//connectPostgres connects the backend to the DB following its connect policy. When every try failed and it may start degraded, it's returned with checks denied until a background reconnection reaches the DB.
+func connectPostgres(postgres Postgres, connStr, engine string) (Postgres, error) {
 	var dbErr error
-	postgres.DB, dbErr = common.OpenDatabase(connStr, "postgres")
+	postgres.DB, dbErr = common.ConnectDatabase(connStr, engine, postgres.ConnectTries, postgres.ConnectRetry)
 
 	if dbErr != nil {
-		return postgres, errors.Errorf("PG backend error: couldn't open DB: %s\n", dbErr)
+		if postgres.DB == nil || !postgres.ConnectDegraded {
+			if postgres.DB != nil {
+				postgres.DB.Close()
+			}
+			return postgres, errors.Errorf("PG backend error: couldn't open DB: %s\n", dbErr)
+		}
+
+		log.Warnf("PG backend: couldn't reach DB, starting degraded and denying checks until it's up: %s", dbErr)
+		var err error
+		if postgres.nodes, err = postgres.openNodes(engine); err != nil {
+			postgres.DB.Close()
+			return postgres, err
+		}
+		postgres.setPool()
+		postgres.reconnect = &pgReconnect{
+			degraded: 1,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		go postgres.reconnectLoop()
+
+		return postgres, nil
 	}
 
+	var err error
+	if postgres.nodes, err = postgres.openNodes(engine); err != nil {
+		postgres.DB.Close()
+		return postgres, err
+	}
+	postgres.setPool()
+
 	return postgres, nil
+}
+
+//openNodes returns the nodes checks are spread over when several hosts or replicas are given, or nil otherwise.
+//The primary's DB is already open, and the rest connect lazily so a node that's down doesn't hold the backend back.
+func (o Postgres) openNodes(engine string) (*pgNodes, error) {
+	if len(o.hosts)+len(o.replicas) < 2 {
+		return nil, nil
+	}
+
+	open := func(addrs []pgAddr) ([]*pgNode, error) {
+		nodes := make([]*pgNode, 0, len(addrs))
+		for _, addr := range addrs {
+			db, err := sqlx.Open(engine, o.dsn(addr.host, addr.port))
+			if err != nil {
+				return nil, errors.Errorf("PG backend error: couldn't open DB at %s: %s\n", addr, err)
+			}
+			nodes = append(nodes, &pgNode{addr: addr, db: db})
+		}
+		return nodes, nil
+	}
 
+	others, err := open(o.hosts[1:])
+	if err != nil {
+		return nil, err
+	}
+	hosts := append([]*pgNode{{addr: o.hosts[0], db: o.DB}}, others...)
+
+	if len(o.replicas) == 0 {
+		return newPGNodes(hosts, nil, o.NodeDownTime), nil
+	}
+
+	replicas, err := open(o.replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPGNodes(replicas, hosts, o.NodeDownTime), nil
+}
+
+//newPGNodes returns the nodes for the given preferred and fallback ones.
+func newPGNodes(preferred, fallback []*pgNode, downFor time.Duration) *pgNodes {
+	return &pgNodes{
+		preferred: preferred,
+		fallback:  fallback,
+		downFor:   downFor,
+		now:       time.Now,
+	}
+}
+
+//order returns the nodes to try a check on: preferred ones starting at the next one round-robin and then fallback ones, with those marked down last.
+func (n *pgNodes) order() []*pgNode {
+	now := n.now().UnixNano()
+	healthy := make([]*pgNode, 0, len(n.preferred)+len(n.fallback))
+	var down []*pgNode
+
+	add := func(node *pgNode) {
+		if atomic.LoadInt64(&node.downUntil) > now {
+			down = append(down, node)
+			return
+		}
+		healthy = append(healthy, node)
+	}
+
+	if len(n.preferred) > 0 {
+		start := int((atomic.AddUint32(&n.next, 1) - 1) % uint32(len(n.preferred)))
+		for i := range n.preferred {
+			add(n.preferred[(start+i)%len(n.preferred)])
+		}
+	}
+	for _, node := range n.fallback {
+		add(node)
+	}
+
+	return append(healthy, down...)
+}
+
+//markDown keeps the node from being tried before others for a while.
+func (n *pgNodes) markDown(node *pgNode, err error) {
+	atomic.StoreInt64(&node.downUntil, n.now().Add(n.downFor).UnixNano())
+	log.Warnf("PG backend: node %s is down, trying other nodes for %s: %s", node.addr, n.downFor, err)
+}
+
+//markUp clears a node's down mark once it answered.
+func (n *pgNodes) markUp(node *pgNode) {
+	if atomic.SwapInt64(&node.downUntil, 0) != 0 {
+		log.Infof("PG backend: node %s is back up.", node.addr)
+	}
+}
+
+//dbs returns every node's DB.
+func (n *pgNodes) dbs() []*sqlx.DB {
+	dbs := make([]*sqlx.DB, 0, len(n.preferred)+len(n.fallback))
+	for _, node := range n.preferred {
+		dbs = append(dbs, node.db)
+	}
+	for _, node := range n.fallback {
+		dbs = append(dbs, node.db)
+	}
+	return dbs
+}
+
+//dbs returns the DBs of every node, or just the one when there's a single host.
+func (o Postgres) dbs() []*sqlx.DB {
+	return o.current().dbs()
+}
+
+//dbs returns the DBs of every node, or just the primary's when there's a single host.
+func (c pgConns) dbs() []*sqlx.DB {
+	if c.nodes == nil {
+		return []*sqlx.DB{c.db}
+	}
+	return c.nodes.dbs()
+}
+
+//current returns the DBs to run checks against, which are replaced when Vault issues new credentials.
+func (o Postgres) current() pgConns {
+	if o.vault != nil {
+		return o.vault.conns.Load().(pgConns)
+	}
+	return pgConns{db: o.DB, nodes: o.nodes}
+}
+
+//db returns the primary's DB to run queries against.
+func (o Postgres) db() *sqlx.DB {
+	return o.current().db
+}
+
+//rotateCredentials connects with the credentials of the new lease, and once they're known to work, has checks run on the new DBs. The previous ones are closed when the checks that got them are done.
+//The notification listener, if any, connects again with them too.
+func (o Postgres) rotateCredentials(lease vaultLease) error {
+	o.User = lease.username
+	o.Password = lease.password
+	connStr := o.connectionString()
+
+	db, err := sqlx.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := o.queryContext()
+	err = db.PingContext(ctx)
+	cancel()
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	o.DB = db
+	if o.nodes, err = o.openNodes("postgres"); err != nil {
+		db.Close()
+		return err
+	}
+	o.setPool()
+
+	old := o.vault.conns.Load().(pgConns)
+	o.vault.conns.Store(pgConns{db: o.DB, nodes: o.nodes})
+
+	if o.notifier != nil {
+		o.notifier.reconnect(connStr)
+	}
+
+	retireDelay := pgRetireDelay
+	if o.QueryTimeout > retireDelay {
+		retireDelay = o.QueryTimeout
+	}
+	time.AfterFunc(retireDelay, func() {
+		for _, db := range old.dbs() {
+			if err := db.Close(); err != nil {
+				log.Errorf("Postgres cleanup error: %s", err)
+			}
+		}
+	})
+
+	return nil
+}
+
+//String returns the address as host:port.
+func (a pgAddr) String() string {
+	return net.JoinHostPort(a.host, a.port)
+}
+
+//parsePGHosts parses a comma separated list of hosts, each one optionally with its port, e.g. db1,db2:5433,[::1]:5434.
+func parsePGHosts(list, defaultPort string) ([]pgAddr, error) {
+	var addrs []pgAddr
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, errors.Errorf("empty host in %s", list)
+		}
+		addr := pgAddr{host: entry, port: defaultPort}
+		//Bare IPv6 addresses have several colons and no port.
+		if strings.HasPrefix(entry, "[") || strings.Count(entry, ":") == 1 {
+			host, port, err := net.SplitHostPort(entry)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := strconv.Atoi(port); err != nil {
+				return nil, errors.Errorf("invalid port %s for host %s", port, host)
+			}
+			addr = pgAddr{host: host, port: port}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+//pgConnectionError tells if a query failed because of its connection to the node, rather than the query itself.
+func pgConnectionError(err error) bool {
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		//Class 08 is connection exception, and 57P01 to 57P03 are the server shutting down or not accepting connections.
+		switch {
+		case pqErr.Code.Class() == "08", pqErr.Code == "57P01", pqErr.Code == "57P02", pqErr.Code == "57P03":
+			return true
+		}
+	}
+
+	return false
+}
+
+//query runs a check's query, moving on to the next node when there are several and one fails at the connection level.
+func (o Postgres) query(ctx context.Context, run func(db *sqlx.DB) error) error {
+	conns := o.current()
+	if conns.nodes == nil {
+		return run(conns.db)
+	}
+
+	var err error
+	for _, node := range conns.nodes.order() {
+		err = run(node.db)
+		if err == nil || !pgConnectionError(err) {
+			conns.nodes.markUp(node)
+			return err
+		}
+		conns.nodes.markDown(node, err)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+//reconnectLoop pings the DB, doubling the wait between attempts from the connect retry up to pgMaxReconnectBackoff, until it's reached or the backend is halted.
+func (o Postgres) reconnectLoop() {
+	defer close(o.reconnect.done)
+
+	backoff := o.ConnectRetry
+	for {
+		select {
+		case <-o.reconnect.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := o.queryContext()
+		err := o.db().PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			atomic.StoreInt32(&o.reconnect.degraded, 0)
+			log.Infof("PG backend: reached DB, no longer degraded.")
+			return
+		}
+
+		backoff *= 2
+		if backoff > pgMaxReconnectBackoff {
+			backoff = pgMaxReconnectBackoff
+		}
+		log.Errorf("PG backend: DB still unreachable, will retry in %s: %s", backoff, err)
+	}
+}
+
+//degraded tells if the backend hasn't reached its DB yet.
+func (o Postgres) degraded() bool {
+	return o.reconnect != nil && atomic.LoadInt32(&o.reconnect.degraded) == 1
+}
+
+//checkSSLFiles checks that the given certificate and key files may be read, and that the key isn't accessible by others, as the driver would refuse it.
+func (o Postgres) checkSSLFiles() error {
+	if (o.SSLCert == "") != (o.SSLKey == "") {
+		return errors.New("PG backend error: pg_sslcert and pg_sslkey must be given together.\n")
+	}
+
+	files := []struct {
+		opt  string
+		path string
+	}{
+		{"pg_sslcert", o.SSLCert},
+		{"pg_sslkey", o.SSLKey},
+		{"pg_sslrootcert", o.SSLRootCert},
+	}
+
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		file, err := os.Open(f.path)
+		if err != nil {
+			return errors.Errorf("PG backend error: couldn't read %s: %s\n", f.opt, err)
+		}
+		info, err := file.Stat()
+		file.Close()
+		if err != nil {
+			return errors.Errorf("PG backend error: couldn't read %s: %s\n", f.opt, err)
+		}
+		if info.IsDir() {
+			return errors.Errorf("PG backend error: %s %s is a directory.\n", f.opt, f.path)
+		}
+		if f.opt == "pg_sslkey" && info.Mode().Perm()&0077 != 0 {
+			return errors.Errorf("PG backend error: pg_sslkey %s has group or world access, it must be 0600 or less.\n", f.path)
+		}
+	}
+
+	return nil
+}
+
+//connectionString builds the DSN for the driver to connect to the primary host.
+func (o Postgres) connectionString() string {
+	return o.dsn(o.Host, o.Port)
+}
+
+//dsn builds the DSN for the driver to connect to the given host, quoting values as needed.
+func (o Postgres) dsn(host, port string) string {
+	params := [][2]string{
+		{"user", o.User},
+		{"password", o.Password},
+		{"dbname", o.DBName},
+		{"host", host},
+		{"port", port},
+		{"sslmode", o.SSLMode},
+	}
+
+	//Files aren't used without TLS, and the driver would otherwise load any default ones.
+	if o.SSLMode != "disable" {
+		if o.SSLCert != "" {
+			params = append(params, [2]string{"sslcert", o.SSLCert}, [2]string{"sslkey", o.SSLKey})
+		}
+		if o.SSLRootCert != "" {
+			params = append(params, [2]string{"sslrootcert", o.SSLRootCert})
+		}
+	}
+
+	parts := make([]string, 0, len(params))
+	for _, p := range params {
+		parts = append(parts, fmt.Sprintf("%s=%s", p[0], pgQuote(p[1])))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+//pgQuote single quotes the value when it's empty or has spaces, quotes or backslashes, escaping the latter two.
+func pgQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " '\\") {
+		return value
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+//checkPostgresConnection tries to connect once, returning an error only when it failed due to TLS or authentication, so other errors, such as the DB not being up yet, are retried.
+func checkPostgresConnection(connStr string) error {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return errors.Errorf("PG backend error: couldn't open DB: %s\n", err)
+	}
+	defer db.Close()
+
+	err = db.Ping()
+	switch pgErrorKind(err) {
+	case "tls":
+		return errors.Errorf("PG backend error: TLS failure connecting to DB: %s\n", err)
+	case "auth":
+		return errors.Errorf("PG backend error: authentication failure connecting to DB: %s\n", err)
+	}
+
+	return nil
+}
+
+//pgErrorKind tells if a connection error is a TLS or an authentication one, returning an empty string otherwise.
+func pgErrorKind(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		//Class 28 is invalid authorization specification (e.g., wrong password or no pg_hba.conf entry).
+		if pqErr.Code.Class() == "28" {
+			return "auth"
+		}
+		return ""
+	}
+
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+		return "tls"
+	}
+
+	msg := err.Error()
+	if err == pq.ErrSSLNotSupported || strings.HasPrefix(msg, "tls:") || strings.HasPrefix(msg, "x509:") || strings.Contains(msg, "pq: Private key file") {
+		return "tls"
+	}
+
+	return ""
+}
+
+//setPool applies the pool limits to the DBs the backend holds, which may be new ones checks don't run on yet.
+func (o Postgres) setPool() {
+	for _, db := range (pgConns{db: o.DB, nodes: o.nodes}).dbs() {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+		db.SetMaxIdleConns(o.MaxIdleConns)
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+
+	log.Infof("PG pool: max open conns %d, max idle conns %d, conn max lifetime %s, query timeout %s.", o.MaxOpenConns, o.MaxIdleConns, o.ConnMaxLifetime, o.QueryTimeout)
+}
+
+//logHandledChecks logs which checks a SQL backend handles given its queries, warning when it handles none.
+func logHandledChecks(backend, userQuery, superuserQuery, aclQuery string) {
+	var checks []string
+	if userQuery != "" {
+		checks = append(checks, "user")
+	}
+	if superuserQuery != "" {
+		checks = append(checks, "superuser")
+	}
+	if aclQuery != "" {
+		checks = append(checks, "acl")
+	}
+
+	if len(checks) == 0 {
+		log.Warnf("%s backend: no queries given, so no checks are handled.", backend)
+		return
+	}
+	log.Infof("%s backend: handling %s checks.", backend, strings.Join(checks, ", "))
+}
+
+//queryContext bounds a check's query, including any wait for a free connection when the pool is exhausted, by the query timeout.
+func (o Postgres) queryContext() (context.Context, context.CancelFunc) {
+	if o.QueryTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), o.QueryTimeout)
+}
+
+//queryFailed logs a check's query error and returns the cache hint for its denial: a query that timed out must not have its denial cached, as the DB could have granted it.
+func (o Postgres) queryFailed(ctx context.Context, check string, start time.Time, err error) time.Duration {
+	//The driver gives its own error when it cancels a query, so look at the context instead.
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Errorf("PG %s timed out after %s (timeout %s): %s", check, time.Since(start), o.QueryTimeout, err)
+		return SkipCache
+	}
+	log.Debugf("PG %s error: %s\n", check, err)
+	return NoTTL
 }
 
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Postgres) GetUser(username, password string) bool {
+	granted, _ := o.GetUserTTL(username, password)
+	return granted
+}
+
+//GetUserTTL checks the user just as GetUser, and also returns SkipCache when the query timed out so the denial isn't cached, or NoTTL otherwise.
+func (o Postgres) GetUserTTL(username, password string) (bool, time.Duration) {
+
+	//If there's no user query, users aren't handled by this backend.
+	if o.UserQuery == "" {
+		return false, NoTTL
+	}
+
+	if o.degraded() {
+		log.Debugf("PG get user error: backend degraded, DB not reached yet.\n")
+		return false, SkipCache
+	}
+
+	ctx, cancel := o.queryContext()
+	defer cancel()
+
+	start := time.Now()
+
+	if o.PasswordCheckMode == "server" {
+		return o.checkServerPassword(ctx, start, username, password)
+	}
 
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &pwHash, o.UserQuery, username)
+	})
 
 	if err != nil {
-		log.Debugf("PG get user error: %s\n", err)
-		return false
+		return false, o.queryFailed(ctx, "get user", start, err)
 	}
 
 	if !pwHash.Valid {
-		log.Debugf("PG get user error: user %s not found.\n", username)
-		return false
+		log.Debugf("PG get user error: user %s not found.\n", common.RedactUsername(username))
+		return false, NoTTL
 	}
 
-	if common.HashCompare(password, pwHash.String) {
-		return true
+	if o.Hasher.Compare(password, pwHash.String) {
+		return true, NoTTL
 	}
 
-	return false
+	return false, NoTTL
+
+}
+
+//checkServerPassword lets the user query check the password, e.g. with pgcrypto's crypt(), granting the user when it gives a positive count.
+//The password is only ever sent as a bind parameter, and mustn't be logged.
+func (o Postgres) checkServerPassword(ctx context.Context, start time.Time, username, password string) (bool, time.Duration) {
+
+	var count sql.NullInt64
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &count, o.UserQuery, username, password)
+	})
+
+	if err != nil {
+		return false, o.queryFailed(ctx, "get user", start, err)
+	}
+
+	if !count.Valid || count.Int64 <= 0 {
+		log.Debugf("PG get user error: user %s not found or wrong password.\n", common.RedactUsername(username))
+		return false, NoTTL
+	}
+
+	return true, NoTTL
 
 }
 
@@ -177,16 +985,28 @@ func (o Postgres) GetSuperuser(username string) bool {
 		return false
 	}
 
+	if o.degraded() {
+		log.Debugf("PG get superuser error: backend degraded, DB not reached yet.\n")
+		return false
+	}
+
+	ctx, cancel := o.queryContext()
+	defer cancel()
+
+	start := time.Now()
+
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &count, o.SuperuserQuery, username)
+	})
 
 	if err != nil {
-		log.Debugf("PG get superuser error: %s\n", err)
+		o.queryFailed(ctx, "get superuser", start, err)
 		return false
 	}
 
 	if !count.Valid {
-		log.Debugf("PG get superuser error: user %s not found.\n", username)
+		log.Debugf("PG get superuser error: user %s not found.\n", common.RedactUsername(username))
 		return false
 	}
 
@@ -200,30 +1020,46 @@ func (o Postgres) GetSuperuser(username string) bool {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) bool {
+	granted, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return granted
+}
+
+//CheckAclTTL checks the acl just as CheckAcl, and also returns SkipCache when the query timed out so the denial isn't cached, or NoTTL otherwise.
+func (o Postgres) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
 
-	//If there's no acl query, assume all privileges for all users.
+	//If there's no acl query, acls aren't handled by this backend.
 	if o.AclQuery == "" {
-		return true
+		return false, NoTTL
+	}
+
+	if o.degraded() {
+		log.Debugf("PG check acl error: backend degraded, DB not reached yet.\n")
+		return false, SkipCache
 	}
 
+	ctx, cancel := o.queryContext()
+	defer cancel()
+
+	start := time.Now()
+
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err := o.query(ctx, func(db *sqlx.DB) error {
+		acls = nil
+		return db.SelectContext(ctx, &acls, o.AclQuery, username, acc)
+	})
 
 	if err != nil {
-		log.Debugf("PG check acl error: %s\n", err)
-		return false
+		return false, o.queryFailed(ctx, "check acl", start, err)
 	}
 
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
-			return true
+		if common.AclMatches(acl, topic, username, clientid) {
+			return true, NoTTL
 		}
 	}
 
-	return false
+	return false, NoTTL
 
 }
 
@@ -232,12 +1068,26 @@ func (o Postgres) GetName() string {
 	return "Postgres"
 }
 
-//Halt closes the mysql connection.
+//Halt stops renewing Vault credentials and listening for notifications, and closes the connections to every host.
 func (o Postgres) Halt() {
+	if o.vault != nil {
+		o.vault.renewer.stop()
+	}
+	if o.notifier != nil {
+		o.notifier.stop()
+	}
+	if o.reconnect != nil {
+		o.reconnect.halt.Do(func() {
+			close(o.reconnect.stop)
+			<-o.reconnect.done
+		})
+	}
 	if o.DB != nil {
-		err := o.DB.Close()
-		if err != nil {
-			log.Errorf("Postgres cleanup error: %s", err)
+		for _, db := range o.dbs() {
+			err := db.Close()
+			if err != nil {
+				log.Errorf("Postgres cleanup error: %s", err)
+			}
 		}
 	}
 }
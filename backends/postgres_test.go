@@ -1,9 +1,27 @@
 package backends
 
 import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -69,6 +87,35 @@ func TestPostgres(t *testing.T) {
 			So(superuser, ShouldBeTrue)
 		})
 
+		Convey("Given server password checks with pgcrypto, only the right password should authenticate", func() {
+			postgres.DB.MustExec("CREATE EXTENSION IF NOT EXISTS pgcrypto")
+			postgres.DB.MustExec("UPDATE test_user SET password_hash = crypt($1, gen_salt('bf')) WHERE id = $2", userPass, userID)
+			defer postgres.DB.MustExec("UPDATE test_user SET password_hash = $1 WHERE id = $2", userPassHash, userID)
+
+			server := postgres
+			server.PasswordCheckMode = "server"
+			server.UserQuery = "SELECT count(*) FROM test_user WHERE username = $1 AND password_hash = crypt($2, password_hash)"
+
+			So(server.GetUser(username, userPass), ShouldBeTrue)
+			So(server.GetUser(username, "wrong_password"), ShouldBeFalse)
+			So(server.GetUser("unknown", userPass), ShouldBeFalse)
+		})
+
+		Convey("Given a query slower than the query timeout, it should be denied and not cached", func() {
+			slow := postgres
+			slow.QueryTimeout = 100 * time.Millisecond
+			slow.UserQuery = "SELECT password_hash FROM test_user, pg_sleep(1) WHERE username = $1 limit 1"
+
+			start := time.Now()
+			authenticated, ttl := slow.GetUserTTL(username, userPass)
+			So(authenticated, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+
+			//The connection should still be usable afterwards.
+			So(postgres.GetUser(username, userPass), ShouldBeTrue)
+		})
+
 		//Now create some acls and test topics
 
 		strictAcl := "test/topic/1"
@@ -163,3 +210,1138 @@ func TestPostgres(t *testing.T) {
 	})
 
 }
+
+//countingDriver is a fake sql driver keeping track of how many connections are open at once. Every query takes delay and returns a single row holding value, or one per rows when given. While down is set, connections are refused and open ones are broken.
+//Open connections may also be dropped as a server closing idle ones would: their next query fails with dropErr, and they're broken afterwards.
+type countingDriver struct {
+	delay time.Duration
+	value string
+	rows  []string
+	down  int32
+
+	mu    sync.Mutex
+	args  []interface{}
+	conns []*countingConn
+
+	dropErr error
+
+	open     int32
+	maxOpen  int32
+	attempts int32
+	queries  int32
+}
+
+func (d *countingDriver) Open(name string) (driver.Conn, error) {
+	atomic.AddInt32(&d.attempts, 1)
+	if atomic.LoadInt32(&d.down) == 1 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	open := atomic.AddInt32(&d.open, 1)
+	for {
+		max := atomic.LoadInt32(&d.maxOpen)
+		if open <= max || atomic.CompareAndSwapInt32(&d.maxOpen, max, open) {
+			break
+		}
+	}
+	conn := &countingConn{driver: d}
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+	return conn, nil
+}
+
+//dropConns drops every open connection.
+func (d *countingDriver) dropConns() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conn := range d.conns {
+		conn.dropped = true
+	}
+}
+
+type countingConn struct {
+	driver  *countingDriver
+	dropped bool
+	broken  bool
+}
+
+func (c *countingConn) Prepare(query string) (driver.Stmt, error) {
+	return &countingStmt{driver: c.driver, conn: c}, nil
+}
+
+func (c *countingConn) Close() error {
+	atomic.AddInt32(&c.driver.open, -1)
+	return nil
+}
+
+func (c *countingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type countingStmt struct {
+	driver *countingDriver
+	conn   *countingConn
+}
+
+func (s *countingStmt) Close() error  { return nil }
+func (s *countingStmt) NumInput() int { return -1 }
+
+func (s *countingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec not supported")
+}
+
+func (s *countingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), nil)
+}
+
+//QueryContext lets the query be cancelled while it's taking its delay, as a real driver would.
+func (s *countingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt32(&s.driver.attempts, 1)
+	if atomic.LoadInt32(&s.driver.down) == 1 {
+		return nil, driver.ErrBadConn
+	}
+	atomic.AddInt32(&s.driver.queries, 1)
+
+	s.driver.mu.Lock()
+	if s.conn.broken {
+		s.driver.mu.Unlock()
+		return nil, driver.ErrBadConn
+	}
+	if s.conn.dropped {
+		s.conn.broken = true
+		s.driver.mu.Unlock()
+		return nil, s.driver.dropErr
+	}
+	s.driver.args = s.driver.args[:0]
+	for _, arg := range args {
+		s.driver.args = append(s.driver.args, arg.Value)
+	}
+	s.driver.mu.Unlock()
+
+	select {
+	case <-time.After(s.driver.delay):
+		if s.driver.rows != nil {
+			return &countingRows{values: s.driver.rows}, nil
+		}
+		return &countingRows{values: []string{s.driver.value}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type countingRows struct {
+	values []string
+	next   int
+}
+
+func (r *countingRows) Columns() []string { return []string{"value"} }
+func (r *countingRows) Close() error      { return nil }
+
+func (r *countingRows) Next(dest []driver.Value) error {
+	if r.next == len(r.values) {
+		return io.EOF
+	}
+	dest[0] = r.values[r.next]
+	r.next++
+	return nil
+}
+
+//lastArgs returns the args given to the last query.
+func (d *countingDriver) lastArgs() []interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]interface{}{}, d.args...)
+}
+
+var countingDrivers int32
+
+//registerCountingDriver registers a new counting driver and returns its name.
+func registerCountingDriver(d *countingDriver) string {
+	name := fmt.Sprintf("counting%d", atomic.AddInt32(&countingDrivers, 1))
+	sql.Register(name, d)
+	return name
+}
+
+//newCountingDB registers a new counting driver and returns a DB using it.
+func newCountingDB(d *countingDriver) *sqlx.DB {
+	db, err := sqlx.Open(registerCountingDriver(d), "")
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+func TestPostgresPool(t *testing.T) {
+
+	authOpts := map[string]string{
+		"pg_dbname":    "go_auth_test",
+		"pg_user":      "go_auth_test",
+		"pg_password":  "go_auth_test",
+		"pg_userquery": "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+	}
+
+	Convey("Given wrong pool options NewPostgres should warn and use the defaults", t, func() {
+		for _, timeoutOpt := range []string{"pg_query_timeout_seconds", "pg_query_timeout_ms"} {
+			opts := map[string]string{}
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			for _, opt := range []string{"pg_max_open_conns", "pg_max_idle_conns", "pg_conn_max_lifetime_seconds", timeoutOpt} {
+				opts[opt] = "-1"
+			}
+			postgres, err := NewPostgres(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(postgres.MaxOpenConns, ShouldEqual, 10)
+			So(postgres.MaxIdleConns, ShouldEqual, 5)
+			So(postgres.ConnMaxLifetime, ShouldEqual, 30*time.Minute)
+			So(postgres.QueryTimeout, ShouldEqual, 5*time.Second)
+			postgres.Halt()
+		}
+	})
+
+	Convey("Given pool limits", t, func() {
+		d := &countingDriver{delay: 20 * time.Millisecond, value: "1"}
+		o := Postgres{
+			DB:              newCountingDB(d),
+			SuperuserQuery:  "select count(*) from test_user where username = $1 and is_admin = true",
+			MaxOpenConns:    3,
+			MaxIdleConns:    2,
+			ConnMaxLifetime: time.Minute,
+			QueryTimeout:    5 * time.Second,
+		}
+		o.setPool()
+		defer o.Halt()
+
+		Convey("They should be applied to the DB", func() {
+			So(o.DB.Stats().MaxOpenConnections, ShouldEqual, 3)
+		})
+
+		Convey("Concurrent checks should never open more connections than allowed", func() {
+			var wg sync.WaitGroup
+			var granted int32
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if o.GetSuperuser("test") {
+						atomic.AddInt32(&granted, 1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			So(granted, ShouldEqual, 50)
+			So(atomic.LoadInt32(&d.maxOpen), ShouldBeLessThanOrEqualTo, 3)
+			So(o.DB.Stats().Idle, ShouldBeLessThanOrEqualTo, 2)
+		})
+	})
+
+	Convey("Given an exhausted pool, checks should wait up to the query timeout", t, func() {
+		d := &countingDriver{value: "1"}
+		o := Postgres{
+			DB:             newCountingDB(d),
+			SuperuserQuery: "select count(*) from test_user where username = $1 and is_admin = true",
+			MaxOpenConns:   1,
+			QueryTimeout:   100 * time.Millisecond,
+		}
+		o.setPool()
+		defer o.Halt()
+
+		//Hold the only connection.
+		conn, err := o.DB.Conn(context.Background())
+		So(err, ShouldBeNil)
+
+		start := time.Now()
+		So(o.GetSuperuser("test"), ShouldBeFalse)
+		elapsed := time.Since(start)
+		So(elapsed, ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+		So(elapsed, ShouldBeLessThan, time.Second)
+
+		//Once released, checks should get the connection.
+		conn.Close()
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+	})
+
+}
+
+func TestPostgresQueryTimeout(t *testing.T) {
+
+	Convey("Given both query timeout options NewPostgres should fail", t, func() {
+		authOpts := map[string]string{
+			"pg_dbname":                "go_auth_test",
+			"pg_user":                  "go_auth_test",
+			"pg_password":              "go_auth_test",
+			"pg_userquery":             "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+			"pg_query_timeout_seconds": "1",
+			"pg_query_timeout_ms":      "500",
+		}
+		_, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "pg_query_timeout_ms")
+	})
+
+	Convey("Given queries slower than the query timeout", t, func() {
+		d := &countingDriver{delay: time.Second, value: "topic/#"}
+		o := Postgres{
+			DB:           newCountingDB(d),
+			UserQuery:    "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+			AclQuery:     "SELECT topic FROM test_acl WHERE username = $1 AND rw >= $2",
+			QueryTimeout: 50 * time.Millisecond,
+		}
+		defer o.Halt()
+
+		Convey("User checks should be denied once it's exceeded and not be cached", func() {
+			start := time.Now()
+			granted, ttl := o.GetUserTTL("test", "test")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+		})
+
+		Convey("Acl checks should be denied once it's exceeded and not be cached", func() {
+			start := time.Now()
+			granted, ttl := o.CheckAclTTL("test", "topic/1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+			So(o.CheckAcl("test", "topic/1", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Superuser checks should be denied once it's exceeded", func() {
+			o.SuperuserQuery = "select count(*) from test_user where username = $1 and is_admin = true"
+			So(o.GetSuperuser("test"), ShouldBeFalse)
+		})
+
+		Convey("Queries within it should be answered as usual", func() {
+			d.delay = 0
+			granted, ttl := o.CheckAclTTL("test", "topic/1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, NoTTL)
+
+			granted, ttl = o.CheckAclTTL("test", "other/1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, NoTTL)
+		})
+	})
+
+}
+
+func TestPostgresConnect(t *testing.T) {
+
+	authOpts := map[string]string{
+		"pg_dbname":    "go_auth_test",
+		"pg_user":      "go_auth_test",
+		"pg_password":  "go_auth_test",
+		"pg_userquery": "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+	}
+
+	Convey("Given wrong connect options NewPostgres should warn and use the defaults", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["pg_connect_tries"] = "-1"
+		opts["pg_connect_retry_ms"] = "0"
+		postgres, err := NewPostgres(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(postgres.ConnectTries, ShouldEqual, 0)
+		So(postgres.ConnectRetry, ShouldEqual, 2*time.Second)
+		postgres.Halt()
+	})
+
+	Convey("Given degraded connecting without retries NewPostgres should fail before connecting", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["pg_connect_degraded"] = "true"
+		opts["pg_connect_tries"] = "0"
+		_, err := NewPostgres(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "pg_connect_tries")
+	})
+
+	newBackend := func() Postgres {
+		return Postgres{
+			UserQuery:      "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+			SuperuserQuery: "select count(*) from test_user where username = $1 and is_admin = true",
+			AclQuery:       "SELECT topic FROM test_acl WHERE username = $1 AND rw >= $2",
+			MaxOpenConns:   2,
+			QueryTimeout:   time.Second,
+			ConnectTries:   3,
+			ConnectRetry:   10 * time.Millisecond,
+		}
+	}
+
+	Convey("Given a DB that's down and no degraded start, connecting should fail after the given tries", t, func() {
+		d := &countingDriver{value: "1", down: 1}
+		start := time.Now()
+		_, err := connectPostgres(newBackend(), "", registerCountingDriver(d))
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "3 tries")
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+	})
+
+	Convey("Given a DB that's up after a few tries, connecting should succeed", t, func() {
+		d := &countingDriver{value: "1", down: 1}
+		time.AfterFunc(15*time.Millisecond, func() { atomic.StoreInt32(&d.down, 0) })
+		o := newBackend()
+		o.ConnectTries = 0
+		o, err := connectPostgres(o, "", registerCountingDriver(d))
+		So(err, ShouldBeNil)
+		defer o.Halt()
+		So(o.degraded(), ShouldBeFalse)
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+	})
+
+	Convey("Given a DB that's down and a degraded start", t, func() {
+		d := &countingDriver{value: "1", down: 1}
+		o := newBackend()
+		o.ConnectDegraded = true
+		o, err := connectPostgres(o, "", registerCountingDriver(d))
+		So(err, ShouldBeNil)
+		defer o.Halt()
+		So(o.degraded(), ShouldBeTrue)
+
+		Convey("Checks should fail closed and not be cached", func() {
+			granted, ttl := o.GetUserTTL("test", "test")
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+
+			granted, ttl = o.CheckAclTTL("test", "1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ttl, ShouldEqual, SkipCache)
+
+			So(o.GetSuperuser("test"), ShouldBeFalse)
+		})
+
+		Convey("Once the DB is up, the backend should recover in the background", func() {
+			atomic.StoreInt32(&d.down, 0)
+
+			deadline := time.Now().Add(2 * time.Second)
+			for o.degraded() && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(o.degraded(), ShouldBeFalse)
+
+			granted, ttl := o.CheckAclTTL("test", "1", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeTrue)
+			So(ttl, ShouldEqual, NoTTL)
+			So(o.GetSuperuser("test"), ShouldBeTrue)
+		})
+
+		Convey("Halting it should stop reconnecting", func() {
+			o.Halt()
+			select {
+			case <-o.reconnect.done:
+			case <-time.After(time.Second):
+				So("reconnection still running", ShouldBeEmpty)
+			}
+			//A second halt should be harmless.
+			o.Halt()
+		})
+	})
+
+}
+
+func TestPostgresReplicas(t *testing.T) {
+
+	Convey("Given host lists, they should be parsed with their ports", t, func() {
+		addrs, err := parsePGHosts("db1, db2:5433,[::1]:5434,::1", "5432")
+		So(err, ShouldBeNil)
+		So(addrs, ShouldResemble, []pgAddr{{"db1", "5432"}, {"db2", "5433"}, {"::1", "5434"}, {"::1", "5432"}})
+		So(addrs[1].String(), ShouldEqual, "db2:5433")
+
+		for _, list := range []string{"db1,", "db1:port", "[::1"} {
+			_, err := parsePGHosts(list, "5432")
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given wrong host options NewPostgres should fail before connecting", t, func() {
+		for opt, value := range map[string]string{"pg_host": "db1,,db2", "pg_replica_host": "replica:port", "pg_node_down_seconds": "0"} {
+			authOpts := map[string]string{
+				"pg_dbname":    "go_auth_test",
+				"pg_user":      "go_auth_test",
+				"pg_password":  "go_auth_test",
+				"pg_userquery": "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+			}
+			authOpts[opt] = value
+			_, err := NewPostgres(authOpts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, opt)
+		}
+	})
+
+	Convey("Given several hosts and replicas, a node should be opened for each one", t, func() {
+		d := &countingDriver{value: "1"}
+		o := Postgres{
+			MaxOpenConns:   2,
+			QueryTimeout:   time.Second,
+			NodeDownTime:   time.Minute,
+			hosts:          []pgAddr{{"primary", "5432"}, {"standby", "5432"}},
+			replicas:       []pgAddr{{"replica1", "5432"}, {"replica2", "5433"}},
+			SuperuserQuery: "select count(*) from test_user where username = $1 and is_admin = true",
+		}
+		o, err := connectPostgres(o, o.connectionString(), registerCountingDriver(d))
+		So(err, ShouldBeNil)
+		defer o.Halt()
+
+		So(o.nodes, ShouldNotBeNil)
+		So(len(o.nodes.preferred), ShouldEqual, 2)
+		So(len(o.nodes.fallback), ShouldEqual, 2)
+		So(o.nodes.preferred[1].addr, ShouldResemble, pgAddr{"replica2", "5433"})
+		So(o.nodes.fallback[0].db, ShouldEqual, o.DB)
+		for _, db := range o.dbs() {
+			So(db.Stats().MaxOpenConnections, ShouldEqual, 2)
+		}
+		So(o.GetSuperuser("test"), ShouldBeTrue)
+	})
+
+	Convey("Given replicas and a primary", t, func() {
+		replica1 := &countingDriver{value: "topic/#"}
+		replica2 := &countingDriver{value: "topic/#"}
+		primary := &countingDriver{value: "topic/#"}
+
+		now := time.Now()
+		nodes := newPGNodes(
+			[]*pgNode{{addr: pgAddr{"replica1", "5432"}, db: newCountingDB(replica1)}, {addr: pgAddr{"replica2", "5432"}, db: newCountingDB(replica2)}},
+			[]*pgNode{{addr: pgAddr{"primary", "5432"}, db: newCountingDB(primary)}},
+			10*time.Second,
+		)
+		nodes.now = func() time.Time { return now }
+
+		o := Postgres{
+			DB:           nodes.fallback[0].db,
+			UserQuery:    "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+			AclQuery:     "SELECT topic FROM test_acl WHERE username = $1 AND rw >= $2",
+			QueryTimeout: time.Second,
+			nodes:        nodes,
+		}
+		defer o.Halt()
+
+		check := func(times int) {
+			for i := 0; i < times; i++ {
+				So(o.CheckAcl("test", "topic/1", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			}
+		}
+
+		Convey("Checks should be spread over the replicas only", func() {
+			check(10)
+			So(atomic.LoadInt32(&replica1.queries), ShouldEqual, 5)
+			So(atomic.LoadInt32(&replica2.queries), ShouldEqual, 5)
+			So(atomic.LoadInt32(&primary.queries), ShouldEqual, 0)
+		})
+
+		Convey("When a replica goes away, checks should go on and it shouldn't be retried on every one", func() {
+			check(2)
+			atomic.StoreInt32(&replica1.down, 1)
+
+			check(2)
+			attempts := atomic.LoadInt32(&replica1.attempts)
+			queries := atomic.LoadInt32(&replica2.queries)
+
+			check(10)
+			So(atomic.LoadInt32(&replica1.attempts), ShouldEqual, attempts)
+			So(atomic.LoadInt32(&replica2.queries), ShouldEqual, queries+10)
+			So(atomic.LoadInt32(&primary.queries), ShouldEqual, 0)
+
+			Convey("And once it's back, it should be used again after the down time", func() {
+				atomic.StoreInt32(&replica1.down, 0)
+				check(4)
+				So(atomic.LoadInt32(&replica1.attempts), ShouldEqual, attempts)
+
+				now = now.Add(11 * time.Second)
+				replicaQueries := atomic.LoadInt32(&replica1.queries)
+				check(4)
+				So(atomic.LoadInt32(&replica1.queries), ShouldEqual, replicaQueries+2)
+				So(atomic.LoadInt64(&nodes.preferred[0].downUntil), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When every replica goes away, checks should fail over to the primary", func() {
+			atomic.StoreInt32(&replica1.down, 1)
+			atomic.StoreInt32(&replica2.down, 1)
+			check(4)
+			So(atomic.LoadInt32(&primary.queries), ShouldEqual, 4)
+		})
+
+		Convey("When every node goes away, checks should be denied", func() {
+			atomic.StoreInt32(&replica1.down, 1)
+			atomic.StoreInt32(&replica2.down, 1)
+			atomic.StoreInt32(&primary.down, 1)
+			So(o.CheckAcl("test", "topic/1", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.GetUser("test", "test"), ShouldBeFalse)
+		})
+
+		Convey("Query errors other than connection ones shouldn't fail over", func() {
+			So(pgConnectionError(sql.ErrNoRows), ShouldBeFalse)
+			So(pgConnectionError(&pq.Error{Code: "42P01"}), ShouldBeFalse)
+			So(pgConnectionError(&pq.Error{Code: "08006"}), ShouldBeTrue)
+			So(pgConnectionError(&pq.Error{Code: "57P01"}), ShouldBeTrue)
+			So(pgConnectionError(driver.ErrBadConn), ShouldBeTrue)
+			So(pgConnectionError(io.ErrUnexpectedEOF), ShouldBeTrue)
+		})
+	})
+
+}
+
+//sqlBackend is the set of checks every SQL backend implements.
+type sqlBackend interface {
+	GetUser(username, password string) bool
+	GetSuperuser(username string) bool
+	CheckAcl(username, topic, clientid string, acc int32) bool
+	Halt()
+}
+
+//checkQueryCombinations checks, for every combination of configured and empty queries, that only checks with a query touch the DB and that the others are denied.
+func checkQueryCombinations(t *testing.T, name string, newBackend func(db *sqlx.DB, userQuery, superuserQuery, aclQuery string) sqlBackend) {
+	queries := []string{
+		"SELECT password_hash FROM test_user WHERE username = ? limit 1",
+		"select count(*) from test_user where username = ? and is_admin = true",
+		"SELECT topic FROM test_acl WHERE username = ? AND rw >= ?",
+	}
+
+	for mask := 0; mask < 8; mask++ {
+		given := make([]string, 3)
+		var names []string
+		for i := range queries {
+			if mask&(1<<uint(i)) != 0 {
+				given[i] = queries[i]
+				names = append(names, []string{"user", "superuser", "acl"}[i])
+			}
+		}
+
+		Convey(fmt.Sprintf("Given a %s backend with queries for %v, only their checks should query the DB", name, names), t, func() {
+			//Hash generated by the pw utility for testpw.
+			d := &countingDriver{value: "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="}
+			o := newBackend(newCountingDB(d), given[0], given[1], given[2])
+			defer o.Halt()
+
+			attempts := atomic.LoadInt32(&d.attempts)
+			So(o.GetUser("test", "testpw"), ShouldEqual, given[0] != "")
+			So(atomic.LoadInt32(&d.attempts) > attempts, ShouldEqual, given[0] != "")
+
+			//From now on queries give 1, which is both a superuser count and an acl.
+			d.value = "1"
+			attempts = atomic.LoadInt32(&d.attempts)
+			So(o.GetSuperuser("test"), ShouldEqual, given[1] != "")
+			So(atomic.LoadInt32(&d.attempts) > attempts, ShouldEqual, given[1] != "")
+
+			attempts = atomic.LoadInt32(&d.attempts)
+			So(o.CheckAcl("test", "1", "client", MOSQ_ACL_READ), ShouldEqual, given[2] != "")
+			So(atomic.LoadInt32(&d.attempts) > attempts, ShouldEqual, given[2] != "")
+		})
+	}
+}
+
+func TestPostgresQueries(t *testing.T) {
+	checkQueryCombinations(t, "postgres", func(db *sqlx.DB, userQuery, superuserQuery, aclQuery string) sqlBackend {
+		return Postgres{DB: db, UserQuery: userQuery, SuperuserQuery: superuserQuery, AclQuery: aclQuery, QueryTimeout: time.Second}
+	})
+}
+
+//logRecorder is a log hook keeping every logged message along with its fields.
+type logRecorder struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (r *logRecorder) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *logRecorder) Fire(entry *log.Entry) error {
+	line, _ := entry.String()
+	r.mu.Lock()
+	r.entries = append(r.entries, line)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *logRecorder) contains(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.entries {
+		if strings.Contains(entry, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPostgresServerPassword(t *testing.T) {
+
+	authOpts := map[string]string{
+		"pg_dbname":              "go_auth_test",
+		"pg_user":                "go_auth_test",
+		"pg_password":            "go_auth_test",
+		"pg_userquery":           "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+		"pg_password_check_mode": "server",
+	}
+
+	Convey("Given wrong password check options NewPostgres should fail before connecting", t, func() {
+		_, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "$2")
+
+		authOpts["pg_password_check_mode"] = "remote"
+		_, err = NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "pg_password_check_mode")
+	})
+
+	Convey("Given server password checks", t, func() {
+		d := &countingDriver{value: "1"}
+		o := Postgres{
+			DB:                newCountingDB(d),
+			UserQuery:         "SELECT count(*) FROM test_user WHERE username = $1 AND password_hash = crypt($2, password_hash)",
+			PasswordCheckMode: "server",
+			QueryTimeout:      time.Second,
+		}
+		defer o.Halt()
+
+		recorder := &logRecorder{}
+		log.AddHook(recorder)
+		defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		password := "s3cret p@ss"
+
+		Convey("A positive count should authenticate the user", func() {
+			So(o.GetUser("test", password), ShouldBeTrue)
+			So(d.lastArgs(), ShouldResemble, []interface{}{"test", password})
+		})
+
+		Convey("A zero count should not", func() {
+			d.value = "0"
+			So(o.GetUser("test", password), ShouldBeFalse)
+			So(d.lastArgs(), ShouldResemble, []interface{}{"test", password})
+		})
+
+		Convey("The password should never be logged", func() {
+			d.value = "0"
+			So(o.GetUser("test", password), ShouldBeFalse)
+			d.value = "1"
+			d.delay = time.Second
+			o.QueryTimeout = 10 * time.Millisecond
+			So(o.GetUser("test", password), ShouldBeFalse)
+
+			So(recorder.contains("test"), ShouldBeTrue)
+			So(recorder.contains(password), ShouldBeFalse)
+		})
+	})
+
+}
+
+func TestPostgresSSL(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	caPath := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(certPath, []byte("cert"), 0644)
+	ioutil.WriteFile(keyPath, []byte("key"), 0600)
+	ioutil.WriteFile(caPath, []byte("ca"), 0644)
+
+	o := Postgres{
+		Host:     "db.example.com",
+		Port:     "5432",
+		DBName:   "go_auth_test",
+		User:     "go_auth_test",
+		Password: "go_auth_test",
+	}
+	base := "user=go_auth_test password=go_auth_test dbname=go_auth_test host=db.example.com port=5432"
+
+	Convey("Given each sslmode, the DSN should carry it along with the given files", t, func() {
+		o.SSLMode = "disable"
+		So(o.connectionString(), ShouldEqual, base+" sslmode=disable")
+
+		o.SSLMode = "require"
+		So(o.connectionString(), ShouldEqual, base+" sslmode=require")
+
+		o.SSLMode = "verify-ca"
+		o.SSLRootCert = caPath
+		So(o.connectionString(), ShouldEqual, base+" sslmode=verify-ca sslrootcert="+caPath)
+
+		o.SSLMode = "verify-full"
+		o.SSLCert = certPath
+		o.SSLKey = keyPath
+		So(o.connectionString(), ShouldEqual, base+" sslmode=verify-full sslcert="+certPath+" sslkey="+keyPath+" sslrootcert="+caPath)
+
+		//Files are left out when TLS is disabled.
+		o.SSLMode = "disable"
+		So(o.connectionString(), ShouldEqual, base+" sslmode=disable")
+	})
+
+	Convey("Given values with spaces or quotes, they should be quoted", t, func() {
+		q := Postgres{User: "user", Password: `it's a \ secret`, DBName: "db", Host: "localhost", Port: "5432", SSLMode: "disable"}
+		So(q.connectionString(), ShouldEqual, `user=user password='it\'s a \\ secret' dbname=db host=localhost port=5432 sslmode=disable`)
+
+		q.Password = ""
+		So(q.connectionString(), ShouldContainSubstring, "password='' ")
+	})
+
+	Convey("Given wrong ssl options NewPostgres should fail before connecting", t, func() {
+		authOpts := map[string]string{
+			"pg_dbname":    "go_auth_test",
+			"pg_user":      "go_auth_test",
+			"pg_password":  "go_auth_test",
+			"pg_userquery": "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+		}
+
+		authOpts["pg_sslmode"] = "prefer"
+		_, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "pg_sslmode")
+
+		authOpts["pg_sslmode"] = "verify-full"
+		authOpts["pg_sslrootcert"] = filepath.Join(dir, "missing.crt")
+		_, err = NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "pg_sslrootcert")
+
+		authOpts["pg_sslrootcert"] = dir
+		_, err = NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		authOpts["pg_sslrootcert"] = caPath
+		authOpts["pg_sslcert"] = certPath
+		_, err = NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "together")
+
+		openKeyPath := filepath.Join(dir, "open.key")
+		ioutil.WriteFile(openKeyPath, []byte("key"), 0644)
+		authOpts["pg_sslkey"] = openKeyPath
+		_, err = NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "group or world access")
+	})
+
+	Convey("Given connection errors, TLS and auth ones should be told apart", t, func() {
+		So(pgErrorKind(&pq.Error{Code: "28P01"}), ShouldEqual, "auth")
+		So(pgErrorKind(&pq.Error{Code: "28000"}), ShouldEqual, "auth")
+		So(pgErrorKind(&pq.Error{Code: "3D000"}), ShouldEqual, "")
+		So(pgErrorKind(x509.UnknownAuthorityError{}), ShouldEqual, "tls")
+		So(pgErrorKind(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "db"}), ShouldEqual, "tls")
+		So(pgErrorKind(pq.ErrSSLNotSupported), ShouldEqual, "tls")
+		So(pgErrorKind(errors.New("tls: failed to find any PEM data in certificate input")), ShouldEqual, "tls")
+		So(pgErrorKind(errors.New("dial tcp 127.0.0.1:5432: connect: connection refused")), ShouldEqual, "")
+		So(pgErrorKind(nil), ShouldEqual, "")
+	})
+
+	Convey("Given an unreachable DB, connection checks should leave it to be retried", t, func() {
+		u := Postgres{User: "user", Password: "pw", DBName: "db", Host: "127.0.0.1", Port: "1", SSLMode: "disable"}
+		So(checkPostgresConnection(u.connectionString()), ShouldBeNil)
+	})
+
+	Convey("Given a server that refuses TLS, connecting should fail as a TLS error", t, func() {
+		//Fake server that reads the SSLRequest and answers it doesn't support TLS.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				request := make([]byte, 8)
+				io.ReadFull(conn, request)
+				conn.Write([]byte("N"))
+				conn.Close()
+			}
+		}()
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		u := Postgres{User: "user", Password: "pw", DBName: "db", Host: "127.0.0.1", Port: port, SSLMode: "require"}
+		err = checkPostgresConnection(u.connectionString())
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "TLS failure")
+
+		Convey("And so should bad client certificate files", func() {
+			u.SSLMode = "verify-full"
+			u.SSLCert = certPath
+			u.SSLKey = keyPath
+			err := checkPostgresConnection(u.connectionString())
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "TLS failure")
+		})
+	})
+
+}
+
+//TestPostgresTLS connects to a TLS enabled Postgres given by the PG_TLS_HOST, PG_TLS_SSLCERT, PG_TLS_SSLKEY and PG_TLS_SSLROOTCERT env vars, if available.
+func TestPostgresTLS(t *testing.T) {
+	host := os.Getenv("PG_TLS_HOST")
+	if host == "" {
+		t.Skip("PG_TLS_HOST not set, skipping TLS Postgres test")
+	}
+
+	authOpts := map[string]string{
+		"pg_host":        host,
+		"pg_dbname":      "go_auth_test",
+		"pg_user":        "go_auth_test",
+		"pg_password":    "go_auth_test",
+		"pg_userquery":   "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+		"pg_sslmode":     "verify-full",
+		"pg_sslcert":     os.Getenv("PG_TLS_SSLCERT"),
+		"pg_sslkey":      os.Getenv("PG_TLS_SSLKEY"),
+		"pg_sslrootcert": os.Getenv("PG_TLS_SSLROOTCERT"),
+	}
+
+	Convey("Given a TLS enabled Postgres and valid certificates, NewPostgres should connect", t, func() {
+		pg, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer pg.Halt()
+		So(pg.DB.Ping(), ShouldBeNil)
+	})
+
+	Convey("Given a wrong password, NewPostgres should fail with an authentication error", t, func() {
+		opts := map[string]string{}
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["pg_password"] = "wrong"
+		_, err := NewPostgres(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "authentication failure")
+	})
+
+}
+
+func TestPostgresAclMatching(t *testing.T) {
+
+	Convey("Given several acl rows, CheckAcl should match the topic against each of them", t, func() {
+		d := &countingDriver{rows: []string{
+			"devices/%u/+/telemetry",
+			"clients/%c/cmd/#",
+			"fleet/#",
+			"$share/workers/jobs/+",
+		}}
+		o := Postgres{
+			DB:       newCountingDB(d),
+			AclQuery: "SELECT topic FROM test_acl WHERE test_user_id = (SELECT id FROM test_user WHERE username = $1) AND rw >= $2",
+		}
+		defer o.Halt()
+
+		Convey("+ should match exactly one level", func() {
+			So(o.CheckAcl("test", "devices/test/d1/telemetry", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("test", "devices/test/d1/d2/telemetry", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl("test", "devices/test/telemetry", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("# should match the parent level and any number of levels below it", func() {
+			So(o.CheckAcl("test", "fleet", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("test", "fleet/a/b/c", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("test", "fleetwood/a", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("%u and %c should be replaced by the username and client id", func() {
+			So(o.CheckAcl("test", "clients/client/cmd/reboot", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("test", "clients/other/cmd/reboot", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl("other", "devices/test/d1/telemetry", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Usernames and client ids with wildcards or levels shouldn't widen acls", func() {
+			So(o.CheckAcl("+", "devices/test/d1/telemetry", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl("test/d1", "devices/test/d1/x/telemetry", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl("test", "clients/a/b/cmd/reboot", "a/b", MOSQ_ACL_READ), ShouldBeFalse)
+			So(o.CheckAcl("test", "clients/c/cmd/reboot", "#", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Shared subscriptions should match by their topic unless the acl is a shared one", func() {
+			So(o.CheckAcl("test", "$share/group/fleet/a", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(o.CheckAcl("test", "$share/group/devices/test/d1/telemetry", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(o.CheckAcl("test", "$share/workers/jobs/j1", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(o.CheckAcl("test", "$share/others/jobs/j1", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+			So(o.CheckAcl("test", "jobs/j1", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+			So(o.CheckAcl("test", "$share/group", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+		})
+
+		Convey("First level wildcards shouldn't match $ topics", func() {
+			d.rows = []string{"#", "+/broker/#"}
+			So(o.CheckAcl("test", "fleet/a", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("test", "$SYS/broker/uptime", "client", MOSQ_ACL_READ), ShouldBeFalse)
+
+			d.rows = []string{"$SYS/#"}
+			So(o.CheckAcl("test", "$SYS/broker/uptime", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		})
+
+		Convey("No rows should deny", func() {
+			d.rows = []string{}
+			So(o.CheckAcl("test", "fleet/a", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+
+}
+
+func TestPostgresNotifyHandling(t *testing.T) {
+
+	Convey("Given an empty pg_notify_channel NewPostgres should fail", t, func() {
+		authOpts := map[string]string{
+			"pg_dbname":         "go_auth_test",
+			"pg_user":           "go_auth_test",
+			"pg_password":       "go_auth_test",
+			"pg_notify_channel": " ",
+		}
+		_, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "pg_notify_channel")
+	})
+
+	Convey("Without a notify channel the backend shouldn't take a handler", t, func() {
+		So(Postgres{}.OnUserChange(func(string) {}), ShouldBeFalse)
+	})
+
+	Convey("Notification payloads should give the username as is or in a JSON object", t, func() {
+		So(notifiedUsername("device-1"), ShouldEqual, "device-1")
+		So(notifiedUsername(" device-1\n"), ShouldEqual, "device-1")
+		So(notifiedUsername(`{"username": "device-1", "reason": "revoked"}`), ShouldEqual, "device-1")
+		So(notifiedUsername(`{"reason": "revoked"}`), ShouldEqual, "")
+		So(notifiedUsername(`{"username": `), ShouldEqual, "")
+		So(notifiedUsername(""), ShouldEqual, "")
+	})
+
+	Convey("Given a handler, notifications should hand it their usernames", t, func() {
+		n := &pgNotifier{channel: "mosquitto_auth"}
+		o := Postgres{notifier: n}
+
+		var changed []string
+		So(o.OnUserChange(func(username string) { changed = append(changed, username) }), ShouldBeTrue)
+
+		n.handle(&pq.Notification{Channel: "mosquitto_auth", Extra: "device-1"})
+		n.handle(&pq.Notification{Channel: "mosquitto_auth", Extra: `{"username": "device-2"}`})
+		n.handle(&pq.Notification{Channel: "mosquitto_auth", Extra: ""})
+		So(changed, ShouldResemble, []string{"device-1", "device-2"})
+
+		Convey("After reconnecting, it should be told that any user may have changed", func() {
+			n.handle(nil)
+			So(changed, ShouldResemble, []string{"device-1", "device-2", ""})
+		})
+	})
+
+	Convey("Given an unreachable DB, the listener should keep retrying and stop when halted", t, func() {
+		n := newPGNotifier("host=127.0.0.1 port=1 dbname=go_auth_test user=go_auth_test sslmode=disable", "mosquitto_auth", 10*time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			n.stop()
+			n.stop()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("listener didn't stop")
+		}
+	})
+
+	Convey("Given new credentials, the listener should be replaced and any user taken as changed", t, func() {
+		n := newPGNotifier("host=127.0.0.1 port=1 dbname=go_auth_test user=go_auth_test sslmode=disable", "mosquitto_auth", 10*time.Millisecond)
+		defer n.stop()
+
+		var changed []string
+		So(Postgres{notifier: n}.OnUserChange(func(username string) { changed = append(changed, username) }), ShouldBeTrue)
+
+		old := n.listener
+		n.reconnect("host=127.0.0.1 port=1 dbname=go_auth_test user=v-rotated sslmode=disable")
+		So(n.listener != old, ShouldBeTrue)
+		So(changed, ShouldResemble, []string{""})
+
+		n.stop()
+		n.reconnect("host=127.0.0.1 port=1 dbname=go_auth_test user=v-late sslmode=disable")
+		So(changed, ShouldResemble, []string{""})
+	})
+
+}
+
+func TestPostgresNotify(t *testing.T) {
+
+	authOpts := map[string]string{
+		"pg_host":           "localhost",
+		"pg_port":           "5432",
+		"pg_dbname":         "go_auth_test",
+		"pg_user":           "go_auth_test",
+		"pg_password":       "go_auth_test",
+		"pg_userquery":      "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+		"pg_aclquery":       "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = $1 AND test_acl.test_user_id = test_user.id AND (rw = $2 or rw = 3)",
+		"pg_notify_channel": "mosquitto_auth",
+	}
+
+	Convey("Given a notify channel, a NOTIFY with a username should make its next check go to the DB", t, func() {
+		postgres, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer postgres.Halt()
+
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		userID := 0
+		err = postgres.DB.Get(&userID, "INSERT INTO test_user(username, password_hash, is_admin) values($1, $2, $3) returning id", "test", "hash", false)
+		So(err, ShouldBeNil)
+		postgres.DB.MustExec("INSERT INTO test_acl(test_user_id, topic, rw) values($1, $2, $3)", userID, "test/topic/#", MOSQ_ACL_READ)
+
+		//Decisions are cached as the plugin would, and dropped when the user is notified.
+		var mu sync.Mutex
+		cached := make(map[string]bool)
+		notified := make(chan string, 1)
+		So(postgres.OnUserChange(func(username string) {
+			mu.Lock()
+			delete(cached, username)
+			mu.Unlock()
+			select {
+			case notified <- username:
+			default:
+			}
+		}), ShouldBeTrue)
+
+		queries := 0
+		check := func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if granted, ok := cached["test"]; ok {
+				return granted
+			}
+			queries++
+			cached["test"] = postgres.CheckAcl("test", "test/topic/1", "client", MOSQ_ACL_READ)
+			return cached["test"]
+		}
+
+		So(check(), ShouldBeTrue)
+		So(queries, ShouldEqual, 1)
+
+		//Revoke the acl: the cached grant is still served.
+		postgres.DB.MustExec("delete from test_acl where test_user_id = $1", userID)
+		So(check(), ShouldBeTrue)
+		So(queries, ShouldEqual, 1)
+
+		//The listener may still be subscribing, so keep notifying until it's heard.
+		var username string
+		deadline := time.After(5 * time.Second)
+	wait:
+		for {
+			postgres.DB.MustExec("select pg_notify($1, $2)", "mosquitto_auth", "test")
+			select {
+			case username = <-notified:
+				break wait
+			case <-time.After(100 * time.Millisecond):
+			case <-deadline:
+				break wait
+			}
+		}
+		So(username, ShouldEqual, "test")
+
+		So(check(), ShouldBeFalse)
+		So(queries, ShouldEqual, 2)
+
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+	})
+
+}
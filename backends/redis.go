@@ -1,34 +1,99 @@
 package backends
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/pkg/errors"
+
 	"github.com/iegomez/mosquitto-go-auth/common"
 
 	goredis "github.com/go-redis/redis"
 )
 
 type Redis struct {
-	Host     string
-	Port     string
-	Password string
-	DB       int32
-	Conn     *goredis.Client
+	Host         string
+	Port         string
+	Username     string
+	Password     string
+	DB           int32
+	Mode         string
+	Addresses    []string
+	MasterName   string
+	ConnectTries int
+	ConnectRetry time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	PlaintextPasswords bool
+	UseLua             bool
+	AclsLayout         string
+
+	KeyPrefix         string
+	UserKey           string
+	SuperuserKey      string
+	UserAclsKey       string
+	CommonAclsKey     string
+	UserAclsHashKey   string
+	CommonAclsHashKey string
+
+	SSL                   bool
+	SSLCA                 string
+	SSLCert               string
+	SSLKey                string
+	SSLInsecureSkipVerify bool
+
+	Conn   goredis.UniversalClient
+	Hasher common.Hasher //Verifies password hashes, taking PBKDF2 salts in its encoding.
+}
+
+//RedisOptions are the auth options the Redis backend takes.
+var RedisOptions = Options{
+	Keys: withKeys([]string{
+		"redis_acls_layout", "redis_cluster_addresses", "redis_common_acls_hash_key", "redis_common_acls_key",
+		"redis_connect_retry_ms", "redis_connect_tries", "redis_db", "redis_dial_timeout_ms", "redis_host",
+		"redis_key_prefix", "redis_master_name", "redis_mode", "redis_password", "redis_plaintext_passwords",
+		"redis_port", "redis_read_timeout_ms", "redis_sentinel_addresses", "redis_ssl", "redis_ssl_ca",
+		"redis_ssl_cert", "redis_ssl_insecure_skip_verify", "redis_ssl_key", "redis_superuser_key",
+		"redis_use_lua", "redis_user_acls_hash_key", "redis_user_acls_key", "redis_user_key",
+		"redis_username", "redis_write_timeout_ms",
+	}, common.HasherOptions, common.PrefixedHasherOptions("redis")),
 }
 
 func NewRedis(authOpts map[string]string, logLevel log.Level) (Redis, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := RedisOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return Redis{}, errors.Errorf("Redis backend error: %s.\n", err)
+	}
+
 	var redis = Redis{
-		Host: "localhost",
-		Port: "6379",
-		DB:   1,
+		Host:              "localhost",
+		Port:              "6379",
+		DB:                1,
+		Mode:              "single",
+		ConnectRetry:      2 * time.Second,
+		UserKey:           "%u",
+		SuperuserKey:      "%u:su",
+		UserAclsKey:       "%u:%a",
+		CommonAclsKey:     "common:%a",
+		UserAclsHashKey:   "%u:acls",
+		CommonAclsHashKey: "common:acls",
+		AclsLayout:        "sets",
 	}
 
 	if redisHost, ok := authOpts["redis_host"]; ok {
@@ -39,66 +104,401 @@ func NewRedis(authOpts map[string]string, logLevel log.Level) (Redis, error) {
 		redis.Port = redisPort
 	}
 
+	if redisUsername, ok := authOpts["redis_username"]; ok {
+		redis.Username = redisUsername
+	}
+
 	if redisPassword, ok := authOpts["redis_password"]; ok {
 		redis.Password = redisPassword
 	}
 
-	if redisDB, ok := authOpts["redis_db"]; ok {
-		db, err := strconv.ParseInt(redisDB, 10, 32)
-		if err == nil {
-			redis.DB = int32(db)
+	hasher, err := common.NewHasher(authOpts, "redis")
+	if err != nil {
+		return redis, errors.Errorf("Redis backend error: %s.\n", err)
+	}
+	redis.Hasher = hasher
+
+	//A Redis 6 user always authenticates with a password, even one marked nopass.
+	if redis.Username != "" && redis.Password == "" {
+		return redis, errors.New("Redis backend error: redis_username needs redis_password.\n")
+	}
+
+	redis.DB = int32(common.IntOption(authOpts, "redis_db", 0, math.MaxInt32, int(redis.DB)))
+
+	if mode, ok := authOpts["redis_mode"]; ok {
+		redis.Mode = strings.TrimSpace(mode)
+	}
+
+	switch redis.Mode {
+	case "single":
+	case "sentinel":
+		if masterName, ok := authOpts["redis_master_name"]; ok {
+			redis.MasterName = strings.TrimSpace(masterName)
+		}
+		if redis.MasterName == "" {
+			return redis, errors.New("Redis backend error: redis_mode sentinel needs redis_master_name.\n")
 		}
+		redis.Addresses = redisAddresses(authOpts["redis_sentinel_addresses"])
+		if len(redis.Addresses) == 0 {
+			return redis, errors.New("Redis backend error: redis_mode sentinel needs redis_sentinel_addresses.\n")
+		}
+	case "cluster":
+		//A cluster only has DB 0, so a DB given explicitly can't be honored.
+		if redisDB, ok := authOpts["redis_db"]; ok && redisDB != "0" {
+			return redis, errors.Errorf("Redis backend error: redis_db %s can't be used in redis_mode cluster, which only has DB 0.\n", redisDB)
+		}
+		redis.DB = 0
+		redis.Addresses = redisAddresses(authOpts["redis_cluster_addresses"])
+		if len(redis.Addresses) == 0 {
+			return redis, errors.New("Redis backend error: redis_mode cluster needs redis_cluster_addresses.\n")
+		}
+	default:
+		return redis, errors.Errorf("Redis backend error: unknown redis_mode %s, it must be single, sentinel or cluster.\n", redis.Mode)
+	}
+
+	if redis.Mode != "single" {
+		for _, opt := range []string{"redis_host", "redis_port"} {
+			if _, ok := authOpts[opt]; ok {
+				log.Warnf("Redis backend: redis_mode is %s, ignoring %s.", redis.Mode, opt)
+			}
+		}
+	}
+
+	//The script reads the user's and common keys in one call, which a cluster can't do as they live in different slots.
+	if common.BoolOption(authOpts, "redis_use_lua", false) {
+		if redis.Mode == "cluster" {
+			return redis, errors.New("Redis backend error: redis_use_lua can't be used in redis_mode cluster.\n")
+		}
+		redis.UseLua = true
+	}
+
+	if layout, ok := authOpts["redis_acls_layout"]; ok {
+		redis.AclsLayout = strings.TrimSpace(layout)
+	}
+
+	switch redis.AclsLayout {
+	case "sets":
+	case "hash", "auto":
+		//The script only knows the sets layout.
+		if redis.UseLua {
+			return redis, errors.Errorf("Redis backend error: redis_use_lua can't be used with redis_acls_layout %s.\n", redis.AclsLayout)
+		}
+	default:
+		return redis, errors.Errorf("Redis backend error: unknown redis_acls_layout %s, it must be sets, hash or auto.\n", redis.AclsLayout)
+	}
+
+	if keyPrefix, ok := authOpts["redis_key_prefix"]; ok {
+		redis.KeyPrefix = keyPrefix
+	}
+
+	//Every user key needs the username, and every acls key the kind of acls, or different users or kinds would share a key.
+	keyTemplates := []struct {
+		opt          string
+		key          *string
+		placeholders []string
+	}{
+		{"redis_user_key", &redis.UserKey, []string{"%u"}},
+		{"redis_superuser_key", &redis.SuperuserKey, []string{"%u"}},
+		{"redis_user_acls_key", &redis.UserAclsKey, []string{"%u", "%a"}},
+		{"redis_common_acls_key", &redis.CommonAclsKey, []string{"%a"}},
+		{"redis_user_acls_hash_key", &redis.UserAclsHashKey, []string{"%u"}},
+		{"redis_common_acls_hash_key", &redis.CommonAclsHashKey, nil},
+	}
+	for _, template := range keyTemplates {
+		key, ok := authOpts[template.opt]
+		if !ok {
+			continue
+		}
+		for _, placeholder := range template.placeholders {
+			if !strings.Contains(key, placeholder) {
+				return redis, errors.Errorf("Redis backend error: %s %s must have %s.\n", template.opt, key, placeholder)
+			}
+		}
+		*template.key = key
+	}
+
+	if redis.UserKey == redis.SuperuserKey {
+		return redis, errors.New("Redis backend error: redis_user_key and redis_superuser_key can't be the same.\n")
+	}
+
+	redis.ConnectTries = common.IntOption(authOpts, "redis_connect_tries", 0, math.MaxInt32, redis.ConnectTries)
+
+	redis.ConnectRetry = common.DurationOption(authOpts, "redis_connect_retry_ms", time.Millisecond, time.Millisecond, redis.ConnectRetry)
+
+	//Timeouts left unset keep the client's defaults: 5 seconds to dial, and 3 to read or write a command.
+	timeouts := []struct {
+		opt     string
+		timeout *time.Duration
+	}{
+		{"redis_dial_timeout_ms", &redis.DialTimeout},
+		{"redis_read_timeout_ms", &redis.ReadTimeout},
+		{"redis_write_timeout_ms", &redis.WriteTimeout},
+	}
+	for _, t := range timeouts {
+		*t.timeout = common.DurationOption(authOpts, t.opt, time.Millisecond, time.Millisecond, *t.timeout)
+	}
+
+	if common.BoolOption(authOpts, "redis_plaintext_passwords", false) {
+		redis.PlaintextPasswords = true
+		log.Warnf("Redis backend: redis_plaintext_passwords is set, passwords stored in plain text will be accepted. Anyone reading the DB can log in as any such user, so store hashes instead.")
+	}
+
+	redis.SSL = common.BoolOption(authOpts, "redis_ssl", false)
+
+	if sslCA, ok := authOpts["redis_ssl_ca"]; ok {
+		redis.SSLCA = sslCA
+	}
+
+	if sslCert, ok := authOpts["redis_ssl_cert"]; ok {
+		redis.SSLCert = sslCert
+	}
+
+	if sslKey, ok := authOpts["redis_ssl_key"]; ok {
+		redis.SSLKey = sslKey
 	}
 
-	addr := fmt.Sprintf("%s:%s", redis.Host, redis.Port)
+	redis.SSLInsecureSkipVerify = common.BoolOption(authOpts, "redis_ssl_insecure_skip_verify", false)
+
+	tlsConfig, err := redis.tlsConfig()
+	if err != nil {
+		return redis, err
+	}
+
+	if redis.SSLInsecureSkipVerify {
+		log.Warnf("Redis backend: redis_ssl_insecure_skip_verify is set, the server's certificate won't be verified.")
+	}
 
 	//Try to start redis.
-	goredisClient := goredis.NewClient(&goredis.Options{
-		Addr:     addr,
-		Password: redis.Password,
-		DB:       int(redis.DB),
-	})
+	redis.Conn = redis.client(tlsConfig)
+	redis.Conn.WrapProcess(retryBrokenConns)
 
-	for {
-		if _, err := goredisClient.Ping().Result(); err != nil {
-			log.Errorf("ping redis error, will retry in 2s: %s", err)
-			time.Sleep(2 * time.Second)
-		} else {
-			break
+	if err := redis.ping(); err != nil {
+		redis.Halt()
+		return redis, errors.Errorf("Redis backend error: couldn't connect in redis_mode %s: %s\n", redis.Mode, err)
+	}
+
+	//The script is loaded once, and sent again by Run whenever the server lost it, e.g. after a restart or SCRIPT FLUSH.
+	if redis.UseLua {
+		if err := redisAclScript.Load(redis.Conn).Err(); err != nil {
+			redis.Halt()
+			return redis, errors.Errorf("Redis backend error: couldn't load the acl script: %s\n", err)
 		}
 	}
 
-	redis.Conn = goredisClient
+	log.Infof("Redis backend: connected in redis_mode %s.", redis.Mode)
 
 	return redis, nil
 
 }
 
-//GetUser checks that the username exists and the given password hashes to the same password.
+//client returns the client for the mode: a single node, a master found through sentinels, or a cluster whose nodes are discovered from the given ones.
+func (o Redis) client(tlsConfig *tls.Config) goredis.UniversalClient {
+	password, db := o.Password, int(o.DB)
+	var onConnect func(*goredis.Conn) error
+
+	//The client would AUTH with the password alone, as the default user, so a named user authenticates itself on connect, before selecting the DB.
+	if o.Username != "" {
+		password, db = "", 0
+		onConnect = o.authenticate
+	}
+
+	switch o.Mode {
+	case "sentinel":
+		return goredis.NewFailoverClient(&goredis.FailoverOptions{
+			MasterName:    o.MasterName,
+			SentinelAddrs: o.Addresses,
+			OnConnect:     onConnect,
+			Password:      password,
+			DB:            db,
+			DialTimeout:   o.DialTimeout,
+			ReadTimeout:   o.ReadTimeout,
+			WriteTimeout:  o.WriteTimeout,
+			TLSConfig:     tlsConfig,
+		})
+	case "cluster":
+		return goredis.NewClusterClient(&goredis.ClusterOptions{
+			Addrs:        o.Addresses,
+			OnConnect:    onConnect,
+			Password:     password,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	default:
+		return goredis.NewClient(&goredis.Options{
+			Addr:         fmt.Sprintf("%s:%s", o.Host, o.Port),
+			OnConnect:    onConnect,
+			Password:     password,
+			DB:           db,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	}
+}
+
+//authenticate authenticates a new connection as the named Redis 6 user and selects the DB.
+func (o Redis) authenticate(conn *goredis.Conn) error {
+	if err := conn.Do("auth", o.Username, o.Password).Err(); err != nil {
+		return errors.Wrapf(err, "auth as redis_username %s", o.Username)
+	}
+	if o.DB > 0 {
+		return conn.Select(int(o.DB)).Err()
+	}
+	return nil
+}
+
+//redisBrokenConnRetries is how many times a command is sent when its connection turns out to be broken.
+const redisBrokenConnRetries = 3
+
+//retryBrokenConns sends a command again when its pooled connection was broken, as after a Redis restart, each try dropping the connection and taking another one or dialing anew.
+//Timeouts aren't retried, so a hung Redis doesn't hold a check longer than the timeouts allow.
+func retryBrokenConns(process func(cmd goredis.Cmder) error) func(cmd goredis.Cmder) error {
+	return func(cmd goredis.Cmder) error {
+		err := process(cmd)
+		for try := 1; try < redisBrokenConnRetries && redisConnBroken(err); try++ {
+			err = process(cmd)
+		}
+		return err
+	}
+}
+
+//redisConnBroken tells if the error comes from a connection closed or reset by the server, rather than from a timeout or a Redis reply.
+func redisConnBroken(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && !netErr.Timeout()
+}
+
+//checkFailed logs a check's error and returns the cache hint for its denial: a command that timed out must not have its denial cached, as Redis could have granted it.
+func (o Redis) checkFailed(check string, start time.Time, err error) time.Duration {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		log.Errorf("Redis %s timed out after %s: %s", check, time.Since(start), err)
+		return SkipCache
+	}
+	log.Debugf("Redis %s error: %s\n", check, err)
+	return NoTTL
+}
+
+//tlsConfig returns the TLS config with the given CA and client certificate loaded, or nil when TLS isn't enabled by redis_ssl.
+//The server's name is checked against the address dialed, as the config has no ServerName.
+func (o Redis) tlsConfig() (*tls.Config, error) {
+	if !o.SSL {
+		if o.SSLCA != "" || o.SSLCert != "" || o.SSLKey != "" || o.SSLInsecureSkipVerify {
+			return nil, errors.New("Redis backend error: redis_ssl must be true to use redis_ssl_ca, redis_ssl_cert, redis_ssl_key or redis_ssl_insecure_skip_verify.\n")
+		}
+		return nil, nil
+	}
+
+	if o.SSLKey != "" && o.SSLCert == "" {
+		return nil, errors.New("Redis backend error: redis_ssl_key needs redis_ssl_cert.\n")
+	}
+
+	config := &tls.Config{InsecureSkipVerify: o.SSLInsecureSkipVerify}
+
+	if o.SSLCA != "" {
+		pem, err := ioutil.ReadFile(o.SSLCA)
+		if err != nil {
+			return nil, errors.Errorf("Redis backend error: couldn't read redis_ssl_ca: %s\n", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("Redis backend error: no certificates found in redis_ssl_ca %s.\n", o.SSLCA)
+		}
+	}
+
+	if o.SSLCert != "" {
+		keyFile := o.SSLKey
+		if keyFile == "" {
+			keyFile = o.SSLCert
+		}
+		cert, err := tls.LoadX509KeyPair(o.SSLCert, keyFile)
+		if err != nil {
+			return nil, errors.Errorf("Redis backend error: couldn't load redis_ssl_cert and redis_ssl_key: %s\n", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+//ping pings redis up to ConnectTries times, or forever when 0, waiting ConnectRetry between tries.
+//A failed TLS handshake isn't retried, as it won't succeed until the certificates are fixed.
+func (o Redis) ping() error {
+	for try := 1; ; try++ {
+		_, err := o.Conn.Ping().Result()
+		if err == nil {
+			return nil
+		}
+		if msg := err.Error(); o.SSL && (strings.Contains(msg, "x509:") || strings.Contains(msg, "tls:") || strings.Contains(msg, "certificate")) {
+			return errors.Wrap(err, "TLS handshake failed, check redis_ssl_ca, redis_ssl_cert and redis_ssl_key")
+		}
+		if o.ConnectTries > 0 && try >= o.ConnectTries {
+			return errors.Wrapf(err, "ping redis error after %d tries", try)
+		}
+		log.Errorf("ping redis error, will retry in %s: %s", o.ConnectRetry, err)
+		time.Sleep(o.ConnectRetry)
+	}
+}
+
+//redisAddresses returns the comma separated host:port addresses.
+func redisAddresses(addresses string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(addresses, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+//GetUser checks that the username exists and the given password hashes to the same password, whatever the format of the stored hash.
+//A value that isn't a known hash is compared as a plain text password only when redis_plaintext_passwords is set.
 func (o Redis) GetUser(username, password string) bool {
+	granted, _ := o.GetUserTTL(username, password)
+	return granted
+}
 
-	pwHash, err := o.Conn.Get(username).Result()
+//GetUserTTL checks the user just as GetUser, and also returns SkipCache when Redis didn't answer in time so the denial isn't cached, or NoTTL otherwise.
+func (o Redis) GetUserTTL(username, password string) (bool, time.Duration) {
+
+	start := time.Now()
+
+	pwHash, err := o.Conn.Get(o.key(o.UserKey, username, "")).Result()
 
 	if err != nil {
-		log.Debugf("Redis get user error: %s\n", err)
-		return false
+		return false, o.checkFailed("get user", start, err)
 	}
 
-	if common.HashCompare(password, pwHash) {
-		return true
+	if common.HashFormat(pwHash) == "" {
+		if o.PlaintextPasswords {
+			return subtle.ConstantTimeCompare([]byte(password), []byte(pwHash)) == 1, NoTTL
+		}
+		log.Debugf("Redis get user error: user %s has a password of unknown hash format.\n", common.RedactUsername(username))
+		return false, NoTTL
 	}
 
-	return false
+	if o.Hasher.Compare(password, pwHash) {
+		return true, NoTTL
+	}
+
+	return false, NoTTL
 
 }
 
-//GetSuperuser checks that the key username:su exists and has value "true".
+//GetSuperuser checks that the user's superuser key, username:su by default, exists and has value "true".
 func (o Redis) GetSuperuser(username string) bool {
 
-	isSuper, err := o.Conn.Get(fmt.Sprintf("%s:su", username)).Result()
+	start := time.Now()
+
+	isSuper, err := o.Conn.Get(o.key(o.SuperuserKey, username, "")).Result()
 
 	if err != nil {
-		log.Debugf("Redis get superuser error: %s\n", err)
+		o.checkFailed("get superuser", start, err)
 		return false
 	}
 
@@ -112,111 +512,163 @@ func (o Redis) GetSuperuser(username string) bool {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
+	granted, _ := o.CheckAclTTL(username, topic, clientid, acc)
+	return granted
+}
 
-	//We need to check if client is subscribing or publishing to get correct acls.
+//CheckAclTTL checks the acl just as CheckAcl, and also returns SkipCache when Redis didn't answer in time so the denial isn't cached, or NoTTL otherwise.
+func (o Redis) CheckAclTTL(username, topic, clientid string, acc int32) (bool, time.Duration) {
 
-	if acc == 1 {
-		//Subscribe
+	start := time.Now()
 
-		//Get all user read and readwrite acls.
-		urAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:racls", username)).Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
-		urwAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:rwacls", username)).Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
+	var granted bool
+	var err error
+	switch {
+	case o.AclsLayout != "sets":
+		granted, err = o.checkAclHashes(username, topic, clientid, acc)
+	case o.UseLua:
+		granted, err = o.checkAclScript(username, topic, clientid, acc)
+	default:
+		granted, err = o.checkAclSets(username, topic, clientid, acc)
+	}
 
-		//Get common read and readwrite acls
-		rAcls, err := o.Conn.SMembers("common:racls").Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
-		rwAcls, err := o.Conn.SMembers("common:rwacls").Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
+	if err != nil {
+		return false, o.checkFailed("check acl", start, err)
+	}
 
-		acls := make([]string, len(urAcls)+len(urwAcls), len(urAcls)+len(urwAcls))
-		acls = append(acls, urAcls...)
-		acls = append(acls, urwAcls...)
+	return granted, NoTTL
 
-		commonAcls := make([]string, len(rAcls)+len(rwAcls), len(rAcls)+len(rwAcls))
-		commonAcls = append(commonAcls, rAcls...)
-		commonAcls = append(commonAcls, rwAcls...)
+}
 
-		for _, acl := range acls {
-			if common.TopicsMatch(acl, topic) {
-				return true
-			}
-		}
+//checkAclScript checks the acl against the sets in a single call with redisAclScript.
+func (o Redis) checkAclScript(username, topic, clientid string, acc int32) (bool, error) {
+	keys := o.aclKeys(username, acc)
+	if keys == nil {
+		return false, nil
+	}
 
-		for _, acl := range commonAcls {
-			aclTopic := strings.Replace(acl, "%c", clientid, -1)
-			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if common.TopicsMatch(aclTopic, topic) {
-				return true
-			}
-		}
+	granted, err := redisAclScript.Run(o.Conn, keys, topic, username, clientid).Int64()
 
-	} else if acc == 2 {
-		//Publish
+	return granted == 1, err
+}
 
-		//Get all user write and readwrite acls.
-		uwAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:wacls", username)).Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
-		urwAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:rwacls", username)).Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
+//checkAclSets checks the acl against the user's and common sets.
+func (o Redis) checkAclSets(username, topic, clientid string, acc int32) (bool, error) {
 
-		//Get common write and readwrite acls
-		wAcls, err := o.Conn.SMembers("common:wacls").Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
-		rwAcls, err := o.Conn.SMembers("common:rwacls").Result()
-		if err != nil {
-			log.Debugf("Redis check acl error: %s\n", err)
-			return false
-		}
+	//We need to check if client is subscribing or publishing to get correct acls.
+	//Every key is read on its own, as in cluster mode the user's and common ones may live in different slots.
+	acls, err := o.setsMembers(o.aclKeys(username, acc))
+	if err != nil {
+		return false, err
+	}
 
-		acls := make([]string, len(uwAcls)+len(urwAcls), len(uwAcls)+len(urwAcls))
-		acls = append(acls, uwAcls...)
-		acls = append(acls, urwAcls...)
+	return redisAclsMatch(acls, topic, username, clientid), nil
 
-		commonAcls := make([]string, len(wAcls)+len(rwAcls), len(wAcls)+len(rwAcls))
-		commonAcls = append(commonAcls, wAcls...)
-		commonAcls = append(commonAcls, rwAcls...)
+}
 
-		for _, acl := range acls {
-			if common.TopicsMatch(acl, topic) {
-				return true
+//checkAclHashes checks the acl against the masks in the user's and common hashes.
+//In the auto layout, sets are read instead of a hash that doesn't exist: the user's ones for the user's hash and the common ones for the common hash.
+func (o Redis) checkAclHashes(username, topic, clientid string, acc int32) (bool, error) {
+
+	keys := o.aclKeys(username, acc)
+	owners := []struct {
+		hashKey string
+		setKeys []string
+	}{
+		{o.key(o.UserAclsHashKey, username, ""), nil},
+		{o.key(o.CommonAclsHashKey, username, ""), nil},
+	}
+	if keys != nil {
+		owners[0].setKeys, owners[1].setKeys = keys[:2], keys[2:]
+	}
+
+	//Everything is read before matching, so any error denies the check.
+	var masks []map[string]string
+	var acls []string
+	for _, owner := range owners {
+		hash, err := o.Conn.HGetAll(owner.hashKey).Result()
+		if err != nil {
+			return false, err
+		}
+		if len(hash) == 0 && o.AclsLayout == "auto" {
+			members, err := o.setsMembers(owner.setKeys)
+			if err != nil {
+				return false, err
 			}
+			acls = append(acls, members...)
+			continue
 		}
+		masks = append(masks, hash)
+	}
 
-		for _, acl := range commonAcls {
-			aclTopic := strings.Replace(acl, "%c", clientid, -1)
-			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if common.TopicsMatch(aclTopic, topic) {
-				return true
+	for _, hash := range masks {
+		for pattern, mask := range hash {
+			m, err := strconv.ParseInt(mask, 10, 32)
+			if err != nil {
+				log.Debugf("Redis check acl error: invalid mask %s for %s.\n", mask, pattern)
+				continue
+			}
+			if redisMaskGrants(int32(m), acc) && common.AclMatches(pattern, topic, username, clientid) {
+				return true, nil
 			}
 		}
+	}
+
+	return redisAclsMatch(acls, topic, username, clientid), nil
 
+}
+
+//setsMembers reads the members of every set, one by one.
+func (o Redis) setsMembers(keys []string) ([]string, error) {
+	var members []string
+	for _, key := range keys {
+		set, err := o.Conn.SMembers(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, set...)
 	}
+	return members, nil
+}
 
+//redisAclsMatch tells if any acl matches the topic. As in the files backend, both user and common acls may have %u and %c, replaced for this check only.
+func redisAclsMatch(acls []string, topic, username, clientid string) bool {
+	for _, acl := range acls {
+		if common.AclMatches(acl, topic, username, clientid) {
+			return true
+		}
+	}
 	return false
+}
+
+//redisMaskGrants tells if a permission mask, a sum of 1 to read, 2 to write and 4 to subscribe, grants every permission the access needs.
+func redisMaskGrants(mask, acc int32) bool {
+	return acc != MOSQ_ACL_NONE && mask&acc == acc
+}
+
+//aclKeys returns the keys of the user's and common acls granting the access, read or readwrite ones for subscribing and write or readwrite ones for publishing, or nil for any other access.
+func (o Redis) aclKeys(username string, acc int32) []string {
+	var kind string
+	switch acc {
+	case MOSQ_ACL_READ:
+		kind = "racls"
+	case MOSQ_ACL_WRITE:
+		kind = "wacls"
+	default:
+		return nil
+	}
+	return []string{
+		o.key(o.UserAclsKey, username, kind),
+		o.key(o.UserAclsKey, username, "rwacls"),
+		o.key(o.CommonAclsKey, username, kind),
+		o.key(o.CommonAclsKey, username, "rwacls"),
+	}
+}
 
+//key returns the prefixed key for the template, with %u replaced by the username and %a by the kind of acls.
+//Both are replaced in a single pass, so a username holding %a is kept as it is.
+func (o Redis) key(template, username, kind string) string {
+	return o.KeyPrefix + strings.NewReplacer("%u", username, "%a", kind).Replace(template)
 }
 
 //GetName returns the backend's name
@@ -22,6 +22,7 @@ var rbClientID = "test_client"
 var rbTestTopic1 = `test/topic/1`
 
 var redis Redis
+var redisLua Redis
 
 func init() {
 	var authOpts = map[string]string{
@@ -36,6 +37,12 @@ func init() {
 		log.Fatalf("Redis error: %s", err)
 	}
 	redis.Conn.FlushDB()
+
+	authOpts["redis_use_lua"] = "true"
+	redisLua, err = NewRedis(authOpts, log.ErrorLevel)
+	if err != nil {
+		log.Fatalf("Redis error: %s", err)
+	}
 }
 
 func BenchmarkRedisUser(b *testing.B) {
@@ -94,3 +101,22 @@ func BenchmarkRedisHierarchyAcl(b *testing.B) {
 	}
 	redis.Conn.FlushDB()
 }
+
+//The common acl benchmarks miss the user's acls and match a common one, so every set is read: one round trip per set, or a single one with the script.
+func BenchmarkRedisCommonAcl(b *testing.B) {
+	redis.Conn.SAdd(rbUsername+":racls", strictAcl)
+	redis.Conn.SAdd("common:rwacls", clientPattern)
+	for n := 0; n < b.N; n++ {
+		redis.CheckAcl(rbUsername, "test/test_client", rbClientID, 1)
+	}
+	redis.Conn.FlushDB()
+}
+
+func BenchmarkRedisLuaCommonAcl(b *testing.B) {
+	redisLua.Conn.SAdd(rbUsername+":racls", strictAcl)
+	redisLua.Conn.SAdd("common:rwacls", clientPattern)
+	for n := 0; n < b.N; n++ {
+		redisLua.CheckAcl(rbUsername, "test/test_client", rbClientID, 1)
+	}
+	redisLua.Conn.FlushDB()
+}
@@ -1,8 +1,22 @@
 package backends
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	goredis "github.com/go-redis/redis"
+	"github.com/iegomez/mosquitto-go-auth/common"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -164,3 +178,1095 @@ func TestRedis(t *testing.T) {
 	})
 
 }
+
+func TestRedisModes(t *testing.T) {
+
+	Convey("Given invalid mode options NewRedis should fail before connecting", t, func() {
+		for _, opts := range []map[string]string{
+			{"redis_mode": "replica"},
+			{"redis_mode": "sentinel", "redis_sentinel_addresses": "localhost:26379"},
+			{"redis_mode": "sentinel", "redis_master_name": "mymaster"},
+			{"redis_mode": "cluster"},
+			{"redis_mode": "cluster", "redis_cluster_addresses": "localhost:7000", "redis_db": "2"},
+		} {
+			_, err := NewRedis(opts, log.DebugLevel)
+			So(err, ShouldBeError)
+		}
+	})
+
+	Convey("Given invalid numbers NewRedis should warn and use the defaults", t, func() {
+		redis, err := NewRedis(map[string]string{"redis_connect_tries": "-1", "redis_connect_retry_ms": "0", "redis_db": "first"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+		So(redis.ConnectTries, ShouldEqual, 0)
+		So(redis.ConnectRetry, ShouldEqual, 2*time.Second)
+		So(redis.DB, ShouldEqual, 1)
+	})
+
+	Convey("Given addresses, they should be split and trimmed", t, func() {
+		So(redisAddresses(" node1:7000, node2:7001,,node3:7002 "), ShouldResemble, []string{"node1:7000", "node2:7001", "node3:7002"})
+		So(redisAddresses(""), ShouldBeEmpty)
+	})
+
+	Convey("Given unreachable nodes, NewRedis should fail once every try failed", t, func() {
+		for _, opts := range []map[string]string{
+			{"redis_host": "127.0.0.1", "redis_port": "1"},
+			{"redis_mode": "sentinel", "redis_master_name": "mymaster", "redis_sentinel_addresses": "127.0.0.1:1"},
+			{"redis_mode": "cluster", "redis_cluster_addresses": "127.0.0.1:1,127.0.0.1:2"},
+		} {
+			opts["redis_connect_tries"] = "2"
+			opts["redis_connect_retry_ms"] = "10"
+			_, err := NewRedis(opts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "after 2 tries")
+		}
+	})
+}
+
+//TestRedisCluster needs a cluster, e.g. one started with redis-cli --cluster create, whose nodes are given in REDIS_CLUSTER_ADDRESSES.
+func TestRedisCluster(t *testing.T) {
+
+	addresses := os.Getenv("REDIS_CLUSTER_ADDRESSES")
+	if addresses == "" {
+		t.Skip("REDIS_CLUSTER_ADDRESSES not set")
+	}
+
+	Convey("Given a cluster, users and acls spread across its slots should be checked", t, func() {
+		redis, err := NewRedis(map[string]string{
+			"redis_mode":              "cluster",
+			"redis_cluster_addresses": addresses,
+			"redis_connect_tries":     "3",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		cluster, ok := redis.Conn.(*goredis.ClusterClient)
+		So(ok, ShouldBeTrue)
+
+		flush := func() {
+			cluster.ForEachMaster(func(node *goredis.Client) error {
+				return node.FlushDB().Err()
+			})
+		}
+		flush()
+		defer flush()
+
+		testRedisChecks(redis)
+	})
+}
+
+//TestRedisSentinel needs sentinels monitoring a master, whose addresses and name are given in REDIS_SENTINEL_ADDRESSES and REDIS_MASTER_NAME.
+func TestRedisSentinel(t *testing.T) {
+
+	addresses := os.Getenv("REDIS_SENTINEL_ADDRESSES")
+	masterName := os.Getenv("REDIS_MASTER_NAME")
+	if addresses == "" || masterName == "" {
+		t.Skip("REDIS_SENTINEL_ADDRESSES or REDIS_MASTER_NAME not set")
+	}
+
+	Convey("Given sentinels, users and acls should be checked against their master", t, func() {
+		redis, err := NewRedis(map[string]string{
+			"redis_mode":               "sentinel",
+			"redis_sentinel_addresses": addresses,
+			"redis_master_name":        masterName,
+			"redis_db":                 "2",
+			"redis_connect_tries":      "3",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		redis.Conn.FlushDB()
+		defer redis.Conn.FlushDB()
+
+		testRedisChecks(redis)
+	})
+}
+
+//testRedisChecks stores a user with acls and common ones, whose keys hash to different cluster slots, and checks them.
+func testRedisChecks(redis Redis) {
+	//Hash generated by the pw utility
+	redis.Conn.Set("dev1", "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==", 0)
+	redis.Conn.Set("dev1:su", "false", 0)
+	redis.Conn.SAdd("dev1:racls", "tele/dev1/#")
+	redis.Conn.SAdd("dev1:wacls", "cmd/dev1/+")
+	redis.Conn.SAdd("common:rwacls", "shared/%c/#")
+
+	So(redis.GetUser("dev1", "testpw"), ShouldBeTrue)
+	So(redis.GetUser("dev1", "wrong_password"), ShouldBeFalse)
+	So(redis.GetSuperuser("dev1"), ShouldBeFalse)
+	So(redis.CheckAcl("dev1", "tele/dev1/temperature", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+	So(redis.CheckAcl("dev1", "cmd/dev1/reboot", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+	So(redis.CheckAcl("dev1", "cmd/dev1/reboot", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+	So(redis.CheckAcl("dev1", "shared/client1/state", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+	So(redis.CheckAcl("dev1", "shared/client2/state", "client1", MOSQ_ACL_WRITE), ShouldBeFalse)
+}
+
+func TestRedisTLS(t *testing.T) {
+
+	certs, err := writeTestCerts()
+	defer os.RemoveAll(certs.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	otherCerts, err := writeTestCerts()
+	defer os.RemoveAll(otherCerts.Dir)
+	if err != nil {
+		t.Fatalf("couldn't generate test certs: %s", err)
+	}
+
+	Convey("Given wrong TLS options NewRedis should fail before connecting", t, func() {
+		for _, c := range []struct {
+			opts map[string]string
+			err  string
+		}{
+			{map[string]string{"redis_ssl_ca": certs.CA}, "redis_ssl must be true"},
+			{map[string]string{"redis_ssl_insecure_skip_verify": "true"}, "redis_ssl must be true"},
+			{map[string]string{"redis_ssl": "true", "redis_ssl_ca": filepath.Join(certs.Dir, "missing.pem")}, "couldn't read redis_ssl_ca"},
+			{map[string]string{"redis_ssl": "true", "redis_ssl_ca": certs.ClientKey}, "no certificates found"},
+			{map[string]string{"redis_ssl": "true", "redis_ssl_key": certs.ClientKey}, "redis_ssl_key needs redis_ssl_cert"},
+			{map[string]string{"redis_ssl": "true", "redis_ssl_cert": certs.ClientCert, "redis_ssl_key": otherCerts.ClientKey}, "redis_ssl_cert and redis_ssl_key"},
+		} {
+			_, err := NewRedis(c.opts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, c.err)
+		}
+	})
+
+	Convey("Given TLS options, the config should carry the CA and client certificate", t, func() {
+		redis := Redis{SSL: true, SSLCA: certs.CA, SSLCert: certs.ClientCert, SSLKey: certs.ClientKey}
+
+		config, err := redis.tlsConfig()
+		So(err, ShouldBeNil)
+		So(config.RootCAs, ShouldNotBeNil)
+		So(config.Certificates, ShouldHaveLength, 1)
+		So(config.InsecureSkipVerify, ShouldBeFalse)
+
+		Convey("Without redis_ssl there should be no TLS config", func() {
+			config, err := Redis{}.tlsConfig()
+			So(err, ShouldBeNil)
+			So(config, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a Redis server requiring TLS and client certificates", t, func() {
+		config, err := fakeRedisTLSConfig(certs)
+		So(err, ShouldBeNil)
+		server, err := newFakeRedisServer(config, map[string]string{
+			//Hash generated by the pw utility
+			"test":    "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+			"test:su": "true",
+		}, nil)
+		So(err, ShouldBeNil)
+		defer server.Close()
+
+		host, port, _ := net.SplitHostPort(server.Addr().String())
+		authOpts := map[string]string{
+			"redis_host":             host,
+			"redis_port":             port,
+			"redis_ssl":              "true",
+			"redis_ssl_ca":           certs.CA,
+			"redis_ssl_cert":         certs.ClientCert,
+			"redis_ssl_key":          certs.ClientKey,
+			"redis_connect_tries":    "3",
+			"redis_connect_retry_ms": "10",
+		}
+
+		Convey("With the right CA and client certificate checks should go through", func() {
+			redis, err := NewRedis(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer redis.Halt()
+
+			So(redis.GetUser("test", "testpw"), ShouldBeTrue)
+			So(redis.GetSuperuser("test"), ShouldBeTrue)
+		})
+
+		Convey("With another CA the handshake should fail at once with a clear error", func() {
+			authOpts["redis_ssl_ca"] = otherCerts.CA
+			authOpts["redis_connect_tries"] = "0"
+			_, err := NewRedis(authOpts, log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "TLS handshake failed")
+		})
+
+		Convey("Skipping verification should accept the server's certificate", func() {
+			delete(authOpts, "redis_ssl_ca")
+			authOpts["redis_ssl_insecure_skip_verify"] = "true"
+			redis, err := NewRedis(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer redis.Halt()
+
+			So(redis.GetUser("test", "testpw"), ShouldBeTrue)
+		})
+
+		Convey("Without a client certificate the handshake should fail", func() {
+			delete(authOpts, "redis_ssl_cert")
+			delete(authOpts, "redis_ssl_key")
+			_, err := NewRedis(authOpts, log.DebugLevel)
+			So(err, ShouldBeError)
+		})
+	})
+}
+
+//fakeRedisTLSConfig returns the config of a server with the test certificate, requiring a client certificate signed by the test CA.
+func fakeRedisTLSConfig(certs testCerts) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(certs.CA)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(pem)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+//fakeRedis is a fake Redis server serving the given string, set and hash keys. It only knows the commands the backend sends to check users.
+type fakeRedis struct {
+	keys   map[string]string
+	sets   map[string][]string
+	hashes map[string]map[string]string
+	//users are the Redis 6 users and passwords AUTH accepts, when set, and then any other command needs an authenticated connection.
+	users map[string]string
+	//delay is waited before replying to reads of keys, as a hung server would.
+	delay time.Duration
+}
+
+//fakeRedisServer is a running fakeRedis, whose Close also closes the connections it accepted, as a restarting server would.
+type fakeRedisServer struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+//Close stops listening and closes every accepted connection.
+func (s *fakeRedisServer) Close() error {
+	err := s.Listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	return err
+}
+
+//newFakeRedisServer serves the given string and set keys on a free port, over TLS when given a config.
+func newFakeRedisServer(config *tls.Config, keys map[string]string, sets map[string][]string) (*fakeRedisServer, error) {
+	return fakeRedis{keys: keys, sets: sets}.listen(config, "127.0.0.1:0")
+}
+
+//listen serves the fake on the address, over TLS when given a config.
+func (f fakeRedis) listen(config *tls.Config, addr string) (*fakeRedisServer, error) {
+	var listener net.Listener
+	var err error
+	if config != nil {
+		listener, err = tls.Listen("tcp", addr, config)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	server := &fakeRedisServer{Listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+
+	return server, nil
+}
+
+//serve answers the RESP commands read from the connection until it's closed.
+func (f fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := f.users == nil
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+		args := make([]string, n)
+		for i := range args {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return
+			}
+			arg, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+		if n == 0 {
+			continue
+		}
+
+		var reply string
+		command := strings.ToUpper(args[0])
+		switch {
+		case command == "AUTH":
+			//Without users any password is accepted, while with them AUTH with just a password is for the default user, which is disabled.
+			ok := f.users == nil
+			if n == 3 {
+				password, found := f.users[args[1]]
+				ok = ok || (found && password == args[2])
+			}
+			if ok {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case command == "PING":
+			reply = "+PONG\r\n"
+		case command == "SELECT":
+			reply = "+OK\r\n"
+		case command == "GET":
+			time.Sleep(f.delay)
+			if value, ok := f.keys[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case command == "SMEMBERS":
+			time.Sleep(f.delay)
+			members := f.sets[args[1]]
+			reply = fmt.Sprintf("*%d\r\n", len(members))
+			for _, member := range members {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+			}
+		case command == "HGETALL":
+			time.Sleep(f.delay)
+			hash := f.hashes[args[1]]
+			reply = fmt.Sprintf("*%d\r\n", 2*len(hash))
+			for field, value := range hash {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(value), value)
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisUsername(t *testing.T) {
+
+	fake := fakeRedis{
+		keys: map[string]string{
+			//Hash generated by the pw utility
+			"test":    "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+			"test:su": "true",
+		},
+		sets: map[string][]string{
+			"test:racls": {"test/topic"},
+		},
+		users: map[string]string{"mqtt": "secret"},
+	}
+	server, err := fake.listen(nil, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr().String())
+	authOpts := func(opts map[string]string) map[string]string {
+		opts["redis_host"] = host
+		opts["redis_port"] = port
+		opts["redis_connect_tries"] = "1"
+		return opts
+	}
+
+	Convey("Given a Redis 6 user, the backend should authenticate as it before selecting the DB", t, func() {
+		redis, err := NewRedis(authOpts(map[string]string{
+			"redis_username": "mqtt",
+			"redis_password": "secret",
+			"redis_db":       "3",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		So(redis.Username, ShouldEqual, "mqtt")
+		So(redis.GetUser("test", "testpw"), ShouldBeTrue)
+		So(redis.GetSuperuser("test"), ShouldBeTrue)
+		So(redis.CheckAcl("test", "test/topic", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+	Convey("Given a wrong password for the user, the backend should fail to start", t, func() {
+		_, err := NewRedis(authOpts(map[string]string{
+			"redis_username": "mqtt",
+			"redis_password": "wrong",
+		}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "WRONGPASS")
+	})
+
+	Convey("Given only the user's password, the backend should fail to start, as it's checked against the default user", t, func() {
+		_, err := NewRedis(authOpts(map[string]string{"redis_password": "secret"}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a user without a password, the backend should fail", t, func() {
+		_, err := NewRedis(authOpts(map[string]string{"redis_username": "mqtt"}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "redis_password")
+	})
+}
+
+func TestRedisTimeouts(t *testing.T) {
+
+	Convey("Given invalid timeouts, the backend should warn and keep the client's defaults", t, func() {
+		for _, timeout := range []string{"0", "-1", "soon"} {
+			redis, err := NewRedis(map[string]string{"redis_dial_timeout_ms": timeout, "redis_read_timeout_ms": timeout, "redis_write_timeout_ms": timeout}, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(redis.DialTimeout, ShouldEqual, 0)
+			So(redis.ReadTimeout, ShouldEqual, 0)
+			So(redis.WriteTimeout, ShouldEqual, 0)
+			redis.Halt()
+		}
+	})
+
+	Convey("Given an unreachable Redis, connecting should give up after the dial timeout", t, func() {
+		start := time.Now()
+		_, err := NewRedis(map[string]string{
+			"redis_host":            "10.255.255.1",
+			"redis_connect_tries":   "1",
+			"redis_dial_timeout_ms": "200",
+		}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+	})
+
+	fake := fakeRedis{
+		keys: map[string]string{
+			//Hash generated by the pw utility
+			"test": "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+		},
+		sets: map[string][]string{
+			"test:racls": {"test/topic"},
+		},
+		delay: time.Second,
+	}
+	server, err := fake.listen(nil, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr().String())
+
+	Convey("Given a hung Redis, checks should be denied after the read timeout and their denials not cached", t, func() {
+		redis, err := NewRedis(map[string]string{
+			"redis_host":            host,
+			"redis_port":            port,
+			"redis_connect_tries":   "1",
+			"redis_read_timeout_ms": "100",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		So(redis.ReadTimeout, ShouldEqual, 100*time.Millisecond)
+
+		start := time.Now()
+		granted, ttl := redis.GetUserTTL("test", "testpw")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+		So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+
+		start = time.Now()
+		granted, ttl = redis.CheckAclTTL("test", "test/topic", "client1", MOSQ_ACL_READ)
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, SkipCache)
+		So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+
+		So(redis.GetSuperuser("test"), ShouldBeFalse)
+	})
+}
+
+func TestRedisRestart(t *testing.T) {
+
+	fake := fakeRedis{
+		keys: map[string]string{
+			//Hash generated by the pw utility
+			"test": "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+		},
+		sets: map[string][]string{
+			"test:racls": {"test/topic"},
+		},
+	}
+	server, err := fake.listen(nil, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	addr := server.Addr().String()
+	defer func() {
+		server.Close()
+	}()
+
+	host, port, _ := net.SplitHostPort(addr)
+
+	Convey("Given Redis restarts, checks should recover without failing", t, func() {
+		redis, err := NewRedis(map[string]string{"redis_host": host, "redis_port": port, "redis_connect_tries": "1"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		So(redis.GetUser("test", "testpw"), ShouldBeTrue)
+		So(redis.CheckAcl("test", "test/topic", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+
+		So(server.Close(), ShouldBeNil)
+
+		//While it's down, checks are denied, and as it refused them right away their denials may be cached.
+		granted, ttl := redis.GetUserTTL("test", "testpw")
+		So(granted, ShouldBeFalse)
+		So(ttl, ShouldEqual, NoTTL)
+
+		server, err = fake.listen(nil, addr)
+		So(err, ShouldBeNil)
+
+		So(redis.GetUser("test", "testpw"), ShouldBeTrue)
+		So(redis.CheckAcl("test", "test/topic", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+
+		Convey("Connections broken while idle should be replaced on the first check", func() {
+			So(server.Close(), ShouldBeNil)
+			server, err = fake.listen(nil, addr)
+			So(err, ShouldBeNil)
+
+			So(redis.GetUser("test", "testpw"), ShouldBeTrue)
+		})
+	})
+}
+
+func TestRedisPasswordFormats(t *testing.T) {
+
+	//Every user's password is testpw. The bcrypt hash was generated with a cost of 10 and the argon2id one with m=65536, t=2 and p=1.
+	users := map[string]string{
+		"pbkdf2":    "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+		"bcrypt":    "$2a$10$xh80J54UqwoR.HWQOMeF2eOHC/Ziwjbr3gf5eG9fh8g08HdwHKNVS",
+		"argon2id":  "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHRzb21lc2FsdA$AC1FikY9QicR2N1utdwXZqEkITDTLWlD/D2HFKeahgY",
+		"plaintext": "testpw",
+		"malformed": "$argon2id$v=19$m=0,t=2,p=1$c29tZXNhbHQ$",
+		"truncated": "PBKDF2$sha512",
+	}
+
+	server, err := newFakeRedisServer(nil, users, nil)
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr().String())
+	authOpts := map[string]string{
+		"redis_host":          host,
+		"redis_port":          port,
+		"redis_connect_tries": "1",
+	}
+
+	Convey("Given users with hashes of every format, their format should be detected", t, func() {
+		redis, err := NewRedis(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		for _, username := range []string{"pbkdf2", "bcrypt", "argon2id"} {
+			So(redis.GetUser(username, "testpw"), ShouldBeTrue)
+			So(redis.GetUser(username, "wrong_password"), ShouldBeFalse)
+		}
+
+		Convey("Malformed hashes should never match", func() {
+			So(redis.GetUser("malformed", "testpw"), ShouldBeFalse)
+			So(redis.GetUser("truncated", "testpw"), ShouldBeFalse)
+		})
+
+		Convey("Plain text passwords should be denied unless told to accept them", func() {
+			So(redis.GetUser("plaintext", "testpw"), ShouldBeFalse)
+
+			authOpts["redis_plaintext_passwords"] = "true"
+			plaintext, err := NewRedis(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer plaintext.Halt()
+
+			So(plaintext.PlaintextPasswords, ShouldBeTrue)
+			So(plaintext.GetUser("plaintext", "testpw"), ShouldBeTrue)
+			So(plaintext.GetUser("plaintext", "wrong_password"), ShouldBeFalse)
+			So(plaintext.GetUser("bcrypt", "testpw"), ShouldBeTrue)
+			So(plaintext.GetUser("bcrypt", users["bcrypt"]), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given the reference argon2id vector, it should be verified", t, func() {
+		So(common.HashCompare("password", "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"), ShouldBeTrue)
+		So(common.HashCompare("password", "$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"), ShouldBeFalse)
+		So(common.HashFormat("$2y$10$xh80J54UqwoR.HWQOMeF2eOHC/Ziwjbr3gf5eG9fh8g08HdwHKNVS"), ShouldEqual, common.HashBcrypt)
+		So(common.HashFormat("testpw"), ShouldEqual, "")
+	})
+}
+
+func TestRedisCommands(t *testing.T) {
+
+	server, err := newFakeRedisServer(nil, map[string]string{
+		//Hash generated by the pw utility
+		"test":    "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+		"test:su": "false",
+	}, nil)
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr().String())
+
+	Convey("Given a client recording its commands, checks should only read the user's and common keys by name", t, func() {
+		redis, err := NewRedis(map[string]string{"redis_host": host, "redis_port": port, "redis_connect_tries": "1"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		var commands []string
+		redis.Conn.WrapProcess(func(process func(cmd goredis.Cmder) error) func(cmd goredis.Cmder) error {
+			return func(cmd goredis.Cmder) error {
+				args := make([]string, len(cmd.Args()))
+				for i, arg := range cmd.Args() {
+					args[i] = fmt.Sprint(arg)
+				}
+				commands = append(commands, strings.Join(args, " "))
+				return process(cmd)
+			}
+		})
+
+		redis.GetUser("test", "testpw")
+		redis.GetSuperuser("test")
+		redis.CheckAcl("test", "test/topic", "client1", MOSQ_ACL_READ)
+		redis.CheckAcl("test", "test/topic", "client1", MOSQ_ACL_WRITE)
+
+		//Every key is named after the user or common, so the keyspace is never walked with KEYS or SCAN.
+		So(commands, ShouldResemble, []string{
+			"get test",
+			"get test:su",
+			"smembers test:racls",
+			"smembers test:rwacls",
+			"smembers common:racls",
+			"smembers common:rwacls",
+			"smembers test:wacls",
+			"smembers test:rwacls",
+			"smembers common:wacls",
+			"smembers common:rwacls",
+		})
+	})
+}
+
+func TestRedisKeys(t *testing.T) {
+
+	Convey("Given no key options, keys should keep the default layout", t, func() {
+		redis := Redis{UserKey: "%u", SuperuserKey: "%u:su", UserAclsKey: "%u:%a", CommonAclsKey: "common:%a"}
+
+		So(redis.key(redis.UserKey, "test", ""), ShouldEqual, "test")
+		So(redis.key(redis.SuperuserKey, "test", ""), ShouldEqual, "test:su")
+		So(redis.aclKeys("test", MOSQ_ACL_READ), ShouldResemble, []string{"test:racls", "test:rwacls", "common:racls", "common:rwacls"})
+		So(redis.aclKeys("test", MOSQ_ACL_WRITE), ShouldResemble, []string{"test:wacls", "test:rwacls", "common:wacls", "common:rwacls"})
+		So(redis.aclKeys("test", MOSQ_ACL_SUBSCRIBE), ShouldBeNil)
+
+		Convey("A username holding a placeholder should be kept as it is", func() {
+			So(redis.aclKeys("%a%u", MOSQ_ACL_READ)[0], ShouldEqual, "%a%u:racls")
+		})
+	})
+
+	Convey("Given key templates missing a placeholder, the backend should fail", t, func() {
+		for opt, key := range map[string]string{
+			"redis_user_key":        "users",
+			"redis_superuser_key":   "su",
+			"redis_user_acls_key":   "acls:%u",
+			"redis_common_acls_key": "common",
+		} {
+			_, err := NewRedis(map[string]string{opt: key}, log.DebugLevel)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, opt)
+		}
+
+		_, err := NewRedis(map[string]string{"redis_user_key": "users:%u", "redis_superuser_key": "users:%u"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	server, err := newFakeRedisServer(nil, map[string]string{
+		//Hash generated by the pw utility
+		"iot:users:test":      "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+		"iot:superusers:test": "true",
+		//Keys in the default layout must be ignored.
+		"test":    "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw==",
+		"test:su": "true",
+	}, map[string][]string{
+		"iot:acls:test:racls":  {"test/read"},
+		"iot:acls:test:rwacls": {"test/readwrite/#"},
+		"iot:patterns:wacls":   {"clients/%c/write"},
+		"iot:patterns:rwacls":  {"users/%u/#"},
+		"test:racls":           {"test/default"},
+		"common:racls":         {"test/default/common"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr().String())
+
+	Convey("Given custom key names, users and acls should be read from them", t, func() {
+		redis, err := NewRedis(map[string]string{
+			"redis_host":            host,
+			"redis_port":            port,
+			"redis_connect_tries":   "1",
+			"redis_key_prefix":      "iot:",
+			"redis_user_key":        "users:%u",
+			"redis_superuser_key":   "superusers:%u",
+			"redis_user_acls_key":   "acls:%u:%a",
+			"redis_common_acls_key": "patterns:%a",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		So(redis.GetUser("test", "testpw"), ShouldBeTrue)
+		So(redis.GetUser("test", "wrong_password"), ShouldBeFalse)
+		So(redis.GetSuperuser("test"), ShouldBeTrue)
+		So(redis.GetUser("users:test", "testpw"), ShouldBeFalse)
+
+		So(redis.CheckAcl("test", "test/read", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(redis.CheckAcl("test", "test/read", "client1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(redis.CheckAcl("test", "test/readwrite/1", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(redis.CheckAcl("test", "clients/client1/write", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(redis.CheckAcl("test", "clients/client2/write", "client1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(redis.CheckAcl("test", "users/test/1", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(redis.CheckAcl("test", "test/default", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(redis.CheckAcl("test", "test/default/common", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+
+		Convey("Keys of another prefix should be ignored", func() {
+			other, err := NewRedis(map[string]string{
+				"redis_host":          host,
+				"redis_port":          port,
+				"redis_connect_tries": "1",
+				"redis_key_prefix":    "other:",
+			}, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer other.Halt()
+
+			So(other.GetUser("test", "testpw"), ShouldBeFalse)
+			So(other.GetSuperuser("test"), ShouldBeFalse)
+			So(other.CheckAcl("test", "test/default", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Without options, the default layout should be read", func() {
+			defaults, err := NewRedis(map[string]string{
+				"redis_host":          host,
+				"redis_port":          port,
+				"redis_connect_tries": "1",
+			}, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer defaults.Halt()
+
+			So(defaults.GetUser("test", "testpw"), ShouldBeTrue)
+			So(defaults.GetSuperuser("test"), ShouldBeTrue)
+			So(defaults.CheckAcl("test", "test/default", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(defaults.CheckAcl("test", "test/default/common", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(defaults.CheckAcl("test", "test/read", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRedisAclPatterns(t *testing.T) {
+
+	server, err := newFakeRedisServer(nil, nil, map[string][]string{
+		"common:racls":  {"devices/%u/#", "clients/%c/status"},
+		"common:wacls":  {"devices/%u/%c/state"},
+		"common:rwacls": {"shared/%u"},
+		"dev1:racls":    {"own/%u/%c"},
+		"#:racls":       {"own/%u"},
+		"+:racls":       {"own/%u/x"},
+		"a/b:racls":     {"own/%u"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr().String())
+
+	Convey("Given acls with %u and %c, they should be replaced by the username and client id of each check", t, func() {
+		redis, err := NewRedis(map[string]string{"redis_host": host, "redis_port": port, "redis_connect_tries": "1"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		So(redis.CheckAcl("dev1", "devices/dev1/temperature", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(redis.CheckAcl("dev2", "devices/dev2/temperature", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(redis.CheckAcl("dev1", "devices/dev2/temperature", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(redis.CheckAcl("dev1", "devices/%u/temperature", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(redis.CheckAcl("dev1", "clients/client1/status", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(redis.CheckAcl("dev1", "clients/client2/status", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(redis.CheckAcl("dev1", "devices/dev1/client1/state", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(redis.CheckAcl("dev1", "devices/dev1/client2/state", "client1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(redis.CheckAcl("dev1", "shared/dev1", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+
+		Convey("User acls may have them too", func() {
+			So(redis.CheckAcl("dev1", "own/dev1/client1", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(redis.CheckAcl("dev1", "own/dev1/client2", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Usernames and client ids with wildcards or levels should never widen an acl", func() {
+			So(redis.CheckAcl("#", "devices/anyone/temperature", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("#", "devices/#", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("+", "devices/+/temperature", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("a/b", "devices/a/b/temperature", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("#", "own/anyone", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("+", "own/anyone/x", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("a/b", "own/a/b", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("dev1", "clients/any/status", "+", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("dev1", "clients/#", "#", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("dev1", "devices/dev1/a/b/state", "a/b", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRedisAclMasks(t *testing.T) {
+
+	Convey("Given every mask, it should grant exactly the accesses it has every permission of", t, func() {
+		accs := []int32{MOSQ_ACL_READ, MOSQ_ACL_WRITE, MOSQ_ACL_READWRITE, MOSQ_ACL_SUBSCRIBE}
+		granted := map[int32][]bool{
+			0: {false, false, false, false},
+			1: {true, false, false, false},
+			2: {false, true, false, false},
+			3: {true, true, true, false},
+			4: {false, false, false, true},
+			5: {true, false, false, true},
+			6: {false, true, false, true},
+			7: {true, true, true, true},
+		}
+		for mask, expected := range granted {
+			for i, acc := range accs {
+				So(redisMaskGrants(mask, acc), ShouldEqual, expected[i])
+			}
+			So(redisMaskGrants(mask, MOSQ_ACL_NONE), ShouldBeFalse)
+		}
+	})
+
+	hashes := map[string]map[string]string{
+		"test:acls": {},
+		"common:acls": {
+			"common/%u/status": "5",
+			"broken/mask":      "many",
+		},
+	}
+	//A topic for each mask, named after it.
+	for mask := 0; mask <= 7; mask++ {
+		hashes["test:acls"][fmt.Sprintf("mask/%d/#", mask)] = strconv.Itoa(mask)
+	}
+
+	fake := fakeRedis{
+		sets: map[string][]string{
+			"test:racls":    {"legacy/read"},
+			"legacy:racls":  {"legacy/read"},
+			"legacy:rwacls": {"legacy/readwrite"},
+			"common:wacls":  {"legacy/common/write"},
+		},
+		hashes: hashes,
+	}
+	server, err := fake.listen(nil, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr().String())
+	newRedis := func(layout string) (Redis, error) {
+		return NewRedis(map[string]string{
+			"redis_host":          host,
+			"redis_port":          port,
+			"redis_connect_tries": "1",
+			"redis_acls_layout":   layout,
+		}, log.DebugLevel)
+	}
+
+	Convey("Given the hash layout, each mask should be checked against each access", t, func() {
+		redis, err := newRedis("hash")
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		for mask := int32(0); mask <= 7; mask++ {
+			topic := fmt.Sprintf("mask/%d/topic", mask)
+			for _, acc := range []int32{MOSQ_ACL_READ, MOSQ_ACL_WRITE, MOSQ_ACL_READWRITE, MOSQ_ACL_SUBSCRIBE} {
+				So(redis.CheckAcl("test", topic, "client1", acc), ShouldEqual, redisMaskGrants(mask, acc))
+			}
+		}
+
+		So(redis.CheckAcl("test", "mask/4/topic", "client1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+		So(redis.CheckAcl("test", "mask/4/topic", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+
+		Convey("Common hashes should apply to any user, replacing %u and %c", func() {
+			So(redis.CheckAcl("other", "common/other/status", "client1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(redis.CheckAcl("other", "common/other/status", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+			So(redis.CheckAcl("other", "common/other/status", "client1", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(redis.CheckAcl("other", "common/test/status", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("#", "common/#", "client1", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+		})
+
+		Convey("Invalid masks should grant nothing", func() {
+			for _, acc := range []int32{MOSQ_ACL_READ, MOSQ_ACL_WRITE, MOSQ_ACL_SUBSCRIBE} {
+				So(redis.CheckAcl("test", "broken/mask", "client1", acc), ShouldBeFalse)
+			}
+		})
+
+		Convey("Sets should be ignored", func() {
+			So(redis.CheckAcl("test", "legacy/read", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+			So(redis.CheckAcl("legacy", "legacy/read", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given the auto layout, sets should be read for users without a hash", t, func() {
+		redis, err := newRedis("auto")
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		So(redis.CheckAcl("test", "mask/4/topic", "client1", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+		So(redis.CheckAcl("test", "legacy/read", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(redis.CheckAcl("legacy", "legacy/read", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(redis.CheckAcl("legacy", "legacy/readwrite", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(redis.CheckAcl("legacy", "legacy/read", "client1", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(redis.CheckAcl("legacy", "common/legacy/status", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		//The common hash exists, so the common sets aren't read.
+		So(redis.CheckAcl("legacy", "legacy/common/write", "client1", MOSQ_ACL_WRITE), ShouldBeFalse)
+	})
+
+	Convey("Given the default sets layout, hashes should be ignored", t, func() {
+		redis, err := newRedis("sets")
+		So(err, ShouldBeNil)
+		defer redis.Halt()
+
+		So(redis.CheckAcl("test", "legacy/read", "client1", MOSQ_ACL_READ), ShouldBeTrue)
+		So(redis.CheckAcl("test", "mask/7/topic", "client1", MOSQ_ACL_READ), ShouldBeFalse)
+		So(redis.CheckAcl("legacy", "legacy/common/write", "client1", MOSQ_ACL_WRITE), ShouldBeTrue)
+	})
+
+	Convey("Given an unknown layout or the hash one with the script, the backend should fail", t, func() {
+		_, err := NewRedis(map[string]string{"redis_acls_layout": "lists"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewRedis(map[string]string{"redis_acls_layout": "hash", "redis_use_lua": "true"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "redis_use_lua")
+	})
+}
+
+//TestRedisLua runs the same acl checks with and without redis_use_lua, which must always decide alike.
+func TestRedisLua(t *testing.T) {
+
+	authOpts := map[string]string{
+		"redis_host":     "localhost",
+		"redis_port":     "6379",
+		"redis_db":       "2",
+		"redis_password": "",
+	}
+
+	Convey("Given redis_use_lua in cluster mode NewRedis should fail", t, func() {
+		_, err := NewRedis(map[string]string{"redis_mode": "cluster", "redis_cluster_addresses": "localhost:7000", "redis_use_lua": "true"}, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given acls checked with and without the script", t, func() {
+		commands, err := NewRedis(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer commands.Halt()
+
+		authOpts["redis_use_lua"] = "true"
+		lua, err := NewRedis(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer lua.Halt()
+		So(lua.UseLua, ShouldBeTrue)
+
+		commands.Conn.FlushDB()
+		defer commands.Conn.FlushDB()
+
+		commands.Conn.SAdd("test:racls", "test/topic/1", "single/+/level", "hier/#", "#")
+		commands.Conn.SAdd("test:wacls", "write/only", "$share/group/shared/write")
+		commands.Conn.SAdd("test:rwacls", "readwrite/+/x", "own/%u/%c")
+		commands.Conn.SAdd("common:racls", "users/%u/#", "clients/%c/+", "both/%u/%c")
+		commands.Conn.SAdd("common:wacls", "out/%u", "percent/%u/%c")
+		commands.Conn.SAdd("common:rwacls", "common/topic")
+		commands.Conn.SAdd("other:racls", "other/only")
+
+		cases := []struct {
+			username string
+			topic    string
+			clientid string
+			acc      int32
+			granted  bool
+		}{
+			{"test", "test/topic/1", "id", MOSQ_ACL_READ, true},
+			{"test", "anything/at/all", "id", MOSQ_ACL_READ, true},
+			{"test", "$SYS/broker/uptime", "id", MOSQ_ACL_READ, false},
+			{"test", "$share/group/test/topic/1", "id", MOSQ_ACL_READ, true},
+			{"test", "write/only", "id", MOSQ_ACL_WRITE, true},
+			{"test", "write/only/more", "id", MOSQ_ACL_WRITE, false},
+			{"test", "$share/group/shared/write", "id", MOSQ_ACL_WRITE, true},
+			{"test", "shared/write", "id", MOSQ_ACL_WRITE, false},
+			{"test", "readwrite/a/x", "id", MOSQ_ACL_WRITE, true},
+			{"test", "readwrite/a/y", "id", MOSQ_ACL_WRITE, false},
+			{"test", "out/test", "id", MOSQ_ACL_WRITE, true},
+			{"test", "out/other", "id", MOSQ_ACL_WRITE, false},
+			{"test", "common/topic", "id", MOSQ_ACL_WRITE, true},
+			{"test", "common/topic", "id", MOSQ_ACL_SUBSCRIBE, false},
+			{"other", "single/a/level", "id", MOSQ_ACL_READ, false},
+			{"other", "users/other/a/b", "id", MOSQ_ACL_READ, true},
+			{"other", "users/test/a", "id", MOSQ_ACL_READ, false},
+			{"other", "clients/id/a", "id", MOSQ_ACL_READ, true},
+			{"other", "clients/id/a/b", "id", MOSQ_ACL_READ, false},
+			{"other", "both/other/id", "id", MOSQ_ACL_READ, true},
+			{"other", "other/only", "id", MOSQ_ACL_READ, true},
+			{"other", "test/topic/1", "id", MOSQ_ACL_READ, false},
+			{"a+b", "users/a+b/x", "id", MOSQ_ACL_READ, false},
+			{"other", "clients/a/b/c", "a/b", MOSQ_ACL_READ, false},
+			{"50%", "percent/50%/x%y", "x%y", MOSQ_ACL_WRITE, true},
+			{"%c", "out/id", "id", MOSQ_ACL_WRITE, false},
+			{"%c", "out/%c", "id", MOSQ_ACL_WRITE, true},
+			{"a%c", "users/alice/x", "lice", MOSQ_ACL_READ, false},
+			{"a%c", "users/a%c/x", "lice", MOSQ_ACL_READ, true},
+			{"other", "clients/%u/x", "%u", MOSQ_ACL_READ, true},
+			{"other", "both/other/other", "%u", MOSQ_ACL_READ, false},
+			{"test", "own/test/id", "id", MOSQ_ACL_WRITE, true},
+			{"test", "own/test/other", "id", MOSQ_ACL_READ, false},
+			{"test", "own/test/+", "+", MOSQ_ACL_READ, false},
+		}
+
+		for _, c := range cases {
+			granted := commands.CheckAcl(c.username, c.topic, c.clientid, c.acc)
+			So(lua.CheckAcl(c.username, c.topic, c.clientid, c.acc), ShouldEqual, granted)
+			So(granted, ShouldEqual, c.granted)
+		}
+
+		Convey("A key of the wrong type should deny the check in both modes", func() {
+			commands.Conn.Set("broken:racls", "not a set", 0)
+			commands.Conn.SAdd("broken:rwacls", "#")
+			So(commands.CheckAcl("broken", "a/b", "id", MOSQ_ACL_READ), ShouldBeFalse)
+			So(lua.CheckAcl("broken", "a/b", "id", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("The script should be sent again when the server lost it", func() {
+			So(lua.Conn.ScriptFlush().Err(), ShouldBeNil)
+			So(lua.CheckAcl("test", "test/topic/1", "id", MOSQ_ACL_READ), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,94 @@
+package backends
+
+import (
+	goredis "github.com/go-redis/redis"
+)
+
+//redisAclScript checks an acl in a single call, given the keys of the user's two acl sets and the two common ones, as returned by aclKeys, and the topic, username and client id.
+//It mirrors common.AclMatches, so its decisions are the same as the ones made by reading the sets one by one: every set is read before matching, so any error denies the check just as then.
+var redisAclScript = goredis.NewScript(`
+local function split(s)
+	local parts = {}
+	local start = 1
+	while true do
+		local i = string.find(s, "/", start, true)
+		if not i then
+			table.insert(parts, string.sub(s, start))
+			return parts
+		end
+		table.insert(parts, string.sub(s, start, i - 1))
+		start = i + 1
+	end
+end
+
+local function match(route, topic)
+	for i = 1, #route do
+		if route[i] == "#" then
+			return true
+		end
+		if topic[i] == nil or (route[i] ~= "+" and route[i] ~= topic[i]) then
+			return false
+		end
+	end
+	return #topic == #route
+end
+
+local function topics_match(saved, given)
+	if given == saved then
+		return true
+	end
+
+	if string.sub(given, 1, 7) == "$share/" and string.sub(saved, 1, 7) ~= "$share/" then
+		local i = string.find(given, "/", 8, true)
+		if not i then
+			return false
+		end
+		given = string.sub(given, i + 1)
+	end
+
+	local route = split(saved)
+	if string.sub(given, 1, 1) == "$" and (route[1] == "+" or route[1] == "#") then
+		return false
+	end
+
+	return match(route, split(given))
+end
+
+local function acl_matches(acl, topic, username, clientid)
+	if string.find(acl, "%u", 1, true) and string.find(username, "[+#/]") then
+		return false
+	end
+
+	if string.find(acl, "%c", 1, true) and string.find(clientid, "[+#/]") then
+		return false
+	end
+
+	-- Both are replaced in one scan, so a username holding %c isn't expanded
+	-- in turn. Values returned by the function are taken as they are.
+	acl = string.gsub(acl, "%%([uc])", function(placeholder)
+		if placeholder == "u" then
+			return username
+		end
+		return clientid
+	end)
+
+	return topics_match(acl, topic)
+end
+
+local topic, username, clientid = ARGV[1], ARGV[2], ARGV[3]
+
+local acls = {}
+for i = 1, 4 do
+	acls[i] = redis.call("SMEMBERS", KEYS[i])
+end
+
+for i = 1, 4 do
+	for _, acl in ipairs(acls[i]) do
+		if acl_matches(acl, topic, username, clientid) then
+			return 1
+		end
+	end
+end
+
+return 0
+`)
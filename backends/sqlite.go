@@ -1,13 +1,24 @@
 package backends
 
 import (
+	"bytes"
 	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 
 	"github.com/iegomez/mosquitto-go-auth/common"
@@ -20,12 +31,47 @@ type Sqlite struct {
 	UserQuery      string
 	SuperuserQuery string
 	AclQuery       string
+	JournalMode    string
+	BusyTimeout    time.Duration
+	Pragmas        []string
+	ReadOnly       bool
+	Immutable      bool
+	ReloadInterval time.Duration
+	InitScript     string
+	Concurrency    string
+	MaxOpenConns   int
+
+	driverName string
+	watcher    *sqliteWatcher
+	mu         *sync.Mutex
+	Hasher     common.Hasher //Verifies password hashes, taking PBKDF2 salts in its encoding.
+}
+
+//sqliteDrivers counts the drivers registered to run pragmas on every connection, so every backend gets its own name.
+var sqliteDrivers uint32
+
+//sqlitePragma is a pragma as given in sqlite_pragmas, e.g. synchronous=NORMAL or cache_size = -4000.
+var sqlitePragma = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.]*)\s*(=\s*([A-Za-z0-9_+\-.']+))?$`)
+
+//SqliteOptions are the auth options the SQLite backend takes.
+var SqliteOptions = Options{
+	Keys: withKeys([]string{
+		"sqlite_aclquery", "sqlite_busy_timeout_ms", "sqlite_concurrency", "sqlite_immutable",
+		"sqlite_init_script", "sqlite_journal_mode", "sqlite_max_open_conns", "sqlite_pragmas",
+		"sqlite_read_only", "sqlite_reload_interval_seconds", "sqlite_source", "sqlite_superquery",
+		"sqlite_userquery",
+	}, common.HasherOptions, common.PrefixedHasherOptions("sqlite")),
 }
 
 func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 
 	log.SetLevel(logLevel)
 
+	authOpts, err := SqliteOptions.readSecretFiles(authOpts)
+	if err != nil {
+		return Sqlite{}, errors.Errorf("Sqlite backend error: %s.\n", err)
+	}
+
 	//Set defaults for sqlite
 
 	sqliteOk := true
@@ -34,6 +80,10 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 	var sqlite = Sqlite{
 		SuperuserQuery: "",
 		AclQuery:       "",
+		JournalMode:    "WAL",
+		BusyTimeout:    5 * time.Second,
+		ReloadInterval: 10 * time.Second,
+		MaxOpenConns:   10,
 	}
 
 	if source, ok := authOpts["sqlite_source"]; ok {
@@ -43,19 +93,74 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 		missingOptions += " sqlite_source"
 	}
 
+	//Checks whose query is left empty aren't handled by this backend.
 	if userQuery, ok := authOpts["sqlite_userquery"]; ok {
-		sqlite.UserQuery = userQuery
-	} else {
-		sqliteOk = false
-		missingOptions += " sqlite_userquery"
+		sqlite.UserQuery = strings.TrimSpace(userQuery)
 	}
 
 	if superuserQuery, ok := authOpts["sqlite_superquery"]; ok {
-		sqlite.SuperuserQuery = superuserQuery
+		sqlite.SuperuserQuery = strings.TrimSpace(superuserQuery)
 	}
 
 	if aclQuery, ok := authOpts["sqlite_aclquery"]; ok {
-		sqlite.AclQuery = aclQuery
+		sqlite.AclQuery = strings.TrimSpace(aclQuery)
+	}
+
+	hasher, err := common.NewHasher(authOpts, "sqlite")
+	if err != nil {
+		return sqlite, errors.Errorf("Sqlite backend error: %s.\n", err)
+	}
+	sqlite.Hasher = hasher
+
+	//Checks mostly read, so WAL lets them go on while the DB is written, and the busy timeout makes them wait for a lock instead of failing with database is locked.
+	if journalMode, ok := authOpts["sqlite_journal_mode"]; ok {
+		sqlite.JournalMode = strings.ToUpper(strings.TrimSpace(journalMode))
+		switch sqlite.JournalMode {
+		case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+		default:
+			return sqlite, errors.Errorf("Sqlite backend error: invalid sqlite_journal_mode %s, it must be DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF.\n", journalMode)
+		}
+	}
+
+	sqlite.BusyTimeout = common.DurationOption(authOpts, "sqlite_busy_timeout_ms", time.Millisecond, 0, sqlite.BusyTimeout)
+
+	//Any other pragmas are given separated by semicolons, and run as given on every connection.
+	if pragmas, ok := authOpts["sqlite_pragmas"]; ok {
+		for _, pragma := range strings.Split(pragmas, ";") {
+			pragma = strings.TrimSpace(pragma)
+			if pragma == "" {
+				continue
+			}
+			if !sqlitePragma.MatchString(pragma) {
+				return sqlite, errors.Errorf("Sqlite backend error: invalid pragma %s in sqlite_pragmas.\n", pragma)
+			}
+			sqlite.Pragmas = append(sqlite.Pragmas, pragma)
+		}
+	}
+
+	sqlite.ReloadInterval = common.DurationOption(authOpts, "sqlite_reload_interval_seconds", time.Second, 0, sqlite.ReloadInterval)
+
+	//The script seeds an in-memory DB, which starts empty every time.
+	if initScript, ok := authOpts["sqlite_init_script"]; ok {
+		sqlite.InitScript = strings.TrimSpace(initScript)
+	}
+
+	//Checks either take turns on a single connection or share a pool of them, see below for the default.
+	if concurrency, ok := authOpts["sqlite_concurrency"]; ok {
+		sqlite.Concurrency = strings.ToLower(strings.TrimSpace(concurrency))
+		if sqlite.Concurrency != "single" && sqlite.Concurrency != "pool" {
+			return sqlite, errors.Errorf("Sqlite backend error: invalid sqlite_concurrency %s, it must be single or pool.\n", concurrency)
+		}
+	}
+
+	sqlite.MaxOpenConns = common.IntOption(authOpts, "sqlite_max_open_conns", 1, math.MaxInt32, sqlite.MaxOpenConns)
+
+	//Immutable files can only be opened read only.
+	sqlite.ReadOnly = common.BoolOption(authOpts, "sqlite_read_only", false)
+
+	if common.BoolOption(authOpts, "sqlite_immutable", false) {
+		sqlite.ReadOnly = true
+		sqlite.Immutable = true
 	}
 
 	//Exit if any mandatory option is missing.
@@ -63,28 +168,239 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 		return sqlite, errors.Errorf("Sqlite backend error: missing options%s.\n", missingOptions)
 	}
 
+	logHandledChecks("Sqlite", sqlite.UserQuery, sqlite.SuperuserQuery, sqlite.AclQuery)
+
+	if sqlite.InitScript != "" && !sqlite.memory() {
+		return sqlite, errors.New("Sqlite backend error: sqlite_init_script can only be used with a memory source.\n")
+	}
+
+	//A read only DB can't be created nor have its journal mode changed, so it must exist and is kept in the mode it's in.
+	if sqlite.ReadOnly {
+		if sqlite.memory() {
+			return sqlite, errors.New("Sqlite backend error: sqlite_read_only can't be used with a memory source.\n")
+		}
+		journalMode, err := sqliteFileJournalMode(sqlite.Source)
+		if err != nil {
+			return sqlite, errors.Errorf("Sqlite backend error: couldn't open sqlite_source %s read only: %s\n", sqlite.Source, err)
+		}
+		if _, ok := authOpts["sqlite_journal_mode"]; ok && sqlite.JournalMode != journalMode {
+			log.Warnf("Sqlite backend: %s is read only, ignoring sqlite_journal_mode %s and keeping its %s journal mode.", sqlite.Source, sqlite.JournalMode, journalMode)
+		}
+		sqlite.JournalMode = journalMode
+	}
+
+	//Checks may only share a pool while the DB is written in WAL mode, as in a rollback journal mode a writer locks readers out, and every connection to a memory DB gets a DB of its own.
+	switch {
+	case sqlite.memory():
+		if sqlite.Concurrency == "pool" {
+			return sqlite, errors.New("Sqlite backend error: a memory source can't be used with sqlite_concurrency pool.\n")
+		}
+		sqlite.Concurrency = "single"
+	case sqlite.Concurrency == "":
+		sqlite.Concurrency = "single"
+		if sqlite.JournalMode == "WAL" || sqlite.ReadOnly {
+			sqlite.Concurrency = "pool"
+		}
+	case sqlite.Concurrency == "pool" && sqlite.JournalMode != "WAL" && !sqlite.ReadOnly:
+		return sqlite, errors.Errorf("Sqlite backend error: sqlite_concurrency pool needs the WAL journal mode or a read only DB, not %s.\n", sqlite.JournalMode)
+	}
+
+	if sqlite.Concurrency == "single" {
+		sqlite.mu = &sync.Mutex{}
+	}
+
 	//Build the dsn string and try to connect to the DB.
-	connStr := ":memory:"
-	if sqlite.Source != "memory" {
-		connStr = sqlite.Source
+	connStr := sqlite.Source
+	if sqlite.memory() {
+		connStr = ":memory:"
 	}
 
+	sqlite.driverName = sqlite.driver()
+
 	var dbErr error
-	sqlite.DB, dbErr = common.OpenDatabase(connStr, "sqlite3")
+	sqlite.DB, dbErr = common.OpenDatabase(sqlite.dsn(connStr), sqlite.driverName)
 
 	if dbErr != nil {
 		return sqlite, errors.Errorf("Sqlite backend error: couldn't open DB %s: %s\n", connStr, dbErr)
 	}
 
+	sqlite.setPool(sqlite.DB)
+
+	if sqlite.InitScript != "" {
+		if err := sqlite.runScript(sqlite.InitScript); err != nil {
+			sqlite.DB.Close()
+			return sqlite, err
+		}
+		log.Infof("Sqlite backend: seeded the memory DB from %s.", sqlite.InitScript)
+	}
+
+	if !sqlite.memory() && sqlite.ReloadInterval > 0 {
+		sqlite.watch()
+		log.Infof("Sqlite backend: reopening %s when it changes, checking every %s.", sqlite.Source, sqlite.ReloadInterval)
+	}
+
+	log.Infof("Sqlite DB: read only %t, immutable %t, journal mode %s, busy timeout %s, pragmas %v, concurrency %s.", sqlite.ReadOnly, sqlite.Immutable, sqlite.JournalMode, sqlite.BusyTimeout, sqlite.Pragmas, sqlite.Concurrency)
+
 	return sqlite, nil
 
 }
 
+//dsn adds the journal mode and busy timeout to the source, so the driver sets them on every connection and not only the first one.
+//Read only sources are opened as a URI with mode=ro, and immutable=1 when they're immutable, so SQLite neither writes nor locks them.
+func (o Sqlite) dsn(connStr string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", o.JournalMode)
+	params.Set("_busy_timeout", strconv.FormatInt(int64(o.BusyTimeout/time.Millisecond), 10))
+
+	if o.ReadOnly {
+		params.Set("mode", "ro")
+		if o.Immutable {
+			params.Set("immutable", "1")
+		}
+		connStr = "file:" + (&url.URL{Path: connStr}).EscapedPath()
+	}
+
+	separator := "?"
+	if strings.Contains(connStr, "?") {
+		separator = "&"
+	}
+
+	return connStr + separator + params.Encode()
+}
+
+//watch starts reopening the DB when its file is replaced.
+func (o *Sqlite) watch() {
+	o.watcher = newSqliteWatcher(o.Source, o.ReloadInterval, o.Immutable, o.DB, o.reopen)
+}
+
+//reopen opens the DB at the source again, checking it's sound so a broken replacement doesn't take the place of the current one.
+//A read only file may have been replaced by one in another journal mode, which is then kept.
+func (o Sqlite) reopen() (*sqlx.DB, error) {
+	if o.ReadOnly {
+		journalMode, err := sqliteFileJournalMode(o.Source)
+		if err != nil {
+			return nil, err
+		}
+		o.JournalMode = journalMode
+	}
+
+	db, err := sqlx.Open(o.driverName, o.dsn(o.Source))
+	if err != nil {
+		return nil, err
+	}
+	o.setPool(db)
+
+	var result string
+	if err := db.Get(&result, "PRAGMA quick_check"); err != nil || result != "ok" {
+		db.Close()
+		if err == nil {
+			err = errors.Errorf("integrity check failed: %s", result)
+		}
+		return nil, err
+	}
+
+	return db, nil
+}
+
+//setPool sizes the DB's pool for the concurrency strategy. Its connections are kept open, so a burst of checks doesn't open lots of them at once, each one setting the journal mode while others hold locks.
+func (o Sqlite) setPool(db *sqlx.DB) {
+	conns := o.MaxOpenConns
+	if o.Concurrency == "single" {
+		conns = 1
+	}
+	db.SetMaxOpenConns(conns)
+	db.SetMaxIdleConns(conns)
+	db.SetConnMaxLifetime(0)
+}
+
+//get runs a check's query for a single value, taking turns with other checks when they're serialized.
+//The mutex also keeps a check on a reopened DB from running alongside one still on the old DB.
+func (o Sqlite) get(dest interface{}, query string, args ...interface{}) error {
+	if o.mu != nil {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+	}
+	return o.db().Get(dest, query, args...)
+}
+
+//selectAll runs a check's query for several rows, taking turns with other checks when they're serialized.
+func (o Sqlite) selectAll(dest interface{}, query string, args ...interface{}) error {
+	if o.mu != nil {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+	}
+	return o.db().Select(dest, query, args...)
+}
+
+//memory tells if the DB is kept in memory rather than in a file.
+func (o Sqlite) memory() bool {
+	return o.Source == "memory" || o.Source == ":memory:"
+}
+
+//db returns the DB to run checks against, which may have been reopened since the backend started.
+func (o Sqlite) db() *sqlx.DB {
+	if o.watcher != nil {
+		return o.watcher.current()
+	}
+	return o.DB
+}
+
+//sqliteFileJournalMode returns the journal mode a DB file is in, WAL or DELETE for any rollback one, as told by its header. An empty file is a new DB.
+func sqliteFileJournalMode(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 100)
+	n, err := io.ReadFull(file, header)
+	if n == 0 && err == io.EOF {
+		return "DELETE", nil
+	}
+	if err != nil || !bytes.HasPrefix(header, []byte("SQLite format 3\x00")) {
+		return "", errors.New("not a SQLite database")
+	}
+
+	//Byte 18 is the version needed to write the file, which is 2 in WAL mode.
+	if header[18] == 2 {
+		return "WAL", nil
+	}
+	return "DELETE", nil
+}
+
+//driver returns the name of the driver to open the DB with: when pragmas are given, a driver running them on every new connection is registered for the backend.
+func (o Sqlite) driver() string {
+	if len(o.Pragmas) == 0 {
+		return "sqlite3"
+	}
+
+	pragmas := o.Pragmas
+	name := fmt.Sprintf("sqlite3-go-auth-%d", atomic.AddUint32(&sqliteDrivers, 1))
+	sql.Register(name, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, pragma := range pragmas {
+				if _, err := conn.Exec("PRAGMA "+pragma, nil); err != nil {
+					return errors.Wrapf(err, "pragma %s", pragma)
+				}
+			}
+			return nil
+		},
+	})
+
+	return name
+}
+
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Sqlite) GetUser(username, password string) bool {
 
+	//If there's no user query, users aren't handled by this backend.
+	if o.UserQuery == "" {
+		return false
+	}
+
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err := o.get(&pwHash, o.UserQuery, username)
 
 	if err != nil {
 		log.Debugf("SQlite get user error: %s\n", err)
@@ -92,11 +408,11 @@ func (o Sqlite) GetUser(username, password string) bool {
 	}
 
 	if !pwHash.Valid {
-		log.Debugf("SQlite get user error: user %s not found.\n", username)
+		log.Debugf("SQlite get user error: user %s not found.\n", common.RedactUsername(username))
 		return false
 	}
 
-	if common.HashCompare(password, pwHash.String) {
+	if o.Hasher.Compare(password, pwHash.String) {
 		return true
 	}
 
@@ -113,7 +429,7 @@ func (o Sqlite) GetSuperuser(username string) bool {
 	}
 
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err := o.get(&count, o.SuperuserQuery, username)
 
 	if err != nil {
 		log.Debugf("SQlite get superuser error: %s\n", err)
@@ -121,7 +437,7 @@ func (o Sqlite) GetSuperuser(username string) bool {
 	}
 
 	if !count.Valid {
-		log.Debugf("SQlite get superuser error: user %s not found.\n", username)
+		log.Debugf("SQlite get superuser error: user %s not found.\n", common.RedactUsername(username))
 		return false
 	}
 
@@ -135,14 +451,14 @@ func (o Sqlite) GetSuperuser(username string) bool {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) bool {
-	//If there's no acl query, assume all privileges for all users.
+	//If there's no acl query, acls aren't handled by this backend.
 	if o.AclQuery == "" {
-		return true
+		return false
 	}
 
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err := o.selectAll(&acls, o.AclQuery, username, acc)
 
 	if err != nil {
 		log.Debugf("SQlite check acl error: %s\n", err)
@@ -150,9 +466,7 @@ func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) bool {
 	}
 
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		if common.AclMatches(acl, topic, username, clientid) {
 			return true
 		}
 	}
@@ -166,10 +480,13 @@ func (o Sqlite) GetName() string {
 	return "Sqlite"
 }
 
-//Halt closes the mysql connection.
+//Halt stops watching the DB file and closes the connection.
 func (o Sqlite) Halt() {
+	if o.watcher != nil {
+		o.watcher.stop()
+	}
 	if o.DB != nil {
-		err := o.DB.Close()
+		err := o.db().Close()
 		if err != nil {
 			log.Errorf("Mysql cleanup error: %s", err)
 		}
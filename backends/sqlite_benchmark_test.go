@@ -0,0 +1,53 @@
+package backends
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//benchmarkSqliteAcl runs acl checks in parallel against a file DB opened with the given concurrency strategy.
+func benchmarkSqliteAcl(b *testing.B, concurrency string) {
+	dir, err := ioutil.TempDir("", "go-auth-sqlite")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sqlite, err := NewSqlite(map[string]string{
+		"sqlite_source":      filepath.Join(dir, "bench.db"),
+		"sqlite_concurrency": concurrency,
+		"sqlite_aclquery":    "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?",
+	}, log.ErrorLevel)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sqlite.Halt()
+
+	sqlite.DB.MustExec(userSchema)
+	sqlite.DB.MustExec(aclSchema)
+	res := sqlite.DB.MustExec("INSERT INTO test_user(username, password_hash, is_admin) values('test', 'hash', 0)")
+	userID, _ := res.LastInsertId()
+	for i := 0; i < 20; i++ {
+		sqlite.DB.MustExec("INSERT INTO test_acl(test_user_id, topic, rw) values(?, ?, 1)", userID, fmt.Sprintf("test/%d/#", i))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sqlite.CheckAcl("test", "test/19/topic", "client", MOSQ_ACL_READ)
+		}
+	})
+}
+
+func BenchmarkSqliteSingleAcl(b *testing.B) {
+	benchmarkSqliteAcl(b, "single")
+}
+
+func BenchmarkSqlitePoolAcl(b *testing.B) {
+	benchmarkSqliteAcl(b, "pool")
+}
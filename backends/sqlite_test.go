@@ -1,9 +1,17 @@
 package backends
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -371,3 +379,704 @@ func TestMemorySqlite(t *testing.T) {
 	})
 
 }
+
+func TestSqliteQueries(t *testing.T) {
+	checkQueryCombinations(t, "sqlite", func(db *sqlx.DB, userQuery, superuserQuery, aclQuery string) sqlBackend {
+		return Sqlite{DB: db, UserQuery: userQuery, SuperuserQuery: superuserQuery, AclQuery: aclQuery}
+	})
+}
+
+func TestSqlitePragmas(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "go-auth-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withOpts := func(opts map[string]string) map[string]string {
+		authOpts := map[string]string{
+			"sqlite_source":   filepath.Join(dir, "pragmas.db"),
+			"sqlite_aclquery": "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?",
+		}
+		for k, v := range opts {
+			authOpts[k] = v
+		}
+		return authOpts
+	}
+
+	Convey("Given wrong pragma options NewSqlite should fail before opening the DB", t, func() {
+		for opt, value := range map[string]string{
+			"sqlite_journal_mode": "fast",
+			"sqlite_pragmas":      "synchronous=NORMAL; cache_size=-2000 drop table test_user",
+		} {
+			_, err := NewSqlite(withOpts(map[string]string{opt: value}), log.DebugLevel)
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, opt)
+		}
+	})
+
+	Convey("Given an invalid busy timeout NewSqlite should warn and use the default", t, func() {
+		sqlite, err := NewSqlite(withOpts(map[string]string{"sqlite_busy_timeout_ms": "-1"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+		So(sqlite.BusyTimeout, ShouldEqual, 5*time.Second)
+	})
+
+	Convey("Given no pragma options, WAL and a 5s busy timeout should be set on every connection", t, func() {
+		sqlite, err := NewSqlite(withOpts(nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+
+		for _, pragma := range sqliteConnPragmas(sqlite.DB, 3, "journal_mode", "busy_timeout") {
+			So(pragma, ShouldResemble, []string{"wal", "5000"})
+		}
+	})
+
+	Convey("Given pragma options, they should be set on every connection", t, func() {
+		sqlite, err := NewSqlite(withOpts(map[string]string{
+			"sqlite_source":          filepath.Join(dir, "options.db"),
+			"sqlite_journal_mode":    "truncate",
+			"sqlite_busy_timeout_ms": "1500",
+			"sqlite_pragmas":         "cache_size = -4000; query_only=true;",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+
+		So(sqlite.Pragmas, ShouldResemble, []string{"cache_size = -4000", "query_only=true"})
+
+		//In a rollback journal mode checks keep to a single connection.
+		So(sqlite.Concurrency, ShouldEqual, "single")
+		for _, pragma := range sqliteConnPragmas(sqlite.DB, 1, "journal_mode", "busy_timeout", "cache_size", "query_only") {
+			So(pragma, ShouldResemble, []string{"truncate", "1500", "-4000", "1"})
+		}
+	})
+
+	Convey("Given pragma options in WAL mode, they should be set on every pooled connection", t, func() {
+		sqlite, err := NewSqlite(withOpts(map[string]string{
+			"sqlite_source":  filepath.Join(dir, "pooled.db"),
+			"sqlite_pragmas": "cache_size = -4000",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+
+		So(sqlite.Concurrency, ShouldEqual, "pool")
+		for _, pragma := range sqliteConnPragmas(sqlite.DB, 3, "journal_mode", "cache_size") {
+			So(pragma, ShouldResemble, []string{"wal", "-4000"})
+		}
+	})
+
+	Convey("Given concurrent acl checks while the DB is written, none should fail because the DB is locked", t, func() {
+		sqlite, err := NewSqlite(withOpts(map[string]string{"sqlite_source": filepath.Join(dir, "concurrent.db")}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+
+		sqlite.DB.MustExec(userSchema)
+		sqlite.DB.MustExec(aclSchema)
+		res := sqlite.DB.MustExec("INSERT INTO test_user(username, password_hash, is_admin) values('test', 'hash', 0)")
+		userID, err := res.LastInsertId()
+		So(err, ShouldBeNil)
+		sqlite.DB.MustExec("INSERT INTO test_acl(test_user_id, topic, rw) values(?, 'test/#', 1)", userID)
+		sqlite.DB.MustExec("DROP TABLE IF EXISTS test_log; CREATE TABLE test_log(id INTEGER PRIMARY KEY, entry varchar(200) not null);")
+
+		//A separate connection keeps writing as an admin tool would, holding the write lock for a while every time.
+		writer, err := sqlx.Open("sqlite3", sqlite.dsn(sqlite.Source))
+		So(err, ShouldBeNil)
+		defer writer.Close()
+
+		stop := make(chan struct{})
+		writes := make(chan error, 1)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					writes <- nil
+					return
+				default:
+				}
+				tx, err := writer.Begin()
+				if err != nil {
+					writes <- err
+					return
+				}
+				for j := 0; j < 50; j++ {
+					if _, err := tx.Exec("INSERT INTO test_log(entry) values(?)", fmt.Sprintf("entry %d/%d", i, j)); err != nil {
+						tx.Rollback()
+						writes <- err
+						return
+					}
+				}
+				if err := tx.Commit(); err != nil {
+					writes <- err
+					return
+				}
+			}
+		}()
+
+		var failed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if !sqlite.CheckAcl("test", fmt.Sprintf("test/%d/%d", i, j), "client", MOSQ_ACL_READ) {
+						atomic.AddInt32(&failed, 1)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(stop)
+
+		So(<-writes, ShouldBeNil)
+		So(atomic.LoadInt32(&failed), ShouldEqual, 0)
+	})
+
+}
+
+//sqliteConnPragmas opens n connections at once and returns the given pragmas' values on each one.
+func sqliteConnPragmas(db *sqlx.DB, n int, names ...string) [][]string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var values [][]string
+	for i := 0; i < n; i++ {
+		conn, err := db.DB.Conn(ctx)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		var connValues []string
+		for _, name := range names {
+			var value string
+			So(conn.QueryRowContext(ctx, "PRAGMA "+name).Scan(&value), ShouldBeNil)
+			connValues = append(connValues, value)
+		}
+		values = append(values, connValues)
+	}
+
+	return values
+}
+
+func TestSqliteReadOnly(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "go-auth-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	userQuery := "SELECT password_hash FROM test_user WHERE username = ? limit 1"
+	superuserQuery := "select count(*) from test_user where username = ? and is_admin = 1"
+	aclQuery := "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?"
+
+	//createDB writes the fixture to a new DB in the given journal mode in its own directory, and makes both read only.
+	createDB := func(name, journalMode string) string {
+		dbDir := filepath.Join(dir, name)
+		So(os.Mkdir(dbDir, 0755), ShouldBeNil)
+		source := filepath.Join(dbDir, "auth.db")
+
+		sqlite, err := NewSqlite(map[string]string{"sqlite_source": source, "sqlite_journal_mode": journalMode}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		sqlite.DB.MustExec(userSchema)
+		sqlite.DB.MustExec(aclSchema)
+		res := sqlite.DB.MustExec("INSERT INTO test_user(username, password_hash, is_admin) values(?, ?, 1)", "test", userPassHash)
+		userID, err := res.LastInsertId()
+		So(err, ShouldBeNil)
+		for _, topic := range []string{"test/topic/1", "test/%u", "test/+/2"} {
+			sqlite.DB.MustExec("INSERT INTO test_acl(test_user_id, topic, rw) values(?, ?, 1)", userID, topic)
+		}
+		sqlite.Halt()
+
+		So(os.Chmod(source, 0444), ShouldBeNil)
+		So(os.Chmod(dbDir, 0555), ShouldBeNil)
+		return source
+	}
+
+	withOpts := func(source string, opts map[string]string) map[string]string {
+		authOpts := map[string]string{
+			"sqlite_source":     source,
+			"sqlite_read_only":  "true",
+			"sqlite_userquery":  userQuery,
+			"sqlite_superquery": superuserQuery,
+			"sqlite_aclquery":   aclQuery,
+		}
+		for k, v := range opts {
+			authOpts[k] = v
+		}
+		return authOpts
+	}
+
+	checkAll := func(sqlite Sqlite) {
+		So(sqlite.GetUser("test", "testpw"), ShouldBeTrue)
+		So(sqlite.GetUser("test", "wrong_password"), ShouldBeFalse)
+		So(sqlite.GetUser("unknown", "testpw"), ShouldBeFalse)
+		So(sqlite.GetSuperuser("test"), ShouldBeTrue)
+		So(sqlite.CheckAcl("test", "test/topic/1", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(sqlite.CheckAcl("test", "test/test", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(sqlite.CheckAcl("test", "test/any/2", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(sqlite.CheckAcl("test", "test/topic/1", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(sqlite.CheckAcl("test", "other/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+	}
+
+	Convey("Given wrong read only sources NewSqlite should fail clearly", t, func() {
+		_, err := NewSqlite(withOpts(filepath.Join(dir, "missing.db"), nil), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "no such file")
+
+		_, err = NewSqlite(withOpts("memory", nil), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "sqlite_read_only")
+
+		notDB := filepath.Join(dir, "not.db")
+		So(ioutil.WriteFile(notDB, []byte("not a database, just some text long enough to fill a header and then some more of it to be sure it does"), 0444), ShouldBeNil)
+		_, err = NewSqlite(withOpts(notDB, nil), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "not a SQLite database")
+	})
+
+	Convey("Given a read only file in rollback journal mode", t, func() {
+		source := createDB("rollback", "DELETE")
+
+		sqlite, err := NewSqlite(withOpts(source, nil), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+		So(sqlite.JournalMode, ShouldEqual, "DELETE")
+
+		Convey("Checks should work as with a writable one, without writing anything next to it", func() {
+			checkAll(sqlite)
+
+			_, err := sqlite.DB.Exec("INSERT INTO test_user(username, password_hash, is_admin) values('other', 'hash', 0)")
+			So(err, ShouldBeError)
+			So(err.Error(), ShouldContainSubstring, "readonly")
+
+			files, err := ioutil.ReadDir(filepath.Dir(source))
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given a read only file in WAL mode, the journal mode option should be ignored", t, func() {
+		source := createDB("wal", "WAL")
+
+		sqlite, err := NewSqlite(withOpts(source, map[string]string{"sqlite_journal_mode": "DELETE"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+		So(sqlite.JournalMode, ShouldEqual, "WAL")
+		checkAll(sqlite)
+	})
+
+	Convey("Given an immutable file, checks should work without SQLite even locking it", t, func() {
+		source := createDB("immutable", "WAL")
+
+		sqlite, err := NewSqlite(withOpts(source, map[string]string{"sqlite_read_only": "false", "sqlite_immutable": "true"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+		So(sqlite.ReadOnly, ShouldBeTrue)
+		So(sqlite.dsn(source), ShouldContainSubstring, "immutable=1")
+		checkAll(sqlite)
+
+		files, err := ioutil.ReadDir(filepath.Dir(source))
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 1)
+	})
+
+	//Let the temporary directories be removed.
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+
+}
+
+func TestSqliteReload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "go-auth-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "auth.db")
+
+	//replaceDB writes a DB with the given users next to the source and renames it over it, as a deployment would.
+	replaceDB := func(usernames ...string) {
+		tmp := filepath.Join(dir, "auth.db.new")
+		db, err := sqlx.Open("sqlite3", tmp)
+		So(err, ShouldBeNil)
+		db.MustExec(userSchema)
+		for _, username := range usernames {
+			db.MustExec("INSERT INTO test_user(username, password_hash, is_admin) values(?, ?, 0)", username, userPassHash)
+		}
+		So(db.Close(), ShouldBeNil)
+		So(os.Rename(tmp, source), ShouldBeNil)
+	}
+
+	waitFor := func(condition func() bool) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for !condition() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return condition()
+	}
+
+	Convey("Given a wrong reload interval NewSqlite should warn and use the default", t, func() {
+		sqlite, err := NewSqlite(map[string]string{"sqlite_source": source, "sqlite_reload_interval_seconds": "-1"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+		So(sqlite.ReloadInterval, ShouldEqual, 10*time.Second)
+	})
+
+	Convey("Given a DB file replaced while checks run", t, func() {
+		replaceDB("old")
+
+		sqlite, err := NewSqlite(map[string]string{
+			"sqlite_source":                  source,
+			"sqlite_userquery":               "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+			"sqlite_reload_interval_seconds": "0",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(sqlite.watcher, ShouldBeNil)
+
+		sqlite.ReloadInterval = 20 * time.Millisecond
+		sqlite.watch()
+		defer sqlite.Halt()
+
+		So(sqlite.GetUser("old", "testpw"), ShouldBeTrue)
+		So(sqlite.GetUser("new", "testpw"), ShouldBeFalse)
+
+		var failed int32
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if !sqlite.GetUser("old", "testpw") {
+						atomic.AddInt32(&failed, 1)
+					}
+				}
+			}()
+		}
+
+		replaceDB("old", "new")
+		newValid := waitFor(func() bool { return sqlite.GetUser("new", "testpw") })
+
+		close(stop)
+		wg.Wait()
+
+		So(newValid, ShouldBeTrue)
+		So(atomic.LoadInt32(&failed), ShouldEqual, 0)
+
+		Convey("A corrupt replacement should be ignored until a sound one shows up", func() {
+			corrupt := filepath.Join(dir, "auth.db.new")
+			So(ioutil.WriteFile(corrupt, []byte("SQLite format 3\x00 but not really, just garbage where pages should be"), 0644), ShouldBeNil)
+			So(os.Rename(corrupt, source), ShouldBeNil)
+
+			time.Sleep(100 * time.Millisecond)
+			So(sqlite.GetUser("new", "testpw"), ShouldBeTrue)
+
+			replaceDB("newer")
+			So(waitFor(func() bool { return sqlite.GetUser("newer", "testpw") }), ShouldBeTrue)
+			So(sqlite.GetUser("old", "testpw"), ShouldBeFalse)
+		})
+	})
+
+}
+
+func TestSqliteInitScript(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "go-auth-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//The seed has semicolons in strings and comments, and a trigger holding several statements.
+	seed := `-- Users and ACLs; seeded at init.
+CREATE TABLE test_user (
+	id INTEGER PRIMARY KEY,
+	username varchar(100) not null,
+	password_hash varchar(200) not null,
+	is_admin integer not null
+);
+CREATE TABLE test_acl (id INTEGER PRIMARY KEY, test_user_id INTEGER not null, topic varchar(200) not null, rw integer not null);
+CREATE TABLE test_log (note varchar(100));
+
+/* Every new user can read its own topics;
+   the trigger below adds the ACL. */
+CREATE TRIGGER user_acl AFTER INSERT ON test_user
+BEGIN
+	INSERT INTO test_acl(test_user_id, topic, rw) VALUES (new.id, 'users/%u/#', 1);
+	INSERT INTO test_log(note) VALUES ('added; ' || new.username);
+END;
+
+INSERT INTO test_user(username, password_hash, is_admin) VALUES ('test', '` + userPassHash + `', 1);
+INSERT INTO test_user(username, password_hash, is_admin) VALUES ('o''brien', '` + userPassHash + `', 0);
+INSERT INTO test_acl(test_user_id, topic, rw) VALUES
+	(1, 'test/topic/1', 1),
+	(1, 'test/+/2', 2)`
+
+	writeScript := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		So(ioutil.WriteFile(path, []byte(script), 0644), ShouldBeNil)
+		return path
+	}
+
+	withOpts := func(source, script string) map[string]string {
+		return map[string]string{
+			"sqlite_source":      source,
+			"sqlite_init_script": script,
+			"sqlite_userquery":   "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+			"sqlite_superquery":  "select count(*) from test_user where username = ? and is_admin = 1",
+			"sqlite_aclquery":    "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?",
+		}
+	}
+
+	Convey("Given a script, splitSqliteScript should split it into statements with their starting lines", t, func() {
+		statements := splitSqliteScript(seed)
+		So(len(statements), ShouldEqual, 9)
+		So(statements[0].line, ShouldEqual, 2)
+		So(statements[1].line, ShouldEqual, 8)
+		So(statements[3].line, ShouldEqual, 13)
+		So(statements[3].text, ShouldEndWith, "new.id, 'users/%u/#', 1);")
+		So(statements[4].text, ShouldContainSubstring, "'added; ' || new.username")
+		So(statements[5].text, ShouldEqual, "END;")
+		So(statements[7].text, ShouldContainSubstring, "'o''brien'")
+		So(statements[8].line, ShouldEqual, 21)
+		So(statements[8].text, ShouldEndWith, "(1, 'test/+/2', 2)")
+	})
+
+	Convey("Given a memory source seeded from a script", t, func() {
+		source := writeScript("seed.sql", seed)
+
+		for _, memory := range []string{":memory:", "memory"} {
+			sqlite, err := NewSqlite(withOpts(memory, source), log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			Convey(fmt.Sprintf("Checks should be answered from the seeded DB with source %s", memory), func() {
+				So(sqlite.GetUser("test", "testpw"), ShouldBeTrue)
+				So(sqlite.GetUser("test", "wrong_password"), ShouldBeFalse)
+				So(sqlite.GetUser("o'brien", "testpw"), ShouldBeTrue)
+				So(sqlite.GetUser("unknown", "testpw"), ShouldBeFalse)
+				So(sqlite.GetSuperuser("test"), ShouldBeTrue)
+				So(sqlite.GetSuperuser("o'brien"), ShouldBeFalse)
+				So(sqlite.CheckAcl("test", "test/topic/1", "client", MOSQ_ACL_READ), ShouldBeTrue)
+				So(sqlite.CheckAcl("test", "test/any/2", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+				So(sqlite.CheckAcl("test", "test/topic/1", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+				So(sqlite.CheckAcl("o'brien", "users/o'brien/inbox", "client", MOSQ_ACL_READ), ShouldBeTrue)
+				So(sqlite.CheckAcl("o'brien", "users/test/inbox", "client", MOSQ_ACL_READ), ShouldBeFalse)
+
+				var notes []string
+				So(sqlite.DB.Select(&notes, "SELECT note FROM test_log ORDER BY note"), ShouldBeNil)
+				So(notes, ShouldResemble, []string{"added; o'brien", "added; test"})
+			})
+
+			Convey(fmt.Sprintf("Concurrent checks should all see the seeded DB with source %s", memory), func() {
+				//Any other connection would open an empty DB.
+				So(sqlite.DB.Stats().MaxOpenConnections, ShouldEqual, 1)
+
+				var wg sync.WaitGroup
+				var failed int32
+				for i := 0; i < 32; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for j := 0; j < 50; j++ {
+							if !sqlite.GetSuperuser("test") || !sqlite.CheckAcl("test", "test/topic/1", "client", MOSQ_ACL_READ) {
+								atomic.AddInt32(&failed, 1)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				So(atomic.LoadInt32(&failed), ShouldEqual, 0)
+			})
+
+			Reset(sqlite.Halt)
+		}
+	})
+
+	Convey("Given a script with an error NewSqlite should fail with its line", t, func() {
+		source := writeScript("broken.sql", `CREATE TABLE test_user (id INTEGER PRIMARY KEY, username varchar(100));
+
+-- The table name is wrong;
+INSERT INTO test_user(username) VALUES ('a');
+INSERT INTO
+	test_users(username) VALUES ('b');`)
+
+		_, err := NewSqlite(withOpts(":memory:", source), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "broken.sql line 5: no such table: test_users")
+
+		source = writeScript("incomplete.sql", `CREATE TABLE t (id INTEGER);
+CREATE TRIGGER tt AFTER INSERT ON t
+BEGIN
+	DELETE FROM t;`)
+
+		_, err = NewSqlite(withOpts(":memory:", source), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "incomplete.sql line 2: incomplete statement")
+	})
+
+	Convey("Given a missing script or a file source NewSqlite should fail", t, func() {
+		_, err := NewSqlite(withOpts(":memory:", filepath.Join(dir, "missing.sql")), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "couldn't read sqlite_init_script")
+
+		_, err = NewSqlite(withOpts(filepath.Join(dir, "auth.db"), writeScript("seed.sql", seed)), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "memory source")
+	})
+
+}
+
+func TestSqliteConcurrency(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "go-auth-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withOpts := func(name string, opts map[string]string) map[string]string {
+		authOpts := map[string]string{
+			"sqlite_source":   filepath.Join(dir, name),
+			"sqlite_aclquery": "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?",
+		}
+		for k, v := range opts {
+			authOpts[k] = v
+		}
+		return authOpts
+	}
+
+	Convey("Given wrong concurrency options NewSqlite should fail", t, func() {
+		_, err := NewSqlite(withOpts("wrong.db", map[string]string{"sqlite_concurrency": "many"}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "sqlite_concurrency")
+
+		_, err = NewSqlite(withOpts("wrong.db", map[string]string{"sqlite_concurrency": "pool", "sqlite_journal_mode": "DELETE"}), log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "needs the WAL journal mode")
+
+		_, err = NewSqlite(map[string]string{"sqlite_source": "memory", "sqlite_concurrency": "pool"}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "memory source")
+	})
+
+	Convey("Given an invalid max of open conns NewSqlite should warn and use the default", t, func() {
+		sqlite, err := NewSqlite(withOpts("conns.db", map[string]string{"sqlite_concurrency": "pool", "sqlite_max_open_conns": "0"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer sqlite.Halt()
+		So(sqlite.MaxOpenConns, ShouldEqual, 10)
+	})
+
+	Convey("Given no concurrency option, it should follow the journal mode", t, func() {
+		for journalMode, concurrency := range map[string]string{"WAL": "pool", "DELETE": "single", "TRUNCATE": "single"} {
+			sqlite, err := NewSqlite(withOpts(journalMode+".db", map[string]string{"sqlite_journal_mode": journalMode}), log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(sqlite.Concurrency, ShouldEqual, concurrency)
+			sqlite.Halt()
+		}
+
+		sqlite, err := NewSqlite(map[string]string{"sqlite_source": "memory"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(sqlite.Concurrency, ShouldEqual, "single")
+		So(sqlite.DB.Stats().MaxOpenConnections, ShouldEqual, 1)
+		sqlite.Halt()
+	})
+
+	//stress runs hundreds of acl checks at once a few times over while a separate connection keeps writing to the DB, and returns how many failed.
+	stress := func(sqlite Sqlite) int32 {
+		sqlite.DB.MustExec(userSchema)
+		sqlite.DB.MustExec(aclSchema)
+		res := sqlite.DB.MustExec("INSERT INTO test_user(username, password_hash, is_admin) values('test', 'hash', 0)")
+		userID, err := res.LastInsertId()
+		So(err, ShouldBeNil)
+		sqlite.DB.MustExec("INSERT INTO test_acl(test_user_id, topic, rw) values(?, 'test/#', 1)", userID)
+		sqlite.DB.MustExec("DROP TABLE IF EXISTS test_log; CREATE TABLE test_log(id INTEGER PRIMARY KEY, entry varchar(200) not null);")
+
+		writer, err := sqlx.Open("sqlite3", sqlite.dsn(sqlite.Source))
+		So(err, ShouldBeNil)
+		defer writer.Close()
+
+		stop := make(chan struct{})
+		writes := make(chan error, 1)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					writes <- nil
+					return
+				default:
+				}
+				tx, err := writer.Begin()
+				if err != nil {
+					writes <- err
+					return
+				}
+				for j := 0; j < 20; j++ {
+					if _, err := tx.Exec("INSERT INTO test_log(entry) values(?)", fmt.Sprintf("entry %d/%d", i, j)); err != nil {
+						tx.Rollback()
+						writes <- err
+						return
+					}
+				}
+				if err := tx.Commit(); err != nil {
+					writes <- err
+					return
+				}
+			}
+		}()
+
+		var failed int32
+		for round := 0; round < 3; round++ {
+			var wg sync.WaitGroup
+			for i := 0; i < 300; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if !sqlite.CheckAcl("test", fmt.Sprintf("test/%d/%d", round, i), "client", MOSQ_ACL_READ) {
+						atomic.AddInt32(&failed, 1)
+					}
+				}(i)
+			}
+			wg.Wait()
+		}
+		close(stop)
+
+		So(<-writes, ShouldBeNil)
+		return atomic.LoadInt32(&failed)
+	}
+
+	//In WAL mode checks never wait for the writer, so a short busy timeout is enough unless they pile up opening connections. In a rollback journal mode they wait for every commit.
+	for _, opts := range []map[string]string{
+		{"sqlite_concurrency": "single", "sqlite_journal_mode": "DELETE"},
+		{"sqlite_concurrency": "single", "sqlite_journal_mode": "WAL", "sqlite_busy_timeout_ms": "50"},
+		{"sqlite_concurrency": "pool", "sqlite_journal_mode": "WAL", "sqlite_busy_timeout_ms": "50", "sqlite_max_open_conns": "4"},
+	} {
+		opts := opts
+		Convey(fmt.Sprintf("Given a storm of acl checks with %v, none should fail", opts), t, func() {
+			sqlite, err := NewSqlite(withOpts(opts["sqlite_concurrency"]+opts["sqlite_journal_mode"]+".db", opts), log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer sqlite.Halt()
+
+			So(stress(sqlite), ShouldEqual, 0)
+
+			if sqlite.Concurrency == "pool" {
+				So(sqlite.DB.Stats().OpenConnections, ShouldBeLessThanOrEqualTo, 4)
+			} else {
+				So(sqlite.DB.Stats().OpenConnections, ShouldEqual, 1)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,117 @@
+package backends
+
+import (
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+//sqliteStatement is a statement from a SQL script along with the line it starts at.
+type sqliteStatement struct {
+	line int
+	text string
+}
+
+//runScript runs the statements in the SQL script at path one by one, so a failing one is reported with the line it starts at.
+func (o Sqlite) runScript(path string) error {
+	script, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Errorf("Sqlite backend error: couldn't read sqlite_init_script %s: %s\n", path, err)
+	}
+
+	var pending *sqliteStatement
+	for _, statement := range splitSqliteScript(string(script)) {
+		if pending != nil {
+			statement = sqliteStatement{line: pending.line, text: pending.text + "\n" + statement.text}
+			pending = nil
+		}
+
+		if _, err := o.DB.Exec(statement.text); err != nil {
+			//Statements such as CREATE TRIGGER hold others ended by semicolons, and are incomplete until their END.
+			//The statement is copied, as the loop variable is reused by the next iteration.
+			if strings.Contains(err.Error(), "incomplete input") {
+				incomplete := statement
+				pending = &incomplete
+				continue
+			}
+			return errors.Errorf("Sqlite backend error: sqlite_init_script %s line %d: %s\n", path, statement.line, err)
+		}
+	}
+
+	if pending != nil {
+		return errors.Errorf("Sqlite backend error: sqlite_init_script %s line %d: incomplete statement\n", path, pending.line)
+	}
+
+	return nil
+}
+
+//splitSqliteScript splits a SQL script into statements ended by semicolons, leaving out comments. Semicolons in quotes or comments don't end a statement.
+func splitSqliteScript(script string) []sqliteStatement {
+	var statements []sqliteStatement
+	var text strings.Builder
+	line, start := 1, 0
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case strings.HasPrefix(script[i:], "--"):
+			//Skip to the end of the line, which is counted on the next pass.
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+				continue
+			}
+			i += end - 1
+			continue
+		case strings.HasPrefix(script[i:], "/*"):
+			comment := script[i:]
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				comment = script[i : i+end+4]
+			}
+			line += strings.Count(comment, "\n")
+			i += len(comment) - 1
+			text.WriteByte(' ')
+			continue
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			//An escaped quote is a doubled one, which is read as two quoted strings in a row.
+			quoted := script[i:]
+			if end := strings.IndexByte(script[i+1:], closing); end >= 0 {
+				quoted = script[i : i+end+2]
+			}
+			if start == 0 {
+				start = line
+			}
+			line += strings.Count(quoted, "\n")
+			text.WriteString(quoted)
+			i += len(quoted) - 1
+			continue
+		case c == ';':
+			if start != 0 {
+				text.WriteByte(c)
+				statements = append(statements, sqliteStatement{line: start, text: strings.TrimSpace(text.String())})
+			}
+			text.Reset()
+			start = 0
+			continue
+		case c == '\n':
+			line++
+		}
+
+		if start == 0 && !unicode.IsSpace(rune(c)) {
+			start = line
+		}
+		text.WriteByte(c)
+	}
+
+	if start != 0 {
+		statements = append(statements, sqliteStatement{line: start, text: strings.TrimSpace(text.String())})
+	}
+
+	return statements
+}
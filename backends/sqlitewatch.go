@@ -0,0 +1,109 @@
+package backends
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//sqliteRetireDelay is how long a replaced DB is kept open, so checks that got it just before it was replaced may still run their query on it.
+const sqliteRetireDelay = 10 * time.Second
+
+//sqliteWatcher polls the DB file and reopens it when it's replaced, e.g. by renaming an updated one over it, as SQLite would otherwise keep reading the old one.
+//Files opened as immutable are also reopened when modified in place, as SQLite won't notice changes to them. A replacement that can't be opened is logged and the current DB kept.
+type sqliteWatcher struct {
+	path      string
+	interval  time.Duration
+	immutable bool
+	open      func() (*sqlx.DB, error)
+	db        atomic.Value
+	file      os.FileInfo
+	done      chan struct{}
+	stopped   chan struct{}
+	halt      sync.Once
+}
+
+//newSqliteWatcher starts polling the file at path every interval, with db being the one currently open.
+func newSqliteWatcher(path string, interval time.Duration, immutable bool, db *sqlx.DB, open func() (*sqlx.DB, error)) *sqliteWatcher {
+	w := &sqliteWatcher{
+		path:      path,
+		interval:  interval,
+		immutable: immutable,
+		open:      open,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	w.db.Store(db)
+	w.file, _ = os.Stat(path)
+
+	go w.run()
+
+	return w
+}
+
+//run checks the file every interval until the watcher is stopped.
+func (w *sqliteWatcher) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+//check reopens the DB if its file changed since last seen, swapping it for the current one.
+func (w *sqliteWatcher) check() {
+	file, err := os.Stat(w.path)
+	if err != nil {
+		log.Warnf("Sqlite backend: couldn't stat %s, keeping the current DB: %s", w.path, err)
+		return
+	}
+
+	if w.file != nil && os.SameFile(w.file, file) && (!w.immutable || (file.ModTime().Equal(w.file.ModTime()) && file.Size() == w.file.Size())) {
+		return
+	}
+
+	//The file is taken as seen even if it can't be opened, so a broken one isn't tried again until it changes.
+	w.file = file
+
+	db, err := w.open()
+	if err != nil {
+		log.Errorf("Sqlite backend: %s changed but couldn't be opened, keeping the current DB: %s", w.path, err)
+		return
+	}
+
+	old := w.db.Load().(*sqlx.DB)
+	w.db.Store(db)
+	log.Infof("Sqlite backend: %s changed, reopened it.", w.path)
+
+	time.AfterFunc(sqliteRetireDelay, func() {
+		if err := old.Close(); err != nil {
+			log.Errorf("Sqlite cleanup error: %s", err)
+		}
+	})
+}
+
+//current returns the DB checks must run against.
+func (w *sqliteWatcher) current() *sqlx.DB {
+	return w.db.Load().(*sqlx.DB)
+}
+
+//stop stops polling the file and waits for any reopening to be done.
+func (w *sqliteWatcher) stop() {
+	w.halt.Do(func() {
+		close(w.done)
+		<-w.stopped
+	})
+}
@@ -0,0 +1,50 @@
+#!/bin/sh
+#Test helper for the exec backend: its first argument is the check, followed by the username and, for acl checks, the topic, clientid and access.
+#Users named after a failure fail that way, whatever the check.
+
+password=$(tr -d '\000')
+
+case "$2" in
+hang)
+	#The background sleep holds stderr, and must be killed along with the helper.
+	sleep 30 &
+	sleep 30
+	;;
+crash)
+	kill -SEGV $$
+	;;
+error)
+	echo "helper misconfigured" >&2
+	exit 2
+	;;
+slow)
+	sleep 0.2
+	exit 0
+	;;
+esac
+
+case "$1" in
+user)
+	if [ "$2" = "test1" ] && [ "$password" = "test pw" ]; then
+		exit 0
+	fi
+	echo "wrong password" >&2
+	exit 1
+	;;
+superuser)
+	[ "$2" = "admin" ] && [ -z "$password" ]
+	exit
+	;;
+acl)
+	#Devices publish their telemetry and read their commands.
+	if [ "$3" = "tele/$4" ] && [ "$5" = "2" ]; then
+		exit 0
+	fi
+	if [ "$3" = "cmd/$2" ] && { [ "$5" = "1" ] || [ "$5" = "4" ]; }; then
+		exit 0
+	fi
+	exit 1
+	;;
+esac
+
+exit 1
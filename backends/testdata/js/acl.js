@@ -0,0 +1,12 @@
+var READ = 1, WRITE = 2, READWRITE = 3, SUBSCRIBE = 4;
+
+//Devices publish their telemetry and read their commands, and anyone reads the announcements.
+module.exports = function (username, password, topic, clientid, acc) {
+	if (topic === "tele/" + clientid) {
+		return acc === WRITE;
+	}
+	if (topic === "cmd/" + username) {
+		return acc === READ || acc === SUBSCRIBE;
+	}
+	return topic.indexOf("announcements/") === 0 && acc !== WRITE && acc !== READWRITE;
+};
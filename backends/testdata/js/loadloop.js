@@ -0,0 +1,6 @@
+while (true) {
+}
+
+module.exports = function () {
+	return true;
+};
@@ -0,0 +1 @@
+throw new Error("not configured");
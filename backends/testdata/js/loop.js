@@ -0,0 +1,7 @@
+module.exports = function (username) {
+	if (username === "looping") {
+		for (;;) {
+		}
+	}
+	return true;
+};
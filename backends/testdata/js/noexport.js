@@ -0,0 +1,3 @@
+function check(username) {
+	return true;
+}
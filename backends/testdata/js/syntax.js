@@ -0,0 +1,3 @@
+module.exports = function (username {
+	return true;
+};
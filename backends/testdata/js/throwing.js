@@ -0,0 +1,6 @@
+module.exports = function (username) {
+	if (username === "throwing") {
+		throw new Error("unknown user");
+	}
+	return username === "test1" ? "yes" : true;
+};
@@ -0,0 +1,9 @@
+//Users and their passwords, which a real script would rather hash or look up.
+var passwords = {
+	test1: "testpw",
+	test2: "otherpw"
+};
+
+module.exports = function (username, password) {
+	return passwords.hasOwnProperty(username) && passwords[username] === password;
+};
@@ -0,0 +1,4 @@
+#!/bin/sh
+#Test helper for the PAM backend, run by pam_exec for account checks: the user is in PAM_USER.
+
+[ "$PAM_USER" != "expired" ]
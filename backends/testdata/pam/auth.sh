@@ -0,0 +1,13 @@
+#!/bin/sh
+#Test helper for the PAM backend, run by pam_exec with expose_authtok: the user is in PAM_USER and the password on stdin, ended by a NUL.
+
+password=$(tr -d '\000')
+
+case "$PAM_USER" in
+hang)
+	sleep 1
+	exit 0
+	;;
+esac
+
+[ "$password" = "test pw" ] && [ "$PAM_USER" != "nobody-knows" ]
@@ -0,0 +1,28 @@
+//badacl is a test plugin exposing the legacy funcs with a CheckAcl taking the access level as an int32, as backends do, instead of an int.
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+func Init(authOpts map[string]string, logLevel log.Level) error {
+	return nil
+}
+
+func GetUser(username, password string) bool {
+	return false
+}
+
+func GetSuperuser(username string) bool {
+	return false
+}
+
+func CheckAcl(username, topic, clientid string, acc int32) bool {
+	return false
+}
+
+func GetName() string {
+	return "Bad acl"
+}
+
+func Halt() {}
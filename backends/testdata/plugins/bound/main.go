@@ -0,0 +1,46 @@
+//bound is a test plugin exposing the legacy funcs along with GetUserWithClientid, authenticating the devices it's given in the bound_devices option, as device:password:clientid triples, only from their client id.
+package main
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type credentials struct {
+	password, clientid string
+}
+
+var devices = make(map[string]credentials)
+
+func Init(authOpts map[string]string, logLevel log.Level) error {
+	for _, triple := range strings.Split(authOpts["bound_devices"], ",") {
+		if parts := strings.SplitN(triple, ":", 3); len(parts) == 3 {
+			devices[parts[0]] = credentials{password: parts[1], clientid: parts[2]}
+		}
+	}
+	return nil
+}
+
+func GetUser(username, password string) bool {
+	return false
+}
+
+func GetUserWithClientid(username, password, clientid string) bool {
+	stored, ok := devices[username]
+	return ok && stored.password == password && stored.clientid == clientid
+}
+
+func GetSuperuser(username string) bool {
+	return false
+}
+
+func CheckAcl(username, topic, clientid string, acc int) bool {
+	return false
+}
+
+func GetName() string {
+	return "Bound devices"
+}
+
+func Halt() {}
@@ -0,0 +1,42 @@
+//boundv2 is a test plugin using the v2 contract with GetUserWithClientid, authenticating the devices it's given in the bound_devices option, as device:password:clientid triples, only from their client id.
+package main
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/pluginapi"
+)
+
+type credentials struct {
+	password, clientid string
+}
+
+var devices = make(map[string]credentials)
+
+func GetPlugin() pluginapi.PluginV2 {
+	return pluginapi.PluginV2{
+		Version: func() string { return "2.0.0" },
+		Init: func(authOpts map[string]string, logLevel log.Level) error {
+			for _, triple := range strings.Split(authOpts["bound_devices"], ",") {
+				if parts := strings.SplitN(triple, ":", 3); len(parts) == 3 {
+					devices[parts[0]] = credentials{password: parts[1], clientid: parts[2]}
+				}
+			}
+			return nil
+		},
+		GetName: func() string { return "Bound devices v2" },
+		GetUser: func(username, password string) (bool, error) {
+			return false, nil
+		},
+		GetUserWithClientid: func(username, password, clientid string) (bool, error) {
+			stored, ok := devices[username]
+			return ok && stored.password == password && stored.clientid == clientid, nil
+		},
+		GetSuperuser: func(username string) (bool, error) { return false, nil },
+		CheckAcl: func(username, topic, clientid string, acc int) (bool, error) {
+			return false, nil
+		},
+	}
+}
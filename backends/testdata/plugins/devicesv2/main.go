@@ -0,0 +1,55 @@
+//devicesv2 is a test plugin using the v2 contract, authenticating the devices it's given in the devicesv2_devices option, as device:password pairs, and failing to tell for the devicesv2_unreachable user.
+package main
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/pluginapi"
+)
+
+var (
+	devices     = make(map[string]string)
+	unreachable string
+)
+
+var errUnreachable = errors.New("device store unreachable")
+
+func GetPlugin() pluginapi.PluginV2 {
+	return pluginapi.PluginV2{
+		Version: func() string { return "2.1.0" },
+		Init: func(authOpts map[string]string, logLevel log.Level) error {
+			for _, pair := range strings.Split(authOpts["devicesv2_devices"], ",") {
+				if kv := strings.SplitN(pair, ":", 2); len(kv) == 2 {
+					devices[kv[0]] = kv[1]
+				}
+			}
+			unreachable = authOpts["devicesv2_unreachable"]
+			return nil
+		},
+		GetName: func() string { return "Devices v2" },
+		GetUser: func(username, password string) (bool, error) {
+			if username == unreachable {
+				return false, errUnreachable
+			}
+			stored, ok := devices[username]
+			return ok && stored == password, nil
+		},
+		GetSuperuser: func(username string) (bool, error) {
+			if username == unreachable {
+				return false, errUnreachable
+			}
+			return false, nil
+		},
+		CheckAcl: func(username, topic, clientid string, acc int) (bool, error) {
+			if username == unreachable {
+				return false, errUnreachable
+			}
+			_, ok := devices[username]
+			return ok && strings.HasPrefix(topic, "devices/"+username+"/"), nil
+		},
+		Options: func() []string { return []string{"devicesv2_devices", "devicesv2_unreachable"} },
+	}
+}
@@ -0,0 +1,34 @@
+//geofence is a test plugin granting any user the topics of the region given in the geofence_region option, and the geofence_admin user everything.
+package main
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var region, admin string
+
+func Init(authOpts map[string]string, logLevel log.Level) error {
+	region = authOpts["geofence_region"]
+	admin = authOpts["geofence_admin"]
+	return nil
+}
+
+func GetUser(username, password string) bool {
+	return false
+}
+
+func GetSuperuser(username string) bool {
+	return admin != "" && username == admin
+}
+
+func CheckAcl(username, topic, clientid string, acc int) bool {
+	return region != "" && strings.HasPrefix(topic, "geo/"+region+"/")
+}
+
+func GetName() string {
+	return "Geofencing"
+}
+
+func Halt() {}
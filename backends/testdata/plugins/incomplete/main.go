@@ -0,0 +1,26 @@
+//incomplete is a test plugin lacking the Halt func.
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+func Init(authOpts map[string]string, logLevel log.Level) error {
+	return nil
+}
+
+func GetUser(username, password string) bool {
+	return true
+}
+
+func GetSuperuser(username string) bool {
+	return true
+}
+
+func CheckAcl(username, topic, clientid string, acc int) bool {
+	return true
+}
+
+func GetName() string {
+	return "Incomplete"
+}
@@ -0,0 +1,8 @@
+//panicking is a test plugin whose GetPlugin panics.
+package main
+
+import "github.com/iegomez/mosquitto-go-auth/pluginapi"
+
+func GetPlugin() pluginapi.PluginV2 {
+	panic("built against another mosquitto-go-auth")
+}
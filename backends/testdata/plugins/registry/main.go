@@ -0,0 +1,43 @@
+//registry is a test plugin authenticating the devices it's given in the registry_devices option, as device:password pairs, and granting them their own topics.
+package main
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var devices = make(map[string]string)
+
+func Init(authOpts map[string]string, logLevel log.Level) error {
+	if authOpts["registry_fail"] == "true" {
+		return errors.New("registry unavailable")
+	}
+	for _, pair := range strings.Split(authOpts["registry_devices"], ",") {
+		if kv := strings.SplitN(pair, ":", 2); len(kv) == 2 {
+			devices[kv[0]] = kv[1]
+		}
+	}
+	return nil
+}
+
+func GetUser(username, password string) bool {
+	stored, ok := devices[username]
+	return ok && stored == password
+}
+
+func GetSuperuser(username string) bool {
+	return false
+}
+
+func CheckAcl(username, topic, clientid string, acc int) bool {
+	_, ok := devices[username]
+	return ok && strings.HasPrefix(topic, "devices/"+username+"/")
+}
+
+func GetName() string {
+	return "Device registry"
+}
+
+func Halt() {}
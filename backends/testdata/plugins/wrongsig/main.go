@@ -0,0 +1,8 @@
+//wrongsig is a test plugin whose GetPlugin doesn't have the v2 contract's signature.
+package main
+
+import "github.com/iegomez/mosquitto-go-auth/pluginapi"
+
+func GetPlugin() *pluginapi.PluginV2 {
+	return &pluginapi.PluginV2{}
+}
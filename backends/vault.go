@@ -0,0 +1,322 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	h "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//vaultRequestTimeout bounds every request made to Vault.
+const vaultRequestTimeout = 10 * time.Second
+
+//vaultMaxRetryBackoff bounds the wait between attempts to get credentials while Vault fails.
+const vaultMaxRetryBackoff = 30 * time.Second
+
+//vaultClient makes requests to Vault, authenticated with a given token or logging in with AppRole, again whenever the AppRole token is about to expire.
+type vaultClient struct {
+	addr         string
+	client       *h.Client
+	token        string
+	approleMount string
+	roleID       string
+	secretID     string
+
+	mu          sync.Mutex
+	loginToken  string
+	loginExpiry time.Time
+	now         func() time.Time
+}
+
+//vaultLease holds database credentials issued by Vault and when they expire. A zero duration means they don't.
+type vaultLease struct {
+	username string
+	password string
+	leaseID  string
+	duration time.Duration
+	obtained time.Time
+}
+
+//vaultError is an error Vault responded with.
+type vaultError struct {
+	status int
+	errors []string
+}
+
+func (e vaultError) Error() string {
+	if len(e.errors) == 0 {
+		return h.StatusText(e.status)
+	}
+	return strings.Join(e.errors, ", ")
+}
+
+//newVaultClient returns a client for the Vault at addr, verifying its certificate with the CAs in caFile, if given, rather than the system ones.
+//It's authenticated with the token when given, or else by logging in with the AppRole role and secret ids at the approle mount.
+func newVaultClient(addr, caFile, token, approleMount, roleID, secretID string) (*vaultClient, error) {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid Vault address %s", addr)
+	}
+
+	if token == "" && (roleID == "" || secretID == "") {
+		return nil, errors.New("a Vault token, or an AppRole role id and secret, must be given")
+	}
+
+	transport := &h.Transport{Proxy: h.ProxyFromEnvironment}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Errorf("couldn't read Vault CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in Vault CA %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &vaultClient{
+		addr:         strings.TrimRight(addr, "/"),
+		client:       &h.Client{Transport: transport, Timeout: vaultRequestTimeout},
+		token:        token,
+		approleMount: strings.Trim(approleMount, "/"),
+		roleID:       roleID,
+		secretID:     secretID,
+		now:          time.Now,
+	}, nil
+}
+
+//request makes a request to the Vault API at path, e.g. database/creds/mqtt, sending body as JSON if not nil and decoding the response into out.
+func (c *vaultClient) request(method, path, token string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := h.NewRequest(method, c.addr+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return vaultError{status: resp.StatusCode, errors: failure.Errors}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+//authToken returns the token to authenticate requests with, logging in with AppRole when there's no valid token from a previous login.
+//An AppRole token is taken as expired once two thirds of its ttl passed, so it isn't used when about to expire.
+func (c *vaultClient) authToken() (string, error) {
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loginToken != "" && (c.loginExpiry.IsZero() || c.now().Before(c.loginExpiry)) {
+		return c.loginToken, nil
+	}
+
+	var login struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": c.roleID, "secret_id": c.secretID}
+	if err := c.request("POST", "auth/"+c.approleMount+"/login", "", body, &login); err != nil {
+		return "", errors.Errorf("couldn't log in with AppRole: %s", err)
+	}
+	if login.Auth.ClientToken == "" {
+		return "", errors.New("couldn't log in with AppRole: no token in the response")
+	}
+
+	c.loginToken = login.Auth.ClientToken
+	c.loginExpiry = time.Time{}
+	if login.Auth.LeaseDuration > 0 {
+		c.loginExpiry = c.now().Add(time.Duration(login.Auth.LeaseDuration) * time.Second * 2 / 3)
+	}
+	return c.loginToken, nil
+}
+
+//forgetToken drops the AppRole token, e.g. after Vault refused it, so the next request logs in again.
+func (c *vaultClient) forgetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loginToken == token {
+		c.loginToken = ""
+	}
+}
+
+//databaseCredentials gets new credentials for the role of the database secrets engine at mount.
+func (c *vaultClient) databaseCredentials(mount, role string) (vaultLease, error) {
+	var creds struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Data          struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+
+	path := strings.Trim(mount, "/") + "/creds/" + url.PathEscape(role)
+	for attempt := 0; ; attempt++ {
+		token, err := c.authToken()
+		if err != nil {
+			return vaultLease{}, err
+		}
+		err = c.request("GET", path, token, nil, &creds)
+		//Vault may have revoked the AppRole token before its ttl, so log in again once.
+		if vErr, ok := err.(vaultError); ok && vErr.status == h.StatusForbidden && c.token == "" && attempt == 0 {
+			c.forgetToken(token)
+			continue
+		}
+		if err != nil {
+			return vaultLease{}, errors.Errorf("couldn't get credentials for role %s: %s", role, err)
+		}
+		break
+	}
+
+	if creds.Data.Username == "" {
+		return vaultLease{}, errors.Errorf("couldn't get credentials for role %s: no username in the response", role)
+	}
+
+	return vaultLease{
+		username: creds.Data.Username,
+		password: creds.Data.Password,
+		leaseID:  creds.LeaseID,
+		duration: time.Duration(creds.LeaseDuration) * time.Second,
+		obtained: c.now(),
+	}, nil
+}
+
+//vaultRenewer gets new credentials before the lease of the current ones ends, once two thirds of it passed, and hands them to rotate, which starts using them.
+//When Vault or rotate fail, it keeps retrying with a growing backoff, while the current credentials are kept until their lease ends.
+type vaultRenewer struct {
+	name     string
+	client   *vaultClient
+	mount    string
+	role     string
+	lease    vaultLease
+	rotate   func(lease vaultLease) error
+	minRetry time.Duration
+	done     chan struct{}
+	stopped  chan struct{}
+	halt     sync.Once
+}
+
+//newVaultRenewer starts renewing the current lease's credentials. The name tells the backend in logs.
+func newVaultRenewer(name string, client *vaultClient, mount, role string, lease vaultLease, rotate func(lease vaultLease) error) *vaultRenewer {
+	r := &vaultRenewer{
+		name:     name,
+		client:   client,
+		mount:    mount,
+		role:     role,
+		lease:    lease,
+		rotate:   rotate,
+		minRetry: time.Second,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+//run gets new credentials whenever the current ones are due, until stopped. Credentials that never expire are kept for good.
+func (r *vaultRenewer) run() {
+	defer close(r.stopped)
+
+	if r.lease.duration <= 0 {
+		log.Infof("%s backend: Vault credentials for role %s don't expire, they won't be renewed.", r.name, r.role)
+		return
+	}
+
+	backoff := r.minRetry
+	wait := r.due()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-time.After(wait):
+		}
+
+		err := r.renew()
+		if err == nil {
+			backoff = r.minRetry
+			wait = r.due()
+			continue
+		}
+
+		end := r.lease.obtained.Add(r.lease.duration)
+		if r.client.now().Before(end) {
+			log.Warnf("%s backend: couldn't renew Vault credentials, keeping the current ones until their lease ends at %s and retrying in %s: %s", r.name, end.Format(time.RFC3339), backoff, err)
+		} else {
+			log.Errorf("%s backend: couldn't renew Vault credentials, whose lease ended at %s, retrying in %s: %s", r.name, end.Format(time.RFC3339), backoff, err)
+		}
+		wait = backoff
+		backoff *= 2
+		if backoff > vaultMaxRetryBackoff {
+			backoff = vaultMaxRetryBackoff
+		}
+	}
+}
+
+//due returns how long until the current credentials must be renewed.
+func (r *vaultRenewer) due() time.Duration {
+	return r.lease.obtained.Add(r.lease.duration * 2 / 3).Sub(r.client.now())
+}
+
+//renew gets new credentials and rotates them in.
+func (r *vaultRenewer) renew() error {
+	lease, err := r.client.databaseCredentials(r.mount, r.role)
+	if err != nil {
+		return err
+	}
+	if err := r.rotate(lease); err != nil {
+		return errors.Errorf("couldn't use the new credentials: %s", err)
+	}
+	r.lease = lease
+	log.Infof("%s backend: renewed Vault credentials for role %s, now connecting as %s until %s.", r.name, r.role, lease.username, lease.obtained.Add(lease.duration).Format(time.RFC3339))
+	return nil
+}
+
+//stop stops renewing and waits for any renewal to be done.
+func (r *vaultRenewer) stop() {
+	r.halt.Do(func() {
+		close(r.done)
+		<-r.stopped
+	})
+}
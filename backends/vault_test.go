@@ -0,0 +1,467 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	h "net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//fakeVault answers AppRole logins and database credentials requests as Vault does, issuing a new username for every request.
+type fakeVault struct {
+	server *httptest.Server
+
+	mu           sync.Mutex
+	token        string
+	roleID       string
+	secretID     string
+	tokenTTL     int
+	leaseTTL     int
+	username     func(n int) string
+	password     func(username string) string
+	down         bool
+	logins       int
+	credentials  int
+	loginTokens  map[string]bool
+	lastUsername string
+}
+
+func newFakeVault() *fakeVault {
+	v := &fakeVault{
+		token:       "root-token",
+		roleID:      "mqtt-role-id",
+		secretID:    "mqtt-secret-id",
+		tokenTTL:    3600,
+		leaseTTL:    3600,
+		username:    func(n int) string { return fmt.Sprintf("v-mqtt-%d", n) },
+		password:    func(username string) string { return username + "-pw" },
+		loginTokens: make(map[string]bool),
+	}
+	v.server = httptest.NewServer(h.HandlerFunc(v.handle))
+	return v
+}
+
+func (v *fakeVault) handle(w h.ResponseWriter, r *h.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fail := func(status int, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+	}
+
+	if v.down {
+		fail(h.StatusServiceUnavailable, "Vault is sealed")
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v1/auth/approle/login":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != v.roleID || body["secret_id"] != v.secretID {
+			fail(h.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		v.logins++
+		token := fmt.Sprintf("approle-token-%d", v.logins)
+		v.loginTokens[token] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": token, "lease_duration": v.tokenTTL, "renewable": true},
+		})
+	case r.Method == "GET" && r.URL.Path == "/v1/database/creds/mqtt":
+		token := r.Header.Get("X-Vault-Token")
+		if token != v.token && !v.loginTokens[token] {
+			fail(h.StatusForbidden, "permission denied")
+			return
+		}
+		v.credentials++
+		v.lastUsername = v.username(v.credentials)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_id":       fmt.Sprintf("database/creds/mqtt/lease-%d", v.credentials),
+			"lease_duration": v.leaseTTL,
+			"renewable":      true,
+			"data":           map[string]string{"username": v.lastUsername, "password": v.password(v.lastUsername)},
+		})
+	default:
+		fail(h.StatusNotFound, "no handler for route")
+	}
+}
+
+func (v *fakeVault) set(f func(v *fakeVault)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	f(v)
+}
+
+func (v *fakeVault) stats() (logins, credentials int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.logins, v.credentials
+}
+
+func TestVault(t *testing.T) {
+
+	vault := newFakeVault()
+	defer vault.server.Close()
+
+	Convey("Given wrong client options, newVaultClient should fail", t, func() {
+		for _, opts := range [][]string{
+			{"vault:8200", "", "root-token", "approle", "", ""},
+			{"ftp://vault:8200", "", "root-token", "approle", "", ""},
+			{vault.server.URL, "", "", "approle", "", ""},
+			{vault.server.URL, "", "", "approle", "mqtt-role-id", ""},
+			{vault.server.URL, "testdata/missing-ca.pem", "root-token", "approle", "", ""},
+		} {
+			_, err := newVaultClient(opts[0], opts[1], opts[2], opts[3], opts[4], opts[5])
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given a token, credentials should be requested with it", t, func() {
+		client, err := newVaultClient(vault.server.URL+"/", "", "root-token", "approle", "", "")
+		So(err, ShouldBeNil)
+
+		lease, err := client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+		So(lease.username, ShouldStartWith, "v-mqtt-")
+		So(lease.password, ShouldEqual, lease.username+"-pw")
+		So(lease.duration, ShouldEqual, time.Hour)
+
+		_, err = client.databaseCredentials("database", "other")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "no handler for route")
+
+		client.token = "wrong-token"
+		_, err = client.databaseCredentials("database", "mqtt")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "permission denied")
+	})
+
+	Convey("Given AppRole ids, the client should log in and log in again when its token expires or is revoked", t, func() {
+		client, err := newVaultClient(vault.server.URL, "", "", "approle", "mqtt-role-id", "mqtt-secret-id")
+		So(err, ShouldBeNil)
+		now := time.Now()
+		client.now = func() time.Time { return now }
+
+		logins, _ := vault.stats()
+		_, err = client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+		_, err = client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+		after, _ := vault.stats()
+		So(after, ShouldEqual, logins+1)
+
+		//Two thirds of the token's hour passed.
+		now = now.Add(41 * time.Minute)
+		_, err = client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+		after, _ = vault.stats()
+		So(after, ShouldEqual, logins+2)
+
+		vault.set(func(v *fakeVault) { v.loginTokens = make(map[string]bool) })
+		_, err = client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+		after, _ = vault.stats()
+		So(after, ShouldEqual, logins+3)
+
+		client.secretID = "wrong-secret-id"
+		client.forgetToken(client.loginToken)
+		_, err = client.databaseCredentials("database", "mqtt")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "couldn't log in with AppRole")
+	})
+
+	Convey("Given credentials with a lease, they should be renewed before it ends", t, func() {
+		vault.set(func(v *fakeVault) { v.leaseTTL = 1 })
+		defer vault.set(func(v *fakeVault) { v.leaseTTL = 3600 })
+
+		client, err := newVaultClient(vault.server.URL, "", "root-token", "approle", "", "")
+		So(err, ShouldBeNil)
+		lease, err := client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+
+		rotated := make(chan vaultLease, 10)
+		renewer := newVaultRenewer("Test", client, "database", "mqtt", lease, func(lease vaultLease) error {
+			rotated <- lease
+			return nil
+		})
+		defer renewer.stop()
+
+		select {
+		case renewed := <-rotated:
+			So(time.Since(lease.obtained), ShouldBeLessThan, time.Second)
+			So(renewed.username, ShouldNotEqual, lease.username)
+		case <-time.After(2 * time.Second):
+			t.Fatal("credentials weren't renewed")
+		}
+	})
+
+	Convey("Given Vault failing, the current credentials should be kept and renewed once it's back", t, func() {
+		vault.set(func(v *fakeVault) { v.leaseTTL = 1 })
+		defer vault.set(func(v *fakeVault) { v.leaseTTL = 3600 })
+
+		client, err := newVaultClient(vault.server.URL, "", "root-token", "approle", "", "")
+		So(err, ShouldBeNil)
+		lease, err := client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+
+		vault.set(func(v *fakeVault) { v.down = true })
+		rotated := make(chan vaultLease, 10)
+		renewer := newVaultRenewer("Test", client, "database", "mqtt", lease, func(lease vaultLease) error {
+			rotated <- lease
+			return nil
+		})
+		defer renewer.stop()
+
+		time.Sleep(time.Second)
+		So(len(rotated), ShouldEqual, 0)
+
+		vault.set(func(v *fakeVault) { v.down = false })
+		select {
+		case renewed := <-rotated:
+			So(renewed.username, ShouldNotEqual, lease.username)
+		case <-time.After(3 * time.Second):
+			t.Fatal("credentials weren't renewed once Vault was back")
+		}
+	})
+
+	Convey("Given new credentials that can't be used, getting them should be retried", t, func() {
+		vault.set(func(v *fakeVault) { v.leaseTTL = 1 })
+		defer vault.set(func(v *fakeVault) { v.leaseTTL = 3600 })
+
+		client, err := newVaultClient(vault.server.URL, "", "root-token", "approle", "", "")
+		So(err, ShouldBeNil)
+		lease, err := client.databaseCredentials("database", "mqtt")
+		So(err, ShouldBeNil)
+
+		var mu sync.Mutex
+		var tried []string
+		rotated := make(chan vaultLease, 10)
+		renewer := newVaultRenewer("Test", client, "database", "mqtt", lease, func(lease vaultLease) error {
+			mu.Lock()
+			defer mu.Unlock()
+			tried = append(tried, lease.username)
+			if len(tried) == 1 {
+				return fmt.Errorf("password authentication failed for user %s", lease.username)
+			}
+			rotated <- lease
+			return nil
+		})
+		defer renewer.stop()
+
+		select {
+		case renewed := <-rotated:
+			mu.Lock()
+			So(len(tried), ShouldEqual, 2)
+			So(renewed.username, ShouldEqual, tried[1])
+			mu.Unlock()
+		case <-time.After(3 * time.Second):
+			t.Fatal("credentials weren't renewed after rotating failed")
+		}
+	})
+
+	Convey("Given credentials that don't expire, the renewer should stop right away", t, func() {
+		client, err := newVaultClient(vault.server.URL, "", "root-token", "approle", "", "")
+		So(err, ShouldBeNil)
+
+		renewer := newVaultRenewer("Test", client, "database", "mqtt", vaultLease{username: "static"}, func(lease vaultLease) error {
+			return nil
+		})
+		select {
+		case <-renewer.stopped:
+		case <-time.After(time.Second):
+			t.Fatal("renewer didn't stop")
+		}
+		renewer.stop()
+	})
+
+}
+
+func TestPostgresVault(t *testing.T) {
+
+	vault := newFakeVault()
+	defer vault.server.Close()
+
+	authOpts := func(opts map[string]string) map[string]string {
+		all := map[string]string{
+			"pg_dbname":     "go_auth_test",
+			"pg_userquery":  "SELECT password_hash FROM test_user WHERE username = $1 limit 1",
+			"pg_vault_addr": vault.server.URL,
+			"pg_vault_role": "mqtt",
+		}
+		for key, value := range opts {
+			if value == "" {
+				delete(all, key)
+			} else {
+				all[key] = value
+			}
+		}
+		return all
+	}
+
+	Convey("Given wrong Vault options, or Vault not issuing credentials, NewPostgres should fail before connecting", t, func() {
+		for _, opts := range []map[string]string{
+			{"pg_vault_token": "root-token", "pg_user": "go_auth_test"},
+			{"pg_vault_token": "root-token", "pg_password": "go_auth_test"},
+			{"pg_vault_token": "root-token", "pg_vault_role": ""},
+			{},
+			{"pg_vault_approle_role_id": "mqtt-role-id"},
+			{"pg_vault_token": "root-token", "pg_vault_addr": "vault:8200"},
+			{"pg_vault_token": "wrong-token"},
+			{"pg_vault_approle_role_id": "mqtt-role-id", "pg_vault_approle_secret": "wrong-secret-id"},
+			{"pg_vault_token": "root-token", "pg_vault_mount": "secret"},
+		} {
+			_, err := NewPostgres(authOpts(opts), log.DebugLevel)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldNotContainSubstring, "couldn't open DB")
+		}
+	})
+
+	//Vault issues the test DB's credentials, as it has no other user, renewing them every second or so.
+	vault.set(func(v *fakeVault) {
+		v.leaseTTL = 1
+		v.username = func(int) string { return "go_auth_test" }
+		v.password = func(string) string { return "go_auth_test" }
+	})
+
+	Convey("Given credentials from Vault, the backend should connect with them and keep checking while they're renewed", t, func() {
+		postgres, err := NewPostgres(authOpts(map[string]string{
+			"pg_vault_approle_role_id": "mqtt-role-id",
+			"pg_vault_approle_secret":  "mqtt-secret-id",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer postgres.Halt()
+		So(postgres.User, ShouldEqual, "go_auth_test")
+
+		first := postgres.db()
+
+		//Checks keep running while the DB is replaced by one connecting with the renewed credentials.
+		failed := 0
+		for deadline := time.Now().Add(1500 * time.Millisecond); time.Now().Before(deadline); {
+			var one int
+			ctx, cancel := postgres.queryContext()
+			if err := postgres.query(ctx, func(db *sqlx.DB) error { return db.GetContext(ctx, &one, "SELECT 1") }); err != nil {
+				failed++
+			}
+			cancel()
+			time.Sleep(20 * time.Millisecond)
+		}
+		So(failed, ShouldEqual, 0)
+		So(postgres.db() != first, ShouldBeTrue)
+
+		//The replaced DB is kept open a while for checks that got it just before.
+		So(first.Ping(), ShouldBeNil)
+	})
+
+}
+
+func TestMysqlVault(t *testing.T) {
+
+	vault := newFakeVault()
+	defer vault.server.Close()
+
+	authOpts := func(opts map[string]string) map[string]string {
+		all := map[string]string{
+			"mysql_dbname":                 "go_auth_test",
+			"mysql_allow_native_passwords": "true",
+			"mysql_userquery":              "SELECT password_hash FROM test_user WHERE username = ? limit 1",
+			"mysql_vault_addr":             vault.server.URL,
+			"mysql_vault_role":             "mqtt",
+		}
+		for key, value := range opts {
+			if value == "" {
+				delete(all, key)
+			} else {
+				all[key] = value
+			}
+		}
+		return all
+	}
+
+	Convey("Given wrong Vault options, or Vault not issuing credentials, NewMysql should fail before connecting", t, func() {
+		for _, opts := range []map[string]string{
+			{"mysql_vault_token": "root-token", "mysql_user": "go_auth_test"},
+			{"mysql_vault_token": "root-token", "mysql_password": "go_auth_test"},
+			{"mysql_vault_token": "root-token", "mysql_vault_role": ""},
+			{},
+			{"mysql_vault_approle_role_id": "mqtt-role-id"},
+			{"mysql_vault_token": "root-token", "mysql_vault_addr": "vault:8200"},
+			{"mysql_vault_token": "wrong-token"},
+			{"mysql_vault_approle_role_id": "mqtt-role-id", "mysql_vault_approle_secret": "wrong-secret-id"},
+			{"mysql_vault_token": "root-token", "mysql_vault_mount": "secret"},
+		} {
+			_, err := NewMysql(authOpts(opts), log.DebugLevel)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldNotContainSubstring, "couldn't open DB")
+		}
+	})
+
+	//Vault issues the test DB's credentials, as it has no other user, renewing them every second or so.
+	vault.set(func(v *fakeVault) {
+		v.leaseTTL = 1
+		v.username = func(int) string { return "go_auth_test" }
+		v.password = func(string) string { return "go_auth_test" }
+	})
+
+	Convey("Given credentials from Vault, the backend should connect with them and keep checking while they're renewed", t, func() {
+		mysql, err := NewMysql(authOpts(map[string]string{
+			"mysql_vault_approle_role_id": "mqtt-role-id",
+			"mysql_vault_approle_secret":  "mqtt-secret-id",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer mysql.Halt()
+		So(mysql.User, ShouldEqual, "go_auth_test")
+
+		first := mysql.db()
+
+		//Checks keep running while the DB is replaced by one connecting with the renewed credentials.
+		failed := 0
+		for deadline := time.Now().Add(1500 * time.Millisecond); time.Now().Before(deadline); {
+			var one int
+			ctx, cancel := mysql.queryContext()
+			if err := mysql.query(ctx, func(db *sqlx.DB) error { return db.GetContext(ctx, &one, "SELECT 1") }); err != nil {
+				failed++
+			}
+			cancel()
+			time.Sleep(20 * time.Millisecond)
+		}
+		So(failed, ShouldEqual, 0)
+		So(mysql.db() != first, ShouldBeTrue)
+
+		//The replaced DB is kept open a while for checks that got it just before.
+		So(first.Ping(), ShouldBeNil)
+	})
+
+	Convey("Given several hosts, renewed credentials should replace the DB of every host", t, func() {
+		mysql, err := NewMysql(authOpts(map[string]string{
+			"mysql_host":        "localhost,127.0.0.1",
+			"mysql_vault_token": "root-token",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer mysql.Halt()
+
+		first := mysql.dbs()
+		So(first, ShouldHaveLength, 2)
+
+		time.Sleep(1500 * time.Millisecond)
+
+		renewed := mysql.dbs()
+		So(renewed, ShouldHaveLength, 2)
+		for i := range renewed {
+			So(renewed[i] != first[i], ShouldBeTrue)
+		}
+
+		ctx, cancel := mysql.queryContext()
+		defer cancel()
+		So(mysql.ping(ctx), ShouldBeNil)
+	})
+
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/iegomez/mosquitto-go-auth/goauth"
+)
+
+// authOptPrefix starts the lines of a mosquitto.conf giving auth options.
+const authOptPrefix = "auth_opt_"
+
+// dryRunOptions are dropped from the checked options, so checking neither
+// writes to the broker's log and audit files nor binds its metrics address.
+// Logs go to stderr instead.
+var dryRunOptions = []string{
+	"log_dest", "log_file", "log_file_max_mb", "log_file_max_backups",
+	"log_syslog_network", "log_syslog_address", "log_syslog_tag",
+	"audit_log_file", "audit_log_max_per_second", "metrics_listen",
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs authcheck with the given arguments and returns its exit code: 0
+// when the plugin starts with the configuration, its backends are healthy
+// and the checks asked for are granted, 1 otherwise, and 2 when the flags
+// are wrong.
+func run(args []string, stdout, stderr io.Writer) int {
+
+	flags := flag.NewFlagSet("authcheck", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	var config = flags.String("c", "", "mosquitto.conf, or file of key=value auth options, to check")
+	var username = flags.String("user", "", "username to check")
+	var password = flags.String("password", "", "password to check the user with")
+	var clientid = flags.String("clientid", "authcheck", "client id to check with")
+	var topic = flags.String("topic", "", "topic to check the user's acl for")
+	var acc = flags.Int("acc", 1, "access to check the topic for: 1 is read, 2 is write, 3 is readwrite, 4 is subscribe")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	passwordGiven := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "password" {
+			passwordGiven = true
+		}
+	})
+
+	switch {
+	case flags.NArg() > 0:
+		fmt.Fprintf(stderr, "error: unexpected arguments %s\n", strings.Join(flags.Args(), " "))
+		return 2
+	case *config == "":
+		fmt.Fprintln(stderr, "error: c must be given")
+		return 2
+	case (passwordGiven || *topic != "") && *username == "":
+		fmt.Fprintln(stderr, "error: user must be given with password or topic")
+		return 2
+	}
+
+	authOpts, err := readOptions(*config)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err)
+		return 1
+	}
+	for _, key := range dryRunOptions {
+		delete(authOpts, key)
+	}
+
+	log.SetOutput(stderr)
+	if err := goauth.Init(authOpts); err != nil {
+		fmt.Fprintf(stdout, "init failed: %s\n", err)
+		return 1
+	}
+	defer goauth.AuthPluginCleanup()
+
+	code := 0
+	health := goauth.Health()
+	for _, name := range goauth.Backends() {
+		healthy, known := health[name]
+		switch {
+		case !known:
+			fmt.Fprintf(stdout, "backend %s: ok\n", name)
+		case healthy:
+			fmt.Fprintf(stdout, "backend %s: healthy\n", name)
+		default:
+			fmt.Fprintf(stdout, "backend %s: unhealthy\n", name)
+			code = 1
+		}
+	}
+
+	user := common.RedactUsername(*username)
+	if passwordGiven {
+		granted, results := goauth.DryRunUser(*username, *password, *clientid)
+		if !printCheck(stdout, fmt.Sprintf("user %s", user), granted, results) {
+			code = 1
+		}
+	}
+	if *topic != "" {
+		granted, results := goauth.DryRunAcl(*username, *topic, *clientid, *acc)
+		if !printCheck(stdout, fmt.Sprintf("acl %s %s %d", user, *topic, *acc), granted, results) {
+			code = 1
+		}
+	}
+
+	return code
+}
+
+// printCheck prints whether the check was granted and what each backend
+// asked gave, returning whether it was granted.
+func printCheck(w io.Writer, check string, granted bool, results []goauth.BackendResult) bool {
+	decision := "denied"
+	if granted {
+		decision = "granted"
+	}
+	fmt.Fprintf(w, "%s: %s\n", check, decision)
+
+	if len(results) == 0 {
+		fmt.Fprintln(w, "  no backend was asked")
+	}
+	for _, result := range results {
+		fmt.Fprintf(w, "  %s: %s in %s\n", result.Backend, result.Result, result.Duration)
+	}
+	return granted
+}
+
+// readOptions reads the auth options from a mosquitto.conf, taking its
+// auth_opt_<key> <value> lines and ignoring every other one, or from a file
+// of key=value lines. Empty lines and # comments are skipped in both.
+func readOptions(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	authOpts := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, authOptPrefix) {
+			option := strings.TrimPrefix(line, authOptPrefix)
+			key, value := option, ""
+			if i := strings.IndexAny(option, " \t"); i >= 0 {
+				key, value = option[:i], strings.TrimSpace(option[i:])
+			}
+			authOpts[key] = value
+			continue
+		}
+
+		// Other mosquitto.conf lines, such as listener 1883, have no =.
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 && !strings.ContainsAny(strings.TrimSpace(kv[0]), " \t") {
+			authOpts[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return authOpts, nil
+}
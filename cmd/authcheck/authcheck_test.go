@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//runAuthcheck runs authcheck with the arguments, returning its exit code, stdout and stderr.
+func runAuthcheck(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestAuthcheck(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "authcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pwPath, _ := filepath.Abs("../../test-files/passwords")
+	aclPath, _ := filepath.Abs("../../test-files/acls")
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	mosquittoConf := write("mosquitto.conf", `# Broker
+listener 1883
+auth_plugin /etc/mosquitto/go-auth.so
+auth_opt_backends files
+auth_opt_password_path `+pwPath+`
+auth_opt_acl_path	`+aclPath+`
+auth_opt_log_level error
+auth_opt_log_dest file
+auth_opt_log_file `+filepath.Join(dir, "missing", "mosquitto.log")+`
+`)
+
+	Convey("Given a mosquitto.conf, its auth options should be read and others ignored", t, func() {
+		authOpts, err := readOptions(mosquittoConf)
+		So(err, ShouldBeNil)
+		So(authOpts, ShouldResemble, map[string]string{
+			"backends":      "files",
+			"password_path": pwPath,
+			"acl_path":      aclPath,
+			"log_level":     "error",
+			"log_dest":      "file",
+			"log_file":      filepath.Join(dir, "missing", "mosquitto.log"),
+		})
+
+		authOpts, err = readOptions(write("auth.conf", "backends = files\n\n# comment\npassword_path="+pwPath+"\n"))
+		So(err, ShouldBeNil)
+		So(authOpts, ShouldResemble, map[string]string{"backends": "files", "password_path": pwPath})
+	})
+
+	Convey("Given a valid configuration, checks should tell the backends' results", t, func() {
+		code, stdout, _ := runAuthcheck("-c", mosquittoConf, "-user", "test1", "-password", "test1", "-topic", "test/topic/1", "-acc", "2")
+		So(code, ShouldEqual, 0)
+		So(stdout, ShouldContainSubstring, "backend files: ok\n")
+		So(stdout, ShouldContainSubstring, "user test1: granted\n  files: allow in ")
+		So(stdout, ShouldContainSubstring, "acl test1 test/topic/1 2: granted\n  files: allow in ")
+
+		//Without checks, the configuration is only started.
+		code, stdout, _ = runAuthcheck("-c", mosquittoConf)
+		So(code, ShouldEqual, 0)
+		So(stdout, ShouldEqual, "backend files: ok\n")
+	})
+
+	Convey("Given denied checks, authcheck should fail", t, func() {
+		code, stdout, _ := runAuthcheck("-c", mosquittoConf, "-user", "test1", "-password", "wrong")
+		So(code, ShouldEqual, 1)
+		So(stdout, ShouldContainSubstring, "user test1: denied\n  files: deny in ")
+
+		code, stdout, _ = runAuthcheck("-c", mosquittoConf, "-user", "test1", "-topic", "test/topic/1", "-acc", "1")
+		So(code, ShouldEqual, 1)
+		So(stdout, ShouldContainSubstring, "acl test1 test/topic/1 1: denied")
+	})
+
+	Convey("Given a wrong configuration, authcheck should fail telling why", t, func() {
+		code, stdout, _ := runAuthcheck("-c", write("wrong.conf", "auth_opt_backends files, nosuch\n"))
+		So(code, ShouldEqual, 1)
+		So(stdout, ShouldContainSubstring, "init failed: backends error: backend not allowed: nosuch")
+
+		code, stdout, _ = runAuthcheck("-c", write("strict.conf", "backends=files\npassword_path="+pwPath+"\nstrict_options=true\npasword_path=x\n"))
+		So(code, ShouldEqual, 1)
+		So(stdout, ShouldContainSubstring, "unknown option pasword_path, did you mean password_path?")
+
+		code, _, stderr := runAuthcheck("-c", filepath.Join(dir, "nosuch.conf"))
+		So(code, ShouldEqual, 1)
+		So(stderr, ShouldContainSubstring, "nosuch.conf")
+	})
+
+	Convey("Given wrong flags, authcheck should fail without checking", t, func() {
+		for _, args := range [][]string{
+			{},
+			{"-c", mosquittoConf, "-password", "test1"},
+			{"-c", mosquittoConf, "-topic", "test/topic/1"},
+			{"-c", mosquittoConf, "extra"},
+			{"-nosuch"},
+		} {
+			code, stdout, _ := runAuthcheck(args...)
+			So(code, ShouldEqual, 2)
+			So(stdout, ShouldBeEmpty)
+		}
+	})
+
+}
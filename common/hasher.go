@@ -0,0 +1,271 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Salt encodings of PBKDF2 hashes, which their format doesn't tell.
+const (
+	// SaltEncodingBase64 is the encoding of salts stored by the pw utility.
+	SaltEncodingBase64 = "base64"
+	// SaltEncodingUTF8 takes the salt as stored, as mosquitto-auth-plug does.
+	SaltEncodingUTF8 = "utf-8"
+)
+
+// Hasher generates password hashes in a format with the given parameters,
+// and verifies them with the parameters stored in each hash. Formats whose
+// hashes don't tell every parameter, as the salt encoding of PBKDF2 ones,
+// are verified with the hasher's.
+type Hasher struct {
+	Format string
+
+	// Pepper is an application-wide secret combined with passwords before
+	// PBKDF2, argon2id and scrypt hashing, unused when empty.
+	Pepper []byte
+
+	// PBKDF2 parameters. A KeyLen of 0 means the digest's size for PBKDF2,
+	// and 32 bytes for argon2id and scrypt.
+	Algorithm    string
+	Iterations   int
+	SaltSize     int
+	KeyLen       int
+	SaltEncoding string
+
+	// bcrypt parameters.
+	Cost int
+
+	// argon2id parameters, with the memory in KiB.
+	Memory      uint32
+	Time        uint32
+	Parallelism uint8
+
+	// scrypt parameters, with N given as its base 2 logarithm.
+	LogN              int
+	BlockSize         int
+	ScryptParallelism int
+}
+
+// DefaultHasher returns the hasher used when no options are given, which
+// generates PBKDF2 hashes as the pw utility does by default.
+func DefaultHasher() Hasher {
+	return Hasher{
+		Format:            HashPBKDF2,
+		Algorithm:         "sha512",
+		Iterations:        100000,
+		SaltSize:          16,
+		SaltEncoding:      SaltEncodingBase64,
+		Cost:              10,
+		Memory:            65536,
+		Time:              3,
+		Parallelism:       4,
+		LogN:              16,
+		BlockSize:         8,
+		ScryptParallelism: 1,
+	}
+}
+
+// HasherOptions are the auth options NewHasher takes, each of which may also
+// be given for a single backend prefixed by it, e.g. pg_hasher_iterations.
+var HasherOptions = []string{
+	"hasher",
+	"hasher_algorithm",
+	"hasher_iterations",
+	"hasher_salt_size",
+	"hasher_salt_encoding",
+	"hasher_keylen",
+	"hasher_cost",
+	"hasher_memory",
+	"hasher_time",
+	"hasher_parallelism",
+	"hasher_ln",
+	"hasher_block_size",
+	"hasher_scrypt_parallelism",
+	"hasher_pepper",
+	"hasher_pepper_file",
+}
+
+// PrefixedHasherOptions returns the hasher options given for the backend with
+// the prefix, as NewHasher takes them.
+func PrefixedHasherOptions(prefix string) []string {
+	options := make([]string, len(HasherOptions))
+	for i, option := range HasherOptions {
+		options[i] = prefix + "_" + option
+	}
+	return options
+}
+
+// NewHasher reads the hasher options, e.g. hasher and hasher_iterations,
+// with the ones given for the backend with the prefix, e.g. pg_hasher and
+// pg_hasher_iterations, taking precedence. Unset ones keep their defaults, as
+// invalid numbers do, warned about as every other option.
+// The pepper is given with hasher_pepper, which backends read from the file
+// hasher_pepper_file gives, as every secret option, before calling it.
+func NewHasher(authOpts map[string]string, prefix string) (Hasher, error) {
+	h := DefaultHasher()
+
+	opt := func(name string) (string, bool) {
+		if value, ok := authOpts[prefix+"_"+name]; ok {
+			return value, true
+		}
+		value, ok := authOpts[name]
+		return value, ok
+	}
+
+	number := func(name string, min, max, def int) int {
+		key := name
+		if _, ok := authOpts[prefix+"_"+name]; ok {
+			key = prefix + "_" + name
+		}
+		return IntOption(authOpts, key, min, max, def)
+	}
+
+	if format, ok := opt("hasher"); ok {
+		switch format {
+		case HashPBKDF2, HashBcrypt, HashArgon2id, HashScrypt:
+			h.Format = format
+		default:
+			return h, errors.Errorf("unknown hasher %s, it must be pbkdf2, bcrypt, argon2id or scrypt", format)
+		}
+	}
+
+	if algorithm, ok := opt("hasher_algorithm"); ok {
+		if algorithm != "sha512" && algorithm != "sha256" {
+			return h, errors.Errorf("unknown hasher_algorithm %s, it must be sha512 or sha256", algorithm)
+		}
+		h.Algorithm = algorithm
+	}
+
+	if encoding, ok := opt("hasher_salt_encoding"); ok {
+		if encoding != SaltEncodingBase64 && encoding != SaltEncodingUTF8 {
+			return h, errors.Errorf("unknown hasher_salt_encoding %s, it must be base64 or utf-8", encoding)
+		}
+		h.SaltEncoding = encoding
+	}
+
+	if pepper, ok := opt("hasher_pepper"); ok {
+		if pepper == "" {
+			return h, errors.New("hasher_pepper is empty")
+		}
+		h.Pepper = []byte(pepper)
+	}
+
+	if len(h.Pepper) > 0 && h.Format == HashBcrypt {
+		return h, errors.New("a pepper can't be used with the bcrypt hasher, bcrypt hashes are never peppered")
+	}
+
+	h.Iterations = number("hasher_iterations", 1, pbkdf2MaxIterations, h.Iterations)
+	h.SaltSize = number("hasher_salt_size", 8, 1024, h.SaltSize)
+	h.KeyLen = number("hasher_keylen", 4, pbkdf2MaxKeyLen, h.KeyLen)
+	h.Cost = number("hasher_cost", 4, 31, h.Cost)
+	h.Memory = uint32(number("hasher_memory", 8, argon2idMaxMemory, int(h.Memory)))
+	h.Time = uint32(number("hasher_time", 1, argon2idMaxWork/8, int(h.Time)))
+	h.Parallelism = uint8(number("hasher_parallelism", 1, argon2idMaxParallelism, int(h.Parallelism)))
+	h.LogN = number("hasher_ln", 1, scryptMaxLn, h.LogN)
+	h.BlockSize = number("hasher_block_size", 1, scryptMaxMemory>>8, h.BlockSize)
+	h.ScryptParallelism = number("hasher_scrypt_parallelism", 1, scryptMaxParallelism, h.ScryptParallelism)
+
+	if h.Format == HashPBKDF2 {
+		if err := pbkdf2CheckParams(h.Iterations, h.KeyLen, h.Algorithm); err != nil {
+			return h, err
+		}
+	}
+
+	if h.Format == HashArgon2id {
+		if err := argon2idCheckParams(h.Memory, h.Time, int(h.Parallelism)); err != nil {
+			return h, err
+		}
+	}
+
+	if h.Format == HashScrypt {
+		if err := scryptCheckParams(h.LogN, h.BlockSize, h.ScryptParallelism); err != nil {
+			return h, err
+		}
+	}
+
+	return h, nil
+}
+
+// ReadPepper reads a pepper from the file at path, without the line break
+// ending it if any.
+func ReadPepper(path string) ([]byte, error) {
+	pepper, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read pepper file %s: %s", path, err)
+	}
+	pepper = []byte(strings.TrimRight(string(pepper), "\r\n"))
+	if len(pepper) == 0 {
+		return nil, errors.Errorf("pepper file %s is empty", path)
+	}
+	return pepper, nil
+}
+
+// pepper combines the password with the pepper as their HMAC-SHA256, which
+// is hashed in its place. The password is returned as it is without pepper.
+func (h Hasher) pepper(password string) string {
+	if len(h.Pepper) == 0 {
+		return password
+	}
+	mac := hmac.New(sha256.New, h.Pepper)
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+// Hash generates the hash of a password in the hasher's format, peppered
+// unless it's a bcrypt one, which can't be generated with a pepper.
+func (h Hasher) Hash(password string) (string, error) {
+	switch h.Format {
+	case HashBcrypt:
+		if len(h.Pepper) > 0 {
+			return "", errors.New("bcrypt hashes can't be peppered")
+		}
+		return BcryptHash(password, h.Cost)
+	case HashArgon2id:
+		keyLen := uint32(h.KeyLen)
+		if keyLen == 0 {
+			keyLen = 32
+		}
+		return Argon2idHash(h.pepper(password), h.SaltSize, h.Memory, h.Time, h.Parallelism, keyLen)
+	case HashScrypt:
+		keyLen := h.KeyLen
+		if keyLen == 0 {
+			keyLen = 32
+		}
+		return ScryptHash(h.pepper(password), h.SaltSize, h.LogN, h.BlockSize, h.ScryptParallelism, keyLen)
+	}
+
+	if err := pbkdf2CheckParams(h.Iterations, h.KeyLen, h.Algorithm); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, h.SaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "read random bytes error")
+	}
+
+	// Salts stored as they are can't have $, so they're made of base64
+	// characters.
+	if h.SaltEncoding == SaltEncodingUTF8 {
+		salt = []byte(base64.RawStdEncoding.EncodeToString(salt)[:h.SaltSize])
+	}
+
+	return hashWithSalt(h.pepper(password), salt, h.SaltEncoding, h.Iterations, h.KeyLen, h.Algorithm), nil
+}
+
+// Compare verifies the password against a hash of any known format, as
+// HashCompare does, with PBKDF2 salts taken in the hasher's encoding. The
+// password is peppered for PBKDF2 and argon2id hashes, but not for bcrypt
+// ones, as its HMAC could hold NUL bytes other bcrypt implementations stop at.
+func (h Hasher) Compare(password, passwordHash string) bool {
+	if HashFormat(passwordHash) != HashBcrypt {
+		password = h.pepper(password)
+	}
+	return hashCompare(password, passwordHash, h.SaltEncoding)
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseBool parses a boolean option's value, which may be true, 1, yes or on,
+// or false, 0, no or off, in any case and with surrounding spaces.
+func ParseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "t", "1", "yes", "y", "on":
+		return true, nil
+	case "false", "f", "0", "no", "n", "off":
+		return false, nil
+	}
+	return false, errors.Errorf("invalid boolean %s, it must be true or false", value)
+}
+
+// ParseInt parses an integer option's value, which must be between min and
+// max, both included.
+func ParseInt(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < min || n > max {
+		return 0, errors.Errorf("invalid number %s, it must be between %d and %d", value, min, max)
+	}
+	return n, nil
+}
+
+// ParseDuration parses a duration option's value, given either as a Go
+// duration, e.g. 30s or 5m, or, as options always took them, as an integer
+// number of the option's unit, e.g. seconds for *_seconds ones. It must be
+// at least min.
+func ParseDuration(value string, unit, min time.Duration) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	var d time.Duration
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		d = time.Duration(n) * unit
+	} else if d, err = time.ParseDuration(value); err != nil {
+		return 0, errors.Errorf("invalid duration %s, it must be e.g. 30s, 5m or a number of %s", value, unitName(unit))
+	}
+
+	if d < min {
+		return 0, errors.Errorf("invalid duration %s, it must be at least %s", value, min)
+	}
+	return d, nil
+}
+
+// unitName names the unit of integer durations.
+func unitName(unit time.Duration) string {
+	switch unit {
+	case time.Millisecond:
+		return "milliseconds"
+	case time.Second:
+		return "seconds"
+	case time.Minute:
+		return "minutes"
+	}
+	return unit.String()
+}
+
+// BoolOption returns the boolean option key, or def when it's unset or
+// invalid, warning about the latter.
+func BoolOption(authOpts map[string]string, key string, def bool) bool {
+	value, ok := authOpts[key]
+	if !ok {
+		return def
+	}
+	b, err := ParseBool(value)
+	if err != nil {
+		log.Warnf("%s: %s, defaulting to %t", key, err, def)
+		return def
+	}
+	return b
+}
+
+// IntOption returns the integer option key, or def when it's unset or
+// invalid, warning about the latter.
+func IntOption(authOpts map[string]string, key string, min, max, def int) int {
+	value, ok := authOpts[key]
+	if !ok {
+		return def
+	}
+	n, err := ParseInt(value, min, max)
+	if err != nil {
+		log.Warnf("%s: %s, defaulting to %d", key, err, def)
+		return def
+	}
+	return n
+}
+
+// DurationOption returns the duration option key, or def when it's unset or
+// invalid, warning about the latter. See ParseDuration.
+func DurationOption(authOpts map[string]string, key string, unit, min, def time.Duration) time.Duration {
+	value, ok := authOpts[key]
+	if !ok {
+		return def
+	}
+	d, err := ParseDuration(value, unit, min)
+	if err != nil {
+		log.Warnf("%s: %s, defaulting to %s", key, err, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseBool(t *testing.T) {
+
+	Convey("Given boolean values, they should be parsed or rejected", t, func() {
+		for _, c := range []struct {
+			value string
+			b     bool
+			ok    bool
+		}{
+			{"true", true, true},
+			{"True", true, true},
+			{" TRUE ", true, true},
+			{"1", true, true},
+			{"yes", true, true},
+			{"on", true, true},
+			{"false", false, true},
+			{"False", false, true},
+			{"0", false, true},
+			{"no", false, true},
+			{"off", false, true},
+			{"", false, false},
+			{"2", false, false},
+			{"enabled", false, false},
+		} {
+			b, err := ParseBool(c.value)
+			So(err == nil, ShouldEqual, c.ok)
+			So(b, ShouldEqual, c.b)
+		}
+	})
+
+	Convey("Given boolean options, invalid ones should default", t, func() {
+		authOpts := map[string]string{"a": "Yes", "b": "nope"}
+		So(BoolOption(authOpts, "a", false), ShouldBeTrue)
+		So(BoolOption(authOpts, "b", true), ShouldBeTrue)
+		So(BoolOption(authOpts, "b", false), ShouldBeFalse)
+		So(BoolOption(authOpts, "c", true), ShouldBeTrue)
+	})
+
+}
+
+func TestParseInt(t *testing.T) {
+
+	Convey("Given integer values, they should be parsed within bounds or rejected", t, func() {
+		for _, c := range []struct {
+			value    string
+			min, max int
+			n        int
+			ok       bool
+		}{
+			{"10", 0, 100, 10, true},
+			{" 0 ", 0, 100, 0, true},
+			{"100", 0, 100, 100, true},
+			{"-1", 0, 100, 0, false},
+			{"101", 0, 100, 0, false},
+			{"0", 1, 100, 0, false},
+			{"1.5", 0, 100, 0, false},
+			{"ten", 0, 100, 0, false},
+		} {
+			n, err := ParseInt(c.value, c.min, c.max)
+			So(err == nil, ShouldEqual, c.ok)
+			So(n, ShouldEqual, c.n)
+		}
+
+		_, err := ParseInt("101", 0, 100)
+		So(err.Error(), ShouldEqual, "invalid number 101, it must be between 0 and 100")
+	})
+
+	Convey("Given integer options, invalid ones should default", t, func() {
+		authOpts := map[string]string{"a": "5", "b": "-5"}
+		So(IntOption(authOpts, "a", 0, 10, 1), ShouldEqual, 5)
+		So(IntOption(authOpts, "b", 0, 10, 1), ShouldEqual, 1)
+		So(IntOption(authOpts, "c", 0, 10, 1), ShouldEqual, 1)
+	})
+
+}
+
+func TestParseDuration(t *testing.T) {
+
+	Convey("Given duration values, integers should be taken in the unit and Go durations as they are", t, func() {
+		for _, c := range []struct {
+			value string
+			unit  time.Duration
+			min   time.Duration
+			d     time.Duration
+			ok    bool
+		}{
+			{"30", time.Second, 0, 30 * time.Second, true},
+			{"30", time.Millisecond, 0, 30 * time.Millisecond, true},
+			{" 30s ", time.Second, 0, 30 * time.Second, true},
+			{"5m", time.Second, 0, 5 * time.Minute, true},
+			{"1h30m", time.Second, 0, 90 * time.Minute, true},
+			{"250ms", time.Second, 0, 250 * time.Millisecond, true},
+			{"0", time.Second, 0, 0, true},
+			{"0", time.Second, time.Second, 0, false},
+			{"500ms", time.Second, time.Second, 0, false},
+			{"-1", time.Second, 0, 0, false},
+			{"30 seconds", time.Second, 0, 0, false},
+			{"", time.Second, 0, 0, false},
+		} {
+			d, err := ParseDuration(c.value, c.unit, c.min)
+			So(err == nil, ShouldEqual, c.ok)
+			So(d, ShouldEqual, c.d)
+		}
+
+		_, err := ParseDuration("soon", time.Millisecond, 0)
+		So(err.Error(), ShouldEqual, "invalid duration soon, it must be e.g. 30s, 5m or a number of milliseconds")
+	})
+
+	Convey("Given duration options, invalid ones should default", t, func() {
+		authOpts := map[string]string{"a": "2m", "b": "2 minutes"}
+		So(DurationOption(authOpts, "a", time.Second, 0, time.Minute), ShouldEqual, 2*time.Minute)
+		So(DurationOption(authOpts, "b", time.Second, 0, time.Minute), ShouldEqual, time.Minute)
+		So(DurationOption(authOpts, "c", time.Second, 0, time.Minute), ShouldEqual, time.Minute)
+	})
+
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Redacted is logged in place of a secret.
+const Redacted = "[redacted]"
+
+// redactedURLValue is put in place of secrets in urls, as Go's url.Redacted
+// does, so they aren't escaped.
+const redactedURLValue = "xxxxx"
+
+// secretOptionSuffixes tell the auth options whose value is a secret.
+// Options ending with _file hold a path to the secret and are kept.
+var secretOptionSuffixes = []string{"_password", "_token", "_secret", "_pepper"}
+
+// secretOptions are the auth options whose value may carry secrets, such as
+// hashes or authorization headers, though their name doesn't tell.
+var secretOptions = map[string]bool{
+	"static_users":      true,
+	"http_headers":      true,
+	"http_extra_params": true,
+	"grpc_metadata":     true,
+}
+
+// Redact returns what's logged in place of the secret, which is empty only
+// when the secret is, so an unset one may still be told apart.
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// RedactUsername returns the username as it's logged, which is the username
+// itself unless it looks like a JWT, as the JWT backend takes tokens as
+// usernames. A token is replaced by a short fingerprint of it, so lines about
+// the same one may still be told apart.
+func RedactUsername(username string) string {
+	if !looksLikeJWT(username) {
+		return username
+	}
+	return RedactToken(username)
+}
+
+// RedactToken returns the token as it's logged, which is always a short
+// fingerprint of it, whether it looks like a JWT or not, so lines about the
+// same one may still be told apart.
+func RedactToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("[redacted jwt %x]", sum[:4])
+}
+
+// looksLikeJWT tells if s is made of the base64url encoded parts of a JWS or
+// JWE, whose header is a JSON object, so it starts with eyJ.
+func looksLikeJWT(s string) bool {
+	if !strings.HasPrefix(s, "eyJ") {
+		return false
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 && len(parts) != 5 {
+		return false
+	}
+	for _, r := range s {
+		isBase64URL := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_'
+		if !isBase64URL && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// RedactURL returns the url with the password of its user info and the
+// values of its query string redacted, or the placeholder when it can't be
+// parsed, as it's unknown what it holds.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Redacted
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedURLValue)
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redactedURLValue}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// RedactURLError returns the error with its url redacted when it's a
+// *url.Error, as returned by http clients and url parsing, since the url may
+// carry credentials in its user info or query string. Other errors are
+// returned as they are.
+func RedactURLError(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	return &url.Error{Op: urlErr.Op, URL: RedactURL(urlErr.URL), Err: urlErr.Err}
+}
+
+// IsSecretOption tells if the auth option's value is a secret, or may carry
+// them, so it mustn't be logged.
+func IsSecretOption(key string) bool {
+	key = strings.ToLower(key)
+	if secretOptions[key] {
+		return true
+	}
+	for _, suffix := range secretOptionSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactOptions formats the auth options as sorted key=value pairs to be
+// logged, redacting secret values and the credentials of urls.
+func RedactOptions(authOpts map[string]string) string {
+	keys := make([]string, 0, len(authOpts))
+	for key := range authOpts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := authOpts[key]
+		switch {
+		case IsSecretOption(key):
+			value = Redact(value)
+		case strings.HasSuffix(key, "_uri") || strings.HasSuffix(key, "_url"):
+			value = RedactURL(value)
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+	return strings.Join(pairs, " ")
+}
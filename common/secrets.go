@@ -0,0 +1,64 @@
+package common
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretFileSuffix ends the auth option giving the path of a file that holds
+// the value of a secret option, e.g. pg_password_file for pg_password, as
+// secrets are mounted as files by e.g. Kubernetes.
+const SecretFileSuffix = "_file"
+
+// SecretFileOption returns the secret option whose value the file the option
+// gives holds, and whether the option gives one.
+func SecretFileOption(key string) (string, bool) {
+	if !strings.HasSuffix(key, SecretFileSuffix) {
+		return "", false
+	}
+	secret := strings.TrimSuffix(key, SecretFileSuffix)
+	return secret, IsSecretOption(secret)
+}
+
+// ReadSecretFile reads a secret from the file at path, without the line
+// break ending it.
+func ReadSecretFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// ReadSecretFiles returns a copy of the auth options where every secret
+// option takes tells it takes is read from the file its _file variant gives,
+// which takes precedence over the option given inline and is removed.
+// Files given for secret options it doesn't take are kept unread, so they
+// can't fail it. An unreadable file fails it, naming the option giving it.
+func ReadSecretFiles(authOpts map[string]string, takes func(key string) bool) (map[string]string, error) {
+	keys := make([]string, 0, len(authOpts))
+	opts := make(map[string]string, len(authOpts))
+	for key, value := range authOpts {
+		keys = append(keys, key)
+		opts[key] = value
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		secret, ok := SecretFileOption(key)
+		if !ok || !takes(secret) {
+			continue
+		}
+		value, err := ReadSecretFile(authOpts[key])
+		if err != nil {
+			return nil, errors.Errorf("couldn't read %s: %s", key, err)
+		}
+		opts[secret] = value
+		delete(opts, key)
+	}
+
+	return opts, nil
+}
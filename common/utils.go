@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"strconv"
@@ -14,7 +15,10 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -23,26 +27,76 @@ import (
 // database is up.
 // Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
 func OpenDatabase(dsn, engine string) (*sqlx.DB, error) {
+	return ConnectDatabase(dsn, engine, 0, 2*time.Second)
+}
+
+// ConnectDatabase opens the database and pings it up to tries times, or
+// forever when tries is 0, waiting retry between attempts. When every try
+// failed, the opened DB is returned along with the error so that it may
+// still be used once the database is up.
+func ConnectDatabase(dsn, engine string, tries int, retry time.Duration) (*sqlx.DB, error) {
 
 	db, err := sqlx.Open(engine, dsn)
 	if err != nil {
 		return nil, errors.Wrap(err, "database connection error")
 	}
 
-	for {
-		if err = db.Ping(); err != nil {
-			log.Errorf("ping database error, will retry in 2s: %s", err)
-			time.Sleep(2 * time.Second)
-		} else {
+	for try := 1; ; try++ {
+		if err = db.Ping(); err == nil {
 			break
 		}
+		if tries > 0 && try >= tries {
+			return db, errors.Wrapf(err, "ping database error after %d tries", try)
+		}
+		log.Errorf("ping database error, will retry in %s: %s", retry, err)
+		time.Sleep(retry)
 	}
 
 	return db, nil
 }
 
+// TopicsMatch tells if the given topic matches the saved one, which may have
+// MQTT wildcards. Shared subscriptions ($share/<group>/<topic>) are matched by
+// their topic, unless the saved one is a shared subscription itself, and, as
+// MQTT requires, wildcards at the first level don't match $ topics (e.g. $SYS).
 func TopicsMatch(savedTopic, givenTopic string) bool {
-	return givenTopic == savedTopic || match(strings.Split(savedTopic, "/"), strings.Split(givenTopic, "/"))
+	if givenTopic == savedTopic {
+		return true
+	}
+
+	if strings.HasPrefix(givenTopic, "$share/") && !strings.HasPrefix(savedTopic, "$share/") {
+		parts := strings.SplitN(givenTopic, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		givenTopic = parts[2]
+	}
+
+	route := strings.Split(savedTopic, "/")
+	if strings.HasPrefix(givenTopic, "$") && (route[0] == "+" || route[0] == "#") {
+		return false
+	}
+
+	return match(route, strings.Split(givenTopic, "/"))
+}
+
+// AclMatches tells if the given topic matches the saved acl, replacing %u and
+// %c in it by the username and client id. As in mosquitto, an acl using them
+// never matches when they hold wildcards or levels, which would widen it.
+// Both are replaced in a single pass, so a username holding %c, or a client
+// id holding %u, is never expanded in turn.
+func AclMatches(acl, topic, username, clientid string) bool {
+	if strings.Contains(acl, "%u") && strings.ContainsAny(username, "+#/") {
+		return false
+	}
+
+	if strings.Contains(acl, "%c") && strings.ContainsAny(clientid, "+#/") {
+		return false
+	}
+
+	acl = strings.NewReplacer("%u", username, "%c", clientid).Replace(acl)
+
+	return TopicsMatch(acl, topic)
 }
 
 func match(route []string, topic []string) bool {
@@ -81,6 +135,10 @@ func match(route []string, topic []string) bool {
 // the default criteria here.
 // Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
 func Hash(password string, saltSize int, iterations int, algorithm string) (string, error) {
+	if err := pbkdf2CheckParams(iterations, 0, algorithm); err != nil {
+		return "", err
+	}
+
 	// Generate a random salt value, 128 bits.
 	salt := make([]byte, saltSize)
 	_, err := rand.Read(salt)
@@ -88,22 +146,19 @@ func Hash(password string, saltSize int, iterations int, algorithm string) (stri
 		return "", errors.Wrap(err, "read random bytes error")
 	}
 
-	return hashWithSalt(password, salt, iterations, algorithm), nil
+	return hashWithSalt(password, salt, SaltEncodingBase64, iterations, 0, algorithm), nil
 }
 
+// hashWithSalt returns the PBKDF2 hash of the password, with the salt stored
+// in the given encoding and a key of keyLen bytes, or of the digest's size
+// when 0.
 // Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
-func hashWithSalt(password string, salt []byte, iterations int, algorithm string) string {
+func hashWithSalt(password string, salt []byte, saltEncoding string, iterations, keyLen int, algorithm string) string {
 	// Generate the hash.  This should be a little painful, adjust ITERATIONS
 	// if it needs performance tweeking.  Greatly depends on the hardware.
 	// NOTE: We store these details with the returned hash, so changes will not
 	// affect our ability to do password compares.
-	shaSize := sha512.Size
-	shaHash := sha512.New
-	if algorithm == "sha256" {
-		shaSize = sha256.Size
-		shaHash = sha256.New
-	}
-	hash := pbkdf2.Key([]byte(password), salt, iterations, shaSize, shaHash)
+	hash := pbkdf2Key(password, salt, iterations, keyLen, algorithm)
 
 	// Build up the parameters and hash into a single string so we can compare
 	// other string to the same hash.  Note that the hash algorithm is hard-
@@ -115,25 +170,353 @@ func hashWithSalt(password string, salt []byte, iterations int, algorithm string
 	buffer.WriteString(fmt.Sprintf("%s$", algorithm))
 	buffer.WriteString(strconv.Itoa(iterations))
 	buffer.WriteString("$")
-	buffer.WriteString(base64.StdEncoding.EncodeToString(salt))
+	if saltEncoding == SaltEncodingUTF8 {
+		buffer.Write(salt)
+	} else {
+		buffer.WriteString(base64.StdEncoding.EncodeToString(salt))
+	}
 	buffer.WriteString("$")
 	buffer.WriteString(base64.StdEncoding.EncodeToString(hash))
 
 	return buffer.String()
 }
 
+// Limits of the PBKDF2 parameters, so a malformed or hostile hash can't
+// make a check take most of the CPU time: the key length is in bytes, and
+// the iterations are run for each digest sized block of the key, so longer
+// keys allow fewer of them.
+const (
+	pbkdf2MaxIterations = 1 << 23
+	pbkdf2MaxKeyLen     = 1024
+)
+
+// pbkdf2CheckParams tells if the PBKDF2 parameters are within the limits,
+// with a key of the digest's size when keyLen is 0.
+func pbkdf2CheckParams(iterations, keyLen int, algorithm string) error {
+	shaSize := sha512.Size
+	if algorithm == "sha256" {
+		shaSize = sha256.Size
+	}
+	if keyLen == 0 {
+		keyLen = shaSize
+	}
+	blocks := (keyLen + shaSize - 1) / shaSize
+
+	switch {
+	case keyLen < 1 || keyLen > pbkdf2MaxKeyLen:
+		return errors.Errorf("PBKDF2 key must be between 1 and %d bytes, got %d", pbkdf2MaxKeyLen, keyLen)
+	case iterations < 1 || iterations > pbkdf2MaxIterations/blocks:
+		return errors.Errorf("PBKDF2 iterations must be at least 1 and at most %d with a %d bytes %s key, got %d", pbkdf2MaxIterations/blocks, keyLen, algorithm, iterations)
+	}
+	return nil
+}
+
+// pbkdf2Key derives a key of keyLen bytes from the password with PBKDF2 and
+// the given digest, sha256 or sha512 otherwise, with a key of the digest's
+// size when keyLen is 0.
+func pbkdf2Key(password string, salt []byte, iterations, keyLen int, algorithm string) []byte {
+	shaSize := sha512.Size
+	shaHash := sha512.New
+	if algorithm == "sha256" {
+		shaSize = sha256.Size
+		shaHash = sha256.New
+	}
+	if keyLen == 0 {
+		keyLen = shaSize
+	}
+	return pbkdf2.Key([]byte(password), salt, iterations, keyLen, shaHash)
+}
+
+// Limits of the argon2id parameters, so a malformed or hostile hash can't
+// make a check take most of the memory or CPU time: memory is in KiB, and the
+// time a check takes grows with the memory times the passes over it.
+const (
+	argon2idMaxMemory      = 1 << 20
+	argon2idMaxWork        = 1 << 22
+	argon2idMaxParallelism = 64
+)
+
+// Argon2idHash generates the argon2id hash of a password for storage in the
+// database, as a PHC string with a random salt of saltSize bytes, e.g.
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash. Memory is given in KiB, passes
+// is the time cost, threads the parallelism and keyLen the length of the
+// hash in bytes.
+func Argon2idHash(password string, saltSize int, memory, passes uint32, threads uint8, keyLen uint32) (string, error) {
+	switch {
+	case saltSize < 8:
+		return "", errors.Errorf("argon2id salt must be at least 8 bytes, got %d", saltSize)
+	case keyLen < 4:
+		return "", errors.Errorf("argon2id key must be at least 4 bytes, got %d", keyLen)
+	}
+	if err := argon2idCheckParams(memory, passes, int(threads)); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "read random bytes error")
+	}
+
+	return argon2idWithSalt(password, salt, memory, passes, threads, keyLen), nil
+}
+
+// argon2idCheckParams tells if the argon2id parameters are within the limits.
+// The memory must be at least 8 KiB per thread, as argon2 would silently raise
+// it otherwise.
+func argon2idCheckParams(memory, passes uint32, threads int) error {
+	switch {
+	case threads < 1 || threads > argon2idMaxParallelism:
+		return errors.Errorf("argon2id parallelism must be between 1 and %d, got %d", argon2idMaxParallelism, threads)
+	case memory < 8*uint32(threads) || memory > argon2idMaxMemory:
+		return errors.Errorf("argon2id memory must be between 8 KiB per thread, %d KiB for %d threads, and %d KiB, got %d", 8*threads, threads, argon2idMaxMemory, memory)
+	case passes < 1 || passes > argon2idMaxWork/memory:
+		return errors.Errorf("argon2id time must be at least 1 and at most %d with %d KiB of memory, got %d", argon2idMaxWork/memory, memory, passes)
+	}
+	return nil
+}
+
+// argon2idWithSalt returns the argon2id hash of the password with the given
+// salt and parameters as a PHC string, with the salt and hash in unpadded
+// base64.
+func argon2idWithSalt(password string, salt []byte, memory, passes uint32, threads uint8, keyLen uint32) string {
+	hash := argon2.IDKey([]byte(password), salt, passes, memory, threads, keyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, passes, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+// BcryptHash generates the bcrypt hash of a password for storage in the
+// database with the given cost, which must be between 4 and 31. Passwords
+// longer than 72 bytes are rejected, as bcrypt would ignore the rest.
+func BcryptHash(password string, cost int) (string, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return "", errors.Errorf("bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, cost)
+	}
+	if len(password) > 72 {
+		return "", errors.Errorf("bcrypt passwords must be at most 72 bytes, got %d", len(password))
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", errors.Wrap(err, "bcrypt error")
+	}
+
+	return string(hash), nil
+}
+
+// Limits of the scrypt parameters, so a malformed or hostile hash can't make
+// a check take most of the memory or CPU time: N is 2^ln, the memory it takes
+// 128*r*N bytes, and the time it takes grows with p too.
+const (
+	scryptMaxLn          = 30
+	scryptMaxMemory      = 1 << 30
+	scryptMaxParallelism = 16
+)
+
+// ScryptHash generates the scrypt hash of a password for storage in the
+// database, as $scrypt$ln=16,r=8,p=1$salt$hash with a random salt of saltSize
+// bytes, where N is 2^ln, and the salt and hash are in passlib's base64,
+// which is unpadded and has . in place of +. The hash is keyLen bytes long.
+func ScryptHash(password string, saltSize, ln, r, p, keyLen int) (string, error) {
+	switch {
+	case saltSize < 8:
+		return "", errors.Errorf("scrypt salt must be at least 8 bytes, got %d", saltSize)
+	case keyLen < 4:
+		return "", errors.Errorf("scrypt key must be at least 4 bytes, got %d", keyLen)
+	}
+	if err := scryptCheckParams(ln, r, p); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "read random bytes error")
+	}
+
+	hash, err := scrypt.Key([]byte(password), salt, 1<<uint(ln), r, p, keyLen)
+	if err != nil {
+		return "", errors.Wrap(err, "scrypt error")
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", ln, r, p, scryptEncode(salt), scryptEncode(hash)), nil
+}
+
+// scryptCheckParams tells if the scrypt parameters are within the limits.
+func scryptCheckParams(ln, r, p int) error {
+	switch {
+	case ln < 1 || ln > scryptMaxLn:
+		return errors.Errorf("scrypt ln must be between 1 and %d, got %d", scryptMaxLn, ln)
+	case r < 1 || r > scryptMaxMemory>>7>>uint(ln):
+		return errors.Errorf("scrypt r must be at least 1 and take at most %d bytes of memory with ln %d, got %d", scryptMaxMemory, ln, r)
+	case p < 1 || p > scryptMaxParallelism:
+		return errors.Errorf("scrypt p must be between 1 and %d, got %d", scryptMaxParallelism, p)
+	}
+	return nil
+}
+
+// scryptEncode encodes the salt or hash of a scrypt hash as passlib does.
+func scryptEncode(data []byte) string {
+	return strings.Replace(base64.RawStdEncoding.EncodeToString(data), "+", ".", -1)
+}
+
+// scryptDecode decodes the salt or hash of a scrypt hash, taking + and
+// padding too, as some tools write them.
+func scryptDecode(encoded string) ([]byte, error) {
+	encoded = strings.TrimRight(strings.Replace(encoded, ".", "+", -1), "=")
+	return base64.RawStdEncoding.DecodeString(encoded)
+}
+
+// Hash formats told apart by HashFormat.
+const (
+	HashPBKDF2   = "pbkdf2"
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+	HashScrypt   = "scrypt"
+)
+
+// HashFormat tells the format of a stored hash by its prefix: PBKDF2,
+// bcrypt ($2a$, $2b$ or $2y$), argon2id ($argon2id$, as a PHC string) or
+// scrypt ($scrypt$, as passlib stores it).
+// It returns an empty string when the format isn't known, e.g. for a plain
+// text password.
+func HashFormat(passwordHash string) string {
+	switch {
+	case strings.HasPrefix(passwordHash, "PBKDF2$"):
+		return HashPBKDF2
+	case strings.HasPrefix(passwordHash, "$2a$"), strings.HasPrefix(passwordHash, "$2b$"), strings.HasPrefix(passwordHash, "$2y$"):
+		return HashBcrypt
+	case strings.HasPrefix(passwordHash, "$argon2id$"):
+		return HashArgon2id
+	case strings.HasPrefix(passwordHash, "$scrypt$"):
+		return HashScrypt
+	}
+	return ""
+}
+
 // HashCompare verifies that passed password hashes to the same value as the
-// passed passwordHash.
-// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
+// passed passwordHash, whose format is detected by HashFormat, with the
+// parameters stored in it. Hashes of an unknown format or malformed ones never
+// match. PBKDF2 salts are taken as base64, as the pw utility stores them.
 func HashCompare(password string, passwordHash string) bool {
+	return hashCompare(password, passwordHash, SaltEncodingBase64)
+}
+
+// hashCompare verifies the password as HashCompare does, with PBKDF2 salts
+// taken in the given encoding.
+func hashCompare(password string, passwordHash string, saltEncoding string) bool {
+	switch HashFormat(passwordHash) {
+	case HashPBKDF2:
+		return pbkdf2Compare(password, passwordHash, saltEncoding)
+	case HashBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil
+	case HashArgon2id:
+		return argon2idCompare(password, passwordHash)
+	case HashScrypt:
+		return scryptCompare(password, passwordHash)
+	}
+	return false
+}
+
+// pbkdf2Compare verifies a password against a PBKDF2 hash, deriving a key of
+// the stored hash's length so hashes of any key length are verified. Hashes
+// with parameters past the limits never match.
+// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
+func pbkdf2Compare(password string, passwordHash string, saltEncoding string) bool {
 	// SPlit the hash string into its parts.
 	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 5 {
+		return false
+	}
 
 	// Get the iterations and the salt and use them to encode the password
-	// being compared.cre
-	iterations, _ := strconv.Atoi(hashSplit[2])
-	salt, _ := base64.StdEncoding.DecodeString(hashSplit[3])
+	// being compared.
+	iterations, err := strconv.Atoi(hashSplit[2])
+	if err != nil {
+		return false
+	}
+	salt := []byte(hashSplit[3])
+	if saltEncoding != SaltEncodingUTF8 {
+		salt, err = base64.StdEncoding.DecodeString(hashSplit[3])
+		if err != nil {
+			return false
+		}
+	}
+	hash, err := base64.StdEncoding.DecodeString(hashSplit[4])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
 	algorithm := hashSplit[1]
-	newHash := hashWithSalt(password, salt, iterations, algorithm)
-	return newHash == passwordHash
+	if pbkdf2CheckParams(iterations, len(hash), algorithm) != nil {
+		return false
+	}
+	newHash := pbkdf2Key(password, salt, iterations, len(hash), algorithm)
+	return subtle.ConstantTimeCompare(newHash, hash) == 1
+}
+
+// argon2idCompare verifies a password against an argon2id hash given as a
+// PHC string, e.g. $argon2id$v=19$m=65536,t=3,p=4$salt$hash, with the salt
+// and hash in unpadded base64. Hashes with parameters past the limits never
+// match.
+func argon2idCompare(password string, passwordHash string) bool {
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(hashSplit[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, passes uint32
+	var threads int
+	var rest string
+	if n, _ := fmt.Sscanf(hashSplit[3], "m=%d,t=%d,p=%d%s", &memory, &passes, &threads, &rest); n != 3 || argon2idCheckParams(memory, passes, threads) != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(hashSplit[4])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(hashSplit[5])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
+
+	newHash := argon2.IDKey([]byte(password), salt, passes, memory, uint8(threads), uint32(len(hash)))
+	return subtle.ConstantTimeCompare(newHash, hash) == 1
+}
+
+// scryptCompare verifies a password against a scrypt hash given as
+// $scrypt$ln=16,r=8,p=1$salt$hash, with the parameters read from it. Hashes
+// with parameters past the limits never match.
+func scryptCompare(password string, passwordHash string) bool {
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 5 {
+		return false
+	}
+
+	var ln, r, p int
+	var rest string
+	if n, _ := fmt.Sscanf(hashSplit[2], "ln=%d,r=%d,p=%d%s", &ln, &r, &p, &rest); n != 3 || scryptCheckParams(ln, r, p) != nil {
+		return false
+	}
+
+	salt, err := scryptDecode(hashSplit[3])
+	if err != nil {
+		return false
+	}
+	hash, err := scryptDecode(hashSplit[4])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
+
+	newHash, err := scrypt.Key([]byte(password), salt, 1<<uint(ln), r, p, len(hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(newHash, hash) == 1
 }
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAclMatches(t *testing.T) {
+
+	Convey("Given acls with %u and %c, they should be replaced by the username and client id", t, func() {
+		So(AclMatches("dev/%u/#", "dev/alice/temp", "alice", "id"), ShouldBeTrue)
+		So(AclMatches("dev/%c/#", "dev/id/temp", "alice", "id"), ShouldBeTrue)
+		So(AclMatches("dev/%u/%c", "dev/alice/id", "alice", "id"), ShouldBeTrue)
+		So(AclMatches("dev/%u/#", "dev/bob/temp", "alice", "id"), ShouldBeFalse)
+	})
+
+	Convey("Given a username or client id with wildcards or levels, acls using them shouldn't match", t, func() {
+		So(AclMatches("dev/%u/#", "dev/a/b/temp", "a/b", "id"), ShouldBeFalse)
+		So(AclMatches("dev/%u/#", "dev/+/temp", "+", "id"), ShouldBeFalse)
+		So(AclMatches("dev/%c/#", "dev/#", "alice", "#"), ShouldBeFalse)
+	})
+
+	Convey("Given a username holding %c or a client id holding %u, they shouldn't be expanded in turn", t, func() {
+		So(AclMatches("dev/%u/#", "dev/alice/temp", "a%c", "lice"), ShouldBeFalse)
+		So(AclMatches("dev/%u/#", "dev/a%c/temp", "a%c", "lice"), ShouldBeTrue)
+		So(AclMatches("dev/%c/%u", "dev/bob/bob", "bob", "%u"), ShouldBeFalse)
+		So(AclMatches("dev/%c/%u", "dev/%u/bob", "bob", "%u"), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,161 @@
+package goauth
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+//Reasons of an audited denial.
+const (
+	//auditCached is a denial answered by the cache, so no backend was asked.
+	auditCached = "cached"
+	//auditBackendError is a denial where some backend couldn't tell, e.g. it was unhealthy or failed, so it may have granted it.
+	auditBackendError = "backend_error"
+	//auditWrongCredentials is a denied user every backend asked rejected, for a wrong password or as it's unknown.
+	auditWrongCredentials = "wrong_credentials"
+	//auditNoAcl is a denied acl check no backend asked had a rule for.
+	auditNoAcl = "no_acl"
+	//auditNoBackend is a denial no backend was asked for, as there was none to ask.
+	auditNoBackend = "no_backend"
+)
+
+//auditRecord is a denial written to the audit log as a JSON line. Passwords are never written, nor JWTs taken as usernames.
+type auditRecord struct {
+	Time     string         `json:"time"`
+	Check    string         `json:"check"`
+	Reason   string         `json:"reason"`
+	Username string         `json:"username"`
+	Clientid string         `json:"clientid"`
+	Topic    string         `json:"topic,omitempty"`
+	Acc      int            `json:"acc,omitempty"`
+	Cached   bool           `json:"cached"`
+	Backends []auditBackend `json:"backends"`
+	Dropped  int64          `json:"dropped,omitempty"`
+}
+
+//auditBackend is the result a backend gave for an audited check, and how long it took, which isn't audited.
+type auditBackend struct {
+	Backend  string `json:"backend"`
+	Result   string `json:"result"`
+	duration time.Duration
+}
+
+//checkTrace records the backends a check was made with and their results, so a denial may be audited.
+type checkTrace struct {
+	cached   bool
+	backends []auditBackend
+}
+
+//add records the result the backend gave and how long it took.
+func (t *checkTrace) add(backend, result string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+	t.backends = append(t.backends, auditBackend{Backend: backend, Result: result, duration: duration})
+}
+
+//reason tells why the traced check was denied.
+func (t *checkTrace) reason(check string) string {
+	if t.cached {
+		return auditCached
+	}
+	if len(t.backends) == 0 {
+		return auditNoBackend
+	}
+	for _, backend := range t.backends {
+		if backend.Result != metrics.ResultDeny {
+			return auditBackendError
+		}
+	}
+	if check == metrics.CheckAuth {
+		return auditWrongCredentials
+	}
+	return auditNoAcl
+}
+
+//auditLog writes every final denial to an append-only file, one JSON line each, up to maxPerSecond lines a second when it's positive.
+//Denials over the limit are dropped, and the next line written tells how many were dropped since the previous one.
+type auditLog struct {
+	mu           sync.Mutex
+	file         *logFile
+	maxPerSecond int
+	second       int64
+	written      int
+	dropped      int64
+	now          func() time.Time
+}
+
+//newAuditLog opens the audit log at path, creating it readable by its owner only. It's reopened when moved, as log files are.
+func newAuditLog(path string, maxPerSecond int) (*auditLog, error) {
+	file, err := openLogFile(path, 0600, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		file:         file,
+		maxPerSecond: maxPerSecond,
+		now:          time.Now,
+	}, nil
+}
+
+//deny audits the denial of a check, told by its trace. A nil auditLog audits nothing.
+func (a *auditLog) deny(check, username, clientid, topic string, acc int, trace *checkTrace) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if second := now.Unix(); second != a.second {
+		a.second = second
+		a.written = 0
+	}
+	if a.maxPerSecond > 0 && a.written >= a.maxPerSecond {
+		a.dropped++
+		return
+	}
+
+	record := auditRecord{
+		Time:     now.UTC().Format(time.RFC3339Nano),
+		Check:    check,
+		Reason:   trace.reason(check),
+		Username: common.RedactUsername(username),
+		Clientid: clientid,
+		Topic:    topic,
+		Acc:      acc,
+		Cached:   trace.cached,
+		Backends: trace.backends,
+		Dropped:  a.dropped,
+	}
+	if record.Backends == nil {
+		record.Backends = []auditBackend{}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("couldn't encode audit record: %s", err)
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Errorf("couldn't write audit record: %s", err)
+		return
+	}
+
+	a.written++
+	a.dropped = 0
+}
+
+//Close closes the audit log's file.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
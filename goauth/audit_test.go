@@ -0,0 +1,146 @@
+package goauth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//readAudit reads the records of the audit log at path.
+func readAudit(path string) []auditRecord {
+	content, err := ioutil.ReadFile(path)
+	So(err, ShouldBeNil)
+
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var record auditRecord
+		So(json.Unmarshal([]byte(line), &record), ShouldBeNil)
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAudit(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+	auditPath := filepath.Join(dir, "audit.log")
+
+	opts := map[string]string{
+		"backends":                 "files",
+		"password_path":            pwPath,
+		"acl_path":                 aclPath,
+		"log_level":                "error",
+		"audit_log_file":           auditPath,
+		"audit_log_max_per_second": "2",
+	}
+	var keys, values []string
+	for key, value := range opts {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	//Skip the all-go time after starting, which grants every check without asking backends.
+	startupAllGoTime = 1
+
+	Convey("Given a scripted sequence of checks, the audit log should have a record for every denial", t, func() {
+		AuthPluginInit(keys, values, len(keys))
+
+		//Every denial falls in a new second but the last ones, which are rate limited.
+		second := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		commonData.Audit.now = func() time.Time {
+			second = second.Add(time.Second)
+			return second
+		}
+
+		So(AuthUnpwdCheck("test1", "test1", "id"), ShouldBeTrue)
+		So(AuthUnpwdCheck("test1", "badpass", "id1"), ShouldBeFalse)
+		So(AuthUnpwdCheck("unknown", "test1", "id2"), ShouldBeFalse)
+		So(AuthAclCheck("id", "test1", "test/topic/1", 2), ShouldBeTrue)
+		So(AuthAclCheck("id3", "test1", "test/topic/2", 2), ShouldBeFalse)
+
+		fixed := second.Add(time.Second)
+		commonData.Audit.now = func() time.Time { return fixed }
+		for i := 0; i < 5; i++ {
+			So(AuthAclCheck("id4", "test2", "other/topic", 1), ShouldBeFalse)
+		}
+		commonData.Audit.now = func() time.Time { return fixed.Add(time.Second) }
+		So(AuthUnpwdCheck("test2", "badpass", "id5"), ShouldBeFalse)
+
+		AuthPluginCleanup()
+
+		info, err := os.Stat(auditPath)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+		content, err := ioutil.ReadFile(auditPath)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldNotContainSubstring, "badpass")
+
+		records := readAudit(auditPath)
+		So(records, ShouldHaveLength, 6)
+
+		files := []auditBackend{{Backend: "files", Result: metrics.ResultDeny}}
+
+		So(records[0].Check, ShouldEqual, metrics.CheckAuth)
+		So(records[0].Reason, ShouldEqual, auditWrongCredentials)
+		So(records[0].Username, ShouldEqual, "test1")
+		So(records[0].Clientid, ShouldEqual, "id1")
+		So(records[0].Time, ShouldEqual, "2020-01-01T00:00:01Z")
+		So(records[0].Backends, ShouldResemble, files)
+
+		So(records[1].Reason, ShouldEqual, auditWrongCredentials)
+		So(records[1].Username, ShouldEqual, "unknown")
+
+		So(records[2].Check, ShouldEqual, metrics.CheckAcl)
+		So(records[2].Reason, ShouldEqual, auditNoAcl)
+		So(records[2].Topic, ShouldEqual, "test/topic/2")
+		So(records[2].Acc, ShouldEqual, 2)
+		So(records[2].Clientid, ShouldEqual, "id3")
+		So(records[2].Backends, ShouldResemble, files)
+
+		//Only 2 of the 5 denials in the same second are written, and the next record tells the 3 dropped.
+		So(records[3].Topic, ShouldEqual, "other/topic")
+		So(records[3].Dropped, ShouldEqual, 0)
+		So(records[4].Topic, ShouldEqual, "other/topic")
+		So(records[5].Check, ShouldEqual, metrics.CheckAuth)
+		So(records[5].Username, ShouldEqual, "test2")
+		So(records[5].Dropped, ShouldEqual, 3)
+	})
+
+	Convey("Given traces, the reason of a denial should tell why it was denied", t, func() {
+		So((&checkTrace{}).reason(metrics.CheckAuth), ShouldEqual, auditNoBackend)
+		So((&checkTrace{cached: true}).reason(metrics.CheckAcl), ShouldEqual, auditCached)
+
+		trace := &checkTrace{}
+		trace.add("files", metrics.ResultDeny, time.Millisecond)
+		trace.add("redis", metrics.ResultUnavailable, 0)
+		So(trace.reason(metrics.CheckAuth), ShouldEqual, auditBackendError)
+
+		var none *checkTrace
+		none.add("files", metrics.ResultDeny, 0)
+	})
+
+	Convey("Given no audit log, denials shouldn't be audited", t, func() {
+		var audit *auditLog
+		audit.deny(metrics.CheckAuth, "test1", "id", "", 0, &checkTrace{})
+		So(audit.Close(), ShouldBeNil)
+	})
+
+}
@@ -0,0 +1,62 @@
+package goauth
+
+import (
+	"time"
+)
+
+//BackendResult is the result a backend, or a plugin as plugin:<name>, gave for a check, and how long it took.
+type BackendResult struct {
+	Backend  string
+	Result   string
+	Duration time.Duration
+}
+
+//DryRunUser checks the user as AuthUnpwdCheck does, but neither in the all-go time after starting nor with the cache, and without auditing a denial, so a configuration may be tried.
+//It returns whether the user is authenticated and the result every backend asked gave, in order.
+func DryRunUser(username, password, clientid string) (bool, []BackendResult) {
+	trace := &checkTrace{}
+	authenticated, _ := checkUser(username, password, clientid, trace)
+	return authenticated, trace.results()
+}
+
+//DryRunAcl checks the user's acl as AuthAclCheck does, but neither in the all-go time after starting nor with the cache, and without auditing a denial, so a configuration may be tried.
+//It returns whether it's granted and the result every backend asked gave, in order.
+func DryRunAcl(username, topic, clientid string, acc int) (bool, []BackendResult) {
+	trace := &checkTrace{}
+	granted, _ := checkUserAcl(username, topic, clientid, acc, trace)
+	return granted, trace.results()
+}
+
+//results returns the traced results.
+func (t *checkTrace) results() []BackendResult {
+	results := make([]BackendResult, 0, len(t.backends))
+	for _, backend := range t.backends {
+		results = append(results, BackendResult{Backend: backend.Backend, Result: backend.Result, Duration: backend.duration})
+	}
+	return results
+}
+
+//Backends returns the names of the enabled backends, in the order they're checked, and the ones of the loaded plugins as plugin:<name>.
+func Backends() []string {
+	var names []string
+	for _, bename := range backends {
+		if bename != "plugin" {
+			names = append(names, bename)
+		}
+	}
+	for _, plug := range loadedPlugins() {
+		names = append(names, "plugin:"+plug.GetName())
+	}
+	return names
+}
+
+//Health tells, by name, whether each backend knowing when its service is down finds it up. Backends that don't know are left out.
+func Health() map[string]bool {
+	health := make(map[string]bool)
+	for name, backend := range commonData.Backends {
+		if healthChecker, ok := backend.(HealthChecker); ok {
+			health[name] = healthChecker.Healthy()
+		}
+	}
+	return health
+}
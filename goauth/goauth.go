@@ -0,0 +1,1256 @@
+package goauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
+
+	b64 "encoding/base64"
+
+	goredis "github.com/go-redis/redis"
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+)
+
+type Backend interface {
+	GetUser(username, password string) bool
+	GetSuperuser(username string) bool
+	CheckAcl(username, topic, clientId string, acc int32) bool
+	GetName() string
+	Halt()
+}
+
+//ClientBackend is implemented by backends that need the client id to authenticate users.
+type ClientBackend interface {
+	GetClientUser(username, password, clientid string) bool
+}
+
+//ClientSuperuserBackend is implemented by backends that need the client id to check superusers, e.g. because clients sharing a username may have different rights.
+type ClientSuperuserBackend interface {
+	GetClientSuperuser(username, clientid string) bool
+}
+
+//TTLBackend is implemented by backends whose responses may hint how long a decision may be cached.
+type TTLBackend interface {
+	GetUserTTL(username, password string) (bool, time.Duration)
+	CheckAclTTL(username, topic, clientId string, acc int32) (bool, time.Duration)
+}
+
+//UserNotifier is implemented by backends that tell when a user changed, e.g. it was revoked, so its cached decisions may be dropped. The handler is given an empty username when any user may have changed.
+//OnUserChange returns false when the backend isn't set to notify changes.
+type UserNotifier interface {
+	OnUserChange(handler func(username string)) bool
+}
+
+//HealthChecker is implemented by backends that know when the service they ask is down, so checks skip them instead of each one waiting for it.
+type HealthChecker interface {
+	Healthy() bool
+}
+
+type CommonData struct {
+	Backends         map[string]Backend
+	Plugins          *bes.PluginSet
+	Superusers       []string
+	AclCacheSeconds  int64
+	AuthCacheSeconds int64
+	CacheMinTTL      time.Duration
+	CacheMaxTTL      time.Duration
+	UseCache         bool
+	RedisCache       *goredis.Client
+	TrackUserCache   bool
+	CheckPrefix      bool
+	Prefixes         map[string]string
+	LogLevel         log.Level
+	LogDest          string
+	LogFile          string
+	LogFileWriter    *logFile
+	LogSyslog        *syslog.Writer
+	Metrics          *metrics.Metrics
+	Audit            *auditLog
+	SlowCheckWarning time.Duration
+}
+
+//Cache stores necessary values for Redis cache
+type Cache struct {
+	Host     string
+	Port     string
+	Password string
+	DB       int32
+}
+
+var allowedBackends = map[string]bool{
+	"postgres": true,
+	"jwt":      true,
+	"redis":    true,
+	"http":     true,
+	"files":    true,
+	"mysql":    true,
+	"sqlite":   true,
+	"mongo":    true,
+	"plugin":   true,
+	"grpc":     true,
+	"ldap":     true,
+	"js":       true,
+	"exec":     true,
+}
+
+//taggedBackends are the constructors of the backends only built with a build tag, registered by the files built with it.
+var taggedBackends = map[string]func(authOpts map[string]string, logLevel log.Level) (Backend, error){}
+
+//backendBuildTags are the build tags backends not built by default need, so enabling one the plugin was built without tells how to get it.
+var backendBuildTags = map[string]string{
+	"pam": "pam",
+}
+
+var backends []string          //List of selected backends.
+var authOpts map[string]string //Options passed by mosquitto.
+var cache Cache                //Cache conf.
+var commonData CommonData      //General struct with options and conf.
+var startupAllGoTime int64     //Tracking the system initialization time so the auth can have the first few minutes in all-go condition
+
+// when Mosquitto starts up, authentication for the first few minutes is in all-go status
+// this is to prevent all T4 attempts to get in which causes congestion failure
+const AuthAllGoDuration int64 = 60
+
+//hintedCacheSuffix marks cached decisions whose expiration was hinted by the backend, so it isn't refreshed on hits.
+const hintedCacheSuffix = ":hinted"
+
+//trackCacheKeyScript adds a cached decision's key to the set of its user's keys, extending the set's expiration so it outlives every key in it.
+var trackCacheKeyScript = goredis.NewScript(`
+redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+//AuthPluginInit initializes the plugin with the options mosquitto passes it, ending the program when it can't.
+func AuthPluginInit(keys []string, values []string, authOptsNum int) {
+	opts := make(map[string]string, authOptsNum)
+	for i := 0; i < authOptsNum; i++ {
+		opts[keys[i]] = values[i]
+	}
+
+	if err := Init(opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//Init initializes the plugin with the auth options, backends included, returning an error when it can't instead of ending the program, so a configuration may be checked without starting mosquitto.
+//Whatever was started before it failed, such as backends, is cleaned up.
+func Init(opts map[string]string) (err error) {
+
+	//Initialize Cache with default values
+	cache = Cache{
+		Host:     "localhost",
+		Port:     "6379",
+		Password: "",
+		DB:       3,
+	}
+
+	log.SetFormatter(&log.TextFormatter{
+		FullTimestamp: true,
+	})
+
+	superusers := make([]string, 10, 10)
+
+	cmbackends := make(map[string]Backend)
+
+	//Initialize common struct with default and given values
+	commonData = CommonData{
+		Backends:         cmbackends,
+		Superusers:       superusers,
+		AclCacheSeconds:  30,
+		AuthCacheSeconds: 30,
+		CheckPrefix:      false,
+		Prefixes:         make(map[string]string),
+		LogLevel:         log.InfoLevel,
+		LogDest:          "stderr",
+	}
+
+	//First, get backends
+	backendsValue, ok := opts["backends"]
+	if !ok {
+		return fmt.Errorf("backends error: no backends given")
+	}
+	backends = strings.Split(strings.Replace(backendsValue, " ", "", -1), ",")
+	for _, backend := range backends {
+		if _, ok := allowedBackends[backend]; !ok {
+			if tag, ok := backendBuildTags[backend]; ok {
+				return fmt.Errorf("backends error: backend not allowed: %s, the plugin must be built with the %s build tag", backend, tag)
+			}
+			return fmt.Errorf("backends error: backend not allowed: %s", backend)
+		}
+	}
+
+	authOpts = make(map[string]string)
+	for key, value := range opts {
+		if key != "backends" {
+			authOpts[key] = value
+		}
+	}
+
+	//Clean up whatever was started when failing, backends registered so far included.
+	defer func() {
+		if err != nil {
+			AuthPluginCleanup()
+		}
+	}()
+
+	//Check if log level is given. Set level if any valid option is given.
+	if logLevel, ok := authOpts["log_level"]; ok {
+
+		logLevel = strings.Replace(logLevel, " ", "", -1)
+
+		switch logLevel {
+		case "debug":
+			commonData.LogLevel = log.DebugLevel
+		case "info":
+			commonData.LogLevel = log.InfoLevel
+		case "warn":
+			commonData.LogLevel = log.WarnLevel
+		case "error":
+			commonData.LogLevel = log.ErrorLevel
+		case "fatal":
+			commonData.LogLevel = log.FatalLevel
+		case "panic":
+			commonData.LogLevel = log.PanicLevel
+		default:
+			log.Info("log_level unkwown, using default info level")
+		}
+
+	}
+
+	if logDest, ok := authOpts["log_dest"]; ok {
+		switch logDest {
+		case "stdout":
+			log.SetOutput(os.Stdout)
+			commonData.LogDest = logDest
+		case "file":
+			if logFile, ok := authOpts["log_file"]; ok {
+				//The log file isn't rotated by default.
+				maxSize := int64(common.IntOption(authOpts, "log_file_max_mb", 0, 1<<20, 0)) << 20
+				maxBackups := common.IntOption(authOpts, "log_file_max_backups", 0, 1000, 5)
+
+				file, err := openLogFile(logFile, 0644, maxSize, maxBackups)
+				if err == nil {
+					log.SetOutput(file)
+					commonData.LogDest = logDest
+					commonData.LogFile = logFile
+					commonData.LogFileWriter = file
+				} else {
+					log.Errorf("failed to log to file, using default stderr: %s", err)
+				}
+			}
+		case "syslog":
+			if err := logToSyslog(authOpts); err != nil {
+				log.Warnf("failed to log to syslog, using default stderr: %s", err)
+			} else {
+				commonData.LogDest = logDest
+			}
+		default:
+			log.Info("log_dest unknown, using default stderr")
+		}
+	}
+
+	//Initialize backends
+	for _, bename := range backends {
+		var beIface Backend
+		var bErr error
+
+		if bename == "plugin" {
+			paths := pluginPaths(authOpts)
+			if len(paths) == 0 {
+				log.Errorf("Could not init custom plugins: plugin_path or plugin_paths must be given")
+			}
+
+			//Plugins are loaded on their own, so one failing doesn't keep the others from loading.
+			var plugins []bes.CustomPlugin
+			for _, path := range paths {
+				plug, plErr := bes.LoadPlugin(path, authOpts, commonData.LogLevel)
+				if plErr != nil {
+					log.Errorf("Could not init custom plugin: %s", plErr)
+					continue
+				}
+				plugins = append(plugins, plug)
+				log.Infof("Backend registered: %s %s", plug.GetName(), plug.Version())
+			}
+
+			//Plugins aren't reloaded by default.
+			reloadInterval := common.DurationOption(authOpts, "plugin_reload_interval_seconds", time.Second, 0, 0)
+			commonData.Plugins = bes.NewPluginSet(plugins, authOpts, commonData.LogLevel, reloadInterval)
+		} else {
+			switch bename {
+			case "postgres":
+				beIface, bErr = bes.NewPostgres(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["postgres"] = beIface.(bes.Postgres)
+				}
+			case "jwt":
+				beIface, bErr = bes.NewJWT(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["jwt"] = beIface.(bes.JWT)
+				}
+			case "files":
+				beIface, bErr = bes.NewFiles(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["files"] = beIface.(bes.Files)
+				}
+			case "redis":
+				beIface, bErr = bes.NewRedis(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["redis"] = beIface.(bes.Redis)
+				}
+			case "mysql":
+				beIface, bErr = bes.NewMysql(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["mysql"] = beIface.(bes.Mysql)
+				}
+			case "http":
+				beIface, bErr = bes.NewHTTP(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["http"] = beIface.(bes.HTTP)
+				}
+			case "sqlite":
+				beIface, bErr = bes.NewSqlite(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["sqlite"] = beIface.(bes.Sqlite)
+				}
+			case "mongo":
+				beIface, bErr = bes.NewMongo(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["mongo"] = beIface.(bes.Mongo)
+				}
+			case "grpc":
+				beIface, bErr = bes.NewGRPC(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["grpc"] = beIface.(bes.GRPC)
+				}
+			case "ldap":
+				beIface, bErr = bes.NewLDAP(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["ldap"] = beIface.(bes.LDAP)
+				}
+			case "js":
+				beIface, bErr = bes.NewJS(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["js"] = beIface.(bes.JS)
+				}
+			case "exec":
+				beIface, bErr = bes.NewExec(authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends["exec"] = beIface.(bes.Exec)
+				}
+			default:
+				beIface, bErr = taggedBackends[bename](authOpts, commonData.LogLevel)
+				if bErr != nil {
+					return fmt.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+				} else {
+					log.Infof("Backend registered: %s", beIface.GetName())
+					cmbackends[bename] = beIface
+				}
+			}
+		}
+
+	}
+
+	if common.BoolOption(authOpts, "cache", false) {
+		log.Info("Cache activated")
+		commonData.UseCache = true
+	} else {
+		log.Info("No cache set.")
+		commonData.UseCache = false
+	}
+
+	if commonData.UseCache {
+		//The cache password may be read from a file, as the secret options of backends.
+		cacheOpts, secretErr := common.ReadSecretFiles(authOpts, func(key string) bool { return key == "cache_password" })
+		if secretErr != nil {
+			return fmt.Errorf("couldn't initialize cache: %s", secretErr)
+		}
+
+		if cacheHost, ok := authOpts["cache_host"]; ok {
+			cache.Host = cacheHost
+		}
+
+		if cachePort, ok := authOpts["cache_port"]; ok {
+			cache.Port = cachePort
+		}
+
+		if cachePassword, ok := cacheOpts["cache_password"]; ok {
+			cache.Password = cachePassword
+		}
+
+		cache.DB = int32(common.IntOption(authOpts, "cache_db", 0, 1<<16, int(cache.DB)))
+
+		authCacheTTL := common.DurationOption(authOpts, "auth_cache_seconds", time.Second, 0, time.Duration(commonData.AuthCacheSeconds)*time.Second)
+		commonData.AuthCacheSeconds = int64(authCacheTTL / time.Second)
+		aclCacheTTL := common.DurationOption(authOpts, "acl_cache_seconds", time.Second, 0, time.Duration(commonData.AclCacheSeconds)*time.Second)
+		commonData.AclCacheSeconds = int64(aclCacheTTL / time.Second)
+
+		//There's no min nor max ttl by default.
+		commonData.CacheMinTTL = common.DurationOption(authOpts, "cache_min_ttl_seconds", time.Second, 0, commonData.CacheMinTTL)
+		commonData.CacheMaxTTL = common.DurationOption(authOpts, "cache_max_ttl_seconds", time.Second, 0, commonData.CacheMaxTTL)
+
+		addr := fmt.Sprintf("%s:%s", cache.Host, cache.Port)
+
+		//If cache is on, try to start redis.
+		goredisClient := goredis.NewClient(&goredis.Options{
+			Addr:     addr,
+			Password: cache.Password, // no password set
+			DB:       int(cache.DB),  // use default DB
+		})
+
+		_, err := goredisClient.Ping().Result()
+		if err != nil {
+			log.Errorf("couldn't start Redis, defaulting to no cache. error: %s", err)
+			commonData.UseCache = false
+		} else {
+			commonData.RedisCache = goredisClient
+			log.Infof("started cache redis client on DB %d", cache.DB)
+			//Check if cache must be reset
+			if common.BoolOption(authOpts, "cache_reset", false) {
+				commonData.RedisCache.FlushDB()
+				log.Infof("flushed cache")
+			}
+		}
+
+	}
+
+	if common.BoolOption(authOpts, "check_prefix", false) {
+		//Check that backends match prefixes.
+		if prefixesStr, ok := authOpts["prefixes"]; ok {
+			prefixes := strings.Split(strings.Replace(prefixesStr, " ", "", -1), ",")
+			if len(prefixes) == len(backends) {
+				//Set prefixes
+				for i, backend := range backends {
+					commonData.Prefixes[prefixes[i]] = backend
+				}
+				log.Infof("Prefixes enabled for backends %s with prefixes %s.", authOpts["backends"], authOpts["prefixes"])
+				commonData.CheckPrefix = true
+			} else {
+				log.Errorf("Error: got %d backends and %d prefixes, defaulting to prefixes disabled.", len(backends), len(prefixes))
+				commonData.CheckPrefix = false
+			}
+
+		} else {
+			log.Warn("Error: prefixes enabled but no options given, defaulting to prefixes disabled.")
+			commonData.CheckPrefix = false
+		}
+	} else {
+		commonData.CheckPrefix = false
+	}
+
+	//Backends notifying user changes get the user's cached decisions dropped, which needs their keys to be tracked.
+	if commonData.UseCache {
+		for name, backend := range cmbackends {
+			if notifier, ok := backend.(UserNotifier); ok && notifier.OnUserChange(InvalidateUserCache) {
+				commonData.TrackUserCache = true
+				log.Infof("dropping cached decisions of users changed in backend %s", name)
+			}
+		}
+	}
+
+	//Slow checks aren't warned about by default.
+	commonData.SlowCheckWarning = common.DurationOption(authOpts, "slow_check_warning_ms", time.Millisecond, 0, 0)
+
+	if auditFile, ok := authOpts["audit_log_file"]; ok && auditFile != "" {
+		//Denials aren't limited by default.
+		maxPerSecond := common.IntOption(authOpts, "audit_log_max_per_second", 0, 1<<30, 0)
+
+		audit, err := newAuditLog(auditFile, maxPerSecond)
+		if err != nil {
+			return fmt.Errorf("couldn't open audit log: %s", err)
+		}
+		commonData.Audit = audit
+		log.Infof("auditing denials to %s", auditFile)
+	}
+
+	if metricsListen, ok := authOpts["metrics_listen"]; ok && metricsListen != "" {
+		m := metrics.New(backendsHealth)
+		if err := m.Listen(metricsListen); err != nil {
+			log.Errorf("couldn't serve metrics, they won't be exposed: %s", err)
+		} else {
+			commonData.Metrics = m
+			log.Infof("serving metrics at http://%s/metrics", m.Addr())
+		}
+	}
+
+	//Log the configuration with secrets redacted, as they may be read by anyone reading logs.
+	log.Infof("auth options: backends=%s %s", strings.Join(backends, ","), common.RedactOptions(authOpts))
+	log.Infof("effective configuration: %s", effectiveConfiguration())
+
+	//Options no backend takes, e.g. misspelled, would be silently ignored otherwise.
+	strict := common.BoolOption(authOpts, "strict_options", false)
+	warnings, ok := unknownOptions(authOpts, backends, loadedPlugins())
+	switch {
+	case !ok && strict:
+		return fmt.Errorf("strict_options is set but unknown options can't be told, as some custom plugin doesn't tell the options it takes or didn't load")
+	case !ok:
+		log.Info("unknown options won't be reported, as some custom plugin doesn't tell the options it takes or didn't load")
+	case len(warnings) > 0 && strict:
+		return fmt.Errorf("strict_options is set and options are wrong: %s", strings.Join(warnings, "; "))
+	}
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+
+	return nil
+}
+
+//logToSyslog sends logs to syslog only, the local one unless log_syslog_network and log_syslog_address tell a unix socket or a remote one, tagged with log_syslog_tag.
+func logToSyslog(authOpts map[string]string) error {
+	network := authOpts["log_syslog_network"]
+	address := authOpts["log_syslog_address"]
+
+	tag := "mosquitto-go-auth"
+	if syslogTag, ok := authOpts["log_syslog_tag"]; ok {
+		tag = syslogTag
+	}
+
+	switch network {
+	case "":
+		if address != "" {
+			return fmt.Errorf("log_syslog_address %s given without log_syslog_network", address)
+		}
+	case "unix", "unixgram", "udp", "tcp":
+		if address == "" {
+			return fmt.Errorf("log_syslog_network %s needs log_syslog_address", network)
+		}
+	default:
+		return fmt.Errorf("unknown log_syslog_network %s, it must be unix, unixgram, udp or tcp", network)
+	}
+
+	hook, err := lSyslog.NewSyslogHook(network, address, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return err
+	}
+
+	//Syslog timestamps messages itself.
+	log.SetFormatter(&log.TextFormatter{
+		DisableTimestamp: true,
+	})
+	log.AddHook(hook)
+	log.SetOutput(ioutil.Discard)
+	commonData.LogSyslog = hook.Writer
+
+	return nil
+}
+
+//AuthUnpwdCheck tells if the user is authenticated with the password, as mosquitto asks for a client connecting.
+func AuthUnpwdCheck(username, password, clientid string) bool {
+
+	// check whether this Mosquitto session just started up
+	now := time.Now()
+	if startupAllGoTime == 0 {
+		startupAllGoTime = now.Unix() + AuthAllGoDuration
+		log.Warningf("init the all-go timer to %d", startupAllGoTime)
+	}
+
+	// check whether it is all-go time now
+	if now.Unix() < startupAllGoTime {
+		log.Debugf("it is pwd all-go time for %s", common.RedactUsername(username))
+		return true
+	}
+
+	// ---------------------------------------------------
+
+	trace := &checkTrace{}
+	var cached = false
+	var granted = false
+	if commonData.UseCache {
+		log.Debugf("checking auth cache for %s", common.RedactUsername(username))
+		cached, granted = CheckAuthCache(username, password, clientid)
+		commonData.Metrics.ObserveCache(metrics.CheckAuth, cached)
+		if cached {
+			log.Debugf("found in cache: %s", common.RedactUsername(username))
+			if !granted {
+				trace.cached = true
+				commonData.Audit.deny(metrics.CheckAuth, username, clientid, "", 0, trace)
+			}
+			return granted
+		}
+	}
+
+	authenticated, ttl := checkUser(username, password, clientid, trace)
+
+	if commonData.UseCache {
+		authGranted := "false"
+		if authenticated {
+			authGranted = "true"
+		}
+		log.Debugf("setting auth cache for %s", common.RedactUsername(username))
+		SetAuthCache(username, password, clientid, authGranted, ttl)
+	}
+
+	if !authenticated {
+		commonData.Audit.deny(metrics.CheckAuth, username, clientid, "", 0, trace)
+	}
+
+	return authenticated
+}
+
+//AuthAclCheck tells if the user may access the topic with the access level, as mosquitto asks for a client.
+func AuthAclCheck(clientid, username, topic string, acc int) bool {
+
+	// check whether this Mosquitto session just started up
+	now := time.Now()
+	if startupAllGoTime == 0 {
+		startupAllGoTime = now.Unix() + AuthAllGoDuration
+		log.Warningf("init the all-go timer to %d", startupAllGoTime)
+	}
+
+	// check whether it is all-go time now
+	if now.Unix() < startupAllGoTime {
+		log.Debugf("it is acl all-go time for %s", common.RedactUsername(username))
+		return true
+	}
+
+	// ---------------------------------------------------
+
+	trace := &checkTrace{}
+	var cached = false
+	var granted = false
+	if commonData.UseCache {
+		log.Debugf("checking acl cache for %s", common.RedactUsername(username))
+		cached, granted = CheckAclCache(username, topic, clientid, acc)
+		commonData.Metrics.ObserveCache(metrics.CheckAcl, cached)
+		if cached {
+			log.Debugf("found in cache: %s", common.RedactUsername(username))
+			if !granted {
+				trace.cached = true
+				commonData.Audit.deny(metrics.CheckAcl, username, clientid, topic, acc, trace)
+			}
+			return granted
+		}
+	}
+
+	aclCheck, ttl := checkUserAcl(username, topic, clientid, acc, trace)
+
+	if commonData.UseCache {
+		authGranted := "false"
+		if aclCheck {
+			authGranted = "true"
+		}
+		log.Debugf("setting acl cache (granted = %s) for %s", authGranted, common.RedactUsername(username))
+		SetAclCache(username, topic, clientid, acc, authGranted, ttl)
+	}
+
+	if !aclCheck {
+		commonData.Audit.deny(metrics.CheckAcl, username, clientid, topic, acc, trace)
+	}
+
+	log.Debugf("Acl is %t for user %s", aclCheck, common.RedactUsername(username))
+
+	return aclCheck
+}
+
+//checkUser checks the user with the backend its username's prefix tells, if prefixes are enabled, or else with every backend and then the plugins, returning whether it's authenticated and the cache ttl hinted for the decision.
+func checkUser(username, password, clientid string, trace *checkTrace) (bool, time.Duration) {
+	authenticated := false
+	ttl := bes.NoTTL
+
+	//If prefixes are enabled, checkt if username has a valid prefix and use the correct backend if so.
+	if commonData.CheckPrefix {
+		validPrefix, bename := CheckPrefix(username)
+		if validPrefix {
+
+			if bename == "plugin" {
+				authenticated, ttl = CheckPluginAuth(username, password, clientid, trace)
+			} else {
+
+				var backend = commonData.Backends[bename]
+
+				authenticated, ttl = getUser(bename, backend, username, password, clientid, trace)
+				if authenticated {
+					log.Debugf("user %s authenticated with backend %s", common.RedactUsername(username), backend.GetName())
+				}
+
+			}
+
+		} else {
+			//If there's no valid prefix, check all backends.
+			authenticated, ttl = CheckBackendsAuth(username, password, clientid, trace)
+			//If not authenticated, check for a present plugin
+			if !authenticated {
+				var hint time.Duration
+				authenticated, hint = CheckPluginAuth(username, password, clientid, trace)
+				if authenticated || hint == bes.SkipCache {
+					ttl = hint
+				}
+			}
+		}
+	} else {
+		authenticated, ttl = CheckBackendsAuth(username, password, clientid, trace)
+		//If not authenticated, check for a present plugin
+		if !authenticated {
+			var hint time.Duration
+			authenticated, hint = CheckPluginAuth(username, password, clientid, trace)
+			if authenticated || hint == bes.SkipCache {
+				ttl = hint
+			}
+		}
+	}
+
+	return authenticated, ttl
+}
+
+//checkUserAcl checks the user's acl with the backend its username's prefix tells, if prefixes are enabled, or else with every backend and then the plugins, returning whether it's granted and the cache ttl hinted for the decision.
+func checkUserAcl(username, topic, clientid string, acc int, trace *checkTrace) (bool, time.Duration) {
+	aclCheck := false
+	ttl := bes.NoTTL
+
+	//If prefixes are enabled, checkt if username has a valid prefix and use the correct backend if so.
+	//Else, check all backends.
+	if commonData.CheckPrefix {
+		validPrefix, bename := CheckPrefix(username)
+		if validPrefix {
+
+			if bename == "plugin" {
+
+				aclCheck, ttl = CheckPluginAcl(username, topic, clientid, acc, trace)
+
+			} else {
+
+				var backend = commonData.Backends[bename]
+
+				/*
+					// TRACMO: Superuser check is always a false
+					log.Debugf("Superuser check with backend %s", backend.GetName())
+					superuser := false
+					if clientBackend, ok := backend.(ClientSuperuserBackend); ok {
+						superuser = clientBackend.GetClientSuperuser(username, clientid)
+					} else {
+						superuser = backend.GetSuperuser(username)
+					}
+					if superuser {
+						log.Debugf("superuser %s acl authenticated with backend %s", common.RedactUsername(username), backend.GetName())
+						aclCheck = true
+					}
+				*/
+
+				//If not superuser, check acl.
+				if !aclCheck {
+					log.Debugf("Acl check with backend %s", backend.GetName())
+					aclCheck, ttl = checkAcl(bename, backend, username, topic, clientid, acc, trace)
+					if aclCheck {
+						log.Debugf("user %s acl authenticated with backend %s", common.RedactUsername(username), backend.GetName())
+					}
+				}
+			}
+
+		} else {
+			//If there's no valid prefix, check all backends.
+			aclCheck, ttl = CheckBackendsAcl(username, topic, clientid, acc, trace)
+			//If acl hasn't passed, check for plugin.
+			if !aclCheck {
+				var hint time.Duration
+				aclCheck, hint = CheckPluginAcl(username, topic, clientid, acc, trace)
+				if aclCheck || hint == bes.SkipCache {
+					ttl = hint
+				}
+			}
+		}
+	} else {
+		aclCheck, ttl = CheckBackendsAcl(username, topic, clientid, acc, trace)
+		//If acl hasn't passed, check for plugin.
+		if !aclCheck {
+			var hint time.Duration
+			aclCheck, hint = CheckPluginAcl(username, topic, clientid, acc, trace)
+			if aclCheck || hint == bes.SkipCache {
+				ttl = hint
+			}
+		}
+	}
+
+	return aclCheck, ttl
+}
+
+//AuthPskKeyGet grants every PSK key request, as no backend handles them.
+func AuthPskKeyGet() bool {
+	return true
+}
+
+//CheckAuthCache checks if the username/password pair is present in the cache for the client. Return if it's present and, if so, if it was granted privileges.
+//The client id is part of the key as backends may keep per client state when authenticating.
+func CheckAuthCache(username, password, clientid string) (bool, bool) {
+	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("auth%s%s%s", username, password, clientid)))
+	val, err := commonData.RedisCache.Get(pair).Result()
+	if err != nil {
+		return false, false
+	}
+	//refresh expiration, unless it was hinted by the backend
+	if !strings.HasSuffix(val, hintedCacheSuffix) {
+		expiration := time.Duration(commonData.AuthCacheSeconds) * time.Second
+		commonData.RedisCache.Expire(pair, expiration)
+		trackCacheKey(username, pair, expiration)
+	}
+	if strings.HasPrefix(val, "true") {
+		return true, true
+	}
+	return true, false
+}
+
+//SetAuthCache sets a pair, granted option and expiration time. If the backend hinted a ttl, it's used (clamped to the configured bounds) instead of the auth cache seconds.
+func SetAuthCache(username, password, clientid string, granted string, ttl time.Duration) error {
+	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("auth%s%s%s", username, password, clientid)))
+	value, expiration := cacheEntry(granted, ttl, commonData.AuthCacheSeconds)
+	if expiration <= 0 {
+		return nil
+	}
+	err := commonData.RedisCache.Set(pair, value, expiration).Err()
+	if err != nil {
+		return err
+	}
+	trackCacheKey(username, pair, expiration)
+
+	return nil
+}
+
+//CheckAclCache checks if the username/topic/clientid/acc mix is present in the cache. Return if it's present and, if so, if it was granted privileges.
+func CheckAclCache(username, topic, clientid string, acc int) (bool, bool) {
+	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("acl%s%s%s", username, topic, clientid)))
+	val, err := commonData.RedisCache.Get(pair).Result()
+	if err != nil {
+		return false, false
+	}
+	//refresh expiration, unless it was hinted by the backend
+	if !strings.HasSuffix(val, hintedCacheSuffix) {
+		expiration := time.Duration(commonData.AclCacheSeconds) * time.Second
+		commonData.RedisCache.Expire(pair, expiration)
+		trackCacheKey(username, pair, expiration)
+	}
+	if strings.HasPrefix(val, "true") {
+		return true, true
+	}
+	return true, false
+}
+
+//SetAclCache sets a mix, granted option and expiration time. If the backend hinted a ttl, it's used (clamped to the configured bounds) instead of the acl cache seconds.
+func SetAclCache(username, topic, clientid string, acc int, granted string, ttl time.Duration) error {
+	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("acl%s%s%s", username, topic, clientid)))
+	value, expiration := cacheEntry(granted, ttl, commonData.AclCacheSeconds)
+	if expiration <= 0 {
+		return nil
+	}
+	err := commonData.RedisCache.Set(pair, value, expiration).Err()
+	if err != nil {
+		return err
+	}
+	trackCacheKey(username, pair, expiration)
+
+	return nil
+}
+
+//userCacheKey returns the key of the set holding the keys of the user's cached decisions.
+func userCacheKey(username string) string {
+	return b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("user%s", username)))
+}
+
+//trackCacheKey adds the key of a decision cached for expiration to its user's set when backends may notify user changes.
+func trackCacheKey(username, key string, expiration time.Duration) {
+	if !commonData.TrackUserCache || expiration <= 0 {
+		return
+	}
+	err := trackCacheKeyScript.Run(commonData.RedisCache, []string{userCacheKey(username)}, key, int64(expiration/time.Millisecond)).Err()
+	if err != nil {
+		log.Errorf("couldn't track cache key for user %s: %s", common.RedactUsername(username), err)
+	}
+}
+
+//InvalidateUserCache drops the user's cached decisions, or every one when no username is given, so the next checks go to the backends.
+func InvalidateUserCache(username string) {
+	if username == "" {
+		if err := commonData.RedisCache.FlushDB().Err(); err != nil {
+			log.Errorf("couldn't flush cache: %s", err)
+			return
+		}
+		log.Infof("flushed cache")
+		return
+	}
+
+	setKey := userCacheKey(username)
+	keys, err := commonData.RedisCache.SMembers(setKey).Result()
+	if err != nil {
+		log.Errorf("couldn't get cache keys for user %s: %s", common.RedactUsername(username), err)
+		return
+	}
+
+	err = commonData.RedisCache.Del(append(keys, setKey)...).Err()
+	if err != nil {
+		log.Errorf("couldn't drop cache for user %s: %s", common.RedactUsername(username), err)
+		return
+	}
+	log.Debugf("dropped %d cached decisions for user %s", len(keys), common.RedactUsername(username))
+}
+
+//cacheEntry returns the value and expiration to cache a decision with. Without a hint the default seconds are used, otherwise the hinted ttl is clamped to the configured bounds and the value is marked so hits don't refresh its expiration. A zero expiration, as given for SkipCache, means the decision must not be cached.
+func cacheEntry(granted string, ttl time.Duration, defaultSeconds int64) (string, time.Duration) {
+	if ttl == bes.SkipCache {
+		return granted, 0
+	}
+
+	if ttl < 0 {
+		return granted, time.Duration(defaultSeconds) * time.Second
+	}
+
+	if ttl < commonData.CacheMinTTL {
+		ttl = commonData.CacheMinTTL
+	}
+
+	if commonData.CacheMaxTTL > 0 && ttl > commonData.CacheMaxTTL {
+		ttl = commonData.CacheMaxTTL
+	}
+
+	return granted + hintedCacheSuffix, ttl
+}
+
+//getUser checks the user with the given backend, registered as name, passing the client id to it if needed and returning the ttl it hinted for caching the decision when it's able to. Unhealthy backends aren't asked.
+//The check is timed, and its result counted in the metrics and recorded in the trace.
+func getUser(name string, backend Backend, username, password, clientid string, trace *checkTrace) (bool, time.Duration) {
+	if unhealthy(backend) {
+		commonData.Metrics.CountCheck(metrics.CheckAuth, name, metrics.ResultUnavailable)
+		trace.add(name, metrics.ResultUnavailable, 0)
+		return false, bes.SkipCache
+	}
+
+	start := time.Now()
+	var granted bool
+	ttl := bes.NoTTL
+	if ttlBackend, ok := backend.(TTLBackend); ok {
+		granted, ttl = ttlBackend.GetUserTTL(username, password)
+	} else if clientBackend, ok := backend.(ClientBackend); ok {
+		granted = clientBackend.GetClientUser(username, password, clientid)
+	} else {
+		granted = backend.GetUser(username, password)
+	}
+	observeCheck(metrics.CheckAuth, name, checkResult(granted, ttl), time.Since(start), trace)
+
+	return granted, ttl
+}
+
+//checkAcl checks the acl with the given backend, registered as name, returning the ttl it hinted for caching the decision when it's able to. Unhealthy backends aren't asked.
+//The check is timed, and its result counted in the metrics and recorded in the trace.
+func checkAcl(name string, backend Backend, username, topic, clientid string, acc int, trace *checkTrace) (bool, time.Duration) {
+	if unhealthy(backend) {
+		commonData.Metrics.CountCheck(metrics.CheckAcl, name, metrics.ResultUnavailable)
+		trace.add(name, metrics.ResultUnavailable, 0)
+		return false, bes.SkipCache
+	}
+
+	start := time.Now()
+	var granted bool
+	ttl := bes.NoTTL
+	if ttlBackend, ok := backend.(TTLBackend); ok {
+		granted, ttl = ttlBackend.CheckAclTTL(username, topic, clientid, int32(acc))
+	} else {
+		granted = backend.CheckAcl(username, topic, clientid, int32(acc))
+	}
+	observeCheck(metrics.CheckAcl, name, checkResult(granted, ttl), time.Since(start), trace)
+
+	return granted, ttl
+}
+
+//observeCheck counts a check the backend, registered as name, answered in the given duration and records it in the trace.
+//Every duration is logged at debug level, and those over the slow check threshold, if set, are warned about so the slow backend may be told.
+func observeCheck(check, name, result string, duration time.Duration, trace *checkTrace) {
+	commonData.Metrics.ObserveCheck(check, name, result, duration)
+	trace.add(name, result, duration)
+
+	if commonData.SlowCheckWarning > 0 && duration > commonData.SlowCheckWarning {
+		log.Warnf("slow %s check: backend %s took %s (threshold %s), result %s", check, name, duration, commonData.SlowCheckWarning, result)
+		return
+	}
+	log.Debugf("%s check with backend %s took %s, result %s", check, name, duration, result)
+}
+
+//checkResult tells the metrics' result of a check given its decision and hinted ttl, which is SkipCache when the backend couldn't tell.
+func checkResult(granted bool, ttl time.Duration) string {
+	switch {
+	case granted:
+		return metrics.ResultAllow
+	case ttl == bes.SkipCache:
+		return metrics.ResultUnavailable
+	}
+	return metrics.ResultDeny
+}
+
+//backendsHealth tells whether each registered backend is healthy, by its name, as checks take it.
+func backendsHealth() map[string]bool {
+	health := make(map[string]bool, len(commonData.Backends))
+	for name, backend := range commonData.Backends {
+		healthChecker, ok := backend.(HealthChecker)
+		health[name] = !ok || healthChecker.Healthy()
+	}
+	return health
+}
+
+//unhealthy tells if the backend knows its service is down, so the check is denied without asking it. The denial mustn't be cached, as the service could have granted it.
+func unhealthy(backend Backend) bool {
+	healthChecker, ok := backend.(HealthChecker)
+	if ok && !healthChecker.Healthy() {
+		log.Debugf("skipping unhealthy backend %s", backend.GetName())
+		return true
+	}
+	return false
+}
+
+//CheckPrefix checks if a username contains a valid prefix. If so, returns ok and the suitable backend name; else, !ok and empty string.
+func CheckPrefix(username string) (bool, string) {
+	if strings.Index(username, "_") > 0 {
+		userPrefix := username[0:strings.Index(username, "_")]
+		if prefix, ok := commonData.Prefixes[userPrefix]; ok {
+			log.Debugf("Found prefix for user %s, using backend %s.", common.RedactUsername(username), prefix)
+			return true, prefix
+		}
+	}
+	return false, ""
+}
+
+//CheckBackendsAuth checks for all backends if a username is authenticated and sets the authenticated param, along with the cache ttl hinted by the backend that authenticated it.
+func CheckBackendsAuth(username, password, clientid string, trace *checkTrace) (bool, time.Duration) {
+
+	authenticated := false
+	ttl := bes.NoTTL
+
+	for _, bename := range backends {
+
+		if bename == "plugin" {
+			continue
+		}
+
+		var backend = commonData.Backends[bename]
+
+		log.Debugf("checking user %s with backend %s", common.RedactUsername(username), backend.GetName())
+
+		granted, hint := getUser(bename, backend, username, password, clientid, trace)
+		if granted {
+			authenticated = true
+			ttl = hint
+			log.Debugf("user %s authenticated with backend %s", common.RedactUsername(username), backend.GetName())
+			break
+		}
+		//A backend that couldn't answer may have granted it, so the denial mustn't be cached.
+		if hint == bes.SkipCache {
+			ttl = hint
+		}
+	}
+
+	return authenticated, ttl
+
+}
+
+//CheckBackendsAcl  checks for all backends if a username is superuser or has acl rights and sets the aclCheck param, along with the cache ttl hinted by the backend that granted it.
+func CheckBackendsAcl(username, topic, clientid string, acc int, trace *checkTrace) (bool, time.Duration) {
+	//Check superusers first
+
+	aclCheck := false
+	ttl := bes.NoTTL
+
+	/*
+		// TRACMO: Superuser check is always a false
+		for _, bename := range backends {
+
+			if bename == "plugin" {
+				continue
+			}
+
+			var backend = commonData.Backends[bename]
+
+			log.Debugf("Superuser check with backend %s", backend.GetName())
+			superuser := false
+			if clientBackend, ok := backend.(ClientSuperuserBackend); ok {
+				superuser = clientBackend.GetClientSuperuser(username, clientid)
+			} else {
+				superuser = backend.GetSuperuser(username)
+			}
+			if superuser {
+				log.Debugf("superuser %s acl authenticated with backend %s", common.RedactUsername(username), backend.GetName())
+				aclCheck = true
+				break
+			}
+		}
+	*/
+
+	if !aclCheck {
+		for _, bename := range backends {
+
+			if bename == "plugin" {
+				continue
+			}
+
+			var backend = commonData.Backends[bename]
+
+			log.Debugf("Acl check with backend %s", backend.GetName())
+			granted, hint := checkAcl(bename, backend, username, topic, clientid, acc, trace)
+			if granted {
+				log.Debugf("user %s acl authenticated with backend %s", common.RedactUsername(username), backend.GetName())
+				aclCheck = true
+				ttl = hint
+				break
+			}
+			//A backend that couldn't answer may have granted it, so the denial mustn't be cached.
+			if hint == bes.SkipCache {
+				ttl = hint
+			}
+		}
+	}
+
+	return aclCheck, ttl
+
+}
+
+//pluginPaths returns the paths of the custom plugins to load, given as a comma separated list in plugin_paths and as a single one in plugin_path.
+func pluginPaths(authOpts map[string]string) []string {
+	var paths []string
+	for _, path := range strings.Split(authOpts["plugin_paths"], ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if path, ok := authOpts["plugin_path"]; ok && path != "" {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+//loadedPlugins returns the plugins to check with, if any. Reloaded plugins may be swapped in meanwhile, so a check must get them once.
+func loadedPlugins() []bes.CustomPlugin {
+	if commonData.Plugins == nil {
+		return nil
+	}
+	return commonData.Plugins.Plugins()
+}
+
+//CheckPluginAuth checks the user with every loaded plugin in order until one authenticates it, passing the client id to those taking it.
+//A plugin failing to tell may have authenticated it, so the denial is given SkipCache then.
+func CheckPluginAuth(username, password, clientid string, trace *checkTrace) (bool, time.Duration) {
+	ttl := bes.NoTTL
+	for _, plug := range loadedPlugins() {
+		start := time.Now()
+		granted, err := plug.GetUser(username, password, clientid)
+		observePluginCheck(metrics.CheckAuth, plug, granted, err, start, trace)
+		if err != nil {
+			log.Errorf("plugin %s get user error: %s", plug.GetName(), err)
+			ttl = bes.SkipCache
+			continue
+		}
+		if granted {
+			log.Debugf("user %s authenticated with plugin %s", common.RedactUsername(username), plug.GetName())
+			return true, bes.NoTTL
+		}
+	}
+	return false, ttl
+}
+
+//CheckPluginAcl checks if the user has acl rights with every loaded plugin in order until one grants it.
+//A plugin failing to tell may have granted it, so the denial is given SkipCache then.
+func CheckPluginAcl(username, topic, clientid string, acc int, trace *checkTrace) (bool, time.Duration) {
+	ttl := bes.NoTTL
+	for _, plug := range loadedPlugins() {
+		start := time.Now()
+		// TRACMO: Superuser check is always a false, for plugins as for backends
+		granted, err := plug.CheckAcl(username, topic, clientid, acc)
+		observePluginCheck(metrics.CheckAcl, plug, granted, err, start, trace)
+		if err != nil {
+			log.Errorf("plugin %s acl error: %s", plug.GetName(), err)
+			ttl = bes.SkipCache
+			continue
+		}
+		if granted {
+			log.Debugf("user %s acl authenticated with plugin %s", common.RedactUsername(username), plug.GetName())
+			return true, bes.NoTTL
+		}
+	}
+	return false, ttl
+}
+
+//observePluginCheck observes a check made by the plugin since start, labeled as plugin:<name> so it's told apart from backends. A plugin failing to tell is unavailable.
+func observePluginCheck(check string, plug bes.CustomPlugin, granted bool, err error, start time.Time, trace *checkTrace) {
+	result := checkResult(granted, bes.NoTTL)
+	if err != nil {
+		result = metrics.ResultUnavailable
+	}
+	observeCheck(check, "plugin:"+plug.GetName(), result, time.Since(start), trace)
+}
+
+//AuthPluginCleanup halts backends and closes whatever the plugin opened, as mosquitto asks when stopping.
+func AuthPluginCleanup() {
+	log.Info("Cleaning up plugin")
+
+	//Stop serving metrics first, as they ask backends for their health.
+	if err := commonData.Metrics.Close(); err != nil {
+		log.Errorf("couldn't stop serving metrics: %s", err)
+	}
+	//If cache is set, close cache connection.
+	if commonData.RedisCache != nil {
+		commonData.RedisCache.Close()
+	}
+
+	//Halt every registered backend.
+
+	for _, v := range commonData.Backends {
+		v.Halt()
+	}
+
+	if commonData.Plugins != nil {
+		commonData.Plugins.Halt()
+	}
+
+	if commonData.LogSyslog != nil {
+		commonData.LogSyslog.Close()
+	}
+
+	if err := commonData.Audit.Close(); err != nil {
+		log.Errorf("couldn't close audit log: %s", err)
+	}
+
+	//Logs after cleaning up, if any, go to stderr instead of the closed file.
+	if commonData.LogFileWriter != nil {
+		log.SetOutput(os.Stderr)
+		commonData.LogFileWriter.Close()
+	}
+}
@@ -0,0 +1,137 @@
+package goauth
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//logFileCheckInterval is how often a log file's path is checked to tell whether the file was moved or removed, so a write doesn't stat it every time.
+const logFileCheckInterval = time.Second
+
+//logFile writes logs to the file at path, rotating it once it would grow past maxSize bytes and keeping up to maxBackups rotated files as path.1, the newest, to path.<maxBackups>.
+//It's reopened when its path no longer leads to it, e.g. as logrotate moved it, so new lines land in the fresh file without copytruncate. A zero maxSize means it's never rotated but by others.
+//Writes are serialized with rotations and reopens, so no line is lost or split between files.
+type logFile struct {
+	mu            sync.Mutex
+	path          string
+	perm          os.FileMode
+	maxSize       int64
+	maxBackups    int
+	checkInterval time.Duration
+	file          *os.File
+	size          int64
+	checked       time.Time
+}
+
+//openLogFile opens the log file at path, appending to it, and creating it with perm if it doesn't exist.
+func openLogFile(path string, perm os.FileMode, maxSize int64, maxBackups int) (*logFile, error) {
+	f := &logFile{
+		path:          path,
+		perm:          perm,
+		maxSize:       maxSize,
+		maxBackups:    maxBackups,
+		checkInterval: logFileCheckInterval,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//open opens the file at path, appending to it, and closes the one being written if any.
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, f.perm)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.size = info.Size()
+	f.checked = time.Now()
+
+	return nil
+}
+
+//Write writes the line to the file, reopening or rotating it first when needed.
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if time.Since(f.checked) >= f.checkInterval {
+		f.checked = time.Now()
+		if f.moved() {
+			if err := f.open(); err != nil {
+				return 0, fmt.Errorf("couldn't reopen log file %s: %s", f.path, err)
+			}
+		}
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("couldn't rotate log file %s: %s", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+//moved tells if the path no longer leads to the file being written.
+func (f *logFile) moved() bool {
+	pathInfo, err := os.Stat(f.path)
+	if err != nil {
+		return true
+	}
+	fileInfo, err := f.file.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(pathInfo, fileInfo)
+}
+
+//rotate shifts the backups, dropping the oldest, moves the file to path.1 and opens a new one. Without backups the file is just removed.
+func (f *logFile) rotate() error {
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return f.open()
+}
+
+//Close closes the file, failing every write afterwards.
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,164 @@
+package goauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//readLines returns the lines of the file, or none if it doesn't exist.
+func readLines(path string) []string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil || len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestLogFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a max size, the log file should be rotated keeping the backups given", t, func() {
+		path := filepath.Join(dir, "size.log")
+		f, err := openLogFile(path, 0644, 100, 2)
+		So(err, ShouldBeNil)
+
+		//Every line is 30 bytes long, so 3 fit in a file.
+		for i := 0; i < 10; i++ {
+			_, err := fmt.Fprintf(f, "line %02d of the size test....\n", i)
+			So(err, ShouldBeNil)
+		}
+
+		So(readLines(path), ShouldResemble, []string{"line 09 of the size test...."})
+		So(readLines(path+".1"), ShouldResemble, []string{"line 06 of the size test....", "line 07 of the size test....", "line 08 of the size test...."})
+		So(readLines(path+".2"), ShouldResemble, []string{"line 03 of the size test....", "line 04 of the size test....", "line 05 of the size test...."})
+		_, err = os.Stat(path + ".3")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		So(f.Close(), ShouldBeNil)
+		_, err = f.Write([]byte("closed\n"))
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given no backups, the log file should be started again when full", t, func() {
+		path := filepath.Join(dir, "nobackups.log")
+		f, err := openLogFile(path, 0644, 100, 0)
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(f, "line %02d of the no backup test\n", i)
+		}
+		So(readLines(path), ShouldResemble, []string{"line 03 of the no backup test"})
+		_, err = os.Stat(path + ".1")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Given the log file moved or removed mid-run, new lines should land in a fresh file at its path", t, func() {
+		path := filepath.Join(dir, "moved.log")
+		f, err := openLogFile(path, 0644, 0, 0)
+		So(err, ShouldBeNil)
+		defer f.Close()
+		f.checkInterval = 0
+
+		fmt.Fprintln(f, "before rotating")
+		So(os.Rename(path, path+".rotated"), ShouldBeNil)
+		fmt.Fprintln(f, "after rotating")
+
+		So(readLines(path+".rotated"), ShouldResemble, []string{"before rotating"})
+		So(readLines(path), ShouldResemble, []string{"after rotating"})
+
+		So(os.Remove(path), ShouldBeNil)
+		fmt.Fprintln(f, "after removing")
+		So(readLines(path), ShouldResemble, []string{"after removing"})
+	})
+
+	Convey("Given concurrent writes while rotating, every line should be written once and whole", t, func() {
+		path := filepath.Join(dir, "concurrent.log")
+		f, err := openLogFile(path, 0644, 2048, 1000)
+		So(err, ShouldBeNil)
+		defer f.Close()
+		f.checkInterval = 0
+
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					fmt.Fprintf(f, "writer %d line %03d\n", w, i)
+				}
+			}(w)
+		}
+
+		//Rotate it as logrotate would meanwhile too.
+		for i := 0; i < 5; i++ {
+			os.Rename(path, fmt.Sprintf("%s.external%d", path, i))
+		}
+		wg.Wait()
+
+		paths, err := filepath.Glob(path + "*")
+		So(err, ShouldBeNil)
+		So(len(paths), ShouldBeGreaterThan, 5)
+
+		lineRe := regexp.MustCompile(`^writer \d line \d{3}$`)
+		seen := make(map[string]bool)
+		for _, p := range paths {
+			for _, line := range readLines(p) {
+				So(lineRe.MatchString(line), ShouldBeTrue)
+				So(seen[line], ShouldBeFalse)
+				seen[line] = true
+			}
+		}
+		So(seen, ShouldHaveLength, 1600)
+	})
+
+	Convey("Given log_dest file, the plugin should log to it and close it when cleaned up", t, func() {
+		path := filepath.Join(dir, "plugin.log")
+		pwPath, _ := filepath.Abs("../test-files/passwords")
+		aclPath, _ := filepath.Abs("../test-files/acls")
+
+		opts := map[string]string{
+			"backends":             "files",
+			"password_path":        pwPath,
+			"acl_path":             aclPath,
+			"log_dest":             "file",
+			"log_file":             path,
+			"log_file_max_mb":      "1",
+			"log_file_max_backups": "3",
+		}
+		var keys, values []string
+		for key, value := range opts {
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+
+		AuthPluginInit(keys, values, len(keys))
+		writer := commonData.LogFileWriter
+		So(writer, ShouldNotBeNil)
+		So(writer.maxSize, ShouldEqual, 1<<20)
+		So(writer.maxBackups, ShouldEqual, 3)
+
+		log.Error("logged to the file")
+		So(strings.Join(readLines(path), "\n"), ShouldContainSubstring, "logged to the file")
+
+		AuthPluginCleanup()
+		So(log.StandardLogger().Out, ShouldEqual, os.Stderr)
+		_, err := writer.Write([]byte("closed\n"))
+		So(err, ShouldBeError)
+	})
+
+}
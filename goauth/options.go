@@ -0,0 +1,217 @@
+package goauth
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//coreOptions are the auth options the plugin takes itself, whichever backends are enabled, along with the hasher options given for every backend hashing passwords at once.
+var coreOptions = append([]string{
+	"log_level", "log_dest", "log_file", "log_file_max_mb", "log_file_max_backups",
+	"log_syslog_network", "log_syslog_address", "log_syslog_tag",
+	"cache", "cache_host", "cache_port", "cache_password", "cache_db", "cache_reset",
+	"auth_cache_seconds", "acl_cache_seconds", "cache_min_ttl_seconds", "cache_max_ttl_seconds",
+	"check_prefix", "prefixes",
+	"plugin_path", "plugin_paths", "plugin_reload_interval_seconds",
+	"slow_check_warning_ms", "audit_log_file", "audit_log_max_per_second", "metrics_listen",
+	"strict_options",
+}, common.HasherOptions...)
+
+//backendOptions are the auth options each backend takes, by its name in backends.
+var backendOptions = map[string]bes.Options{
+	"postgres": bes.PostgresOptions,
+	"jwt":      bes.JWTOptions,
+	"redis":    bes.RedisOptions,
+	"http":     bes.HTTPOptions,
+	"files":    bes.FilesOptions,
+	"mysql":    bes.MysqlOptions,
+	"sqlite":   bes.SqliteOptions,
+	"mongo":    bes.MongoOptions,
+	"grpc":     bes.GRPCOptions,
+	"ldap":     bes.LDAPOptions,
+	"js":       bes.JSOptions,
+	"exec":     bes.ExecOptions,
+}
+
+//unknownOptions returns a warning for every given option neither the plugin nor any enabled backend takes, sorted by option, telling the backend taking it when it isn't enabled, or a known option it may be a typo of.
+//Custom plugins take options of their own, so when some plugin doesn't tell them, or didn't load, unknown options can't be told and it returns false.
+func unknownOptions(authOpts map[string]string, enabled []string, plugins []bes.CustomPlugin) ([]string, bool) {
+	taken := make(map[string]bool)
+	for _, key := range coreOptions {
+		taken[key] = true
+	}
+
+	for _, bename := range enabled {
+		if bename == "plugin" {
+			if len(plugins) < len(pluginPaths(authOpts)) {
+				return nil, false
+			}
+			for _, plug := range plugins {
+				options, ok := plug.Options()
+				if !ok {
+					return nil, false
+				}
+				for _, key := range options {
+					taken[key] = true
+				}
+			}
+			continue
+		}
+		for _, key := range backendOptions[bename].All(authOpts) {
+			taken[key] = true
+		}
+	}
+
+	var warnings []string
+	for _, key := range sortedKeys(authOpts) {
+		if taken[key] {
+			continue
+		}
+		if secret, ok := common.SecretFileOption(key); ok && taken[secret] {
+			continue
+		}
+		if bename := optionBackend(key); bename != "" {
+			warnings = append(warnings, fmt.Sprintf("option %s is for the %s backend, which isn't enabled", key, bename))
+		} else if similar := similarOption(key, enabled); similar != "" {
+			warnings = append(warnings, fmt.Sprintf("unknown option %s, did you mean %s?", key, similar))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("unknown option %s", key))
+		}
+	}
+
+	return warnings, true
+}
+
+//optionBackend returns the backend taking the option, if any, which for the file of a secret option is the one taking the option.
+func optionBackend(key string) string {
+	if secret, ok := common.SecretFileOption(key); ok {
+		key = secret
+	}
+
+	names := make([]string, 0, len(backendOptions))
+	for bename := range backendOptions {
+		names = append(names, bename)
+	}
+	sort.Strings(names)
+
+	for _, bename := range names {
+		for _, k := range backendOptions[bename].Keys {
+			if k == key {
+				return bename
+			}
+		}
+	}
+	return ""
+}
+
+//similarOption returns the option the plugin or an enabled backend takes that's closest to the unknown one, when it's at most 2 edits away so it's likely a typo of it.
+func similarOption(key string, enabled []string) string {
+	candidates := append([]string(nil), coreOptions...)
+	for _, bename := range enabled {
+		candidates = append(candidates, backendOptions[bename].Keys...)
+	}
+
+	similar, best := "", 3
+	for _, candidate := range candidates {
+		if d := editDistance(key, candidate); d < best {
+			similar, best = candidate, d
+		}
+	}
+	return similar
+}
+
+//editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+//minInt returns the least of the values.
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+//sortedKeys returns the options' keys sorted.
+func sortedKeys(authOpts map[string]string) []string {
+	keys := make([]string, 0, len(authOpts))
+	for key := range authOpts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//effectiveConfiguration formats the plugin's own configuration as it was applied, defaults included, with secrets redacted.
+func effectiveConfiguration() string {
+	pairs := []string{
+		"backends=" + strings.Join(backends, ","),
+		"log_level=" + commonData.LogLevel.String(),
+		"log_dest=" + commonData.LogDest,
+	}
+	if commonData.LogFile != "" {
+		pairs = append(pairs, "log_file="+commonData.LogFile)
+	}
+
+	pairs = append(pairs, "cache="+strconv.FormatBool(commonData.UseCache))
+	if commonData.UseCache {
+		pairs = append(pairs,
+			"cache_host="+cache.Host,
+			"cache_port="+cache.Port,
+			"cache_db="+strconv.Itoa(int(cache.DB)),
+			"cache_password="+common.Redact(cache.Password),
+			"auth_cache_seconds="+strconv.FormatInt(commonData.AuthCacheSeconds, 10),
+			"acl_cache_seconds="+strconv.FormatInt(commonData.AclCacheSeconds, 10),
+			"cache_min_ttl_seconds="+strconv.FormatInt(int64(commonData.CacheMinTTL.Seconds()), 10),
+			"cache_max_ttl_seconds="+strconv.FormatInt(int64(commonData.CacheMaxTTL.Seconds()), 10),
+		)
+	}
+
+	pairs = append(pairs, "check_prefix="+strconv.FormatBool(commonData.CheckPrefix))
+	if commonData.CheckPrefix {
+		prefixes := make([]string, 0, len(commonData.Prefixes))
+		for _, prefix := range sortedKeys(commonData.Prefixes) {
+			prefixes = append(prefixes, prefix+":"+commonData.Prefixes[prefix])
+		}
+		pairs = append(pairs, "prefixes="+strings.Join(prefixes, ","))
+	}
+
+	pairs = append(pairs,
+		"slow_check_warning_ms="+strconv.FormatInt(int64(commonData.SlowCheckWarning/time.Millisecond), 10),
+		"metrics_listen="+commonData.Metrics.Addr(),
+	)
+	if commonData.Audit != nil {
+		pairs = append(pairs,
+			"audit_log_file="+commonData.Audit.file.path,
+			"audit_log_max_per_second="+strconv.Itoa(commonData.Audit.maxPerSecond),
+		)
+	}
+
+	return strings.Join(pairs, " ")
+}
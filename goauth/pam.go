@@ -0,0 +1,19 @@
+//go:build pam
+// +build pam
+
+package goauth
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+)
+
+//The pam backend needs cgo and libpam, so it's only registered when built with the pam tag.
+func init() {
+	allowedBackends["pam"] = true
+	backendOptions["pam"] = bes.PAMOptions
+	taggedBackends["pam"] = func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return bes.NewPAM(authOpts, logLevel)
+	}
+}
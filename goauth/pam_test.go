@@ -0,0 +1,40 @@
+//go:build pam
+// +build pam
+
+package goauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPAMRegistration(t *testing.T) {
+
+	configDir, err := ioutil.TempDir("", "mosquitto-pam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+	if err := ioutil.WriteFile(filepath.Join(configDir, "mosquitto-test"), []byte("auth required pam_permit.so\naccount required pam_permit.so\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given the pam tag, the pam backend should be allowed and its options known", t, func() {
+		opts := map[string]string{
+			"backends":       "pam",
+			"pam_service":    "mosquitto-test",
+			"pam_config_dir": configDir,
+			"strict_options": "true",
+		}
+		So(Init(opts), ShouldBeNil)
+		defer AuthPluginCleanup()
+
+		So(Backends(), ShouldResemble, []string{"pam"})
+		So(AuthUnpwdCheck("test1", "test pw", "client"), ShouldBeTrue)
+	})
+
+}
@@ -181,7 +181,14 @@ func (m *CheckAclRequest) GetAcc() int32 {
 
 type AuthResponse struct {
 	// If the user is authorized/authenticated.
-	Ok                   bool     `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	Ok bool `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	// If the user is a superuser, so its acls needn't be checked.
+	IsSuperuser bool `protobuf:"varint,2,opt,name=is_superuser,json=isSuperuser,proto3" json:"is_superuser,omitempty"`
+	// Why the user was authorized/authenticated or not.
+	Reason string `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	// Seconds the response may be cached for. Zero leaves it to the plugin's
+	// cache settings, and a negative value means it must not be cached.
+	CacheTtlSeconds      int32    `protobuf:"varint,4,opt,name=cache_ttl_seconds,json=cacheTtlSeconds,proto3" json:"cache_ttl_seconds,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -219,6 +226,27 @@ func (m *AuthResponse) GetOk() bool {
 	return false
 }
 
+func (m *AuthResponse) GetIsSuperuser() bool {
+	if m != nil {
+		return m.IsSuperuser
+	}
+	return false
+}
+
+func (m *AuthResponse) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+func (m *AuthResponse) GetCacheTtlSeconds() int32 {
+	if m != nil {
+		return m.CacheTtlSeconds
+	}
+	return 0
+}
+
 type NameResponse struct {
 	// The name of the gRPC backend.
 	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
@@ -259,39 +287,148 @@ func (m *NameResponse) GetName() string {
 	return ""
 }
 
+type CheckAclStreamRequest struct {
+	// Id correlating the check with its response.
+	Id uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// The acl to check.
+	Check                *CheckAclRequest `protobuf:"bytes,2,opt,name=check,proto3" json:"check,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *CheckAclStreamRequest) Reset()         { *m = CheckAclStreamRequest{} }
+func (m *CheckAclStreamRequest) String() string { return proto.CompactTextString(m) }
+func (*CheckAclStreamRequest) ProtoMessage()    {}
+func (*CheckAclStreamRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8bbd6f3875b0e874, []int{5}
+}
+
+func (m *CheckAclStreamRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CheckAclStreamRequest.Unmarshal(m, b)
+}
+func (m *CheckAclStreamRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CheckAclStreamRequest.Marshal(b, m, deterministic)
+}
+func (m *CheckAclStreamRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CheckAclStreamRequest.Merge(m, src)
+}
+func (m *CheckAclStreamRequest) XXX_Size() int {
+	return xxx_messageInfo_CheckAclStreamRequest.Size(m)
+}
+func (m *CheckAclStreamRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CheckAclStreamRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CheckAclStreamRequest proto.InternalMessageInfo
+
+func (m *CheckAclStreamRequest) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+func (m *CheckAclStreamRequest) GetCheck() *CheckAclRequest {
+	if m != nil {
+		return m.Check
+	}
+	return nil
+}
+
+type CheckAclStreamResponse struct {
+	// Id of the check the response is for.
+	Id uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// The check's response.
+	Response             *AuthResponse `protobuf:"bytes,2,opt,name=response,proto3" json:"response,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *CheckAclStreamResponse) Reset()         { *m = CheckAclStreamResponse{} }
+func (m *CheckAclStreamResponse) String() string { return proto.CompactTextString(m) }
+func (*CheckAclStreamResponse) ProtoMessage()    {}
+func (*CheckAclStreamResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8bbd6f3875b0e874, []int{6}
+}
+
+func (m *CheckAclStreamResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CheckAclStreamResponse.Unmarshal(m, b)
+}
+func (m *CheckAclStreamResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CheckAclStreamResponse.Marshal(b, m, deterministic)
+}
+func (m *CheckAclStreamResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CheckAclStreamResponse.Merge(m, src)
+}
+func (m *CheckAclStreamResponse) XXX_Size() int {
+	return xxx_messageInfo_CheckAclStreamResponse.Size(m)
+}
+func (m *CheckAclStreamResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_CheckAclStreamResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CheckAclStreamResponse proto.InternalMessageInfo
+
+func (m *CheckAclStreamResponse) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+func (m *CheckAclStreamResponse) GetResponse() *AuthResponse {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*GetUserRequest)(nil), "grpc.GetUserRequest")
 	proto.RegisterType((*GetSuperuserRequest)(nil), "grpc.GetSuperuserRequest")
 	proto.RegisterType((*CheckAclRequest)(nil), "grpc.CheckAclRequest")
 	proto.RegisterType((*AuthResponse)(nil), "grpc.AuthResponse")
 	proto.RegisterType((*NameResponse)(nil), "grpc.NameResponse")
+	proto.RegisterType((*CheckAclStreamRequest)(nil), "grpc.CheckAclStreamRequest")
+	proto.RegisterType((*CheckAclStreamResponse)(nil), "grpc.CheckAclStreamResponse")
 }
 
 func init() { proto.RegisterFile("auth.proto", fileDescriptor_8bbd6f3875b0e874) }
 
 var fileDescriptor_8bbd6f3875b0e874 = []byte{
-	// 331 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x92, 0xdf, 0x4e, 0xc2, 0x30,
-	0x14, 0xc6, 0x61, 0x0c, 0xc5, 0x23, 0x41, 0x53, 0xd1, 0x4c, 0x4c, 0x0c, 0xe9, 0x15, 0x57, 0x23,
-	0x6a, 0x8c, 0xde, 0x19, 0x62, 0x0c, 0x5c, 0x79, 0x31, 0xe2, 0x03, 0x8c, 0x72, 0x84, 0x85, 0x41,
-	0x4b, 0xff, 0x68, 0x7c, 0x2c, 0xdf, 0xd0, 0x74, 0x65, 0xcb, 0x24, 0x59, 0xc2, 0x5d, 0xcf, 0x77,
-	0xfa, 0x9d, 0xaf, 0xfd, 0xe5, 0x00, 0xc4, 0x46, 0x2f, 0x43, 0x21, 0xb9, 0xe6, 0xc4, 0x5f, 0x48,
-	0xc1, 0x7a, 0x37, 0x0b, 0xce, 0x17, 0x29, 0x0e, 0x33, 0x6d, 0x66, 0x3e, 0x87, 0xb8, 0x16, 0xfa,
-	0xc7, 0x5d, 0xa1, 0x13, 0xe8, 0x8c, 0x51, 0x7f, 0x28, 0x94, 0x11, 0x6e, 0x0d, 0x2a, 0x4d, 0x7a,
-	0xd0, 0x32, 0x0a, 0xe5, 0x26, 0x5e, 0x63, 0x50, 0xef, 0xd7, 0x07, 0x27, 0x51, 0x51, 0xdb, 0x9e,
-	0x88, 0x95, 0xfa, 0xe6, 0x72, 0x1e, 0x78, 0xae, 0x97, 0xd7, 0xf4, 0x0e, 0x2e, 0xc6, 0xa8, 0xa7,
-	0x46, 0xa0, 0x34, 0x87, 0x8d, 0xa3, 0x5b, 0x38, 0x7b, 0x5d, 0x22, 0x5b, 0x8d, 0x58, 0x7a, 0x48,
-	0x7a, 0x17, 0x9a, 0x9a, 0x8b, 0x84, 0xed, 0xa2, 0x5d, 0x61, 0x1d, 0x2c, 0x4d, 0x70, 0xa3, 0x93,
-	0x79, 0xd0, 0x70, 0x8e, 0xbc, 0x26, 0xe7, 0xd0, 0x88, 0x19, 0x0b, 0xfc, 0x7e, 0x7d, 0xd0, 0x8c,
-	0xec, 0x91, 0xde, 0x42, 0x7b, 0x64, 0xf4, 0x32, 0x42, 0x25, 0xf8, 0x46, 0x21, 0xe9, 0x80, 0xc7,
-	0x57, 0x59, 0x52, 0x2b, 0xf2, 0xf8, 0x8a, 0x52, 0x68, 0xbf, 0xc7, 0x6b, 0x2c, 0xfa, 0x04, 0xfc,
-	0xd2, 0x5b, 0xb2, 0xf3, 0xfd, 0xaf, 0x07, 0xa7, 0x76, 0xc8, 0x14, 0xe5, 0x57, 0xc2, 0x90, 0x3c,
-	0xc2, 0xf1, 0x8e, 0x21, 0xe9, 0x86, 0x16, 0x79, 0xf8, 0x1f, 0x69, 0x8f, 0x38, 0xb5, 0x1c, 0x4c,
-	0x6b, 0xe4, 0x05, 0xda, 0x65, 0x60, 0xe4, 0xba, 0xf0, 0xee, 0x43, 0xac, 0x18, 0xf0, 0x04, 0xad,
-	0x1c, 0x1f, 0xb9, 0x74, 0x37, 0xf6, 0x70, 0x56, 0x1a, 0xed, 0x83, 0xed, 0x3f, 0xc9, 0x55, 0xe8,
-	0xb6, 0x23, 0xcc, 0xb7, 0x23, 0x7c, 0xb3, 0xdb, 0x91, 0x1b, 0xcb, 0x2c, 0x68, 0x8d, 0x3c, 0x83,
-	0x3f, 0x89, 0x53, 0x5d, 0xe9, 0xaa, 0xd0, 0x69, 0x6d, 0x76, 0x94, 0x29, 0x0f, 0x7f, 0x01, 0x00,
-	0x00, 0xff, 0xff, 0xc9, 0x8a, 0xd9, 0x7b, 0x9f, 0x02, 0x00, 0x00,
+	// 466 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x53, 0xcf, 0x6f, 0xd3, 0x30,
+	0x14, 0x6e, 0xd2, 0x74, 0x84, 0xd7, 0xaa, 0x83, 0xc7, 0x56, 0x95, 0x8e, 0xc3, 0xf0, 0xa9, 0x02,
+	0x29, 0x83, 0x21, 0x34, 0x6e, 0x68, 0x42, 0x68, 0x3b, 0x21, 0x91, 0x0e, 0x89, 0x5b, 0x95, 0x39,
+	0x8f, 0x36, 0x6a, 0x1a, 0x67, 0xb6, 0x03, 0xe2, 0x0e, 0xff, 0x37, 0x4a, 0x1c, 0x87, 0xa6, 0x6a,
+	0xa5, 0xde, 0xfc, 0x7e, 0x7c, 0xdf, 0xe7, 0xf7, 0xf9, 0x19, 0x20, 0x2a, 0xf4, 0x32, 0xc8, 0xa5,
+	0xd0, 0x02, 0xbd, 0x85, 0xcc, 0xf9, 0xe4, 0x6c, 0x21, 0xc4, 0x22, 0xa5, 0x8b, 0x2a, 0x77, 0x5f,
+	0xfc, 0xb8, 0xa0, 0x75, 0xae, 0x7f, 0x9b, 0x16, 0x76, 0x0b, 0xc3, 0x1b, 0xd2, 0xdf, 0x14, 0xc9,
+	0x90, 0x1e, 0x0a, 0x52, 0x1a, 0x27, 0xe0, 0x17, 0x8a, 0x64, 0x16, 0xad, 0x69, 0xec, 0x9c, 0x3b,
+	0xd3, 0xc7, 0x61, 0x13, 0x97, 0xb5, 0x3c, 0x52, 0xea, 0x97, 0x90, 0xf1, 0xd8, 0x35, 0x35, 0x1b,
+	0xb3, 0xb7, 0xf0, 0xec, 0x86, 0xf4, 0xac, 0xc8, 0x49, 0x16, 0x87, 0xd1, 0xb1, 0x07, 0x38, 0xfe,
+	0xb4, 0x24, 0xbe, 0xba, 0xe6, 0xe9, 0x21, 0xea, 0x27, 0xd0, 0xd3, 0x22, 0x4f, 0x78, 0x2d, 0x6d,
+	0x82, 0x12, 0xc1, 0xd3, 0x84, 0x32, 0x9d, 0xc4, 0xe3, 0xae, 0x41, 0xd8, 0x18, 0x9f, 0x40, 0x37,
+	0xe2, 0x7c, 0xec, 0x9d, 0x3b, 0xd3, 0x5e, 0x58, 0x1e, 0xd9, 0x5f, 0x07, 0x06, 0xd7, 0x85, 0x5e,
+	0x86, 0xa4, 0x72, 0x91, 0x29, 0xc2, 0x21, 0xb8, 0x62, 0x55, 0x49, 0xf9, 0xa1, 0x2b, 0x56, 0xf8,
+	0x12, 0x06, 0x89, 0x9a, 0x2b, 0x3b, 0x46, 0xa5, 0xe5, 0x87, 0xfd, 0x44, 0x35, 0x93, 0xe1, 0x08,
+	0x8e, 0x24, 0x45, 0x4a, 0x64, 0xb5, 0x5e, 0x1d, 0xe1, 0x2b, 0x78, 0xca, 0x23, 0xbe, 0xa4, 0xb9,
+	0xd6, 0xe9, 0x5c, 0x11, 0x17, 0x59, 0xac, 0x6a, 0xed, 0xe3, 0xaa, 0x70, 0xa7, 0xd3, 0x99, 0x49,
+	0x33, 0x06, 0x83, 0x2f, 0xd1, 0x9a, 0x9a, 0x6b, 0x20, 0x78, 0x1b, 0x33, 0x57, 0x67, 0x76, 0x07,
+	0xa7, 0xd6, 0x9e, 0x99, 0x96, 0x14, 0xad, 0xad, 0x49, 0x43, 0x70, 0x93, 0xb8, 0x6a, 0xf5, 0x42,
+	0x37, 0x89, 0xf1, 0x35, 0xf4, 0x78, 0xd9, 0x58, 0x5d, 0xb6, 0x7f, 0x79, 0x1a, 0x94, 0xef, 0x1e,
+	0x6c, 0x59, 0x1b, 0x9a, 0x1e, 0xf6, 0x1d, 0x46, 0xdb, 0xac, 0xff, 0xad, 0x68, 0xd1, 0x06, 0xe0,
+	0xcb, 0xba, 0x56, 0x33, 0xa3, 0x61, 0xde, 0x34, 0x30, 0x6c, 0x7a, 0x2e, 0xff, 0x74, 0xa1, 0x5f,
+	0x96, 0x66, 0x24, 0x7f, 0x26, 0x9c, 0xf0, 0x3d, 0x3c, 0xaa, 0x77, 0x0b, 0x4f, 0x0c, 0xb0, 0xbd,
+	0x6a, 0x93, 0x1d, 0x74, 0xac, 0x83, 0x1f, 0x61, 0xb0, 0xb9, 0x48, 0xf8, 0xbc, 0xc1, 0x6e, 0x2f,
+	0xd7, 0x1e, 0x82, 0x2b, 0xf0, 0xed, 0x84, 0xb8, 0xdb, 0x8b, 0x3d, 0xc0, 0xaf, 0x30, 0x6c, 0x5b,
+	0x83, 0x67, 0x6d, 0x78, 0xeb, 0x19, 0x26, 0x2f, 0x76, 0x17, 0x2d, 0xdd, 0xd4, 0x79, 0xe3, 0xe0,
+	0x55, 0xe5, 0x41, 0xf9, 0xd4, 0x38, 0x0a, 0xcc, 0x47, 0x0c, 0xec, 0x47, 0x0c, 0x3e, 0x97, 0x1f,
+	0xd1, 0xde, 0x65, 0x73, 0x1d, 0x58, 0x07, 0x3f, 0x80, 0x77, 0x1b, 0xa5, 0x7a, 0x2f, 0x6a, 0x4f,
+	0x9e, 0x75, 0xee, 0x8f, 0xaa, 0xcc, 0xbb, 0x7f, 0x03, 0x00, 0xf8, 0x24, 0x7d, 0xf3, 0x0a, 0x04,
+	0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -312,6 +449,9 @@ type AuthServiceClient interface {
 	GetSuperuser(ctx context.Context, in *GetSuperuserRequest, opts ...grpc.CallOption) (*AuthResponse, error)
 	// CheckAcl checks user's authorization for the given topic.
 	CheckAcl(ctx context.Context, in *CheckAclRequest, opts ...grpc.CallOption) (*AuthResponse, error)
+	// CheckAclStream checks many acls over a single stream, answering each
+	// check with the id it was sent with, in any order.
+	CheckAclStream(ctx context.Context, opts ...grpc.CallOption) (AuthService_CheckAclStreamClient, error)
 	// GetName retrieves the name of the backend.
 	GetName(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*NameResponse, error)
 	// Halt signals the backend to halt.
@@ -353,6 +493,37 @@ func (c *authServiceClient) CheckAcl(ctx context.Context, in *CheckAclRequest, o
 	return out, nil
 }
 
+func (c *authServiceClient) CheckAclStream(ctx context.Context, opts ...grpc.CallOption) (AuthService_CheckAclStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_AuthService_serviceDesc.Streams[0], "/grpc.AuthService/CheckAclStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &authServiceCheckAclStreamClient{stream}
+	return x, nil
+}
+
+type AuthService_CheckAclStreamClient interface {
+	Send(*CheckAclStreamRequest) error
+	Recv() (*CheckAclStreamResponse, error)
+	grpc.ClientStream
+}
+
+type authServiceCheckAclStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *authServiceCheckAclStreamClient) Send(m *CheckAclStreamRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *authServiceCheckAclStreamClient) Recv() (*CheckAclStreamResponse, error) {
+	m := new(CheckAclStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *authServiceClient) GetName(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*NameResponse, error) {
 	out := new(NameResponse)
 	err := c.cc.Invoke(ctx, "/grpc.AuthService/GetName", in, out, opts...)
@@ -379,6 +550,9 @@ type AuthServiceServer interface {
 	GetSuperuser(context.Context, *GetSuperuserRequest) (*AuthResponse, error)
 	// CheckAcl checks user's authorization for the given topic.
 	CheckAcl(context.Context, *CheckAclRequest) (*AuthResponse, error)
+	// CheckAclStream checks many acls over a single stream, answering each
+	// check with the id it was sent with, in any order.
+	CheckAclStream(AuthService_CheckAclStreamServer) error
 	// GetName retrieves the name of the backend.
 	GetName(context.Context, *empty.Empty) (*NameResponse, error)
 	// Halt signals the backend to halt.
@@ -443,6 +617,32 @@ func _AuthService_CheckAcl_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AuthService_CheckAclStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AuthServiceServer).CheckAclStream(&authServiceCheckAclStreamServer{stream})
+}
+
+type AuthService_CheckAclStreamServer interface {
+	Send(*CheckAclStreamResponse) error
+	Recv() (*CheckAclStreamRequest, error)
+	grpc.ServerStream
+}
+
+type authServiceCheckAclStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *authServiceCheckAclStreamServer) Send(m *CheckAclStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *authServiceCheckAclStreamServer) Recv() (*CheckAclStreamRequest, error) {
+	m := new(CheckAclStreamRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _AuthService_GetName_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(empty.Empty)
 	if err := dec(in); err != nil {
@@ -504,6 +704,13 @@ var _AuthService_serviceDesc = grpc.ServiceDesc{
 			Handler:    _AuthService_Halt_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CheckAclStream",
+			Handler:       _AuthService_CheckAclStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "auth.proto",
 }
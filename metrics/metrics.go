@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Checks told apart by the metrics.
+const (
+	CheckAuth = "auth"
+	CheckAcl  = "acl"
+)
+
+// Results of a check made by a backend. A backend is unavailable when it
+// couldn't tell, e.g. it was unhealthy and skipped or a plugin failed.
+const (
+	ResultAllow       = "allow"
+	ResultDeny        = "deny"
+	ResultUnavailable = "unavailable"
+)
+
+// DurationBuckets are the upper bounds in seconds of the check duration
+// histograms' buckets.
+var DurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// shutdownTimeout is how long Close waits for scrapes being served.
+const shutdownTimeout = 5 * time.Second
+
+// Metrics counts the checks made by backends along with their duration, and
+// the cache hits and misses, exposing them with the backends' health through
+// a Prometheus registry of its own. A nil Metrics counts nothing, so callers
+// needn't tell whether metrics are enabled.
+type Metrics struct {
+	registry  *prometheus.Registry
+	checks    *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	cache     *prometheus.CounterVec
+	handler   http.Handler
+	server    *http.Server
+	listener  net.Listener
+	done      chan struct{}
+}
+
+// healthCollector collects whether each backend is healthy when scraped, as
+// backends may come and go with their health.
+type healthCollector struct {
+	desc   *prometheus.Desc
+	health func() map[string]bool
+}
+
+// New returns metrics telling the backends' health with the given func,
+// which returns whether each backend is healthy by its name.
+func New(health func() map[string]bool) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mosquitto_auth_checks_total",
+			Help: "Checks made by each backend, by check and result.",
+		}, []string{"backend", "check", "result"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mosquitto_auth_check_duration_seconds",
+			Help:    "Time taken by each backend to answer checks.",
+			Buckets: DurationBuckets,
+		}, []string{"backend", "check"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mosquitto_auth_cache_requests_total",
+			Help: "Cache lookups, by check and whether they hit.",
+		}, []string{"check", "result"}),
+	}
+
+	m.registry.MustRegister(m.checks, m.durations, m.cache)
+	if health != nil {
+		m.registry.MustRegister(&healthCollector{
+			desc:   prometheus.NewDesc("mosquitto_auth_backend_healthy", "Whether each backend is healthy, 0 while checks skip it.", []string{"backend"}, nil),
+			health: health,
+		})
+	}
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+
+	return m
+}
+
+// Describe sends the description of the backends' health.
+func (c *healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect sends whether each backend is healthy.
+func (c *healthCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, healthy := range c.health() {
+		value := 0.0
+		if healthy {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, name)
+	}
+}
+
+// ObserveCheck counts a check answered by the backend with its result and
+// the time it took.
+func (m *Metrics) ObserveCheck(check, backend, result string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.checks.WithLabelValues(backend, check, result).Inc()
+	m.durations.WithLabelValues(backend, check).Observe(duration.Seconds())
+}
+
+// CountCheck counts a check the backend wasn't asked, e.g. as it was
+// unhealthy, so its duration isn't observed.
+func (m *Metrics) CountCheck(check, backend, result string) {
+	if m == nil {
+		return
+	}
+
+	m.checks.WithLabelValues(backend, check, result).Inc()
+}
+
+// ObserveCache counts a cache lookup for the check as a hit or a miss.
+func (m *Metrics) ObserveCache(check string, hit bool) {
+	if m == nil {
+		return
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	m.cache.WithLabelValues(check, result).Inc()
+}
+
+// Listen serves the metrics at /metrics on the address until closed.
+func (m *Metrics) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "metrics listen error on %s", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	m.listener = listener
+	m.server = &http.Server{Handler: mux}
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+		m.server.Serve(listener)
+	}()
+
+	return nil
+}
+
+// Addr returns the address the metrics are served at, which tells the port
+// picked when listening on port 0.
+func (m *Metrics) Addr() string {
+	if m == nil || m.listener == nil {
+		return ""
+	}
+	return m.listener.Addr().String()
+}
+
+// Close stops serving the metrics, waiting a while for scrapes being served.
+func (m *Metrics) Close() error {
+	if m == nil || m.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := m.server.Shutdown(ctx)
+	<-m.done
+	return err
+}
+
+// ServeHTTP serves the metrics with Prometheus' handler, in the format the
+// scraper asks for.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetrics(t *testing.T) {
+
+	Convey("Given nil metrics, counting should do nothing", t, func() {
+		var m *Metrics
+		So(func() {
+			m.ObserveCheck(CheckAuth, "files", ResultAllow, time.Millisecond)
+			m.CountCheck(CheckAcl, "grpc", ResultUnavailable)
+			m.ObserveCache(CheckAuth, true)
+			m.Close()
+		}, ShouldNotPanic)
+		So(m.Addr(), ShouldBeEmpty)
+	})
+
+	Convey("Given observed checks, they should be served in Prometheus' text format", t, func() {
+		m := New(func() map[string]bool {
+			return map[string]bool{"grpc": false, "files": true}
+		})
+
+		m.ObserveCheck(CheckAuth, "files", ResultAllow, 300*time.Microsecond)
+		m.ObserveCheck(CheckAuth, "files", ResultDeny, 2*time.Millisecond)
+		m.ObserveCheck(CheckAuth, "files", ResultDeny, 20*time.Second)
+		m.CountCheck(CheckAcl, "grpc", ResultUnavailable)
+		m.ObserveCheck(CheckAcl, `odd"name`, ResultAllow, time.Millisecond)
+		m.ObserveCache(CheckAcl, true)
+		m.ObserveCache(CheckAcl, false)
+		m.ObserveCache(CheckAcl, false)
+
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		So(rec.Header().Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+		body := rec.Body.String()
+		lines := strings.Split(body, "\n")
+
+		So(lines, ShouldContain, `mosquitto_auth_checks_total{backend="files",check="auth",result="allow"} 1`)
+		So(lines, ShouldContain, `mosquitto_auth_checks_total{backend="files",check="auth",result="deny"} 2`)
+		So(lines, ShouldContain, `mosquitto_auth_checks_total{backend="grpc",check="acl",result="unavailable"} 1`)
+		So(lines, ShouldContain, `mosquitto_auth_checks_total{backend="odd\"name",check="acl",result="allow"} 1`)
+
+		//Buckets are cumulative, with the 20s check only in +Inf, and the unavailable check has no duration.
+		So(lines, ShouldContain, `mosquitto_auth_check_duration_seconds_bucket{backend="files",check="auth",le="0.0005"} 1`)
+		So(lines, ShouldContain, `mosquitto_auth_check_duration_seconds_bucket{backend="files",check="auth",le="0.001"} 1`)
+		So(lines, ShouldContain, `mosquitto_auth_check_duration_seconds_bucket{backend="files",check="auth",le="0.0025"} 2`)
+		So(lines, ShouldContain, `mosquitto_auth_check_duration_seconds_bucket{backend="files",check="auth",le="10"} 2`)
+		So(lines, ShouldContain, `mosquitto_auth_check_duration_seconds_bucket{backend="files",check="auth",le="+Inf"} 3`)
+		So(lines, ShouldContain, `mosquitto_auth_check_duration_seconds_sum{backend="files",check="auth"} 20.0023`)
+		So(lines, ShouldContain, `mosquitto_auth_check_duration_seconds_count{backend="files",check="auth"} 3`)
+		So(body, ShouldNotContainSubstring, `mosquitto_auth_check_duration_seconds_count{backend="grpc"`)
+
+		So(lines, ShouldContain, `mosquitto_auth_cache_requests_total{check="acl",result="hit"} 1`)
+		So(lines, ShouldContain, `mosquitto_auth_cache_requests_total{check="acl",result="miss"} 2`)
+
+		So(lines, ShouldContain, `mosquitto_auth_backend_healthy{backend="files"} 1`)
+		So(lines, ShouldContain, `mosquitto_auth_backend_healthy{backend="grpc"} 0`)
+		So(lines, ShouldContain, "# TYPE mosquitto_auth_check_duration_seconds histogram")
+		So(lines, ShouldContain, "# TYPE mosquitto_auth_backend_healthy gauge")
+	})
+
+	Convey("Given metrics listening, they should be scraped at /metrics", t, func() {
+		m := New(func() map[string]bool {
+			return map[string]bool{"files": true}
+		})
+		So(m.Listen("127.0.0.1:0"), ShouldBeNil)
+		defer m.Close()
+
+		m.ObserveCache(CheckAuth, true)
+
+		resp, err := http.Get("http://" + m.Addr() + "/metrics")
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		So(string(body), ShouldContainSubstring, `mosquitto_auth_cache_requests_total{check="auth",result="hit"} 1`)
+		So(string(body), ShouldContainSubstring, `mosquitto_auth_backend_healthy{backend="files"} 1`)
+	})
+
+	Convey("Given a listen address in use, listening should fail", t, func() {
+		m := New(nil)
+		So(m.Listen("127.0.0.1:0"), ShouldBeNil)
+		defer m.Close()
+
+		other := New(nil)
+		So(other.Listen(m.Addr()), ShouldBeError)
+		So(other.Close(), ShouldBeNil)
+	})
+
+}
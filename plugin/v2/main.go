@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/iegomez/mosquitto-go-auth/pluginapi"
+	log "github.com/sirupsen/logrus"
+)
+
+func GetPlugin() pluginapi.PluginV2 {
+	return pluginapi.PluginV2{
+		Version: func() string {
+			return "1.0.0"
+		},
+		Init: func(authOpts map[string]string, logLevel log.Level) error {
+			//Initialize your plugin with the necessary options
+			log.Infof("Plugin initialized!")
+			log.Infof("Received %d options.", len(authOpts))
+			return nil
+		},
+		GetName: func() string {
+			return "Custom v2 plugin"
+		},
+		GetUser: func(username, password string) (bool, error) {
+			log.Infof("Checking get user with custom v2 plugin.")
+			return false, nil
+		},
+		GetSuperuser: func(username string) (bool, error) {
+			log.Infof("Checking get superuser with custom v2 plugin.")
+			return false, nil
+		},
+		CheckAcl: func(username, topic, clientid string, acc int) (bool, error) {
+			log.Infof("Checking acl with custom v2 plugin.")
+			return false, nil
+		},
+		Halt: func() {
+			//Do whatever cleanup is needed.
+		},
+		Options: func() []string {
+			//Tell the options your plugin takes, so they aren't reported as unknown.
+			return nil
+		},
+	}
+}
@@ -0,0 +1,32 @@
+//Package pluginapi defines the contract custom plugins may implement, which lets them report errors apart from denials.
+package pluginapi
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+//PluginV2 holds the funcs of a plugin implementing the v2 contract, handed to mosquitto-go-auth by the plugin's exported GetPlugin func:
+//
+//	func GetPlugin() pluginapi.PluginV2
+//
+//Every func but GetUserWithClientid, Halt and Options must be set. Checks return an error when they couldn't tell, e.g. because a service they ask is down, which denies the check without caching the denial.
+type PluginV2 struct {
+	//Version returns the version of the plugin, which is logged when it's loaded.
+	Version func() string
+	//Init initializes the plugin with every auth option.
+	Init func(authOpts map[string]string, logLevel log.Level) error
+	//GetName returns the plugin's name, used for logging.
+	GetName func() string
+	//GetUser checks the user's password.
+	GetUser func(username, password string) (bool, error)
+	//GetUserWithClientid checks the user's password for a client id, e.g. for credentials bound to a device. When set, it's used instead of GetUser.
+	GetUserWithClientid func(username, password, clientid string) (bool, error)
+	//GetSuperuser checks if the user is a superuser.
+	GetSuperuser func(username string) (bool, error)
+	//CheckAcl checks if the user may access the topic, with acc being mosquitto's access level.
+	CheckAcl func(username, topic, clientid string, acc int) (bool, error)
+	//Halt cleans up when mosquitto halts.
+	Halt func()
+	//Options returns the auth options the plugin takes, so they aren't reported as unknown. When not set, unknown options can't be told apart from the plugin's, so none are reported.
+	Options func() []string
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/iegomez/mosquitto-go-auth/common"
 )
@@ -11,18 +16,244 @@ import (
 const saltSize = 16
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs pw with the given arguments and returns its exit code: 0 when
+// done or, when verifying, the password matches, 1 when it doesn't match or
+// something failed, and 2 when the flags are wrong.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+
+	flags := flag.NewFlagSet("pw", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	var algorithm = flags.String("a", "sha512", "algorithm (sha256, bcrypt, argon2id or scrypt, or default: sha512)")
+	var HashIterations = flags.Int("i", 100000, "PBKDF2 hash iterations (default: 100000)")
+	var salt = flags.Int("s", saltSize, "PBKDF2, argon2id and scrypt salt size in bytes (default: 16)")
+	var saltEncoding = flags.String("e", common.SaltEncodingBase64, "PBKDF2 salt encoding (utf-8 or default: base64)")
+	var cost = flags.Int("cost", 10, "bcrypt cost, between 4 and 31 (default: 10)")
+	var memory = flags.Uint("m", 65536, "argon2id memory in KiB (default: 65536)")
+	var passes = flags.Uint("t", 3, "argon2id time (default: 3)")
+	var parallelism = flags.Uint("par", 4, "argon2id and scrypt parallelism (default: 4 for argon2id, 1 for scrypt)")
+	var logN = flags.Int("ln", 16, "scrypt cost, as the base 2 logarithm of N (default: 16)")
+	var blockSize = flags.Int("r", 8, "scrypt block size (default: 8)")
+	var keyLen = flags.Int("l", 0, "hash length in bytes (default: the digest size for PBKDF2, 32 for argon2id and scrypt)")
+	var pepper = flags.String("pepper", "", "pepper combined with the password, not usable with bcrypt")
+	var pepperFile = flags.String("pepper-file", "", "file holding the pepper combined with the password")
+	var password = flags.String("p", "", "password")
+	var fromStdin = flags.Bool("stdin", false, "read the password from the first line of stdin instead of -p")
+	var verify = flags.String("verify", "", "verify the password read from the first line of stdin against this hash, exiting with 0 when it matches and 1 otherwise")
+	var batch = flags.String("batch", "", "read username:password lines from this file, or stdin when -, and print username:hash lines for the files backend")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	passwordGiven, parallelismGiven := false, false
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			passwordGiven = true
+		case "par":
+			parallelismGiven = true
+		}
+	})
+
+	switch {
+	case flags.NArg() > 0:
+		fmt.Fprintf(stderr, "error: unexpected arguments %s\n", strings.Join(flags.Args(), " "))
+		return 2
+	case *verify != "" && *batch != "":
+		fmt.Fprintln(stderr, "error: verify and batch can't be both given")
+		return 2
+	case (*verify != "" || *batch != "") && (passwordGiven || *fromStdin):
+		fmt.Fprintln(stderr, "error: p and stdin can't be given with verify or batch, which read passwords themselves")
+		return 2
+	case passwordGiven && *fromStdin:
+		fmt.Fprintln(stderr, "error: p and stdin can't be both given")
+		return 2
+	}
+
+	hasher := common.DefaultHasher()
+	hasher.Iterations = *HashIterations
+	hasher.SaltSize = *salt
+	hasher.SaltEncoding = *saltEncoding
+	hasher.KeyLen = *keyLen
+	hasher.Cost = *cost
+	hasher.Memory = uint32(*memory)
+	hasher.Time = uint32(*passes)
+	hasher.Parallelism = uint8(*parallelism)
+	hasher.LogN = *logN
+	hasher.BlockSize = *blockSize
+	if parallelismGiven {
+		hasher.ScryptParallelism = int(*parallelism)
+	}
+
+	var err error
+	switch {
+	case *algorithm == "sha512" || *algorithm == "sha256":
+		hasher.Format = common.HashPBKDF2
+		hasher.Algorithm = *algorithm
+	case *algorithm == common.HashBcrypt || *algorithm == common.HashArgon2id || *algorithm == common.HashScrypt:
+		hasher.Format = *algorithm
+	default:
+		err = fmt.Errorf("unknown algorithm %s", *algorithm)
+	}
+	switch {
+	case err != nil:
+	case *parallelism > 255:
+		err = fmt.Errorf("parallelism must be at most 255, got %d", *parallelism)
+	case *saltEncoding != common.SaltEncodingBase64 && *saltEncoding != common.SaltEncodingUTF8:
+		err = fmt.Errorf("unknown salt encoding %s", *saltEncoding)
+	case *pepper != "" && *pepperFile != "":
+		err = fmt.Errorf("pepper and pepper-file can't be both given")
+	case *pepperFile != "":
+		hasher.Pepper, err = common.ReadPepper(*pepperFile)
+	default:
+		hasher.Pepper = []byte(*pepper)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err)
+		return 1
+	}
+
+	switch {
+	case *verify != "":
+		return verifyPassword(hasher, *verify, stdin, stderr)
+	case *batch != "":
+		return hashBatch(hasher, *batch, stdin, stdout, stderr)
+	}
+
+	if *fromStdin {
+		*password, err = readPassword(stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %s\n", err)
+			return 1
+		}
+	}
+
+	pwHash, err := hasher.Hash(*password)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, pwHash)
+
+	return 0
+}
+
+// readPassword reads the password from the first line of r, without its
+// line break.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("couldn't read the password from stdin: %s", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("no password read from stdin")
+	}
+	return line, nil
+}
+
+// verifyPassword verifies the password read from stdin against the hash,
+// which may be of any format the backends take.
+func verifyPassword(hasher common.Hasher, hash string, stdin io.Reader, stderr io.Writer) int {
+	if common.HashFormat(hash) == "" {
+		fmt.Fprintln(stderr, "error: unknown hash format, it must be a PBKDF2, bcrypt, argon2id or scrypt one")
+		return 1
+	}
+
+	password, err := readPassword(stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err)
+		return 1
+	}
+
+	if !hasher.Compare(password, hash) {
+		fmt.Fprintln(stderr, "password doesn't match")
+		return 1
+	}
 
-	var algorithm = flag.String("a", "sha512", "algorithm (sha256 or default: sha512)")
-	var HashIterations = flag.Int("i", 100000, "hash iterations (default: 100000)")
-	var password = flag.String("p", "", "password")
+	return 0
+}
+
+// hashBatch hashes the passwords of the username:password lines of the file,
+// skipping empty and comment lines as the files backend does, and prints
+// username:hash lines. Nothing is printed unless every line is fine, so a
+// passwords file isn't written with users missing.
+func hashBatch(hasher common.Hasher, path string, stdin io.Reader, stdout, stderr io.Writer) int {
+	input := stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: couldn't open batch file: %s\n", err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+
+	var output bytes.Buffer
+	seen := make(map[string]int)
+	failed := false
+
+	scanner := bufio.NewScanner(input)
+	index := 0
+	for scanner.Scan() {
+		index++
+
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(strings.Replace(line, " ", "", -1)) == 0 || line[0:1] == "#" {
+			continue
+		}
 
-	flag.Parse()
+		lineArr := strings.SplitN(line, ":", 2)
+		var err error
+		switch {
+		case len(lineArr) != 2:
+			err = fmt.Errorf("it must be username:password")
+		case lineArr[0] == "":
+			err = fmt.Errorf("empty username")
+		case lineArr[1] == "":
+			err = fmt.Errorf("empty password for user %s", lineArr[0])
+		case seen[lineArr[0]] > 0:
+			err = fmt.Errorf("user %s was already given at line %d", lineArr[0], seen[lineArr[0]])
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error: line %d: %s\n", index, err)
+			failed = true
+			continue
+		}
+		seen[lineArr[0]] = index
+
+		//Once a line failed nothing is printed, so there's no point hashing the rest, which is only checked.
+		if failed {
+			continue
+		}
+
+		pwHash, err := hasher.Hash(lineArr[1])
+		if err != nil {
+			fmt.Fprintf(stderr, "error: line %d: %s\n", index, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(&output, "%s:%s\n", lineArr[0], pwHash)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(stderr, "error: couldn't read batch file after line %d: %s\n", index, err)
+		return 1
+	}
+
+	if failed {
+		return 1
+	}
 
-	pwHash, err := common.Hash(*password, saltSize, *HashIterations, *algorithm)
+	_, err := output.WriteTo(stdout)
 	if err != nil {
-		fmt.Errorf("error: %s\n", err)
-	} else {
-		fmt.Println(pwHash)
+		fmt.Fprintf(stderr, "error: %s\n", err)
+		return 1
 	}
 
+	return 0
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//runPw runs pw with the arguments and stdin, returning its exit code, stdout and stderr.
+func runPw(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestGenerate(t *testing.T) {
+
+	Convey("Given a password, pw should print its hash in every format", t, func() {
+		for _, args := range [][]string{
+			{"-i", "1000"},
+			{"-a", "sha256", "-i", "1000", "-e", "utf-8", "-l", "24"},
+			{"-a", "bcrypt", "-cost", "4"},
+			{"-a", "argon2id", "-m", "64", "-t", "1", "-par", "1"},
+		} {
+			code, stdout, stderr := runPw("", append(args, "-p", "testpw")...)
+			So(code, ShouldEqual, 0)
+			So(stderr, ShouldBeEmpty)
+			So(stdout, ShouldEndWith, "\n")
+
+			hasher := common.DefaultHasher()
+			if args[1] == "sha256" {
+				hasher.SaltEncoding = common.SaltEncodingUTF8
+			}
+			So(hasher.Compare("testpw", strings.TrimSuffix(stdout, "\n")), ShouldBeTrue)
+		}
+	})
+
+	Convey("Given stdin, pw should hash the password in its first line", t, func() {
+		code, stdout, _ := runPw("testpw\r\nignored\n", "-stdin", "-i", "1000")
+		So(code, ShouldEqual, 0)
+		So(common.HashCompare("testpw", strings.TrimSuffix(stdout, "\n")), ShouldBeTrue)
+
+		code, stdout, stderr := runPw("", "-stdin")
+		So(code, ShouldEqual, 1)
+		So(stdout, ShouldBeEmpty)
+		So(stderr, ShouldContainSubstring, "no password")
+	})
+
+	Convey("Given wrong flags or parameters, pw should fail without printing a hash", t, func() {
+		for _, args := range [][]string{
+			{"-p", "testpw", "-stdin"},
+			{"-p", "testpw", "-verify", "PBKDF2$sha512$1$c2FsdA==$aGFzaA=="},
+			{"-stdin", "-batch", "-"},
+			{"-verify", "PBKDF2$sha512$1$c2FsdA==$aGFzaA==", "-batch", "-"},
+			{"-p", "testpw", "extra"},
+			{"-unknown"},
+		} {
+			code, stdout, stderr := runPw("testpw\n", args...)
+			So(code, ShouldEqual, 2)
+			So(stdout, ShouldBeEmpty)
+			So(stderr, ShouldNotBeEmpty)
+		}
+
+		for _, args := range [][]string{
+			{"-a", "md5"},
+			{"-a", "bcrypt", "-cost", "3"},
+			{"-a", "bcrypt", "-pepper", "pepper"},
+			{"-e", "hex"},
+			{"-a", "argon2id", "-par", "256"},
+		} {
+			code, stdout, stderr := runPw("", append(args, "-p", "testpw")...)
+			So(code, ShouldEqual, 1)
+			So(stdout, ShouldBeEmpty)
+			So(stderr, ShouldStartWith, "error: ")
+		}
+	})
+
+}
+
+func TestVerify(t *testing.T) {
+
+	Convey("Given a hash, pw should exit with 0 only when the password read from stdin matches", t, func() {
+		for _, hash := range []string{
+			"PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg==",
+			"$2y$04$abcdefghijklmnopqrstuuqoQHewhqEyYMD4RANOA5YF6Tgic9hO6",
+			"$argon2id$v=19$m=64,t=1,p=1$cGVwcGVyc2FsdHBlcHBlcg$wpdtvi1WWybsU3cmB0J/7SN7DHZY+Vp8qBOjRC/Tfr8",
+		} {
+			password := "pepperedpw\n"
+			if strings.HasPrefix(hash, "PBKDF2") {
+				password = "test1\n"
+			}
+
+			code, stdout, stderr := runPw(password, "-verify", hash)
+			So(code, ShouldEqual, 0)
+			So(stdout, ShouldBeEmpty)
+			So(stderr, ShouldBeEmpty)
+
+			code, _, stderr = runPw("wrong\n", "-verify", hash)
+			So(code, ShouldEqual, 1)
+			So(stderr, ShouldContainSubstring, "doesn't match")
+		}
+	})
+
+	Convey("Given salt encoding and pepper flags, pw should verify with them", t, func() {
+		code, _, _ := runPw("authplug", "-verify", "PBKDF2$sha256$901$qIk9UVrOC6DF3bg9$/aBf1gftpR34xB8O+zIt5PCsEj2BMyXv")
+		So(code, ShouldEqual, 1)
+		code, _, _ = runPw("authplug", "-e", "utf-8", "-verify", "PBKDF2$sha256$901$qIk9UVrOC6DF3bg9$/aBf1gftpR34xB8O+zIt5PCsEj2BMyXv")
+		So(code, ShouldEqual, 0)
+
+		peppered := "$argon2id$v=19$m=64,t=1,p=1$cGVwcGVyc2FsdHBlcHBlcg$wdUQIoedda82w2wZW7Dp8tRSL86mux0RsLyhTZ9+OfU"
+		code, _, _ = runPw("pepperedpw", "-verify", peppered)
+		So(code, ShouldEqual, 1)
+		code, _, _ = runPw("pepperedpw", "-pepper", "s3cr3t-pepper", "-verify", peppered)
+		So(code, ShouldEqual, 0)
+	})
+
+	Convey("Given an unknown hash or no password, pw should exit with 1", t, func() {
+		code, _, stderr := runPw("testpw\n", "-verify", "testpw")
+		So(code, ShouldEqual, 1)
+		So(stderr, ShouldContainSubstring, "unknown hash format")
+
+		code, _, stderr = runPw("", "-verify", "$2y$04$abcdefghijklmnopqrstuuqoQHewhqEyYMD4RANOA5YF6Tgic9hO6")
+		So(code, ShouldEqual, 1)
+		So(stderr, ShouldContainSubstring, "no password")
+	})
+
+}
+
+func TestBatch(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pw-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Given a batch file, pw should print username:hash lines the files backend takes", t, func() {
+		batch := filepath.Join(dir, "users")
+		So(ioutil.WriteFile(batch, []byte("#Provisioned devices.\ndev1:first:pass\r\n\n  \ndev2:second\n"), 0600), ShouldBeNil)
+
+		for _, args := range [][]string{
+			{"-i", "1000"},
+			{"-a", "argon2id", "-m", "64", "-t", "1", "-par", "1"},
+		} {
+			code, stdout, stderr := runPw("", append(args, "-batch", batch)...)
+			So(code, ShouldEqual, 0)
+			So(stderr, ShouldBeEmpty)
+
+			lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+			So(lines, ShouldHaveLength, 2)
+			So(lines[0], ShouldStartWith, "dev1:")
+			So(lines[1], ShouldStartWith, "dev2:")
+
+			passwords := filepath.Join(dir, "passwords")
+			So(ioutil.WriteFile(passwords, []byte(stdout), 0600), ShouldBeNil)
+
+			files, err := backends.NewFiles(map[string]string{"password_path": passwords}, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(files.GetUser("dev1", "first:pass"), ShouldBeTrue)
+			So(files.GetUser("dev2", "second"), ShouldBeTrue)
+			So(files.GetUser("dev2", "first:pass"), ShouldBeFalse)
+			files.Halt()
+		}
+
+		code, stdout, _ := runPw("dev3:third\n", "-a", "bcrypt", "-cost", "4", "-batch", "-")
+		So(code, ShouldEqual, 0)
+		So(stdout, ShouldStartWith, "dev3:$2a$04$")
+		So(common.HashCompare("third", strings.TrimSuffix(strings.TrimPrefix(stdout, "dev3:"), "\n")), ShouldBeTrue)
+	})
+
+	Convey("Given wrong lines, pw should name every one of them and print nothing", t, func() {
+		input := "dev1:first\nnocolon\n:nouser\ndev2:\ndev1:again\ndev3:" + strings.Repeat("x", 73) + "\n"
+
+		code, stdout, stderr := runPw(input, "-a", "bcrypt", "-cost", "4", "-batch", "-")
+		So(code, ShouldEqual, 1)
+		So(stdout, ShouldBeEmpty)
+		So(stderr, ShouldContainSubstring, "line 2: it must be username:password")
+		So(stderr, ShouldContainSubstring, "line 3: empty username")
+		So(stderr, ShouldContainSubstring, "line 4: empty password for user dev2")
+		So(stderr, ShouldContainSubstring, "line 5: user dev1 was already given at line 1")
+		So(stderr, ShouldNotContainSubstring, "first")
+
+		code, stdout, stderr = runPw("dev1:first\ndev3:"+strings.Repeat("x", 73)+"\n", "-a", "bcrypt", "-cost", "4", "-batch", "-")
+		So(code, ShouldEqual, 1)
+		So(stdout, ShouldBeEmpty)
+		So(stderr, ShouldContainSubstring, "line 2: bcrypt passwords must be at most 72 bytes")
+
+		code, _, stderr = runPw("", "-batch", filepath.Join(dir, "missing"))
+		So(code, ShouldEqual, 1)
+		So(stderr, ShouldContainSubstring, "couldn't open batch file")
+	})
+
+}